@@ -0,0 +1,104 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/lesismal/arpc"
+)
+
+// RouteStats defines json of a route in "/routes"
+type RouteStats struct {
+	Method     string  `json:"method"`
+	Calls      uint64  `json:"calls"`
+	Errors     uint64  `json:"errors"`
+	BytesIn    uint64  `json:"bytes_in"`
+	BytesOut   uint64  `json:"bytes_out"`
+	Deprecated uint64  `json:"deprecated"`
+	P50Seconds float64 `json:"p50_seconds"`
+	P95Seconds float64 `json:"p95_seconds"`
+	P99Seconds float64 `json:"p99_seconds"`
+}
+
+// FlightRecord defines json of a connection in "/flight"
+type FlightRecord struct {
+	Addr   string             `json:"addr"`
+	Events []arpc.FlightEvent `json:"events"`
+}
+
+// Admin serves admin endpoints of a handler over http:
+//
+// - "/routes": route stats sorted by method, see arpc.Handler.SetRouteStats
+//
+// - "/flight": flight records of connections sorted by address, see HandleFlight
+type Admin struct {
+	handler arpc.Handler
+	mux     *http.ServeMux
+}
+
+// Handle registers endpoint of other subsystems
+func (a *Admin) Handle(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, h)
+}
+
+// ServeHTTP implements http.Handler
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) routes(w http.ResponseWriter, r *http.Request) {
+	stats := a.handler.RouteStats()
+	routes := make([]RouteStats, 0, len(stats))
+	for method, st := range stats {
+		routes = append(routes, RouteStats{
+			Method:     method,
+			Calls:      st.Calls,
+			Errors:     st.Errors,
+			BytesIn:    st.BytesIn,
+			BytesOut:   st.BytesOut,
+			Deprecated: st.Deprecated,
+			P50Seconds: st.P50.Seconds(),
+			P95Seconds: st.P95.Seconds(),
+			P99Seconds: st.P99.Seconds(),
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Method < routes[j].Method })
+	writeJSON(w, routes)
+}
+
+// HandleFlight serves flight records of connections of s on "/flight", "?addr=" selects the
+// connection of the remote address, see arpc.Handler.SetFlightRecorder
+func (a *Admin) HandleFlight(s *arpc.Server) {
+	a.mux.HandleFunc("/flight", func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Query().Get("addr")
+		records := []FlightRecord{}
+		for _, c := range s.Clients() {
+			ra := c.Conn.RemoteAddr().String()
+			if addr != "" && ra != addr {
+				continue
+			}
+			records = append(records, FlightRecord{Addr: ra, Events: c.FlightRecord()})
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].Addr < records[j].Addr })
+		writeJSON(w, records)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// New returns Admin of h, mount it under a prefix with http.StripPrefix if needed
+func New(h arpc.Handler) *Admin {
+	a := &Admin{handler: h, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/routes", a.routes)
+	return a
+}
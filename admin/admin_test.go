@@ -0,0 +1,78 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestAdmin_Routes(t *testing.T) {
+	h := arpc.NewHandler()
+	h.Handle("/b", func(*arpc.Context) {})
+	h.Handle("/a", func(*arpc.Context) {})
+	ts := httptest.NewServer(New(h))
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/routes")
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer rsp.Body.Close()
+	var routes []RouteStats
+	if err = json.NewDecoder(rsp.Body).Decode(&routes); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(routes) != 2 || routes[0].Method != "/a" || routes[1].Method != "/b" {
+		t.Fatalf("/routes = %+v", routes)
+	}
+}
+
+func TestAdmin_HandleFlight(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.SetFlightRecorder(8, 1)
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) { ctx.Write(ctx.Body()) })
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if err := c.Call("/echo", "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+
+	a := New(svr.Handler)
+	a.HandleFlight(svr)
+	ts := httptest.NewServer(a)
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/flight?addr=" + c.Conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer rsp.Body.Close()
+	var records []FlightRecord
+	if err = json.NewDecoder(rsp.Body).Decode(&records); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(records) != 1 || len(records[0].Events) == 0 || records[0].Events[0].Method != "/echo" {
+		t.Fatalf("/flight = %+v", records)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "github.com/lesismal/arpc/util"
+
+// AfterHandleFunc post-processes body of the response of ctx before sent, e.g. signing it,
+// appending timing metadata by ctx.SetResponseMeta or limiting its size. rsp is a copy owned by
+// the hook, which returns the body to send, or an error to respond instead
+type AfterHandleFunc func(ctx *Context, rsp []byte) ([]byte, error)
+
+func (h *handler) AfterHandle(cb AfterHandleFunc) {
+	if cb == nil {
+		return
+	}
+	h.update(func(s *handlerState) {
+		hooks := make([]AfterHandleFunc, len(s.afterHandles)+1)
+		copy(hooks, s.afterHandles)
+		hooks[len(s.afterHandles)] = cb
+		s.afterHandles = hooks
+	})
+}
+
+func (h *handler) AfterHandles() []AfterHandleFunc {
+	return h.load().afterHandles
+}
+
+// afterHandle runs the AfterHandle hooks on response v of ctx, it returns the body to send and
+// whether it is an error. An error returned by a hook is responded, following hooks are skipped
+func (ctx *Context) afterHandle(hooks []AfterHandleFunc, v interface{}, isError bool) (interface{}, bool) {
+	cli := ctx.Client
+	rsp := append([]byte(nil), util.ValueToBytes(cli.Codec, v)...)
+	for _, hook := range hooks {
+		var err error
+		if rsp, err = hook(ctx, rsp); err != nil {
+			ctx.err = err
+			if ec := cli.Handler.ErrorCodec(); ec != nil && !ctx.isEnvelope() {
+				return ec.Encode(err), true
+			}
+			return err, true
+		}
+	}
+	return rsp, isError
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestHandler_AfterHandle(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/fail", func(ctx *Context) {
+		ctx.Error("failed")
+	})
+	svr.Handler.AfterHandle(func(ctx *Context, rsp []byte) ([]byte, error) {
+		if len(rsp) > 8 {
+			return nil, errors.New("response too large")
+		}
+		return rsp, nil
+	})
+	svr.Handler.AfterHandle(func(ctx *Context, rsp []byte) ([]byte, error) {
+		ctx.SetResponseMeta("sig", string(rsp))
+		if ctx.ResponseError() != nil {
+			return rsp, nil
+		}
+		return append(rsp, '!'), nil
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+
+	done := make(chan struct{})
+	err = c.CallAsync("/echo", "hello", func(ctx *Context) {
+		defer close(done)
+		if body := string(ctx.Body()); body != "hello!" {
+			t.Errorf("response = %q, want %q", body, "hello!")
+		}
+		if sig, _ := ctx.Meta().Get("sig"); sig != "hello" {
+			t.Errorf("response meta sig = %q, want %q", sig, "hello")
+		}
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() failed: %v", err)
+	}
+	<-done
+
+	rsp := ""
+	if err = c.Call("/echo", "too large body", &rsp, time.Second); err == nil || err.Error() != "response too large" {
+		t.Fatalf("Client.Call() for large response = %v, want response too large", err)
+	}
+	if err = c.Call("/fail", "", &rsp, time.Second); err == nil || err.Error() != "failed" {
+		t.Fatalf("Client.Call() for error response = %v, want failed", err)
+	}
+}
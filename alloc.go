@@ -0,0 +1,43 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "sync/atomic"
+
+// allocPath counts allocations of a sampled call path
+type allocPath struct {
+	n       uint64
+	samples uint64
+	mallocs uint64
+	bytes   uint64
+}
+
+var allocSampler struct {
+	rate     uint64
+	recv     allocPath
+	dispatch allocPath
+	send     allocPath
+}
+
+// SetAllocSampleRate samples allocations of one in rate calls of each path, 0 disables sampling.
+// Sampling reads runtime.MemStats which stops the world, and allocations of other goroutines during
+// the sampled call are also counted, it's for performance tuning and regression checks under a
+// steady load rather than exact accounting. It does nothing if built with arpc_nometrics
+func SetAllocSampleRate(rate uint64) {
+	atomic.StoreUint64(&allocSampler.rate, rate)
+}
+
+// AllocSampleRate returns sample rate of allocations, 0 if disabled
+func AllocSampleRate() uint64 {
+	return atomic.LoadUint64(&allocSampler.rate)
+}
+
+func (p *allocPath) stats() AllocStats {
+	return AllocStats{
+		Samples: atomic.LoadUint64(&p.samples),
+		Mallocs: atomic.LoadUint64(&p.mallocs),
+		Bytes:   atomic.LoadUint64(&p.bytes),
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build arpc_nometrics
+// +build arpc_nometrics
+
+package arpc
+
+import "runtime"
+
+// metricsEnabled is false if metrics are compiled out by arpc_nometrics
+const metricsEnabled = false
+
+func (p *allocPath) begin() *runtime.MemStats { return nil }
+
+func (p *allocPath) end(before *runtime.MemStats) {}
@@ -0,0 +1,38 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nometrics
+// +build !arpc_nometrics
+
+package arpc
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// metricsEnabled is false if metrics are compiled out by arpc_nometrics
+const metricsEnabled = true
+
+// begin returns memory stats before the call if it's sampled, nil otherwise
+func (p *allocPath) begin() *runtime.MemStats {
+	rate := atomic.LoadUint64(&allocSampler.rate)
+	if rate == 0 || atomic.AddUint64(&p.n, 1)%rate != 0 {
+		return nil
+	}
+	before := &runtime.MemStats{}
+	runtime.ReadMemStats(before)
+	return before
+}
+
+func (p *allocPath) end(before *runtime.MemStats) {
+	if before == nil {
+		return
+	}
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	atomic.AddUint64(&p.samples, 1)
+	atomic.AddUint64(&p.mallocs, after.Mallocs-before.Mallocs)
+	atomic.AddUint64(&p.bytes, after.TotalAlloc-before.TotalAlloc)
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nometrics
+// +build !arpc_nometrics
+
+package arpc
+
+import "testing"
+
+var allocSink []byte
+
+func TestAllocSampler(t *testing.T) {
+	p := &allocPath{}
+	if ms := p.begin(); ms != nil {
+		t.Fatalf("allocPath.begin() sampled with sampling disabled")
+	}
+
+	SetAllocSampleRate(2)
+	defer SetAllocSampleRate(0)
+	for i := 0; i < 4; i++ {
+		ms := p.begin()
+		allocSink = make([]byte, 1<<20)
+		p.end(ms)
+	}
+	st := p.stats()
+	if st.Samples != 2 {
+		t.Fatalf("allocPath samples = %v, want 2", st.Samples)
+	}
+	if _, bytes := st.PerSample(); bytes < 1<<20 {
+		t.Fatalf("allocPath bytes per sample = %v, want >= %v", bytes, 1<<20)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+// Allocator allocates buffers of frames received, e.g. from mmap'd or other memory off the Go heap,
+// to reduce GC of high throughput servers. Buffers are freed by arpc after messages are dispatched:
+//
+//   - requests and notifies after handlers of the route return, or after Context.Release if the
+//     handler called Context.Retain, e.g. to respond in another goroutine
+//   - responses of Call after decoded into rsp, bodies decoded into *[]byte are copied
+//   - responses of CallAsync after the handler returns, or after Context.Release if retained
+//   - notifies of HandleNotify are owned by the NotifyFunc, which should call Message.Release
+//
+// so bodies, e.g. Context.Body, must not be referenced after freed, handlers keeping them should
+// copy. Buffers of messages sent are still got from Handler.GetBuffer.
+type Allocator interface {
+	// Malloc returns a buffer of size
+	Malloc(size int) []byte
+	// Free frees a buffer returned by Malloc
+	Free(buf []byte)
+}
+
+func (h *handler) Allocator() Allocator {
+	return h.load().allocator
+}
+
+func (h *handler) SetAllocator(a Allocator) {
+	h.update(func(s *handlerState) { s.allocator = a })
+}
+
+// recvMessage returns message of a frame received of size, its buffer is from the allocator of h
+// if it's set, otherwise from GetBuffer
+func recvMessage(h Handler, size int) *Message {
+	if a := h.Allocator(); a != nil {
+		buf := a.Malloc(size)
+		return &Message{Buffer: buf, alloc: a, allocBuf: buf}
+	}
+	return &Message{Buffer: h.GetBuffer(size)}
+}
+
+// Release frees buffer of a message received into a buffer of Handler.Allocator, the message must
+// not be used after. It does nothing for other messages
+func (m *Message) Release() {
+	if m == nil || m.alloc == nil {
+		return
+	}
+	a, buf := m.alloc, m.allocBuf
+	m.alloc, m.allocBuf, m.Buffer = nil, nil, nil
+	a.Free(buf)
+}
+
+// release frees m after dispatched unless it's retained
+func (m *Message) release() {
+	if !m.retained {
+		m.Release()
+	}
+}
+
+// inheritAlloc makes m own the allocated buffer of raw, for messages replaced by coders
+func (m *Message) inheritAlloc(raw *Message) {
+	if m != raw && m.alloc == nil && raw.alloc != nil {
+		m.alloc, m.allocBuf = raw.alloc, raw.allocBuf
+		raw.alloc, raw.allocBuf = nil, nil
+	}
+}
+
+// Retain keeps the message of ctx from being freed after the handler returns if it's received
+// into a buffer of Handler.Allocator, Release should be called after done with it
+func (ctx *Context) Retain() {
+	ctx.retained = true
+	// messages of async routes are retained before dispatched to another goroutine, writing the
+	// flag again would race with the reading loop checking it
+	if !ctx.Message.retained {
+		ctx.Message.retained = true
+	}
+}
+
+// Release frees the message of ctx retained, see Retain
+func (ctx *Context) Release() {
+	ctx.releaseValues()
+	ctx.Message.Release()
+}
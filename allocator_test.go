@@ -0,0 +1,110 @@
+package arpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAllocator struct {
+	mux   sync.Mutex
+	bufs  map[*byte]int
+	total int
+}
+
+func (a *testAllocator) Malloc(size int) []byte {
+	buf := make([]byte, size, size+1)
+	a.mux.Lock()
+	a.bufs[&buf[:1][0]]++
+	a.total++
+	a.mux.Unlock()
+	return buf
+}
+
+func (a *testAllocator) Free(buf []byte) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	p := &buf[:1][0]
+	if a.bufs[p] != 1 {
+		panic("free of a buffer not allocated or freed already")
+	}
+	delete(a.bufs, p)
+}
+
+func (a *testAllocator) stats() (int, int) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return len(a.bufs), a.total
+}
+
+func TestHandler_SetAllocator(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svrAlloc := &testAllocator{bufs: map[*byte]int{}}
+	svr := NewServer()
+	svr.Handler.SetAllocator(svrAlloc)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/later", func(ctx *Context) {
+		ctx.Retain()
+		go func() {
+			defer ctx.Release()
+			ctx.Write(ctx.Body())
+		}()
+	}, true)
+	chNotified := make(chan string, 1)
+	svr.Handler.HandleNotify("/fast", func(c *Client, msg *Message) {
+		chNotified <- string(msg.Data())
+		msg.Release()
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	cliAlloc := &testAllocator{bufs: map[*byte]int{}}
+	h := DefaultHandler.Clone()
+	h.SetAllocator(cliAlloc)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	for i := 0; i < 10; i++ {
+		rsp := []byte{}
+		if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil || string(rsp) != "hello" {
+			t.Fatalf("Client.Call() = (%s, %v), want hello", rsp, err)
+		}
+		str := ""
+		if err := c.Call("/later", "later", &str, time.Second); err != nil || str != "later" {
+			t.Fatalf("Client.Call() = (%v, %v), want later", str, err)
+		}
+	}
+	if err := c.Notify("/fast", "fast", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	if s := <-chNotified; s != "fast" {
+		t.Fatalf("notified = %v, want fast", s)
+	}
+
+	chAsync := make(chan string, 1)
+	c.CallAsync("/echo", "async", func(ctx *Context) {
+		chAsync <- string(ctx.Body())
+	}, time.Second)
+	if s := <-chAsync; s != "async" {
+		t.Fatalf("CallAsync response = %v, want async", s)
+	}
+
+	// the response of the last call is freed after the call returns
+	time.Sleep(time.Millisecond * 20)
+	for name, a := range map[string]*testAllocator{"server": svrAlloc, "client": cliAlloc} {
+		if n, total := a.stats(); n != 0 || total < 21 {
+			t.Fatalf("%v allocator: %v not freed of %v, want 0 of at least 21", name, n, total)
+		}
+	}
+}
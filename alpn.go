@@ -0,0 +1,180 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+// ALPNProtocol is the ALPN protocol id of arpc, see SplitALPN
+const ALPNProtocol = "arpc"
+
+// ALPNHandshakeTimeout is the timeout of TLS handshakes of SplitALPN
+var ALPNHandshakeTimeout = time.Second * 10
+
+// alpnMux accepts TLS connections and dispatches them by the protocol negotiated
+type alpnMux struct {
+	ln     net.Listener
+	config *tls.Config
+	arpc   *alpnListener
+	other  *alpnListener
+
+	mux    sync.Mutex
+	closed int
+	done   chan util.Empty
+	err    error
+}
+
+// alpnListener is the listener of connections of a protocol
+type alpnListener struct {
+	m      *alpnMux
+	ch     chan net.Conn
+	once   sync.Once
+	closed chan util.Empty
+}
+
+// SplitALPN serves TLS on ln with config, and splits connections by ALPN: those negotiated
+// ALPNProtocol are accepted by arpcLn, others, e.g. "h2", "http/1.1" or without ALPN, by otherLn,
+// so arpc and an http.Server share one port. ALPNProtocol is added to config.NextProtos in front
+// of "h2" and "http/1.1" if missing. ln is closed after both listeners are closed
+func SplitALPN(ln net.Listener, config *tls.Config) (arpcLn net.Listener, otherLn net.Listener) {
+	config = config.Clone()
+	if !hasProto(config.NextProtos, ALPNProtocol) {
+		protos := []string{ALPNProtocol}
+		if len(config.NextProtos) == 0 {
+			protos = append(protos, "h2", "http/1.1")
+		}
+		config.NextProtos = append(protos, config.NextProtos...)
+	}
+	m := &alpnMux{ln: ln, config: config, done: make(chan util.Empty)}
+	m.arpc = &alpnListener{m: m, ch: make(chan net.Conn), closed: make(chan util.Empty)}
+	m.other = &alpnListener{m: m, ch: make(chan net.Conn), closed: make(chan util.Empty)}
+	go util.Safe(m.acceptLoop)
+	return m.arpc, m.other
+}
+
+// ServeTLS serves arpc and hs on ln with TLS of config, connections are dispatched by ALPN, see
+// SplitALPN. hs serves HTTP/2 if its TLSConfig is nil or has "h2" in NextProtos. It returns when
+// the arpc server is stopped, hs is not closed
+func (s *Server) ServeTLS(ln net.Listener, config *tls.Config, hs *http.Server) error {
+	arpcLn, otherLn := SplitALPN(ln, config)
+	go util.Safe(func() {
+		if err := hs.Serve(otherLn); err != nil && err != http.ErrServerClosed {
+			log.Warn("%v http server stopped: %v", s.Handler.LogTag(), err)
+		}
+	})
+	return s.Serve(arpcLn)
+}
+
+// DialTLS dials addr with TLS negotiating ALPNProtocol, e.g. of servers of ServeTLS
+func DialTLS(addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.NextProtos = []string{ALPNProtocol}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != ALPNProtocol {
+		conn.Close()
+		return nil, ErrALPNNotNegotiated
+	}
+	return conn, nil
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *alpnMux) acceptLoop() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				sleep(SystemClock, time.Second/20, m.done)
+				continue
+			}
+			m.mux.Lock()
+			if m.err == nil {
+				m.err = err
+				close(m.done)
+			}
+			m.mux.Unlock()
+			return
+		}
+		go util.Safe(func() { m.dispatch(conn) })
+	}
+}
+
+// dispatch handshakes conn and hands it to the listener of the protocol negotiated
+func (m *alpnMux) dispatch(conn net.Conn) {
+	tc := tls.Server(conn, m.config)
+	tc.SetDeadline(time.Now().Add(ALPNHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		log.Debug("ALPN\t%v\ttls handshake failed: %v", conn.RemoteAddr(), err)
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+	l := m.other
+	if tc.ConnectionState().NegotiatedProtocol == ALPNProtocol {
+		l = m.arpc
+	}
+	select {
+	case l.ch <- tc:
+	case <-l.closed:
+		tc.Close()
+	case <-m.done:
+		tc.Close()
+	}
+}
+
+// Accept implements net.Listener
+func (l *alpnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.m.done:
+		return nil, l.m.err
+	}
+}
+
+// Close implements net.Listener, the underlying listener is closed after both are closed
+func (l *alpnListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		m := l.m
+		m.mux.Lock()
+		m.closed++
+		last := m.closed == 2
+		m.mux.Unlock()
+		if last {
+			err = m.ln.Close()
+		}
+	})
+	return err
+}
+
+// Addr implements net.Listener
+func (l *alpnListener) Addr() net.Addr {
+	return l.m.ln.Addr()
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func newTestCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServer_ServeTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	config := &tls.Config{Certificates: []tls.Certificate{newTestCert(t)}}
+
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	defer hs.Close()
+	go svr.ServeTLS(ln, config, hs)
+	defer svr.Stop()
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	conn, err := DialTLS(addr, clientConfig, time.Second)
+	if err != nil {
+		t.Fatalf("DialTLS() failed: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%q, %v)", rsp, err)
+	}
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		hc := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}},
+			ForceAttemptHTTP2: proto == "h2",
+		}}
+		res, err := hc.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatalf("%v: http get failed: %v", proto, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		want := "HTTP/1.1"
+		if proto == "h2" {
+			want = "HTTP/2.0"
+		}
+		if string(body) != want {
+			t.Fatalf("%v: http response = %q, want %q", proto, body, want)
+		}
+		hc.CloseIdleConnections()
+	}
+
+	// servers without ALPN are not arpc
+	hsLn, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go http.Serve(tls.NewListener(hsLn, config), nil)
+	defer hsLn.Close()
+	if _, err = DialTLS(hsLn.Addr().String(), clientConfig, time.Second); err != ErrALPNNotNegotiated {
+		t.Fatalf("DialTLS() to http server = %v, want %v", err, ErrALPNNotNegotiated)
+	}
+}
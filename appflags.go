@@ -0,0 +1,139 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"time"
+)
+
+// Application flags are the high 4 bits of the header flags, arpc never sets or reads them, so
+// applications could mark messages without metadata, e.g. compressed or encrypted by themselves.
+// They're not carried by tiny frames, sending messages with them fails with ErrTinyFrameAppFlags.
+//
+// They're apart from the flag bits of Message.SetFlagBit, which are the reserved byte and belong
+// to coders, e.g. GZipFlagBit of package coder is bit 0: coders set their bits when encoding and
+// clear them when decoding, so handlers never see them, and a bit marked by an application would
+// be taken by the coder of the same bit. Application flags are never touched by coders, they reach
+// handlers as sent, and coders could be added without renumbering flags of applications
+const (
+	// AppFlag0 is the first application flag
+	AppFlag0 byte = 1 << iota
+	// AppFlag1 is the second application flag
+	AppFlag1
+	// AppFlag2 is the third application flag
+	AppFlag2
+	// AppFlag3 is the fourth application flag
+	AppFlag3
+
+	// AppFlagsMask masks all application flags
+	AppFlagsMask byte = 0x0F
+)
+
+// AppFlags returns application flags, AppFlag0-AppFlag3
+func (m *Message) AppFlags() byte {
+	return (m.Buffer[HeaderIndexFlag] & HeaderFlagMaskApp) >> 4
+}
+
+// SetAppFlags sets application flags, bits other than AppFlagsMask are ignored
+func (m *Message) SetAppFlags(flags byte) {
+	m.Buffer[HeaderIndexFlag] = m.Buffer[HeaderIndexFlag]&^HeaderFlagMaskApp | (flags&AppFlagsMask)<<4
+}
+
+// Flags returns application flags of the message
+func (ctx *Context) Flags() byte {
+	return ctx.Message.AppFlags()
+}
+
+// SetResponseFlags sets application flags of the response, the response fails to be sent with
+// ErrTinyFrameAppFlags on connections of tiny frames
+func (ctx *Context) SetResponseFlags(flags byte) {
+	ctx.rspFlags = flags & AppFlagsMask
+}
+
+// CallOption sets options of a request or notify message before it's sent, the call fails with the
+// error returned, see Client.CallWithOptions
+type CallOption func(msg *Message) error
+
+// WithAppFlags sets application flags of the message, calls fail with ErrTinyFrameAppFlags on
+// connections of tiny frames
+func WithAppFlags(flags byte) CallOption {
+	return func(msg *Message) error {
+		msg.SetAppFlags(flags)
+		return nil
+	}
+}
+
+// WithMeta sets metadata of the message, calls fail with ErrMetaTooLarge if it's more than
+// MaxMetaLen encoded
+func WithMeta(md Metadata) CallOption {
+	return func(msg *Message) error {
+		return msg.SetMeta(md)
+	}
+}
+
+// CallWithOptions make rpc call with timeout and options of the request
+func (c *Client) CallWithOptions(method string, req interface{}, rsp interface{}, timeout time.Duration, opts ...CallOption) (err error) {
+	defer c.statCall(&err)
+
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return err
+	}
+
+	msg := c.newRequestMessage(CmdRequest, method, req, false, false)
+	for _, opt := range opts {
+		if err := opt(msg); err != nil {
+			return err
+		}
+	}
+	if err := c.encodeContentType(msg, req); err != nil {
+		return err
+	}
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	msg, err = c.call(msg, timeout)
+	if err != nil {
+		return err
+	}
+	return c.parseResponse(msg, rsp)
+}
+
+// NotifyWithOptions make rpc notify with context and options of the notify
+func (c *Client) NotifyWithOptions(ctx context.Context, method string, data interface{}, opts ...CallOption) error {
+	if err := c.checkStateAndMethod(method); err != nil {
+		return err
+	}
+
+	msg := c.newRequestMessage(CmdNotify, method, data, false, true)
+	for _, opt := range opts {
+		if err := opt(msg); err != nil {
+			return err
+		}
+	}
+	if err := c.encodeContentType(msg, data); err != nil {
+		return err
+	}
+	if err := c.setOutgoingMetaFrom(ctx, msg); err != nil {
+		return err
+	}
+
+	if err := c.prepareSend(msg, true, nil, ctx.Done()); err != nil {
+		return err
+	}
+
+	select {
+	case c.chSend <- msg:
+	case <-ctx.Done():
+		c.cancelSend(msg)
+		c.Handler.OnOverstock(c, msg)
+		return ErrClientTimeout
+	case <-c.chClose:
+		c.cancelSend(msg)
+		c.Handler.OnOverstock(c, msg)
+		return ErrClientStopped
+	}
+	return nil
+}
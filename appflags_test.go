@@ -0,0 +1,132 @@
+package arpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage_AppFlags(t *testing.T) {
+	msg := newMessage(CmdRequest, "/flags", "hello", true, true, 1, nil, nil, nil)
+	msg.SetAppFlags(AppFlag0 | AppFlag3 | 0xF0)
+	if flags := msg.AppFlags(); flags != AppFlag0|AppFlag3 {
+		t.Fatalf("Message.AppFlags() = %v, want %v", flags, AppFlag0|AppFlag3)
+	}
+	if !msg.IsError() || !msg.IsAsync() {
+		t.Fatalf("flags of arpc are changed by Message.SetAppFlags()")
+	}
+	msg.SetAppFlags(0)
+	if flags := msg.AppFlags(); flags != 0 {
+		t.Fatalf("Message.AppFlags() = %v, want 0", flags)
+	}
+
+	// flag bits of coders and application flags don't share bits
+	for i := 0; i < 8; i++ {
+		msg.SetFlagBit(i, true)
+	}
+	if flags := msg.AppFlags(); flags != 0 {
+		t.Fatalf("Message.AppFlags() = %v after flag bits set, want 0", flags)
+	}
+	msg.SetAppFlags(AppFlagsMask)
+	msg.SetAppFlags(0)
+	for i := 0; i < 8; i++ {
+		if !msg.IsFlagBitSet(i) {
+			t.Fatalf("Message.IsFlagBitSet(%v) = false after application flags cleared, want true", i)
+		}
+	}
+}
+
+func TestClient_CallWithOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	notified := make(chan byte, 1)
+	svr.Handler.Handle("/flags", func(ctx *Context) {
+		ctx.SetResponseFlags(ctx.Flags() | AppFlag3)
+		ctx.Write(ctx.Meta()["k"])
+	})
+	svr.Handler.Handle("/notify", func(ctx *Context) {
+		notified <- ctx.Flags()
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err := c.CallWithOptions("/flags", "", &rsp, time.Second, WithAppFlags(AppFlag1), WithMeta(Metadata{"k": "v"})); err != nil || rsp != "v" {
+		t.Fatalf("Client.CallWithOptions() = (%v, %v), want v", rsp, err)
+	}
+
+	rspFlags := make(chan byte, 1)
+	err = c.CallAsync("/flags", "", func(ctx *Context) { rspFlags <- ctx.Flags() }, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	if flags := <-rspFlags; flags != AppFlag3 {
+		t.Fatalf("response flags = %v, want %v", flags, AppFlag3)
+	}
+
+	if err := c.NotifyWithOptions(context.Background(), "/notify", "", WithAppFlags(AppFlag2)); err != nil {
+		t.Fatalf("Client.NotifyWithOptions() error = %v", err)
+	}
+	if flags := <-notified; flags != AppFlag2 {
+		t.Fatalf("notify flags = %v, want %v", flags, AppFlag2)
+	}
+
+	// metadata is not dropped silently, the call fails
+	large := WithMeta(Metadata{"k": strings.Repeat("v", MaxMetaLen-3)})
+	if err := c.CallWithOptions("/flags", "", &rsp, time.Second, large); err != ErrMetaTooLarge {
+		t.Fatalf("Client.CallWithOptions() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+	if err := c.NotifyWithOptions(context.Background(), "/notify", "", large); err != ErrMetaTooLarge {
+		t.Fatalf("Client.NotifyWithOptions() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+}
+
+func TestClient_CallWithOptionsTinyFrame(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	table, _ := NewMethodTable("/flags")
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetTinyFrame(table)
+	svr.Handler.Handle("/flags", func(ctx *Context) {
+		ctx.Write(nil)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	h := NewHandler()
+	h.SetTinyFrame(table)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	// tiny frames don't carry application flags, the call fails instead of losing them
+	if err := c.CallWithOptions("/flags", "", nil, time.Second, WithAppFlags(AppFlag1)); err != ErrTinyFrameAppFlags {
+		t.Fatalf("Client.CallWithOptions() error = %v, want %v", err, ErrTinyFrameAppFlags)
+	}
+	if err := c.NotifyWithOptions(context.Background(), "/flags", "", WithAppFlags(AppFlag2)); err != ErrTinyFrameAppFlags {
+		t.Fatalf("Client.NotifyWithOptions() error = %v, want %v", err, ErrTinyFrameAppFlags)
+	}
+	if err := c.CallWithOptions("/flags", "", nil, time.Second); err != nil {
+		t.Fatalf("Client.CallWithOptions() without flags error = %v", err)
+	}
+}
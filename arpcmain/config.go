@@ -0,0 +1,103 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpcmain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// DefaultAddr is the rpc address if the config doesn't set
+	DefaultAddr = ":8888"
+
+	// DefaultShutdownTimeout is the timeout of graceful shutdown if the config doesn't set
+	DefaultShutdownTimeout = time.Second * 10
+)
+
+// Duration is time.Duration decoded from strings like "10s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config of Main, loaded from a JSON file, e.g.
+//
+//	{
+//		"addr": ":8888",
+//		"admin_addr": "localhost:6060",
+//		"log_level": "info",
+//		"metrics_url": "http://localhost:9091/metrics/job/echo",
+//		"app": {"greeting": "hello"}
+//	}
+type Config struct {
+	// Addr is the address of the rpc server, DefaultAddr by default
+	Addr string `json:"addr"`
+	// AdminAddr is the address of admin endpoints over http, disabled if empty
+	AdminAddr string `json:"admin_addr"`
+	// LogLevel is one of "debug", "info", "warn", "error" and "none", "info" by default
+	LogLevel string `json:"log_level"`
+	// MetricsURL is the Pushgateway URL metrics are pushed to, disabled if empty
+	MetricsURL string `json:"metrics_url"`
+	// MetricsInterval is the interval of pushing metrics
+	MetricsInterval Duration `json:"metrics_interval"`
+	// ShutdownTimeout is the timeout of graceful shutdown, DefaultShutdownTimeout by default
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// App is config of the application, see Main.Bind
+	App json.RawMessage `json:"app"`
+}
+
+// LoadConfig loads Config from the JSON file of path, the default Config is returned if path is empty
+func LoadConfig(path string) (*Config, error) {
+	conf := &Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, conf); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+	if conf.Addr == "" {
+		conf.Addr = DefaultAddr
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = Duration(DefaultShutdownTimeout)
+	}
+	if _, ok := logLevels[conf.LogLevel]; !ok {
+		return nil, fmt.Errorf("%w: log_level %q", ErrInvalidConfig, conf.LogLevel)
+	}
+	return conf, nil
+}
+
+var logLevels = map[string]int{
+	"":      log.LogLevelInfo,
+	"debug": log.LogLevelDebug,
+	"info":  log.LogLevelInfo,
+	"warn":  log.LogLevelWarn,
+	"error": log.LogLevelError,
+	"none":  log.LogLevelNone,
+}
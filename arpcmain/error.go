@@ -0,0 +1,15 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpcmain
+
+import "errors"
+
+var (
+	// ErrInvalidConfig .
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrNoAppConfig .
+	ErrNoAppConfig = errors.New("no app config")
+)
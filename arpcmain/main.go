@@ -0,0 +1,196 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package arpcmain wires config, logging, metrics, admin, signal based graceful shutdown and hot
+// reload of a service, e.g.
+//
+//	func main() {
+//		m := arpcmain.New("echo")
+//		flag.StringVar(&m.ConfigPath, "config", "", "config file")
+//		flag.Parse()
+//		m.Setup = func(m *arpcmain.Main) error {
+//			m.Server.Handler.Handle("/echo", func(ctx *arpc.Context) {
+//				ctx.Write(ctx.Body())
+//			})
+//			return nil
+//		}
+//		if err := m.Run(); err != nil {
+//			log.Error("%v", err)
+//			os.Exit(1)
+//		}
+//	}
+//
+// SIGINT and SIGTERM shut the service down gracefully, SIGHUP reloads the config.
+package arpcmain
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/admin"
+	"github.com/lesismal/arpc/lifecycle"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/metrics"
+)
+
+// Main is the scaffolding of a service
+type Main struct {
+	// Name of the service, it's the "service" label of metrics
+	Name string
+	// ConfigPath is the JSON file of Config, defaults are used if empty, e.g. set by a flag
+	ConfigPath string
+
+	// Server is the rpc server
+	Server *arpc.Server
+	// Lifecycle manages subsystems, Setup could add subsystems of the application to it, they are
+	// started before the rpc server and admin, and stopped after them
+	Lifecycle *lifecycle.Manager
+	// Metrics is the pusher if Config.MetricsURL is set, clients of the application could be added
+	// to it in Setup
+	Metrics *metrics.Pusher
+
+	// Setup is called once after the config is loaded, e.g. to register handlers
+	Setup func(m *Main) error
+	// OnReload is called on SIGHUP with the config reloaded, it's not applied if an error is returned.
+	// The log level is reloaded, addresses and metrics are not, they need a restart
+	OnReload func(m *Main, old, new *Config) error
+
+	config atomic.Value
+}
+
+// New returns Main of name
+func New(name string) *Main {
+	return &Main{
+		Name:      name,
+		Server:    arpc.NewServer(),
+		Lifecycle: lifecycle.New(),
+	}
+}
+
+// Config returns the current config, nil before Run
+func (m *Main) Config() *Config {
+	conf, _ := m.config.Load().(*Config)
+	return conf
+}
+
+// Bind decodes app config of the current config into v
+func (m *Main) Bind(v interface{}) error {
+	conf := m.Config()
+	if conf == nil || len(conf.App) == 0 {
+		return ErrNoAppConfig
+	}
+	return json.Unmarshal(conf.App, v)
+}
+
+// Run runs the service until SIGINT or SIGTERM
+func (m *Main) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext runs the service until SIGINT, SIGTERM or ctx is done, then shuts it down gracefully
+func (m *Main) RunContext(ctx context.Context) error {
+	conf, err := LoadConfig(m.ConfigPath)
+	if err != nil {
+		return err
+	}
+	m.config.Store(conf)
+	log.SetLogLevel(logLevels[conf.LogLevel])
+
+	if m.Setup != nil {
+		if err := m.Setup(m); err != nil {
+			return err
+		}
+	}
+	if err := m.addSubsystems(conf); err != nil {
+		return err
+	}
+	if err := m.Lifecycle.Start(ctx); err != nil {
+		return err
+	}
+	log.Info("[%v] started", m.Name)
+
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(chSignal)
+
+	for running := true; running; {
+		select {
+		case sig := <-chSignal:
+			if sig == syscall.SIGHUP {
+				m.reload()
+				continue
+			}
+			log.Info("[%v] %v received, shutting down", m.Name, sig)
+			running = false
+		case <-ctx.Done():
+			running = false
+		}
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Config().ShutdownTimeout))
+	defer cancel()
+	err = m.Lifecycle.Stop(stopCtx)
+	log.Info("[%v] stopped", m.Name)
+	return err
+}
+
+// addSubsystems adds metrics, which starts first and stops last, and the rpc server and admin,
+// which start last and stop first
+func (m *Main) addSubsystems(conf *Config) error {
+	if conf.MetricsURL != "" {
+		m.Metrics = metrics.NewPusher(&metrics.PushGateway{URL: conf.MetricsURL}, time.Duration(conf.MetricsInterval), map[string]string{"service": m.Name})
+		if err := m.Lifecycle.Add("metrics", lifecycle.Pusher(m.Metrics), lifecycle.WithPriority(1)); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return err
+	}
+	if err := m.Lifecycle.Add("rpc", lifecycle.Server(m.Server, ln), lifecycle.WithPriority(-1)); err != nil {
+		ln.Close()
+		return err
+	}
+
+	if conf.AdminAddr == "" {
+		return nil
+	}
+	aln, err := net.Listen("tcp", conf.AdminAddr)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	a := admin.New(m.Server.Handler)
+	a.HandleFlight(m.Server)
+	srv := &http.Server{Handler: a}
+	return m.Lifecycle.Add("admin", lifecycle.HTTPServer(srv, aln), lifecycle.WithPriority(-1))
+}
+
+// reload loads the config again and applies it, the current config is kept if it fails
+func (m *Main) reload() {
+	old := m.Config()
+	conf, err := LoadConfig(m.ConfigPath)
+	if err != nil {
+		log.Error("[%v] reload config failed: %v", m.Name, err)
+		return
+	}
+	if m.OnReload != nil {
+		if err := m.OnReload(m, old, conf); err != nil {
+			log.Error("[%v] reload config failed: %v", m.Name, err)
+			return
+		}
+	}
+	m.config.Store(conf)
+	log.SetLogLevel(logLevels[conf.LogLevel])
+	log.Info("[%v] config reloaded", m.Name)
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpcmain
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func writeConfig(t *testing.T, path, conf string) {
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+}
+
+func TestMain_Run(t *testing.T) {
+	addr := freeAddr(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"addr": "`+addr+`", "shutdown_timeout": "3s", "app": {"greeting": "hello"}}`)
+
+	type appConfig struct {
+		Greeting string `json:"greeting"`
+	}
+	m := New("echo")
+	m.ConfigPath = path
+	m.Setup = func(m *Main) error {
+		m.Server.Handler.Handle("/greet", func(ctx *arpc.Context) {
+			app := appConfig{}
+			m.Bind(&app)
+			ctx.Write(app.Greeting)
+		})
+		return nil
+	}
+	reloaded := make(chan *Config, 1)
+	m.OnReload = func(m *Main, old, new *Config) error {
+		if new.LogLevel == "none" {
+			return errors.New("refused")
+		}
+		reloaded <- new
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chErr := make(chan error, 1)
+	go func() { chErr <- m.RunContext(ctx) }()
+
+	var c *arpc.Client
+	var err error
+	for i := 0; i < 100; i++ {
+		c, err = arpc.NewClient(func() (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	greet := func() string {
+		rsp := ""
+		if err := c.Call("/greet", "", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		return rsp
+	}
+	if rsp := greet(); rsp != "hello" {
+		t.Fatalf("greet = %v, want hello", rsp)
+	}
+
+	writeConfig(t, path, `{"addr": "`+addr+`", "log_level": "warn", "app": {"greeting": "hi"}}`)
+	m.reload()
+	if conf := <-reloaded; conf.LogLevel != "warn" {
+		t.Fatalf("reloaded log level = %v, want warn", conf.LogLevel)
+	}
+	if rsp := greet(); rsp != "hi" {
+		t.Fatalf("greet after reload = %v, want hi", rsp)
+	}
+
+	// config refused by OnReload is not applied
+	writeConfig(t, path, `{"addr": "`+addr+`", "log_level": "none", "app": {"greeting": "bye"}}`)
+	m.reload()
+	if rsp := greet(); rsp != "hi" {
+		t.Fatalf("greet after refused reload = %v, want hi", rsp)
+	}
+
+	cancel()
+	select {
+	case err := <-chErr:
+		if err != nil {
+			t.Fatalf("Main.RunContext() error = %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Main.RunContext() not returned after ctx done")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if conf.Addr != DefaultAddr || time.Duration(conf.ShutdownTimeout) != DefaultShutdownTimeout {
+		t.Fatalf("LoadConfig() = %+v, want defaults", conf)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"log_level": "verbose"}`)
+	if _, err := LoadConfig(path); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("LoadConfig() error = %v, want %v", err, ErrInvalidConfig)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// BatchAckRoute is the internal route negotiating cumulative acks
+	BatchAckRoute = "_arpc.batchack"
+
+	// ackRoute notifies the client of ranges of seqs acked
+	ackRoute = "_arpc.ack"
+
+	// maxAckBatch limits seqs acked by a notify, pending acks are flushed when reached
+	maxAckBatch = 1024
+
+	batchAckTimeout = time.Second * 5
+)
+
+func (h *handler) BatchAck() time.Duration {
+	return h.load().batchAck
+}
+
+func (h *handler) SetBatchAck(delay time.Duration) {
+	h.update(func(s *handlerState) { s.batchAck = delay })
+}
+
+// negotiateBatchAck asks the server to ack empty responses cumulatively, responses of the
+// server's calls are acked the same way after negotiated
+func (c *Client) negotiateBatchAck() {
+	if err := c.Call(BatchAckRoute, nil, nil, batchAckTimeout); err != nil {
+		log.Warn("%v\t%v\tnegotiate batch ack failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+		return
+	}
+	atomic.StoreUint32(&c.batchAck, 1)
+}
+
+// onBatchAck enables cumulative acks of the connection, the negotiation itself is responded
+func (h *handler) onBatchAck(c *Client, msg *Message) {
+	newContext(c, msg, nil).Write(nil)
+	atomic.StoreUint32(&c.batchAck, 1)
+}
+
+// batchAcked returns whether the response of ctx could be acked cumulatively: an empty success
+// response without metadata or flags, on a connection negotiated
+func (ctx *Context) batchAcked(v interface{}, isError bool) bool {
+	if isError || atomic.LoadUint32(&ctx.Client.batchAck) == 0 || ctx.isEnvelope() ||
+		len(ctx.rspMeta) > 0 || ctx.rspFlags != 0 || ctx.Client.Handler.RequestIDs() ||
+		(ctx.route != nil && ctx.route.Deprecated) {
+		return false
+	}
+	switch vt := v.(type) {
+	case nil:
+		return true
+	case []byte:
+		return len(vt) == 0
+	case string:
+		return len(vt) == 0
+	}
+	return false
+}
+
+// ack adds seq to pending acks, flushed after the delay or when maxAckBatch reached. It's called
+// by handlers, i.e. the read loop, so acks are never sent by the caller
+func (c *Client) ack(seq uint64) {
+	c.ackMux.Lock()
+	c.acks = append(c.acks, seq)
+	if len(c.acks) >= maxAckBatch {
+		acks := c.acks
+		c.acks = nil
+		if c.ackTimer != nil {
+			c.ackTimer.Stop()
+			c.ackTimer = nil
+		}
+		c.ackMux.Unlock()
+		// sending blocks while the send queue is full, the read loop should not wait for it
+		go c.sendAcks(acks)
+		return
+	}
+	if c.ackTimer == nil {
+		t, err := c.AfterFunc(c.Handler.BatchAck(), c.flushAcks)
+		if err != nil {
+			// disconnected, the calls acked fail or are retried by the peer
+			c.acks = nil
+		}
+		c.ackTimer = t
+	}
+	c.ackMux.Unlock()
+}
+
+// flushAcks sends pending acks
+func (c *Client) flushAcks() {
+	c.ackMux.Lock()
+	acks := c.acks
+	c.acks = nil
+	c.ackTimer = nil
+	c.ackMux.Unlock()
+	if len(acks) > 0 {
+		c.sendAcks(acks)
+	}
+}
+
+// resetBatchAck drops pending acks and the mode negotiated of the previous connection
+func (c *Client) resetBatchAck() {
+	c.ackMux.Lock()
+	c.acks = nil
+	c.ackTimer = nil
+	c.ackMux.Unlock()
+	atomic.StoreUint32(&c.batchAck, 0)
+}
+
+func (c *Client) sendAcks(acks []uint64) {
+	msg := newMessage(CmdNotify, ackRoute, encodeAckRanges(acks), false, false, 0, c.Handler, c.Codec, nil)
+	if err := c.PushMsg(msg, TimeForever); err != nil {
+		log.Warn("%v\t%v\tsend %v acks failed: %v", c.logTag(), c.Conn.RemoteAddr(), len(acks), err)
+	}
+}
+
+// onAck resolves pending calls of the seqs acked as empty responses, dispatched as the responses
+// would be, the async flag is restored by the pending call of the seq. Seqs without pending calls,
+// e.g. timed out, are dropped. It's only called on connections negotiated
+func (h *handler) onAck(c *Client, msg *Message, s *handlerState) {
+	err := decodeAckRanges(msg.Data(), func(seq uint64) {
+		async, ok := c.pendingCall(seq)
+		if !ok {
+			return
+		}
+		rsp := newMessage(CmdResponse, ackRoute, nil, false, async, seq, c.Handler, c.Codec, nil)
+		h.handleMessage(c, rsp, s)
+	})
+	if err != nil {
+		log.Warn("%v\t%v\tinvalid acks: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+	}
+}
+
+// pendingCall returns whether seq is of a pending call, and whether it's of an async call
+func (c *Client) pendingCall(seq uint64) (async bool, ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok = c.sessionMap[seq]; ok {
+		return false, true
+	}
+	_, ok = c.asyncHandlerMap[seq]
+	return ok, ok
+}
+
+// encodeAckRanges encodes seqs sorted as ranges of consecutive seqs, each range is
+// [uvarint: from - previous to][uvarint: to - from]
+func encodeAckRanges(seqs []uint64) []byte {
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	buf := make([]byte, 0, len(seqs)*2)
+	var tmp [binary.MaxVarintLen64]byte
+	prev := uint64(0)
+	for i := 0; i < len(seqs); {
+		from, to := seqs[i], seqs[i]
+		for i++; i < len(seqs) && seqs[i] <= to+1; i++ {
+			to = seqs[i]
+		}
+		n := binary.PutUvarint(tmp[:], from-prev)
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], to-from)
+		buf = append(buf, tmp[:n]...)
+		prev = to
+	}
+	return buf
+}
+
+// decodeAckRanges calls f with each seq of ranges encoded by encodeAckRanges, it fails without
+// calling f of the range exceeding maxAckBatch seqs in total, which the peer never sends
+func decodeAckRanges(data []byte, f func(seq uint64)) error {
+	prev, total := uint64(0), uint64(0)
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid ack range at %v", len(data))
+		}
+		data = data[n:]
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length >= maxAckBatch {
+			return fmt.Errorf("invalid ack range length at %v", len(data))
+		}
+		data = data[n:]
+		total += length + 1
+		if total > maxAckBatch {
+			return fmt.Errorf("too many seqs acked: more than %v", maxAckBatch)
+		}
+		from := prev + delta
+		if from < prev || from+length < from {
+			return fmt.Errorf("ack range overflowed at %v", len(data))
+		}
+		for i := uint64(0); i <= length; i++ {
+			f(from + i)
+		}
+		prev = from + length
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestBatchAck_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetBatchAck(time.Millisecond * 5)
+	svr.Handler.Handle("/ack/empty", func(ctx *Context) {
+		ctx.Write(nil)
+	})
+	svr.Handler.Handle("/ack/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	SetBatchAck(time.Millisecond * 5)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetBatchAck(0)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	// negotiated asynchronously after connected
+	for i := 0; i < 100 && atomic.LoadUint32(&c.batchAck) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if atomic.LoadUint32(&c.batchAck) == 0 {
+		t.Fatalf("batch ack not negotiated")
+	}
+	in := c.Stats().MessagesIn
+
+	const n = 100
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Call("/ack/empty", "hello", nil, time.Second); err != nil {
+				t.Errorf("Client.Call() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if received := c.Stats().MessagesIn - in; received == 0 || received >= n {
+		t.Fatalf("received %v messages for %v calls", received, n)
+	}
+
+	done := make(chan error, 1)
+	if err = c.CallAsync("/ack/empty", "hello", func(ctx *Context) {
+		done <- ctx.Message.Error()
+	}, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("async response error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("async call not acked")
+	}
+
+	in = c.Stats().MessagesIn
+	rsp := ""
+	if err = c.Call("/ack/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+	}
+	if received := c.Stats().MessagesIn - in; received != 1 {
+		t.Fatalf("received %v messages for a non-empty response, want 1", received)
+	}
+}
+
+func TestBatchAck_FullQueue(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	h := NewHandler()
+	h.SetSendQueueSize(1)
+	h.SetBatchAck(time.Hour)
+	c := newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	defer c.Stop()
+	atomic.StoreUint32(&c.batchAck, 1)
+
+	// the peer never reads, acks of full batches don't block the caller
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for seq := uint64(1); seq <= maxAckBatch*4; seq++ {
+			c.ack(seq)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Client.ack() blocked by the send queue full")
+	}
+}
+
+func TestBatchAck_Ranges(t *testing.T) {
+	seqs := []uint64{9, 1, 2, 3, 7, 300, 8, 5}
+	data := encodeAckRanges(seqs)
+	var got []uint64
+	if err := decodeAckRanges(data, func(seq uint64) { got = append(got, seq) }); err != nil {
+		t.Fatalf("decodeAckRanges() error = %v", err)
+	}
+	want := []uint64{1, 2, 3, 5, 7, 8, 9, 300}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeAckRanges() = %v, want %v", got, want)
+	}
+	// [1,3] [5,5] [7,9] [300,300], 2 bytes of each range but the last
+	if len(data) != 9 {
+		t.Fatalf("len(encodeAckRanges()) = %v, want 9", len(data))
+	}
+	if err := decodeAckRanges([]byte{0x01, 0xFF}, func(uint64) {}); err == nil {
+		t.Fatalf("decodeAckRanges() error = nil, want invalid range")
+	}
+}
+
+func TestBatchAck_MaliciousRanges(t *testing.T) {
+	var tmp [binary.MaxVarintLen64]byte
+	appendRange := func(buf []byte, delta uint64, length uint64) []byte {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], delta)]...)
+		return append(buf, tmp[:binary.PutUvarint(tmp[:], length)]...)
+	}
+	var ranges []byte
+	for i := 0; i < 1000; i++ {
+		ranges = appendRange(ranges, 1, maxAckBatch-1)
+	}
+	cases := map[string][]byte{
+		"too many seqs":    ranges,
+		"overflowed range": appendRange(appendRange(nil, math.MaxUint64-1, 0), 0, 2),
+		"overflowed delta": appendRange(appendRange(nil, 1, 0), math.MaxUint64, 0),
+	}
+	for name, data := range cases {
+		called := 0
+		if err := decodeAckRanges(data, func(uint64) { called++ }); err == nil {
+			t.Fatalf("decodeAckRanges() of %v error = nil, want error", name)
+		}
+		if called > maxAckBatch {
+			t.Fatalf("decodeAckRanges() of %v called f %v times, want at most %v", name, called, maxAckBatch)
+		}
+	}
+}
+
+func TestBatchAck_NotNegotiated(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/ack/forged", func(ctx *Context) {
+		// acks forged by the peer which never negotiated batch ack, then the real response
+		ctx.Client.Notify(ackRoute, encodeAckRanges([]uint64{ctx.Message.Seq()}), time.Second)
+		time.Sleep(time.Millisecond * 20)
+		ctx.Write("real")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/ack/forged", "hello", &rsp, time.Second); err != nil || rsp != "real" {
+		t.Fatalf("Client.Call() = (%v, %v), want (real, nil)", rsp, err)
+	}
+}
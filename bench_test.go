@@ -0,0 +1,226 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+// loopReader reads the same frame repeatedly
+type loopReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.frame[r.off:])
+	r.off = (r.off + n) % len(r.frame)
+	return n, nil
+}
+
+func newBenchPair(b *testing.B) (*Server, *Client) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	// coders registered on DefaultHandler by tests add allocations, use new handlers
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/bench/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/bench/notify", func(ctx *Context) {})
+	go svr.Serve(ln)
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		b.Fatalf("failed to dial: %v", err)
+	}
+	return svr, newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+}
+
+// newDiscardClient returns client of a peer discarding frames, so only the send path is measured
+func newDiscardClient(b *testing.B) *Client {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		defer ln.Close()
+		if conn, err := ln.Accept(); err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		b.Fatalf("failed to dial: %v", err)
+	}
+	return newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+}
+
+func BenchmarkNewMessage(b *testing.B) {
+	h := NewHandler()
+	data := make([]byte, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newMessage(CmdRequest, "/bench/echo", data, false, false, uint64(i), h, codec.DefaultCodec, nil)
+	}
+}
+
+func BenchmarkHandlerRecv(b *testing.B) {
+	h := NewHandler()
+	msg := newMessage(CmdRequest, "/bench/echo", make([]byte, 128), false, false, 1, h, codec.DefaultCodec, nil)
+	c := &Client{Handler: h, Reader: &loopReader{frame: msg.Buffer}}
+	c.Head = Header(c.head[:])
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Recv(c); err != nil {
+			b.Fatalf("Handler.Recv() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	svr, c := newBenchPair(b)
+	defer svr.Stop()
+	defer c.Stop()
+	req, rsp := make([]byte, 128), []byte{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Call("/bench/echo", req, &rsp, time.Second); err != nil {
+			b.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkCallParallel(b *testing.B) {
+	svr, c := newBenchPair(b)
+	defer svr.Stop()
+	defer c.Stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req, rsp := make([]byte, 128), []byte{}
+		for pb.Next() {
+			if err := c.Call("/bench/echo", req, &rsp, time.Second); err != nil {
+				b.Fatalf("Client.Call() error = %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkNotify(b *testing.B) {
+	svr, c := newBenchPair(b)
+	defer svr.Stop()
+	defer c.Stop()
+	data := make([]byte, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Notify("/bench/notify", data, TimeForever); err != nil {
+			b.Fatalf("Client.Notify() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkOnMessage_Notify(b *testing.B) {
+	h := NewHandler()
+	h.Handle("/bench/notify", func(ctx *Context) {})
+	c := &Client{Handler: h}
+	msg := newMessage(CmdNotify, "/bench/notify", make([]byte, 128), false, false, 0, h, codec.DefaultCodec, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.OnMessage(c, msg)
+	}
+}
+
+func BenchmarkOnMessage_NotifyFunc(b *testing.B) {
+	h := NewHandler()
+	h.HandleNotify("/bench/notify", func(c *Client, msg *Message) {})
+	c := &Client{Handler: h}
+	msg := newMessage(CmdNotify, "/bench/notify", make([]byte, 128), false, false, 0, h, codec.DefaultCodec, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.OnMessage(c, msg)
+	}
+}
+
+func BenchmarkNotify_Discard(b *testing.B) {
+	c := newDiscardClient(b)
+	defer c.Stop()
+	data := make([]byte, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Notify("/bench/notify", data, TimeForever); err != nil {
+			b.Fatalf("Client.Notify() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkNotifyBytes(b *testing.B) {
+	c := newDiscardClient(b)
+	defer c.Stop()
+	data := make([]byte, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.NotifyBytes("/bench/notify", data, TimeForever); err != nil {
+			b.Fatalf("Client.NotifyBytes() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkNotifyBytesParallel(b *testing.B) {
+	c := newDiscardClient(b)
+	defer c.Stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		data := make([]byte, 128)
+		for pb.Next() {
+			if err := c.NotifyBytes("/bench/notify", data, TimeForever); err != nil {
+				b.Fatalf("Client.NotifyBytes() error = %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkCallContext_Notify(b *testing.B) {
+	c := newDiscardClient(b)
+	defer c.Stop()
+	cc := c.NewCallContext()
+	data := make([]byte, 128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cc.Notify("/bench/notify", data, TimeForever); err != nil {
+			b.Fatalf("CallContext.Notify() error = %v", err)
+		}
+	}
+}
+
+// BenchmarkCallContext allocations are of receiving responses and of the server, compare with
+// BenchmarkCall
+func BenchmarkCallContext(b *testing.B) {
+	svr, c := newBenchPair(b)
+	defer svr.Stop()
+	defer c.Stop()
+	cc := c.NewCallContext()
+	req, rsp := make([]byte, 128), []byte{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cc.Call("/bench/echo", req, &rsp, time.Second); err != nil {
+			b.Fatalf("CallContext.Call() error = %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Caller makes rpc calls with context, e.g. *Client
+type Caller interface {
+	CallWith(ctx context.Context, method string, req interface{}, rsp interface{}) error
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Bind fills func fields of the struct pointed by v with calls of caller. Go could not implement
+// interfaces by reflection, so the methods are declared as func fields instead, e.g.
+//
+//	type UserAPI struct {
+//		Get    func(ctx context.Context, id int) (*User, error)
+//		Delete func(ctx context.Context, id int) error `arpc:"/user/remove"`
+//	}
+//	api := &UserAPI{}
+//	err := arpc.Bind(client, api, "/user/")
+//
+// The method of a field is prefix + field name, or its "arpc" tag. Fields should be func of
+// context.Context and a request, returning an optional response and an error, the request and
+// response are encoded by the codec of caller. Fields not of func type are skipped
+func Bind(caller Caller, v interface{}, prefix string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %T, should be pointer to struct", ErrInvalidBinding, v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.Type.Kind() != reflect.Func || field.PkgPath != "" {
+			continue
+		}
+		if err := checkBinding(field.Type); err != nil {
+			return fmt.Errorf("%w: field %v %v", err, field.Name, field.Type)
+		}
+		method := field.Tag.Get("arpc")
+		if method == "" {
+			method = prefix + field.Name
+		}
+		if err := checkMethod(method); err != nil {
+			return fmt.Errorf("%w: field %v", err, field.Name)
+		}
+		rv.Field(i).Set(reflect.MakeFunc(field.Type, bindCall(caller, method, field.Type)))
+	}
+	return nil
+}
+
+func checkBinding(ft reflect.Type) error {
+	if ft.IsVariadic() || ft.NumIn() != 2 || ft.In(0) != contextType {
+		return ErrInvalidBinding
+	}
+	switch ft.NumOut() {
+	case 1:
+		if ft.Out(0) != errorType {
+			return ErrInvalidBinding
+		}
+	case 2:
+		if ft.Out(1) != errorType {
+			return ErrInvalidBinding
+		}
+	default:
+		return ErrInvalidBinding
+	}
+	return nil
+}
+
+func bindCall(caller Caller, method string, ft reflect.Type) func(args []reflect.Value) []reflect.Value {
+	return func(args []reflect.Value) []reflect.Value {
+		ctx, _ := args[0].Interface().(context.Context)
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		req := args[1].Interface()
+		if ft.NumOut() == 1 {
+			err := caller.CallWith(ctx, method, req, nil)
+			return []reflect.Value{errorValue(err)}
+		}
+
+		out := ft.Out(0)
+		var rsp reflect.Value
+		if out.Kind() == reflect.Ptr {
+			rsp = reflect.New(out.Elem())
+		} else {
+			rsp = reflect.New(out)
+		}
+		err := caller.CallWith(ctx, method, req, rsp.Interface())
+		if err != nil {
+			return []reflect.Value{reflect.Zero(out), errorValue(err)}
+		}
+		if out.Kind() != reflect.Ptr {
+			rsp = rsp.Elem()
+		}
+		return []reflect.Value{rsp, errorValue(nil)}
+	}
+}
+
+func errorValue(err error) reflect.Value {
+	if err == nil {
+		return reflect.Zero(errorType)
+	}
+	return reflect.ValueOf(err)
+}
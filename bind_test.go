@@ -0,0 +1,82 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type bindUser struct {
+	ID   int
+	Name string
+}
+
+type bindUserAPI struct {
+	Get    func(ctx context.Context, id int) (*bindUser, error)
+	Name   func(ctx context.Context, id int) (string, error)
+	Delete func(ctx context.Context, id int) error `arpc:"/bind/user/remove"`
+
+	note string
+}
+
+func TestBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/bind/user/Get", func(ctx *Context) {
+		var id int
+		if err := ctx.Bind(&id); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(&bindUser{ID: id, Name: "alice"})
+	})
+	svr.Handler.Handle("/bind/user/Name", func(ctx *Context) {
+		ctx.Write("alice")
+	})
+	svr.Handler.Handle("/bind/user/remove", func(ctx *Context) {
+		ctx.Error(errors.New("forbidden"))
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	api := &bindUserAPI{}
+	if err = Bind(c, api, "/bind/user/"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	user, err := api.Get(context.Background(), 3)
+	if err != nil || user.ID != 3 || user.Name != "alice" {
+		t.Fatalf("api.Get() = %+v, %v, want {3 alice}", user, err)
+	}
+	if name, err := api.Name(context.Background(), 3); err != nil || name != "alice" {
+		t.Fatalf("api.Name() = %v, %v, want alice", name, err)
+	}
+	if err = api.Delete(context.Background(), 3); err == nil || err.Error() != "forbidden" {
+		t.Fatalf("api.Delete() error = %v, want forbidden", err)
+	}
+
+	invalid := &struct {
+		Get func(id int) (string, error)
+	}{}
+	if err = Bind(c, invalid, "/bind/"); !errors.Is(err, ErrInvalidBinding) {
+		t.Fatalf("Bind() error = %v, want %v", err, ErrInvalidBinding)
+	}
+	if err = Bind(c, api.note, "/bind/"); !errors.Is(err, ErrInvalidBinding) {
+		t.Fatalf("Bind() error = %v, want %v", err, ErrInvalidBinding)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"time"
+
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// subscribeRoute and unsubscribeRoute are the internal routes a client subscribes and
+	// unsubscribes a topic with, the body is the topic
+	subscribeRoute   = "_arpc.subscribe"
+	unsubscribeRoute = "_arpc.unsubscribe"
+
+	resubscribeTimeout = time.Second * 5
+)
+
+func (h *handler) Broker() *Broker {
+	return h.load().broker
+}
+
+func (h *handler) SetBroker(b *Broker) {
+	h.update(func(s *handlerState) { s.broker = b })
+}
+
+// onSubscribe handles subscribing and unsubscribing of the peer
+func (h *handler) onSubscribe(c *Client, msg *Message, s *handlerState, subscribe bool) {
+	ctx := newContext(c, msg, nil)
+	if s.broker == nil {
+		ctx.Error(ErrBrokerDisabled)
+		return
+	}
+	topic := string(msg.Data())
+	if !subscribe {
+		s.broker.Unsubscribe(c, topic)
+		ctx.Write(nil)
+		return
+	}
+	if err := s.broker.subscribe(c, topic); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(nil)
+}
+
+// Publish encodes v once and pushes it to subscribers of topic of the broker of the handler as a
+// notify of method topic. It returns number of subscribers it's queued to
+func (s *Server) Publish(topic string, v interface{}) (int, error) {
+	b := s.Handler.Broker()
+	if b == nil {
+		return 0, ErrBrokerDisabled
+	}
+	if err := checkMethod(topic); err != nil {
+		return 0, err
+	}
+	t, ok := b.Topic(topic)
+	if !ok {
+		return 0, nil
+	}
+	return t.Publish(newMessage(CmdNotify, topic, v, false, false, 0, s.Handler, s.Codec, nil)), nil
+}
+
+// Subscribe subscribes topic of the broker of the peer, messages published are handled by the
+// handler of topic. Topics are subscribed again after reconnected
+func (c *Client) Subscribe(topic string, timeout time.Duration) error {
+	if err := c.Call(subscribeRoute, topic, nil, timeout); err != nil {
+		return err
+	}
+	c.submux.Lock()
+	if c.topics == nil {
+		c.topics = map[string]util.Empty{}
+	}
+	c.topics[topic] = util.Empty{}
+	c.submux.Unlock()
+	return nil
+}
+
+// Unsubscribe unsubscribes topic of the broker of the peer
+func (c *Client) Unsubscribe(topic string, timeout time.Duration) error {
+	c.submux.Lock()
+	delete(c.topics, topic)
+	c.submux.Unlock()
+	return c.Call(unsubscribeRoute, topic, nil, timeout)
+}
+
+// resubscribe subscribes topics again after reconnected
+func (c *Client) resubscribe() {
+	c.submux.Lock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	c.submux.Unlock()
+	for _, topic := range topics {
+		if err := c.Call(subscribeRoute, topic, nil, resubscribeTimeout); err != nil {
+			log.Warn("%v\t%v\tresubscribe [%v] failed: %v", c.logTag(), c.Conn.RemoteAddr(), topic, err)
+		}
+	}
+}
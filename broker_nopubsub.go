@@ -0,0 +1,49 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build arpc_nopubsub
+// +build arpc_nopubsub
+
+package arpc
+
+// Topic is compiled out by arpc_nopubsub
+type Topic struct{}
+
+// Name returns empty name, pub/sub is compiled out by arpc_nopubsub
+func (t *Topic) Name() string { return "" }
+
+// Subscribers returns 0, pub/sub is compiled out by arpc_nopubsub
+func (t *Topic) Subscribers() int { return 0 }
+
+// Publish does nothing, pub/sub is compiled out by arpc_nopubsub
+func (t *Topic) Publish(msg *Message) int { return 0 }
+
+// Broker is compiled out by arpc_nopubsub, NewBroker returns nil so handlers have no broker:
+// Client.Subscribe and Server.Publish fail with ErrBrokerDisabled
+type Broker struct{}
+
+// Topic returns no topic, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) Topic(name string) (*Topic, bool) { return nil, false }
+
+// Topics returns no topic, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) Topics() []string { return nil }
+
+// Subscribe returns ErrBrokerDisabled, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) Subscribe(c *Client, topic string) error { return ErrBrokerDisabled }
+
+// Unsubscribe does nothing, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) Unsubscribe(c *Client, topic string) {}
+
+// UnsubscribeAll does nothing, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) UnsubscribeAll(c *Client) {}
+
+// Publish does nothing, pub/sub is compiled out by arpc_nopubsub
+func (b *Broker) Publish(topic string, msg *Message) int { return 0 }
+
+func (b *Broker) subscribe(c *Client, topic string) error { return ErrBrokerDisabled }
+
+func (b *Broker) clone() *Broker { return nil }
+
+// NewBroker returns nil, pub/sub is compiled out by arpc_nopubsub
+func NewBroker() *Broker { return nil }
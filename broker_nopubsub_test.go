@@ -0,0 +1,43 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build arpc_nopubsub
+// +build arpc_nopubsub
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_PublishCompiledOut(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetBroker(NewBroker())
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	if b := svr.Handler.Broker(); b != nil {
+		t.Fatalf("Handler.Broker() = %v, want nil", b)
+	}
+	if _, err := svr.Publish("room", "hello"); err != ErrBrokerDisabled {
+		t.Fatalf("Server.Publish() error = %v, want %v", err, ErrBrokerDisabled)
+	}
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	if err := c.Subscribe("room", time.Second); err == nil || err.Error() != ErrBrokerDisabled.Error() {
+		t.Fatalf("Client.Subscribe() error = %v, want %v", err, ErrBrokerDisabled)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nopubsub
+// +build !arpc_nopubsub
+
+package arpc
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// Topic is a topic of Broker with its subscribers
+type Topic struct {
+	name    string
+	mux     sync.RWMutex
+	clients map[*Client]util.Empty
+}
+
+// Name returns name of the topic
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Subscribers returns number of subscribers of the topic
+func (t *Topic) Subscribers() int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return len(t.clients)
+}
+
+// Publish pushes msg to subscribers of the topic without blocking, msg is shared by them and
+// should not be modified after, subscribers with coders get copies since coders may modify
+// messages in place. It returns number of subscribers msg is queued to, slow subscribers with
+// send queues full are skipped, see Handler.HandleOverstock
+func (t *Topic) Publish(msg *Message) int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	n := 0
+	for c := range t.clients {
+		m := msg
+		if len(c.Handler.Coders()) > 0 {
+			m = &Message{Buffer: c.Handler.GetBuffer(len(msg.Buffer)), Values: msg.Values}
+			copy(m.Buffer, msg.Buffer)
+		}
+		if err := c.PushMsg(m, TimeZero); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// DefaultMaxTopics is the default limit of topics a client subscribes of brokers created by NewBroker
+const DefaultMaxTopics = 1024
+
+// Broker tracks subscribers of topics, subscribers are removed when disconnected.
+// Topics are methods of notify messages published to subscribers, so they're handled by handlers
+// of the topics registered on the clients. Handlers have no broker by default, subscribing fails
+// with ErrBrokerDisabled until one is set, e.g.
+//
+//	b := arpc.NewBroker()
+//	b.Authorize = func(c *arpc.Client, topic string) error { ... }
+//	server.Handler.SetBroker(b)
+//	...
+//	client.Handler.Handle("room.1", func(ctx *arpc.Context) { ... })
+//	client.Subscribe("room.1", time.Second)
+//	...
+//	server.Publish("room.1", "hello")
+type Broker struct {
+	// Authorize checks topics subscribed by peers, the subscription fails with the error returned.
+	// Subscriptions are handled before router middlewares, so peers are not authenticated by them,
+	// all peers may subscribe all topics if it's nil
+	Authorize func(c *Client, topic string) error
+	// MaxTopics limits topics a client subscribes, ErrTooManyTopics is returned beyond it, no
+	// limit if it's 0
+	MaxTopics int
+
+	mux    sync.RWMutex
+	topics map[string]*Topic
+	subs   map[*Client]map[string]*Topic
+}
+
+// Topic returns topic of name if it has subscribers
+func (b *Broker) Topic(name string) (*Topic, bool) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	t, ok := b.topics[name]
+	return t, ok
+}
+
+// Topics returns names of topics with subscribers, sorted
+func (b *Broker) Topics() []string {
+	b.mux.RLock()
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	b.mux.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Subscribe adds c to subscribers of topic, it's not checked by Authorize
+func (b *Broker) Subscribe(c *Client, topic string) error {
+	if err := checkMethod(topic); err != nil {
+		return err
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.subs[c][topic]; ok {
+		return nil
+	}
+	if b.MaxTopics > 0 && len(b.subs[c]) >= b.MaxTopics {
+		return ErrTooManyTopics
+	}
+	t, ok := b.topics[topic]
+	if !ok {
+		t = &Topic{name: topic, clients: map[*Client]util.Empty{}}
+		b.topics[topic] = t
+	}
+	topics, ok := b.subs[c]
+	if !ok {
+		topics = map[string]*Topic{}
+		b.subs[c] = topics
+	}
+	topics[topic] = t
+	t.mux.Lock()
+	t.clients[c] = util.Empty{}
+	t.mux.Unlock()
+	return nil
+}
+
+// subscribe adds c to subscribers of topic subscribed by the peer if it's authorized
+func (b *Broker) subscribe(c *Client, topic string) error {
+	if b.Authorize != nil {
+		if err := b.Authorize(c, topic); err != nil {
+			return err
+		}
+	}
+	return b.Subscribe(c, topic)
+}
+
+// Unsubscribe removes c from subscribers of topic, the topic is removed if it has no subscribers
+func (b *Broker) Unsubscribe(c *Client, topic string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	t, ok := b.subs[c][topic]
+	if !ok {
+		return
+	}
+	delete(b.subs[c], topic)
+	if len(b.subs[c]) == 0 {
+		delete(b.subs, c)
+	}
+	b.remove(t, c)
+}
+
+// UnsubscribeAll removes c from subscribers of all topics, it's called when c is stopped
+func (b *Broker) UnsubscribeAll(c *Client) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	topics, ok := b.subs[c]
+	if !ok {
+		return
+	}
+	delete(b.subs, c)
+	for _, t := range topics {
+		b.remove(t, c)
+	}
+}
+
+// remove removes c from t, b.mux should be held
+func (b *Broker) remove(t *Topic, c *Client) {
+	t.mux.Lock()
+	delete(t.clients, c)
+	empty := len(t.clients) == 0
+	t.mux.Unlock()
+	if empty {
+		delete(b.topics, t.name)
+	}
+}
+
+// Publish pushes msg to subscribers of topic, see Topic.Publish
+func (b *Broker) Publish(topic string, msg *Message) int {
+	t, ok := b.Topic(topic)
+	if !ok {
+		return 0
+	}
+	return t.Publish(msg)
+}
+
+// clone returns an empty broker of the same options
+func (b *Broker) clone() *Broker {
+	cp := NewBroker()
+	cp.Authorize, cp.MaxTopics = b.Authorize, b.MaxTopics
+	return cp
+}
+
+// NewBroker returns Broker limiting topics of a client to DefaultMaxTopics
+func NewBroker() *Broker {
+	return &Broker{
+		MaxTopics: DefaultMaxTopics,
+		topics:    map[string]*Topic{},
+		subs:      map[*Client]map[string]*Topic{},
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !arpc_nopubsub
+// +build !arpc_nopubsub
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Publish(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetBroker(NewBroker())
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	received := make(chan string, 4)
+	newSubscriber := func() *Client {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.Dial("tcp", ln.Addr().String())
+		})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		c.Handler.Handle("room", func(ctx *Context) {
+			received <- string(ctx.Body())
+		})
+		if err := c.Subscribe("room", time.Second); err != nil {
+			t.Fatalf("Client.Subscribe() error = %v", err)
+		}
+		return c
+	}
+	c1, c2 := newSubscriber(), newSubscriber()
+	defer c1.Stop()
+	defer c2.Stop()
+
+	n, err := svr.Publish("room", "hello")
+	if err != nil || n != 2 {
+		t.Fatalf("Server.Publish() = (%v, %v), want 2", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			if data != "hello" {
+				t.Fatalf("received %v, want hello", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("published message not received")
+		}
+	}
+
+	if err := c1.Unsubscribe("room", time.Second); err != nil {
+		t.Fatalf("Client.Unsubscribe() error = %v", err)
+	}
+	topic, ok := svr.Handler.Broker().Topic("room")
+	if !ok || topic.Subscribers() != 1 {
+		t.Fatalf("Broker.Topic() = (%v, %v), want 1 subscriber", topic, ok)
+	}
+
+	// subscribers are removed on disconnected
+	c2.Stop()
+	for i := 0; i < 100 && len(svr.Handler.Broker().Topics()) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if topics := svr.Handler.Broker().Topics(); len(topics) != 0 {
+		t.Fatalf("Broker.Topics() = %v, want empty", topics)
+	}
+	if n, err := svr.Publish("room", "hello"); err != nil || n != 0 {
+		t.Fatalf("Server.Publish() = (%v, %v), want 0", n, err)
+	}
+}
+
+func TestBroker_Authorize(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	// servers have no broker by default
+	if err := c.Subscribe("room", time.Second); err == nil || err.Error() != ErrBrokerDisabled.Error() {
+		t.Fatalf("Client.Subscribe() error = %v, want %v", err, ErrBrokerDisabled)
+	}
+
+	errDenied := errors.New("topic denied")
+	b := NewBroker()
+	b.MaxTopics = 2
+	b.Authorize = func(c *Client, topic string) error {
+		if strings.HasPrefix(topic, "admin.") {
+			return errDenied
+		}
+		return nil
+	}
+	svr.Handler.SetBroker(b)
+
+	if err := c.Subscribe("admin.events", time.Second); err == nil || err.Error() != errDenied.Error() {
+		t.Fatalf("Client.Subscribe() of unauthorized topic error = %v, want %v", err, errDenied)
+	}
+	if _, ok := b.Topic("admin.events"); ok {
+		t.Fatalf("unauthorized topic subscribed")
+	}
+	for _, topic := range []string{"room.1", "room.2", "room.1"} {
+		if err := c.Subscribe(topic, time.Second); err != nil {
+			t.Fatalf("Client.Subscribe(%v) error = %v", topic, err)
+		}
+	}
+	if err := c.Subscribe("room.3", time.Second); err == nil || err.Error() != ErrTooManyTopics.Error() {
+		t.Fatalf("Client.Subscribe() beyond MaxTopics error = %v, want %v", err, ErrTooManyTopics)
+	}
+	if topics := b.Topics(); len(topics) != 2 {
+		t.Fatalf("Broker.Topics() = %v, want 2", topics)
+	}
+}
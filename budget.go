@@ -0,0 +1,124 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SendBudgetPolicy is called when sending msg exceeds the process-wide send budget, buffered is
+// the total bytes buffered in send queues of all clients. Returning nil queues msg anyway, returning
+// an error rejects it, e.g. the policy may stop the client with the most bytes buffered
+type SendBudgetPolicy func(c *Client, msg *Message, buffered int64) error
+
+var sendBudget struct {
+	max      int64
+	buffered int64
+
+	mux    sync.RWMutex
+	policy SendBudgetPolicy
+}
+
+// SetSendBudget limits total bytes buffered in send queues of all clients of the process,
+// max <= 0 disables the limit, nil policy rejects messages with ErrSendBudgetExceeded
+func SetSendBudget(max int64, policy SendBudgetPolicy) {
+	sendBudget.mux.Lock()
+	sendBudget.policy = policy
+	sendBudget.mux.Unlock()
+	atomic.StoreInt64(&sendBudget.max, max)
+}
+
+// SendBuffered returns total bytes buffered in send queues of all clients
+func SendBuffered() int64 {
+	return atomic.LoadInt64(&sendBudget.buffered)
+}
+
+// SendBuffered returns bytes buffered in send queue of the client
+func (c *Client) SendBuffered() int64 {
+	c.budgetMux.Lock()
+	defer c.budgetMux.Unlock()
+	return c.sendBuffered
+}
+
+// charge counts msg into send budget before it's queued
+func (c *Client) charge(msg *Message) error {
+	c.checkQueueHigh()
+	n := int64(msg.Len())
+	if max := atomic.LoadInt64(&sendBudget.max); max > 0 {
+		if buffered := atomic.LoadInt64(&sendBudget.buffered); buffered+n > max {
+			sendBudget.mux.RLock()
+			policy := sendBudget.policy
+			sendBudget.mux.RUnlock()
+			if policy == nil {
+				c.Handler.OnOverstock(c, msg)
+				return ErrSendBudgetExceeded
+			}
+			if err := policy(c, msg, buffered); err != nil {
+				c.Handler.OnOverstock(c, msg)
+				return err
+			}
+		}
+	}
+	c.budgetMux.Lock()
+	if !c.budgetClosed {
+		c.sendBuffered += n
+		atomic.AddInt64(&sendBudget.buffered, n)
+	}
+	c.budgetMux.Unlock()
+	return nil
+}
+
+// uncharge is called when msg is taken out of send queue or failed to be queued
+func (c *Client) uncharge(msg *Message) {
+	n := int64(msg.Len())
+	c.budgetMux.Lock()
+	if !c.budgetClosed {
+		c.sendBuffered -= n
+		atomic.AddInt64(&sendBudget.buffered, -n)
+	}
+	c.budgetMux.Unlock()
+	c.checkQueueLow()
+}
+
+// closeBudget releases bytes left in send queue of the stopped client
+func (c *Client) closeBudget() {
+	c.budgetMux.Lock()
+	c.budgetClosed = true
+	atomic.AddInt64(&sendBudget.buffered, -c.sendBuffered)
+	c.sendBuffered = 0
+	c.budgetMux.Unlock()
+}
+
+func (c *Client) openBudget() {
+	c.budgetMux.Lock()
+	c.budgetClosed = false
+	c.budgetMux.Unlock()
+}
+
+// prepareSend checks msg is carried by the frame mode, and acquires flow control window and send
+// budget for msg before it's queued
+func (c *Client) prepareSend(msg *Message, block bool, expire <-chan time.Time, done <-chan struct{}) error {
+	if t := c.Handler.TinyFrame(); t != nil {
+		if err := checkTinyFrame(t, msg.Buffer); err != nil {
+			return err
+		}
+	}
+	if err := c.acquireWindow(msg, block, expire, done); err != nil {
+		return err
+	}
+	if err := c.charge(msg); err != nil {
+		c.restoreWindow(msg)
+		return err
+	}
+	return nil
+}
+
+// cancelSend returns window and budget of msg prepared but not queued
+func (c *Client) cancelSend(msg *Message) {
+	c.restoreWindow(msg)
+	c.uncharge(msg)
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"testing"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+func TestSendBudget(t *testing.T) {
+	// no send loop, messages stay buffered in the queue
+	c := &Client{Handler: NewHandler(), Codec: codec.DefaultCodec, running: true}
+	c.chSend = make(chan *Message, 10)
+	c.chClose = make(chan util.Empty)
+
+	msg := c.NewMessage(CmdNotify, "/budget", "hello")
+	size := int64(msg.Len())
+	base := SendBuffered()
+
+	SetSendBudget(base+size*2, nil)
+	defer SetSendBudget(0, nil)
+
+	for i := 0; i < 2; i++ {
+		if err := c.PushMsg(msg, TimeZero); err != nil {
+			t.Fatalf("Client.PushMsg() error = %v", err)
+		}
+	}
+	if got := c.SendBuffered(); got != size*2 {
+		t.Fatalf("Client.SendBuffered() = %v, want %v", got, size*2)
+	}
+	if err := c.PushMsg(msg, TimeZero); err != ErrSendBudgetExceeded {
+		t.Fatalf("Client.PushMsg() error = %v, want %v", err, ErrSendBudgetExceeded)
+	}
+
+	var policyBuffered int64
+	SetSendBudget(base+size*2, func(c *Client, msg *Message, buffered int64) error {
+		policyBuffered = buffered
+		return nil
+	})
+	if err := c.PushMsg(msg, TimeZero); err != nil {
+		t.Fatalf("Client.PushMsg() with policy error = %v", err)
+	}
+	if policyBuffered != base+size*2 {
+		t.Fatalf("policy buffered = %v, want %v", policyBuffered, base+size*2)
+	}
+
+	c.uncharge(<-c.chSend)
+	if got := SendBuffered() - base; got != size*2 {
+		t.Fatalf("SendBuffered() = %v, want %v", got, size*2)
+	}
+	c.closeBudget()
+	if got := SendBuffered() - base; got != 0 {
+		t.Fatalf("SendBuffered() after closed = %v, want 0", got)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// CapabilitiesRoute is the internal route fetching capabilities of the server
+	CapabilitiesRoute = "_arpc.capabilities"
+
+	// MetaVersion is the metadata key of Capabilities.Version
+	MetaVersion = "arpc.version"
+	// MetaMethods is the metadata key of Capabilities.Methods, joined by ","
+	MetaMethods = "arpc.methods"
+	// MetaMaxBodyLen is the metadata key of Capabilities.MaxBodyLen
+	MetaMaxBodyLen = "arpc.maxbodylen"
+	// MetaRecvWindow is the metadata key of Capabilities.RecvWindow
+	MetaRecvWindow = "arpc.recvwindow"
+
+	internalRoutePrefix = "_arpc."
+
+	capabilitiesTimeout = time.Second * 5
+)
+
+// Capabilities is what a server supports, advertised to clients on connected and to registries as
+// metadata, so clients avoid calling methods the server doesn't support and balancers route by it
+type Capabilities struct {
+	// Version of the server, set by users
+	Version string `json:"version,omitempty"`
+	// Methods are routes of the server sorted, filled by Handler
+	Methods []string `json:"methods,omitempty"`
+	// MethodLimits are body limits of routes set by WithMaxBodyLen, filled by Handler
+	MethodLimits map[string]int `json:"methodLimits,omitempty"`
+	// MaxBodyLen and RecvWindow are limits of connections, filled by Handler
+	MaxBodyLen int `json:"maxBodyLen,omitempty"`
+	RecvWindow int `json:"recvWindow,omitempty"`
+	// Meta is extra metadata set by users, e.g. zone or weight
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Supports returns whether method is a route of the server, internal methods are always supported
+func (caps *Capabilities) Supports(method string) bool {
+	if strings.HasPrefix(method, internalRoutePrefix) {
+		return true
+	}
+	i := sort.SearchStrings(caps.Methods, method)
+	return i < len(caps.Methods) && caps.Methods[i] == method
+}
+
+// Metadata returns caps as registry metadata, Meta is merged as it is
+func (caps *Capabilities) Metadata() map[string]string {
+	meta := make(map[string]string, len(caps.Meta)+4)
+	for k, v := range caps.Meta {
+		meta[k] = v
+	}
+	if caps.Version != "" {
+		meta[MetaVersion] = caps.Version
+	}
+	if len(caps.Methods) > 0 {
+		meta[MetaMethods] = strings.Join(caps.Methods, ",")
+	}
+	if caps.MaxBodyLen > 0 {
+		meta[MetaMaxBodyLen] = strconv.Itoa(caps.MaxBodyLen)
+	}
+	if caps.RecvWindow > 0 {
+		meta[MetaRecvWindow] = strconv.Itoa(caps.RecvWindow)
+	}
+	return meta
+}
+
+// ParseCapabilities parses registry metadata returned by Capabilities.Metadata, MethodLimits are
+// not included in metadata
+func ParseCapabilities(meta map[string]string) (*Capabilities, error) {
+	caps := &Capabilities{Version: meta[MetaVersion]}
+	if methods := meta[MetaMethods]; methods != "" {
+		caps.Methods = strings.Split(methods, ",")
+		sort.Strings(caps.Methods)
+	}
+	var err error
+	if v, ok := meta[MetaMaxBodyLen]; ok {
+		if caps.MaxBodyLen, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := meta[MetaRecvWindow]; ok {
+		if caps.RecvWindow, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range meta {
+		switch k {
+		case MetaVersion, MetaMethods, MetaMaxBodyLen, MetaRecvWindow:
+		default:
+			if caps.Meta == nil {
+				caps.Meta = map[string]string{}
+			}
+			caps.Meta[k] = v
+		}
+	}
+	return caps, nil
+}
+
+func (h *handler) Capabilities() *Capabilities {
+	s := h.load()
+	if s.capabilities == nil {
+		return nil
+	}
+	caps := &Capabilities{
+		Version:    s.capabilities.Version,
+		Methods:    make([]string, 0, len(s.routes)),
+		MaxBodyLen: MaxBodyLen,
+		RecvWindow: s.recvWindow,
+	}
+	for method, rh := range s.routes {
+		if method == "" {
+			continue
+		}
+		caps.Methods = append(caps.Methods, method)
+		if rh.MaxBodyLen > 0 {
+			if caps.MethodLimits == nil {
+				caps.MethodLimits = map[string]int{}
+			}
+			caps.MethodLimits[method] = rh.MaxBodyLen
+		}
+	}
+	sort.Strings(caps.Methods)
+	if len(s.capabilities.Meta) > 0 {
+		caps.Meta = make(map[string]string, len(s.capabilities.Meta))
+		for k, v := range s.capabilities.Meta {
+			caps.Meta[k] = v
+		}
+	}
+	return caps
+}
+
+func (h *handler) SetCapabilities(caps *Capabilities) {
+	h.update(func(s *handlerState) { s.capabilities = caps })
+}
+
+// Capabilities returns capabilities of the server fetched on connected, nil if not fetched,
+// e.g. the server doesn't advertise them
+func (c *Client) Capabilities() *Capabilities {
+	caps, _ := c.peerCaps.Load().(*Capabilities)
+	return caps
+}
+
+// FetchCapabilities fetches capabilities of the server, it's called on connected if capabilities
+// of the handler are enabled, calls are not checked until fetched
+func (c *Client) FetchCapabilities() error {
+	rsp := []byte{}
+	if err := c.Call(CapabilitiesRoute, nil, &rsp, capabilitiesTimeout); err != nil {
+		return err
+	}
+	caps := &Capabilities{}
+	if err := json.Unmarshal(rsp, caps); err != nil {
+		return err
+	}
+	sort.Strings(caps.Methods)
+	c.peerCaps.Store(caps)
+	return nil
+}
+
+func (c *Client) fetchCapabilities() {
+	c.peerCaps.Store((*Capabilities)(nil))
+	if err := c.FetchCapabilities(); err != nil {
+		log.Warn("%v\t%v\tfetch capabilities failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+	}
+}
+
+// onCapabilities responds capabilities of h in json
+func (h *handler) onCapabilities(c *Client, msg *Message) {
+	data, err := json.Marshal(h.Capabilities())
+	ctx := newContext(c, msg, nil)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(data)
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapabilities_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetCapabilities(&Capabilities{Version: "v2", Meta: map[string]string{"zone": "a"}})
+	svr.Handler.Handle("/caps/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	}, WithMaxBodyLen(1024))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	SetCapabilities(&Capabilities{})
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetCapabilities(nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	// fetched asynchronously after connected
+	for i := 0; i < 100 && c.Capabilities() == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	caps := c.Capabilities()
+	if caps == nil {
+		t.Fatalf("capabilities not fetched")
+	}
+	if caps.Version != "v2" || caps.Meta["zone"] != "a" || caps.MaxBodyLen != MaxBodyLen ||
+		caps.MethodLimits["/caps/echo"] != 1024 || !caps.Supports("/caps/echo") {
+		t.Fatalf("Client.Capabilities() = %+v", caps)
+	}
+
+	rsp := ""
+	if err = c.Call("/caps/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+	}
+	if err = c.Call("/caps/none", "hello", &rsp, time.Second); err != ErrMethodNotSupported {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrMethodNotSupported)
+	}
+	if err = c.Notify("/caps/none", "hello", time.Second); err != ErrMethodNotSupported {
+		t.Fatalf("Client.Notify() error = %v, want %v", err, ErrMethodNotSupported)
+	}
+}
+
+func TestCapabilities_Metadata(t *testing.T) {
+	caps := &Capabilities{
+		Version:    "v1",
+		Methods:    []string{"/a", "/b"},
+		MaxBodyLen: 4096,
+		RecvWindow: 1024,
+		Meta:       map[string]string{"zone": "a"},
+	}
+	meta := caps.Metadata()
+	if meta[MetaMethods] != "/a,/b" || meta["zone"] != "a" {
+		t.Fatalf("Capabilities.Metadata() = %v", meta)
+	}
+	parsed, err := ParseCapabilities(meta)
+	if err != nil || !reflect.DeepEqual(parsed, caps) {
+		t.Fatalf("ParseCapabilities() = (%+v, %v), want %+v", parsed, err, caps)
+	}
+	if _, err := ParseCapabilities(map[string]string{MetaMaxBodyLen: "x"}); err == nil {
+		t.Fatalf("ParseCapabilities() error = nil, want invalid limit")
+	}
+}
@@ -38,6 +38,25 @@ func newSession(seq uint64) *rpcSession {
 
 // Client defines rpc client struct
 type Client struct {
+	// keep 64-bit aligned for atomic operations
+	stats Stats
+
+	// 1 if chSend reached high watermark and not drained to low yet, accessed atomically
+	queueHigh uint32
+
+	// monotonic nanoseconds of connecting, last read and last write, see monoNanos, and clock skew
+	// of the peer, accessed atomically
+	connectedAt int64
+	lastRead    int64
+	lastWrite   int64
+	clockSkew   int64
+
+	// state of the lifecycle, see ClientState, accessed atomically
+	state int32
+
+	// frames counted for sampling of the flight recorder, accessed atomically
+	flightN uint64
+
 	Conn     net.Conn
 	Reader   io.Reader
 	head     [4]byte
@@ -55,13 +74,104 @@ type Client struct {
 	sessionMap      map[uint64]*rpcSession
 	asyncHandlerMap map[uint64]HandlerFunc
 
-	chSend  chan *Message
-	chClose chan util.Empty
+	chSend   chan *Message
+	chUrgent chan *Message
+	chCredit chan util.Empty
+	chClose  chan util.Empty
 
 	onStop func(*Client)
 
 	kvmux  sync.RWMutex
 	values map[string]interface{}
+
+	// method tables negotiated for method ids
+	sendMethods atomic.Value
+	recvMethods atomic.Value
+
+	// capabilities advertised by the server
+	peerCaps atomic.Value
+
+	// static labels set by WithLabels, encoded for metadata and logs
+	labels     map[string]string
+	labelsMeta string
+	labelsTag  string
+
+	// namespace set by WithNamespace, sent as MetaKeyNamespace
+	namespace string
+
+	// varint header switched by each side, accessed atomically, recvVarint is written by Restart
+	// while the reading loop of the previous conn may be still running
+	sendVarint uint32
+	recvVarint uint32
+
+	// cumulative acks negotiated by the peer, batchAck is accessed atomically
+	batchAck uint32
+	ackMux   sync.Mutex
+	acks     []uint64
+	ackTimer Timer
+
+	// flow control windows advertised by the peer and counted for the peer
+	flowmux     sync.RWMutex
+	sendWindow  *flowWindow
+	sendWindows map[string]*flowWindow
+	recvWindow  *recvWindow
+	recvWindows map[string]*recvWindow
+	// credit returned to the peer and not sent yet by the send loop, the connection window's is
+	// keyed by ""
+	credits map[string]int
+
+	// bytes buffered in chSend counted into the process-wide send budget
+	budgetMux    sync.Mutex
+	sendBuffered int64
+	budgetClosed bool
+
+	// buffered conn of batch send loop, see Handler.SetSendBufferSize
+	wmux  sync.Mutex
+	wconn *bufferedConn
+
+	// source address from PROXY protocol header, see Server.ProxyProtocol
+	realAddr net.Addr
+
+	// protocol error reported by the peer before closing
+	peerProtoErr atomic.Value
+
+	// reason of closing the current conn, see CloseReason
+	cmux        sync.Mutex
+	closeReason CloseReason
+	closeErr    error
+
+	// timers of AfterFunc stopped on disconnection
+	tmux   sync.Mutex
+	timers map[*connTimer]util.Empty
+
+	// context of the current connection, see ConnContext
+	connMux    sync.Mutex
+	connCtx    context.Context
+	connCancel context.CancelCauseFunc
+
+	// connection migration, see Handler.SetMigration
+	migrateMux  sync.Mutex
+	migrateID   string
+	migrateSet  *migrations
+	migrateGen  uint64
+	migratedTo  *Client
+	detached    []*Message
+	detachTimer Timer
+
+	// streams opened by each side, see OpenStream
+	smux          sync.Mutex
+	streamSeq     uint64
+	streams       map[streamKey]*Stream
+	remoteStreams int
+
+	// topics subscribed again after reconnected, see Subscribe
+	submux sync.Mutex
+	topics map[string]util.Empty
+
+	// ring of the flight recorder, see Handler.SetFlightRecorder
+	fmux       sync.Mutex
+	flight     []FlightEvent
+	flightNext int
 }
 
 // Get returns value for key
@@ -94,45 +204,67 @@ func (c *Client) NewMessage(cmd byte, method string, v interface{}) *Message {
 }
 
 // Call make rpc call with timeout
-func (c *Client) Call(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+func (c *Client) Call(method string, req interface{}, rsp interface{}, timeout time.Duration) (err error) {
+	defer c.statCall(&err)
+
 	if err := c.checkCallArgs(method, timeout); err != nil {
 		return err
 	}
 
+	msg := c.newRequestMessage(CmdRequest, method, req, false, false)
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	msg, err = c.call(msg, timeout)
+	if err != nil {
+		return err
+	}
+	return c.parseResponse(msg, rsp)
+}
+
+// call sends request msg and waits for the response
+func (c *Client) call(msg *Message, timeout time.Duration) (*Message, error) {
 	if timeout < 0 {
 		timeout = TimeForever
 	}
 
-	timer := time.NewTimer(timeout)
+	timer := c.Handler.Clock().NewTimer(timeout)
+	defer stopTimer(timer)
+	msg, _, err := c.callWith(msg, newSession(msg.Seq()), timer)
+	return msg, err
+}
 
-	msg := c.newRequestMessage(CmdRequest, method, req, false, false)
+// callWith sends request msg and waits for the response on sess until timer fires, it returns
+// whether msg was queued
+func (c *Client) callWith(msg *Message, sess *rpcSession, timer Timer) (*Message, bool, error) {
 	seq := msg.Seq()
-	sess := newSession(seq)
 	c.addSession(seq, sess)
-	defer func() {
-		timer.Stop()
-		c.deleteSession(seq)
-	}()
+	defer c.deleteSession(seq)
+
+	if err := c.prepareSend(msg, true, timer.C(), nil); err != nil {
+		return nil, false, err
+	}
 
 	select {
 	case c.chSend <- msg:
-	case <-timer.C:
+	case <-timer.C():
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
-		return ErrClientTimeout
+		return nil, false, ErrClientTimeout
 	case <-c.chClose:
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
-		return ErrClientStopped
+		return nil, false, ErrClientStopped
 	}
 
 	select {
 	case msg = <-sess.done:
-	case <-timer.C:
-		return ErrClientTimeout
+	case <-timer.C():
+		return nil, true, ErrClientTimeout
 	case <-c.chClose:
-		return ErrClientStopped
+		return nil, true, ErrClientStopped
 	}
-
-	return c.parseResponse(msg, rsp)
+	return msg, true, nil
 }
 
 func (c *Client) checkCallArgs(method string, timeout time.Duration) error {
@@ -146,23 +278,39 @@ func (c *Client) checkCallArgs(method string, timeout time.Duration) error {
 }
 
 // CallWith make rpc call with context
-func (c *Client) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}) error {
+func (c *Client) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}) (err error) {
+	defer c.statCall(&err)
+
 	if err := c.checkStateAndMethod(method); err != nil {
 		return err
 	}
 
 	msg := c.newRequestMessage(CmdRequest, method, req, false, false)
+	if err := c.setOutgoingMetaFrom(ctx, msg); err != nil {
+		return err
+	}
+	span, err := c.startSpan(ctx, msg)
+	if err != nil {
+		return err
+	}
+	defer c.finishSpan(span, &err)
 	seq := msg.Seq()
 	sess := newSession(seq)
 	c.addSession(seq, sess)
 	defer c.deleteSession(seq)
 
+	if err = c.prepareSend(msg, true, nil, ctx.Done()); err != nil {
+		return err
+	}
+
 	select {
 	case c.chSend <- msg:
 	case <-ctx.Done():
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
 		return ErrClientTimeout
 	case <-c.chClose:
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
 		return ErrClientStopped
 	}
@@ -185,17 +333,20 @@ func (c *Client) CallAsync(method string, req interface{}, handler HandlerFunc,
 		return err
 	}
 
-	var timer *time.Timer
+	var timer Timer
 
 	msg := c.newRequestMessage(CmdRequest, method, req, false, true)
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
 	seq := msg.Seq()
 	if handler != nil {
 		c.addAsyncHandler(seq, handler)
-		timer = time.AfterFunc(timeout, func() { c.deleteAsyncHandler(seq) })
-		defer timer.Stop()
+		timer = c.Handler.Clock().AfterFunc(timeout, func() { c.deleteAsyncHandler(seq) })
+		defer stopTimer(timer)
 	} else if timeout > 0 {
-		timer = time.NewTimer(timeout)
-		defer timer.Stop()
+		timer = c.Handler.Clock().NewTimer(timeout)
+		defer stopTimer(timer)
 	}
 
 	switch timeout {
@@ -234,12 +385,15 @@ func (c *Client) Notify(method string, data interface{}, timeout time.Duration)
 	}
 
 	msg := c.newRequestMessage(CmdNotify, method, data, false, true)
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
 	switch timeout {
 	case TimeZero:
 		err = c.pushMessage(msg, nil)
 	default:
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+		timer := c.Handler.Clock().NewTimer(timeout)
+		defer stopTimer(timer)
 		err = c.pushMessage(msg, timer)
 	}
 
@@ -256,20 +410,57 @@ func (c *Client) checkNotifyArgs(method string, timeout time.Duration) error {
 	return nil
 }
 
+// TryNotify makes rpc notify without blocking, it returns ErrWouldBlock without calling OnOverstock
+// if the send queue is full, and depth of the send queue, so callers could shed load by themselves
+func (c *Client) TryNotify(method string, data interface{}) (int, error) {
+	if err := c.checkStateAndMethod(method); err != nil {
+		return len(c.chSend), err
+	}
+
+	msg := c.newRequestMessage(CmdNotify, method, data, false, true)
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return len(c.chSend), err
+	}
+	if err := c.prepareSend(msg, false, nil, nil); err != nil {
+		return len(c.chSend), err
+	}
+	select {
+	case c.chSend <- msg:
+		return len(c.chSend), nil
+	default:
+		c.cancelSend(msg)
+		return len(c.chSend), ErrWouldBlock
+	}
+}
+
 // NotifyWith make rpc notify with context
-func (c *Client) NotifyWith(ctx context.Context, method string, data interface{}) error {
+func (c *Client) NotifyWith(ctx context.Context, method string, data interface{}) (err error) {
 	if err := c.checkStateAndMethod(method); err != nil {
 		return err
 	}
 
 	msg := c.newRequestMessage(CmdNotify, method, data, false, true)
+	if err := c.setOutgoingMetaFrom(ctx, msg); err != nil {
+		return err
+	}
+	span, err := c.startSpan(ctx, msg)
+	if err != nil {
+		return err
+	}
+	defer c.finishSpan(span, &err)
+
+	if err := c.prepareSend(msg, true, nil, ctx.Done()); err != nil {
+		return err
+	}
 
 	select {
 	case c.chSend <- msg:
 	case <-ctx.Done():
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
 		return ErrClientTimeout
 	case <-c.chClose:
+		c.cancelSend(msg)
 		c.Handler.OnOverstock(c, msg)
 		return ErrClientStopped
 	}
@@ -281,6 +472,14 @@ func (c *Client) NotifyWith(ctx context.Context, method string, data interface{}
 func (c *Client) PushMsg(msg *Message, timeout time.Duration) error {
 	err := c.checkState()
 	if err != nil {
+		if err == ErrClientStopped {
+			if nc, ok := c.pushDetached(msg); ok {
+				if nc != nil {
+					return nc.PushMsg(msg, timeout)
+				}
+				return nil
+			}
+		}
 		return err
 	}
 
@@ -290,46 +489,64 @@ func (c *Client) PushMsg(msg *Message, timeout time.Duration) error {
 
 	switch timeout {
 	case TimeZero:
+		if err = c.prepareSend(msg, false, nil, nil); err != nil {
+			return err
+		}
 		select {
 		case c.chSend <- msg:
 		default:
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientOverstock
 		}
 	case TimeForever:
+		if err = c.prepareSend(msg, true, nil, nil); err != nil {
+			return err
+		}
 		select {
 		case c.chSend <- msg:
 		case <-c.chClose:
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientStopped
 		}
 	default:
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+		timer := c.Handler.Clock().NewTimer(timeout)
+		defer stopTimer(timer)
 		err = c.pushMessage(msg, timer)
 	}
 
 	return err
 }
 
-func (c *Client) pushMessage(msg *Message, timer *time.Timer) error {
+func (c *Client) pushMessage(msg *Message, timer Timer) error {
 	if timer == nil {
+		if err := c.prepareSend(msg, false, nil, nil); err != nil {
+			return err
+		}
 		select {
 		case c.chSend <- msg:
 		case <-c.chClose:
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientStopped
 		default:
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientOverstock
 		}
 	} else {
+		if err := c.prepareSend(msg, true, timer.C(), nil); err != nil {
+			return err
+		}
 		select {
 		case c.chSend <- msg:
-		case <-timer.C:
+		case <-timer.C():
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientTimeout
 		case <-c.chClose:
+			c.cancelSend(msg)
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientStopped
 		}
@@ -352,7 +569,31 @@ func (c *Client) checkStateAndMethod(method string) error {
 	if err != nil {
 		return err
 	}
-	return checkMethod(method)
+	if err := checkMethod(method); err != nil {
+		return err
+	}
+	if caps := c.Capabilities(); caps != nil && !caps.Supports(method) {
+		return ErrMethodNotSupported
+	}
+	return nil
+}
+
+// Run blocks until ctx is done or the client is stopped, the client is stopped when ctx is done.
+// It returns nil if stopped by ctx, otherwise the error closed the conn, or ErrClientStopped
+func (c *Client) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		c.Stop()
+		return nil
+	case <-c.chClose:
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := c.CloseErr(); err != nil {
+		return err
+	}
+	return ErrClientStopped
 }
 
 // Stop client
@@ -362,10 +603,22 @@ func (c *Client) Stop() {
 
 	if c.running {
 		c.running = false
+		// transited before the conn closed, so the reading loop never transits to reconnecting
+		c.transit(ClientStateStopped)
+		c.setCloseReason(CloseReasonLocal, nil)
+		c.recordDisconnect(c.CloseErr())
 		c.Conn.Close()
 		if c.chSend != nil {
 			close(c.chClose)
 		}
+		c.closeBudget()
+		c.stopTimers()
+		c.cancelConnContext()
+		c.resetStreams(ErrClientStopped)
+		if b := c.Handler.Broker(); b != nil {
+			b.UnsubscribeAll(c)
+		}
+		c.detach()
 		if c.onStop != nil {
 			c.onStop(c)
 		}
@@ -381,22 +634,31 @@ func (c *Client) parseResponse(msg *Message, rsp interface{}) error {
 	if msg == nil {
 		return ErrClientReconnecting
 	}
+	defer msg.Release()
 
 	switch msg.Cmd() {
 	case CmdResponse:
-		if msg.IsError() {
-			return msg.Error()
+		data, err := messageData(c.Handler, msg)
+		if err != nil {
+			return withRetryAfter(msg, err)
 		}
 		if rsp != nil {
 			switch vt := rsp.(type) {
 			case *string:
-				*vt = string(msg.Data())
+				*vt = string(data)
 			case *[]byte:
-				*vt = msg.Data()
+				if msg.alloc != nil {
+					data = append([]byte(nil), data...)
+				}
+				*vt = data
 			// case *error:
 			// 	*vt = msg.Error()
 			default:
-				return c.Codec.Unmarshal(msg.Data(), rsp)
+				cc, err := codecOf(c, msg.ContentType())
+				if err != nil {
+					return err
+				}
+				return cc.Unmarshal(data, rsp)
 			}
 		}
 	default:
@@ -407,6 +669,7 @@ func (c *Client) parseResponse(msg *Message, rsp interface{}) error {
 
 func (c *Client) addSession(seq uint64, session *rpcSession) {
 	c.mux.Lock()
+	c.checkSeq(seq)
 	c.sessionMap[seq] = session
 	c.mux.Unlock()
 }
@@ -450,6 +713,7 @@ func (c *Client) dropMessage(msg *Message) {
 
 func (c *Client) addAsyncHandler(seq uint64, h HandlerFunc) {
 	c.mux.Lock()
+	c.checkSeq(seq)
 	c.asyncHandlerMap[seq] = h
 	c.mux.Unlock()
 }
@@ -495,9 +759,16 @@ func (c *Client) Restart() error {
 		c.Conn = conn
 
 		c.chSend = make(chan *Message, c.Handler.SendQueueSize())
+		c.chUrgent = make(chan *Message, UrgentQueueSize)
+		c.chCredit = make(chan util.Empty, 1)
 		c.chClose = make(chan util.Empty)
 		c.sessionMap = make(map[uint64]*rpcSession)
 		c.asyncHandlerMap = make(map[uint64]HandlerFunc)
+		c.resetVarintHeader()
+		c.resetBatchAck()
+		c.resetWindows()
+		c.resetConnContext()
+		c.openBudget()
 
 		c.initReader()
 		go util.Safe(c.sendLoop)
@@ -505,8 +776,9 @@ func (c *Client) Restart() error {
 
 		c.running = true
 		c.reconnecting = false
+		c.transit(ClientStateConnected)
 
-		log.Info("%v\t[%v] Restarted to [%v]", c.Handler.LogTag(), preConn.RemoteAddr(), conn.RemoteAddr())
+		log.Info("%v\t[%v] Restarted to [%v]", c.logTag(), preConn.RemoteAddr(), conn.RemoteAddr())
 	}
 
 	return nil
@@ -517,6 +789,7 @@ func (c *Client) run() {
 	defer c.mux.Unlock()
 	if !c.running {
 		c.running = true
+		c.transit(ClientStateConnected)
 		c.initReader()
 		go util.Safe(c.sendLoop)
 		go util.Safe(c.recvLoop)
@@ -528,6 +801,7 @@ func (c *Client) runWebsocket() {
 	defer c.mux.Unlock()
 	if !c.running {
 		c.running = true
+		c.transit(ClientStateConnected)
 		c.initReader()
 		go util.Safe(c.sendLoop)
 		c.Conn.(WebsocketConn).HandleWebsocket(c.recvLoop)
@@ -549,40 +823,64 @@ func (c *Client) recvLoop() {
 		addr = c.Conn.RemoteAddr().String()
 	)
 
-	log.Debug("%v\t%v\trecvLoop start", c.Handler.LogTag(), addr)
-	defer log.Debug("%v\t%v\trecvLoop stop", c.Handler.LogTag(), addr)
+	c.labelGoroutine(labelLoopRecv)
+	log.Debug("%v\t%v\trecvLoop start", c.logTag(), addr)
+	defer log.Debug("%v\t%v\trecvLoop stop", c.logTag(), addr)
 
 	if c.Dialer == nil {
+		c.startKeepAlive()
 		for c.running {
+			ms := allocSampler.recv.begin()
 			msg, err = c.Handler.Recv(c)
+			allocSampler.recv.end(ms)
 			if err != nil {
-				log.Info("%v\t%v\tDisconnected: %v", c.Handler.LogTag(), addr, err)
+				c.setReadCloseReason(err)
+				log.Info("%v\t%v\tDisconnected [%v]: %v", c.logTag(), addr, c.CloseReason(), err)
+				c.onReadError(err)
+				c.reportProtocolError(err)
 				c.Stop()
 				return
 			}
-			c.Handler.OnMessage(c, msg)
+			c.statRecv(msg)
+			c.onMessage(msg)
 		}
 	} else {
-		go c.Handler.OnConnected(c)
+		go c.onConnected()
 
 		for c.running {
 			for {
+				ms := allocSampler.recv.begin()
 				msg, err = c.Handler.Recv(c)
+				allocSampler.recv.end(ms)
 				if err != nil {
-					log.Info("%v\t%v\tDisconnected: %v", c.Handler.LogTag(), addr, err)
+					c.setReadCloseReason(err)
+					log.Info("%v\t%v\tDisconnected [%v]: %v", c.logTag(), addr, c.CloseReason(), err)
+					c.onReadError(err)
+					c.reportProtocolError(err)
 					break
 				}
-				c.Handler.OnMessage(c, msg)
+				c.statRecv(msg)
+				c.onMessage(msg)
 			}
 
 			c.reconnecting = true
+			c.transit(ClientStateReconnecting)
+			c.recordDisconnect(err)
 
 			c.Conn.Close()
-			c.clearSession()
-			c.clearAsyncHandler()
+			c.resetVarintHeader()
+			c.resetBatchAck()
+			c.resetWindows()
+			if c.Handler.Migration() <= 0 {
+				c.clearSession()
+				c.clearAsyncHandler()
+			}
+			c.stopTimers()
+			c.cancelConnContext()
+			c.resetStreams(ErrClientReconnecting)
 
 			for c.running {
-				log.Info("%v\t%v\tReconnecting ...", c.Handler.LogTag(), addr)
+				log.Info("%v\t%v\tReconnecting ...", c.logTag(), addr)
 				conn, err := c.Dialer()
 				if err == nil {
 					c.Conn = conn
@@ -590,24 +888,57 @@ func (c *Client) recvLoop() {
 					c.initReader()
 
 					c.reconnecting = false
+					c.resetCloseReason()
+					c.resetConnContext()
+					c.setConnectedAt()
+					// not of a client stopped while dialing, it's restarted only by Client.Restart
+					c.transit(ClientStateConnected, ClientStateReconnecting)
 
-					log.Info("%v\t%v\tReconnected", c.Handler.LogTag(), addr)
+					log.Info("%v\t%v\tReconnected", c.logTag(), addr)
 
-					go c.Handler.OnConnected(c)
+					go c.onConnected()
 
 					break
 				}
 
-				time.Sleep(time.Second)
+				sleep(c.Handler.Clock(), time.Second, c.chClose)
 			}
 		}
 	}
 }
 
+func (c *Client) onMessage(msg *Message) {
+	ms := allocSampler.dispatch.begin()
+	c.Handler.OnMessage(c, msg)
+	allocSampler.dispatch.end(ms)
+}
+
+func (c *Client) onConnected() {
+	c.startKeepAlive()
+	if c.Handler.Migration() > 0 {
+		c.migrate()
+	}
+	if c.Handler.Capabilities() != nil {
+		c.fetchCapabilities()
+	}
+	if c.Handler.MethodIDs() {
+		c.negotiateMethods()
+	}
+	if c.Handler.VarintHeader() {
+		c.negotiateFeatures()
+	}
+	if c.Handler.BatchAck() > 0 {
+		c.negotiateBatchAck()
+	}
+	c.resubscribe()
+	c.Handler.OnConnected(c)
+}
+
 func (c *Client) sendLoop() {
 	addr := c.Conn.RemoteAddr().String()
-	log.Debug("%v\t%v\tsendLoop start", c.Handler.LogTag(), addr)
-	defer log.Debug("%v\t%v\tsendLoop stop", c.Handler.LogTag(), addr)
+	c.labelGoroutine(labelLoopSend)
+	log.Debug("%v\t%v\tsendLoop start", c.logTag(), addr)
+	defer log.Debug("%v\t%v\tsendLoop stop", c.logTag(), addr)
 
 	if c.Handler.BatchSend() {
 		c.batchSendLoop()
@@ -619,84 +950,190 @@ func (c *Client) sendLoop() {
 func (c *Client) normalSendLoop() {
 	var msg *Message
 	var coders = c.Handler.Coders()
+	var varint = c.Handler.VarintHeader()
 	for {
+		// messages of the urgent lane are sent before those of the send queue
 		select {
-		case msg = <-c.chSend:
-			if !c.reconnecting {
-				for j := 0; j < len(coders); j++ {
-					msg = coders[j].Encode(c, msg)
-				}
-				if _, err := c.Handler.Send(c.Conn, msg.Buffer); err != nil {
-					c.Conn.Close()
+		case msg = <-c.chUrgent:
+		default:
+			select {
+			case msg = <-c.chUrgent:
+			case msg = <-c.chSend:
+				c.uncharge(msg)
+			case <-c.chCredit:
+				for _, m := range c.takeCredits() {
+					c.sendMessage(m, coders, varint)
 				}
-			} else {
-				c.dropMessage(msg)
+				continue
+			case <-c.chClose:
+				return
 			}
-		case <-c.chClose:
-			return
 		}
+		c.sendMessage(msg, coders, varint)
 	}
 }
 
+// sendMessage writes msg to the conn for the normal send loop
+func (c *Client) sendMessage(msg *Message, coders []MessageCoder, varint bool) {
+	c.recordFrame(FlightSend, msg)
+	if !c.reconnecting {
+		ms := allocSampler.send.begin()
+		sw := varint && isVarintSwitch(msg)
+		m := encodeMethodID(c, msg)
+		for j := 0; j < len(coders); j++ {
+			m = coders[j].Encode(c, m)
+		}
+		n, err := c.Handler.Send(c.Conn, c.frame(m.Buffer, sw))
+		if err != nil {
+			c.closeOnWriteError(err)
+		} else {
+			c.statSend(1, n)
+		}
+		allocSampler.send.end(ms)
+	} else {
+		c.dropMessage(msg)
+	}
+	msg.written()
+}
+
 func (c *Client) batchSendLoop() {
 	var msg *Message
 	var coders = c.Handler.Coders()
+	var varint = c.Handler.VarintHeader()
 	var messages []*Message = make([]*Message, 10)[0:0]
 	var buffers net.Buffers = make([][]byte, 10)[0:0]
+	var bufferSize = c.Handler.SendBufferSize()
+	var flushC <-chan time.Time
+	if bufferSize > 0 {
+		defer c.releaseWriter()
+		if interval := c.Handler.FlushInterval(); interval > 0 {
+			ticker := c.Handler.Clock().NewTicker(interval)
+			defer ticker.Stop()
+			flushC = ticker.C()
+		}
+	}
 	for {
+		// messages of the urgent lane are sent before those of the send queue, and flushed
+		// from the buffered conn at once
+		urgent := true
 		select {
-		case msg = <-c.chSend:
-		case <-c.chClose:
-			return
+		case msg = <-c.chUrgent:
+		default:
+			select {
+			case msg = <-c.chUrgent:
+			case msg = <-c.chSend:
+				urgent = false
+				c.uncharge(msg)
+			case <-c.chCredit:
+				msg = nil
+			case <-flushC:
+				if err := c.Flush(); err != nil {
+					c.closeOnWriteError(err)
+				}
+				continue
+			case <-c.chClose:
+				return
+			}
+		}
+		if msg != nil {
+			c.recordFrame(FlightSend, msg)
+			messages = append(messages, msg)
+		} else {
+			// credit updates are sent as urgent messages
+			for _, m := range c.takeCredits() {
+				c.recordFrame(FlightSend, m)
+				messages = append(messages, m)
+			}
+			if len(messages) == 0 {
+				continue
+			}
+		}
+		for len(c.chUrgent) > 0 && len(messages) < 10 {
+			msg = <-c.chUrgent
+			urgent = true
+			c.recordFrame(FlightSend, msg)
+			messages = append(messages, msg)
 		}
-		messages = append(messages, msg)
 		for i := 1; i < len(c.chSend) && i < 10; i++ {
 			msg = <-c.chSend
+			c.uncharge(msg)
+			c.recordFrame(FlightSend, msg)
 			messages = append(messages, msg)
 		}
 		if !c.reconnecting {
+			ms := allocSampler.send.begin()
 			if len(messages) == 1 {
+				sw := varint && isVarintSwitch(messages[0])
+				m := encodeMethodID(c, messages[0])
 				for j := 0; j < len(coders); j++ {
-					messages[0] = coders[j].Encode(c, messages[0])
+					m = coders[j].Encode(c, m)
 				}
-				if _, err := c.Handler.Send(c.Conn, messages[0].Buffer); err != nil {
-					c.Conn.Close()
+				n, err := c.Handler.Send(c.lockWriter(bufferSize), c.frame(m.Buffer, sw))
+				if err = c.unlockWriter(bufferSize, err); err != nil {
+					c.closeOnWriteError(err)
+				} else {
+					c.statSend(1, n)
 				}
 			} else {
 				for i := 0; i < len(messages); i++ {
+					sw := varint && isVarintSwitch(messages[i])
+					m := encodeMethodID(c, messages[i])
 					for j := 0; j < len(coders); j++ {
-						messages[i] = coders[j].Encode(c, messages[i])
+						m = coders[j].Encode(c, m)
 					}
-					buffers = append(buffers, messages[i].Buffer)
+					buffers = append(buffers, c.frame(m.Buffer, sw))
 				}
-				if _, err := c.Handler.SendN(c.Conn, buffers); err != nil {
-					c.Conn.Close()
+				n, err := c.Handler.SendN(c.lockWriter(bufferSize), buffers)
+				if err = c.unlockWriter(bufferSize, err); err != nil {
+					c.closeOnWriteError(err)
+				} else {
+					c.statSend(len(messages), n)
 				}
 				buffers = buffers[0:0]
 			}
+			if urgent && bufferSize > 0 {
+				if err := c.Flush(); err != nil {
+					c.closeOnWriteError(err)
+				}
+			}
+			allocSampler.send.end(ms)
 		} else {
 			for _, m := range messages {
 				c.dropMessage(m)
 			}
 		}
+		for i, m := range messages {
+			m.written()
+			messages[i] = nil
+		}
 		messages = messages[0:0]
 	}
 }
 
 // newClientWithConn factory
 func newClientWithConn(conn net.Conn, codec codec.Codec, handler Handler, onStop func(*Client)) *Client {
+	return newClientWithRealAddr(conn, nil, codec, handler, onStop)
+}
+
+// newClientWithRealAddr factory, realAddr is the source address of PROXY protocol header
+func newClientWithRealAddr(conn net.Conn, realAddr net.Addr, codec codec.Codec, handler Handler, onStop func(*Client)) *Client {
 	log.Info("%v\t%v\tConnected", handler.LogTag(), conn.RemoteAddr())
 
 	c := &Client{}
 	c.Conn = conn
+	c.realAddr = realAddr
 	c.Head = Header(c.head[:])
 	c.Codec = codec
 	c.Handler = handler
 	c.chSend = make(chan *Message, c.Handler.SendQueueSize())
+	c.chUrgent = make(chan *Message, UrgentQueueSize)
+	c.chCredit = make(chan util.Empty, 1)
 	c.chClose = make(chan util.Empty)
 	c.sessionMap = make(map[uint64]*rpcSession)
 	c.asyncHandlerMap = make(map[uint64]HandlerFunc)
 	c.onStop = onStop
+	trackClient(c)
+	c.setConnectedAt()
 
 	if _, ok := conn.(WebsocketConn); !ok {
 		c.run()
@@ -707,8 +1144,23 @@ func newClientWithConn(conn net.Conn, codec codec.Codec, handler Handler, onStop
 	return c
 }
 
+// WithHandler sets handler of the client before its loops start, replacing Client.Handler after
+// NewClient returned races with them
+func WithHandler(h Handler) ClientOption {
+	return func(c *Client) {
+		c.Handler = h
+	}
+}
+
+// WithCodec sets codec of the client before its loops start
+func WithCodec(codec codec.Codec) ClientOption {
+	return func(c *Client) {
+		c.Codec = codec
+	}
+}
+
 // NewClient factory
-func NewClient(dialer DialerFunc) (*Client, error) {
+func NewClient(dialer DialerFunc, opts ...ClientOption) (*Client, error) {
 	conn, err := dialer()
 	if err != nil {
 		return nil, err
@@ -722,13 +1174,20 @@ func NewClient(dialer DialerFunc) (*Client, error) {
 	c.Handler = DefaultHandler.Clone()
 	c.Dialer = dialer
 	c.chSend = make(chan *Message, c.Handler.SendQueueSize())
+	c.chUrgent = make(chan *Message, UrgentQueueSize)
+	c.chCredit = make(chan util.Empty, 1)
 	c.chClose = make(chan util.Empty)
 	c.sessionMap = make(map[uint64]*rpcSession)
 	c.asyncHandlerMap = make(map[uint64]HandlerFunc)
+	for _, opt := range opts {
+		opt(c)
+	}
+	trackClient(c)
+	c.setConnectedAt()
 
 	c.run()
 
-	log.Info("%v\t%v\tConnected", c.Handler.LogTag(), conn.RemoteAddr())
+	log.Info("%v\t%v\tConnected", c.logTag(), conn.RemoteAddr())
 
 	return c, nil
 }
@@ -778,7 +1237,7 @@ func (pool *ClientPool) Stop() {
 }
 
 // NewClientPool factory
-func NewClientPool(dialer DialerFunc, size int) (*ClientPool, error) {
+func NewClientPool(dialer DialerFunc, size int, opts ...ClientOption) (*ClientPool, error) {
 	pool := &ClientPool{
 		size:    uint64(size),
 		round:   0xFFFFFFFFFFFFFFFF,
@@ -786,15 +1245,16 @@ func NewClientPool(dialer DialerFunc, size int) (*ClientPool, error) {
 	}
 
 	for i := 0; i < size; i++ {
-		c, err := NewClient(dialer)
+		c, err := NewClient(dialer, opts...)
 		if err != nil {
 			for j := 0; j < i; j++ {
 				pool.clients[j].Stop()
 			}
 			return nil, err
 		}
-		if i > 0 {
-			c.Handler = pool.clients[0].Handler
+		if i == 0 {
+			// clients share the handler of the first one, set before their loops start
+			opts = append(opts[:len(opts):len(opts)], WithHandler(c.Handler))
 		}
 		pool.clients[i] = c
 	}
@@ -803,7 +1263,7 @@ func NewClientPool(dialer DialerFunc, size int) (*ClientPool, error) {
 }
 
 // NewClientPoolFromDialers factory
-func NewClientPoolFromDialers(dialers []DialerFunc) (*ClientPool, error) {
+func NewClientPoolFromDialers(dialers []DialerFunc, opts ...ClientOption) (*ClientPool, error) {
 	pool := &ClientPool{
 		size:    0,
 		round:   0xFFFFFFFFFFFFFFFF,
@@ -813,19 +1273,17 @@ func NewClientPoolFromDialers(dialers []DialerFunc) (*ClientPool, error) {
 	if len(dialers) == 0 {
 		return nil, ErrClientInvalidPoolDialers
 	}
-	var h Handler
-	for _, dialer := range dialers {
-		c, err := NewClient(dialer)
+	for i, dialer := range dialers {
+		c, err := NewClient(dialer, opts...)
 		if err != nil {
 			for j := 0; j < len(pool.clients); j++ {
 				pool.clients[j].Stop()
 			}
 			return nil, err
 		}
-		if h == nil {
-			h = c.Handler
-		} else {
-			c.Handler = h
+		if i == 0 {
+			// clients share the handler of the first one, set before their loops start
+			opts = append(opts[:len(opts):len(opts)], WithHandler(c.Handler))
 		}
 		pool.clients = append(pool.clients, c)
 	}
@@ -11,6 +11,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"github.com/lesismal/arpc/codec"
 )
 
 var (
@@ -871,3 +873,35 @@ func testNewClientPoolFromDialers(t *testing.T) {
 	testServer.Stop()
 	time.Sleep(time.Second / 10)
 }
+
+func TestClient_Stats(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	c.Call(methodCallString, "hello", nil, time.Second)
+	c.Call(methodCallError, "error", nil, time.Second)
+	st := c.Stats()
+	if st.Calls != 2 || st.CallErrors != 1 || st.MessagesIn != 2 || st.MessagesOut != 2 || st.BytesIn == 0 || st.BytesOut == 0 {
+		t.Fatalf("Client.Stats() = %+v", st)
+	}
+}
+
+func TestClient_TryNotify(t *testing.T) {
+	c := &Client{Codec: codec.DefaultCodec, Handler: NewHandler(), chSend: make(chan *Message, 2), running: true}
+	for i := 1; i <= 2; i++ {
+		depth, err := c.TryNotify("/try", "data")
+		if err != nil || depth != i {
+			t.Fatalf("Client.TryNotify() = (%v, %v), want (%v, nil)", depth, err, i)
+		}
+	}
+	depth, err := c.TryNotify("/try", "data")
+	if err != ErrWouldBlock || depth != 2 {
+		t.Fatalf("Client.TryNotify() = (%v, %v), want (2, %v)", depth, err, ErrWouldBlock)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// MetaKeyClientLabels carries labels of the client on requests and notifies, url query encoded
+const MetaKeyClientLabels = "arpc-client-labels"
+
+// ClientOption configures a Client at construction, see NewClient
+type ClientOption func(c *Client)
+
+// WithLabels attaches static labels to the client, e.g. tenant or component, to disambiguate many
+// clients in one process. Labels are added to logs of the client, metrics pushed by
+// metrics.Pusher and metadata of requests and notifies
+func WithLabels(labels map[string]string) ClientOption {
+	return func(c *Client) {
+		if len(labels) == 0 {
+			return
+		}
+		c.labels = make(map[string]string, len(labels))
+		values := url.Values{}
+		keys := make([]string, 0, len(labels))
+		for k, v := range labels {
+			c.labels[k] = v
+			values.Set(k, v)
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			pairs[i] = k + "=" + labels[k]
+		}
+		c.labelsMeta = values.Encode()
+		c.labelsTag = "[" + strings.Join(pairs, " ") + "]"
+	}
+}
+
+// Labels returns a copy of labels of the client, nil if none
+func (c *Client) Labels() map[string]string {
+	if len(c.labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(c.labels))
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// logTag returns log tag of the handler with labels of the client
+func (c *Client) logTag() string {
+	if c.labelsTag == "" {
+		return c.Handler.LogTag()
+	}
+	return c.Handler.LogTag() + c.labelsTag
+}
+
+// ClientLabels returns labels of the client sent the message, nil if none
+func (ctx *Context) ClientLabels() map[string]string {
+	value, ok := ctx.Meta().Get(MetaKeyClientLabels)
+	if !ok || value == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(value)
+	if err != nil {
+		return nil
+	}
+	labels := make(map[string]string, len(values))
+	for k := range values {
+		labels[k] = values.Get(k)
+	}
+	return labels
+}
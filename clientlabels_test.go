@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientLabels(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/labels", func(ctx *Context) {
+		labels := ctx.ClientLabels()
+		ctx.Write(labels["tenant"] + "/" + labels["component"] + "/" + ctx.Meta()["k"])
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, WithLabels(map[string]string{"tenant": "a&b", "component": "billing"}))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	labels := c.Labels()
+	labels["tenant"] = "changed"
+	if c.Labels()["tenant"] != "a&b" {
+		t.Fatalf("Client.Labels() returned labels of the client, want a copy")
+	}
+	if tag := c.logTag(); !strings.HasSuffix(tag, "[component=billing tenant=a&b]") {
+		t.Fatalf("Client.logTag() = %v, want labels", tag)
+	}
+
+	rsp := ""
+	if err = c.Call("/labels", nil, &rsp, time.Second); err != nil || rsp != "a&b/billing/" {
+		t.Fatalf("Client.Call() = (%v, %v), want a&b/billing/", rsp, err)
+	}
+	// labels are merged with metadata of options
+	if err = c.CallWithOptions("/labels", nil, &rsp, time.Second, WithMeta(Metadata{"k": "v"})); err != nil || rsp != "a&b/billing/v" {
+		t.Fatalf("Client.CallWithOptions() = (%v, %v), want a&b/billing/v", rsp, err)
+	}
+
+	// labels are not dropped silently, calls fail if metadata has no room for them
+	large, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, WithLabels(map[string]string{"tenant": strings.Repeat("a", MaxMetaLen-len("tenant="))}))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer large.Stop()
+	if err = large.Call("/labels", nil, &rsp, time.Second); err != ErrMetaTooLarge {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+	if err = large.Notify("/labels", nil, time.Second); err != ErrMetaTooLarge {
+		t.Fatalf("Client.Notify() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync/atomic"
+)
+
+// ClientState defines state of the lifecycle of a Client:
+//
+//	ClientStateNew          -> ClientStateConnected     running
+//	ClientStateConnected    -> ClientStateReconnecting  disconnected, only of clients with Dialer
+//	ClientStateReconnecting -> ClientStateConnected     reconnected
+//	ClientStateConnected    -> ClientStateStopped       Client.Stop, or disconnected without Dialer
+//	ClientStateReconnecting -> ClientStateStopped       Client.Stop
+//	ClientStateStopped      -> ClientStateConnected     Client.Restart
+type ClientState int32
+
+const (
+	// ClientStateNew means the client is created and not running yet
+	ClientStateNew ClientState = iota
+	// ClientStateConnected means the client is running on a conn
+	ClientStateConnected
+	// ClientStateReconnecting means the conn is closed and the client is dialing again
+	ClientStateReconnecting
+	// ClientStateStopped means the client is stopped, it runs again only by Client.Restart
+	ClientStateStopped
+)
+
+var clientStateNames = []string{"new", "connected", "reconnecting", "stopped"}
+
+// clientTransitions are the allowed transitions, indexed by the state transited from
+var clientTransitions = [][]ClientState{
+	ClientStateNew:          {ClientStateConnected},
+	ClientStateConnected:    {ClientStateReconnecting, ClientStateStopped},
+	ClientStateReconnecting: {ClientStateConnected, ClientStateStopped},
+	ClientStateStopped:      {ClientStateConnected},
+}
+
+// String implements fmt.Stringer
+func (s ClientState) String() string {
+	if s >= 0 && int(s) < len(clientStateNames) {
+		return clientStateNames[s]
+	}
+	return "unknown"
+}
+
+// CanTransit returns whether a client transits from state from to state to
+func CanTransit(from, to ClientState) bool {
+	if from < 0 || int(from) >= len(clientTransitions) {
+		return false
+	}
+	return containsState(clientTransitions[from], to)
+}
+
+// Transitions returns states a client in state s transits to
+func (s ClientState) Transitions() []ClientState {
+	if s < 0 || int(s) >= len(clientTransitions) {
+		return nil
+	}
+	return append([]ClientState(nil), clientTransitions[s]...)
+}
+
+// State returns the current state of the lifecycle
+func (c *Client) State() ClientState {
+	return ClientState(atomic.LoadInt32(&c.state))
+}
+
+// transit changes state of c to to if allowed from the current state, and the current state is one
+// of from if any, then calls Handler.OnStateChange. Transitions not allowed are ignored, e.g. a
+// disconnection observed by the reading loop after the client is stopped
+func (c *Client) transit(to ClientState, from ...ClientState) bool {
+	for {
+		curr := c.State()
+		if !CanTransit(curr, to) || (len(from) > 0 && !containsState(from, curr)) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.state, int32(curr), int32(to)) {
+			c.Handler.OnStateChange(c, curr, to)
+			return true
+		}
+	}
+}
+
+func containsState(states []ClientState, s ClientState) bool {
+	for _, v := range states {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) HandleStateChange(onStateChange func(c *Client, from, to ClientState)) {
+	h.update(func(s *handlerState) { s.onStateChange = onStateChange })
+}
+
+func (h *handler) OnStateChange(c *Client, from, to ClientState) {
+	if s := h.load(); s.onStateChange != nil {
+		s.onStateChange(c, from, to)
+	}
+}
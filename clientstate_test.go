@@ -0,0 +1,104 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCanTransit(t *testing.T) {
+	cases := []struct {
+		from, to ClientState
+		want     bool
+	}{
+		{ClientStateNew, ClientStateConnected, true},
+		{ClientStateNew, ClientStateStopped, false},
+		{ClientStateConnected, ClientStateReconnecting, true},
+		{ClientStateConnected, ClientStateStopped, true},
+		{ClientStateReconnecting, ClientStateConnected, true},
+		{ClientStateReconnecting, ClientStateStopped, true},
+		{ClientStateStopped, ClientStateReconnecting, false},
+		{ClientStateStopped, ClientStateConnected, true},
+		{ClientStateConnected, ClientStateConnected, false},
+		{ClientState(9), ClientStateConnected, false},
+	}
+	for _, v := range cases {
+		if got := CanTransit(v.from, v.to); got != v.want {
+			t.Fatalf("CanTransit(%v, %v) = %v, want %v", v.from, v.to, got, v.want)
+		}
+	}
+	if s := ClientState(9).String(); s != "unknown" {
+		t.Fatalf("ClientState(9).String() = %v, want unknown", s)
+	}
+	if ts := ClientStateStopped.Transitions(); len(ts) != 1 || ts[0] != ClientStateConnected {
+		t.Fatalf("ClientStateStopped.Transitions() = %v, want [connected]", ts)
+	}
+}
+
+func TestClient_State(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/state/kick", func(ctx *Context) {
+		ctx.Client.Stop()
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	type transition struct{ from, to ClientState }
+	transitions := make(chan transition, 8)
+	h := NewHandler()
+	h.HandleStateChange(func(c *Client, from, to ClientState) {
+		if c.State() != to {
+			t.Errorf("Client.State() = %v in OnStateChange, want %v", c.State(), to)
+		}
+		transitions <- transition{from, to}
+	})
+	expect := func(from, to ClientState) {
+		select {
+		case v := <-transitions:
+			if v.from != from || v.to != to {
+				t.Fatalf("transition %v -> %v, want %v -> %v", v.from, v.to, from, to)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("no transition, want %v -> %v", from, to)
+		}
+	}
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Stop()
+	expect(ClientStateNew, ClientStateConnected)
+
+	// closed by the server, then reconnected by Dialer
+	c.Notify("/state/kick", nil, time.Second)
+	expect(ClientStateConnected, ClientStateReconnecting)
+	expect(ClientStateReconnecting, ClientStateConnected)
+
+	c.Stop()
+	expect(ClientStateConnected, ClientStateStopped)
+	c.Stop()
+	if err = c.Restart(); err != nil {
+		t.Fatalf("Client.Restart() failed: %v", err)
+	}
+	expect(ClientStateStopped, ClientStateConnected)
+	if s := c.State(); s != ClientStateConnected {
+		t.Fatalf("Client.State() = %v, want %v", s, ClientStateConnected)
+	}
+	select {
+	case v := <-transitions:
+		t.Fatalf("unexpected transition %v -> %v", v.from, v.to)
+	default:
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// Clock provides current time and timers of timeouts and intervals, see Handler.SetClock
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the timer of a Clock, C returns nil for timers created by AfterFunc
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of package time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// stopTimer stops t created for a single call, pooled timers go back to their pool, e.g. timers
+// of TimerWheel, t should not be used after
+func stopTimer(t Timer) {
+	t.Stop()
+	if p, ok := t.(interface{ release() }); ok {
+		p.release()
+	}
+}
+
+// sleep waits for d on clock or until done is closed, returns false if done is closed
+func sleep(clock Clock, d time.Duration, done <-chan util.Empty) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// MockClock is a Clock whose time only moves by Advance, for tests and simulations
+type MockClock struct {
+	mux    sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*mockTimer
+}
+
+// NewMockClock returns a MockClock starting at now
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+type mockTimer struct {
+	clock  *MockClock
+	at     time.Time
+	seq    uint64
+	period time.Duration
+	ch     chan time.Time
+	f      func()
+	active bool
+}
+
+// Now returns current time of the clock
+func (c *MockClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer fired when the clock is advanced by d
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0, make(chan time.Time, 1), nil)
+}
+
+// AfterFunc calls f in the goroutine of Advance when the clock is advanced by d
+func (c *MockClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, 0, nil, f)
+}
+
+// NewTicker creates a ticker fired each time the clock is advanced by d
+func (c *MockClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("arpc: non-positive interval for MockClock.NewTicker")
+	}
+	return mockTicker{c.add(d, d, make(chan time.Time, 1), nil)}
+}
+
+// Timers returns number of active timers and tickers
+func (c *MockClock) Timers() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by d and fires due timers in time order
+func (c *MockClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.at
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			c.insert(t)
+		} else {
+			t.active = false
+		}
+		c.mux.Unlock()
+		t.fire()
+		c.mux.Lock()
+	}
+	c.now = end
+	c.mux.Unlock()
+}
+
+func (c *MockClock) add(d, period time.Duration, ch chan time.Time, f func()) *mockTimer {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := &mockTimer{clock: c, period: period, ch: ch, f: f}
+	c.schedule(t, d)
+	return t
+}
+
+func (c *MockClock) schedule(t *mockTimer, d time.Duration) {
+	c.seq++
+	t.at, t.seq, t.active = c.now.Add(d), c.seq, true
+	c.insert(t)
+}
+
+// insert keeps timers ordered by fired time, then creation order
+func (c *MockClock) insert(t *mockTimer) {
+	i := sort.Search(len(c.timers), func(i int) bool {
+		o := c.timers[i]
+		return o.at.After(t.at) || (o.at.Equal(t.at) && o.seq > t.seq)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+}
+
+func (c *MockClock) remove(t *mockTimer) bool {
+	if !t.active {
+		return false
+	}
+	t.active = false
+	for i, o := range c.timers {
+		if o == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (t *mockTimer) fire() {
+	if t.f != nil {
+		t.f()
+		return
+	}
+	select {
+	case t.ch <- t.clock.Now():
+	default:
+	}
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+	active := t.clock.remove(t)
+	t.clock.schedule(t, d)
+	return active
+}
+
+type mockTicker struct {
+	*mockTimer
+}
+
+func (t mockTicker) Stop() {
+	t.mockTimer.Stop()
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMockClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	mc := NewMockClock(start)
+
+	var fired []int
+	mc.AfterFunc(time.Second*2, func() { fired = append(fired, 2) })
+	mc.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := mc.AfterFunc(time.Second, func() { fired = append(fired, 0) })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("Timer.Stop() should return true only once")
+	}
+	timer := mc.NewTimer(time.Second * 3)
+	ticker := mc.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	mc.Advance(time.Second * 2)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 2 {
+		t.Fatalf("AfterFunc fired %v, want [1 2]", fired)
+	}
+	if got := <-ticker.C(); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("Ticker.C() = %v, want %v", got, start.Add(time.Second))
+	}
+	select {
+	case <-timer.C():
+		t.Fatalf("timer fired before due")
+	default:
+	}
+
+	timer.Reset(time.Second * 2)
+	mc.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("reset timer fired before due")
+	default:
+	}
+	mc.Advance(time.Second)
+	if got := <-timer.C(); !got.Equal(start.Add(time.Second * 4)) {
+		t.Fatalf("Timer.C() = %v, want %v", got, start.Add(time.Second*4))
+	}
+	if !mc.Now().Equal(start.Add(time.Second * 4)) {
+		t.Fatalf("MockClock.Now() = %v, want %v", mc.Now(), start.Add(time.Second*4))
+	}
+	if n := mc.Timers(); n != 1 {
+		t.Fatalf("MockClock.Timers() = %v, want 1", n)
+	}
+}
+
+func TestClient_MockClockTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/clock/never", func(ctx *Context) {})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	mc := NewMockClock(time.Now())
+	h := DefaultHandler.Clone()
+	h.SetClock(mc)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	chErr := make(chan error, 1)
+	go func() { chErr <- c.Call("/clock/never", nil, nil, time.Hour) }()
+	for i := 0; mc.Timers() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("call timer not created on mock clock")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	mc.Advance(time.Hour)
+	select {
+	case err = <-chErr:
+		if err != ErrClientTimeout {
+			t.Fatalf("Client.Call() error = %v, want %v", err, ErrClientTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Client.Call() not timed out by mock clock")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// CloseReason defines why the conn of a Client is closed
+type CloseReason int
+
+const (
+	// CloseReasonNone means the conn is not closed
+	CloseReasonNone CloseReason = iota
+	// CloseReasonLocal means the conn is closed by Client.Stop
+	CloseReasonLocal
+	// CloseReasonRemote means the conn is closed by the peer
+	CloseReasonRemote
+	// CloseReasonReadError means reading failed, e.g. reset by the peer or a protocol violation
+	CloseReasonReadError
+	// CloseReasonWriteError means writing failed
+	CloseReasonWriteError
+	// CloseReasonIdleTimeout means read deadline exceeded, e.g. set in Handler.BeforeRecv
+	CloseReasonIdleTimeout
+)
+
+var closeReasonNames = []string{"none", "local close", "remote close", "read error", "write error", "idle timeout"}
+
+// String implements fmt.Stringer
+func (r CloseReason) String() string {
+	if r >= 0 && int(r) < len(closeReasonNames) {
+		return closeReasonNames[r]
+	}
+	return "unknown"
+}
+
+// CloseReason returns why the conn is closed, CloseReasonNone if connected, it's available in
+// callbacks of Handler.HandleDisconnected
+func (c *Client) CloseReason() CloseReason {
+	c.cmux.Lock()
+	defer c.cmux.Unlock()
+	return c.closeReason
+}
+
+// CloseErr returns the error that closed the conn, nil for local close and if connected, the peer's
+// ProtocolError if it reported one before closing
+func (c *Client) CloseErr() error {
+	c.cmux.Lock()
+	defer c.cmux.Unlock()
+	return c.closeErr
+}
+
+// setCloseReason records the first reason of closing the current conn
+func (c *Client) setCloseReason(reason CloseReason, err error) {
+	c.cmux.Lock()
+	if c.closeReason == CloseReasonNone {
+		c.closeReason, c.closeErr = reason, err
+	}
+	c.cmux.Unlock()
+}
+
+// resetCloseReason is called when reconnected
+func (c *Client) resetCloseReason() {
+	c.cmux.Lock()
+	c.closeReason, c.closeErr = CloseReasonNone, nil
+	c.cmux.Unlock()
+}
+
+// setReadCloseReason classifies err of reading
+func (c *Client) setReadCloseReason(err error) {
+	if pe := c.PeerProtocolError(); pe != nil {
+		c.setCloseReason(CloseReasonRemote, pe)
+		return
+	}
+	var ne net.Error
+	switch {
+	case err == io.EOF:
+		c.setCloseReason(CloseReasonRemote, err)
+	case errors.As(err, &ne) && ne.Timeout():
+		c.setCloseReason(CloseReasonIdleTimeout, err)
+	default:
+		c.setCloseReason(CloseReasonReadError, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_CloseReason(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	chReason := make(chan CloseReason, 2)
+	svr.Handler.HandleDisconnected(func(c *Client) {
+		chReason <- c.CloseReason()
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	c, err := NewClient(dial)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if c.CloseReason() != CloseReasonNone {
+		t.Fatalf("Client.CloseReason() = %v, want %v", c.CloseReason(), CloseReasonNone)
+	}
+	c.Stop()
+	if c.CloseReason() != CloseReasonLocal || c.CloseErr() != nil {
+		t.Fatalf("Client.CloseReason() = (%v, %v), want (%v, nil)", c.CloseReason(), c.CloseErr(), CloseReasonLocal)
+	}
+	select {
+	case reason := <-chReason:
+		if reason != CloseReasonRemote {
+			t.Fatalf("server side CloseReason() = %v, want %v", reason, CloseReasonRemote)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server side not disconnected")
+	}
+
+	svr.Handler.BeforeRecv(func(conn net.Conn) error {
+		return conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	})
+	c, err = NewClient(dial)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	select {
+	case reason := <-chReason:
+		if reason != CloseReasonIdleTimeout {
+			t.Fatalf("server side CloseReason() = %v, want %v", reason, CloseReasonIdleTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server side not closed by idle timeout")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// Coalescer collapses identical calls of Client in flight into one request, the callers share its
+// response or error. It's only for idempotent methods, e.g. reads of hot keys.
+//
+// The request is sent by the first caller with its timeout or context, callers joined later wait
+// for it, or until their own timeout or context is done.
+type Coalescer struct {
+	Client *Client
+
+	// Key returns key of a call, calls of the same key share a request, calls are not coalesced if
+	// it returns an empty string. By default, it's the method with the encoded request
+	Key func(method string, req interface{}) string
+
+	mux   sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+	// dups is the number of callers joined
+	dups int
+}
+
+// NewCoalescer returns Coalescer of c
+func NewCoalescer(c *Client) *Coalescer {
+	return &Coalescer{Client: c}
+}
+
+func (co *Coalescer) key(method string, req interface{}) string {
+	if co.Key != nil {
+		return co.Key(method, req)
+	}
+	return method + "\x00" + string(util.ValueToBytes(co.Client.Codec, req))
+}
+
+// Call makes rpc call with timeout, shares the request with identical calls in flight
+func (co *Coalescer) Call(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+	return co.do(method, req, rsp, timeout, nil, func(data *[]byte) error {
+		return co.Client.Call(method, req, data, timeout)
+	})
+}
+
+// CallWith makes rpc call with context, shares the request with identical calls in flight
+func (co *Coalescer) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}) error {
+	return co.do(method, req, rsp, 0, ctx.Done(), func(data *[]byte) error {
+		return co.Client.CallWith(ctx, method, req, data)
+	})
+}
+
+func (co *Coalescer) do(method string, req interface{}, rsp interface{}, timeout time.Duration, ctxDone <-chan struct{}, call func(data *[]byte) error) error {
+	key := co.key(method, req)
+	if key == "" {
+		var data []byte
+		if err := call(&data); err != nil {
+			return err
+		}
+		return co.decode(data, rsp)
+	}
+
+	co.mux.Lock()
+	if co.calls == nil {
+		co.calls = map[string]*coalescedCall{}
+	}
+	if cc, ok := co.calls[key]; ok {
+		cc.dups++
+		co.mux.Unlock()
+		return co.wait(cc, rsp, timeout, ctxDone)
+	}
+	cc := &coalescedCall{done: make(chan struct{})}
+	co.calls[key] = cc
+	co.mux.Unlock()
+
+	cc.err = call(&cc.data)
+
+	co.mux.Lock()
+	delete(co.calls, key)
+	co.mux.Unlock()
+	close(cc.done)
+
+	if cc.err != nil {
+		return cc.err
+	}
+	return co.decode(cc.data, rsp)
+}
+
+// wait waits for the request shared, until timeout or ctxDone
+func (co *Coalescer) wait(cc *coalescedCall, rsp interface{}, timeout time.Duration, ctxDone <-chan struct{}) error {
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := co.Client.Handler.Clock().NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C()
+	}
+	select {
+	case <-cc.done:
+	case <-timeoutC:
+		return ErrClientTimeout
+	case <-ctxDone:
+		return ErrClientTimeout
+	}
+	if cc.err != nil {
+		return cc.err
+	}
+	return co.decode(cc.data, rsp)
+}
+
+// decode decodes data shared into rsp of each caller, bytes are copied for callers may modify them
+func (co *Coalescer) decode(data []byte, rsp interface{}) error {
+	if rsp == nil {
+		return nil
+	}
+	switch vt := rsp.(type) {
+	case *string:
+		*vt = string(data)
+	case *[]byte:
+		*vt = append([]byte(nil), data...)
+	default:
+		return co.Client.Codec.Unmarshal(data, rsp)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescer_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var calls int32
+	release := make(chan struct{})
+	svr := NewServer()
+	svr.Handler.Handle("/coalesce/get", func(ctx *Context) {
+		atomic.AddInt32(&calls, 1)
+		var key string
+		ctx.Bind(&key)
+		<-release
+		ctx.Write("value of " + key)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	co := NewCoalescer(c)
+	const n = 8
+	rsps := make([]string, n)
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = co.Call("/coalesce/get", "a", &rsps[i], time.Second*5)
+		}(i)
+	}
+
+	// wait until all callers joined the first one
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		co.mux.Lock()
+		cc := co.calls[co.key("/coalesce/get", "a")]
+		joined := cc != nil && cc.dups == n-1
+		co.mux.Unlock()
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callers not coalesced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil || rsps[i] != "value of a" {
+			t.Fatalf("Coalescer.Call() = %q, %v", rsps[i], errs[i])
+		}
+	}
+	if v := atomic.LoadInt32(&calls); v != 1 {
+		t.Fatalf("requests handled = %v, want 1", v)
+	}
+
+	// calls are not coalesced with an empty key
+	co.Key = func(method string, req interface{}) string { return "" }
+	for i := 0; i < 2; i++ {
+		var rsp string
+		if err := co.Call("/coalesce/get", "b", &rsp, time.Second*5); err != nil || rsp != "value of b" {
+			t.Fatalf("Coalescer.Call() = %q, %v", rsp, err)
+		}
+	}
+	if v := atomic.LoadInt32(&calls); v != 3 {
+		t.Fatalf("requests handled = %v, want 3", v)
+	}
+}
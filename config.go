@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "fmt"
+
+// CheckMethod returns error wrapping ErrInvalidMethodLen if method can't be registered or called,
+// to validate user-supplied methods before Handle
+func CheckMethod(method string) error {
+	return checkMethod(method)
+}
+
+// checkSize returns error wrapping ErrInvalidSize if size of name is negative
+func checkSize(name string, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %v %v, should >= 0", ErrInvalidSize, name, size)
+	}
+	return nil
+}
+
+func (h *handler) HandleNotifyE(method string, cb NotifyFunc) error {
+	if err := checkMethod(method); err != nil {
+		return err
+	}
+	return h.handleNotify(method, cb)
+}
+
+func (h *handler) HandleStreamE(method string, cb StreamFunc) error {
+	if err := checkMethod(method); err != nil {
+		return err
+	}
+	return h.handleStream(method, cb)
+}
+
+func (h *handler) SetRecvBufferSizeE(size int) error {
+	if err := checkSize("recv buffer size", size); err != nil {
+		return err
+	}
+	h.SetRecvBufferSize(size)
+	return nil
+}
+
+func (h *handler) SetSendQueueSizeE(size int) error {
+	if err := checkSize("send queue size", size); err != nil {
+		return err
+	}
+	h.SetSendQueueSize(size)
+	return nil
+}
+
+func (h *handler) SetSendBufferSizeE(size int) error {
+	if err := checkSize("send buffer size", size); err != nil {
+		return err
+	}
+	h.SetSendBufferSize(size)
+	return nil
+}
+
+func (h *handler) SetRecvWindowE(size int) error {
+	if err := checkSize("recv window", size); err != nil {
+		return err
+	}
+	h.SetRecvWindow(size)
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+)
+
+// ConnContext returns context of the current connection of c, shared by all handlers of the
+// connection and canceled when it's stopped or broken, context.Cause returns the error closed
+// it, or ErrClientStopped. Per-connection resources, e.g. a database session, could be kept as
+// values by SetConnValue and released when it's done. A client reconnected has a new context
+func (c *Client) ConnContext() context.Context {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	return c.connContext()
+}
+
+// SetConnValue sets value of key to the context of the current connection, see ConnContext
+func (c *Client) SetConnValue(key, value interface{}) {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	c.connCtx = context.WithValue(c.connContext(), key, value)
+}
+
+// ConnValue returns value of key in the context of the current connection, see ConnContext
+func (c *Client) ConnValue(key interface{}) interface{} {
+	return c.ConnContext().Value(key)
+}
+
+// ConnContext returns context of the connection of the handler, see Client.ConnContext
+func (ctx *Context) ConnContext() context.Context {
+	return ctx.Client.ConnContext()
+}
+
+// connContext creates context of the connection on demand, c.connMux should be held
+func (c *Client) connContext() context.Context {
+	if c.connCtx == nil {
+		c.connCtx, c.connCancel = context.WithCancelCause(context.Background())
+	}
+	return c.connCtx
+}
+
+// cancelConnContext cancels context of the connection when it's stopped or broken, it stays
+// canceled until reconnected
+func (c *Client) cancelConnContext() {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	c.connContext()
+	err := c.CloseErr()
+	if err == nil {
+		err = ErrClientStopped
+	}
+	c.connCancel(err)
+}
+
+// resetConnContext drops context of the previous connection before reconnected
+func (c *Client) resetConnContext() {
+	c.connMux.Lock()
+	defer c.connMux.Unlock()
+	c.connCtx, c.connCancel = nil, nil
+}
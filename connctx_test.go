@@ -0,0 +1,74 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+type connKey struct{}
+
+func TestClient_ConnContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	conns := make(chan context.Context, 1)
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/conn/set", func(ctx *Context) {
+		ctx.Client.SetConnValue(connKey{}, "session")
+		ctx.Write(nil)
+	})
+	svr.Handler.Handle("/conn/value", func(ctx *Context) {
+		select {
+		case conns <- ctx.ConnContext():
+		default:
+		}
+		ctx.Write(ctx.ConnContext().Value(connKey{}))
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+
+	if err := c.Call("/conn/set", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		rsp := ""
+		if err := c.Call("/conn/value", nil, &rsp, time.Second); err != nil || rsp != "session" {
+			t.Fatalf("Client.Call() = (%q, %v), want %q", rsp, err, "session")
+		}
+	}
+	connCtx := <-conns
+	if connCtx.Err() != nil {
+		t.Fatalf("ConnContext() canceled before disconnected: %v", connCtx.Err())
+	}
+
+	cctx := c.ConnContext()
+	c.Stop()
+	select {
+	case <-connCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("ConnContext() of the server not canceled after disconnected")
+	}
+	if context.Cause(cctx) != ErrClientStopped {
+		t.Fatalf("context.Cause() = %v, want %v", context.Cause(cctx), ErrClientStopped)
+	}
+	if c.ConnContext().Err() == nil {
+		t.Fatalf("ConnContext() not canceled after stopped")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// connTimer is a timer of Client.AfterFunc
+type connTimer struct {
+	Timer
+	c *Client
+}
+
+// AfterFunc calls f after d on Handler.Clock, the timer is stopped when the connection is stopped
+// or broken, so f never runs after disconnection and needs no cleanup in OnDisconnected
+func (c *Client) AfterFunc(d time.Duration, f func()) (Timer, error) {
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	if err := c.checkState(); err != nil {
+		return nil, err
+	}
+	t := &connTimer{c: c}
+	t.Timer = c.Handler.Clock().AfterFunc(d, func() {
+		if c.removeTimer(t) {
+			util.Safe(f)
+		}
+	})
+	if c.timers == nil {
+		c.timers = map[*connTimer]util.Empty{}
+	}
+	c.timers[t] = util.Empty{}
+	return t, nil
+}
+
+// Timers returns number of pending timers of AfterFunc
+func (c *Client) Timers() int {
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	return len(c.timers)
+}
+
+func (c *Client) removeTimer(t *connTimer) bool {
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	_, ok := c.timers[t]
+	delete(c.timers, t)
+	return ok
+}
+
+// stopTimers stops timers of AfterFunc when the connection is stopped or broken
+func (c *Client) stopTimers() {
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	for t := range c.timers {
+		t.Timer.Stop()
+	}
+	c.timers = nil
+}
+
+func (t *connTimer) Stop() bool {
+	return t.c.removeTimer(t) && t.Timer.Stop()
+}
+
+// Reset restarts the timer, it returns false without restarting if the connection is disconnected
+func (t *connTimer) Reset(d time.Duration) bool {
+	c := t.c
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	if c.checkState() != nil {
+		return false
+	}
+	_, active := c.timers[t]
+	if c.timers == nil {
+		c.timers = map[*connTimer]util.Empty{}
+	}
+	c.timers[t] = util.Empty{}
+	t.Timer.Reset(d)
+	return active
+}
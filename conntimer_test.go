@@ -0,0 +1,58 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_AfterFunc(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	mc := NewMockClock(time.Now())
+	h := DefaultHandler.Clone()
+	h.SetClock(mc)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	fired := 0
+	if _, err = c.AfterFunc(time.Second, func() { fired++ }); err != nil {
+		t.Fatalf("Client.AfterFunc() error = %v", err)
+	}
+	stopped, _ := c.AfterFunc(time.Second, func() { fired += 10 })
+	if !stopped.Stop() {
+		t.Fatalf("Timer.Stop() = false, want true")
+	}
+	c.AfterFunc(time.Minute, func() { fired += 100 })
+
+	mc.Advance(time.Second)
+	if fired != 1 || c.Timers() != 1 {
+		t.Fatalf("fired = %v, Timers() = %v, want 1, 1", fired, c.Timers())
+	}
+
+	c.Stop()
+	if n := c.Timers(); n != 0 || mc.Timers() != 0 {
+		t.Fatalf("Timers() = %v, clock timers = %v after Stop, want 0, 0", n, mc.Timers())
+	}
+	mc.Advance(time.Minute)
+	if fired != 1 {
+		t.Fatalf("timer fired after Stop, fired = %v", fired)
+	}
+	if _, err = c.AfterFunc(time.Second, func() {}); err != ErrClientStopped {
+		t.Fatalf("Client.AfterFunc() after Stop error = %v, want %v", err, ErrClientStopped)
+	}
+}
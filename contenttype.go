@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+// Content types are the high 4 bits of the cmd byte, so that a connection carries messages of mixed
+// codecs, e.g. of a gateway aggregating heterogeneous clients. Data of messages of a registered
+// content type is decoded by its codec, see Handler.SetContentTypeCodec, and responses are encoded
+// by the codec of their request. Peers of older versions don't support content types other than
+// ContentTypeDefault, and they're not carried by tiny frames
+const (
+	// ContentTypeDefault means data is encoded by Codec of the client
+	ContentTypeDefault byte = 0
+	// MaxContentType limit, content types of codecs are 1-15
+	MaxContentType byte = 15
+)
+
+// ContentType returns content type of the message, ContentTypeDefault if not set
+func (m *Message) ContentType() byte {
+	return (m.Buffer[HeaderIndexCmd] & HeaderContentTypeMask) >> 4
+}
+
+// SetContentType sets content type of the message, bits beyond MaxContentType are ignored
+func (m *Message) SetContentType(ct byte) {
+	m.Buffer[HeaderIndexCmd] = m.Buffer[HeaderIndexCmd]&HeaderCmdMask | (ct&MaxContentType)<<4
+}
+
+// WithContentType encodes data of the message by codec of content type ct, registered by
+// Handler.SetContentTypeCodec, calls return ErrUnsupportedContentType if it's not registered or
+// the connection is of tiny frames
+func WithContentType(ct byte) CallOption {
+	return func(msg *Message) error {
+		msg.SetContentType(ct)
+		return nil
+	}
+}
+
+// codecOf returns codec of content type ct, Codec of c for ContentTypeDefault
+func codecOf(c *Client, ct byte) (codec.Codec, error) {
+	if ct == ContentTypeDefault {
+		return c.Codec, nil
+	}
+	if cc := c.Handler.ContentTypeCodec(ct); cc != nil {
+		return cc, nil
+	}
+	return nil, ErrUnsupportedContentType
+}
+
+// encodeContentType encodes data of msg again by codec of its content type if it's set by options
+func (c *Client) encodeContentType(msg *Message, v interface{}) error {
+	ct := msg.ContentType()
+	if ct == ContentTypeDefault {
+		return nil
+	}
+	if c.Handler.TinyFrame() != nil {
+		return ErrUnsupportedContentType
+	}
+	cc, err := codecOf(c, ct)
+	if err != nil {
+		return err
+	}
+	msg.setData(util.ValueToBytes(cc, v))
+	return nil
+}
+
+// setData replaces data of the message, method and metadata are kept
+func (m *Message) setData(data []byte) {
+	offset := m.dataOffset()
+	buf := make([]byte, offset+len(data))
+	copy(buf, m.Buffer[:offset])
+	copy(buf[offset:], data)
+	m.Buffer = buf
+	m.SetBodyLen(len(buf) - HeadLen)
+}
+
+func (h *handler) ContentTypeCodec(ct byte) codec.Codec {
+	if ct > MaxContentType {
+		return nil
+	}
+	return h.load().codecs[ct]
+}
+
+func (h *handler) SetContentTypeCodec(ct byte, cc codec.Codec) error {
+	if ct == ContentTypeDefault || ct > MaxContentType {
+		return ErrInvalidContentType
+	}
+	h.update(func(s *handlerState) { s.codecs[ct] = cc })
+	return nil
+}
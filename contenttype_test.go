@@ -0,0 +1,137 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+// prefixCodec is json with a prefix, data of other codecs fails to decode
+type prefixCodec struct{}
+
+func (prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return append([]byte("pfx:"), data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte("pfx:")) {
+		return errors.New("not prefixed")
+	}
+	return json.Unmarshal(data[4:], v)
+}
+
+func TestMessage_ContentType(t *testing.T) {
+	msg := newMessage(CmdRequest, "/ct", nil, false, false, 1, NewHandler(), codec.DefaultCodec, nil)
+	if ct := msg.ContentType(); ct != ContentTypeDefault {
+		t.Fatalf("ContentType() = %v, want %v", ct, ContentTypeDefault)
+	}
+	msg.SetContentType(3)
+	if msg.ContentType() != 3 || msg.Cmd() != CmdRequest {
+		t.Fatalf("after SetContentType(3): (%v, %v), want (3, %v)", msg.ContentType(), msg.Cmd(), CmdRequest)
+	}
+	msg.SetCmd(CmdNotify)
+	if msg.ContentType() != 3 || msg.Cmd() != CmdNotify {
+		t.Fatalf("after SetCmd(): (%v, %v), want (3, %v)", msg.ContentType(), msg.Cmd(), CmdNotify)
+	}
+	if err := NewHandler().SetContentTypeCodec(ContentTypeDefault, prefixCodec{}); err != ErrInvalidContentType {
+		t.Fatalf("SetContentTypeCodec(0) error = %v, want %v", err, ErrInvalidContentType)
+	}
+	if err := NewHandler().SetContentTypeCodec(MaxContentType+1, prefixCodec{}); err != ErrInvalidContentType {
+		t.Fatalf("SetContentTypeCodec(16) error = %v, want %v", err, ErrInvalidContentType)
+	}
+}
+
+func TestClient_ContentType(t *testing.T) {
+	type payload struct {
+		Name string
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetContentTypeCodec(1, prefixCodec{})
+	svr.Handler.Handle("/ct/echo", func(ctx *Context) {
+		p := &payload{}
+		if err := ctx.Bind(p); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(p)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	h := NewHandler()
+	h.SetContentTypeCodec(1, prefixCodec{})
+	h.SetContentTypeCodec(2, prefixCodec{})
+	c := newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	defer c.Stop()
+
+	// messages of mixed codecs on the same connection
+	for _, opts := range [][]CallOption{nil, {WithContentType(1)}, {WithMeta(Metadata{"k": "v"}), WithContentType(1)}} {
+		rsp := &payload{}
+		if err = c.CallWithOptions("/ct/echo", &payload{Name: "arpc"}, rsp, time.Second, opts...); err != nil || rsp.Name != "arpc" {
+			t.Fatalf("CallWithOptions() = (%+v, %v), want (arpc, nil)", rsp, err)
+		}
+	}
+
+	// not registered by the server
+	if err = c.CallWithOptions("/ct/echo", &payload{Name: "arpc"}, &payload{}, time.Second, WithContentType(2)); err == nil {
+		t.Fatalf("CallWithOptions() of content type not supported by the server succeeded")
+	}
+	if err = c.CallWithOptions("/ct/echo", &payload{}, nil, time.Second, WithContentType(3)); err != ErrUnsupportedContentType {
+		t.Fatalf("CallWithOptions() error = %v, want %v", err, ErrUnsupportedContentType)
+	}
+}
+
+func TestClient_ContentTypeTinyFrame(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	table, _ := NewMethodTable("/ct/echo")
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetTinyFrame(table)
+	svr.Handler.SetContentTypeCodec(1, prefixCodec{})
+	svr.Handler.Handle("/ct/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	h := NewHandler()
+	h.SetTinyFrame(table)
+	h.SetContentTypeCodec(1, prefixCodec{})
+	c := newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	defer c.Stop()
+
+	// tiny frames don't carry content types even if the codec is registered
+	if err := c.CallWithOptions("/ct/echo", "hello", nil, time.Second, WithContentType(1)); err != ErrUnsupportedContentType {
+		t.Fatalf("CallWithOptions() error = %v, want %v", err, ErrUnsupportedContentType)
+	}
+	rsp := ""
+	if err := c.CallWithOptions("/ct/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("CallWithOptions() = (%v, %v), want (hello, nil)", rsp, err)
+	}
+}
@@ -18,10 +18,30 @@ type Context struct {
 	err      interface{}
 	response []interface{}
 	timeout  time.Duration
+	rspMeta  Metadata
+	rspFlags byte
 
 	done     bool
-	index    int
-	handlers []HandlerFunc
+	retained bool
+	written  bool
+
+	requestID string
+	fallback  error
+	index     int
+	handlers  []HandlerFunc
+	route     *RouterHandler
+	stats     *routeStats
+
+	// cleanups of values, see SetWithCleanup
+	cleanups []ctxCleanup
+
+	// span of the handler, see Handler.SetTracer
+	span *Span
+
+	// onWrite is called with the response before it's encoded, e.g. by Singleflight
+	onWrite func(v interface{}, isError bool)
+	// discard drops responses instead of sending them, e.g. for refreshing of Memo in background
+	discard bool
 }
 
 // Get returns value for key
@@ -42,6 +62,22 @@ func (ctx *Context) Set(key string, value interface{}) {
 		ctx.Values = map[string]interface{}{}
 	}
 	ctx.Values[key] = value
+	if len(ctx.cleanups) > 0 {
+		ctx.dropCleanups(key)
+	}
+}
+
+// Meta returns metadata of the message
+func (ctx *Context) Meta() Metadata {
+	return ctx.Message.Meta()
+}
+
+// SetResponseMeta sets metadata key-value pair for the response
+func (ctx *Context) SetResponseMeta(key, value string) {
+	if ctx.rspMeta == nil {
+		ctx.rspMeta = Metadata{}
+	}
+	ctx.rspMeta[key] = value
 }
 
 // Body returns body
@@ -51,12 +87,11 @@ func (ctx *Context) Body() []byte {
 
 // Bind body data to struct
 func (ctx *Context) Bind(v interface{}) error {
-	msg := ctx.Message
-	if msg.IsError() {
-		return msg.Error()
+	data, err := messageData(ctx.Client.Handler, ctx.Message)
+	if err != nil {
+		return err
 	}
 	if v != nil {
-		data := msg.Data()
 		switch vt := v.(type) {
 		case *[]byte:
 			*vt = data
@@ -65,7 +100,11 @@ func (ctx *Context) Bind(v interface{}) error {
 		// case *error:
 		// 	*vt = errors.New(util.BytesToStr(data))
 		default:
-			return ctx.Client.Codec.Unmarshal(data, v)
+			cc, err := codecOf(ctx.Client, ctx.Message.ContentType())
+			if err != nil {
+				return err
+			}
+			return cc.Unmarshal(data, v)
 		}
 	}
 	return nil
@@ -103,6 +142,30 @@ func (ctx *Context) Done() {
 	ctx.done = true
 }
 
+// Abort stops calling the following handlers, e.g. by a middleware short-circuiting the message
+func (ctx *Context) Abort() {
+	ctx.Done()
+}
+
+// AbortWithError responds v as the error to requests and stops calling the following handlers
+func (ctx *Context) AbortWithError(v interface{}) error {
+	ctx.Done()
+	if ctx.Message.Cmd() != CmdRequest {
+		return nil
+	}
+	return ctx.Error(v)
+}
+
+// IsAborted returns whether the following handlers are stopped by Abort or Done
+func (ctx *Context) IsAborted() bool {
+	return ctx.done
+}
+
+// ResponseError returns the error responded by handlers, nil if no error responded
+func (ctx *Context) ResponseError() interface{} {
+	return ctx.err
+}
+
 func (ctx *Context) write(v interface{}, isError bool, timeout time.Duration) error {
 	cli := ctx.Client
 	req := ctx.Message
@@ -112,10 +175,64 @@ func (ctx *Context) write(v interface{}, isError bool, timeout time.Duration) er
 	if _, ok := v.(error); ok {
 		isError = true
 	}
-	rsp := newMessage(CmdResponse, req.method(), v, isError, req.IsAsync(), req.Seq(), cli.Handler, cli.Codec, ctx.Values)
+	if isError {
+		ctx.err = v
+	}
+	ctx.written = true
+	if ctx.onWrite != nil {
+		ctx.onWrite(v, isError)
+	}
+	if ctx.discard {
+		return nil
+	}
+	if err, ok := v.(error); ok {
+		if ec := cli.Handler.ErrorCodec(); ec != nil && !ctx.isEnvelope() {
+			v = ec.Encode(err)
+		}
+	}
+	if hooks := cli.Handler.AfterHandles(); len(hooks) > 0 {
+		v, isError = ctx.afterHandle(hooks, v, isError)
+	}
+	// responses are encoded by codec of the request content type, or Codec of the client if
+	// it's not supported
+	ct, cc := req.ContentType(), cli.Codec
+	if c, err := codecOf(cli, ct); err == nil {
+		cc = c
+	} else {
+		ct = ContentTypeDefault
+	}
+	if ctx.isEnvelope() {
+		v = newEnvelope(v, isError, cc).toBytes()
+	}
+	if ctx.batchAcked(v, isError) {
+		cli.ack(req.Seq())
+		return nil
+	}
+	rsp := newMessage(CmdResponse, req.method(), v, isError, req.IsAsync(), req.Seq(), cli.Handler, cc, ctx.Values)
+	rsp.SetEnvelope(ctx.isEnvelope())
+	rsp.SetContentType(ct)
+	if ctx.route != nil && ctx.route.Deprecated {
+		ctx.SetResponseMeta(MetaKeyDeprecated, ctx.route.Replacement)
+	}
+	if cli.Handler.RequestIDs() {
+		ctx.SetResponseMeta(MetaKeyRequestID, ctx.RequestID())
+	}
+	if len(ctx.rspMeta) > 0 {
+		if err := rsp.SetMeta(ctx.rspMeta); err != nil {
+			return err
+		}
+	}
+	if ctx.rspFlags != 0 {
+		rsp.SetAppFlags(ctx.rspFlags)
+	}
+	ctx.stats.addBytesOut(rsp.Len())
 	return cli.PushMsg(rsp, ctx.timeout)
 }
 
+func (ctx *Context) isEnvelope() bool {
+	return ctx.route != nil && ctx.route.Envelope
+}
+
 func newContext(cli *Client, msg *Message, handlers []HandlerFunc) *Context {
 	return &Context{Client: cli, Message: msg, done: false, index: -1, handlers: handlers}
 }
@@ -0,0 +1,34 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+// Cost returns cost of the call declared by WithCostFunc or WithCost of the route, 1 if not
+// declared or not positive, rate and concurrency limiters consume it so one heavy call counts
+// more than many cheap ones
+func (ctx *Context) Cost() int {
+	rh := ctx.route
+	if rh == nil {
+		return 1
+	}
+	cost := rh.Cost
+	if rh.CostFunc != nil {
+		cost = rh.CostFunc(ctx)
+	}
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
+// CostBySize returns cost func of WithCostFunc counting 1 for each unit bytes of request body
+// started, at least 1
+func CostBySize(unit int) func(ctx *Context) int {
+	if unit <= 0 {
+		unit = 1
+	}
+	return func(ctx *Context) int {
+		return (len(ctx.Body()) + unit - 1) / unit
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestContext_Cost(t *testing.T) {
+	body := strings.Repeat("x", 2500)
+	cases := []struct {
+		opts []RouteOption
+		want int
+	}{
+		{nil, 1},
+		{[]RouteOption{WithCost(5)}, 5},
+		{[]RouteOption{WithCost(-1)}, 1},
+		{[]RouteOption{WithCostFunc(CostBySize(1024))}, 3},
+		{[]RouteOption{WithCost(5), WithCostFunc(CostBySize(4096))}, 1},
+	}
+	for i, v := range cases {
+		rh := &RouterHandler{}
+		for _, opt := range v.opts {
+			opt(rh)
+		}
+		ctx := &Context{
+			Client:  &Client{Codec: codec.DefaultCodec},
+			Message: newMessage(CmdRequest, "method", body, false, false, 0, DefaultHandler, codec.DefaultCodec, nil),
+			route:   rh,
+		}
+		if cost := ctx.Cost(); cost != v.want {
+			t.Fatalf("case %v: Context.Cost() = %v, want %v", i, cost, v.want)
+		}
+	}
+	if cost := (&Context{}).Cost(); cost != 1 {
+		t.Fatalf("Context.Cost() without route = %v, want 1", cost)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Values of Context are of the request, e.g. auth claims or parsed params passed by middlewares to
+// handlers, they're dropped when the handlers of the route returned, or released if the context is
+// retained. Values of the connection are set by Client.Set or Client.SetConnValue
+
+// ctxCleanup is registered by Context.SetWithCleanup
+type ctxCleanup struct {
+	key     string
+	cleanup func(value interface{})
+}
+
+// SetWithCleanup sets key-value pair, cleanup is called with value when values of ctx are dropped,
+// unless the key is set again or deleted before
+func (ctx *Context) SetWithCleanup(key string, value interface{}, cleanup func(value interface{})) {
+	if value == nil {
+		return
+	}
+	ctx.Set(key, value)
+	if cleanup != nil {
+		ctx.cleanups = append(ctx.cleanups, ctxCleanup{key: key, cleanup: cleanup})
+	}
+}
+
+// Delete deletes value of key, its cleanup is not called
+func (ctx *Context) Delete(key string) {
+	delete(ctx.Values, key)
+	ctx.dropCleanups(key)
+}
+
+// MustGet returns value for key, it panics if not set
+func (ctx *Context) MustGet(key string) interface{} {
+	if value, ok := ctx.Get(key); ok {
+		return value
+	}
+	panic(fmt.Sprintf("arpc: context value [%v] not set", key))
+}
+
+// GetString returns string value for key, false if not set or not a string
+func (ctx *Context) GetString(key string) (string, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := value.(string)
+	return s, ok
+}
+
+// GetBytes returns []byte value for key, false if not set or not a []byte
+func (ctx *Context) GetBytes(key string) ([]byte, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return nil, false
+	}
+	b, ok := value.([]byte)
+	return b, ok
+}
+
+// GetBool returns bool value for key, false if not set or not a bool
+func (ctx *Context) GetBool(key string) (bool, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return false, false
+	}
+	b, ok := value.(bool)
+	return b, ok
+}
+
+// GetInt returns int value for key, false if not set or not an int
+func (ctx *Context) GetInt(key string) (int, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return 0, false
+	}
+	i, ok := value.(int)
+	return i, ok
+}
+
+// GetInt64 returns int64 value for key, values of int are converted, false if not set or not an integer
+func (ctx *Context) GetInt64(key string) (int64, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// GetDuration returns time.Duration value for key, false if not set or not a time.Duration
+func (ctx *Context) GetDuration(key string) (time.Duration, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return 0, false
+	}
+	d, ok := value.(time.Duration)
+	return d, ok
+}
+
+// GetTime returns time.Time value for key, false if not set or not a time.Time
+func (ctx *Context) GetTime(key string) (time.Time, bool) {
+	value, ok := ctx.Get(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, ok := value.(time.Time)
+	return t, ok
+}
+
+func (ctx *Context) dropCleanups(key string) {
+	cleanups := ctx.cleanups[:0]
+	for _, v := range ctx.cleanups {
+		if v.key != key {
+			cleanups = append(cleanups, v)
+		}
+	}
+	ctx.cleanups = cleanups
+}
+
+// release drops values of ctx after handlers of the route returned, unless ctx is retained
+func (ctx *Context) release() {
+	if !ctx.retained {
+		ctx.releaseValues()
+	}
+}
+
+// releaseValues calls cleanups in reverse order of registered and drops values of ctx
+func (ctx *Context) releaseValues() {
+	cleanups := ctx.cleanups
+	values := ctx.Values
+	ctx.cleanups, ctx.Values = nil, nil
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		if value, ok := values[cleanups[i].key]; ok {
+			cleanups[i].cleanup(value)
+		}
+	}
+}
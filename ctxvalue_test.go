@@ -0,0 +1,136 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestContext_TypedValues(t *testing.T) {
+	now := time.Now()
+	ctx := &Context{}
+	ctx.Set("s", "v")
+	ctx.Set("b", []byte("v"))
+	ctx.Set("bool", true)
+	ctx.Set("i", 3)
+	ctx.Set("i64", int64(4))
+	ctx.Set("d", time.Second)
+	ctx.Set("t", now)
+
+	if v, ok := ctx.GetString("s"); !ok || v != "v" {
+		t.Fatalf("GetString() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetBytes("b"); !ok || string(v) != "v" {
+		t.Fatalf("GetBytes() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetBool("bool"); !ok || !v {
+		t.Fatalf("GetBool() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetInt("i"); !ok || v != 3 {
+		t.Fatalf("GetInt() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetInt64("i"); !ok || v != 3 {
+		t.Fatalf("GetInt64() of int = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetInt64("i64"); !ok || v != 4 {
+		t.Fatalf("GetInt64() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetDuration("d"); !ok || v != time.Second {
+		t.Fatalf("GetDuration() = (%v, %v)", v, ok)
+	}
+	if v, ok := ctx.GetTime("t"); !ok || !v.Equal(now) {
+		t.Fatalf("GetTime() = (%v, %v)", v, ok)
+	}
+	if _, ok := ctx.GetInt("s"); ok {
+		t.Fatalf("GetInt() of string ok = true")
+	}
+	if _, ok := ctx.GetString("none"); ok {
+		t.Fatalf("GetString() of key not set ok = true")
+	}
+
+	ctx.Delete("s")
+	if _, ok := ctx.Get("s"); ok {
+		t.Fatalf("Get() after Delete() ok = true")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("MustGet() of key not set didn't panic")
+		}
+	}()
+	ctx.MustGet("s")
+}
+
+func TestContext_ValuesCleanup(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	cleaned := make(chan string, 4)
+	retained := make(chan *Context, 1)
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Use(func(ctx *Context) {
+		ctx.SetWithCleanup("claims", "alice", func(v interface{}) { cleaned <- v.(string) })
+		ctx.SetWithCleanup("replaced", "old", func(v interface{}) { cleaned <- v.(string) })
+		ctx.Set("replaced", "new")
+		ctx.Next()
+	})
+	svr.Handler.Handle("/values/get", func(ctx *Context) {
+		claims, _ := ctx.GetString("claims")
+		ctx.Write(claims)
+	})
+	svr.Handler.Handle("/values/retain", func(ctx *Context) {
+		ctx.Retain()
+		retained <- ctx
+		ctx.Write(nil)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/values/get", nil, &rsp, time.Second); err != nil || rsp != "alice" {
+		t.Fatalf("Call() = (%v, %v), want (alice, nil)", rsp, err)
+	}
+	select {
+	case v := <-cleaned:
+		if v != "alice" {
+			t.Fatalf("cleaned %v, want alice", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("cleanup not called after the handler returned")
+	}
+
+	if err = c.Call("/values/retain", nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() failed: %v", err)
+	}
+	ctx := <-retained
+	time.Sleep(time.Millisecond * 20)
+	select {
+	case v := <-cleaned:
+		t.Fatalf("cleanup of %v called for retained context", v)
+	default:
+	}
+	if v, ok := ctx.GetString("claims"); !ok || v != "alice" {
+		t.Fatalf("GetString() of retained context = (%v, %v)", v, ok)
+	}
+	ctx.Release()
+	if v := <-cleaned; v != "alice" {
+		t.Fatalf("cleaned %v, want alice", v)
+	}
+	if _, ok := ctx.Get("claims"); ok {
+		t.Fatalf("Get() after Release() ok = true")
+	}
+}
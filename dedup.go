@@ -0,0 +1,154 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// dedupRoute is the internal route a sender asks whether the receiver has a payload with
+const dedupRoute = "_arpc.dedup"
+
+// MetaKeyPayloadHash is set on notifies of Client.NotifyDedup, value is hex sha256 of the payload
+const MetaKeyPayloadHash = "arpc-payload-hash"
+
+// dedupHit is the response of dedupRoute if the receiver has the payload
+const dedupHit = "1"
+
+// payloadCache keeps payloads recently notified by hashes, the least recently used is evicted
+type payloadCache struct {
+	mux   sync.Mutex
+	size  int
+	lru   *list.List
+	items map[[sha256.Size]byte]*list.Element
+}
+
+type payloadEntry struct {
+	hash [sha256.Size]byte
+	data []byte
+}
+
+func newPayloadCache(size int) *payloadCache {
+	return &payloadCache{size: size, lru: list.New(), items: map[[sha256.Size]byte]*list.Element{}}
+}
+
+// cache keeps data of msg if it carries a hash of NotifyDedup
+func (p *payloadCache) cache(msg *Message) {
+	if !msg.HasMeta() {
+		return
+	}
+	v, ok := msg.Meta().Get(MetaKeyPayloadHash)
+	if !ok {
+		return
+	}
+	h, err := hex.DecodeString(v)
+	data := msg.Data()
+	sum := sha256.Sum256(data)
+	if err != nil || !bytes.Equal(h, sum[:]) {
+		return
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if e, ok := p.items[sum]; ok {
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.items[sum] = p.lru.PushFront(&payloadEntry{hash: sum, data: append([]byte(nil), data...)})
+	for p.lru.Len() > p.size {
+		e := p.lru.Back()
+		p.lru.Remove(e)
+		delete(p.items, e.Value.(*payloadEntry).hash)
+	}
+}
+
+func (p *payloadCache) get(hash []byte) ([]byte, bool) {
+	var key [sha256.Size]byte
+	copy(key[:], hash)
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	e, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*payloadEntry).data, true
+}
+
+func (h *handler) PayloadCache() int {
+	if p := h.load().payloads; p != nil {
+		return p.size
+	}
+	return 0
+}
+
+func (h *handler) SetPayloadCache(size int) {
+	h.update(func(s *handlerState) {
+		if size <= 0 {
+			s.payloads = nil
+			return
+		}
+		s.payloads = newPayloadCache(size)
+	})
+}
+
+// onDedup handles notify of the payload cached as if it's sent again, msg is sha256 of the payload
+// followed by the method
+func (h *handler) onDedup(c *Client, msg *Message, s *handlerState) {
+	ctx := newContext(c, msg, nil)
+	if s.payloads == nil {
+		ctx.Error(ErrPayloadCacheDisabled)
+		return
+	}
+	body := msg.Data()
+	if len(body) <= sha256.Size {
+		ctx.Error(ErrInvalidPayloadHash)
+		return
+	}
+	data, ok := s.payloads.get(body[:sha256.Size])
+	if !ok {
+		ctx.Write("")
+		return
+	}
+	ctx.Write(dedupHit)
+
+	// values set by coders, e.g. verification of the request, are inherited by the notify
+	nmsg := newMessage(CmdNotify, string(body[sha256.Size:]), data, false, false, 0, h, c.Codec, msg.Values)
+	h.handleMessage(c, nmsg, s)
+}
+
+// NotifyDedup makes rpc notify of a large payload which may have been notified to the peer recently,
+// e.g. config pushed to many clients repeatedly. Its sha256 is sent first, the payload is not sent
+// if the peer has it in the payload cache, see Handler.SetPayloadCache, the peer handles the notify
+// with the payload cached instead.
+//
+// It costs a round trip for each notify, so it's only for payloads much larger than the hash.
+// The payload is sent if the peer doesn't support it.
+func (c *Client) NotifyDedup(method string, data []byte, timeout time.Duration) error {
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	rsp := ""
+	if err := c.Call(dedupRoute, append(sum[:], method...), &rsp, timeout); err == nil && rsp == dedupHit {
+		return nil
+	}
+
+	msg := c.newRequestMessage(CmdNotify, method, data, false, true)
+	if err := msg.SetMeta(Metadata{MetaKeyPayloadHash: hex.EncodeToString(sum[:])}); err != nil {
+		return err
+	}
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	timer := c.Handler.Clock().NewTimer(timeout)
+	defer timer.Stop()
+	return c.pushMessage(msg, timer)
+}
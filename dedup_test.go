@@ -0,0 +1,81 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_NotifyDedup(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	type received struct {
+		data   []byte
+		hashed bool
+	}
+	chRecv := make(chan received, 4)
+	svr := NewServer()
+	svr.Handler.Handle("/dedup/config", func(ctx *Context) {
+		_, hashed := ctx.Meta().Get(MetaKeyPayloadHash)
+		chRecv <- received{append([]byte(nil), ctx.Body()...), hashed}
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	config := bytes.Repeat([]byte("config"), 1024)
+	recv := func() received {
+		select {
+		case r := <-chRecv:
+			if !bytes.Equal(r.data, config) {
+				t.Fatalf("received %v bytes, want config of %v bytes", len(r.data), len(config))
+			}
+			return r
+		case <-time.After(time.Second * 5):
+			t.Fatalf("notify not received")
+		}
+		return received{}
+	}
+
+	// the payload is sent if the peer doesn't cache it
+	if err := c.NotifyDedup("/dedup/config", config, time.Second); err != nil {
+		t.Fatalf("Client.NotifyDedup() error = %v", err)
+	}
+	if r := recv(); !r.hashed {
+		t.Fatalf("payload not sent with hash")
+	}
+
+	svr.Handler.SetPayloadCache(4)
+	if n := svr.Handler.PayloadCache(); n != 4 {
+		t.Fatalf("Handler.PayloadCache() = %v, want 4", n)
+	}
+	if err := c.NotifyDedup("/dedup/config", config, time.Second); err != nil {
+		t.Fatalf("Client.NotifyDedup() error = %v", err)
+	}
+	if r := recv(); !r.hashed {
+		t.Fatalf("payload not sent with hash")
+	}
+	// the peer has the payload now, it's handled from the cache
+	for i := 0; i < 2; i++ {
+		if err := c.NotifyDedup("/dedup/config", config, time.Second); err != nil {
+			t.Fatalf("Client.NotifyDedup() error = %v", err)
+		}
+		if r := recv(); r.hashed {
+			t.Fatalf("payload sent again, want handled from the cache")
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "net"
+
+// DialerMiddleware decorates a conn right after dialed, before arpc uses it, e.g. metering,
+// encryption or writing a protocol prefix. It returns the conn to be used
+type DialerMiddleware func(conn net.Conn) (net.Conn, error)
+
+// WrapDialer returns dialer calling middlewares in order on each dialed conn, including conns
+// dialed by reconnecting. The raw conn is closed if a middleware fails
+func WrapDialer(dialer DialerFunc, middlewares ...DialerMiddleware) DialerFunc {
+	if len(middlewares) == 0 {
+		return dialer
+	}
+	return func() (net.Conn, error) {
+		conn, err := dialer()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range middlewares {
+			wrapped, err := m(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = wrapped
+		}
+		return conn, nil
+	}
+}
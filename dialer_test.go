@@ -0,0 +1,77 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type meteredConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+func TestWrapDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/dialer", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	var order []int
+	var written int64
+	c, err := NewClient(WrapDialer(dialer,
+		func(conn net.Conn) (net.Conn, error) {
+			order = append(order, 1)
+			return &meteredConn{Conn: conn, written: &written}, nil
+		},
+		func(conn net.Conn) (net.Conn, error) {
+			order = append(order, 2)
+			if _, ok := conn.(*meteredConn); !ok {
+				t.Errorf("middleware got %T, want *meteredConn", conn)
+			}
+			return conn, nil
+		},
+	))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	if err = c.Call("/dialer", "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Fatalf("middlewares called in order %v", order)
+	}
+	if atomic.LoadInt64(&written) == 0 {
+		t.Fatalf("metered conn not used by client")
+	}
+
+	errFailed := errors.New("failed")
+	_, err = WrapDialer(dialer, func(conn net.Conn) (net.Conn, error) {
+		return nil, errFailed
+	})()
+	if err != errFailed {
+		t.Fatalf("WrapDialer() error = %v, want %v", err, errFailed)
+	}
+}
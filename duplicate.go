@@ -0,0 +1,60 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// DuplicatePolicy defines how registering a handler of a method already registered is handled
+type DuplicatePolicy int
+
+const (
+	// DuplicatePanic panics, it's the default
+	DuplicatePanic DuplicatePolicy = iota
+	// DuplicateOverwrite replaces the handler registered with a warning, e.g. for plugins reloaded
+	DuplicateOverwrite
+	// DuplicateError keeps the handler registered, Handle logs an error and HandleE returns it
+	DuplicateError
+)
+
+func (h *handler) DuplicatePolicy() DuplicatePolicy {
+	return h.load().duplicatePolicy
+}
+
+func (h *handler) SetDuplicatePolicy(policy DuplicatePolicy) {
+	h.update(func(s *handlerState) { s.duplicatePolicy = policy })
+}
+
+func (h *handler) HandleE(method string, cb HandlerFunc, args ...interface{}) error {
+	if method == "" {
+		return ErrEmptyMethod
+	}
+	return h.handle(method, cb, args...)
+}
+
+// duplicate returns nil if the handler of method registered should be overwritten, or the error
+func (s *handlerState) duplicate(kind string, method string) error {
+	if s.duplicatePolicy == DuplicateOverwrite {
+		log.Warn("%v %v: handler exist for method [%v], overwritten", s.logtag, kind, method)
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrRouteExists, method)
+}
+
+// registered handles err of registering a handler, only duplicates are logged with DuplicateError
+func (h *handler) registered(kind string, err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, ErrRouteExists) && h.DuplicatePolicy() == DuplicateError {
+		log.Error("%v %v: %v, ignored", h.LogTag(), kind, err)
+		return
+	}
+	panic(err)
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// StatusCodeOK is the Envelope code of success responses
+	StatusCodeOK int = 0
+	// StatusCodeError is the default Envelope code of error responses
+	StatusCodeError int = 1
+	// StatusCodeInternal is the code of requests whose handlers panicked, see Handler.SetPanicResponse
+	StatusCodeInternal int = 500
+	// StatusCodeUnavailable is the code of requests rejected during maintenance, see Server.SetMaintenance
+	StatusCodeUnavailable int = 503
+)
+
+// Envelope defines unified response with status code, error message and payload
+type Envelope struct {
+	Code    int
+	Message string
+	Data    []byte
+}
+
+// StatusError defines error carried by Envelope responses
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+// Error implements error
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+func (env *Envelope) toBytes() []byte {
+	msgLen := len(env.Message)
+	if msgLen > 0xFFFF {
+		msgLen = 0xFFFF
+	}
+	buf := make([]byte, 6+msgLen+len(env.Data))
+	binary.LittleEndian.PutUint32(buf, uint32(int32(env.Code)))
+	binary.LittleEndian.PutUint16(buf[4:], uint16(msgLen))
+	copy(buf[6:], env.Message[:msgLen])
+	copy(buf[6+msgLen:], env.Data)
+	return buf
+}
+
+func (env *Envelope) fromBytes(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("invalid envelope length: %v", len(data))
+	}
+	msgLen := int(binary.LittleEndian.Uint16(data[4:]))
+	if len(data) < 6+msgLen {
+		return fmt.Errorf("invalid envelope message length: %v", msgLen)
+	}
+	env.Code = int(int32(binary.LittleEndian.Uint32(data)))
+	env.Message = string(data[6 : 6+msgLen])
+	env.Data = data[6+msgLen:]
+	return nil
+}
+
+func newEnvelope(v interface{}, isError bool, cc codec.Codec) *Envelope {
+	if !isError {
+		return &Envelope{Code: StatusCodeOK, Data: util.ValueToBytes(cc, v)}
+	}
+	if se, ok := v.(*StatusError); ok {
+		return &Envelope{Code: se.Code, Message: se.Message}
+	}
+	return &Envelope{Code: StatusCodeError, Message: string(util.ValueToBytes(cc, v))}
+}
+
+// messageData returns payload of a message, or the error it carries
+func messageData(h Handler, msg *Message) ([]byte, error) {
+	if msg.IsEnvelope() {
+		env := &Envelope{}
+		if err := env.fromBytes(msg.Data()); err != nil {
+			return nil, err
+		}
+		if env.Code != StatusCodeOK {
+			return nil, &StatusError{Code: env.Code, Message: env.Message}
+		}
+		return env.Data, nil
+	}
+	if msg.IsError() {
+		return nil, decodeError(h, msg)
+	}
+	return msg.Data(), nil
+}
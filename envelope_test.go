@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	src := &Envelope{Code: -3, Message: "msg", Data: []byte("data")}
+	dst := &Envelope{}
+	if err := dst.fromBytes(src.toBytes()); err != nil {
+		t.Fatalf("Envelope.fromBytes() error = %v", err)
+	}
+	if dst.Code != src.Code || dst.Message != src.Message || string(dst.Data) != string(src.Data) {
+		t.Fatalf("Envelope.fromBytes() = %+v, want %+v", dst, src)
+	}
+	if err := dst.fromBytes([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("Envelope.fromBytes() error = nil")
+	}
+}
+
+func TestEnvelope_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/envelope/ok", func(ctx *Context) {
+		ctx.Write("hello")
+	}, WithEnvelope())
+	svr.Handler.Handle("/envelope/status", func(ctx *Context) {
+		ctx.Error(&StatusError{Code: 404, Message: "not found"})
+	}, WithEnvelope())
+	svr.Handler.Handle("/envelope/error", func(ctx *Context) {
+		ctx.Error(errors.New("failed"))
+	}, true, WithEnvelope())
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/envelope/ok", "", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+	}
+	var se *StatusError
+	err = c.Call("/envelope/status", "", nil, time.Second)
+	if !errors.As(err, &se) || se.Code != 404 || se.Message != "not found" {
+		t.Fatalf("Client.Call() error = %v, want StatusError 404", err)
+	}
+	err = c.Call("/envelope/error", "", nil, time.Second)
+	if !errors.As(err, &se) || se.Code != StatusCodeError || se.Message != "failed" {
+		t.Fatalf("Client.Call() error = %v, want StatusError %v", err, StatusCodeError)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+// errorMagic marks an error body encoded by TypedErrorCodec
+const errorMagic byte = 0
+
+// ErrorCodec encodes errors to error response body and decodes them back on the caller side
+type ErrorCodec interface {
+	// Encode converts an error to response body
+	Encode(err error) []byte
+	// Decode converts response body to an error
+	Decode(data []byte) error
+}
+
+// TypedErrorCodec defines ErrorCodec that keeps registered error types with their fields
+type TypedErrorCodec struct {
+	Codec codec.Codec
+
+	mux   sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// Register registers an error type by name, err is a sample value of the type
+func (ec *TypedErrorCodec) Register(name string, err error) {
+	if name == "" || len(name) > 255 || err == nil {
+		return
+	}
+	t := reflect.TypeOf(err)
+	ec.mux.Lock()
+	ec.types[name] = t
+	ec.names[t] = name
+	ec.mux.Unlock()
+}
+
+// Encode implements ErrorCodec
+func (ec *TypedErrorCodec) Encode(err error) []byte {
+	ec.mux.RLock()
+	defer ec.mux.RUnlock()
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		name, ok := ec.names[reflect.TypeOf(e)]
+		if !ok {
+			continue
+		}
+		data, merr := ec.codec().Marshal(e)
+		if merr != nil {
+			break
+		}
+		buf := make([]byte, 2+len(name)+len(data))
+		buf[0] = errorMagic
+		buf[1] = byte(len(name))
+		copy(buf[2:], name)
+		copy(buf[2+len(name):], data)
+		return buf
+	}
+	return []byte(err.Error())
+}
+
+// Decode implements ErrorCodec
+func (ec *TypedErrorCodec) Decode(data []byte) error {
+	if len(data) < 2 || data[0] != errorMagic || len(data) < 2+int(data[1]) {
+		return errors.New(util.BytesToStr(data))
+	}
+	nameLen := int(data[1])
+	name := util.BytesToStr(data[2 : 2+nameLen])
+	ec.mux.RLock()
+	t, ok := ec.types[name]
+	ec.mux.RUnlock()
+	if !ok {
+		return errors.New(string(data[2+nameLen:]))
+	}
+
+	var v reflect.Value
+	if t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem())
+	} else {
+		v = reflect.New(t)
+	}
+	if err := ec.codec().Unmarshal(data[2+nameLen:], v.Interface()); err != nil {
+		return errors.New(string(data[2+nameLen:]))
+	}
+	if t.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	if err, ok := v.Interface().(error); ok {
+		return err
+	}
+	return errors.New(string(data[2+nameLen:]))
+}
+
+func (ec *TypedErrorCodec) codec() codec.Codec {
+	if ec.Codec != nil {
+		return ec.Codec
+	}
+	return codec.DefaultCodec
+}
+
+// NewTypedErrorCodec factory
+func NewTypedErrorCodec(c codec.Codec) *TypedErrorCodec {
+	return &TypedErrorCodec{
+		Codec: c,
+		types: map[string]reflect.Type{},
+		names: map[reflect.Type]string{},
+	}
+}
+
+func decodeError(h Handler, msg *Message) error {
+	if !msg.IsError() {
+		return nil
+	}
+	if h != nil {
+		if ec := h.ErrorCodec(); ec != nil {
+			return ec.Decode(msg.Data())
+		}
+	}
+	return msg.Error()
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCodeError struct {
+	Code   int
+	Reason string
+}
+
+func (e *testCodeError) Error() string {
+	return fmt.Sprintf("code %v: %v", e.Code, e.Reason)
+}
+
+func TestTypedErrorCodec(t *testing.T) {
+	ec := NewTypedErrorCodec(nil)
+	ec.Register("code", &testCodeError{})
+
+	src := fmt.Errorf("wrapped: %w", &testCodeError{Code: 403, Reason: "forbidden"})
+	err := ec.Decode(ec.Encode(src))
+	var ce *testCodeError
+	if !errors.As(err, &ce) {
+		t.Fatalf("TypedErrorCodec.Decode() = %v, want *testCodeError", err)
+	}
+	if ce.Code != 403 || ce.Reason != "forbidden" {
+		t.Fatalf("TypedErrorCodec.Decode() = %+v, want code 403", ce)
+	}
+
+	err = ec.Decode(ec.Encode(errors.New("plain")))
+	if err.Error() != "plain" {
+		t.Fatalf("TypedErrorCodec.Decode() = %v, want plain", err)
+	}
+}
+
+func TestTypedErrorCodec_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ec := NewTypedErrorCodec(nil)
+	ec.Register("code", &testCodeError{})
+
+	svr := NewServer()
+	svr.Handler.SetErrorCodec(ec)
+	svr.Handler.Handle("/errcodec", func(ctx *Context) {
+		ctx.Error(&testCodeError{Code: 500, Reason: "internal"})
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.Handler.SetErrorCodec(ec)
+
+	err = c.Call("/errcodec", "", nil, time.Second)
+	var ce *testCodeError
+	if !errors.As(err, &ce) || ce.Code != 500 {
+		t.Fatalf("Client.Call() error = %v, want *testCodeError with code 500", err)
+	}
+}
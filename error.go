@@ -39,6 +39,121 @@ var (
 	// ErrMethodNotFound .
 	ErrMethodNotFound = errors.New("method not found")
 
+	// ErrMessageBodyTooLarge .
+	ErrMessageBodyTooLarge = errors.New("message body too large")
+
+	// ErrMetaTooLarge .
+	ErrMetaTooLarge = errors.New("message metadata too large, should not be more than MaxMetaLen")
+
+	// ErrMethodTableFull .
+	ErrMethodTableFull = errors.New("method table full, should not be more than 255 methods")
+
+	// ErrInvalidTinyFrame .
+	ErrInvalidTinyFrame = errors.New("invalid tiny frame")
+
+	// ErrTinyBodyTooLarge .
+	ErrTinyBodyTooLarge = errors.New("tiny frame body too large, should not be more than 65535")
+
+	// ErrTinyFrameAppFlags .
+	ErrTinyFrameAppFlags = errors.New("application flags are not carried by tiny frames")
+
+	// ErrInvalidVarintHeader .
+	ErrInvalidVarintHeader = errors.New("invalid varint header")
+
+	// ErrFlowControlWindow .
+	ErrFlowControlWindow = errors.New("flow control window exhausted")
+
+	// ErrSendBudgetExceeded .
+	ErrSendBudgetExceeded = errors.New("send budget exceeded")
+
+	// ErrInvalidProxyHeader .
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+	// ErrPeerCredUnsupported .
+	ErrPeerCredUnsupported = errors.New("peer credentials not supported by the conn")
+
+	// ErrMethodDisabled .
+	ErrMethodDisabled = errors.New("method disabled by feature flag")
+
+	// ErrInvalidBodyLen .
+	ErrInvalidBodyLen = errors.New("invalid body length")
+
+	// ErrWouldBlock .
+	ErrWouldBlock = errors.New("send queue is full, would block")
+
+	// ErrKeyNotFound .
+	ErrKeyNotFound = errors.New("key version not found")
+
+	// ErrMigrationDisabled .
+	ErrMigrationDisabled = errors.New("connection migration disabled")
+
+	// ErrInvalidMigrateID .
+	ErrInvalidMigrateID = errors.New("invalid migration id")
+
+	// ErrMigrationOutdated .
+	ErrMigrationOutdated = errors.New("migration of an outdated connection")
+
+	// ErrInvalidBinding .
+	ErrInvalidBinding = errors.New("invalid binding, should be func(context.Context, Request) (Response, error) or func(context.Context, Request) error")
+
+	// ErrInvalidPage .
+	ErrInvalidPage = errors.New("invalid page")
+
+	// ErrPayloadCacheDisabled .
+	ErrPayloadCacheDisabled = errors.New("payload cache disabled")
+
+	// ErrInvalidPayloadHash .
+	ErrInvalidPayloadHash = errors.New("invalid payload hash")
+
+	// ErrStreamClosed .
+	ErrStreamClosed = errors.New("stream closed")
+
+	// ErrStreamNotFound .
+	ErrStreamNotFound = errors.New("stream not found")
+
+	// ErrStreamWindowExceeded .
+	ErrStreamWindowExceeded = errors.New("stream window exceeded")
+
+	// ErrStreamLimit .
+	ErrStreamLimit = errors.New("stream limit exceeded")
+
+	// ErrBrokerDisabled .
+	ErrBrokerDisabled = errors.New("pub/sub broker disabled")
+
+	// ErrTooManyTopics .
+	ErrTooManyTopics = errors.New("too many topics subscribed")
+
+	// ErrSRVNoTarget .
+	ErrSRVNoTarget = errors.New("no target of SRV records")
+
+	// ErrMethodNotSupported .
+	ErrMethodNotSupported = errors.New("method not supported by the server")
+
+	// ErrInvalidMethodLen .
+	ErrInvalidMethodLen = errors.New("invalid method length")
+
+	// ErrInvalidSize .
+	ErrInvalidSize = errors.New("invalid size")
+
+	// ErrRouteExists .
+	ErrRouteExists = errors.New("handler exist for method")
+
+	// ErrEmptyMethod .
+	ErrEmptyMethod = errors.New("empty('') method is reserved for [method not found], should use HandleNotFound to register '' handler")
+
+	// ErrHTTPUpgrade .
+	ErrHTTPUpgrade = errors.New("http upgrade failed")
+
+	// ErrALPNNotNegotiated .
+	ErrALPNNotNegotiated = errors.New("alpn protocol arpc not negotiated")
+
+	// ErrInvalidConfig .
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrInvalidContentType .
+	ErrInvalidContentType = errors.New("invalid content type, should use[1~15]")
+	// ErrUnsupportedContentType .
+	ErrUnsupportedContentType = errors.New("unsupported content type")
 	// ErrInvalidFlagBitIndex .
 	ErrInvalidFlagBitIndex = errors.New("invalid index, should use[0~9]")
 )
@@ -0,0 +1,104 @@
+// Package chatroom is an example of chat rooms on pubsub: clients join rooms by subscribing
+// topics of the rooms, and say by calling the server, which publishes to the room
+package chatroom
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/pubsub"
+)
+
+// RouteSay is the route of saying something in a room
+const RouteSay = "/chat/say"
+
+var (
+	// ErrEmptyRoom .
+	ErrEmptyRoom = errors.New("empty room")
+	// ErrEmptyText .
+	ErrEmptyText = errors.New("empty text")
+)
+
+// Message is a message said in a room
+type Message struct {
+	Room string `json:"room"`
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+// topicOf returns topic of room
+func topicOf(room string) string {
+	return "chat/" + room
+}
+
+// NewServer returns pubsub server of chat rooms
+func NewServer(password string) *pubsub.Server {
+	s := pubsub.NewServer()
+	s.Password = password
+	s.Handler.Handle(RouteSay, func(ctx *arpc.Context) {
+		m := &Message{}
+		if err := ctx.Bind(m); err != nil {
+			ctx.Error(err)
+			return
+		}
+		if m.Room == "" {
+			ctx.Error(ErrEmptyRoom)
+			return
+		}
+		if m.Text == "" {
+			ctx.Error(ErrEmptyText)
+			return
+		}
+		if err := s.Publish(topicOf(m.Room), m); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(nil)
+	})
+	return s
+}
+
+// Client is a chat client of Name
+type Client struct {
+	*pubsub.Client
+	Name string
+}
+
+// Dial connects to the server at addr and authenticates with password
+func Dial(addr, name, password string) (*Client, error) {
+	c, err := pubsub.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second*3)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Password = password
+	if err = c.Authenticate(); err != nil {
+		c.Stop()
+		return nil, err
+	}
+	return &Client{Client: c, Name: name}, nil
+}
+
+// Join joins room, onMessage is called for each message said in the room after joined
+func (c *Client) Join(room string, onMessage func(m *Message)) error {
+	return c.Subscribe(topicOf(room), func(tp *pubsub.Topic) {
+		m := &Message{}
+		if codec.DefaultCodec.Unmarshal(tp.Data, m) == nil {
+			onMessage(m)
+		}
+	}, time.Second)
+}
+
+// Leave leaves room
+func (c *Client) Leave(room string) error {
+	return c.Unsubscribe(topicOf(room), time.Second)
+}
+
+// Say says text in room
+func (c *Client) Say(room, text string) error {
+	return c.Call(RouteSay, &Message{Room: room, From: c.Name, Text: text}, nil, time.Second)
+}
@@ -0,0 +1,71 @@
+package chatroom
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChatroom(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := NewServer("secret")
+	go s.Serve(ln)
+	defer s.Stop()
+	addr := ln.Addr().String()
+
+	if _, err = Dial(addr, "mallory", "wrong"); err == nil {
+		t.Fatalf("Dial() with wrong password succeeded")
+	}
+
+	received := map[string]chan *Message{}
+	clients := map[string]*Client{}
+	for name, room := range map[string]string{"alice": "lobby", "bob": "lobby", "carol": "other"} {
+		c, err := Dial(addr, name, "secret")
+		if err != nil {
+			t.Fatalf("Dial() failed: %v", err)
+		}
+		defer c.Stop()
+		ch := make(chan *Message, 8)
+		if err = c.Join(room, func(m *Message) { ch <- m }); err != nil {
+			t.Fatalf("Client.Join() failed: %v", err)
+		}
+		clients[name], received[name] = c, ch
+	}
+
+	if err = clients["alice"].Say("lobby", "hello"); err != nil {
+		t.Fatalf("Client.Say() failed: %v", err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		select {
+		case m := <-received[name]:
+			if m.Room != "lobby" || m.From != "alice" || m.Text != "hello" {
+				t.Fatalf("%v received %+v", name, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v received nothing", name)
+		}
+	}
+	select {
+	case m := <-received["carol"]:
+		t.Fatalf("carol in another room received %+v", m)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if err = clients["bob"].Leave("lobby"); err != nil {
+		t.Fatalf("Client.Leave() failed: %v", err)
+	}
+	clients["alice"].Say("lobby", "bye")
+	<-received["alice"]
+	select {
+	case m := <-received["bob"]:
+		t.Fatalf("bob received %+v after left", m)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if err = clients["alice"].Say("lobby", ""); err == nil || err.Error() != ErrEmptyText.Error() {
+		t.Fatalf("Client.Say() empty text = %v, want %v", err, ErrEmptyText)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lesismal/arpc/examples/chatroom"
+	"github.com/lesismal/arpc/log"
+)
+
+var (
+	address = "localhost:8888"
+
+	password = "123qwe"
+
+	name = flag.String("name", "guest", "name in the room")
+	room = flag.String("room", "lobby", "room to join")
+)
+
+func main() {
+	flag.Parse()
+
+	c, err := chatroom.Dial(address, *name, password)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Stop()
+
+	err = c.Join(*room, func(m *chatroom.Message) {
+		fmt.Printf("[%v] %v: %v\n", m.Room, m.From, m.Text)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// say each line of stdin
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if err = c.Say(*room, scanner.Text()); err != nil {
+			log.Error("Say failed: %v", err)
+		}
+	}
+}
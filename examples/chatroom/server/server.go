@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/lesismal/arpc/examples/chatroom"
+)
+
+var (
+	address = "localhost:8888"
+
+	password = "123qwe"
+)
+
+func main() {
+	s := chatroom.NewServer(password)
+	s.Run(address)
+}
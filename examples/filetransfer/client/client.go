@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/examples/filetransfer"
+	"github.com/lesismal/arpc/log"
+)
+
+var (
+	address = "localhost:8888"
+
+	upload   = flag.String("upload", "", "path of file to upload")
+	download = flag.String("download", "", "name of file to download to the current directory")
+)
+
+func main() {
+	flag.Parse()
+
+	client, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second*3)
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer client.Stop()
+
+	if *upload != "" {
+		f, err := os.Open(*upload)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		n, err := filetransfer.Upload(client, filepath.Base(*upload), f)
+		if err != nil {
+			log.Error("Upload %v failed: %v", *upload, err)
+			return
+		}
+		log.Info("Uploaded %v: %v bytes", *upload, n)
+	}
+
+	if *download != "" {
+		f, err := os.Create(*download)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		n, err := filetransfer.Download(client, *download, f)
+		if err != nil {
+			log.Error("Download %v failed: %v", *download, err)
+			return
+		}
+		log.Info("Downloaded %v: %v bytes", *download, n)
+	}
+}
@@ -0,0 +1,197 @@
+// Package filetransfer is an example of transferring files on streams: the first frame of a
+// stream is the file name, following frames are chunks of the file, and the receiver of an upload
+// returns sha256 of what it received. See package transfer for resumable transfers
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lesismal/arpc"
+)
+
+const (
+	// RouteUpload is the stream route of uploading
+	RouteUpload = "/file/upload"
+	// RouteDownload is the stream route of downloading
+	RouteDownload = "/file/download"
+
+	// ChunkSize is the size of data frames
+	ChunkSize = 32 * 1024
+)
+
+var (
+	// ErrInvalidName .
+	ErrInvalidName = errors.New("invalid file name")
+	// ErrChecksum .
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// Server stores files uploaded in Dir and serves them for downloading
+type Server struct {
+	Dir string
+}
+
+// Register registers stream routes of s to h
+func (s *Server) Register(h arpc.Handler) {
+	h.HandleStream(RouteUpload, s.onUpload)
+	h.HandleStream(RouteDownload, s.onDownload)
+}
+
+// path returns path of file name in Dir, names with directories are invalid
+func (s *Server) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+func (s *Server) onUpload(stream *arpc.Stream) {
+	name := ""
+	if err := stream.Recv(&name); err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	path, err := s.path(name)
+	if err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	// written to a temporary file first, so that downloads never see a part of the file
+	f, err := os.CreateTemp(s.Dir, name+".*.part")
+	if err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	defer os.Remove(f.Name())
+	sum := sha256.New()
+	err = recvChunks(stream, io.MultiWriter(f, sum))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	stream.Send(hex.EncodeToString(sum.Sum(nil)))
+}
+
+func (s *Server) onDownload(stream *arpc.Stream) {
+	name := ""
+	if err := stream.Recv(&name); err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	path, err := s.path(name)
+	if err != nil {
+		stream.CloseWithError(err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		stream.CloseWithError(fmt.Errorf("open %v failed", name))
+		return
+	}
+	defer f.Close()
+	if _, err = sendChunks(stream, f); err != nil {
+		stream.CloseWithError(err)
+	}
+}
+
+// Upload uploads r as file name by c, it returns bytes uploaded
+func Upload(c *arpc.Client, name string, r io.Reader) (int64, error) {
+	stream, err := c.OpenStream(RouteUpload)
+	if err != nil {
+		return 0, err
+	}
+	if err = stream.Send(name); err != nil {
+		return 0, err
+	}
+	sum := sha256.New()
+	n, err := sendChunks(stream, io.TeeReader(r, sum))
+	if err != nil {
+		stream.CloseWithError(err)
+		return n, err
+	}
+	if err = stream.Close(); err != nil {
+		return n, err
+	}
+	remote := ""
+	if err = stream.Recv(&remote); err != nil {
+		return n, err
+	}
+	if remote != hex.EncodeToString(sum.Sum(nil)) {
+		return n, ErrChecksum
+	}
+	return n, nil
+}
+
+// Download downloads file name by c to w, it returns bytes downloaded
+func Download(c *arpc.Client, name string, w io.Writer) (int64, error) {
+	stream, err := c.OpenStream(RouteDownload)
+	if err != nil {
+		return 0, err
+	}
+	if err = stream.Send(name); err != nil {
+		return 0, err
+	}
+	stream.Close()
+	cw := &countWriter{w: w}
+	err = recvChunks(stream, cw)
+	return cw.n, err
+}
+
+func sendChunks(stream *arpc.Stream, r io.Reader) (int64, error) {
+	var n int64
+	buf := make([]byte, ChunkSize)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			if serr := stream.Send(buf[:nr]); serr != nil {
+				return n, serr
+			}
+			n += int64(nr)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func recvChunks(stream *arpc.Stream, w io.Writer) error {
+	for {
+		var chunk []byte
+		err := stream.Recv(&chunk)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
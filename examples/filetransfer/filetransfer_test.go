@@ -0,0 +1,61 @@
+package filetransfer
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestUploadDownload(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	dir := t.TempDir()
+	svr := arpc.NewServer()
+	fs := &Server{Dir: dir}
+	fs.Register(svr.Handler)
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	// larger than the window of a stream
+	data := make([]byte, arpc.StreamWindowSize*3+123)
+	rand.Read(data)
+	n, err := Upload(c, "data.bin", bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Upload() = (%v, %v), want %v", n, err, len(data))
+	}
+	if stored, err := os.ReadFile(filepath.Join(dir, "data.bin")); err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("file stored mismatch: %v", err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(parts) != 0 {
+		t.Fatalf("temporary files left: %v", parts)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err = Download(c, "data.bin", buf)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Download() = (%v, %v), want %v bytes", n, err, len(data))
+	}
+
+	if _, err = Download(c, "missing.bin", &bytes.Buffer{}); err == nil {
+		t.Fatalf("Download() of missing file succeeded")
+	}
+	if _, err = Upload(c, "../escape.bin", bytes.NewReader(data[:10])); err == nil || err.Error() != ErrInvalidName.Error() {
+		t.Fatalf("Upload() with directory = %v, want %v", err, ErrInvalidName)
+	}
+}
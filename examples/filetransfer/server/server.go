@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/examples/filetransfer"
+)
+
+var (
+	address = "localhost:8888"
+
+	dir = flag.String("dir", "./files", "directory of files")
+)
+
+func main() {
+	flag.Parse()
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		panic(err)
+	}
+
+	svr := arpc.NewServer()
+	fs := &filetransfer.Server{Dir: *dir}
+	fs.Register(svr.Handler)
+	svr.Run(address)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/lesismal/arpc"
+)
+
+var (
+	address = flag.String("addr", "localhost:9001", "address to listen")
+	name    = flag.String("service", "users", "name of the service")
+)
+
+func main() {
+	flag.Parse()
+
+	svr := arpc.NewServer()
+	// methods of the service are prefixed with its name, the gateway routes them by it
+	svr.Handler.Handle("/"+*name+"/hello", func(ctx *arpc.Context) {
+		ctx.Write("hello " + string(ctx.Body()) + " from " + *address)
+	})
+	svr.Run(*address)
+}
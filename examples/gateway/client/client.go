@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+var (
+	address = "localhost:8888"
+)
+
+func main() {
+	client, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second*3)
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer client.Stop()
+
+	// calls are balanced over backends of the service by the gateway
+	for i := 0; i < 4; i++ {
+		rsp := ""
+		if err = client.Call("/users/hello", "arpc", &rsp, time.Second*5); err != nil {
+			log.Error("Call /users/hello failed: %v", err)
+			continue
+		}
+		log.Info("Call /users/hello Response: \"%v\"", rsp)
+	}
+}
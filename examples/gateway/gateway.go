@@ -0,0 +1,102 @@
+// Package gateway is an example of a gateway with service discovery: requests are routed by the
+// first segment of their methods, e.g. "/users/get" to service "users", whose addresses are
+// resolved by the resolver of the service, e.g. a registry that backends keep registered to
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/service"
+)
+
+// ErrNoService .
+var ErrNoService = errors.New("no service of method")
+
+// Gateway is the arpc server forwarding requests to services
+type Gateway struct {
+	*arpc.Server
+
+	resolve func(name string) service.Resolver
+	options []service.Option
+
+	mux      sync.Mutex
+	services map[string]*service.Service
+}
+
+// New returns Gateway resolving addresses of services by resolve, options are applied to each
+// service, e.g. service.WithTimeout
+func New(resolve func(name string) service.Resolver, options ...service.Option) *Gateway {
+	g := &Gateway{
+		Server:   arpc.NewServer(),
+		resolve:  resolve,
+		options:  options,
+		services: map[string]*service.Service{},
+	}
+	g.Handler.SetLogTag("[GATEWAY]")
+	g.Handler.HandleNotFound(g.forward)
+	return g
+}
+
+// ServiceOf returns name of the service of method, the first segment of it
+func ServiceOf(method string) string {
+	method = strings.TrimPrefix(method, "/")
+	if i := strings.Index(method, "/"); i > 0 {
+		return method[:i]
+	}
+	return ""
+}
+
+// service returns the service of name, it's created on the first request to it
+func (g *Gateway) service(name string) (*service.Service, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if svc, ok := g.services[name]; ok {
+		return svc, nil
+	}
+	svc, err := service.New(name, g.resolve(name), g.options...)
+	if err != nil {
+		return nil, err
+	}
+	g.services[name] = svc
+	return svc, nil
+}
+
+func (g *Gateway) forward(ctx *arpc.Context) {
+	method := ctx.Message.Method()
+	if ctx.Message.Cmd() != arpc.CmdRequest {
+		log.Warn("%v notify of [%v] dropped", g.Handler.LogTag(), method)
+		return
+	}
+	name := ServiceOf(method)
+	if name == "" {
+		ctx.Error(ErrNoService)
+		return
+	}
+	svc, err := g.service(name)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	var rsp []byte
+	if err = svc.Invoke(context.Background(), method, ctx.Body(), &rsp); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(rsp)
+}
+
+// Stop stops the server and clients of services
+func (g *Gateway) Stop() error {
+	g.mux.Lock()
+	for name, svc := range g.services {
+		svc.Stop()
+		delete(g.services, name)
+	}
+	g.mux.Unlock()
+	return g.Server.Stop()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/lesismal/arpc/examples/gateway"
+	"github.com/lesismal/arpc/service"
+)
+
+var (
+	address = "localhost:8888"
+
+	name     = flag.String("service", "users", "name of the service")
+	backends = flag.String("backends", "localhost:9001,localhost:9002", "comma separated addresses of the service")
+)
+
+func main() {
+	flag.Parse()
+
+	// addresses are static here, resolvers of registries, e.g. service.EndpointSliceResolver,
+	// or service.SRVResolver discover them dynamically
+	addrs := service.StaticResolver(strings.Split(*backends, ","))
+	g := gateway.New(func(svc string) service.Resolver {
+		if svc == *name {
+			return addrs
+		}
+		return service.StaticResolver(nil)
+	})
+	g.Run(address)
+}
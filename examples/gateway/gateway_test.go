@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/service"
+)
+
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return ln
+}
+
+func TestGateway(t *testing.T) {
+	registry := service.NewMemoryRegistry()
+	for i := 0; i < 2; i++ {
+		ln := listen(t)
+		addr := ln.Addr().String()
+		svr := arpc.NewServer()
+		svr.Handler = arpc.NewHandler()
+		svr.Handler.Handle("/users/hello", func(ctx *arpc.Context) {
+			ctx.Write(addr)
+		})
+		go svr.Serve(ln)
+		defer svr.Stop()
+		if err := registry.Register("users", addr, time.Minute, nil); err != nil {
+			t.Fatalf("MemoryRegistry.Register() failed: %v", err)
+		}
+	}
+
+	ln := listen(t)
+	g := New(registry.Resolver, service.WithRefreshInterval(time.Millisecond*20))
+	go g.Serve(ln)
+	defer g.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Stop()
+
+	call := func() (string, error) {
+		rsp := ""
+		err := c.Call("/users/hello", nil, &rsp, time.Second)
+		return rsp, err
+	}
+	served := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		addr, err := call()
+		if err != nil {
+			t.Fatalf("Call() through gateway failed: %v", err)
+		}
+		served[addr] = true
+	}
+	addrs := registry.Addrs("users")
+	if len(served) != len(addrs) {
+		t.Fatalf("calls served by %v, want all of %v", served, addrs)
+	}
+
+	registry.Deregister("users", addrs[0])
+	deadline := time.Now().Add(time.Second)
+	for {
+		served = map[string]bool{}
+		for i := 0; i < 4; i++ {
+			addr, err := call()
+			if err != nil {
+				t.Fatalf("Call() through gateway failed: %v", err)
+			}
+			served[addr] = true
+		}
+		if len(served) == 1 && !served[addrs[0]] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("calls served by %v after %v deregistered", served, addrs[0])
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if err = c.Call("/orders/get", nil, nil, time.Second); err == nil {
+		t.Fatalf("Call() of unknown service succeeded")
+	}
+	if err = c.Call("/nothing", nil, nil, time.Second); err == nil || err.Error() != ErrNoService.Error() {
+		t.Fatalf("Call() without service = %v, want %v", err, ErrNoService)
+	}
+}
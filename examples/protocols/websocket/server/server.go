@@ -6,7 +6,7 @@ import (
 	"time"
 
 	"github.com/lesismal/arpc"
-	"github.com/lesismal/arpcext/websocket"
+	"github.com/lesismal/arpc/websocket"
 )
 
 func main() {
@@ -10,7 +10,7 @@ import (
 
 	"github.com/lesismal/arpc"
 	"github.com/lesismal/arpc/log"
-	"github.com/lesismal/arpcext/websocket"
+	"github.com/lesismal/arpc/websocket"
 )
 
 // Message .
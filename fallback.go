@@ -0,0 +1,24 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+// Fallback degrades the request gracefully when the route's handlers are unavailable, e.g. circuit
+// open, overloaded or gated: the fallback handler of WithFallback is invoked to respond, e.g. with
+// cached or default data, and reason is returned by FallbackReason, or reason is responded as
+// error if the route has no fallback. It's called for requests rejected by maintenance mode and
+// feature flags in the read loop, and should be called by limiters and breakers instead of Error
+func (ctx *Context) Fallback(reason error) error {
+	if ctx.route == nil || ctx.route.Fallback == nil || ctx.fallback != nil {
+		return ctx.Error(reason)
+	}
+	ctx.fallback = reason
+	ctx.route.Fallback(ctx)
+	return nil
+}
+
+// FallbackReason returns the reason the fallback handler is invoked for, nil in other handlers
+func (ctx *Context) FallbackReason() error {
+	return ctx.fallback
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContext_Fallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	errOverloaded := errors.New("overloaded")
+	svr := NewServer()
+	svr.Handler.Use(func(ctx *Context) {
+		if string(ctx.Body()) == "heavy" {
+			ctx.Fallback(errOverloaded)
+			return
+		}
+		ctx.Next()
+	})
+	svr.Handler.Handle("/fallback/data", func(ctx *Context) {
+		ctx.Write("fresh")
+	}, WithFallback(func(ctx *Context) {
+		ctx.Write("cached: " + ctx.FallbackReason().Error())
+	}))
+	svr.Handler.Handle("/fallback/none", func(ctx *Context) {
+		ctx.Write("fresh")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/fallback/data", "light", &rsp, time.Second); err != nil || rsp != "fresh" {
+		t.Fatalf("Client.Call() = (%v, %v), want (fresh, nil)", rsp, err)
+	}
+	if err = c.Call("/fallback/data", "heavy", &rsp, time.Second); err != nil || rsp != "cached: overloaded" {
+		t.Fatalf("Client.Call() overloaded = (%v, %v), want (cached: overloaded, nil)", rsp, err)
+	}
+	if err = c.Call("/fallback/none", "heavy", &rsp, time.Second); err == nil || err.Error() != errOverloaded.Error() {
+		t.Fatalf("Client.Call() without fallback error = %v, want %v", err, errOverloaded)
+	}
+
+	svr.SetMaintenance("upgrading")
+	defer svr.SetMaintenance("")
+	if err = c.Call("/fallback/data", "light", &rsp, time.Second); err != nil || rsp != "cached: upgrading" {
+		t.Fatalf("Client.Call() in maintenance = (%v, %v), want (cached: upgrading, nil)", rsp, err)
+	}
+}
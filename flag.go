@@ -0,0 +1,85 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// FlagProvider decides whether a feature flag is on for the caller of ctx, e.g. backed by a flag
+// service or config, it's called for each message of routes registered with WithFlag
+type FlagProvider interface {
+	Enabled(flag string, ctx *Context) bool
+}
+
+// FlagProviderFunc adapts a function to FlagProvider
+type FlagProviderFunc func(flag string, ctx *Context) bool
+
+// Enabled implements FlagProvider
+func (f FlagProviderFunc) Enabled(flag string, ctx *Context) bool {
+	return f(flag, ctx)
+}
+
+// Flags defines FlagProvider of percentage rollouts that could be changed at runtime, callers are
+// bucketed by host of Context.OriginAddr so each caller sees a stable result for the same percent
+type Flags struct {
+	mux      sync.RWMutex
+	percents map[string]int
+}
+
+// Set sets rollout percent of flag: 0 disables it, 100 enables it for all callers
+func (f *Flags) Set(flag string, percent int) {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	f.mux.Lock()
+	f.percents[flag] = percent
+	f.mux.Unlock()
+}
+
+// Delete deletes flag, unknown flags are enabled
+func (f *Flags) Delete(flag string) {
+	f.mux.Lock()
+	delete(f.percents, flag)
+	f.mux.Unlock()
+}
+
+// Enabled implements FlagProvider
+func (f *Flags) Enabled(flag string, ctx *Context) bool {
+	f.mux.RLock()
+	percent, ok := f.percents[flag]
+	f.mux.RUnlock()
+	switch {
+	case !ok || percent >= 100:
+		return true
+	case percent <= 0:
+		return false
+	}
+	caller := ctx.OriginAddr()
+	if host, _, err := net.SplitHostPort(caller); err == nil {
+		caller = host
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(flag))
+	hash.Write([]byte(caller))
+	return int(hash.Sum32()%100) < percent
+}
+
+// NewFlags factory
+func NewFlags() *Flags {
+	return &Flags{percents: map[string]int{}}
+}
+
+func (h *handler) FlagProvider() FlagProvider {
+	return h.load().flagProvider
+}
+
+func (h *handler) SetFlagProvider(fp FlagProvider) {
+	h.update(func(s *handlerState) { s.flagProvider = fp })
+}
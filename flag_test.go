@@ -0,0 +1,77 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlags_Enabled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	h := NewHandler()
+	ctx := &Context{Client: &Client{Conn: c1, Handler: h}, Message: newMessage(CmdRequest, "/flag", nil, false, false, 0, h, nil, nil)}
+
+	flags := NewFlags()
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		flag := fmt.Sprintf("flag-%v", i)
+		flags.Set(flag, 30)
+		if flags.Enabled(flag, ctx) {
+			enabled++
+		}
+		if flags.Enabled(flag, ctx) != flags.Enabled(flag, ctx) {
+			t.Fatalf("Flags.Enabled() not stable for %v", flag)
+		}
+	}
+	if enabled < 200 || enabled > 400 {
+		t.Fatalf("Flags.Enabled() at 30%% enabled %v of 1000", enabled)
+	}
+}
+
+func TestHandler_SetFlagProvider(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	flags := NewFlags()
+	svr.Handler.SetFlagProvider(flags)
+	svr.Handler.Handle("/flag/beta", func(ctx *Context) {
+		ctx.Write("beta")
+	}, WithFlag("beta"))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	var rsp string
+	if err = c.Call("/flag/beta", nil, &rsp, time.Second); err != nil || rsp != "beta" {
+		t.Fatalf("Client.Call() unknown flag = (%v, %v), want (beta, nil)", rsp, err)
+	}
+	flags.Set("beta", 0)
+	if err = c.Call("/flag/beta", nil, &rsp, time.Second); err == nil || err.Error() != ErrMethodDisabled.Error() {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrMethodDisabled)
+	}
+	flags.Set("beta", 100)
+	if err = c.Call("/flag/beta", nil, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+
+	svr.Handler.SetFlagProvider(FlagProviderFunc(func(flag string, ctx *Context) bool { return false }))
+	if err = c.Call("/flag/beta", nil, &rsp, time.Second); err == nil || err.Error() != ErrMethodDisabled.Error() {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrMethodDisabled)
+	}
+}
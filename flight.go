@@ -0,0 +1,155 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// FlightSend is kind of frames sent, recorded before encoded by coders
+	FlightSend = "send"
+	// FlightRecv is kind of frames received, recorded after decoded by coders
+	FlightRecv = "recv"
+	// FlightDisconnect is kind of disconnection events, Note is the close reason and error
+	FlightDisconnect = "disconnect"
+	// FlightPanic is kind of panics recovered in dispatching, Note is the panic value
+	FlightPanic = "panic"
+)
+
+// FlightEvent is an event kept by the flight recorder, see Handler.SetFlightRecorder
+type FlightEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Cmd    byte      `json:"cmd,omitempty"`
+	Flag   byte      `json:"flag,omitempty"`
+	Seq    uint64    `json:"seq,omitempty"`
+	Method string    `json:"method,omitempty"`
+	Len    int       `json:"len,omitempty"`
+	Note   string    `json:"note,omitempty"`
+}
+
+func (e FlightEvent) String() string {
+	switch e.Kind {
+	case FlightSend, FlightRecv:
+		return fmt.Sprintf("%v %v cmd=%v flag=%v seq=%v method=%v len=%v", e.Time.Format(time.RFC3339Nano), e.Kind, e.Cmd, e.Flag, e.Seq, e.Method, e.Len)
+	default:
+		return fmt.Sprintf("%v %v %v", e.Time.Format(time.RFC3339Nano), e.Kind, e.Note)
+	}
+}
+
+type flightRecorder struct {
+	size int
+	rate int
+}
+
+func (h *handler) FlightRecorder() (int, int) {
+	if f := h.load().flight; f != nil {
+		return f.size, f.rate
+	}
+	return 0, 0
+}
+
+func (h *handler) SetFlightRecorder(size int, rate int) {
+	h.update(func(s *handlerState) {
+		if size <= 0 {
+			s.flight = nil
+			return
+		}
+		if rate < 1 {
+			rate = 1
+		}
+		s.flight = &flightRecorder{size: size, rate: rate}
+	})
+}
+
+// FlightRecord returns events kept by the flight recorder of the connection, oldest first
+func (c *Client) FlightRecord() []FlightEvent {
+	c.fmux.Lock()
+	defer c.fmux.Unlock()
+	events := make([]FlightEvent, 0, len(c.flight))
+	if len(c.flight) < cap(c.flight) {
+		return append(events, c.flight...)
+	}
+	events = append(events, c.flight[c.flightNext:]...)
+	return append(events, c.flight[:c.flightNext]...)
+}
+
+// recordFrame keeps header of msg, one in rate frames is kept
+func (c *Client) recordFrame(kind string, msg *Message) {
+	size, rate := c.Handler.FlightRecorder()
+	if size <= 0 || (rate > 1 && atomic.AddUint64(&c.flightN, 1)%uint64(rate) != 0) {
+		return
+	}
+	e := FlightEvent{
+		Time: c.Handler.Clock().Now(),
+		Kind: kind,
+		Cmd:  msg.Cmd(),
+		Flag: msg.Buffer[HeaderIndexFlag],
+		Seq:  msg.Seq(),
+		Len:  msg.Len(),
+	}
+	if ml := msg.MethodLen(); ml > 0 && HeadLen+ml <= len(msg.Buffer) {
+		e.Method = msg.method()
+	}
+	c.record(size, e)
+}
+
+// recordEvent keeps events of the connection, they're not sampled
+func (c *Client) recordEvent(kind string, note string) {
+	size, _ := c.Handler.FlightRecorder()
+	if size <= 0 {
+		return
+	}
+	c.record(size, FlightEvent{Time: c.Handler.Clock().Now(), Kind: kind, Note: note})
+}
+
+func (c *Client) recordDisconnect(err error) {
+	if size, _ := c.Handler.FlightRecorder(); size > 0 {
+		c.recordEvent(FlightDisconnect, fmt.Sprintf("%v: %v", c.CloseReason(), err))
+	}
+}
+
+func (c *Client) record(size int, e FlightEvent) {
+	c.fmux.Lock()
+	defer c.fmux.Unlock()
+	if cap(c.flight) != size {
+		c.flight, c.flightNext = make([]FlightEvent, 0, size), 0
+	}
+	if len(c.flight) < size {
+		c.flight = append(c.flight, e)
+		return
+	}
+	c.flight[c.flightNext] = e
+	c.flightNext = (c.flightNext + 1) % size
+}
+
+// dumpFlightRecord logs events kept by the flight recorder of the connection
+func (c *Client) dumpFlightRecord(reason string) {
+	events := c.FlightRecord()
+	if len(events) == 0 {
+		return
+	}
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = e.String()
+	}
+	log.Error("%v\t%v\tflight record on %v:\n%v", c.logTag(), c.Conn.RemoteAddr(), reason, strings.Join(lines, "\n"))
+}
+
+// recoverFlight recovers panics of dispatching, the flight record of the connection is dumped
+func (c *Client) recoverFlight() {
+	if err := recover(); err != nil {
+		log.Error("%v\t%v\truntime error: %v\ntraceback:\n%v", c.logTag(), c.Conn.RemoteAddr(), err, string(debug.Stack()))
+		c.recordEvent(FlightPanic, fmt.Sprintf("%v", err))
+		c.dumpFlightRecord(FlightPanic)
+	}
+}
@@ -0,0 +1,69 @@
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_FlightRecord(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetFlightRecorder(4, 1)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/panic", func(ctx *Context) {
+		panic("boom")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		rsp := ""
+		if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if events := c.FlightRecord(); len(events) != 0 {
+		t.Fatalf("Client.FlightRecord() = %v, want empty if disabled", events)
+	}
+
+	clients := svr.Clients()
+	if len(clients) != 1 {
+		t.Fatalf("Server.Clients() = %v, want 1", len(clients))
+	}
+	sc := clients[0]
+	// the response is recorded after it's written to the client
+	time.Sleep(time.Millisecond * 20)
+	events := sc.FlightRecord()
+	if len(events) != 4 {
+		t.Fatalf("Client.FlightRecord() = %v events, want 4", len(events))
+	}
+	last := events[len(events)-1]
+	if last.Kind != FlightSend || last.Cmd != CmdResponse {
+		t.Fatalf("last event = %v, want response sent", last)
+	}
+	prev := events[len(events)-2]
+	if prev.Kind != FlightRecv || prev.Method != "/echo" || prev.Seq != last.Seq {
+		t.Fatalf("event before last = %v, want request of /echo received", prev)
+	}
+
+	c.Notify("/panic", nil, time.Second)
+	time.Sleep(time.Millisecond * 20)
+	events = sc.FlightRecord()
+	if last := events[len(events)-1]; last.Kind != FlightPanic || last.Note != "boom" {
+		t.Fatalf("last event = %v, want panic", last)
+	}
+}
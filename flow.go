@@ -0,0 +1,307 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// windowRoute is the internal route advertising and updating flow control windows:
+	// [flags:1][size or increment:4][method, empty for the connection window]
+	windowRoute = "_arpc.window"
+
+	windowFlagInit byte = 0x1
+
+	internalMethodPrefix = "_arpc."
+)
+
+// flowWindow is the send credit advertised by the receiver
+type flowWindow struct {
+	mux    sync.Mutex
+	size   int
+	avail  int
+	closed bool
+	ch     chan util.Empty
+}
+
+// tryAcquire takes n bytes of credit, a message larger than the window is allowed when the window is idle.
+// It returns a channel closed on credit released if the window is exhausted
+func (w *flowWindow) tryAcquire(n int) (bool, <-chan util.Empty) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed || w.avail >= n || w.avail >= w.size {
+		w.avail -= n
+		return true, nil
+	}
+	return false, w.ch
+}
+
+func (w *flowWindow) release(n int) {
+	w.mux.Lock()
+	w.avail += n
+	if w.avail > w.size {
+		w.avail = w.size
+	}
+	close(w.ch)
+	w.ch = make(chan util.Empty)
+	w.mux.Unlock()
+}
+
+// close stops limiting, waiters are woken up
+func (w *flowWindow) close() {
+	w.mux.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+	w.mux.Unlock()
+}
+
+func newFlowWindow(size int) *flowWindow {
+	return &flowWindow{size: size, avail: size, ch: make(chan util.Empty)}
+}
+
+// recvWindow counts handled bytes of the receiver, credit is returned when half of the window is consumed
+type recvWindow struct {
+	size     int
+	consumed int
+}
+
+// flowControlled returns the method and the counted length of msg, responses and internal messages are
+// not counted, responses are limited by calls of the receiver itself
+func flowControlled(msg *Message) (string, int, bool) {
+	cmd := msg.Cmd()
+	if cmd != CmdRequest && cmd != CmdNotify {
+		return "", 0, false
+	}
+	ml := msg.MethodLen()
+	if ml <= 0 || HeadLen+ml > len(msg.Buffer) {
+		return "", 0, false
+	}
+	method := msg.method()
+	if strings.HasPrefix(method, internalMethodPrefix) {
+		return "", 0, false
+	}
+	return method, msg.Len(), true
+}
+
+// sendWindowsOf returns windows limiting msg, nil if the peer has not advertised them
+func (c *Client) sendWindowsOf(method string) (*flowWindow, *flowWindow) {
+	c.flowmux.RLock()
+	defer c.flowmux.RUnlock()
+	return c.sendWindow, c.sendWindows[method]
+}
+
+// acquireWindow waits for send credit of msg from the connection window and the method window.
+// It fails with ErrFlowControlWindow immediately if block is false, or with ErrClientTimeout when
+// expire or done fires
+func (c *Client) acquireWindow(msg *Message, block bool, expire <-chan time.Time, done <-chan struct{}) error {
+	method, n, ok := flowControlled(msg)
+	if !ok {
+		return nil
+	}
+	connWindow, methodWindow := c.sendWindowsOf(method)
+	if connWindow == nil && methodWindow == nil {
+		return nil
+	}
+	wait := func(ch <-chan util.Empty) error {
+		if !block {
+			c.Handler.OnOverstock(c, msg)
+			return ErrFlowControlWindow
+		}
+		select {
+		case <-ch:
+			return nil
+		case <-expire:
+			c.Handler.OnOverstock(c, msg)
+			return ErrClientTimeout
+		case <-done:
+			c.Handler.OnOverstock(c, msg)
+			return ErrClientTimeout
+		case <-c.chClose:
+			c.Handler.OnOverstock(c, msg)
+			return ErrClientStopped
+		}
+	}
+	for {
+		if methodWindow != nil {
+			if ok, ch := methodWindow.tryAcquire(n); !ok {
+				if err := wait(ch); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if connWindow != nil {
+			if ok, ch := connWindow.tryAcquire(n); !ok {
+				if methodWindow != nil {
+					methodWindow.release(n)
+				}
+				if err := wait(ch); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return nil
+	}
+}
+
+// restoreWindow returns credit of msg acquired but not sent
+func (c *Client) restoreWindow(msg *Message) {
+	method, n, ok := flowControlled(msg)
+	if !ok {
+		return
+	}
+	connWindow, methodWindow := c.sendWindowsOf(method)
+	if connWindow != nil {
+		connWindow.release(n)
+	}
+	if methodWindow != nil {
+		methodWindow.release(n)
+	}
+}
+
+// resetWindows is called before reconnected, windows are advertised again by the new connection
+func (c *Client) resetWindows() {
+	c.flowmux.Lock()
+	if c.sendWindow != nil {
+		c.sendWindow.close()
+	}
+	for _, w := range c.sendWindows {
+		w.close()
+	}
+	c.sendWindow = nil
+	c.sendWindows = nil
+	c.recvWindow = nil
+	c.recvWindows = nil
+	c.credits = nil
+	c.flowmux.Unlock()
+}
+
+func windowMessage(c *Client, flags byte, size int, method string) *Message {
+	data := make([]byte, 5+len(method))
+	data[0] = flags
+	binary.LittleEndian.PutUint32(data[1:], uint32(size))
+	copy(data[5:], method)
+	return newMessage(CmdNotify, windowRoute, data, false, false, 0, c.Handler, c.Codec, nil)
+}
+
+// advertiseWindows sends receive windows of the connection and the routes to the peer
+func (h *handler) advertiseWindows(c *Client) {
+	s := h.load()
+	var msgs []*Message
+	if s.recvWindow > 0 {
+		msgs = append(msgs, windowMessage(c, windowFlagInit, s.recvWindow, ""))
+	}
+	for method, rh := range s.routes {
+		if rh.Window > 0 && method != "" {
+			msgs = append(msgs, windowMessage(c, windowFlagInit, rh.Window, method))
+		}
+	}
+	for _, msg := range msgs {
+		if err := c.PushMsg(msg, TimeForever); err != nil {
+			log.Warn("%v\t%v\tadvertise window failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// consumeWindow counts n bytes handled for method, and returns credit to the peer
+// when half of the window is consumed. It's called by the reading loop, so credit is not sent
+// here, which could block on a full send queue, but coalesced and sent by the send loop
+func (h *handler) consumeWindow(c *Client, method string, n int, methodSize int) {
+	s := h.load()
+	returned := false
+	consume := func(w *recvWindow, size int, name string) *recvWindow {
+		if w == nil {
+			w = &recvWindow{size: size}
+		}
+		w.consumed += n
+		if w.consumed >= (w.size+1)/2 {
+			if c.credits == nil {
+				c.credits = map[string]int{}
+			}
+			c.credits[name] += w.consumed
+			w.consumed = 0
+			returned = true
+		}
+		return w
+	}
+	c.flowmux.Lock()
+	if s.recvWindow > 0 {
+		c.recvWindow = consume(c.recvWindow, s.recvWindow, "")
+	}
+	if methodSize > 0 {
+		if c.recvWindows == nil {
+			c.recvWindows = map[string]*recvWindow{}
+		}
+		c.recvWindows[method] = consume(c.recvWindows[method], methodSize, method)
+	}
+	c.flowmux.Unlock()
+	if returned {
+		select {
+		case c.chCredit <- util.Empty{}:
+		default:
+		}
+	}
+}
+
+// takeCredits returns messages of credit coalesced by consumeWindow, called by the send loop
+func (c *Client) takeCredits() []*Message {
+	c.flowmux.Lock()
+	credits := c.credits
+	c.credits = nil
+	c.flowmux.Unlock()
+	msgs := make([]*Message, 0, len(credits))
+	for method, n := range credits {
+		msgs = append(msgs, windowMessage(c, 0, n, method))
+	}
+	return msgs
+}
+
+// onWindow handles window advertisement and update from the peer
+func (h *handler) onWindow(c *Client, msg *Message) {
+	data := msg.Data()
+	if len(data) < 5 {
+		log.Warn("%v OnMessage: invalid window message length %v, dropped", h.LogTag(), len(data))
+		return
+	}
+	flags, size, method := data[0], int(binary.LittleEndian.Uint32(data[1:])), string(data[5:])
+	c.flowmux.Lock()
+	defer c.flowmux.Unlock()
+	if flags&windowFlagInit != 0 {
+		w := newFlowWindow(size)
+		if method == "" {
+			if c.sendWindow != nil {
+				c.sendWindow.close()
+			}
+			c.sendWindow = w
+		} else {
+			if c.sendWindows == nil {
+				c.sendWindows = map[string]*flowWindow{}
+			}
+			if prev, ok := c.sendWindows[method]; ok {
+				prev.close()
+			}
+			c.sendWindows[method] = w
+		}
+		return
+	}
+	w := c.sendWindow
+	if method != "" {
+		w = c.sendWindows[method]
+	}
+	if w != nil {
+		w.release(size)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+func TestFlowWindow(t *testing.T) {
+	w := newFlowWindow(100)
+	if ok, _ := w.tryAcquire(60); !ok {
+		t.Fatalf("flowWindow.tryAcquire(60) failed")
+	}
+	ok, ch := w.tryAcquire(60)
+	if ok {
+		t.Fatalf("flowWindow.tryAcquire(60) ok with 40 bytes available")
+	}
+	w.release(60)
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("flowWindow.release() did not wake waiters")
+	}
+	// a message larger than the window is allowed when the window is idle
+	if ok, _ := w.tryAcquire(200); !ok {
+		t.Fatalf("flowWindow.tryAcquire(200) failed on idle window")
+	}
+	if ok, _ := w.tryAcquire(1); ok {
+		t.Fatalf("flowWindow.tryAcquire(1) ok with negative credit")
+	}
+	w.close()
+	if ok, _ := w.tryAcquire(1); !ok {
+		t.Fatalf("flowWindow.tryAcquire(1) failed after closed")
+	}
+}
+
+func TestConsumeWindow_Coalesced(t *testing.T) {
+	h := NewHandler().(*handler)
+	h.SetRecvWindow(100)
+	// the send queue is full, consuming doesn't block the reading loop
+	c := &Client{Handler: h, chSend: make(chan *Message), chCredit: make(chan util.Empty, 1)}
+	for i := 0; i < 4; i++ {
+		h.consumeWindow(c, "/m", 30, 40)
+	}
+	select {
+	case <-c.chCredit:
+	default:
+		t.Fatalf("send loop not signaled of credit")
+	}
+	got := map[string]uint32{}
+	for _, msg := range c.takeCredits() {
+		data := msg.Data()
+		got[string(data[5:])] = binary.LittleEndian.Uint32(data[1:])
+	}
+	// credit of the connection is returned twice and of the method 4 times, one message each
+	if len(got) != 2 || got[""] != 120 || got["/m"] != 120 {
+		t.Fatalf("takeCredits() = %v, want 120 of the connection and /m", got)
+	}
+	if msgs := c.takeCredits(); len(msgs) != 0 {
+		t.Fatalf("takeCredits() again = %v messages, want 0", len(msgs))
+	}
+}
+
+func TestFlowControl_Notify(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	method := "/flow/slow"
+	gate := make(chan struct{})
+	handled := make(chan struct{}, 4)
+	svr := NewServer()
+	svr.Handler.Handle(method, func(ctx *Context) {
+		<-gate
+		handled <- struct{}{}
+	}, WithWindow(1024))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	// windows are advertised asynchronously after connected
+	for i := 0; i < 100; i++ {
+		if _, w := c.sendWindowsOf(method); w != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, w := c.sendWindowsOf(method); w == nil {
+		t.Fatalf("window of %v not advertised", method)
+	}
+
+	data := strings.Repeat("x", 600)
+	if err = c.Notify(method, data, TimeZero); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	if err = c.Notify(method, data, TimeZero); err != ErrFlowControlWindow {
+		t.Fatalf("Client.Notify() error = %v, want %v", err, ErrFlowControlWindow)
+	}
+	if err = c.Notify(method, data, time.Millisecond*20); err != ErrClientTimeout {
+		t.Fatalf("Client.Notify() error = %v, want %v", err, ErrClientTimeout)
+	}
+
+	close(gate)
+	<-handled
+	if err = c.Notify(method, data, time.Second); err != nil {
+		t.Fatalf("Client.Notify() after window updated error = %v", err)
+	}
+	<-handled
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// MetaKeyForwardedFor is set on messages forwarded by Context.Forward, value is comma separated
+// addresses of callers appended by each gateway, the original caller first. It's only trusted from
+// clients set by Handler.SetTrustedProxies, and ignored from others
+const MetaKeyForwardedFor = "arpc-forwarded-for"
+
+// TrustNetworks returns predicate for Handler.SetTrustedProxies trusting clients whose real
+// addresses are in the networks of cidrs, e.g. "10.0.0.0/8"
+func TrustNetworks(cidrs ...string) (func(c *Client) bool, error) {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks[i] = network
+	}
+	return func(c *Client) bool {
+		ip := addrIP(c.RealAddr())
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Forward forwards the request or notify of ctx to c with the same method, body and metadata, and
+// writes the response of c back. Address of the caller is appended to MetaKeyForwardedFor, which
+// is dropped first if the caller is not a trusted proxy.
+// Transformers of the route set by WithTransformers are applied, see ForwardWith.
+// If forwarding a request fails, the error is responded to the caller and returned
+func (ctx *Context) Forward(c *Client, timeout time.Duration) error {
+	var ts []Transformer
+	if ctx.route != nil {
+		ts = ctx.route.Transformers
+	}
+	return ctx.ForwardWith(c, timeout, ts...)
+}
+
+// ForwardWith forwards as Forward with transformers ts instead of those of the route, requests
+// are transformed by ts in order and responses in reverse order
+func (ctx *Context) ForwardWith(c *Client, timeout time.Duration, ts ...Transformer) error {
+	req := ctx.Message
+	method := req.method()
+
+	md := Metadata{}
+	for k, v := range req.Meta() {
+		md[k] = v
+	}
+	md[MetaKeyForwardedFor] = strings.Join(append(ctx.ForwardedFor(), ctx.Client.RealAddr().String()), ", ")
+	if ctx.requestID != "" || ctx.Client.Handler.RequestIDs() || c.Handler.RequestIDs() {
+		md[MetaKeyRequestID] = ctx.RequestID()
+	}
+	if ctx.span != nil {
+		md[MetaKeyParentSpan] = ctx.span.ID
+	}
+
+	f := &Forwarded{Method: method, Body: req.Data(), Meta: md}
+	if err := transformRequest(ts, f); err != nil {
+		return ctx.forwardFailed(err)
+	}
+	if err := c.checkStateAndMethod(f.Method); err != nil {
+		return ctx.forwardFailed(err)
+	}
+
+	if req.Cmd() != CmdRequest {
+		msg := c.NewMessage(CmdNotify, f.Method, f.Body)
+		if err := msg.SetMeta(f.Meta); err != nil {
+			return ctx.forwardFailed(err)
+		}
+		return c.PushMsg(msg, timeout)
+	}
+
+	msg := c.newRequestMessage(CmdRequest, f.Method, f.Body, false, false)
+	if err := msg.SetMeta(f.Meta); err != nil {
+		return ctx.forwardFailed(err)
+	}
+	rsp, err := c.call(msg, timeout)
+	if err != nil {
+		return ctx.forwardFailed(err)
+	}
+	if rsp == nil {
+		return ctx.forwardFailed(ErrClientReconnecting)
+	}
+	defer rsp.Release()
+	f = &Forwarded{Method: method, Body: rsp.Data(), Meta: rsp.Meta(), Error: rsp.IsError()}
+	if err = transformResponse(ts, f); err != nil {
+		return ctx.forwardFailed(err)
+	}
+	for k, v := range f.Meta {
+		ctx.SetResponseMeta(k, v)
+	}
+	if f.Error {
+		return ctx.write(f.Body, true, TimeForever)
+	}
+	return ctx.Write(f.Body)
+}
+
+func (ctx *Context) forwardFailed(err error) error {
+	if ctx.Message.Cmd() == CmdRequest {
+		ctx.Error(err)
+	}
+	return err
+}
+
+// ForwardedFor returns addresses of MetaKeyForwardedFor, nil if the message is not forwarded or
+// the client is not a trusted proxy
+func (ctx *Context) ForwardedFor() []string {
+	if !ctx.Client.Handler.TrustedProxy(ctx.Client) {
+		return nil
+	}
+	value, ok := ctx.Meta().Get(MetaKeyForwardedFor)
+	if !ok || value == "" {
+		return nil
+	}
+	addrs := strings.Split(value, ",")
+	for i, addr := range addrs {
+		addrs[i] = strings.TrimSpace(addr)
+	}
+	return addrs
+}
+
+// OriginAddr returns address of the original caller, the first of ForwardedFor if forwarded by a
+// trusted proxy, or else real address of the client
+func (ctx *Context) OriginAddr() string {
+	if addrs := ctx.ForwardedFor(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ctx.Client.RealAddr().String()
+}
+
+func (h *handler) TrustedProxy(c *Client) bool {
+	trusted := h.load().trustedProxies
+	return trusted != nil && trusted(c)
+}
+
+func (h *handler) SetTrustedProxies(trusted func(c *Client) bool) {
+	h.update(func(s *handlerState) { s.trustedProxies = trusted })
+}
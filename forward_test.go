@@ -0,0 +1,214 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newForwardServer(t *testing.T, setup func(h Handler)) (*Server, string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	setup(svr.Handler)
+	go svr.Serve(ln)
+	return svr, ln.Addr().String()
+}
+
+func TestContext_Forward(t *testing.T) {
+	backend, backendAddr := newForwardServer(t, func(h Handler) {
+		trusted, err := TrustNetworks("127.0.0.0/8", "::1/128")
+		if err != nil {
+			t.Fatalf("TrustNetworks() error = %v", err)
+		}
+		h.SetTrustedProxies(trusted)
+		h.Handle("/forward/origin", func(ctx *Context) {
+			ctx.Write(ctx.OriginAddr() + "|" + strings.Join(ctx.ForwardedFor(), ","))
+		})
+		h.Handle("/forward/fail", func(ctx *Context) {
+			ctx.Error(errors.New("backend failed"))
+		})
+	})
+	defer backend.Stop()
+
+	bc, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", backendAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer bc.Stop()
+
+	gateway, gatewayAddr := newForwardServer(t, func(h Handler) {
+		h.HandleNotFound(func(ctx *Context) {
+			ctx.Forward(bc, time.Second)
+		})
+	})
+	defer gateway.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", gatewayAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	var rsp string
+	if err = c.Call("/forward/origin", nil, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	origin := c.Conn.LocalAddr().String()
+	if rsp != origin+"|"+origin {
+		t.Fatalf("forwarded origin = %v, want %v|%v", rsp, origin, origin)
+	}
+	if err = c.Call("/forward/fail", nil, nil, time.Second); err == nil || err.Error() != "backend failed" {
+		t.Fatalf("Client.Call() error = %v, want backend failed", err)
+	}
+}
+
+func TestContext_ForwardedForUntrusted(t *testing.T) {
+	svr, addr := newForwardServer(t, func(h Handler) {
+		h.Handle("/forward/origin", func(ctx *Context) {
+			ctx.Write(ctx.OriginAddr() + "|" + strings.Join(ctx.ForwardedFor(), ","))
+		})
+	})
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	// a direct client can't forge its origin
+	var rsp string
+	err = c.CallWithOptions("/forward/origin", nil, &rsp, time.Second, WithMeta(Metadata{MetaKeyForwardedFor: "10.0.0.1:1"}))
+	if err != nil {
+		t.Fatalf("Client.CallWithOptions() error = %v", err)
+	}
+	if origin := c.Conn.LocalAddr().String(); rsp != origin+"|" {
+		t.Fatalf("forged origin = %v, want %v|", rsp, origin)
+	}
+}
+
+func TestContext_ForwardTransformers(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+	}
+	backend, backendAddr := newForwardServer(t, func(h Handler) {
+		h.Handle("/v2/user", func(ctx *Context) {
+			if ctx.ForwardedFor() != nil {
+				ctx.Error("forwarded for not stripped")
+				return
+			}
+			u := &user{}
+			if err := ctx.Bind(u); err != nil {
+				ctx.Error(err)
+				return
+			}
+			ctx.SetResponseMeta("internal", "1")
+			ctx.Write([]user{*u, {Name: "v2"}})
+		})
+	})
+	defer backend.Stop()
+
+	bc, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", backendAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer bc.Stop()
+
+	gateway, gatewayAddr := newForwardServer(t, func(h Handler) {
+		h.Handle("/v1/user", func(ctx *Context) {
+			ctx.Forward(bc, time.Second)
+		}, WithTransformers(
+			RenameMethod("/v2/user"),
+			RenameFields(map[string]string{"username": "name"}),
+			StripMeta(MetaKeyForwardedFor, "internal"),
+		))
+	})
+	defer gateway.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", gatewayAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	done := make(chan struct{})
+	req := map[string]string{"username": "v1"}
+	err = c.CallAsync("/v1/user", req, func(ctx *Context) {
+		defer close(done)
+		if ctx.Message.IsError() {
+			t.Errorf("forwarded call failed: %s", ctx.Body())
+			return
+		}
+		if body := string(ctx.Body()); body != `[{"username":"v1"},{"username":"v2"}]` {
+			t.Errorf("transformed response = %v", body)
+		}
+		if _, ok := ctx.Meta().Get("internal"); ok {
+			t.Errorf("response meta internal not stripped")
+		}
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() failed: %v", err)
+	}
+	<-done
+}
+
+func TestContext_ForwardMetaTooLarge(t *testing.T) {
+	backend, backendAddr := newForwardServer(t, func(h Handler) {
+		h.Handle("/forward/echo", func(ctx *Context) { ctx.Write(ctx.Body()) })
+	})
+	defer backend.Stop()
+
+	bc, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", backendAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer bc.Stop()
+
+	forwarded := make(chan error, 1)
+	gateway, gatewayAddr := newForwardServer(t, func(h Handler) {
+		h.Handle("/forward/echo", func(ctx *Context) {
+			forwarded <- ctx.ForwardWith(bc, time.Second, Transformer{Request: func(f *Forwarded) error {
+				f.Meta["large"] = strings.Repeat("v", MaxMetaLen-len("large="))
+				return nil
+			}})
+		})
+	})
+	defer gateway.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", gatewayAddr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err := c.Call("/forward/echo", "hello", &rsp, time.Second); err == nil {
+		t.Fatalf("Client.Call() = %v, want forwarding failed", rsp)
+	}
+	if err := <-forwarded; err != ErrMetaTooLarge {
+		t.Fatalf("Context.ForwardWith() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+}
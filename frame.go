@@ -0,0 +1,219 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+const (
+	// MaxMethodTableSize limit, method ids are 1-255
+	MaxMethodTableSize = 255
+
+	// MaxTinyBodyLen limit of tiny frame
+	MaxTinyBodyLen = 0xFFFF
+
+	tinyMaskCmd      byte = 0x03
+	tinyMaskError    byte = 0x04
+	tinyMaskAsync    byte = 0x08
+	tinyMaskEnvelope byte = 0x10
+	tinyMaskMeta     byte = 0x20
+	tinyMaskName     byte = 0x40
+	tinyMaskReserved byte = 0x80
+)
+
+// MethodTable maps method names to 1-byte ids, both sides should use the same table
+type MethodTable struct {
+	ids   map[string]byte
+	names []string
+}
+
+// ID returns id of method
+func (t *MethodTable) ID(method string) (byte, bool) {
+	id, ok := t.ids[method]
+	return id, ok
+}
+
+// Method returns method of id
+func (t *MethodTable) Method(id byte) (string, bool) {
+	if id == 0 || int(id) > len(t.names) {
+		return "", false
+	}
+	return t.names[id-1], true
+}
+
+// Methods returns methods in id order
+func (t *MethodTable) Methods() []string {
+	return append([]string(nil), t.names...)
+}
+
+// NewMethodTable returns MethodTable, ids are assigned from 1 in order of methods
+func NewMethodTable(methods ...string) (*MethodTable, error) {
+	if len(methods) > MaxMethodTableSize {
+		return nil, ErrMethodTableFull
+	}
+	t := &MethodTable{ids: map[string]byte{}}
+	for _, m := range methods {
+		if err := checkMethod(m); err != nil {
+			return nil, err
+		}
+		if _, ok := t.ids[m]; ok {
+			continue
+		}
+		t.names = append(t.names, m)
+		t.ids[m] = byte(len(t.names))
+	}
+	return t, nil
+}
+
+// toTinyFrame converts message buffer to tiny frame for constrained links:
+// [ctl:1][reserved:1, if ctl&0x80][seq:2][bodyLen:2][methodID:1 | methodLen:1 method, if ctl&0x40][meta][data]
+// ctl: cmd(bits 0-1), error, async, envelope, meta, method by name, reserved byte follows
+func toTinyFrame(t *MethodTable, buf []byte) ([]byte, error) {
+	if err := checkTinyFrame(t, buf); err != nil {
+		return nil, err
+	}
+	msg := &Message{Buffer: buf}
+	ml := int(buf[HeaderIndexMethodLen])
+	cmd := msg.Cmd()
+	method := buf[HeadLen : HeadLen+ml]
+	rest := buf[HeadLen+ml:]
+
+	ctl := cmd
+	flag := buf[HeaderIndexFlag]
+	if flag&HeaderFlagMaskError != 0 {
+		ctl |= tinyMaskError
+	}
+	if flag&HeaderFlagMaskAsync != 0 {
+		ctl |= tinyMaskAsync
+	}
+	if flag&HeaderFlagMaskEnvelope != 0 {
+		ctl |= tinyMaskEnvelope
+	}
+	if flag&HeaderFlagMaskMeta != 0 {
+		ctl |= tinyMaskMeta
+	}
+	id, ok := t.ID(string(method))
+	methodPart := 1
+	if !ok {
+		ctl |= tinyMaskName
+		methodPart += ml
+	}
+	bodyLen := methodPart + len(rest)
+
+	frame := make([]byte, 0, 6+bodyLen)
+	reserved := buf[HeaderIndexReserved]
+	if reserved != 0 {
+		ctl |= tinyMaskReserved
+		frame = append(frame, ctl, reserved)
+	} else {
+		frame = append(frame, ctl)
+	}
+	seq := binary.LittleEndian.Uint64(buf[HeaderIndexSeqBegin:HeaderIndexSeqEnd])
+	frame = append(frame, byte(seq), byte(seq>>8), byte(bodyLen), byte(bodyLen>>8))
+	if ok {
+		frame = append(frame, id)
+	} else {
+		frame = append(frame, byte(ml))
+		frame = append(frame, method...)
+	}
+	return append(frame, rest...), nil
+}
+
+// checkTinyFrame returns error if the message is not carried by tiny frames: stream cmds, content
+// types, application flags and bodies beyond MaxTinyBodyLen, so that sending it fails before it's queued
+func checkTinyFrame(t *MethodTable, buf []byte) error {
+	msg := &Message{Buffer: buf}
+	ml := int(buf[HeaderIndexMethodLen])
+	if msg.Cmd() > tinyMaskCmd || msg.ContentType() != ContentTypeDefault || HeadLen+ml > len(buf) {
+		return ErrInvalidTinyFrame
+	}
+	if msg.AppFlags() != 0 {
+		return ErrTinyFrameAppFlags
+	}
+	bodyLen := 1 + len(buf) - HeadLen - ml
+	if _, ok := t.ID(string(buf[HeadLen : HeadLen+ml])); !ok {
+		bodyLen += ml
+	}
+	if bodyLen > MaxTinyBodyLen {
+		return ErrTinyBodyTooLarge
+	}
+	return nil
+}
+
+// recvTinyFrame reads a tiny frame and converts it to message
+func recvTinyFrame(t *MethodTable, c *Client) (*Message, error) {
+	head := c.Head[:HeaderIndexBodyLenEnd]
+	if _, err := io.ReadFull(c.Reader, head[:1]); err != nil {
+		return nil, err
+	}
+	ctl, reserved := head[0], byte(0)
+	if ctl&tinyMaskReserved != 0 {
+		if _, err := io.ReadFull(c.Reader, head[:1]); err != nil {
+			return nil, err
+		}
+		reserved = head[0]
+	}
+	if _, err := io.ReadFull(c.Reader, head[:4]); err != nil {
+		return nil, err
+	}
+	seq := uint64(binary.LittleEndian.Uint16(head))
+	bodyLen := int(binary.LittleEndian.Uint16(head[2:]))
+	if bodyLen == 0 {
+		return nil, ErrInvalidTinyFrame
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(c.Reader, body); err != nil {
+		return nil, err
+	}
+
+	var method string
+	var rest []byte
+	if ctl&tinyMaskName != 0 {
+		ml := int(body[0])
+		if 1+ml > len(body) {
+			return nil, ErrInvalidTinyFrame
+		}
+		method, rest = string(body[1:1+ml]), body[1+ml:]
+	} else {
+		m, ok := t.Method(body[0])
+		if !ok {
+			return nil, ErrInvalidTinyFrame
+		}
+		method, rest = m, body[1:]
+	}
+
+	cmd := ctl & tinyMaskCmd
+	if cmd == CmdResponse {
+		seq = expandSeq(atomic.LoadUint64(&c.seq), seq)
+	}
+	msg := recvMessage(c.Handler, HeadLen+len(method)+len(rest))
+	msg.Buffer[HeaderIndexReserved] = reserved
+	msg.SetCmd(cmd)
+	msg.Buffer[HeaderIndexFlag] = 0
+	msg.SetError(ctl&tinyMaskError != 0)
+	msg.SetAsync(ctl&tinyMaskAsync != 0)
+	msg.SetEnvelope(ctl&tinyMaskEnvelope != 0)
+	if ctl&tinyMaskMeta != 0 {
+		msg.Buffer[HeaderIndexFlag] |= HeaderFlagMaskMeta
+	}
+	msg.SetMethodLen(len(method))
+	msg.SetBodyLen(len(method) + len(rest))
+	msg.SetSeq(seq)
+	copy(msg.Buffer[HeadLen:], method)
+	copy(msg.Buffer[HeadLen+len(method):], rest)
+	return msg, nil
+}
+
+// expandSeq restores the latest seq not greater than curr with the lower 16 bits of tiny frame
+func expandSeq(curr, low uint64) uint64 {
+	seq := curr&^0xFFFF | low
+	if seq > curr && seq >= 0x10000 {
+		seq -= 0x10000
+	}
+	return seq
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMethodTable(t *testing.T) {
+	table, err := NewMethodTable("/a", "/b", "/a")
+	if err != nil {
+		t.Fatalf("NewMethodTable() error = %v", err)
+	}
+	if id, ok := table.ID("/b"); !ok || id != 2 {
+		t.Fatalf("MethodTable.ID() = (%v, %v), want (2, true)", id, ok)
+	}
+	if m, ok := table.Method(1); !ok || m != "/a" {
+		t.Fatalf("MethodTable.Method() = (%v, %v), want (/a, true)", m, ok)
+	}
+	if _, ok := table.Method(3); ok {
+		t.Fatalf("MethodTable.Method(3) ok = true")
+	}
+	if _, err = NewMethodTable(make([]string, 256)...); err != ErrMethodTableFull {
+		t.Fatalf("NewMethodTable() error = %v, want %v", err, ErrMethodTableFull)
+	}
+}
+
+func TestExpandSeq(t *testing.T) {
+	cases := []struct{ curr, low, want uint64 }{
+		{5, 3, 3},
+		{0x10005, 0xFFFE, 0xFFFE},
+		{0x2FFFF, 0xFFFF, 0x2FFFF},
+		{0x20001, 0x0001, 0x20001},
+	}
+	for _, c := range cases {
+		if got := expandSeq(c.curr, c.low); got != c.want {
+			t.Fatalf("expandSeq(%x, %x) = %x, want %x", c.curr, c.low, got, c.want)
+		}
+	}
+}
+
+func TestTinyFrame_Call(t *testing.T) {
+	table, _ := NewMethodTable("/tiny/echo")
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	// coders registered on DefaultHandler by tests rewrite header bytes, use new handlers
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetTinyFrame(table)
+	echo := func(ctx *Context) {
+		ctx.SetResponseMeta("k", "v")
+		ctx.Write(ctx.Body())
+	}
+	svr.Handler.Handle("/tiny/echo", echo)
+	svr.Handler.Handle("/tiny/byname", echo)
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	h := NewHandler()
+	h.SetTinyFrame(table)
+	c := newClientWithConn(conn, svr.Codec, h, nil)
+	defer c.Stop()
+
+	for _, method := range []string{"/tiny/echo", "/tiny/byname"} {
+		rsp := ""
+		if err = c.Call(method, "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call(%v) = (%v, %v), want (hello, nil)", method, rsp, err)
+		}
+	}
+	if err = c.Call("/tiny/none", "", nil, time.Second); err == nil {
+		t.Fatalf("Client.Call() not found error = nil")
+	}
+
+	buf := newMessage(CmdRequest, "/tiny/echo", "hello", false, false, 1, nil, nil, nil).Buffer
+	frame, err := toTinyFrame(table, buf)
+	if err != nil || len(frame) != 6+len("hello") {
+		t.Fatalf("toTinyFrame() = (%v, %v), want %v bytes", frame, err, 6+len("hello"))
+	}
+
+	// messages tiny frames don't carry fail at once instead of being dropped
+	if err = c.Call("/tiny/echo", make([]byte, MaxTinyBodyLen), nil, time.Second); err != ErrTinyBodyTooLarge {
+		t.Fatalf("Client.Call() oversize error = %v, want %v", err, ErrTinyBodyTooLarge)
+	}
+	buf = newMessage(CmdStreamOpen, "/tiny/echo", nil, false, false, 2, nil, nil, nil).Buffer
+	if _, err = toTinyFrame(table, buf); err != ErrInvalidTinyFrame {
+		t.Fatalf("toTinyFrame() stream error = %v, want %v", err, ErrInvalidTinyFrame)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+// Golden frames are the bytes on the wire of each format and message feature, peers of older
+// versions read and send exactly these. A fixture changes only with a deliberate protocol change,
+// regenerate them by: go test -run TestGoldenFrames -update
+var updateGolden = flag.Bool("update", false, "rewrite golden frame fixtures in testdata/golden")
+
+var goldenTable, _ = NewMethodTable("/golden/echo")
+
+// goldenFormat encodes message buffers to frames of a wire format and sets up c to receive them
+type goldenFormat struct {
+	name   string
+	encode func(c *Client, buf []byte) ([]byte, error)
+	setup  func(c *Client)
+	// headerBits is whether the format carries application flags and content types
+	headerBits bool
+}
+
+var goldenFormats = []goldenFormat{
+	{
+		name:       "fixed",
+		encode:     func(c *Client, buf []byte) ([]byte, error) { return buf, nil },
+		setup:      func(c *Client) {},
+		headerBits: true,
+	},
+	{
+		name:       "varint",
+		encode:     func(c *Client, buf []byte) ([]byte, error) { return toVarintFrame(buf), nil },
+		setup:      func(c *Client) { c.recvVarint = 1 },
+		headerBits: true,
+	},
+	{
+		name: "methodid",
+		encode: func(c *Client, buf []byte) ([]byte, error) {
+			return encodeMethodID(c, &Message{Buffer: buf}).Buffer, nil
+		},
+		setup: func(c *Client) {
+			c.sendMethods.Store(goldenTable)
+			c.recvMethods.Store(goldenTable)
+		},
+		headerBits: true,
+	},
+	{
+		name:   "tiny",
+		encode: func(c *Client, buf []byte) ([]byte, error) { return toTinyFrame(goldenTable, buf) },
+		setup:  func(c *Client) { c.Handler.SetTinyFrame(goldenTable) },
+	},
+}
+
+// goldenMessages are messages of each feature, methods not in goldenTable are sent by name
+var goldenMessages = []struct {
+	name string
+	msg  func(h Handler) *Message
+}{
+	{"request", func(h Handler) *Message {
+		return newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, false, 1, h, codec.DefaultCodec, nil)
+	}},
+	{"response", func(h Handler) *Message {
+		return newMessage(CmdResponse, "/golden/echo", []byte("hello"), false, false, 2, h, codec.DefaultCodec, nil)
+	}},
+	{"notify", func(h Handler) *Message {
+		return newMessage(CmdNotify, "/golden/echo", []byte("hello"), false, false, 0, h, codec.DefaultCodec, nil)
+	}},
+	{"empty", func(h Handler) *Message {
+		return newMessage(CmdNotify, "/golden/echo", nil, false, false, 0, h, codec.DefaultCodec, nil)
+	}},
+	{"byname", func(h Handler) *Message {
+		return newMessage(CmdRequest, "/golden/byname", []byte("hello"), false, false, 3, h, codec.DefaultCodec, nil)
+	}},
+	{"error", func(h Handler) *Message {
+		return newMessage(CmdResponse, "/golden/echo", []byte("oops"), true, false, 4, h, codec.DefaultCodec, nil)
+	}},
+	{"async", func(h Handler) *Message {
+		return newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, true, 5, h, codec.DefaultCodec, nil)
+	}},
+	{"envelope", func(h Handler) *Message {
+		env := &Envelope{Code: StatusCodeUnavailable, Message: "maintenance"}
+		msg := newMessage(CmdResponse, "/golden/echo", env.toBytes(), false, false, 6, h, codec.DefaultCodec, nil)
+		msg.SetEnvelope(true)
+		return msg
+	}},
+	{"meta", func(h Handler) *Message {
+		msg := newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, false, 7, h, codec.DefaultCodec, nil)
+		msg.SetMeta(Metadata{MetaKeyRequestID: "req-1", "k": "v"})
+		return msg
+	}},
+	{"flagbits", func(h Handler) *Message {
+		msg := newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, false, 8, h, codec.DefaultCodec, nil)
+		msg.SetFlagBit(0, true)
+		msg.SetFlagBit(7, true)
+		return msg
+	}},
+	{"appflags", func(h Handler) *Message {
+		msg := newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, false, 9, h, codec.DefaultCodec, nil)
+		msg.SetAppFlags(AppFlag0 | AppFlag3)
+		return msg
+	}},
+	{"contenttype", func(h Handler) *Message {
+		msg := newMessage(CmdRequest, "/golden/echo", []byte("hello"), false, false, 10, h, codec.DefaultCodec, nil)
+		msg.SetContentType(MaxContentType)
+		return msg
+	}},
+}
+
+func newGoldenClient(f goldenFormat, frame []byte) *Client {
+	c := &Client{Handler: NewHandler(), Reader: bytes.NewReader(frame)}
+	c.Head = Header(c.head[:])
+	// responses of tiny frames carry the lower bits of seq, restored by seq of the client
+	c.seq = 0xFF
+	f.setup(c)
+	return c
+}
+
+func readGolden(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden frame %v: %v, regenerate by -update", path, err)
+	}
+	frame, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("invalid golden frame %v: %v", path, err)
+	}
+	return frame
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, f := range goldenFormats {
+		for _, m := range goldenMessages {
+			if (m.name == "appflags" || m.name == "contenttype") && !f.headerBits {
+				continue
+			}
+			name := f.name + "_" + m.name
+			path := filepath.Join("testdata", "golden", name+".hex")
+			want := m.msg(NewHandler())
+
+			frame, err := f.encode(newGoldenClient(f, nil), want.Buffer)
+			if err != nil {
+				t.Fatalf("%v: encode failed: %v", name, err)
+			}
+			if *updateGolden {
+				if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+					err = os.WriteFile(path, []byte(hex.EncodeToString(frame)+"\n"), 0644)
+				}
+				if err != nil {
+					t.Fatalf("%v: failed to write golden frame: %v", name, err)
+				}
+			}
+			golden := readGolden(t, path)
+			if !bytes.Equal(frame, golden) {
+				t.Fatalf("%v: encoded\n%x\nwant golden\n%x", name, frame, golden)
+			}
+
+			// frames of older peers are decoded to the same message
+			c := newGoldenClient(f, golden)
+			got, err := c.Handler.Recv(c)
+			if err != nil {
+				t.Fatalf("%v: Handler.Recv() failed: %v", name, err)
+			}
+			if f.name == "methodid" {
+				got = decodeMethodID(c, got)
+			}
+			if !bytes.Equal(got.Buffer, want.Buffer) {
+				t.Fatalf("%v: decoded\n%x\nwant\n%x", name, got.Buffer, want.Buffer)
+			}
+			if got.Method() != want.Method() || got.Seq() != want.Seq() || !bytes.Equal(got.Data(), want.Data()) {
+				t.Fatalf("%v: decoded (%v, %v, %q), want (%v, %v, %q)", name,
+					got.Method(), got.Seq(), got.Data(), want.Method(), want.Seq(), want.Data())
+			}
+		}
+	}
+}
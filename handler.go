@@ -9,7 +9,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/lesismal/arpc/codec"
 	"github.com/lesismal/arpc/log"
 	"github.com/lesismal/arpc/util"
 )
@@ -20,15 +24,107 @@ var DefaultHandler Handler = NewHandler()
 // HandlerFunc type define
 type HandlerFunc func(*Context)
 
+// NotifyFunc handles notify messages of the fast path registered by HandleNotify, msg.Data() is the
+// body in the received buffer without copying, msg is not used by arpc after the call and its buffer
+// could be released with Handler.ReleaseBuffer when the handler is done with it, or Message.Release
+// if Handler.Allocator is set
+type NotifyFunc func(c *Client, msg *Message)
+
 // RouterHandler handle message
 type RouterHandler struct {
-	Async    bool
-	Handlers []HandlerFunc
+	Async       bool
+	Envelope    bool
+	Deprecated  bool
+	Replacement string
+	MaxBodyLen  int
+	Window      int
+	Flag        string
+	Cost        int
+	CostFunc    func(ctx *Context) int
+	Fallback    HandlerFunc
+	Handlers    []HandlerFunc
+
+	// Transformers are applied by Context.Forward of the route
+	Transformers []Transformer
+
+	// index is the index of the route's own handler in Handlers, middlewares are before it
+	index int
+	stats *routeStats
+}
+
+// RouteOption configures a route registered by Handle
+type RouteOption func(*RouterHandler)
+
+// WithEnvelope makes the route respond with Envelope
+func WithEnvelope() RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Envelope = true
+	}
+}
+
+// WithDeprecated marks the route deprecated, replacement is the hint sent to callers. Calls of it
+// are counted by RouteStats.Deprecated and warned at most once a minute
+func WithDeprecated(replacement string) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Deprecated = true
+		rh.Replacement = replacement
+	}
+}
+
+// WithMaxBodyLen limits body length of messages to the route, should be less than MaxBodyLen
+func WithMaxBodyLen(size int) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.MaxBodyLen = size
+	}
+}
+
+// WithWindow advertises receive window of the route in bytes, senders block or fail
+// when the window is exhausted until messages of the route are handled
+func WithWindow(size int) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Window = size
+	}
 }
 
-// Handler defines net message handler
+// WithFlag gates the route by feature flag of Handler.FlagProvider, requests are rejected with
+// ErrMethodDisabled or degraded to the fallback of the route, and notifies are dropped when the
+// flag is off for the caller
+func WithFlag(flag string) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Flag = flag
+	}
+}
+
+// WithCost declares cost of each call to the route consumed by limiters, see Context.Cost
+func WithCost(cost int) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Cost = cost
+	}
+}
+
+// WithCostFunc computes cost of each call to the route consumed by limiters, e.g. from request
+// size by CostBySize, see Context.Cost
+func WithCostFunc(f func(ctx *Context) int) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.CostFunc = f
+	}
+}
+
+// WithFallback registers fallback handler of the route invoked instead of the route's handlers when
+// they are unavailable, see Context.Fallback
+func WithFallback(fallback HandlerFunc) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Fallback = fallback
+	}
+}
+
+// Handler defines net message handler, setters are safe to be called after clients and servers started
 type Handler interface {
-	// Clone returns a copy
+	// Clone returns a copy, routes, namespaces, middlewares and coders registered later to either
+	// are not shared. Route stats, migrated clients, the dedup payload cache and subscribers of the
+	// broker start empty. Objects set by users are shared: the Scheduler and its workers, Tracer,
+	// Capabilities, Allocator, codecs and callbacks. Maintenance mode and the flight recorder are
+	// shared until set again on either, they are replaced rather than modified
 	Clone() Handler
 
 	// LogTag returns log tag value
@@ -51,6 +147,17 @@ type Handler interface {
 	// OnOverstock would be called when Client chSend is full
 	OnOverstock(c *Client, m *Message)
 
+	// HandleQueueWatermark registers callbacks called when Client chSend fills up to high ratio of its
+	// capacity and when it drains down to low ratio after that, e.g. 0.8 and 0.2, to pause and resume
+	// producers, onLow is called in the send loop and should not block
+	HandleQueueWatermark(high, low float64, onHigh, onLow func(c *Client))
+	// QueueWatermark returns high and low ratio of HandleQueueWatermark, 0 if not set
+	QueueWatermark() (high, low float64)
+	// OnQueueHigh would be called when Client chSend reaches high watermark
+	OnQueueHigh(c *Client)
+	// OnQueueLow would be called when Client chSend drains to low watermark
+	OnQueueLow(c *Client)
+
 	// HandleMessageDropped registers callback on message dropped
 	HandleMessageDropped(onOverstock func(c *Client, m *Message))
 	// OnOverstock would be called when message is dropped
@@ -61,6 +168,23 @@ type Handler interface {
 	// OnSessionMiss would be called when Client async message seq not found
 	OnSessionMiss(c *Client, m *Message)
 
+	// HandleReadError registers callback on errors of reading that close the conn, kind classifies err,
+	// errors after the conn is closed by Client.Stop are not reported
+	HandleReadError(onReadError func(c *Client, kind IOErrorKind, err error))
+	// OnReadError would be called when reading of Client fails
+	OnReadError(c *Client, kind IOErrorKind, err error)
+
+	// HandleWriteError registers callback on errors of writing that close the conn, like HandleReadError
+	HandleWriteError(onWriteError func(c *Client, kind IOErrorKind, err error))
+	// OnWriteError would be called when writing of Client fails
+	OnWriteError(c *Client, kind IOErrorKind, err error)
+
+	// HandleDeprecated registers callback on response of deprecated method, without it a warning is
+	// logged at most once a minute per method
+	HandleDeprecated(onDeprecated func(c *Client, method string, replacement string))
+	// OnDeprecated would be called when response of deprecated method received
+	OnDeprecated(c *Client, method string, replacement string)
+
 	// BeforeRecv registers callback before Recv
 	BeforeRecv(h func(net.Conn) error)
 	// BeforeSend registers callback before Send
@@ -96,14 +220,221 @@ type Handler interface {
 	RecvBufferSize() int
 	// SetRecvBufferSize sets Client.Reader size
 	SetRecvBufferSize(size int)
+	// SetRecvBufferSizeE sets Client.Reader size, returns ErrInvalidSize if it's negative
+	SetRecvBufferSizeE(size int) error
 
 	// SendQueueSize returns Client.chSend capacity
 	SendQueueSize() int
 	// SetSendQueueSize sets Client.chSend capacity
 	SetSendQueueSize(size int)
+	// SetSendQueueSizeE sets Client.chSend capacity, returns ErrInvalidSize if it's negative
+	SetSendQueueSizeE(size int) error
+
+	// GoroutineLabels flag
+	GoroutineLabels() bool
+	// SetGoroutineLabels tags reading, sending and worker goroutines with pprof labels of
+	// loop, side and remote address, to make goroutine dumps of large servers interpretable
+	SetGoroutineLabels(enable bool)
+
+	// Maintenance returns message of maintenance mode, empty if not in maintenance
+	Maintenance() string
+	// SetMaintenance rejects requests and drops notifies of methods not in allow with a StatusError of
+	// StatusCodeUnavailable and msg, connections are kept open, an empty msg ends maintenance
+	SetMaintenance(msg string, allow ...string)
+
+	// Migration returns timeout of connection migration, 0 if disabled
+	Migration() time.Duration
+	// SetMigration enables connection migration on both sides: a client presents its connection id
+	// after reconnecting, e.g. with a new IP, and keeps pending calls instead of failing them; the
+	// server holds messages pushed to a disconnected client for timeout, and redirects them to the
+	// new connection presenting the same id
+	SetMigration(timeout time.Duration)
+	// HandleMigrated registers callback on a client migrated to a new connection, e.g. to move
+	// application state of old to new
+	HandleMigrated(onMigrated func(old *Client, new *Client))
+	// OnMigrated would be called when a client migrated to a new connection
+	OnMigrated(old *Client, new *Client)
+
+	// PayloadCache returns max number of payloads cached for Client.NotifyDedup, 0 if disabled
+	PayloadCache() int
+	// SetPayloadCache keeps size payloads recently notified by Client.NotifyDedup, so that they're
+	// not transferred again if the sender asks with their hashes
+	SetPayloadCache(size int)
+
+	// FlagProvider returns feature flag provider of routes registered with WithFlag
+	FlagProvider() FlagProvider
+	// SetFlagProvider sets feature flag provider, routes with flags are enabled if it's nil
+	SetFlagProvider(fp FlagProvider)
+
+	// Clock returns clock of timeouts and intervals, SystemClock by default
+	Clock() Clock
+	// SetClock sets clock of timeouts and intervals, e.g. a MockClock for tests and simulations
+	SetClock(clock Clock)
+
+	// SendBufferSize returns buffered writer size of batch send
+	SendBufferSize() int
+	// SetSendBufferSize enables pooled buffered writers of the size when batch send enabled,
+	// data is flushed when the send queue is idle, or every flush interval if set, 0 disables it
+	SetSendBufferSize(size int)
+	// SetSendBufferSizeE sets size of buffered writers, returns ErrInvalidSize if it's negative
+	SetSendBufferSizeE(size int) error
+
+	// FlushInterval returns flush interval of the send buffer
+	FlushInterval() time.Duration
+	// SetFlushInterval flushes the send buffer every interval instead of when the send queue is idle,
+	// Client.Flush flushes it explicitly, 0 disables it
+	SetFlushInterval(interval time.Duration)
+
+	// TinyFrame returns method table of tiny frame mode, nil if disabled
+	TinyFrame() *MethodTable
+	// SetTinyFrame enables compact frames with 1-byte method ids for constrained links,
+	// peers should use the same mode and table, nil disables it. Messages tiny frames don't carry,
+	// e.g. of streams or content types, fail to be sent with ErrInvalidTinyFrame, and with
+	// ErrTinyFrameAppFlags of application flags.
+	// Coders rewriting header bytes, e.g. compression coders, should not be used with it
+	SetTinyFrame(table *MethodTable)
+
+	// MethodIDs flag
+	MethodIDs() bool
+	// SetMethodIDs enables method ids negotiation, clients fetch method table from the server
+	// on connected and then messages are sent with 1-byte method ids instead of method names,
+	// tiny frame mode has its own method table and should not be used with it
+	SetMethodIDs(enable bool)
+
+	// VarintHeader flag
+	VarintHeader() bool
+	// SetVarintHeader enables varint header negotiation, if both sides enable it, messages are
+	// sent with uvarint body length instead of the fixed 4 bytes after negotiated on connected,
+	// tiny frame mode has its own header and should not be used with it
+	SetVarintHeader(enable bool)
+
+	// BatchAck returns delay of cumulative acks, 0 if disabled
+	BatchAck() time.Duration
+	// SetBatchAck enables cumulative acks, if both sides enable it, empty success responses are
+	// not sent one by one but acked in ranges of seqs after delay or when 1024 acks pending,
+	// negotiated by clients on connected. It saves messages of high-rate small requests
+	SetBatchAck(delay time.Duration)
+
+	// KeepAlive returns interval of keepalive notifies, 0 if disabled
+	KeepAlive() time.Duration
+	// SetKeepAlive sends keepalive notifies on connections nothing written for interval, so load
+	// balancers don't drop them silently for idle timeouts, e.g. DefaultKeepAlive. Peers drop
+	// them without responding, both sides should enable it if idle timeouts count each direction
+	SetKeepAlive(interval time.Duration)
+
+	// MaxClockSkew returns clock skew of peers tolerated, 0 if not checked
+	MaxClockSkew() time.Duration
+	// SetMaxClockSkew sets clock skew of peers tolerated, DefaultMaxClockSkew by default. Ping
+	// responses carry wall clock of the responder, skew measured by Client.Ping beyond d is passed
+	// to OnClockSkew, see Client.ClockSkew
+	SetMaxClockSkew(d time.Duration)
+	// HandleClockSkew registers callback on clock skew of a peer beyond MaxClockSkew
+	HandleClockSkew(onClockSkew func(c *Client, skew time.Duration))
+	// OnClockSkew would be called when clock skew of a peer beyond MaxClockSkew is measured, it
+	// logs a warning by default
+	OnClockSkew(c *Client, skew time.Duration)
+
+	// HandleStateChange registers callback on state transitions of clients, see ClientState. It's
+	// called synchronously by the transiting goroutine with internal locks held, so it should not
+	// stop or restart c in place, e.g. restart a stopped client in another goroutine
+	HandleStateChange(onStateChange func(c *Client, from, to ClientState))
+	// OnStateChange would be called when a client transits from state from to state to
+	OnStateChange(c *Client, from, to ClientState)
+
+	// Scheduler returns the shared workers of async routes, nil if handlers of async routes run
+	// in their own goroutines
+	Scheduler() *Scheduler
+	// SetScheduler runs handlers of async routes on the shared workers of sched, scheduled fairly
+	// across connections, they run in their own goroutines again if sched is stopped
+	SetScheduler(sched *Scheduler)
+
+	// Capabilities returns capabilities advertised to the peers, with methods of routes and limits
+	// filled, nil if disabled
+	Capabilities() *Capabilities
+	// SetCapabilities enables capability advertisement with version and metadata of caps, clients
+	// fetch capabilities of the server on connected, and calls of methods the server doesn't
+	// support fail with ErrMethodNotSupported without being sent, nil disables it
+	SetCapabilities(caps *Capabilities)
+
+	// RecvWindow returns receive window of connections, 0 if flow control disabled
+	RecvWindow() int
+	// SetRecvWindow advertises receive window of connections in bytes to the peers on connected,
+	// senders block or fail when the window is exhausted until messages are handled.
+	// Responses are not limited, sync handlers should not block on sending to the same connection
+	SetRecvWindow(size int)
+	// SetRecvWindowE sets receive window of connections, returns ErrInvalidSize if it's negative
+	SetRecvWindowE(size int) error
+
+	// PanicResponse flag
+	PanicResponse() bool
+	// SetPanicResponse recovers panics of route handlers and responds requests with PanicError
+	// carrying a correlation id logged with the stack, instead of leaving callers to time out
+	SetPanicResponse(enable bool)
+
+	// RequestIDs flag
+	RequestIDs() bool
+	// SetRequestIDs enables request ids, clients send a new id with requests and notifies without
+	// one, unless replaced by WithMeta, servers respond the id of requests in MetaKeyRequestID and
+	// log it with panics, see Context.RequestID
+	SetRequestIDs(enable bool)
+
+	// TrustedProxy returns whether MetaKeyForwardedFor of messages from c is trusted
+	TrustedProxy(c *Client) bool
+	// SetTrustedProxies sets clients trusted as gateways, MetaKeyForwardedFor of messages from
+	// others is ignored by Context.ForwardedFor and OriginAddr and dropped by Context.Forward.
+	// Nil trusts no clients, see TrustNetworks
+	SetTrustedProxies(trusted func(c *Client) bool)
+
+	// ErrorCodec returns error codec
+	ErrorCodec() ErrorCodec
+	// SetErrorCodec sets error codec for error responses
+	SetErrorCodec(ec ErrorCodec)
+
+	// Tracer returns tracer of handlers, nil if not traced
+	Tracer() *Tracer
+	// SetTracer records spans of handlers and calls issued under their Context.RequestContext to t,
+	// linked to spans of callers by MetaKeyParentSpan, see Tracer.Graph
+	SetTracer(t *Tracer)
+
+	// ContentTypeCodec returns codec of content type ct, nil if not registered
+	ContentTypeCodec(ct byte) codec.Codec
+	// SetContentTypeCodec registers codec of content type ct, 1-15, nil unregisters it. Messages of
+	// ct are decoded by cc, and responses to them encoded by cc, see WithContentType. It returns
+	// ErrInvalidContentType if ct is out of range
+	SetContentTypeCodec(ct byte, cc codec.Codec) error
+
+	// RouteStats returns counters of routes by method, empty if route stats disabled
+	RouteStats() map[string]RouteStats
+	// SetRouteStats enables counting calls, errors, bytes and latency of each route, it does
+	// nothing if built with arpc_nometrics
+	SetRouteStats(enable bool)
+
+	// FlightRecorder returns number of events kept by the flight recorder of each connection and
+	// its sample rate of frames, 0 if disabled
+	FlightRecorder() (int, int)
+	// SetFlightRecorder keeps the last size events of each connection in memory, headers of one in
+	// rate frames and all disconnections and panics, the record is dumped to the log on panics of
+	// dispatching, or read by Client.FlightRecord
+	SetFlightRecorder(size int, rate int)
+
+	// Broker returns pub/sub broker of subscribers, nil if disabled
+	Broker() *Broker
+	// SetBroker sets pub/sub broker tracking subscribers of Client.Subscribe, handlers have no
+	// broker by default, so peers can't subscribe until it's set
+	SetBroker(b *Broker)
 
 	// Use sets middleware
 	Use(h HandlerFunc)
+	// UseMethod sets middleware of method, called in order after middlewares set by Use and passed
+	// to Handle, h could call ctx.Abort or ctx.AbortWithError to stop the following handlers
+	UseMethod(method string, h HandlerFunc)
+	// UseResponse sets middleware of async responses, called in order before handlers of CallAsync
+	UseResponse(h HandlerFunc)
+	// AfterHandle adds hook post-processing bodies of responses written by ctx.Write or ctx.Error,
+	// called in order before responses sent
+	AfterHandle(h AfterHandleFunc)
+	// AfterHandles returns hooks added by AfterHandle
+	AfterHandles() []AfterHandleFunc
 
 	// UseCoder sets middleware for message encoding/decoding
 	UseCoder(coder MessageCoder)
@@ -111,12 +442,52 @@ type Handler interface {
 	// Coders returns encoding/decoding middlewares
 	Coders() []MessageCoder
 
-	// Handle registers method handler
+	// Handle registers method handler, args could be a bool for async response, RouteOptions and
+	// HandlerFuncs as middlewares of the route, called in order after middlewares set by Use
 	Handle(m string, h HandlerFunc, args ...interface{})
+	// HandleE registers method handler as Handle, it returns the error instead of panicking, which
+	// is ErrRouteExists for a method registered unless DuplicatePolicy is DuplicateOverwrite
+	HandleE(m string, h HandlerFunc, args ...interface{}) error
+
+	// HandleNamespace registers method handler as Handle in tenant namespace ns, which is selected
+	// by MetaKeyNamespace of messages, e.g. set by WithNamespace. Middlewares set by Use before are
+	// applied, "" method is the not found handler of ns and "" ns is the default routes
+	HandleNamespace(ns string, m string, h HandlerFunc, args ...interface{})
+	// Namespaces returns namespaces of HandleNamespace
+	Namespaces() []string
+	// NamespaceResolver returns resolver set by SetNamespaceResolver
+	NamespaceResolver() func(c *Client, requested string) (string, bool)
+	// SetNamespaceResolver sets resolve binding namespaces to clients, it's called with the
+	// namespace requested by MetaKeyNamespace, "" if not set, and returns the namespace of routes
+	// for the message, messages are rejected as not found if it returns false. It's called for each
+	// message and should be cheap, e.g. read the tenant of the client saved at authentication
+	SetNamespaceResolver(resolve func(c *Client, requested string) (string, bool))
+
+	// DuplicatePolicy returns how Handle, HandleNotify and HandleStream handle methods registered
+	DuplicatePolicy() DuplicatePolicy
+	// SetDuplicatePolicy sets how methods registered again are handled, DuplicatePanic by default
+	SetDuplicatePolicy(policy DuplicatePolicy)
 
 	// HandleNotFound registers "" method handler
 	HandleNotFound(h HandlerFunc)
 
+	// HandleNotify registers fast path handler for notify messages of method, it's called in the reading
+	// loop without Context and middlewares, for ingesting workloads, messages of other cmds are dropped
+	HandleNotify(m string, h NotifyFunc)
+	// HandleNotifyE registers notify handler as HandleNotify, returns the error instead of panicking
+	HandleNotifyE(m string, h NotifyFunc) error
+
+	// HandleStream registers handler for streams of method opened by the peer with Client.OpenStream,
+	// it's called in a new goroutine for each stream
+	HandleStream(m string, h StreamFunc)
+	// HandleStreamE registers stream handler as HandleStream, returns the error instead of panicking
+	HandleStreamE(m string, h StreamFunc) error
+	// MaxStreams returns number of concurrent streams the peer could open on a connection, 0 if unlimited
+	MaxStreams() int
+	// SetMaxStreams sets number of concurrent streams the peer could open on a connection,
+	// DefaultMaxStreams by default, streams opened beyond it are reset with ErrStreamLimit
+	SetMaxStreams(n int)
+
 	// OnMessage dispatches messages
 	OnMessage(c *Client, m *Message)
 
@@ -125,9 +496,30 @@ type Handler interface {
 
 	// SetBufferFactory registers buffer factory handler
 	SetBufferFactory(f func(int) []byte)
+
+	// ReleaseBuffer releases buffer got from GetBuffer
+	ReleaseBuffer(buf []byte)
+
+	// SetBufferReleaser registers buffer releaser handler, e.g. putting the buffer back to the pool of factory
+	SetBufferReleaser(f func([]byte))
+
+	// Allocator returns allocator of buffers of frames received, nil by default
+	Allocator() Allocator
+
+	// SetAllocator sets allocator of buffers of frames received, see Allocator
+	SetAllocator(a Allocator)
 }
 
+// handler is safe to be mutated after clients started, setters publish a modified copy of the state
 type handler struct {
+	mux   sync.Mutex
+	state atomic.Value
+	// deprecated maps methods of deprecated responses to unix nano of the last warning, see OnDeprecated
+	deprecated sync.Map
+}
+
+// handlerState is not modified after published, maps and slices of it are copied on write
+type handlerState struct {
 	logtag         string
 	batchRecv      bool
 	batchSend      bool
@@ -140,64 +532,201 @@ type handler struct {
 	onOverstock      func(c *Client, m *Message)
 	onMessageDropped func(c *Client, m *Message)
 	onSessionMiss    func(c *Client, m *Message)
-
-	beforeRecv    func(net.Conn) error
-	beforeSend    func(net.Conn) error
-	bufferFactory func(int) []byte
+	onQueueHigh      func(c *Client)
+	onQueueLow       func(c *Client)
+	queueHigh        float64
+	queueLow         float64
+	onDeprecated     func(c *Client, method string, replacement string)
+	onReadError      func(c *Client, kind IOErrorKind, err error)
+	onWriteError     func(c *Client, kind IOErrorKind, err error)
+
+	beforeRecv     func(net.Conn) error
+	beforeSend     func(net.Conn) error
+	bufferFactory  func(int) []byte
+	bufferReleaser func([]byte)
+	allocator      Allocator
 
 	wrapReader func(conn net.Conn) io.Reader
 
+	errorCodec ErrorCodec
+	codecs     [MaxContentType + 1]codec.Codec
+	tracer     *Tracer
+
+	goroutineLabels bool
+
+	clock Clock
+
+	maintenance *maintenance
+
+	migration  *migrations
+	onMigrated func(old *Client, new *Client)
+
+	payloads *payloadCache
+
+	flagProvider FlagProvider
+
+	sendBufferSize int
+	flushInterval  time.Duration
+
+	tinyFrame *MethodTable
+	methodIDs bool
+
+	varintHeader bool
+	batchAck     time.Duration
+
+	scheduler *Scheduler
+	keepAlive time.Duration
+
+	maxClockSkew time.Duration
+	onClockSkew  func(c *Client, skew time.Duration)
+
+	onStateChange func(c *Client, from, to ClientState)
+
+	trustedProxies func(c *Client) bool
+
+	duplicatePolicy DuplicatePolicy
+
+	capabilities *Capabilities
+
+	panicResponse bool
+	requestIDs    bool
+
+	recvWindow int
+
 	middles   []HandlerFunc
 	msgCoders []MessageCoder
 
+	methodMiddles   map[string][]HandlerFunc
+	responseMiddles []HandlerFunc
+	afterHandles    []AfterHandleFunc
+
 	routes map[string]*RouterHandler
+
+	// namespaces are route tables of tenants, see HandleNamespace
+	namespaces map[string]map[string]*RouterHandler
+
+	resolveNamespace func(c *Client, requested string) (string, bool)
+
+	notifyRoutes map[string]NotifyFunc
+
+	streamRoutes map[string]StreamFunc
+	maxStreams   int
+
+	// flowControl is set if receive window of connections or routes is set
+	flowControl bool
+
+	routeStats bool
+
+	flight *flightRecorder
+
+	broker *Broker
+}
+
+func (h *handler) load() *handlerState {
+	return h.state.Load().(*handlerState)
+}
+
+// update applies f to a copy of the state and publishes it, setters are serialized
+func (h *handler) update(f func(s *handlerState)) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s := *h.load()
+	f(&s)
+	h.state.Store(&s)
 }
 
 func (h *handler) Clone() Handler {
-	cp := *h
-	cp.middles = make([]HandlerFunc, len(h.middles))
-	copy(cp.middles, h.middles)
+	src := h.load()
+	s := *src
+	s.middles = make([]HandlerFunc, len(src.middles))
+	copy(s.middles, src.middles)
 
-	cp.msgCoders = make([]MessageCoder, len(h.msgCoders))
-	copy(cp.msgCoders, h.msgCoders)
+	s.msgCoders = make([]MessageCoder, len(src.msgCoders))
+	copy(s.msgCoders, src.msgCoders)
 
-	cp.routes = map[string]*RouterHandler{}
-	for k, v := range h.routes {
-		rh := &RouterHandler{
-			Async:    v.Async,
-			Handlers: make([]HandlerFunc, len(v.Handlers)),
+	s.notifyRoutes = copyNotifyRoutes(s.notifyRoutes)
+
+	s.routes = cloneRoutes(src.routes)
+	if src.namespaces != nil {
+		s.namespaces = make(map[string]map[string]*RouterHandler, len(src.namespaces))
+		for ns, routes := range src.namespaces {
+			s.namespaces[ns] = cloneRoutes(routes)
 		}
+	}
+
+	// state of connections and payloads served is not inherited
+	if src.migration != nil {
+		s.migration = &migrations{timeout: src.migration.timeout, clients: map[string]migrated{}}
+	}
+	if src.payloads != nil {
+		s.payloads = newPayloadCache(src.payloads.size)
+	}
+	if src.broker != nil {
+		s.broker = src.broker.clone()
+	}
+
+	cp := &handler{}
+	cp.state.Store(&s)
+	return cp
+}
+
+// cloneRoutes returns copies of routes with their own stats
+func cloneRoutes(routes map[string]*RouterHandler) map[string]*RouterHandler {
+	cp := make(map[string]*RouterHandler, len(routes))
+	for k, v := range routes {
+		rh := *v
+		rh.Handlers = make([]HandlerFunc, len(v.Handlers))
 		copy(rh.Handlers, v.Handlers)
-		cp.routes[k] = rh
+		rh.stats = &routeStats{}
+		cp[k] = &rh
 	}
+	return cp
+}
+
+func copyRoutes(routes map[string]*RouterHandler) map[string]*RouterHandler {
+	cp := make(map[string]*RouterHandler, len(routes)+1)
+	for k, v := range routes {
+		cp[k] = v
+	}
+	return cp
+}
 
-	return &cp
+func copyNotifyRoutes(routes map[string]NotifyFunc) map[string]NotifyFunc {
+	cp := make(map[string]NotifyFunc, len(routes)+1)
+	for k, v := range routes {
+		cp[k] = v
+	}
+	return cp
 }
 
 func (h *handler) LogTag() string {
-	return h.logtag
+	return h.load().logtag
 }
 
 func (h *handler) SetLogTag(tag string) {
-	h.logtag = tag
+	h.update(func(s *handlerState) { s.logtag = tag })
 }
 
 func (h *handler) HandleConnected(onConnected func(*Client)) {
 	if onConnected == nil {
 		return
 	}
-	pre := h.onConnected
-	h.onConnected = func(c *Client) {
-		if pre != nil {
-			pre(c)
+	h.update(func(s *handlerState) {
+		pre := s.onConnected
+		s.onConnected = func(c *Client) {
+			if pre != nil {
+				pre(c)
+			}
+			onConnected(c)
 		}
-		onConnected(c)
-	}
+	})
 }
 
 func (h *handler) OnConnected(c *Client) {
-	if h.onConnected != nil {
-		h.onConnected(c)
+	s := h.load()
+	h.advertiseWindows(c)
+	if s.onConnected != nil {
+		s.onConnected(c)
 	}
 }
 
@@ -205,206 +734,445 @@ func (h *handler) HandleDisconnected(onDisConnected func(*Client)) {
 	if onDisConnected == nil {
 		return
 	}
-	pre := h.onDisConnected
-	h.onDisConnected = func(c *Client) {
-		if pre != nil {
-			pre(c)
+	h.update(func(s *handlerState) {
+		pre := s.onDisConnected
+		s.onDisConnected = func(c *Client) {
+			if pre != nil {
+				pre(c)
+			}
+			onDisConnected(c)
 		}
-		onDisConnected(c)
-	}
+	})
 }
 
 func (h *handler) OnDisconnected(c *Client) {
-	if h.onDisConnected != nil {
-		h.onDisConnected(c)
+	s := h.load()
+	if s.onDisConnected != nil {
+		s.onDisConnected(c)
 	}
 }
 
 func (h *handler) HandleOverstock(onOverstock func(c *Client, m *Message)) {
-	h.onOverstock = onOverstock
+	h.update(func(s *handlerState) { s.onOverstock = onOverstock })
 }
 
 func (h *handler) OnOverstock(c *Client, m *Message) {
-	if h.onOverstock != nil {
-		h.onOverstock(c, m)
+	s := h.load()
+	if s.onOverstock != nil {
+		s.onOverstock(c, m)
 	}
 }
 
 func (h *handler) HandleMessageDropped(onMessageDropped func(c *Client, m *Message)) {
-	h.onMessageDropped = onMessageDropped
+	h.update(func(s *handlerState) { s.onMessageDropped = onMessageDropped })
 }
 
 func (h *handler) OnMessageDropped(c *Client, m *Message) {
-	if h.onMessageDropped != nil {
-		h.onMessageDropped(c, m)
+	s := h.load()
+	if s.onMessageDropped != nil {
+		s.onMessageDropped(c, m)
 	}
 }
 
 func (h *handler) HandleSessionMiss(onSessionMiss func(c *Client, m *Message)) {
-	h.onSessionMiss = onSessionMiss
+	h.update(func(s *handlerState) { s.onSessionMiss = onSessionMiss })
 }
 
 func (h *handler) OnSessionMiss(c *Client, m *Message) {
-	if h.onSessionMiss != nil {
-		h.onSessionMiss(c, m)
+	s := h.load()
+	if s.onSessionMiss != nil {
+		s.onSessionMiss(c, m)
+	}
+}
+
+func (h *handler) HandleDeprecated(onDeprecated func(c *Client, method string, replacement string)) {
+	h.update(func(s *handlerState) { s.onDeprecated = onDeprecated })
+}
+
+func (h *handler) OnDeprecated(c *Client, method string, replacement string) {
+	s := h.load()
+	if s.onDeprecated != nil {
+		s.onDeprecated(c, method, replacement)
+		return
+	}
+	last, ok := h.deprecated.Load(method)
+	if !ok {
+		last, _ = h.deprecated.LoadOrStore(method, new(int64))
+	}
+	if warnDue(last.(*int64), h.Clock().Now()) {
+		log.Warn("%v OnDeprecated: method [%v] is deprecated, replacement: [%v]", h.LogTag(), method, replacement)
 	}
 }
 
 func (h *handler) BeforeRecv(hb func(net.Conn) error) {
-	h.beforeRecv = hb
+	h.update(func(s *handlerState) { s.beforeRecv = hb })
 }
 
 func (h *handler) BeforeSend(hs func(net.Conn) error) {
-	h.beforeSend = hs
+	h.update(func(s *handlerState) { s.beforeSend = hs })
 }
 
 func (h *handler) BatchRecv() bool {
-	return h.batchRecv
+	return h.load().batchRecv
 }
 
 func (h *handler) SetBatchRecv(batch bool) {
-	h.batchRecv = batch
+	h.update(func(s *handlerState) { s.batchRecv = batch })
 }
 
 func (h *handler) BatchSend() bool {
-	return h.batchSend
+	return h.load().batchSend
 }
 
 func (h *handler) SetBatchSend(batch bool) {
-	h.batchSend = batch
+	h.update(func(s *handlerState) { s.batchSend = batch })
 }
 
 func (h *handler) AsyncResponse() bool {
-	return h.asyncResponse
+	return h.load().asyncResponse
 }
 
 func (h *handler) SetAsyncResponse(async bool) {
-	h.asyncResponse = async
+	h.update(func(s *handlerState) { s.asyncResponse = async })
 }
 
 func (h *handler) WrapReader(conn net.Conn) io.Reader {
-	if h.wrapReader != nil {
-		return h.wrapReader(conn)
+	s := h.load()
+	if s.wrapReader != nil {
+		return s.wrapReader(conn)
 	}
 	return conn
 }
 
 func (h *handler) SetReaderWrapper(wrapper func(conn net.Conn) io.Reader) {
-	h.wrapReader = wrapper
+	h.update(func(s *handlerState) { s.wrapReader = wrapper })
 }
 
 func (h *handler) RecvBufferSize() int {
-	return h.recvBufferSize
+	return h.load().recvBufferSize
 }
 
 func (h *handler) SetRecvBufferSize(size int) {
-	h.recvBufferSize = size
+	h.update(func(s *handlerState) { s.recvBufferSize = size })
 }
 
 func (h *handler) SendQueueSize() int {
-	return h.sendQueueSize
+	return h.load().sendQueueSize
 }
 
 func (h *handler) SetSendQueueSize(size int) {
-	h.sendQueueSize = size
+	h.update(func(s *handlerState) { s.sendQueueSize = size })
+}
+
+func (h *handler) GoroutineLabels() bool {
+	return h.load().goroutineLabels
+}
+
+func (h *handler) SetGoroutineLabels(enable bool) {
+	h.update(func(s *handlerState) { s.goroutineLabels = enable })
+}
+
+func (h *handler) Clock() Clock {
+	return h.load().clock
+}
+
+func (h *handler) SetClock(clock Clock) {
+	if clock == nil {
+		clock = SystemClock
+	}
+	h.update(func(s *handlerState) { s.clock = clock })
+}
+
+func (h *handler) SendBufferSize() int {
+	return h.load().sendBufferSize
+}
+
+func (h *handler) SetSendBufferSize(size int) {
+	h.update(func(s *handlerState) { s.sendBufferSize = size })
+}
+
+func (h *handler) FlushInterval() time.Duration {
+	return h.load().flushInterval
+}
+
+func (h *handler) SetFlushInterval(interval time.Duration) {
+	h.update(func(s *handlerState) { s.flushInterval = interval })
+}
+
+func (h *handler) TinyFrame() *MethodTable {
+	return h.load().tinyFrame
+}
+
+func (h *handler) SetTinyFrame(table *MethodTable) {
+	h.update(func(s *handlerState) { s.tinyFrame = table })
+}
+
+func (h *handler) MethodIDs() bool {
+	return h.load().methodIDs
+}
+
+func (h *handler) SetMethodIDs(enable bool) {
+	h.update(func(s *handlerState) { s.methodIDs = enable })
+}
+
+func (h *handler) VarintHeader() bool {
+	return h.load().varintHeader
+}
+
+func (h *handler) SetVarintHeader(enable bool) {
+	h.update(func(s *handlerState) { s.varintHeader = enable })
+}
+
+func (h *handler) RecvWindow() int {
+	return h.load().recvWindow
+}
+
+func (h *handler) SetRecvWindow(size int) {
+	h.update(func(s *handlerState) {
+		s.recvWindow = size
+		if size > 0 {
+			s.flowControl = true
+		}
+	})
+}
+
+func (h *handler) ErrorCodec() ErrorCodec {
+	return h.load().errorCodec
+}
+
+func (h *handler) SetErrorCodec(ec ErrorCodec) {
+	h.update(func(s *handlerState) { s.errorCodec = ec })
 }
 
 func (h *handler) Use(cb HandlerFunc) {
 	if cb == nil {
 		return
 	}
-	cbWithNext := func(ctx *Context) {
-		cb(ctx)
+	cbWithNext := withNext(cb)
+	h.update(func(s *handlerState) {
+		middles := make([]HandlerFunc, len(s.middles)+1)
+		copy(middles, s.middles)
+		middles[len(s.middles)] = cbWithNext
+		s.middles = middles
+		routes := copyRoutes(s.routes)
+		for k, v := range routes {
+			rh := *v
+			rh.Handlers = make([]HandlerFunc, len(v.Handlers)+1)
+			copy(rh.Handlers, v.Handlers)
+			rh.Handlers[len(v.Handlers)] = cbWithNext
+			routes[k] = &rh
+		}
+		s.routes = routes
+	})
+}
+
+// withNext calls the next handler after h if h doesn't
+func withNext(h HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		h(ctx)
 		ctx.Next()
 	}
-	h.middles = append(h.middles, cbWithNext)
-	for k, v := range h.routes {
-		rh := &RouterHandler{
-			Async:    v.Async,
-			Handlers: make([]HandlerFunc, len(v.Handlers)+1),
+}
+
+func (h *handler) UseMethod(method string, cb HandlerFunc) {
+	if cb == nil {
+		return
+	}
+	mw := withNext(cb)
+	h.update(func(s *handlerState) {
+		methodMiddles := make(map[string][]HandlerFunc, len(s.methodMiddles)+1)
+		for k, v := range s.methodMiddles {
+			methodMiddles[k] = v
 		}
-		copy(rh.Handlers, v.Handlers)
-		rh.Handlers[len(v.Handlers)] = cbWithNext
-		h.routes[k] = rh
+		middles := make([]HandlerFunc, len(methodMiddles[method])+1)
+		copy(middles, methodMiddles[method])
+		middles[len(middles)-1] = mw
+		methodMiddles[method] = middles
+		s.methodMiddles = methodMiddles
+
+		v, ok := s.routes[method]
+		if !ok {
+			return
+		}
+		rh := *v
+		rh.Handlers = make([]HandlerFunc, 0, len(v.Handlers)+1)
+		rh.Handlers = append(rh.Handlers, v.Handlers[:v.index]...)
+		rh.Handlers = append(rh.Handlers, mw)
+		rh.Handlers = append(rh.Handlers, v.Handlers[v.index:]...)
+		rh.index++
+		s.routes = copyRoutes(s.routes)
+		s.routes[method] = &rh
+	})
+}
+
+func (h *handler) UseResponse(cb HandlerFunc) {
+	if cb == nil {
+		return
 	}
+	h.update(func(s *handlerState) {
+		middles := make([]HandlerFunc, len(s.responseMiddles)+1)
+		copy(middles, s.responseMiddles)
+		middles[len(s.responseMiddles)] = withNext(cb)
+		s.responseMiddles = middles
+	})
 }
 
 func (h *handler) UseCoder(coder MessageCoder) {
 	if coder != nil {
-		h.msgCoders = append(h.msgCoders, coder)
+		h.update(func(s *handlerState) {
+			coders := make([]MessageCoder, len(s.msgCoders)+1)
+			copy(coders, s.msgCoders)
+			coders[len(s.msgCoders)] = coder
+			s.msgCoders = coders
+		})
 	}
 }
 
 func (h *handler) Coders() []MessageCoder {
-	return h.msgCoders
+	return h.load().msgCoders
 }
 
 func (h *handler) Handle(method string, cb HandlerFunc, args ...interface{}) {
 	if method == "" {
-		panic(fmt.Errorf("empty('') method is reserved for [method not found], should use HandleNotFound to register '' handler"))
+		panic(ErrEmptyMethod)
 	}
-	h.handle(method, cb, args...)
+	h.registered("Handle", h.handle(method, cb, args...))
 }
 
 func (h *handler) HandleNotFound(cb HandlerFunc) {
-	h.handle("", cb)
+	h.registered("HandleNotFound", h.handle("", cb))
+}
+
+func (h *handler) HandleNotify(method string, cb NotifyFunc) {
+	if err := checkMethod(method); err != nil {
+		panic(err)
+	}
+	h.registered("HandleNotify", h.handleNotify(method, cb))
+}
+
+func (h *handler) handleNotify(method string, cb NotifyFunc) error {
+	var err error
+	h.update(func(s *handlerState) {
+		_, ok := s.routes[method]
+		if _, ok2 := s.notifyRoutes[method]; ok || ok2 {
+			if err = s.duplicate("HandleNotify", method); err != nil {
+				return
+			}
+		}
+		s.notifyRoutes = copyNotifyRoutes(s.notifyRoutes)
+		s.notifyRoutes[method] = cb
+	})
+	return err
 }
 
-func (h *handler) handle(method string, cb HandlerFunc, args ...interface{}) {
-	if h.routes == nil {
-		h.routes = map[string]*RouterHandler{}
+func (h *handler) HandleStream(method string, cb StreamFunc) {
+	if err := checkMethod(method); err != nil {
+		panic(err)
 	}
+	h.registered("HandleStream", h.handleStream(method, cb))
+}
+
+func (h *handler) handleStream(method string, cb StreamFunc) error {
+	var err error
+	h.update(func(s *handlerState) {
+		if _, ok := s.streamRoutes[method]; ok {
+			if err = s.duplicate("HandleStream", method); err != nil {
+				return
+			}
+		}
+		routes := make(map[string]StreamFunc, len(s.streamRoutes)+1)
+		for k, v := range s.streamRoutes {
+			routes[k] = v
+		}
+		routes[method] = cb
+		s.streamRoutes = routes
+	})
+	return err
+}
+
+func (h *handler) handle(method string, cb HandlerFunc, args ...interface{}) error {
 	if len(method) > MaxMethodLen {
-		panic(fmt.Errorf("invalid method length %v(> MaxMethodLen %v)", len(method), MaxMethodLen))
+		return fmt.Errorf("%w %v(> MaxMethodLen %v)", ErrInvalidMethodLen, len(method), MaxMethodLen)
 	}
+	var err error
+	h.update(func(s *handlerState) {
+		err = s.handle(method, cb, args...)
+	})
+	return err
+}
 
-	if _, ok := h.routes[""]; !ok {
+func (s *handlerState) handle(method string, cb HandlerFunc, args ...interface{}) error {
+	if _, ok := s.routes[method]; ok && method != "" {
+		if err := s.duplicate("Handle", method); err != nil {
+			return err
+		}
+	}
+	s.routes = copyRoutes(s.routes)
+
+	if _, ok := s.routes[""]; !ok {
 		rh := &RouterHandler{
 			Async:    false,
-			Handlers: make([]HandlerFunc, len(h.middles)+1),
+			Handlers: make([]HandlerFunc, len(s.middles)+1),
 		}
-		copy(rh.Handlers, h.middles)
-		rh.Handlers[len(h.middles)] = func(ctx *Context) {
+		copy(rh.Handlers, s.middles)
+		rh.Handlers[len(s.middles)] = func(ctx *Context) {
 			ctx.Error(ErrMethodNotFound)
 			ctx.Next()
 		}
-		h.routes[""] = rh
+		s.routes[""] = rh
 	}
 
-	if _, ok := h.routes[method]; ok && method != "" {
-		panic(fmt.Errorf("handler exist for method %v ", method))
+	rh := &RouterHandler{
+		Async:    s.asyncResponse,
+		Handlers: make([]HandlerFunc, len(s.middles), len(s.middles)+1),
+		stats:    &routeStats{},
 	}
-
-	async := h.AsyncResponse()
-	if len(args) > 0 {
-		if bv, ok := args[0].(bool); ok {
-			async = bv
+	copy(rh.Handlers, s.middles)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case bool:
+			rh.Async = v
+		case RouteOption:
+			v(rh)
+		case HandlerFunc:
+			rh.Handlers = append(rh.Handlers, withNext(v))
+		case func(*Context):
+			rh.Handlers = append(rh.Handlers, withNext(v))
 		}
 	}
-	rh := &RouterHandler{
-		Async:    async,
-		Handlers: make([]HandlerFunc, len(h.middles)+1),
+	if rh.Window > 0 {
+		s.flowControl = true
 	}
-	copy(rh.Handlers, h.middles)
-	rh.Handlers[len(h.middles)] = func(ctx *Context) {
-		cb(ctx)
-		ctx.Next()
+	for _, mw := range s.methodMiddles[method] {
+		rh.Handlers = append(rh.Handlers, mw)
 	}
-	h.routes[method] = rh
+	rh.index = len(rh.Handlers)
+	rh.Handlers = append(rh.Handlers, withNext(cb))
+	s.routes[method] = rh
+	return nil
 }
 
 func (h *handler) Recv(c *Client) (*Message, error) {
+	s := h.load()
 	var (
 		err     error
 		message *Message
 	)
 
-	if h.beforeRecv != nil {
-		if err = h.beforeRecv(c.Conn); err != nil {
+	if s.beforeRecv != nil {
+		if err = s.beforeRecv(c.Conn); err != nil {
 			return nil, err
 		}
 	}
 
+	if s.tinyFrame != nil {
+		return recvTinyFrame(s.tinyFrame, c)
+	}
+
+	if atomic.LoadUint32(&c.recvVarint) == 1 {
+		return recvVarintFrame(c)
+	}
+
 	_, err = io.ReadFull(c.Reader, c.Head[:HeaderIndexBodyLenEnd])
 	if err != nil {
 		return nil, err
@@ -415,39 +1183,84 @@ func (h *handler) Recv(c *Client) (*Message, error) {
 		return nil, err
 	}
 
-	if message.Len() > HeadLen {
-		_, err = io.ReadFull(c.Reader, message.Buffer[HeaderIndexBodyLenEnd:])
+	// the rest of the header is read even if the body is empty, e.g. closing a stream
+	_, err = io.ReadFull(c.Reader, message.Buffer[HeaderIndexBodyLenEnd:])
+	if err != nil {
+		message.Release()
 	}
 
 	return message, err
 }
 
 func (h *handler) Send(conn net.Conn, buffer []byte) (int, error) {
-	if h.beforeSend != nil {
-		if err := h.beforeSend(conn); err != nil {
+	s := h.load()
+	if s.beforeSend != nil {
+		if err := s.beforeSend(conn); err != nil {
+			return -1, err
+		}
+	}
+
+	if s.tinyFrame != nil {
+		frame, err := toTinyFrame(s.tinyFrame, buffer)
+		if err != nil {
 			return -1, err
 		}
+		buffer = frame
 	}
 
 	return conn.Write(buffer)
 }
 
 func (h *handler) SendN(conn net.Conn, buffers net.Buffers) (int, error) {
-	if h.beforeSend != nil {
-		if err := h.beforeSend(conn); err != nil {
+	s := h.load()
+	if s.beforeSend != nil {
+		if err := s.beforeSend(conn); err != nil {
 			return -1, err
 		}
 	}
 
+	if s.tinyFrame != nil {
+		frames := make(net.Buffers, 0, len(buffers))
+		for _, buffer := range buffers {
+			frame, err := toTinyFrame(s.tinyFrame, buffer)
+			if err != nil {
+				return -1, err
+			}
+			frames = append(frames, frame)
+		}
+		buffers = frames
+	}
+
 	n64, err := buffers.WriteTo(conn)
 	return int(n64), err
 }
 
 func (h *handler) OnMessage(c *Client, msg *Message) {
-	defer util.Recover()
+	s := h.load()
+	if s.flight != nil {
+		defer c.recoverFlight()
+	} else {
+		defer util.Recover()
+	}
 
-	for i := len(h.msgCoders) - 1; i >= 0; i-- {
-		msg = h.msgCoders[i].Decode(c, msg)
+	raw := msg
+	for i := len(s.msgCoders) - 1; i >= 0; i-- {
+		msg = s.msgCoders[i].Decode(c, msg)
+	}
+	msg = decodeMethodID(c, msg)
+	msg.inheritAlloc(raw)
+	if s.flight != nil {
+		c.recordFrame(FlightRecv, msg)
+	}
+	h.handleMessage(c, msg, s)
+	msg.release()
+}
+
+// handleMessage dispatches msg decoded by coders
+func (h *handler) handleMessage(c *Client, msg *Message, s *handlerState) {
+	if cmd := msg.Cmd(); cmd >= CmdStreamOpen && cmd <= CmdStreamWindow {
+		h.onStream(c, msg, s)
+		return
 	}
 
 	ml := msg.MethodLen()
@@ -457,23 +1270,161 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 	}
 
 	cmd := msg.Cmd()
+	if cmd == CmdNotify && s.payloads != nil {
+		s.payloads.cache(msg)
+	}
+	if cmd == CmdNotify && len(s.notifyRoutes) > 0 {
+		if nh, ok := s.notifyRoutes[string(msg.Buffer[HeadLen:HeadLen+ml])]; ok {
+			if s.recvWindow > 0 {
+				// msg may be released by the handler
+				defer h.consumeWindow(c, "", msg.Len(), 0)
+			}
+			msg.retained = true
+			nh(c, msg)
+			return
+		}
+	}
+
+	routes := s.routesOf(c, msg)
+
+	// credit of flow controlled messages is returned to the sender after handled
+	var consumed func()
+	if method, n, ok := flowControlled(msg); ok && s.flowControl {
+		rh, exist := routes[method]
+		if s.recvWindow > 0 || (exist && rh.Window > 0) {
+			size := 0
+			if exist {
+				size = rh.Window
+			}
+			consumed = func() { h.consumeWindow(c, method, n, size) }
+			defer func() {
+				if consumed != nil {
+					consumed()
+				}
+			}()
+		}
+	}
+
 	switch cmd {
 	case CmdRequest, CmdNotify:
 		method := msg.method()
-		if rh, ok := h.routes[method]; ok {
+		if cmd == CmdNotify && method == windowRoute {
+			h.onWindow(c, msg)
+			return
+		}
+		if cmd == CmdNotify && method == protocolErrorRoute {
+			h.onProtocolError(c, msg)
+			return
+		}
+		if cmd == CmdRequest && method == migrateRoute {
+			h.onMigrate(c, msg)
+			return
+		}
+		if cmd == CmdRequest && method == dedupRoute {
+			h.onDedup(c, msg, s)
+			return
+		}
+		if cmd == CmdRequest && (method == subscribeRoute || method == unsubscribeRoute) {
+			h.onSubscribe(c, msg, s, method == subscribeRoute)
+			return
+		}
+		if s.methodIDs && cmd == CmdRequest && method == MethodTableRoute {
+			h.onMethodTable(c, msg)
+			return
+		}
+		if cmd == CmdNotify && method == KeepAliveRoute {
+			return
+		}
+		if cmd == CmdRequest && method == PingRoute {
+			h.onPing(c, msg)
+			return
+		}
+		if cmd == CmdNotify && method == ackRoute && atomic.LoadUint32(&c.batchAck) == 1 {
+			h.onAck(c, msg, s)
+			return
+		}
+		if s.batchAck > 0 && cmd == CmdRequest && method == BatchAckRoute {
+			h.onBatchAck(c, msg)
+			return
+		}
+		if s.capabilities != nil && cmd == CmdRequest && method == CapabilitiesRoute {
+			h.onCapabilities(c, msg)
+			return
+		}
+		if s.varintHeader {
+			if cmd == CmdRequest && method == FeatureRoute {
+				h.onFeatures(c, msg)
+				return
+			}
+			if cmd == CmdNotify && method == varintHeaderRoute {
+				h.onVarintHeader(c)
+				return
+			}
+		}
+		if s.maintenance != nil && !s.maintenance.allow[method] {
+			if cmd == CmdRequest {
+				ctx := newContext(c, msg, nil)
+				ctx.route = routes[method]
+				ctx.Fallback(&StatusError{Code: StatusCodeUnavailable, Message: s.maintenance.message})
+			}
+			return
+		}
+		if rh, ok := routes[method]; ok {
 			ctx := newContext(c, msg, rh.Handlers)
+			ctx.route = rh
+			var start time.Time
+			if s.routeStats {
+				ctx.stats, start = rh.stats, s.clock.Now()
+			}
+			if rh.Flag != "" && s.flagProvider != nil && !s.flagProvider.Enabled(rh.Flag, ctx) {
+				if cmd == CmdRequest {
+					ctx.Fallback(ErrMethodDisabled)
+				}
+				ctx.stats.record(ctx, start)
+				return
+			}
+			if rh.MaxBodyLen > 0 && len(msg.Data()) > rh.MaxBodyLen {
+				if cmd == CmdRequest {
+					ctx.Error(ErrMessageBodyTooLarge)
+				}
+				ctx.stats.record(ctx, start)
+				log.Warn("%v OnMessage: method [%v] body length %v exceeds %v, from %v, dropped", h.LogTag(), method, len(msg.Data()), rh.MaxBodyLen, c.Conn.RemoteAddr())
+				return
+			}
+			if rh.Deprecated {
+				if n, warn := rh.stats.deprecatedCall(h.Clock().Now()); warn {
+					log.Warn("%v OnMessage: deprecated method [%v] called %v times, last from %v, replacement: [%v]", h.LogTag(), method, n, c.Conn.RemoteAddr(), rh.Replacement)
+				}
+			}
 			if !rh.Async {
-				ctx.Next()
+				h.runRoute(ctx, s)
+				ctx.stats.record(ctx, start)
 			} else {
-				go ctx.Next()
+				done := consumed
+				consumed = nil
+				msg.retained = true
+				run := func() {
+					c.labelGoroutine(labelLoopWorker)
+					if done != nil {
+						defer done()
+					}
+					h.runRoute(ctx, s)
+					ctx.stats.record(ctx, start)
+					if !ctx.retained {
+						msg.Release()
+					}
+				}
+				if s.scheduler == nil || !s.scheduler.Submit(c, ctx.Cost(), run) {
+					go run()
+				}
 			}
 		} else {
 			if cmd == CmdRequest {
-				if rh, ok = h.routes[""]; ok {
+				if rh, ok = routes[""]; ok {
 					ctx := newContext(c, msg, rh.Handlers)
-					ctx.Next()
+					h.runRoute(ctx, s)
 				} else {
-					ctx := newContext(c, msg, rh.Handlers)
+					ctx := newContext(c, msg, nil)
 					ctx.Error(ErrMethodNotFound)
 				}
 			}
@@ -481,10 +1432,17 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 		}
 		break
 	case CmdResponse:
+		if msg.HasMeta() {
+			if replacement, ok := msg.Meta().Get(MetaKeyDeprecated); ok {
+				h.OnDeprecated(c, msg.Method(), replacement)
+			}
+		}
 		if !msg.IsAsync() {
 			seq := msg.Seq()
 			session, ok := c.getSession(seq)
 			if ok {
+				// Call owns msg after delivered
+				msg.retained = true
 				session.done <- msg
 			} else {
 				h.OnSessionMiss(c, msg)
@@ -493,8 +1451,14 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 		} else {
 			handler, ok := c.getAndDeleteAsyncHandler(msg.Seq())
 			if ok {
-				ctx := newContext(c, msg, nil)
-				handler(ctx)
+				if len(s.responseMiddles) == 0 {
+					handler(newContext(c, msg, nil))
+				} else {
+					handlers := make([]HandlerFunc, len(s.responseMiddles)+1)
+					copy(handlers, s.responseMiddles)
+					handlers[len(s.responseMiddles)] = handler
+					newContext(c, msg, handlers).Next()
+				}
 			} else {
 				h.OnSessionMiss(c, msg)
 				log.Warn("%v OnMessage: async handler not exist or expired", h.LogTag())
@@ -508,29 +1472,46 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 }
 
 func (h *handler) GetBuffer(size int) []byte {
-	if h.bufferFactory != nil {
-		return h.bufferFactory(size)
+	s := h.load()
+	if s.bufferFactory != nil {
+		return s.bufferFactory(size)
 	}
 	return make([]byte, size)
 }
 
 func (h *handler) SetBufferFactory(f func(int) []byte) {
-	h.bufferFactory = f
+	h.update(func(s *handlerState) { s.bufferFactory = f })
+}
+
+func (h *handler) ReleaseBuffer(buf []byte) {
+	s := h.load()
+	if s.bufferReleaser != nil {
+		s.bufferReleaser(buf)
+	}
+}
+
+func (h *handler) SetBufferReleaser(f func([]byte)) {
+	h.update(func(s *handlerState) { s.bufferReleaser = f })
 }
 
 // NewHandler factory
 func NewHandler() Handler {
-	h := &handler{
+	h := &handler{}
+	s := &handlerState{
 		logtag:         "[ARPC CLI]",
 		batchRecv:      true,
 		batchSend:      true,
 		asyncResponse:  false,
 		recvBufferSize: 8192,
 		sendQueueSize:  4096,
+		clock:          SystemClock,
+		maxClockSkew:   DefaultMaxClockSkew,
+		maxStreams:     DefaultMaxStreams,
 	}
-	h.wrapReader = func(conn net.Conn) io.Reader {
-		return bufio.NewReaderSize(conn, h.recvBufferSize)
+	s.wrapReader = func(conn net.Conn) io.Reader {
+		return bufio.NewReaderSize(conn, h.RecvBufferSize())
 	}
+	h.state.Store(s)
 	return h
 }
 
@@ -559,6 +1540,11 @@ func HandleOverstock(onOverstock func(c *Client, m *Message)) {
 	DefaultHandler.HandleOverstock(onOverstock)
 }
 
+// HandleQueueWatermark registers callbacks on Client chSend watermarks for DefaultHandler
+func HandleQueueWatermark(high, low float64, onHigh, onLow func(c *Client)) {
+	DefaultHandler.HandleQueueWatermark(high, low, onHigh, onLow)
+}
+
 // HandleMessageDropped registers callback on message dropped for DefaultHandler
 func HandleMessageDropped(onOverstock func(c *Client, m *Message)) {
 	DefaultHandler.HandleMessageDropped(onOverstock)
@@ -569,6 +1555,21 @@ func HandleSessionMiss(onSessionMiss func(c *Client, m *Message)) {
 	DefaultHandler.HandleSessionMiss(onSessionMiss)
 }
 
+// HandleReadError registers callback on errors of reading for DefaultHandler
+func HandleReadError(onReadError func(c *Client, kind IOErrorKind, err error)) {
+	DefaultHandler.HandleReadError(onReadError)
+}
+
+// HandleWriteError registers callback on errors of writing for DefaultHandler
+func HandleWriteError(onWriteError func(c *Client, kind IOErrorKind, err error)) {
+	DefaultHandler.HandleWriteError(onWriteError)
+}
+
+// HandleDeprecated registers callback on response of deprecated method for DefaultHandler
+func HandleDeprecated(onDeprecated func(c *Client, method string, replacement string)) {
+	DefaultHandler.HandleDeprecated(onDeprecated)
+}
+
 // BeforeRecv registers callback before Recv for DefaultHandler
 func BeforeRecv(h func(net.Conn) error) {
 	DefaultHandler.BeforeRecv(h)
@@ -624,6 +1625,11 @@ func SetRecvBufferSize(size int) {
 	DefaultHandler.SetRecvBufferSize(size)
 }
 
+// SetRecvBufferSizeE sets Client.Reader size for DefaultHandler, returns ErrInvalidSize if it's negative
+func SetRecvBufferSizeE(size int) error {
+	return DefaultHandler.SetRecvBufferSizeE(size)
+}
+
 // SendQueueSize returns Client.chSend capacity
 func SendQueueSize() int {
 	return DefaultHandler.SendQueueSize()
@@ -634,11 +1640,191 @@ func SetSendQueueSize(size int) {
 	DefaultHandler.SetSendQueueSize(size)
 }
 
+// SetSendQueueSizeE sets Client.chSend capacity for DefaultHandler, returns ErrInvalidSize if it's negative
+func SetSendQueueSizeE(size int) error {
+	return DefaultHandler.SetSendQueueSizeE(size)
+}
+
+// SetGoroutineLabels enables pprof labels of goroutines for DefaultHandler
+func SetGoroutineLabels(enable bool) {
+	DefaultHandler.SetGoroutineLabels(enable)
+}
+
+// SetMaintenance sets maintenance mode for DefaultHandler
+func SetMaintenance(msg string, allow ...string) {
+	DefaultHandler.SetMaintenance(msg, allow...)
+}
+
+// SetMigration enables connection migration for DefaultHandler
+func SetMigration(timeout time.Duration) {
+	DefaultHandler.SetMigration(timeout)
+}
+
+// HandleMigrated registers callback on a client migrated for DefaultHandler
+func HandleMigrated(onMigrated func(old *Client, new *Client)) {
+	DefaultHandler.HandleMigrated(onMigrated)
+}
+
+// SetPayloadCache sets size of the payload cache for DefaultHandler
+func SetPayloadCache(size int) {
+	DefaultHandler.SetPayloadCache(size)
+}
+
+// SetFlagProvider sets feature flag provider for DefaultHandler
+func SetFlagProvider(fp FlagProvider) {
+	DefaultHandler.SetFlagProvider(fp)
+}
+
+// SetClock sets clock for DefaultHandler
+func SetClock(clock Clock) {
+	DefaultHandler.SetClock(clock)
+}
+
+// SetSendBufferSize sets buffered writer size of batch send for DefaultHandler
+func SetSendBufferSize(size int) {
+	DefaultHandler.SetSendBufferSize(size)
+}
+
+// SetSendBufferSizeE sets size of buffered writers for DefaultHandler, returns ErrInvalidSize if it's negative
+func SetSendBufferSizeE(size int) error {
+	return DefaultHandler.SetSendBufferSizeE(size)
+}
+
+// SetFlushInterval sets flush interval of the send buffer for DefaultHandler
+func SetFlushInterval(interval time.Duration) {
+	DefaultHandler.SetFlushInterval(interval)
+}
+
+// SetMethodIDs enables method ids negotiation for DefaultHandler, should be called before clients created
+func SetMethodIDs(enable bool) {
+	DefaultHandler.SetMethodIDs(enable)
+}
+
+// SetVarintHeader enables varint header negotiation for DefaultHandler, should be called before clients created
+func SetVarintHeader(enable bool) {
+	DefaultHandler.SetVarintHeader(enable)
+}
+
+// SetPanicResponse enables panic responses for DefaultHandler
+func SetPanicResponse(enable bool) {
+	DefaultHandler.SetPanicResponse(enable)
+}
+
+// SetRequestIDs enables request ids for DefaultHandler
+func SetRequestIDs(enable bool) {
+	DefaultHandler.SetRequestIDs(enable)
+}
+
+// SetTrustedProxies sets clients trusted as gateways for DefaultHandler
+func SetTrustedProxies(trusted func(c *Client) bool) {
+	DefaultHandler.SetTrustedProxies(trusted)
+}
+
+// SetCapabilities enables capability advertisement for DefaultHandler, should be called before clients created
+func SetCapabilities(caps *Capabilities) {
+	DefaultHandler.SetCapabilities(caps)
+}
+
+// SetBatchAck enables cumulative acks of empty responses for DefaultHandler, should be called before clients created
+func SetBatchAck(delay time.Duration) {
+	DefaultHandler.SetBatchAck(delay)
+}
+
+// SetScheduler runs handlers of async routes on the shared workers of sched for DefaultHandler
+func SetScheduler(sched *Scheduler) {
+	DefaultHandler.SetScheduler(sched)
+}
+
+// SetMaxClockSkew sets clock skew of peers tolerated for DefaultHandler
+func SetMaxClockSkew(d time.Duration) {
+	DefaultHandler.SetMaxClockSkew(d)
+}
+
+// HandleClockSkew registers callback on clock skew of a peer beyond MaxClockSkew for DefaultHandler
+func HandleClockSkew(onClockSkew func(c *Client, skew time.Duration)) {
+	DefaultHandler.HandleClockSkew(onClockSkew)
+}
+
+// HandleStateChange registers callback on state transitions of clients for DefaultHandler
+func HandleStateChange(onStateChange func(c *Client, from, to ClientState)) {
+	DefaultHandler.HandleStateChange(onStateChange)
+}
+
+// SetKeepAlive sends keepalive notifies on idle connections for DefaultHandler, should be called before clients created
+func SetKeepAlive(interval time.Duration) {
+	DefaultHandler.SetKeepAlive(interval)
+}
+
+// SetTinyFrame enables tiny frame mode for DefaultHandler, should be called before clients created
+func SetTinyFrame(table *MethodTable) {
+	DefaultHandler.SetTinyFrame(table)
+}
+
+// SetRecvWindow sets receive window of connections for DefaultHandler
+func SetRecvWindow(size int) {
+	DefaultHandler.SetRecvWindow(size)
+}
+
+// SetRecvWindowE sets receive window of connections for DefaultHandler, returns ErrInvalidSize if it's negative
+func SetRecvWindowE(size int) error {
+	return DefaultHandler.SetRecvWindowE(size)
+}
+
+// SetTracer records spans of handlers to t for DefaultHandler
+func SetTracer(t *Tracer) {
+	DefaultHandler.SetTracer(t)
+}
+
+// SetContentTypeCodec registers codec of content type ct for DefaultHandler
+func SetContentTypeCodec(ct byte, cc codec.Codec) error {
+	return DefaultHandler.SetContentTypeCodec(ct, cc)
+}
+
+// SetErrorCodec sets error codec for DefaultHandler
+func SetErrorCodec(ec ErrorCodec) {
+	DefaultHandler.SetErrorCodec(ec)
+}
+
+// ReadRouteStats returns counters of routes of DefaultHandler
+func ReadRouteStats() map[string]RouteStats {
+	return DefaultHandler.RouteStats()
+}
+
+// SetRouteStats enables route stats for DefaultHandler
+func SetRouteStats(enable bool) {
+	DefaultHandler.SetRouteStats(enable)
+}
+
+// SetFlightRecorder sets flight recorder of connections for DefaultHandler
+func SetFlightRecorder(size int, rate int) {
+	DefaultHandler.SetFlightRecorder(size, rate)
+}
+
+// SetBroker sets pub/sub broker for DefaultHandler
+func SetBroker(b *Broker) {
+	DefaultHandler.SetBroker(b)
+}
+
 // Use sets middleware for DefaultHandler
 func Use(h HandlerFunc) {
 	DefaultHandler.Use(h)
 }
 
+// UseMethod sets middleware of method for DefaultHandler
+func UseMethod(method string, h HandlerFunc) {
+	DefaultHandler.UseMethod(method, h)
+}
+
+// UseResponse sets middleware of async responses for DefaultHandler
+func UseResponse(h HandlerFunc) {
+	DefaultHandler.UseResponse(h)
+}
+
+// AfterHandle adds hook post-processing bodies of responses for DefaultHandler
+func AfterHandle(h AfterHandleFunc) {
+	DefaultHandler.AfterHandle(h)
+}
+
 // UseCoder sets middleware for message encoding/decoding for DefaultHandler
 func UseCoder(coder MessageCoder) {
 	DefaultHandler.UseCoder(coder)
@@ -649,12 +1835,67 @@ func Handle(m string, h HandlerFunc, args ...interface{}) {
 	DefaultHandler.Handle(m, h, args...)
 }
 
+// HandleE registers method handler for DefaultHandler, returns the error instead of panicking
+func HandleE(m string, h HandlerFunc, args ...interface{}) error {
+	return DefaultHandler.HandleE(m, h, args...)
+}
+
+// HandleNamespace registers method handler in tenant namespace ns for DefaultHandler
+func HandleNamespace(ns string, m string, h HandlerFunc, args ...interface{}) {
+	DefaultHandler.HandleNamespace(ns, m, h, args...)
+}
+
+// SetNamespaceResolver sets resolver binding namespaces to clients for DefaultHandler
+func SetNamespaceResolver(resolve func(c *Client, requested string) (string, bool)) {
+	DefaultHandler.SetNamespaceResolver(resolve)
+}
+
+// SetDuplicatePolicy sets how methods registered again are handled for DefaultHandler
+func SetDuplicatePolicy(policy DuplicatePolicy) {
+	DefaultHandler.SetDuplicatePolicy(policy)
+}
+
 // HandleNotFound registers "" method handler for DefaultHandler
 func HandleNotFound(h HandlerFunc) {
 	DefaultHandler.HandleNotFound(h)
 }
 
+// HandleNotify registers fast path notify handler for DefaultHandler
+func HandleNotify(m string, h NotifyFunc) {
+	DefaultHandler.HandleNotify(m, h)
+}
+
+// HandleStream registers stream handler for DefaultHandler
+func HandleStream(m string, h StreamFunc) {
+	DefaultHandler.HandleStream(m, h)
+}
+
+// HandleNotifyE registers fast path notify handler for DefaultHandler, returns the error instead of panicking
+func HandleNotifyE(m string, h NotifyFunc) error {
+	return DefaultHandler.HandleNotifyE(m, h)
+}
+
+// HandleStreamE registers stream handler for DefaultHandler, returns the error instead of panicking
+func HandleStreamE(m string, h StreamFunc) error {
+	return DefaultHandler.HandleStreamE(m, h)
+}
+
+// SetMaxStreams sets number of concurrent streams the peer could open on a connection for DefaultHandler
+func SetMaxStreams(n int) {
+	DefaultHandler.SetMaxStreams(n)
+}
+
 // SetBufferFactory registers buffer factory handler for DefaultHandler
 func SetBufferFactory(f func(int) []byte) {
 	DefaultHandler.SetBufferFactory(f)
 }
+
+// SetBufferReleaser registers buffer releaser handler for DefaultHandler
+func SetBufferReleaser(f func([]byte)) {
+	DefaultHandler.SetBufferReleaser(f)
+}
+
+// SetAllocator sets allocator of buffers of frames received for DefaultHandler
+func SetAllocator(a Allocator) {
+	DefaultHandler.SetAllocator(a)
+}
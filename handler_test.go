@@ -5,9 +5,12 @@
 package arpc
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 func Test_handler_Clone(t *testing.T) {
@@ -16,6 +19,45 @@ func Test_handler_Clone(t *testing.T) {
 	}
 }
 
+func Test_handler_CloneShared(t *testing.T) {
+	h := NewHandler().(*handler)
+	h.Handle("/a", func(ctx *Context) {})
+	h.HandleNamespace("t1", "/b", func(ctx *Context) {})
+	h.SetMigration(time.Second)
+	h.SetPayloadCache(8)
+	h.SetBroker(NewBroker())
+	h.SetTracer(NewTracer(0))
+	h.SetMaintenance("upgrading")
+
+	cp := h.Clone().(*handler)
+	src, dst := h.load(), cp.load()
+	if dst.routes["/a"] == src.routes["/a"] || dst.routes["/a"].stats == src.routes["/a"].stats {
+		t.Fatalf("handler.Clone() shares routes")
+	}
+	if dst.namespaces["t1"]["/b"] == nil || dst.namespaces["t1"]["/b"] == src.namespaces["t1"]["/b"] {
+		t.Fatalf("handler.Clone() shares routes of namespaces")
+	}
+	if dst.migration == src.migration || dst.migration.timeout != time.Second {
+		t.Fatalf("handler.Clone() shares migrated clients")
+	}
+	if dst.payloads == src.payloads || dst.payloads.size != 8 {
+		t.Fatalf("handler.Clone() shares the payload cache")
+	}
+	if src.broker != nil && dst.broker == src.broker {
+		t.Fatalf("handler.Clone() shares subscribers of the broker")
+	}
+	// objects set by users are shared
+	if dst.tracer != src.tracer || cp.Maintenance() != "upgrading" {
+		t.Fatalf("handler.Clone() = (%v, %q), want the tracer and maintenance mode", dst.tracer, cp.Maintenance())
+	}
+
+	cp.HandleNamespace("t2", "/c", func(ctx *Context) {})
+	cp.SetMaintenance("")
+	if ns := h.Namespaces(); len(ns) != 1 || h.Maintenance() != "upgrading" {
+		t.Fatalf("handler.Namespaces() = %v, Maintenance() = %q after the clone changed", ns, h.Maintenance())
+	}
+}
+
 func Test_handler_LogTag(t *testing.T) {
 	if got := DefaultHandler.LogTag(); got != "[ARPC CLI]" {
 		t.Errorf("handler.LogTag() = %v, want %v", got, "[ARPC CLI]")
@@ -172,3 +214,326 @@ func TestSetHandler(t *testing.T) {
 	SetBufferFactory(func(int) []byte { return nil })
 	SetHandler(d)
 }
+
+func Test_handler_HandleDeprecated(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/deprecated", func(ctx *Context) {
+		ctx.Write(nil)
+	}, WithDeprecated("/replacement"))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	chReplacement := make(chan string, 1)
+	c.Handler.HandleDeprecated(func(c *Client, method string, replacement string) {
+		chReplacement <- replacement
+	})
+	if err = c.Call("/deprecated", "", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if got := <-chReplacement; got != "/replacement" {
+		t.Fatalf("OnDeprecated replacement = %v, want /replacement", got)
+	}
+}
+
+func Test_handler_DeprecatedCalls(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/deprecated", func(ctx *Context) {
+		ctx.Write(nil)
+	}, WithDeprecated("/replacement"))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := c.Call("/deprecated", "", nil, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if got := svr.Handler.RouteStats()["/deprecated"].Deprecated; got != 3 {
+		t.Fatalf("RouteStats() Deprecated = %v, want 3", got)
+	}
+
+	var last int64
+	now := time.Unix(1600000000, 0)
+	for _, tc := range []struct {
+		after time.Duration
+		want  bool
+	}{{0, true}, {time.Second, false}, {deprecatedWarnInterval - time.Second, true}, {time.Second, false}} {
+		now = now.Add(tc.after)
+		if got := warnDue(&last, now); got != tc.want {
+			t.Fatalf("warnDue() after %v = %v, want %v", tc.after, got, tc.want)
+		}
+	}
+}
+
+func Test_handler_WithMaxBodyLen(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/login", func(ctx *Context) {
+		ctx.Write(nil)
+	}, WithMaxBodyLen(8))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	if err = c.Call("/login", "12345678", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.Call("/login", "123456789", nil, time.Second); err == nil || err.Error() != ErrMessageBodyTooLarge.Error() {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrMessageBodyTooLarge)
+	}
+}
+
+func Test_handler_HandleNotify(t *testing.T) {
+	h := NewHandler()
+	released := 0
+	h.SetBufferReleaser(func([]byte) { released++ })
+	got := ""
+	h.HandleNotify("/fast/notify", func(c *Client, msg *Message) {
+		got = string(msg.Data())
+		c.Handler.ReleaseBuffer(msg.Buffer)
+	})
+	c := &Client{Handler: h}
+	h.OnMessage(c, newMessage(CmdNotify, "/fast/notify", "telemetry", false, false, 0, h, nil, nil))
+	if got != "telemetry" || released != 1 {
+		t.Fatalf("fast notify got (%v, %v), want (telemetry, 1)", got, released)
+	}
+
+	got = ""
+	h.OnMessage(c, newMessage(CmdRequest, "/fast/notify", "telemetry", false, false, 1, h, nil, nil))
+	if got != "" {
+		t.Fatalf("fast notify handler called for request")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("HandleNotify() duplicated method did not panic")
+		}
+	}()
+	h.HandleNotify("/fast/notify", func(*Client, *Message) {})
+}
+
+func Test_handler_SetDuplicatePolicy(t *testing.T) {
+	h := NewHandler()
+	got := ""
+	h.Handle("/dup", func(ctx *Context) { got = "first" })
+	call := func() {
+		h.OnMessage(&Client{Handler: h}, newMessage(CmdNotify, "/dup", nil, false, false, 1, h, nil, nil))
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Handle() duplicated method did not panic")
+			}
+		}()
+		h.Handle("/dup", func(ctx *Context) {})
+	}()
+	if err := h.HandleE("/dup", func(ctx *Context) {}); !errors.Is(err, ErrRouteExists) {
+		t.Fatalf("HandleE() error = %v, want %v", err, ErrRouteExists)
+	}
+	if err := h.HandleE("", func(ctx *Context) {}); err != ErrEmptyMethod {
+		t.Fatalf("HandleE() error = %v, want %v", err, ErrEmptyMethod)
+	}
+
+	h.SetDuplicatePolicy(DuplicateError)
+	h.Handle("/dup", func(ctx *Context) { got = "ignored" })
+	h.HandleStream("/dup/stream", func(*Stream) {})
+	h.HandleStream("/dup/stream", func(*Stream) {})
+	call()
+	if got != "first" {
+		t.Fatalf("handler called = %v, want first", got)
+	}
+
+	h.SetDuplicatePolicy(DuplicateOverwrite)
+	if err := h.HandleE("/dup", func(ctx *Context) { got = "second" }); err != nil {
+		t.Fatalf("HandleE() error = %v", err)
+	}
+	call()
+	if got != "second" {
+		t.Fatalf("handler called = %v, want second", got)
+	}
+}
+
+func Test_handler_MutateWhileServing(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/mutate/0", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 50; i++ {
+			svr.Handler.Handle(fmt.Sprintf("/mutate/%v", i), func(ctx *Context) {
+				ctx.Write(ctx.Body())
+			})
+			svr.Handler.Use(func(ctx *Context) {})
+			svr.Handler.SetAsyncResponse(i%2 == 0)
+			svr.Handler.HandleSessionMiss(func(*Client, *Message) {})
+			c.Handler.SetBatchSend(i%2 == 0)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		var rsp string
+		if err = c.Call("/mutate/0", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = %v, %v", rsp, err)
+		}
+	}
+	<-done
+	var rsp string
+	if err = c.Call("/mutate/50", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() route registered while serving = %v, %v", rsp, err)
+	}
+}
+
+func Test_handler_Middlewares(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	trace := func(name string) HandlerFunc {
+		return func(ctx *Context) {
+			v, _ := ctx.Get("trace")
+			s, _ := v.(string)
+			ctx.Set("trace", s+name+",")
+		}
+	}
+	svr := NewServer()
+	svr.Handler.Use(trace("use"))
+	svr.Handler.UseMethod("/mw", trace("method1"))
+	svr.Handler.Handle("/mw", func(ctx *Context) {
+		v, _ := ctx.Get("trace")
+		ctx.Write(v.(string) + "handler")
+	}, trace("route"))
+	svr.Handler.UseMethod("/mw", trace("method2"))
+	svr.Handler.UseMethod("/mw", func(ctx *Context) {
+		if string(ctx.Body()) == "deny" {
+			ctx.AbortWithError("denied")
+		}
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/mw", "allow", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if want := "use,route,method1,method2,handler"; rsp != want {
+		t.Fatalf("Client.Call() = %v, want %v", rsp, want)
+	}
+	if err = c.Call("/mw", "deny", &rsp, time.Second); err == nil || err.Error() != "denied" {
+		t.Fatalf("Client.Call() error = %v, want denied", err)
+	}
+
+	chRsp := make(chan string, 1)
+	c.Handler.UseResponse(trace("response"))
+	err = c.CallAsync("/mw", "allow", func(ctx *Context) {
+		v, _ := ctx.Get("trace")
+		s, _ := v.(string)
+		chRsp <- s
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	select {
+	case s := <-chRsp:
+		if s != "response," {
+			t.Fatalf("async response middlewares = %v, want response,", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("async response not handled")
+	}
+}
+
+func Test_handler_ConfigErrors(t *testing.T) {
+	h := NewHandler()
+	if err := CheckMethod(""); !errors.Is(err, ErrInvalidMethodLen) {
+		t.Fatalf("CheckMethod() error = %v, want %v", err, ErrInvalidMethodLen)
+	}
+	long := string(make([]byte, MaxMethodLen+1))
+	if err := h.HandleE(long, func(ctx *Context) {}); !errors.Is(err, ErrInvalidMethodLen) {
+		t.Fatalf("HandleE() error = %v, want %v", err, ErrInvalidMethodLen)
+	}
+	if err := h.HandleNotifyE(long, func(*Client, *Message) {}); !errors.Is(err, ErrInvalidMethodLen) {
+		t.Fatalf("HandleNotifyE() error = %v, want %v", err, ErrInvalidMethodLen)
+	}
+	if err := h.HandleStreamE("", func(*Stream) {}); !errors.Is(err, ErrInvalidMethodLen) {
+		t.Fatalf("HandleStreamE() error = %v, want %v", err, ErrInvalidMethodLen)
+	}
+	if err := h.HandleNotifyE("/notify", func(*Client, *Message) {}); err != nil {
+		t.Fatalf("HandleNotifyE() error = %v", err)
+	}
+	if err := h.HandleNotifyE("/notify", func(*Client, *Message) {}); !errors.Is(err, ErrRouteExists) {
+		t.Fatalf("HandleNotifyE() error = %v, want %v", err, ErrRouteExists)
+	}
+
+	for name, set := range map[string]func(int) error{
+		"SetRecvBufferSizeE": h.SetRecvBufferSizeE,
+		"SetSendQueueSizeE":  h.SetSendQueueSizeE,
+		"SetSendBufferSizeE": h.SetSendBufferSizeE,
+		"SetRecvWindowE":     h.SetRecvWindowE,
+	} {
+		if err := set(-1); !errors.Is(err, ErrInvalidSize) {
+			t.Fatalf("%v() error = %v, want %v", name, err, ErrInvalidSize)
+		}
+	}
+	if err := h.SetSendQueueSizeE(16); err != nil || h.SendQueueSize() != 16 {
+		t.Fatalf("SetSendQueueSizeE() = %v, size = %v", err, h.SendQueueSize())
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import "errors"
+
+var (
+	// ErrInvalidTicket .
+	ErrInvalidTicket = errors.New("invalid ticket")
+
+	// ErrTicketExpired .
+	ErrTicketExpired = errors.New("ticket expired")
+
+	// ErrTicketNotYetValid .
+	ErrTicketNotYetValid = errors.New("ticket issued in the future, clock skew exceeds MaxSkew")
+
+	// ErrNoCredential .
+	ErrNoCredential = errors.New("no credential or valid ticket presented")
+)
@@ -0,0 +1,271 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// DefaultTicketTTL is the lifetime of tickets by default
+	DefaultTicketTTL = time.Hour * 24
+
+	// DefaultMaxSkew is the clock skew between servers tolerated by default
+	DefaultMaxSkew = time.Second * 30
+
+	// ticketKey stores the Ticket of an authenticated client by arpc.Client.Set
+	ticketKey = "handshake.ticket"
+
+	defaultTimeout = time.Second * 5
+)
+
+type request struct {
+	Credential []byte `json:",omitempty"`
+	Ticket     string `json:",omitempty"`
+}
+
+type response struct {
+	Identity string
+	Ticket   string
+	Resumed  bool
+}
+
+// Server runs the application handshake, the heavy Authenticate is skipped for clients presenting
+// a valid ticket issued earlier, tickets are renewed on each handshake
+type Server struct {
+	// Keys signs tickets, rotated keys are still accepted until removed, see arpc.Keyring
+	Keys arpc.KeyProvider
+	// Authenticate is the heavy path, e.g. db lookups, it returns the ticket fields of the client
+	Authenticate func(c *arpc.Client, credential []byte) (identity string, data string, err error)
+	// Validate checks a ticket presented before resuming, e.g. for revoked identities,
+	// nil accepts all tickets verified and unexpired
+	Validate func(c *arpc.Client, t *Ticket) error
+	// OnAuthenticated is called after the handshake succeeds by either path
+	OnAuthenticated func(c *arpc.Client, t *Ticket, resumed bool)
+	// TTL is the lifetime of tickets, DefaultTicketTTL by default
+	TTL time.Duration
+	// MaxLifetime limits time since Issued that tickets could be renewed, 0 means no limit,
+	// clients go through the heavy path again after it
+	MaxLifetime time.Duration
+	// MaxSkew tolerates clock skew between the server issued a ticket and the one verifying it,
+	// tickets are accepted until MaxSkew after expired, DefaultMaxSkew by default
+	MaxSkew time.Duration
+}
+
+// NewServer returns Server signing tickets with keys
+func NewServer(keys arpc.KeyProvider, authenticate func(c *arpc.Client, credential []byte) (string, string, error)) *Server {
+	return &Server{Keys: keys, Authenticate: authenticate}
+}
+
+// Register registers the handshake route to h
+func (s *Server) Register(h arpc.Handler, route string) {
+	h.Handle(route, s.onHandshake)
+}
+
+// Authenticated returns the ticket of c, false if c has not finished the handshake
+func Authenticated(c *arpc.Client) (*Ticket, bool) {
+	v, ok := c.Get(ticketKey)
+	if !ok {
+		return nil, false
+	}
+	t, ok := v.(*Ticket)
+	return t, ok
+}
+
+func (s *Server) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return DefaultTicketTTL
+}
+
+func (s *Server) maxSkew() time.Duration {
+	if s.MaxSkew > 0 {
+		return s.MaxSkew
+	}
+	return DefaultMaxSkew
+}
+
+// resume returns the ticket presented if it could be resumed
+func (s *Server) resume(c *arpc.Client, ticket string, now time.Time) (*Ticket, error) {
+	skew := s.maxSkew()
+	t, err := openTicket(s.Keys, ticket, now, skew)
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxLifetime > 0 && now.Sub(time.Unix(t.Issued, 0)) >= s.MaxLifetime+skew {
+		return nil, ErrTicketExpired
+	}
+	if s.Validate != nil {
+		if err = s.Validate(c, t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (s *Server) onHandshake(ctx *arpc.Context) {
+	req := &request{}
+	if err := ctx.Bind(req); err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	c := ctx.Client
+	now := c.Handler.Clock().Now()
+	var t *Ticket
+	resumed := false
+	if req.Ticket != "" {
+		var err error
+		if t, err = s.resume(c, req.Ticket, now); err == nil {
+			resumed = true
+		} else {
+			log.Debug("%v [Handshake] ticket rejected: %v, from\t%v", c.Handler.LogTag(), err, c.Conn.RemoteAddr())
+		}
+	}
+	if t == nil {
+		if req.Credential == nil {
+			ctx.Error(ErrNoCredential)
+			return
+		}
+		identity, data, err := s.Authenticate(c, req.Credential)
+		if err != nil {
+			ctx.Error(err)
+			log.Error("%v [Handshake] failed: %v, from\t%v", c.Handler.LogTag(), err, c.Conn.RemoteAddr())
+			return
+		}
+		t = &Ticket{Identity: identity, Issued: now.Unix(), Data: data}
+	}
+
+	renewed := *t
+	renewed.Expires = now.Add(s.ttl()).Unix()
+	ticket, err := sealTicket(s.Keys, &renewed)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	c.Set(ticketKey, &renewed)
+	if s.OnAuthenticated != nil {
+		s.OnAuthenticated(c, &renewed, resumed)
+	}
+	ctx.Write(&response{Identity: renewed.Identity, Ticket: ticket, Resumed: resumed})
+}
+
+// Client runs the handshake with the Server, it keeps the ticket and presents it on reconnecting
+type Client struct {
+	*arpc.Client
+	// Route is the route registered by Server
+	Route string
+	// Credential returns the credential for the heavy path, it's called only if no ticket or the
+	// ticket is rejected
+	Credential func() []byte
+	// OnHandshake is called after each handshake of Start and reconnecting, err is not nil if it failed
+	OnHandshake func(identity string, resumed bool, err error)
+	// Timeout is the timeout of each call, 5s by default
+	Timeout time.Duration
+
+	mux    sync.Mutex
+	ticket string
+}
+
+// NewClient returns Client making handshakes on c, its loops are running already, so handshakes
+// are not made again on reconnecting, see Dial
+func NewClient(c *arpc.Client, route string, credential func() []byte) *Client {
+	return &Client{Client: c, Route: route, Credential: credential}
+}
+
+// Dial returns Client making handshakes on a client dialed by dialer and opts, the handler of the
+// client is cloned with the hook of reconnecting set before its loops start, replacing
+// arpc.Client.Handler after that races with them
+func Dial(dialer arpc.DialerFunc, route string, credential func() []byte, opts ...arpc.ClientOption) (*Client, error) {
+	c := &Client{Route: route, Credential: credential}
+	opts = append(opts[:len(opts):len(opts)], func(ac *arpc.Client) {
+		var connected int32
+		ac.Handler = ac.Handler.Clone()
+		ac.Handler.HandleConnected(func(ac *arpc.Client) {
+			// the first conn is handshaked by Start
+			if atomic.AddInt32(&connected, 1) > 1 {
+				c.handshake(ac)
+			}
+		})
+	})
+	ac, err := arpc.NewClient(dialer, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Client = ac
+	return c, nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+// Handshake presents the ticket, or the credential if there's no ticket or it's rejected,
+// and returns identity of the client and whether it's resumed by the ticket
+func (c *Client) Handshake() (string, bool, error) {
+	return c.handshakeOn(c.Client)
+}
+
+func (c *Client) handshakeOn(ac *arpc.Client) (string, bool, error) {
+	rsp := &response{}
+	var err error
+	if ticket := c.getTicket(); ticket != "" {
+		err = ac.Call(c.Route, &request{Ticket: ticket}, rsp, c.timeout())
+		if err == nil {
+			c.setTicket(rsp.Ticket)
+			return rsp.Identity, rsp.Resumed, nil
+		}
+	}
+	if c.Credential == nil {
+		if err == nil {
+			err = ErrNoCredential
+		}
+		return "", false, err
+	}
+	err = ac.Call(c.Route, &request{Credential: c.Credential()}, rsp, c.timeout())
+	if err != nil {
+		return "", false, err
+	}
+	c.setTicket(rsp.Ticket)
+	return rsp.Identity, rsp.Resumed, nil
+}
+
+// Start makes the handshake now, clients returned by Dial make it again with the ticket each time
+// they reconnect
+func (c *Client) Start() (string, bool, error) {
+	return c.handshake(c.Client)
+}
+
+func (c *Client) handshake(ac *arpc.Client) (string, bool, error) {
+	identity, resumed, err := c.handshakeOn(ac)
+	if err != nil {
+		log.Error("%v [Handshake] failed: %v, to\t%v", ac.Handler.LogTag(), err, ac.Conn.RemoteAddr())
+	}
+	if c.OnHandshake != nil {
+		c.OnHandshake(identity, resumed, err)
+	}
+	return identity, resumed, err
+}
+
+func (c *Client) getTicket() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.ticket
+}
+
+func (c *Client) setTicket(ticket string) {
+	c.mux.Lock()
+	c.ticket = ticket
+	c.mux.Unlock()
+}
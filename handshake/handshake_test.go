@@ -0,0 +1,136 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestHandshake(t *testing.T) {
+	var heavy int32
+	svr := arpc.NewServer()
+	hs := NewServer(arpc.NewKeyring("v1", []byte("secret")), func(c *arpc.Client, credential []byte) (string, string, error) {
+		atomic.AddInt32(&heavy, 1)
+		if string(credential) != "alice:password" {
+			return "", "", errors.New("wrong password")
+		}
+		return "alice", "admin", nil
+	})
+	var revoked int32
+	hs.Validate = func(c *arpc.Client, t *Ticket) error {
+		if atomic.LoadInt32(&revoked) == 1 {
+			return errors.New("revoked")
+		}
+		return nil
+	}
+	hs.Register(svr.Handler, "/handshake")
+	svr.Handler.Handle("/whoami", func(ctx *arpc.Context) {
+		if t, ok := Authenticated(ctx.Client); ok {
+			ctx.Write(t.Identity + "|" + t.Data)
+			return
+		}
+		ctx.Error("not authenticated")
+	})
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, "/handshake", func() []byte { return []byte("alice:password") })
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Stop()
+
+	chResumed := make(chan bool, 4)
+	c.OnHandshake = func(identity string, resumed bool, err error) {
+		if err == nil {
+			chResumed <- resumed
+		}
+	}
+	identity, resumed, err := c.Start()
+	if err != nil || identity != "alice" || resumed {
+		t.Fatalf("Client.Start() = %v, %v, %v, want alice, false, nil", identity, resumed, err)
+	}
+	<-chResumed
+
+	whoami := func() string {
+		var rsp string
+		if err := c.Call("/whoami", nil, &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		return rsp
+	}
+	if rsp := whoami(); rsp != "alice|admin" {
+		t.Fatalf("whoami = %v, want alice|admin", rsp)
+	}
+
+	// reconnect with the ticket skips the heavy path
+	c.Conn.Close()
+	select {
+	case resumed = <-chResumed:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("handshake on reconnecting timeout")
+	}
+	if !resumed || atomic.LoadInt32(&heavy) != 1 {
+		t.Fatalf("reconnected resumed = %v with %v heavy handshakes, want true, 1", resumed, heavy)
+	}
+	if rsp := whoami(); rsp != "alice|admin" {
+		t.Fatalf("whoami after resumed = %v, want alice|admin", rsp)
+	}
+
+	// a rejected ticket falls back to the credential
+	atomic.StoreInt32(&revoked, 1)
+	if _, resumed, err = c.Handshake(); err != nil || resumed {
+		t.Fatalf("Client.Handshake() = %v, %v, want false, nil", resumed, err)
+	}
+	if n := atomic.LoadInt32(&heavy); n != 2 {
+		t.Fatalf("heavy handshakes = %v, want 2", n)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	keys := arpc.NewKeyring("v1", []byte("old"))
+	now := time.Now()
+	s, err := sealTicket(keys, &Ticket{Identity: "alice", Issued: now.Unix(), Expires: now.Unix() + 60})
+	if err != nil {
+		t.Fatalf("sealTicket() error = %v", err)
+	}
+
+	// tickets of rotated keys are accepted until the key is removed
+	keys.Add("v2", []byte("new"))
+	keys.SetCurrent("v2")
+	if tk, err := openTicket(keys, s, now, 0); err != nil || tk.Identity != "alice" {
+		t.Fatalf("openTicket() = %v, %v, want alice", tk, err)
+	}
+	if _, err := openTicket(keys, s, now.Add(time.Minute), 0); err != ErrTicketExpired {
+		t.Fatalf("openTicket() error = %v, want %v", err, ErrTicketExpired)
+	}
+	// skew between servers is tolerated
+	if _, err := openTicket(keys, s, now.Add(time.Minute), time.Second*30); err != nil {
+		t.Fatalf("openTicket() with skew error = %v, want nil", err)
+	}
+	if _, err := openTicket(keys, s, now.Add(-time.Minute), time.Second*30); err != ErrTicketNotYetValid {
+		t.Fatalf("openTicket() issued in the future error = %v, want %v", err, ErrTicketNotYetValid)
+	}
+	if _, err := openTicket(keys, s[:len(s)-2]+"xx", now, 0); err != ErrInvalidTicket {
+		t.Fatalf("openTicket() tampered error = %v, want %v", err, ErrInvalidTicket)
+	}
+	keys.Remove("v1")
+	if _, err := openTicket(keys, s, now, 0); err != ErrInvalidTicket {
+		t.Fatalf("openTicket() removed key error = %v, want %v", err, ErrInvalidTicket)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// Ticket is the result of a handshake, signed by the server and presented by the client on
+// reconnecting to resume without the heavy path
+type Ticket struct {
+	Identity string `json:"id"`
+	// Issued is unix seconds of the heavy handshake, it's kept by tickets renewed on resuming
+	Issued int64 `json:"iat"`
+	// Expires is unix seconds the ticket expires at
+	Expires int64 `json:"exp"`
+	// Data is application data of the handshake, e.g. roles loaded from db
+	Data string `json:"data,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+func ticketMAC(key []byte, version, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(version))
+	mac.Write([]byte{'.'})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sealTicket encodes t as "version.payload.mac" with the current key of keys
+func sealTicket(keys arpc.KeyProvider, t *Ticket) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	version, key := keys.Current()
+	v := encoding.EncodeToString([]byte(version))
+	payload := encoding.EncodeToString(data)
+	return v + "." + payload + "." + encoding.EncodeToString(ticketMAC(key, v, payload)), nil
+}
+
+// openTicket verifies s with key of its version and returns the ticket if it's valid at now,
+// tolerating skew between clocks of the server issuing it and now
+func openTicket(keys arpc.KeyProvider, s string, now time.Time, skew time.Duration) (*Ticket, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidTicket
+	}
+	version, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	key, ok := keys.Key(string(version))
+	if !ok {
+		return nil, ErrInvalidTicket
+	}
+	mac, err := encoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(mac, ticketMAC(key, parts[0], parts[1])) {
+		return nil, ErrInvalidTicket
+	}
+	data, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	t := &Ticket{}
+	if err = json.Unmarshal(data, t); err != nil {
+		return nil, ErrInvalidTicket
+	}
+	if now.Add(-skew).Unix() >= t.Expires {
+		return nil, ErrTicketExpired
+	}
+	if now.Add(skew).Unix() < t.Issued {
+		return nil, ErrTicketNotYetValid
+	}
+	return t, nil
+}
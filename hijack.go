@@ -0,0 +1,140 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// HTTPUpgradeProtocol is the Upgrade header of connections upgraded from HTTP, see Server.ServeHTTP
+const HTTPUpgradeProtocol = "arpc"
+
+// hijackedConn reads bytes buffered by the HTTP reader before the conn
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// withBuffered returns conn reading bytes buffered by r first, or conn itself if nothing buffered
+func withBuffered(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r == nil || r.Buffered() == 0 {
+		return conn
+	}
+	return &hijackedConn{Conn: conn, r: r}
+}
+
+// ServeHTTP implements http.Handler, requests with "Upgrade: arpc" are switched to arpc by
+// hijacking the connection, which is served as accepted by Serve. It lets arpc share a port, e.g.
+// 443 with TLS, with an existing HTTP server:
+//
+//	http.Handle("/arpc", server)
+//	...
+//	client, _ := arpc.NewClient(func() (net.Conn, error) {
+//		return arpc.DialHTTP("localhost:8080", "/arpc", time.Second)
+//	})
+//
+// Hijacking needs HTTP/1.1, HTTP/2 connections are responded 505
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", HTTPUpgradeProtocol) {
+		w.Header().Set("Upgrade", HTTPUpgradeProtocol)
+		http.Error(w, "arpc upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "arpc upgrade needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Warn("%v\t%v\thijack failed: %v", s.Handler.LogTag(), r.RemoteAddr, err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + HTTPUpgradeProtocol + "\r\nConnection: Upgrade\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		log.Warn("%v\t%v\tupgrade failed: %v", s.Handler.LogTag(), r.RemoteAddr, err)
+		conn.Close()
+		return
+	}
+	// deadlines set by the HTTP server are not for arpc
+	conn.SetDeadline(time.Time{})
+	s.accept(withBuffered(conn, rw.Reader), nil)
+}
+
+// stopHTTP stops clients of ServeHTTP for servers without a listener
+func (s *Server) stopHTTP() error {
+	s.running = false
+	s.clearClients()
+	log.Info("%v Stop", s.Handler.LogTag())
+	return nil
+}
+
+// DialHTTP dials addr and upgrades the connection on path of an HTTP server, see Server.ServeHTTP
+func DialHTTP(addr string, path string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	upgraded, err := UpgradeHTTP(conn, addr, path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return upgraded, nil
+}
+
+// UpgradeHTTP upgrades conn dialed to an HTTP server on path of host, e.g. conn of tls.Dial
+// for servers on 443, which should not negotiate h2 by ALPN. It returns the conn to use
+func UpgradeHTTP(conn net.Conn, host string, path string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", HTTPUpgradeProtocol)
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: %v", ErrHTTPUpgrade, rsp.Status)
+	}
+	return withBuffered(conn, br), nil
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
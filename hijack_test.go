@@ -0,0 +1,76 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestServer_ServeHTTP(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	defer svr.Stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/arpc", svr)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("world"))
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+	addr := strings.TrimPrefix(hs.URL, "http://")
+
+	conn, err := DialHTTP(addr, "/arpc", time.Second)
+	if err != nil {
+		t.Fatalf("DialHTTP() error = %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+	for i := 0; i < 3; i++ {
+		rsp := ""
+		if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = (%q, %v)", rsp, err)
+		}
+	}
+
+	// the HTTP server still serves other paths
+	rsp, err := http.Get(hs.URL + "/hello")
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("http.Get() status = %v", rsp.Status)
+	}
+
+	rsp, err = http.Get(hs.URL + "/arpc")
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("http.Get() status = %v, want %v", rsp.StatusCode, http.StatusUpgradeRequired)
+	}
+
+	raw, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer raw.Close()
+	if _, err = UpgradeHTTP(raw, addr, "/hello"); !errors.Is(err, ErrHTTPUpgrade) {
+		t.Fatalf("UpgradeHTTP() error = %v, want %v", err, ErrHTTPUpgrade)
+	}
+}
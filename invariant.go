@@ -0,0 +1,152 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writersInUse counts buffered writers taken from writerPool and not put back
+var writersInUse int64
+
+var invariants struct {
+	enabled uint32
+
+	mux        sync.Mutex
+	clients    map[*Client]struct{}
+	violations []string
+}
+
+// InvariantError lists violated invariants found by CheckInvariants
+type InvariantError struct {
+	Violations []string
+}
+
+// Error implements error
+func (e *InvariantError) Error() string {
+	return "arpc: invariants violated:\n\t" + strings.Join(e.Violations, "\n\t")
+}
+
+// EnableInvariants enables or disables invariant checks for tests and soak runs, clients are tracked
+// from then on and previous state is dropped. Clients created before enabled are not checked, and
+// should be stopped before it since process-wide counters are checked too
+func EnableInvariants(enable bool) {
+	invariants.mux.Lock()
+	invariants.clients = nil
+	invariants.violations = nil
+	if enable {
+		invariants.clients = map[*Client]struct{}{}
+		atomic.StoreUint32(&invariants.enabled, 1)
+	} else {
+		atomic.StoreUint32(&invariants.enabled, 0)
+	}
+	invariants.mux.Unlock()
+}
+
+func invariantsEnabled() bool {
+	return atomic.LoadUint32(&invariants.enabled) == 1
+}
+
+func trackClient(c *Client) {
+	if !invariantsEnabled() {
+		return
+	}
+	invariants.mux.Lock()
+	if invariants.clients != nil {
+		invariants.clients[c] = struct{}{}
+	}
+	invariants.mux.Unlock()
+}
+
+func violateInvariant(format string, v ...interface{}) {
+	invariants.mux.Lock()
+	invariants.violations = append(invariants.violations, fmt.Sprintf(format, v...))
+	invariants.mux.Unlock()
+}
+
+// checkSeq records a violation if seq is still in use by a session or an async handler, must be
+// called with c.mux locked
+func (c *Client) checkSeq(seq uint64) {
+	if !invariantsEnabled() {
+		return
+	}
+	_, inSession := c.sessionMap[seq]
+	_, inAsync := c.asyncHandlerMap[seq]
+	if inSession || inAsync {
+		violateInvariant("%v: duplicate seq %v in flight", c.Conn.RemoteAddr(), seq)
+	}
+}
+
+// CheckInvariants checks invariants of tracked clients after traffic is quiesced, it retries until
+// all invariants hold or timeout, since send loops and stopping may lag behind the caller:
+//
+// - sessions and async handlers of each client are all done
+// - send queues of running clients are drained, and bytes of the send budget returned
+// - buffered writers of stopped clients are put back to the pool
+// - seqs of in-flight calls are unique
+func CheckInvariants(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		violations := checkInvariants()
+		if len(violations) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return &InvariantError{Violations: violations}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func checkInvariants() []string {
+	invariants.mux.Lock()
+	violations := append([]string{}, invariants.violations...)
+	clients := make([]*Client, 0, len(invariants.clients))
+	for c := range invariants.clients {
+		clients = append(clients, c)
+	}
+	invariants.mux.Unlock()
+
+	var writers int64
+	var running bool
+	for _, c := range clients {
+		addr := c.Conn.RemoteAddr()
+		c.mux.RLock()
+		sessions, asyncHandlers, queued := len(c.sessionMap), len(c.asyncHandlerMap), 0
+		if c.running {
+			// messages left in send queue of stopped clients are dropped with their budget
+			running, queued = true, len(c.chSend)
+		}
+		c.mux.RUnlock()
+		if sessions > 0 {
+			violations = append(violations, fmt.Sprintf("%v: %v sessions left", addr, sessions))
+		}
+		if asyncHandlers > 0 {
+			violations = append(violations, fmt.Sprintf("%v: %v async handlers left", addr, asyncHandlers))
+		}
+		if queued > 0 {
+			violations = append(violations, fmt.Sprintf("%v: %v messages left in send queue", addr, queued))
+		}
+		if n := c.SendBuffered(); n != 0 {
+			violations = append(violations, fmt.Sprintf("%v: %v bytes of send budget not returned", addr, n))
+		}
+		c.wmux.Lock()
+		if c.wconn != nil {
+			writers++
+		}
+		c.wmux.Unlock()
+	}
+	if n := atomic.LoadInt64(&writersInUse); n != writers {
+		violations = append(violations, fmt.Sprintf("%v buffered writers taken from pool, %v in use by clients", n, writers))
+	}
+	if n := SendBuffered(); !running && n != 0 {
+		violations = append(violations, fmt.Sprintf("%v bytes of send budget not returned after all clients stopped", n))
+	}
+	return violations
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	EnableInvariants(true)
+	defer EnableInvariants(false)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/invariant", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	done := make(chan struct{}, 10)
+	for i := 0; i < 10; i++ {
+		var rsp string
+		if err = c.Call("/invariant", "hello", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		if err = c.CallAsync("/invariant", "hello", func(*Context) { done <- struct{}{} }, time.Second); err != nil {
+			t.Fatalf("Client.CallAsync() error = %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if err = CheckInvariants(time.Second); err != nil {
+		t.Fatalf("CheckInvariants() error = %v", err)
+	}
+
+	sess := newSession(c.seq + 1)
+	c.addSession(sess.seq, sess)
+	c.addSession(sess.seq, sess)
+	err = CheckInvariants(time.Millisecond * 20)
+	if err == nil {
+		t.Fatalf("CheckInvariants() returned nil with a leaked session")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "duplicate seq") || !strings.Contains(msg, "1 sessions left") {
+		t.Fatalf("CheckInvariants() error = %v", msg)
+	}
+	c.deleteSession(sess.seq)
+	invariants.violations = nil
+
+	c.Stop()
+	if err = CheckInvariants(time.Second); err != nil {
+		t.Fatalf("CheckInvariants() after stopped error = %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// IOErrorKind classifies errors of reading and writing conns, see Handler.HandleReadError
+type IOErrorKind int
+
+const (
+	// IOErrorOther is kind of errors not classified
+	IOErrorOther IOErrorKind = iota
+	// IOErrorEOF means the peer closed the conn, including in the middle of a frame
+	IOErrorEOF
+	// IOErrorTimeout means a deadline exceeded, e.g. set in Handler.BeforeRecv
+	IOErrorTimeout
+	// IOErrorReset means the conn is reset or broken, e.g. ECONNRESET or EPIPE
+	IOErrorReset
+	// IOErrorProtocol means frames of the peer violate the protocol, see ProtocolError
+	IOErrorProtocol
+)
+
+var ioErrorKindNames = []string{"other", "eof", "timeout", "reset", "protocol"}
+
+// String implements fmt.Stringer
+func (k IOErrorKind) String() string {
+	if k >= 0 && int(k) < len(ioErrorKindNames) {
+		return ioErrorKindNames[k]
+	}
+	return "unknown"
+}
+
+// ClassifyIOError returns kind of err of reading or writing conns
+func ClassifyIOError(err error) IOErrorKind {
+	var ne net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return IOErrorEOF
+	case errors.As(err, &ne) && ne.Timeout():
+		return IOErrorTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return IOErrorReset
+	}
+	if _, ok := protocolErrorCode(err); ok {
+		return IOErrorProtocol
+	}
+	return IOErrorOther
+}
+
+func (h *handler) HandleReadError(onReadError func(c *Client, kind IOErrorKind, err error)) {
+	h.update(func(s *handlerState) { s.onReadError = onReadError })
+}
+
+func (h *handler) OnReadError(c *Client, kind IOErrorKind, err error) {
+	s := h.load()
+	if s.onReadError != nil {
+		s.onReadError(c, kind, err)
+	}
+}
+
+func (h *handler) HandleWriteError(onWriteError func(c *Client, kind IOErrorKind, err error)) {
+	h.update(func(s *handlerState) { s.onWriteError = onWriteError })
+}
+
+func (h *handler) OnWriteError(c *Client, kind IOErrorKind, err error) {
+	s := h.load()
+	if s.onWriteError != nil {
+		s.onWriteError(c, kind, err)
+	}
+}
+
+// onReadError reports err that stopped reading, errors caused by Client.Stop or closing after
+// writing failed are not reported
+func (c *Client) onReadError(err error) {
+	if reason := c.CloseReason(); reason == CloseReasonLocal || reason == CloseReasonWriteError {
+		return
+	}
+	c.Handler.OnReadError(c, ClassifyIOError(err), err)
+}
+
+// closeOnWriteError closes the conn of c after writing failed, reading fails next and the conn
+// is stopped or reconnected by the reading loop
+func (c *Client) closeOnWriteError(err error) {
+	local := c.CloseReason() == CloseReasonLocal
+	c.setCloseReason(CloseReasonWriteError, err)
+	c.Conn.Close()
+	if !local {
+		c.Handler.OnWriteError(c, ClassifyIOError(err), err)
+	}
+}
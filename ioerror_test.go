@@ -0,0 +1,146 @@
+package arpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyIOError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want IOErrorKind
+	}{
+		{io.EOF, IOErrorEOF},
+		{io.ErrUnexpectedEOF, IOErrorEOF},
+		{os.ErrDeadlineExceeded, IOErrorTimeout},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, IOErrorReset},
+		{fmt.Errorf("write: %w", syscall.EPIPE), IOErrorReset},
+		{fmt.Errorf("%w: %v", ErrInvalidBodyLen, -1), IOErrorProtocol},
+		{ErrInvalidTinyFrame, IOErrorProtocol},
+		{errors.New("other"), IOErrorOther},
+	}
+	for _, tt := range tests {
+		if got := ClassifyIOError(tt.err); got != tt.want {
+			t.Errorf("ClassifyIOError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+type failWriteConn struct {
+	net.Conn
+	fail int32
+}
+
+func (c *failWriteConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) != 0 {
+		return 0, &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	}
+	return c.Conn.Write(b)
+}
+
+func TestHandler_HandleReadError(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	chKind := make(chan IOErrorKind, 4)
+	svr.Handler.HandleReadError(func(c *Client, kind IOErrorKind, err error) {
+		chKind <- kind
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	wantKind := func(want IOErrorKind) {
+		t.Helper()
+		select {
+		case kind := <-chKind:
+			if kind != want {
+				t.Fatalf("OnReadError kind = %v, want %v", kind, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnReadError not called, want %v", want)
+		}
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	conn.Close()
+	wantKind(IOErrorEOF)
+
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	head := make([]byte, HeaderIndexBodyLenEnd)
+	binary.LittleEndian.PutUint32(head[HeaderIndexBodyLenBegin:], uint32(MaxBodyLen+1))
+	conn.Write(head)
+	wantKind(IOErrorProtocol)
+	conn.Close()
+
+	svr.Handler.BeforeRecv(func(conn net.Conn) error {
+		return conn.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	})
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	wantKind(IOErrorTimeout)
+}
+
+func TestHandler_HandleWriteError(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	chKind := make(chan IOErrorKind, 2)
+	chRead := make(chan error, 2)
+	h := DefaultHandler.Clone()
+	h.HandleWriteError(func(c *Client, kind IOErrorKind, err error) {
+		chKind <- kind
+	})
+	h.HandleReadError(func(c *Client, kind IOErrorKind, err error) {
+		chRead <- err
+	})
+	wc := &failWriteConn{}
+	c, err := NewClient(func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		wc.Conn = conn
+		return wc, err
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	atomic.StoreInt32(&wc.fail, 1)
+	c.Notify("/none", "", time.Second)
+	select {
+	case kind := <-chKind:
+		if kind != IOErrorReset {
+			t.Fatalf("OnWriteError kind = %v, want %v", kind, IOErrorReset)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnWriteError not called")
+	}
+	select {
+	case err := <-chRead:
+		t.Fatalf("OnReadError called after write error: %v", err)
+	case <-time.After(time.Millisecond * 20):
+	}
+}
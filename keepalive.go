@@ -0,0 +1,45 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "time"
+
+const (
+	// KeepAliveRoute is the internal route of keepalive notifies, dropped by the peer
+	KeepAliveRoute = "_arpc.keepalive"
+
+	// DefaultKeepAlive stays under idle timeouts of common load balancers: 60 seconds of AWS ALB,
+	// 350 of AWS NLB, 4 minutes of Azure LB and 30 seconds or more usually set for HAProxy
+	DefaultKeepAlive = time.Second * 25
+)
+
+func (h *handler) KeepAlive() time.Duration {
+	return h.load().keepAlive
+}
+
+func (h *handler) SetKeepAlive(interval time.Duration) {
+	h.update(func(s *handlerState) { s.keepAlive = interval })
+}
+
+// startKeepAlive starts keepalive of the connection if enabled, the timer is stopped on
+// disconnection and started again after reconnected
+func (c *Client) startKeepAlive() {
+	if interval := c.Handler.KeepAlive(); interval > 0 {
+		c.keepAlive(interval, interval)
+	}
+}
+
+// keepAlive sends a keepalive notify after d if nothing is written for interval by then
+func (c *Client) keepAlive(interval, d time.Duration) {
+	c.AfterFunc(d, func() {
+		idle := c.Handler.Clock().Now().Sub(c.LastWrite())
+		if idle >= interval {
+			// a full urgent lane is being sent anyway
+			c.tryUrgent(newMessage(CmdNotify, KeepAliveRoute, nil, false, false, 0, c.Handler, c.Codec, nil))
+			idle = 0
+		}
+		c.keepAlive(interval, interval-idle)
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestHandler_SetKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	h := NewHandler()
+	h.SetKeepAlive(time.Millisecond * 20)
+	c := newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	defer c.Stop()
+
+	time.Sleep(time.Millisecond * 150)
+	st := c.Stats()
+	if st.MessagesOut < 3 {
+		t.Fatalf("keepalive notifies sent = %v, want >= 3", st.MessagesOut)
+	}
+	if st.MessagesIn != 0 {
+		t.Fatalf("messages received = %v, keepalive notifies should not be responded", st.MessagesIn)
+	}
+
+	// keepalive is not sent while the connection is busy
+	out := st.MessagesOut
+	for i := 0; i < 10; i++ {
+		rsp := ""
+		if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = (%q, %v)", rsp, err)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if sent := c.Stats().MessagesOut - out; sent > 12 {
+		t.Fatalf("messages sent while busy = %v, want <= 12", sent)
+	}
+	c.Stop()
+	if n := c.Timers(); n != 0 {
+		t.Fatalf("Client.Timers() = %v after stopped, want 0", n)
+	}
+}
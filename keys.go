@@ -0,0 +1,84 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "sync"
+
+// KeyProvider provides versioned keys of auth and cipher components, e.g. message signers and
+// passwords of pubsub, Current signs or authenticates new messages and connections, while older
+// versions are still accepted by Key, so keys could be rotated without disconnecting clients
+type KeyProvider interface {
+	// Current returns version and key in use
+	Current() (version string, key []byte)
+	// Key returns key of version, false if the version is unknown or retired
+	Key(version string) ([]byte, bool)
+}
+
+// Keyring is a KeyProvider of keys in memory, a rotation usually goes by Add the new version on
+// servers, SetCurrent on clients and servers, and Remove the old version at last
+type Keyring struct {
+	mux     sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns Keyring with key of version in use
+func NewKeyring(version string, key []byte) *Keyring {
+	return &Keyring{
+		current: version,
+		keys:    map[string][]byte{version: append([]byte(nil), key...)},
+	}
+}
+
+// Current implements KeyProvider
+func (k *Keyring) Current() (string, []byte) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// Key implements KeyProvider
+func (k *Keyring) Key(version string) ([]byte, bool) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	key, ok := k.keys[version]
+	return key, ok
+}
+
+// Add adds key of version to be accepted, it replaces the key if version exists
+func (k *Keyring) Add(version string, key []byte) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.keys[version] = append([]byte(nil), key...)
+}
+
+// SetCurrent sets version in use, the version should be added
+func (k *Keyring) SetCurrent(version string) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if _, ok := k.keys[version]; !ok {
+		return ErrKeyNotFound
+	}
+	k.current = version
+	return nil
+}
+
+// Remove retires key of version, the version in use could not be removed
+func (k *Keyring) Remove(version string) bool {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if _, ok := k.keys[version]; !ok || version == k.current {
+		return false
+	}
+	delete(k.keys, version)
+	return true
+}
+
+// Versions returns number of versions accepted
+func (k *Keyring) Versions() int {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	return len(k.keys)
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "testing"
+
+func TestKeyring(t *testing.T) {
+	k := NewKeyring("v1", []byte("key1"))
+	if err := k.SetCurrent("v2"); err != ErrKeyNotFound {
+		t.Fatalf("Keyring.SetCurrent() error = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	k.Add("v2", []byte("key2"))
+	if version, key := k.Current(); version != "v1" || string(key) != "key1" {
+		t.Fatalf("Keyring.Current() = %v, %s, want v1, key1", version, key)
+	}
+	if err := k.SetCurrent("v2"); err != nil {
+		t.Fatalf("Keyring.SetCurrent() error = %v", err)
+	}
+	if version, key := k.Current(); version != "v2" || string(key) != "key2" {
+		t.Fatalf("Keyring.Current() = %v, %s, want v2, key2", version, key)
+	}
+	if key, ok := k.Key("v1"); !ok || string(key) != "key1" {
+		t.Fatalf("Keyring.Key(v1) = %s, %v, want key1, true", key, ok)
+	}
+
+	if k.Remove("v2") {
+		t.Fatalf("Keyring.Remove() removed the version in use")
+	}
+	if !k.Remove("v1") {
+		t.Fatalf("Keyring.Remove(v1) = false, want true")
+	}
+	if _, ok := k.Key("v1"); ok {
+		t.Fatalf("Keyring.Key(v1) found after removed")
+	}
+	if n := k.Versions(); n != 1 {
+		t.Fatalf("Keyring.Versions() = %v, want 1", n)
+	}
+}
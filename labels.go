@@ -0,0 +1,34 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+const (
+	// LabelLoop is pprof label key of goroutine role: accept, recv, send or worker
+	LabelLoop = "arpc.loop"
+	// LabelSide is pprof label key of connection side: client or server
+	LabelSide = "arpc.side"
+	// LabelAddr is pprof label key of remote address, or listening address of accept loop
+	LabelAddr = "arpc.addr"
+
+	labelLoopAccept = "accept"
+	labelLoopRecv   = "recv"
+	labelLoopSend   = "send"
+	labelLoopWorker = "worker"
+
+	labelSideClient = "client"
+	labelSideServer = "server"
+)
+
+// labelGoroutine sets pprof labels of the current goroutine if enabled by Handler.SetGoroutineLabels
+func (c *Client) labelGoroutine(loop string) {
+	if !c.Handler.GoroutineLabels() {
+		return
+	}
+	side := labelSideClient
+	if c.Dialer == nil {
+		side = labelSideServer
+	}
+	setGoroutineLabels(loop, side, c.Conn.RemoteAddr().String())
+}
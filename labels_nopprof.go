@@ -0,0 +1,11 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build arpc_nopprof
+// +build arpc_nopprof
+
+package arpc
+
+// setGoroutineLabels does nothing, runtime/pprof is compiled out by arpc_nopprof
+func setGoroutineLabels(loop, side, addr string) {}
@@ -0,0 +1,17 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nopprof
+// +build !arpc_nopprof
+
+package arpc
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+func setGoroutineLabels(loop, side, addr string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels(LabelLoop, loop, LabelSide, side, LabelAddr, addr)))
+}
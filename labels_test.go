@@ -0,0 +1,63 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nopprof
+// +build !arpc_nopprof
+
+package arpc
+
+import (
+	"bytes"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoroutineLabels(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetGoroutineLabels(true)
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	SetGoroutineLabels(true)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetGoroutineLabels(false)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	want := []string{
+		`"arpc.loop":"accept"`,
+		`"arpc.loop":"recv"`,
+		`"arpc.loop":"send"`,
+		`"arpc.side":"client"`,
+		`"arpc.side":"server"`,
+	}
+	var dump string
+	for i := 0; i < 100; i++ {
+		buf := &bytes.Buffer{}
+		pprof.Lookup("goroutine").WriteTo(buf, 1)
+		dump = buf.String()
+		missing := false
+		for _, w := range want {
+			if !strings.Contains(dump, w) {
+				missing = true
+			}
+		}
+		if !missing {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("goroutine labels missing in dump:\n%v", dump)
+}
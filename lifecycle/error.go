@@ -0,0 +1,21 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lifecycle
+
+import "errors"
+
+var (
+	// ErrDuplicateSubsystem .
+	ErrDuplicateSubsystem = errors.New("subsystem already added")
+
+	// ErrUnknownDependency .
+	ErrUnknownDependency = errors.New("unknown dependency of subsystem")
+
+	// ErrDependencyCycle .
+	ErrDependencyCycle = errors.New("dependency cycle of subsystems")
+
+	// ErrAlreadyStarted .
+	ErrAlreadyStarted = errors.New("subsystems already started")
+)
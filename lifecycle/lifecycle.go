@@ -0,0 +1,284 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// Subsystem is an optional part of a composed server, e.g. metrics, pubsub, discovery or admin
+type Subsystem interface {
+	// Start starts the subsystem, it should not block until the subsystem stops
+	Start(ctx context.Context) error
+	// Stop stops the subsystem, it should return before ctx is done
+	Stop(ctx context.Context) error
+}
+
+// HealthChecker is implemented by subsystems reporting health while running
+type HealthChecker interface {
+	Health() error
+}
+
+// State of a subsystem
+type State int
+
+const (
+	// StateStopped .
+	StateStopped State = iota
+	// StateStarting .
+	StateStarting
+	// StateRunning .
+	StateRunning
+	// StateStopping .
+	StateStopping
+	// StateFailed is the state of subsystems failed to start or stop
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status of a subsystem
+type Status struct {
+	Name  string
+	State State
+	// Err is the error failed to start or stop, or the error of HealthChecker while running
+	Err error
+}
+
+// Option configures a subsystem added to Manager
+type Option func(u *unit)
+
+// DependsOn sets subsystems started before and stopped after the subsystem
+func DependsOn(names ...string) Option {
+	return func(u *unit) { u.deps = append(u.deps, names...) }
+}
+
+// WithPriority orders subsystems not depending on each other, higher ones start earlier and stop
+// later, 0 by default
+func WithPriority(priority int) Option {
+	return func(u *unit) { u.priority = priority }
+}
+
+type unit struct {
+	name     string
+	sub      Subsystem
+	deps     []string
+	priority int
+	index    int
+
+	state State
+	err   error
+}
+
+// Manager starts subsystems in dependency order and stops them in reverse order, so a composed
+// server shuts down cleanly, e.g. the rpc server stops accepting before pubsub and metrics stop
+type Manager struct {
+	mux     sync.Mutex
+	units   []*unit
+	byName  map[string]*unit
+	order   []*unit
+	started bool
+}
+
+// New returns Manager
+func New() *Manager {
+	return &Manager{byName: map[string]*unit{}}
+}
+
+// Add adds subsystem s with name, it should be called before Start
+func (m *Manager) Add(name string, s Subsystem, opts ...Option) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.started {
+		return ErrAlreadyStarted
+	}
+	if _, ok := m.byName[name]; ok {
+		return fmt.Errorf("%w: %v", ErrDuplicateSubsystem, name)
+	}
+	u := &unit{name: name, sub: s, index: len(m.units)}
+	for _, opt := range opts {
+		opt(u)
+	}
+	m.units = append(m.units, u)
+	m.byName[name] = u
+	return nil
+}
+
+// sortUnits returns units in dependency order, ties are broken by priority and order of Add
+func (m *Manager) sortUnits() ([]*unit, error) {
+	pending := map[*unit]int{}
+	dependents := map[*unit][]*unit{}
+	for _, u := range m.units {
+		for _, dep := range u.deps {
+			d, ok := m.byName[dep]
+			if !ok {
+				return nil, fmt.Errorf("%w: %v of %v", ErrUnknownDependency, dep, u.name)
+			}
+			pending[u]++
+			dependents[d] = append(dependents[d], u)
+		}
+	}
+
+	var ready, order []*unit
+	for _, u := range m.units {
+		if pending[u] == 0 {
+			ready = append(ready, u)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if ready[i].priority != ready[j].priority {
+				return ready[i].priority > ready[j].priority
+			}
+			return ready[i].index < ready[j].index
+		})
+		u := ready[0]
+		ready = ready[1:]
+		order = append(order, u)
+		for _, d := range dependents[u] {
+			if pending[d]--; pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if len(order) != len(m.units) {
+		return nil, ErrDependencyCycle
+	}
+	return order, nil
+}
+
+// Start starts subsystems in dependency order, subsystems started are stopped if one fails
+func (m *Manager) Start(ctx context.Context) error {
+	m.mux.Lock()
+	if m.started {
+		m.mux.Unlock()
+		return ErrAlreadyStarted
+	}
+	order, err := m.sortUnits()
+	if err != nil {
+		m.mux.Unlock()
+		return err
+	}
+	m.started, m.order = true, order
+	m.mux.Unlock()
+
+	for i, u := range order {
+		m.setState(u, StateStarting, nil)
+		if err := u.sub.Start(ctx); err != nil {
+			m.setState(u, StateFailed, err)
+			log.Error("[Lifecycle] start %v failed: %v", u.name, err)
+			m.stop(ctx, order[:i])
+			return fmt.Errorf("start %v: %w", u.name, err)
+		}
+		m.setState(u, StateRunning, nil)
+		log.Info("[Lifecycle] %v started", u.name)
+	}
+	return nil
+}
+
+// Stop stops subsystems in reverse order of starting, all of them are stopped even if some fail,
+// the first error is returned
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mux.Lock()
+	order := m.order
+	m.mux.Unlock()
+	return m.stop(ctx, order)
+}
+
+func (m *Manager) stop(ctx context.Context, order []*unit) error {
+	var first error
+	for i := len(order) - 1; i >= 0; i-- {
+		u := order[i]
+		m.mux.Lock()
+		running := u.state == StateRunning
+		m.mux.Unlock()
+		if !running {
+			continue
+		}
+		m.setState(u, StateStopping, nil)
+		if err := u.sub.Stop(ctx); err != nil {
+			m.setState(u, StateFailed, err)
+			log.Error("[Lifecycle] stop %v failed: %v", u.name, err)
+			if first == nil {
+				first = fmt.Errorf("stop %v: %w", u.name, err)
+			}
+			continue
+		}
+		m.setState(u, StateStopped, nil)
+		log.Info("[Lifecycle] %v stopped", u.name)
+	}
+	return first
+}
+
+// Run starts subsystems, waits until ctx is done, then stops them within timeout
+func (m *Manager) Run(ctx context.Context, timeout time.Duration) error {
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.Stop(stopCtx)
+}
+
+func (m *Manager) setState(u *unit, state State, err error) {
+	m.mux.Lock()
+	u.state, u.err = state, err
+	m.mux.Unlock()
+}
+
+// Health returns status of subsystems in starting order, or in order of Add if not started
+func (m *Manager) Health() []Status {
+	m.mux.Lock()
+	units := m.order
+	if units == nil {
+		units = m.units
+	}
+	statuses := make([]Status, len(units))
+	for i, u := range units {
+		statuses[i] = Status{Name: u.name, State: u.state, Err: u.err}
+	}
+	m.mux.Unlock()
+
+	for i, u := range units {
+		if hc, ok := u.sub.(HealthChecker); ok && statuses[i].State == StateRunning {
+			statuses[i].Err = hc.Health()
+		}
+	}
+	return statuses
+}
+
+// Healthy returns nil if all subsystems are running and healthy
+func (m *Manager) Healthy() error {
+	for _, s := range m.Health() {
+		if s.State != StateRunning {
+			return fmt.Errorf("%v is %v", s.Name, s.State)
+		}
+		if s.Err != nil {
+			return fmt.Errorf("%v: %w", s.Name, s.Err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lesismal/arpc"
+)
+
+func recorder(events *[]string, name string, startErr error) Subsystem {
+	return Func(
+		func(ctx context.Context) error {
+			*events = append(*events, "start "+name)
+			return startErr
+		},
+		func(ctx context.Context) error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	)
+}
+
+func TestManager(t *testing.T) {
+	var events []string
+	m := New()
+	m.Add("admin", recorder(&events, "admin", nil), DependsOn("rpc"))
+	m.Add("metrics", recorder(&events, "metrics", nil))
+	m.Add("rpc", recorder(&events, "rpc", nil), DependsOn("pubsub", "metrics"))
+	m.Add("pubsub", recorder(&events, "pubsub", nil), WithPriority(1))
+	if err := m.Add("rpc", recorder(&events, "rpc", nil)); !errors.Is(err, ErrDuplicateSubsystem) {
+		t.Fatalf("Manager.Add() error = %v, want %v", err, ErrDuplicateSubsystem)
+	}
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Manager.Start() error = %v", err)
+	}
+	if err := m.Healthy(); err != nil {
+		t.Fatalf("Manager.Healthy() = %v", err)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatalf("Manager.Stop() error = %v", err)
+	}
+	want := "start pubsub,start metrics,start rpc,start admin,stop admin,stop rpc,stop metrics,stop pubsub"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for _, s := range m.Health() {
+		if s.State != StateStopped {
+			t.Fatalf("%v is %v after Stop", s.Name, s.State)
+		}
+	}
+}
+
+func TestManager_StartFailed(t *testing.T) {
+	var events []string
+	errFailed := errors.New("failed")
+	m := New()
+	m.Add("metrics", recorder(&events, "metrics", nil))
+	m.Add("rpc", recorder(&events, "rpc", errFailed), DependsOn("metrics"))
+	m.Add("admin", recorder(&events, "admin", nil), DependsOn("rpc"))
+	if err := m.Start(context.Background()); !errors.Is(err, errFailed) {
+		t.Fatalf("Manager.Start() error = %v, want %v", err, errFailed)
+	}
+	want := "start metrics,start rpc,stop metrics"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if err := m.Healthy(); err == nil {
+		t.Fatalf("Manager.Healthy() = nil after start failed")
+	}
+
+	m = New()
+	m.Add("a", recorder(&events, "a", nil), DependsOn("b"))
+	m.Add("b", recorder(&events, "b", nil), DependsOn("a"))
+	if err := m.Start(context.Background()); err != ErrDependencyCycle {
+		t.Fatalf("Manager.Start() error = %v, want %v", err, ErrDependencyCycle)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) { ctx.Write(ctx.Body()) })
+	m := New()
+	m.Add("rpc", Server(svr, ln))
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Manager.Start() error = %v", err)
+	}
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	rsp := ""
+	if err := c.Call("/echo", "hello", &rsp, arpc.TimeForever); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v", rsp, err)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatalf("Manager.Stop() error = %v", err)
+	}
+	if err := m.Healthy(); err == nil {
+		t.Fatalf("Manager.Healthy() = nil after Stop")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/metrics"
+)
+
+type funcSubsystem struct {
+	start func(ctx context.Context) error
+	stop  func(ctx context.Context) error
+}
+
+func (f *funcSubsystem) Start(ctx context.Context) error {
+	if f.start == nil {
+		return nil
+	}
+	return f.start(ctx)
+}
+
+func (f *funcSubsystem) Stop(ctx context.Context) error {
+	if f.stop == nil {
+		return nil
+	}
+	return f.stop(ctx)
+}
+
+// Func returns Subsystem of start and stop, either could be nil, e.g. for service.Service:
+//
+//	m.Add("discovery", lifecycle.Func(nil, func(ctx context.Context) error { svc.Stop(); return nil }))
+func Func(start, stop func(ctx context.Context) error) Subsystem {
+	return &funcSubsystem{start: start, stop: stop}
+}
+
+// Pusher returns Subsystem of a metrics pusher
+func Pusher(p *metrics.Pusher) Subsystem {
+	return Func(
+		func(ctx context.Context) error { p.Start(); return nil },
+		func(ctx context.Context) error { p.Stop(); return nil },
+	)
+}
+
+// serving is a server serving a listener in background, it's unhealthy if serving returned
+// before stopping
+type serving struct {
+	serve    func() error
+	shutdown func(ctx context.Context) error
+
+	mux      sync.Mutex
+	stopping bool
+	err      error
+}
+
+func (s *serving) Start(ctx context.Context) error {
+	go func() {
+		err := s.serve()
+		s.mux.Lock()
+		if !s.stopping {
+			s.err = err
+		}
+		s.mux.Unlock()
+	}()
+	return nil
+}
+
+func (s *serving) Stop(ctx context.Context) error {
+	s.mux.Lock()
+	s.stopping = true
+	s.mux.Unlock()
+	return s.shutdown(ctx)
+}
+
+func (s *serving) Health() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.err
+}
+
+// Server returns Subsystem serving ln by svr, it's stopped by svr.Shutdown
+func Server(svr *arpc.Server, ln net.Listener) Subsystem {
+	return &serving{
+		serve:    func() error { return svr.Serve(ln) },
+		shutdown: svr.Shutdown,
+	}
+}
+
+// HTTPServer returns Subsystem serving ln by srv, e.g. with admin.Admin as the handler
+func HTTPServer(srv *http.Server, ln net.Listener) Subsystem {
+	return &serving{
+		serve:    func() error { return srv.Serve(ln) },
+		shutdown: srv.Shutdown,
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+// maintenance defines maintenance mode of a handler, see Handler.SetMaintenance
+type maintenance struct {
+	message string
+	allow   map[string]bool
+}
+
+func (h *handler) Maintenance() string {
+	if m := h.load().maintenance; m != nil {
+		return m.message
+	}
+	return ""
+}
+
+func (h *handler) SetMaintenance(msg string, allow ...string) {
+	var m *maintenance
+	if msg != "" {
+		m = &maintenance{message: msg, allow: make(map[string]bool, len(allow))}
+		for _, method := range allow {
+			m.allow[method] = true
+		}
+	}
+	h.update(func(s *handlerState) { s.maintenance = m })
+}
+
+// SetMaintenance enters maintenance mode for planned maintenance windows: requests of methods not in
+// allow are rejected with a StatusError of StatusCodeUnavailable and msg while connections are kept
+// open, an empty msg ends maintenance
+func (s *Server) SetMaintenance(msg string, allow ...string) {
+	s.Handler.SetMaintenance(msg, allow...)
+}
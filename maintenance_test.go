@@ -0,0 +1,55 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_SetMaintenance(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/maintenance/work", func(ctx *Context) {
+		ctx.Write("done")
+	}, WithEnvelope())
+	svr.Handler.Handle("/maintenance/health", func(ctx *Context) {
+		ctx.Write("ok")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	svr.SetMaintenance("upgrading, retry later", "/maintenance/health")
+	if msg := svr.Handler.Maintenance(); msg != "upgrading, retry later" {
+		t.Fatalf("Handler.Maintenance() = %v", msg)
+	}
+	var se *StatusError
+	err = c.Call("/maintenance/work", nil, nil, time.Second)
+	if !errors.As(err, &se) || se.Code != StatusCodeUnavailable || se.Message != "upgrading, retry later" {
+		t.Fatalf("Client.Call() error = %v, want StatusError %v", err, StatusCodeUnavailable)
+	}
+	var rsp string
+	if err = c.Call("/maintenance/health", nil, &rsp, time.Second); err != nil || rsp != "ok" {
+		t.Fatalf("Client.Call() allowed method = (%v, %v), want (ok, nil)", rsp, err)
+	}
+
+	svr.SetMaintenance("")
+	if err = c.Call("/maintenance/work", nil, &rsp, time.Second); err != nil || rsp != "done" {
+		t.Fatalf("Client.Call() after maintenance = (%v, %v), want (done, nil)", rsp, err)
+	}
+}
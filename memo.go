@@ -0,0 +1,195 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// DefaultMemoMaxEntries is the max number of results cached by a Memo if it's not set
+const DefaultMemoMaxEntries = 10000
+
+// Memo caches results of a handler with stale-while-revalidate semantics. Results younger than TTL are
+// responded without calling the handler, results older than TTL but within TTL+Stale are responded
+// immediately and refreshed in background, older results are refreshed before responding.
+//
+// A Memo is used for one method, so methods could be cached with different TTLs. Only responses not of
+// errors are cached, they are cached as written, so handlers should not modify them after writing.
+// Background refreshing calls the handler with the context of the request triggered it, responses
+// written by it are dropped.
+type Memo struct {
+	// TTL is the time results are fresh
+	TTL time.Duration
+	// Stale is the time results are still responded after TTL while refreshing, 0 disables it
+	Stale time.Duration
+	// MaxEntries limits number of results cached, DefaultMemoMaxEntries if not positive
+	MaxEntries int
+	// Key returns key of a request, requests are not cached if it returns an empty string.
+	// By default, it's the method with the request body
+	Key func(ctx *Context) string
+
+	mux     sync.Mutex
+	entries map[string]*memoEntry
+}
+
+type memoEntry struct {
+	v          interface{}
+	rspMeta    Metadata
+	fresh      time.Time
+	stale      time.Time
+	refreshing bool
+}
+
+// NewMemo returns Memo with ttl and stale
+func NewMemo(ttl, stale time.Duration) *Memo {
+	return &Memo{TTL: ttl, Stale: stale}
+}
+
+func (m *Memo) maxEntries() int {
+	if m.MaxEntries > 0 {
+		return m.MaxEntries
+	}
+	return DefaultMemoMaxEntries
+}
+
+func (m *Memo) key(ctx *Context) string {
+	if m.Key != nil {
+		return m.Key(ctx)
+	}
+	return ctx.Message.Method() + "\x00" + string(ctx.Body())
+}
+
+// Handler returns handler responding results of h cached by m
+func (m *Memo) Handler(h HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		if ctx.Message.Cmd() != CmdRequest {
+			h(ctx)
+			return
+		}
+		key := m.key(ctx)
+		if key == "" {
+			h(ctx)
+			return
+		}
+		now := ctx.Client.Handler.Clock().Now()
+
+		m.mux.Lock()
+		e, ok := m.entries[key]
+		if ok && now.Before(e.stale) {
+			refresh := !now.Before(e.fresh) && !e.refreshing
+			if refresh {
+				e.refreshing = true
+			}
+			m.mux.Unlock()
+			if refresh {
+				// copied before, values of ctx are dropped after the handler returned
+				rctx := refreshContext(ctx)
+				go util.Safe(func() { m.refresh(rctx, h, key) })
+			}
+			for k, v := range e.rspMeta {
+				ctx.SetResponseMeta(k, v)
+			}
+			ctx.write(e.v, false, TimeForever)
+			return
+		}
+		m.mux.Unlock()
+
+		m.capture(ctx, key)
+		h(ctx)
+	}
+}
+
+// refreshContext returns a copy of ctx for refresh, responses written to it are discarded
+func refreshContext(ctx *Context) *Context {
+	rctx := newContext(ctx.Client, ctx.Message, nil)
+	rctx.route = ctx.route
+	rctx.discard = true
+	for k, v := range ctx.Values {
+		rctx.Set(k, v)
+	}
+	return rctx
+}
+
+// refresh calls h with rctx, a copy of the request by refreshContext, responses are cached but not sent
+func (m *Memo) refresh(rctx *Context, h HandlerFunc, key string) {
+	defer func() {
+		m.mux.Lock()
+		if e, ok := m.entries[key]; ok {
+			e.refreshing = false
+		}
+		m.mux.Unlock()
+	}()
+	m.capture(rctx, key)
+	h(rctx)
+}
+
+// capture caches the first response written to ctx if it's not an error
+func (m *Memo) capture(ctx *Context, key string) {
+	captured := false
+	onWrite := ctx.onWrite
+	ctx.onWrite = func(v interface{}, isError bool) {
+		if onWrite != nil {
+			onWrite(v, isError)
+		}
+		if captured || isError {
+			return
+		}
+		captured = true
+		e := &memoEntry{v: v}
+		for k, v := range ctx.rspMeta {
+			if e.rspMeta == nil {
+				e.rspMeta = Metadata{}
+			}
+			e.rspMeta[k] = v
+		}
+		m.set(ctx.Client.Handler.Clock().Now(), key, e)
+	}
+}
+
+func (m *Memo) set(now time.Time, key string, e *memoEntry) {
+	e.fresh = now.Add(m.TTL)
+	e.stale = e.fresh.Add(m.Stale)
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.entries == nil {
+		m.entries = map[string]*memoEntry{}
+	}
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.maxEntries() {
+		for k, old := range m.entries {
+			if !now.Before(old.stale) {
+				delete(m.entries, k)
+			}
+		}
+		if len(m.entries) >= m.maxEntries() {
+			return
+		}
+	}
+	m.entries[key] = e
+}
+
+// Invalidate removes the result cached of key
+func (m *Memo) Invalidate(key string) {
+	m.mux.Lock()
+	delete(m.entries, key)
+	m.mux.Unlock()
+}
+
+// Purge removes all results cached
+func (m *Memo) Purge() {
+	m.mux.Lock()
+	m.entries = nil
+	m.mux.Unlock()
+}
+
+// Len returns number of results cached
+func (m *Memo) Len() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return len(m.entries)
+}
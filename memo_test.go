@@ -0,0 +1,83 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemo(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	mc := NewMockClock(time.Unix(0, 0))
+	var calls int32
+	memo := NewMemo(time.Second, time.Second*2)
+	svr := NewServer()
+	svr.Handler.SetClock(mc)
+	svr.Handler.Handle("/memo/get", memo.Handler(func(ctx *Context) {
+		ctx.Write(strconv.Itoa(int(atomic.AddInt32(&calls, 1))))
+	}))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	get := func() string {
+		rsp := ""
+		if err := c.Call("/memo/get", "k", &rsp, time.Second*5); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		return rsp
+	}
+
+	if rsp := get(); rsp != "1" {
+		t.Fatalf("first call = %v, want 1", rsp)
+	}
+	if rsp := get(); rsp != "1" {
+		t.Fatalf("fresh call = %v, want cached 1", rsp)
+	}
+
+	// stale results are responded while refreshing
+	mc.Advance(time.Second)
+	if rsp := get(); rsp != "1" {
+		t.Fatalf("stale call = %v, want cached 1", rsp)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for get() != "2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale result not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v := atomic.LoadInt32(&calls); v != 2 {
+		t.Fatalf("handler called %v times, want 2", v)
+	}
+
+	// expired results are refreshed before responding
+	mc.Advance(time.Second * 3)
+	if rsp := get(); rsp != "3" {
+		t.Fatalf("expired call = %v, want 3", rsp)
+	}
+
+	memo.Invalidate("/memo/get\x00k")
+	if rsp := get(); rsp != "4" {
+		t.Fatalf("call after Invalidate = %v, want 4", rsp)
+	}
+	if n := memo.Len(); n != 1 {
+		t.Fatalf("Memo.Len() = %v, want 1", n)
+	}
+}
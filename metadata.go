@@ -0,0 +1,125 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxMetaLen limit
+	MaxMetaLen int = 0xFFFF
+
+	// MetaKeyDeprecated is set on responses of deprecated methods, value is the replacement hint
+	MetaKeyDeprecated = "arpc-deprecated"
+)
+
+// Metadata defines key-value pairs carried by a message on the wire
+type Metadata map[string]string
+
+// Get returns value for key
+func (md Metadata) Get(key string) (string, bool) {
+	if md == nil {
+		return "", false
+	}
+	value, ok := md[key]
+	return value, ok
+}
+
+// Set sets key-value pair
+func (md Metadata) Set(key, value string) {
+	md[key] = value
+}
+
+// toBytes encodes pairs as [keyLen:1][key][valueLen:2][value], sorted by key. Pairs of empty keys,
+// keys longer than 255 or values longer than 65535 are skipped, ErrMetaTooLarge is returned if the
+// rest are encoded to more than MaxMetaLen
+func (md Metadata) toBytes() ([]byte, error) {
+	keys := make([]string, 0, len(md))
+	size := 0
+	for k, v := range md {
+		if len(k) == 0 || len(k) > 0xFF || len(v) > 0xFFFF {
+			continue
+		}
+		keys = append(keys, k)
+		size += 3 + len(k) + len(v)
+	}
+	if size > MaxMetaLen {
+		return nil, ErrMetaTooLarge
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, size)
+	for _, k := range keys {
+		v := md[k]
+		buf = append(buf, byte(len(k)))
+		buf = append(buf, k...)
+		buf = append(buf, byte(len(v)), byte(len(v)>>8))
+		buf = append(buf, v...)
+	}
+	return buf, nil
+}
+
+func metadataFromBytes(data []byte) Metadata {
+	md := Metadata{}
+	for len(data) > 0 {
+		kl := int(data[0])
+		if len(data) < 1+kl+2 {
+			break
+		}
+		k := string(data[1 : 1+kl])
+		vl := int(binary.LittleEndian.Uint16(data[1+kl:]))
+		if len(data) < 3+kl+vl {
+			break
+		}
+		md[k] = string(data[3+kl : 3+kl+vl])
+		data = data[3+kl+vl:]
+	}
+	return md
+}
+
+// setOutgoingMeta sets metadata of request or notify msg sent by c: a new request id if request
+// ids enabled and msg has none, and labels of c. Internal messages are not set. It returns
+// ErrMetaTooLarge if metadata of msg has no room for them
+func (c *Client) setOutgoingMeta(msg *Message) error {
+	return c.setOutgoingMetaWithID(msg, "")
+}
+
+// setOutgoingMetaFrom sets metadata as setOutgoingMeta, with the request id carried by ctx
+func (c *Client) setOutgoingMetaFrom(ctx context.Context, msg *Message) error {
+	id, _ := RequestIDFrom(ctx)
+	return c.setOutgoingMetaWithID(msg, id)
+}
+
+func (c *Client) setOutgoingMetaWithID(msg *Message, id string) error {
+	if strings.HasPrefix(msg.method(), internalRoutePrefix) {
+		return nil
+	}
+	md := msg.Meta()
+	if id == "" && c.Handler.RequestIDs() {
+		if _, ok := md.Get(MetaKeyRequestID); !ok {
+			id = NewRequestID()
+		}
+	}
+	if id == "" && c.labelsMeta == "" && c.namespace == "" {
+		return nil
+	}
+	if md == nil {
+		md = Metadata{}
+	}
+	if id != "" {
+		md[MetaKeyRequestID] = id
+	}
+	if c.labelsMeta != "" {
+		md[MetaKeyClientLabels] = c.labelsMeta
+	}
+	if c.namespace != "" {
+		md[MetaKeyNamespace] = c.namespace
+	}
+	return msg.SetMeta(md)
+}
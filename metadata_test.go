@@ -0,0 +1,49 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestMessage_SetMeta(t *testing.T) {
+	msg := newMessage(CmdRequest, "method", "data", false, false, 1, DefaultHandler, codec.DefaultCodec, nil)
+	if msg.HasMeta() || msg.Meta() != nil {
+		t.Fatalf("Message.Meta() = %v, want nil", msg.Meta())
+	}
+
+	if err := msg.SetMeta(Metadata{"k1": "v1", "k2": ""}); err != nil {
+		t.Fatalf("Message.SetMeta() error = %v", err)
+	}
+	if !msg.HasMeta() {
+		t.Fatalf("Message.HasMeta() = false, want true")
+	}
+	md := msg.Meta()
+	if v, ok := md.Get("k1"); !ok || v != "v1" {
+		t.Fatalf("Metadata.Get(k1) = %v, want v1", v)
+	}
+	if _, ok := md.Get("k2"); !ok {
+		t.Fatalf("Metadata.Get(k2) not found")
+	}
+	if string(msg.Data()) != "data" || msg.Method() != "method" {
+		t.Fatalf("Message.Data() = %v, Method() = %v, want data, method", string(msg.Data()), msg.Method())
+	}
+	if msg.BodyLen() != len(msg.Buffer)-HeadLen {
+		t.Fatalf("Message.BodyLen() = %v, want %v", msg.BodyLen(), len(msg.Buffer)-HeadLen)
+	}
+
+	if err := msg.SetMeta(nil); err != nil || msg.HasMeta() || string(msg.Data()) != "data" || msg.BodyLen() != 10 {
+		t.Fatalf("Message.SetMeta(nil) failed: %v, %v", err, msg.Buffer)
+	}
+
+	buf := msg.Buffer
+	large := Metadata{"k1": strings.Repeat("v", 0xFFFF-4), "k2": "v2"}
+	if err := msg.SetMeta(large); err != ErrMetaTooLarge || &msg.Buffer[0] != &buf[0] {
+		t.Fatalf("Message.SetMeta() of large metadata error = %v, want %v and the message unchanged", err, ErrMetaTooLarge)
+	}
+}
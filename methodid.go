@@ -0,0 +1,142 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// MethodTableRoute is the internal route negotiating method ids
+	MethodTableRoute = "_arpc.methods"
+
+	// method length byte with methodIDMask set means the method is sent as 1-byte id
+	methodIDMask byte = 0x80
+
+	methodTableTimeout = time.Second * 5
+)
+
+// sendMethodTable returns method table used to encode sending messages, nil if not negotiated
+func (c *Client) sendMethodTable() *MethodTable {
+	table, _ := c.sendMethods.Load().(*MethodTable)
+	return table
+}
+
+// recvMethodTable returns method table used to decode received messages, nil if not negotiated
+func (c *Client) recvMethodTable() *MethodTable {
+	table, _ := c.recvMethods.Load().(*MethodTable)
+	return table
+}
+
+// negotiateMethods fetches method table of the server, methods in the table are sent as ids later
+func (c *Client) negotiateMethods() {
+	c.sendMethods.Store((*MethodTable)(nil))
+	c.recvMethods.Store((*MethodTable)(nil))
+	rsp := ""
+	if err := c.Call(MethodTableRoute, nil, &rsp, methodTableTimeout); err != nil {
+		log.Warn("%v\t%v\tnegotiate method ids failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+		return
+	}
+	var methods []string
+	if rsp != "" {
+		methods = strings.Split(rsp, "\n")
+	}
+	table, err := NewMethodTable(methods...)
+	if err != nil {
+		log.Warn("%v\t%v\tnegotiate method ids failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+		return
+	}
+	c.recvMethods.Store(table)
+	c.sendMethods.Store(table)
+}
+
+// onMethodTable responds sorted routes as method table, at most MaxMethodTableSize methods.
+// The server decodes ids after responding, and encodes ids after receiving the first id from
+// the client, which makes sure the client holds the table
+func (h *handler) onMethodTable(c *Client, msg *Message) {
+	s := h.load()
+	methods := make([]string, 0, len(s.routes))
+	for method := range s.routes {
+		if method != "" && method != MethodTableRoute {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	if len(methods) > MaxMethodTableSize {
+		methods = methods[:MaxMethodTableSize]
+	}
+	table, _ := NewMethodTable(methods...)
+	c.sendMethods.Store((*MethodTable)(nil))
+	c.recvMethods.Store(table)
+	newContext(c, msg, nil).Write(strings.Join(methods, "\n"))
+}
+
+// SendingMethod returns method of msg sent by c, method ids negotiated are resolved, coders
+// should use it instead of Message.Method since ids are encoded before coders
+func (c *Client) SendingMethod(msg *Message) string {
+	if msg.Buffer[HeaderIndexMethodLen] == methodIDMask|1 && len(msg.Buffer) > HeadLen {
+		if table := c.sendMethodTable(); table != nil {
+			if method, ok := table.Method(msg.Buffer[HeadLen]); ok {
+				return method
+			}
+		}
+	}
+	return msg.Method()
+}
+
+// encodeMethodID replaces method of msg with its id in the negotiated table
+func encodeMethodID(c *Client, msg *Message) *Message {
+	table := c.sendMethodTable()
+	if table == nil {
+		return msg
+	}
+	ml := msg.MethodLen()
+	if ml == 0 || ml&int(methodIDMask) != 0 || HeadLen+ml > len(msg.Buffer) {
+		return msg
+	}
+	id, ok := table.ID(msg.method())
+	if !ok {
+		return msg
+	}
+	// build a new message, msg may be shared by other clients
+	rest := msg.Buffer[HeadLen+ml:]
+	m := &Message{Buffer: c.Handler.GetBuffer(HeadLen + 1 + len(rest)), Values: msg.Values}
+	copy(m.Buffer, msg.Buffer[:HeadLen])
+	m.Buffer[HeaderIndexMethodLen] = methodIDMask | 1
+	m.Buffer[HeadLen] = id
+	copy(m.Buffer[HeadLen+1:], rest)
+	m.SetBodyLen(len(m.Buffer) - HeadLen)
+	return m
+}
+
+// decodeMethodID restores method name of msg sent as id
+func decodeMethodID(c *Client, msg *Message) *Message {
+	if msg.Buffer[HeaderIndexMethodLen] != methodIDMask|1 || len(msg.Buffer) <= HeadLen {
+		return msg
+	}
+	table := c.recvMethodTable()
+	if table == nil {
+		return msg
+	}
+	method, ok := table.Method(msg.Buffer[HeadLen])
+	if !ok {
+		return msg
+	}
+	if c.sendMethodTable() == nil {
+		c.sendMethods.Store(table)
+	}
+	rest := msg.Buffer[HeadLen+1:]
+	m := &Message{Buffer: c.Handler.GetBuffer(HeadLen + len(method) + len(rest)), Values: msg.Values}
+	copy(m.Buffer, msg.Buffer[:HeadLen])
+	m.SetMethodLen(len(method))
+	copy(m.Buffer[HeadLen:], method)
+	copy(m.Buffer[HeadLen+len(method):], rest)
+	m.SetBodyLen(len(m.Buffer) - HeadLen)
+	return m
+}
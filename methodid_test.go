@@ -0,0 +1,84 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMethodIDs_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetMethodIDs(true)
+	svr.Handler.Handle("/methodid/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	SetMethodIDs(true)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetMethodIDs(false)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	// negotiation runs asynchronously after connected
+	for i := 0; i < 100 && c.sendMethodTable() == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if c.sendMethodTable() == nil {
+		t.Fatalf("method table not negotiated")
+	}
+
+	for i := 0; i < 2; i++ {
+		before := c.Stats().BytesOut
+		rsp := ""
+		if err = c.Call("/methodid/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+		}
+		if sent := c.Stats().BytesOut - before; sent != uint64(HeadLen+1+len("hello")) {
+			t.Fatalf("Client.Call() sent %v bytes, want %v", sent, HeadLen+1+len("hello"))
+		}
+	}
+
+	svr.mux.Lock()
+	for sc := range svr.clients {
+		if sc.sendMethodTable() == nil {
+			t.Fatalf("server side method table not enabled after receiving ids")
+		}
+	}
+	svr.mux.Unlock()
+}
+
+func TestMethodID_Codec(t *testing.T) {
+	table, _ := NewMethodTable("/a", "/b")
+	c := &Client{Handler: NewHandler()}
+	c.sendMethods.Store(table)
+	c.recvMethods.Store(table)
+
+	msg := newMessage(CmdRequest, "/b", "data", false, false, 7, nil, nil, nil)
+	encoded := encodeMethodID(c, msg)
+	if encoded == msg || encoded.Buffer[HeaderIndexMethodLen] != methodIDMask|1 || encoded.Buffer[HeadLen] != 2 {
+		t.Fatalf("encodeMethodID() = %v", encoded.Buffer)
+	}
+	if method := c.SendingMethod(encoded); method != "/b" {
+		t.Fatalf("Client.SendingMethod() = %v, want /b", method)
+	}
+	decoded := decodeMethodID(c, encoded)
+	if decoded.Method() != "/b" || string(decoded.Data()) != "data" || decoded.Seq() != 7 {
+		t.Fatalf("decodeMethodID() = %v, %s, %v", decoded.Method(), decoded.Data(), decoded.Seq())
+	}
+	if m := newMessage(CmdRequest, "/c", "data", false, false, 7, nil, nil, nil); encodeMethodID(c, m) != m {
+		t.Fatalf("encodeMethodID() encoded method not in table")
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+// Sample defines a metric value with labels
+type Sample struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Exporter exports samples to a metrics backend
+type Exporter interface {
+	Export(samples []Sample) error
+}
+
+// PushGateway exports samples to Prometheus Pushgateway in text exposition format
+type PushGateway struct {
+	// URL e.g. "http://localhost:9091/metrics/job/arpc_client"
+	URL    string
+	Client *http.Client
+}
+
+// Export implements Exporter
+func (pg *PushGateway) Export(samples []Sample) error {
+	cli := pg.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	rsp, err := cli.Post(pg.URL, "text/plain; version=0.0.4; charset=utf-8", bytes.NewReader(Encode(samples)))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("push to %v failed: %v", pg.URL, rsp.Status)
+	}
+	return nil
+}
+
+// Encode encodes samples in text exposition format
+func Encode(samples []Sample) []byte {
+	var (
+		buf   bytes.Buffer
+		typed = map[string]bool{}
+	)
+	for _, s := range samples {
+		if !typed[s.Name] {
+			typed[s.Name] = true
+			if s.Help != "" {
+				fmt.Fprintf(&buf, "# HELP %s %s\n", s.Name, s.Help)
+			}
+			if s.Type != "" {
+				fmt.Fprintf(&buf, "# TYPE %s %s\n", s.Name, s.Type)
+			}
+		}
+		buf.WriteString(s.Name)
+		if len(s.Labels) > 0 {
+			keys := make([]string, 0, len(s.Labels))
+			for k := range s.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			pairs := make([]string, len(keys))
+			for i, k := range keys {
+				pairs[i] = fmt.Sprintf("%s=%q", k, s.Labels[k])
+			}
+			buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(&buf, " %v\n", s.Value)
+	}
+	return buf.Bytes()
+}
+
+// Pusher pushes stats of clients periodically, for clients that could not be scraped
+type Pusher struct {
+	exporter Exporter
+	interval time.Duration
+	labels   map[string]string
+	clock    arpc.Clock
+
+	mux     sync.Mutex
+	clients map[string]*arpc.Client
+	chStop  chan util.Empty
+}
+
+// Add adds a client, name is used as "client" label, labels of the client are added to its samples
+func (p *Pusher) Add(name string, c *arpc.Client) {
+	p.mux.Lock()
+	p.clients[name] = c
+	p.mux.Unlock()
+}
+
+// Delete deletes a client
+func (p *Pusher) Delete(name string) {
+	p.mux.Lock()
+	delete(p.clients, name)
+	p.mux.Unlock()
+}
+
+// Samples returns samples of all clients
+func (p *Pusher) Samples() []Sample {
+	p.mux.Lock()
+	names := make([]string, 0, len(p.clients))
+	for name := range p.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]arpc.Stats, len(names))
+	skews := make([]time.Duration, len(names))
+	clientLabels := make([]map[string]string, len(names))
+	for i, name := range names {
+		stats[i] = p.clients[name].Stats()
+		skews[i] = p.clients[name].ClockSkew()
+		clientLabels[i] = p.clients[name].Labels()
+	}
+	p.mux.Unlock()
+
+	samples := make([]Sample, 0, len(names)*7)
+	sample := func(name, help, typ string, i int, value float64) {
+		labels := map[string]string{"client": names[i]}
+		for k, v := range clientLabels[i] {
+			labels[k] = v
+		}
+		for k, v := range p.labels {
+			labels[k] = v
+		}
+		samples = append(samples, Sample{Name: name, Help: help, Type: typ, Labels: labels, Value: value})
+	}
+	add := func(name, help string, i int, value uint64) {
+		sample(name, help, "counter", i, float64(value))
+	}
+	for i, st := range stats {
+		add("arpc_client_messages_in_total", "Messages received.", i, st.MessagesIn)
+		add("arpc_client_messages_out_total", "Messages sent.", i, st.MessagesOut)
+		add("arpc_client_bytes_in_total", "Bytes received.", i, st.BytesIn)
+		add("arpc_client_bytes_out_total", "Bytes sent.", i, st.BytesOut)
+		add("arpc_client_calls_total", "Calls made.", i, st.Calls)
+		add("arpc_client_call_errors_total", "Calls failed.", i, st.CallErrors)
+		sample("arpc_client_clock_skew_seconds", "Clock skew of the peer measured by ping.", "gauge", i, skews[i].Seconds())
+	}
+	samples = append(samples, AllocSamples(p.labels)...)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+	return samples
+}
+
+// AllocSamples returns sampled allocations of recv, dispatch and send paths, nil if sampling
+// disabled, see arpc.SetAllocSampleRate
+func AllocSamples(labels map[string]string) []Sample {
+	if arpc.AllocSampleRate() == 0 {
+		return nil
+	}
+	report := arpc.ReadAllocReport()
+	samples := make([]Sample, 0, 9)
+	add := func(name, help, path string, value uint64) {
+		ls := map[string]string{"path": path}
+		for k, v := range labels {
+			ls[k] = v
+		}
+		samples = append(samples, Sample{Name: name, Help: help, Type: "counter", Labels: ls, Value: float64(value)})
+	}
+	for _, p := range []struct {
+		path  string
+		stats arpc.AllocStats
+	}{{"recv", report.Recv}, {"dispatch", report.Dispatch}, {"send", report.Send}} {
+		add("arpc_alloc_samples_total", "Sampled calls.", p.path, p.stats.Samples)
+		add("arpc_alloc_mallocs_total", "Heap objects allocated in sampled calls.", p.path, p.stats.Mallocs)
+		add("arpc_alloc_bytes_total", "Heap bytes allocated in sampled calls.", p.path, p.stats.Bytes)
+	}
+	return samples
+}
+
+// RouteSamples returns counters of routes of h by "method" label, see arpc.Handler.RouteStats
+func RouteSamples(h arpc.Handler, labels map[string]string) []Sample {
+	stats := h.RouteStats()
+	methods := make([]string, 0, len(stats))
+	for method := range stats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	samples := make([]Sample, 0, len(methods)*3)
+	add := func(name, help, method string, value uint64) {
+		ls := map[string]string{"method": method}
+		for k, v := range labels {
+			ls[k] = v
+		}
+		samples = append(samples, Sample{Name: name, Help: help, Type: "counter", Labels: ls, Value: float64(value)})
+	}
+	for _, method := range methods {
+		st := stats[method]
+		add("arpc_route_calls_total", "Calls handled.", method, st.Calls)
+		add("arpc_route_errors_total", "Calls failed.", method, st.Errors)
+		add("arpc_route_deprecated_calls_total", "Calls of deprecated routes.", method, st.Deprecated)
+	}
+	return samples
+}
+
+// SetClock sets clock of pushing intervals, should be called before Start
+func (p *Pusher) SetClock(clock arpc.Clock) {
+	if clock == nil {
+		clock = arpc.SystemClock
+	}
+	p.clock = clock
+}
+
+// Push pushes once
+func (p *Pusher) Push() error {
+	return p.exporter.Export(p.Samples())
+}
+
+// Start starts pushing every interval
+func (p *Pusher) Start() {
+	go util.Safe(func() {
+		ticker := p.clock.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				if err := p.Push(); err != nil {
+					log.Error("[Metrics] push failed: %v", err)
+				}
+			case <-p.chStop:
+				return
+			}
+		}
+	})
+}
+
+// Stop stops pushing
+func (p *Pusher) Stop() {
+	close(p.chStop)
+}
+
+// NewPusher factory, labels are added to all samples
+func NewPusher(exporter Exporter, interval time.Duration, labels map[string]string) *Pusher {
+	if interval <= 0 {
+		interval = time.Second * 15
+	}
+	return &Pusher{
+		exporter: exporter,
+		interval: interval,
+		labels:   labels,
+		clock:    arpc.SystemClock,
+		clients:  map[string]*arpc.Client{},
+		chStop:   make(chan util.Empty),
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestEncode(t *testing.T) {
+	got := string(Encode([]Sample{
+		{Name: "a_total", Help: "A.", Type: "counter", Labels: map[string]string{"z": "1", "b": "2"}, Value: 3},
+		{Name: "a_total", Labels: map[string]string{"z": "2"}, Value: 4},
+	}))
+	want := "# HELP a_total A.\n# TYPE a_total counter\na_total{b=\"2\",z=\"1\"} 3\na_total{z=\"2\"} 4\n"
+	if got != want {
+		t.Fatalf("Encode() = %q, want %q", got, want)
+	}
+}
+
+func TestPusher_Push(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer ts.Close()
+
+	p := NewPusher(&PushGateway{URL: ts.URL}, 0, map[string]string{"app": "test"})
+	p.Add("c1", &arpc.Client{})
+	if err := p.Push(); err != nil {
+		t.Fatalf("Pusher.Push() error = %v", err)
+	}
+	if !strings.Contains(body, `arpc_client_calls_total{app="test",client="c1"} 0`) {
+		t.Fatalf("Pusher.Push() body = %v", body)
+	}
+}
+
+func TestAllocSamples(t *testing.T) {
+	if samples := AllocSamples(nil); samples != nil {
+		t.Fatalf("AllocSamples() = %v, want nil when sampling disabled", samples)
+	}
+	arpc.SetAllocSampleRate(1)
+	defer arpc.SetAllocSampleRate(0)
+	body := string(Encode(AllocSamples(map[string]string{"app": "test"})))
+	for _, path := range []string{"recv", "dispatch", "send"} {
+		if !strings.Contains(body, `arpc_alloc_bytes_total{app="test",path="`+path+`"}`) {
+			t.Fatalf("AllocSamples() missing path %v: %v", path, body)
+		}
+	}
+}
+
+func TestRouteSamples(t *testing.T) {
+	h := arpc.NewHandler()
+	h.Handle("/old", func(ctx *arpc.Context) {}, arpc.WithDeprecated("/new"))
+	body := string(Encode(RouteSamples(h, map[string]string{"app": "test"})))
+	if !strings.Contains(body, `arpc_route_deprecated_calls_total{app="test",method="/old"} 0`) {
+		t.Fatalf("RouteSamples() body = %v", body)
+	}
+}
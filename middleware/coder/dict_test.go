@@ -0,0 +1,115 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package coder
+
+import (
+	"compress/flate"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func dictSamples(n int) [][]byte {
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"user_id":%d,"event":"page_view","path":"/products/%d","referrer":"search"}`, i, i*7))
+	}
+	return samples
+}
+
+func TestDictCompressor(t *testing.T) {
+	samples := dictSamples(64)
+	dc, err := NewDictCompressor("dict-v1", 2, BuildDict(samples, 4096), flate.BestCompression)
+	if err != nil {
+		t.Fatalf("NewDictCompressor() error = %v", err)
+	}
+	plain := NewFlateCompressor(flate.BestCompression)
+
+	data := []byte(`{"user_id":1000,"event":"page_view","path":"/products/7000","referrer":"search"}`)
+	buf := dc.Compress(data)
+	got, err := dc.Decompress(buf)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("DictCompressor.Decompress() = (%s, %v), want %s", got, err, data)
+	}
+	if n := len(plain.Compress(data)); len(buf) >= n {
+		t.Fatalf("compressed with dictionary = %v bytes, want less than %v without", len(buf), n)
+	}
+}
+
+func TestDictCompressorMismatched(t *testing.T) {
+	dict := BuildDict(dictSamples(64), 4096)
+	v1, _ := NewDictCompressor("dict-v1", 2, dict, flate.DefaultCompression)
+	same, _ := NewDictCompressor("dict-v1", 2, append([]byte(nil), dict...), flate.DefaultCompression)
+	other, _ := NewDictCompressor("dict-v1", 2, []byte(strings.Repeat("other", 100)), flate.DefaultCompression)
+	if v1.Name() != same.Name() || v1.ID() != same.ID() {
+		t.Fatalf("names of the same dictionary = (%v, %v), want equal", v1.Name(), same.Name())
+	}
+	if v1.Name() == other.Name() {
+		t.Fatalf("names of different dictionaries = %v, want different", v1.Name())
+	}
+
+	// peers holding dictionaries of the same name but different content fall back to gzip
+	c := newNegotiateClient(arpc.SystemClock)
+	c.SetConnValue(acceptedKey, NewNegotiator(other, NewGzipCompressor(-1)).accept)
+	n := NewNegotiator(v1, NewGzipCompressor(-1))
+	m := n.Encode(c, c.NewMessage(arpc.CmdResponse, "/dict", strings.Repeat("mismatched", 200)))
+	if m.IsFlagBitSet(v1.FlagBit()) || !m.IsFlagBitSet(GZipFlagBit) {
+		t.Fatalf("Negotiator.Encode() used the mismatched dictionary")
+	}
+}
+
+func TestNegotiatorHandshake(t *testing.T) {
+	dict := BuildDict(dictSamples(64), 4096)
+	newNegotiator := func() *Negotiator {
+		dc, err := NewDictCompressor("dict-v1", 2, dict, flate.BestCompression)
+		if err != nil {
+			t.Fatalf("NewDictCompressor() error = %v", err)
+		}
+		n := NewNegotiator(dc)
+		n.SetCritical(0)
+		return n
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler = arpc.NewHandler()
+	sn := newNegotiator()
+	svr.Handler.UseCoder(sn)
+	sn.Register(svr.Handler)
+	svr.Handler.Handle("/dict", func(ctx *arpc.Context) { ctx.Write(ctx.Body()) })
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	h := arpc.NewHandler()
+	cn := newNegotiator()
+	h.UseCoder(cn)
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, arpc.WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Stop()
+
+	if err := cn.Handshake(c, time.Second); err != nil {
+		t.Fatalf("Negotiator.Handshake() error = %v", err)
+	}
+	// requests are compressed with the dictionary from the first after handshaked
+	req := `{"user_id":1000,"event":"page_view","path":"/products/7000","referrer":"search"}`
+	if m := cn.Encode(c, c.NewMessage(arpc.CmdRequest, "/dict", req)); !m.IsFlagBitSet(2) {
+		t.Fatalf("Negotiator.Encode() not compressed with the dictionary after handshaked")
+	}
+	rsp := ""
+	if err := c.Call("/dict", req, &rsp, time.Second); err != nil || rsp != req {
+		t.Fatalf("Client.Call() = (%v, %v), want %v", rsp, err, req)
+	}
+}
@@ -0,0 +1,35 @@
+package coder
+
+import (
+	"sync"
+
+	"github.com/lesismal/arpc"
+)
+
+// exemptions are methods whose payloads are sent uncompressed, e.g. images or zips compressed already
+type exemptions struct {
+	mux     sync.RWMutex
+	methods map[string]struct{}
+}
+
+func (e *exemptions) add(methods ...string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.methods == nil {
+		e.methods = map[string]struct{}{}
+	}
+	for _, method := range methods {
+		e.methods[method] = struct{}{}
+	}
+}
+
+// exempt returns whether msg is of a method exempted, requests and responses of the method both
+func (e *exemptions) exempt(client *arpc.Client, msg *arpc.Message) bool {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	if len(e.methods) == 0 {
+		return false
+	}
+	_, ok := e.methods[client.SendingMethod(msg)]
+	return ok
+}
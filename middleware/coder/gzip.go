@@ -35,10 +35,16 @@ func gzipUnCompress(data []byte) ([]byte, error) {
 type Gzip struct {
 	critical int
 	flagMask byte
+	exempts  exemptions
+}
+
+// Exempt marks methods whose payloads are compressed already, messages of them are not compressed
+func (c *Gzip) Exempt(methods ...string) {
+	c.exempts.add(methods...)
 }
 
 func (c *Gzip) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
-	if len(msg.Buffer) > c.critical && !msg.IsFlagBitSet(GZipFlagBit) {
+	if len(msg.Buffer) > c.critical && !msg.IsFlagBitSet(GZipFlagBit) && !c.exempts.exempt(client, msg) {
 		buf := gzipCompress(msg.Buffer[arpc.HeaderIndexReserved+1:])
 		total := len(buf) + arpc.HeaderIndexReserved + 1
 		if total < len(msg.Buffer) {
@@ -0,0 +1,281 @@
+package coder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// AcceptEncodingMetaKey carries names of compressors accepted by the sender
+const AcceptEncodingMetaKey = "arpc-accept-encoding"
+
+// NegotiateRoute is the route exchanging names of compressors accepted, see Negotiator.Handshake
+const NegotiateRoute = "coder.negotiate"
+
+// FlateFlagBit .
+const FlateFlagBit = 1
+
+// negotiateKey is key of values of Negotiator kept in context of the connection, a client
+// reconnected advertises its encodings again and learns those of the new peer
+type negotiateKey int
+
+const (
+	advertisedKey negotiateKey = iota
+	acceptedKey
+)
+
+// Compressor defines compression algorithm used by Negotiator
+type Compressor interface {
+	// Name returns name advertised to the peer
+	Name() string
+	// FlagBit returns header flag bit marking messages compressed by this compressor
+	FlagBit() int
+	// Compress compresses data
+	Compress(data []byte) []byte
+	// Decompress decompresses data
+	Decompress(data []byte) ([]byte, error)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) FlagBit() int {
+	return GZipFlagBit
+}
+
+func (c *gzipCompressor) Compress(data []byte) []byte {
+	var out bytes.Buffer
+	w, err := gzip.NewWriterLevel(&out, c.level)
+	if err != nil {
+		w = gzip.NewWriter(&out)
+	}
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+func (c *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	return gzipUnCompress(data)
+}
+
+// NewGzipCompressor returns gzip Compressor
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+type flateCompressor struct {
+	level int
+}
+
+func (c *flateCompressor) Name() string {
+	return "flate"
+}
+
+func (c *flateCompressor) FlagBit() int {
+	return FlateFlagBit
+}
+
+func (c *flateCompressor) Compress(data []byte) []byte {
+	var out bytes.Buffer
+	w, err := flate.NewWriter(&out, c.level)
+	if err != nil {
+		w, _ = flate.NewWriter(&out, flate.DefaultCompression)
+	}
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+func (c *flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// NewFlateCompressor returns flate Compressor
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+// Negotiator advertises accepted compressors on requests and compresses
+// messages with the first compressor in preference order the peer accepts
+type Negotiator struct {
+	critical    int
+	budget      int64
+	accept      string
+	compressors []Compressor
+	exempts     exemptions
+
+	mux    sync.Mutex
+	second int64
+	used   int64
+}
+
+// SetCritical sets min message length to be compressed
+func (n *Negotiator) SetCritical(size int) {
+	n.critical = size
+}
+
+// SetBudget sets max bytes compressed per second, messages beyond budget are sent uncompressed, 0 means unlimited
+func (n *Negotiator) SetBudget(bytesPerSecond int64) {
+	n.budget = bytesPerSecond
+}
+
+// Exempt marks methods whose payloads are compressed already, e.g. images or zips, messages of
+// them are sent uncompressed without spending budget
+func (n *Negotiator) Exempt(methods ...string) {
+	n.exempts.add(methods...)
+}
+
+// Encode implements arpc.MessageCoder, msg is not modified since it may be shared by other
+// clients, e.g. broadcast, a new message is returned instead
+func (n *Negotiator) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	cmd := msg.Cmd()
+	if (cmd == arpc.CmdRequest || cmd == arpc.CmdNotify) && client.ConnValue(advertisedKey) == nil {
+		md := arpc.Metadata{}
+		for k, v := range msg.Meta() {
+			md[k] = v
+		}
+		md[AcceptEncodingMetaKey] = n.accept
+		m := &arpc.Message{Buffer: msg.Buffer, Values: msg.Values}
+		if err := m.SetMeta(md); err != nil {
+			log.Error("[Negotiator] advertise accepted encodings failed: %v", err)
+		} else {
+			client.SetConnValue(advertisedKey, true)
+			msg = m
+		}
+	}
+
+	if len(msg.Buffer) <= n.critical || n.compressedBy(msg) != nil || n.exempts.exempt(client, msg) {
+		return msg
+	}
+	accepted, ok := client.ConnValue(acceptedKey).(string)
+	if !ok {
+		return msg
+	}
+	for _, c := range n.compressors {
+		if !acceptable(accepted, c.Name()) {
+			continue
+		}
+		if !n.consume(client, len(msg.Buffer)) {
+			break
+		}
+		buf := c.Compress(msg.Buffer[arpc.HeaderIndexReserved+1:])
+		total := len(buf) + arpc.HeaderIndexReserved + 1
+		if total < len(msg.Buffer) && total >= arpc.HeadLen {
+			m := &arpc.Message{Buffer: make([]byte, 0, total), Values: msg.Values}
+			m.Buffer = append(append(m.Buffer, msg.Buffer[:arpc.HeaderIndexReserved+1]...), buf...)
+			m.SetBodyLen(total - arpc.HeadLen)
+			m.SetFlagBit(c.FlagBit(), true)
+			msg = m
+		}
+		break
+	}
+	return msg
+}
+
+// Register registers NegotiateRoute to h of the server, clients handshaked are answered with
+// compressors accepted by the server
+func (n *Negotiator) Register(h arpc.Handler) {
+	h.Handle(NegotiateRoute, func(ctx *arpc.Context) {
+		ctx.Client.SetConnValue(acceptedKey, string(ctx.Body()))
+		ctx.Client.SetConnValue(advertisedKey, true)
+		ctx.Write(n.accept)
+	})
+}
+
+// Handshake exchanges names of compressors accepted with the server on the connection of c,
+// messages of both sides are compressed from the first after it returned instead of after the
+// peer advertised. It should be called again on reconnected, e.g. in Handler.HandleConnected
+func (n *Negotiator) Handshake(c *arpc.Client, timeout time.Duration) error {
+	accepted := ""
+	if err := c.Call(NegotiateRoute, n.accept, &accepted, timeout); err != nil {
+		return err
+	}
+	c.SetConnValue(acceptedKey, accepted)
+	c.SetConnValue(advertisedKey, true)
+	return nil
+}
+
+// Decode implements arpc.MessageCoder
+func (n *Negotiator) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	if c := n.compressedBy(msg); c != nil {
+		buf, err := c.Decompress(msg.Buffer[arpc.HeaderIndexReserved+1:])
+		if err == nil {
+			msg.Buffer = append(msg.Buffer[:arpc.HeaderIndexReserved+1], buf...)
+			msg.SetBodyLen(len(msg.Buffer) - arpc.HeadLen)
+			msg.SetFlagBit(c.FlagBit(), false)
+		}
+	}
+	if msg.HasMeta() {
+		if accepted, ok := msg.Meta().Get(AcceptEncodingMetaKey); ok {
+			client.SetConnValue(acceptedKey, accepted)
+		}
+	}
+	return msg
+}
+
+func (n *Negotiator) compressedBy(msg *arpc.Message) Compressor {
+	for _, c := range n.compressors {
+		if msg.IsFlagBitSet(c.FlagBit()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// consume spends size bytes of the budget of the current second of the handler clock, shared by
+// all clients of the Negotiator
+func (n *Negotiator) consume(client *arpc.Client, size int) bool {
+	if n.budget <= 0 {
+		return true
+	}
+	now := client.Handler.Clock().Now().Unix()
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.second != now {
+		n.second, n.used = now, 0
+	}
+	if n.used+int64(size) > n.budget {
+		return false
+	}
+	n.used += int64(size)
+	return true
+}
+
+func acceptable(accepted, name string) bool {
+	for _, v := range strings.Split(accepted, ",") {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewNegotiator returns Negotiator with compressors in preference order, gzip by default
+func NewNegotiator(compressors ...Compressor) *Negotiator {
+	if len(compressors) == 0 {
+		compressors = []Compressor{NewGzipCompressor(gzip.DefaultCompression)}
+	}
+	names := make([]string, len(compressors))
+	for i, c := range compressors {
+		names[i] = c.Name()
+	}
+	return &Negotiator{
+		critical:    1024,
+		accept:      strings.Join(names, ","),
+		compressors: compressors,
+	}
+}
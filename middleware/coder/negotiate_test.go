@@ -0,0 +1,109 @@
+package coder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/codec"
+)
+
+func newNegotiateClient(clock arpc.Clock) *arpc.Client {
+	h := arpc.NewHandler()
+	h.SetClock(clock)
+	return &arpc.Client{Handler: h, Codec: codec.DefaultCodec}
+}
+
+// wire returns a copy of msg as read from the wire
+func wire(msg *arpc.Message) *arpc.Message {
+	return &arpc.Message{Buffer: append([]byte(nil), msg.Buffer...)}
+}
+
+func TestNegotiator(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	client, server := newNegotiateClient(clock), newNegotiateClient(clock)
+	n := NewNegotiator(NewFlateCompressor(-1), NewGzipCompressor(-1))
+	peer := NewNegotiator(NewGzipCompressor(-1))
+	data := strings.Repeat("negotiate", 200)
+
+	// responses are sent uncompressed until the peer advertised its encodings
+	rsp := server.NewMessage(arpc.CmdResponse, "/echo", data)
+	if m := peer.Encode(server, rsp); m.IsFlagBitSet(GZipFlagBit) {
+		t.Fatalf("Negotiator.Encode() compressed before the peer advertised")
+	}
+
+	req := client.NewMessage(arpc.CmdRequest, "/echo", data)
+	orig := append([]byte(nil), req.Buffer...)
+	m := n.Encode(client, req)
+	if !bytes.Equal(req.Buffer, orig) {
+		t.Fatalf("Negotiator.Encode() modified the message")
+	}
+	if accept, _ := m.Meta().Get(AcceptEncodingMetaKey); accept != "flate,gzip" {
+		t.Fatalf("advertised encodings = %q, want %q", accept, "flate,gzip")
+	}
+	peer.Decode(server, wire(m))
+	// advertised once per connection
+	m = n.Encode(client, client.NewMessage(arpc.CmdRequest, "/echo", data))
+	if _, ok := m.Meta().Get(AcceptEncodingMetaKey); ok {
+		t.Fatalf("Negotiator.Encode() advertised encodings again")
+	}
+
+	// the peer compresses with the encoding both sides accept
+	orig = append([]byte(nil), rsp.Buffer...)
+	m = peer.Encode(server, rsp)
+	if !bytes.Equal(rsp.Buffer, orig) {
+		t.Fatalf("Negotiator.Encode() modified the message")
+	}
+	if !m.IsFlagBitSet(GZipFlagBit) || len(m.Buffer) >= len(rsp.Buffer) {
+		t.Fatalf("Negotiator.Encode() = %v bytes, want compressed by gzip", len(m.Buffer))
+	}
+	if got := string(n.Decode(client, wire(m)).Data()); got != data {
+		t.Fatalf("Negotiator.Decode() = %v bytes, want %v", len(got), len(data))
+	}
+}
+
+func TestNegotiatorBudget(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newNegotiateClient(clock)
+	c.SetConnValue(acceptedKey, "gzip")
+	n := NewNegotiator()
+	data := strings.Repeat("budget", 300)
+	size := len(c.NewMessage(arpc.CmdResponse, "/echo", data).Buffer)
+	n.SetBudget(int64(size * 3 / 2))
+
+	compressed := func() bool {
+		return n.Encode(c, c.NewMessage(arpc.CmdResponse, "/echo", data)).IsFlagBitSet(GZipFlagBit)
+	}
+	if !compressed() {
+		t.Fatalf("message within budget not compressed")
+	}
+	if compressed() {
+		t.Fatalf("message beyond budget compressed")
+	}
+	clock.Advance(time.Second)
+	if !compressed() {
+		t.Fatalf("message of the next second not compressed")
+	}
+}
+
+func TestNegotiatorExempt(t *testing.T) {
+	c := newNegotiateClient(arpc.SystemClock)
+	c.SetConnValue(acceptedKey, "gzip")
+	n := NewNegotiator()
+	n.Exempt("/image")
+	data := strings.Repeat("exempt", 300)
+	size := len(c.NewMessage(arpc.CmdResponse, "/echo", data).Buffer)
+	n.SetBudget(int64(size * 3 / 2))
+
+	// exempted messages are sent uncompressed without spending budget
+	for i := 0; i < 2; i++ {
+		if m := n.Encode(c, c.NewMessage(arpc.CmdResponse, "/image", data)); m.IsFlagBitSet(GZipFlagBit) {
+			t.Fatalf("message of exempted method compressed")
+		}
+	}
+	if m := n.Encode(c, c.NewMessage(arpc.CmdResponse, "/echo", data)); !m.IsFlagBitSet(GZipFlagBit) {
+		t.Fatalf("message not exempted not compressed")
+	}
+}
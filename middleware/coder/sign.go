@@ -0,0 +1,272 @@
+package coder
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// SignTimestampMetaKey carries unix milliseconds of signing
+	SignTimestampMetaKey = "arpc-sign-ts"
+	// SignNonceMetaKey carries random nonce of a signed message
+	SignNonceMetaKey = "arpc-sign-nonce"
+	// SignKeyVersionMetaKey carries version of the key signed with
+	SignKeyVersionMetaKey = "arpc-sign-kid"
+	// SignatureMetaKey carries hex HMAC-SHA256 of the header except body length, method, the other
+	// metadata pairs sorted by key and data
+	SignatureMetaKey = "arpc-sign"
+
+	signedKey = "coder.signed"
+)
+
+var (
+	// ErrSignatureKeyUnknown .
+	ErrSignatureKeyUnknown = errors.New("signature key version unknown")
+	// ErrSignatureInvalid .
+	ErrSignatureInvalid = errors.New("invalid or missing signature")
+	// ErrSignatureExpired .
+	ErrSignatureExpired = errors.New("signature timestamp out of allowed skew")
+	// ErrSignatureReplayed .
+	ErrSignatureReplayed = errors.New("signature nonce replayed")
+	// ErrReplayCacheFull .
+	ErrReplayCacheFull = errors.New("signature replay cache full")
+)
+
+// Signer signs outgoing requests and notifies with HMAC-SHA256 over the header, method, metadata
+// including timestamp and nonce, and data, and verifies incoming ones against skew and a replay
+// cache of nonces. It's for deployments that can't terminate TLS at the arpc server, it doesn't
+// encrypt anything.
+//
+// Both sides should register it as the last coder, so it signs the bytes on the wire. The server
+// should also use Handle as the first router middleware, which rejects messages failed to verify.
+// Handle is a router middleware, so messages not dispatched to router handlers are not checked by
+// it: internal _arpc.* routes, e.g. flow control windows, and fast path notify handlers registered
+// by Handler.HandleNotify, which should call Verified themselves. Messages sent as method ids don't
+// carry metadata, so it doesn't work with Handler.SetMethodIDs.
+//
+// Messages are signed with the current key of Keys and verified with the key of their version, so
+// keys could be rotated by arpc.Keyring without disconnecting clients.
+type Signer struct {
+	// Keys provides versioned keys
+	Keys arpc.KeyProvider
+
+	// MaxSkew is allowed difference between timestamp of signing and now, 30s by default,
+	// nonces are cached for twice of it
+	MaxSkew time.Duration
+	// MaxNonces limits size of the replay cache, messages are rejected if it's full, 100000 by default
+	MaxNonces int
+
+	mux    sync.Mutex
+	nonces map[string]int64
+	sweep  int64
+}
+
+func (s *Signer) maxSkew() time.Duration {
+	if s.MaxSkew > 0 {
+		return s.MaxSkew
+	}
+	return time.Second * 30
+}
+
+func (s *Signer) maxNonces() int {
+	if s.MaxNonces > 0 {
+		return s.MaxNonces
+	}
+	return 100000
+}
+
+func signed(cmd byte) bool {
+	return cmd == arpc.CmdRequest || cmd == arpc.CmdNotify
+}
+
+// sign returns signature of msg: the header except body length, i.e. reserved bits, cmd, flags,
+// method length and seq, then method, metadata pairs except the signature sorted by key, and data
+func (s *Signer) sign(key []byte, msg *arpc.Message) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg.Buffer[arpc.HeaderIndexReserved:arpc.HeadLen])
+	mac.Write(wireMethod(msg))
+
+	md := msg.Meta()
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		if k != SignatureMetaKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var n [4]byte
+	write := func(b string) {
+		binary.LittleEndian.PutUint32(n[:], uint32(len(b)))
+		mac.Write(n[:])
+		mac.Write([]byte(b))
+	}
+	binary.LittleEndian.PutUint32(n[:], uint32(len(keys)))
+	mac.Write(n[:])
+	for _, k := range keys {
+		write(k)
+		write(md[k])
+	}
+
+	mac.Write(msg.Data())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func wireMethod(msg *arpc.Message) []byte {
+	ml := msg.MethodLen()
+	if arpc.HeadLen+ml > len(msg.Buffer) {
+		return nil
+	}
+	return msg.Buffer[arpc.HeadLen : arpc.HeadLen+ml]
+}
+
+// Encode implements arpc.MessageCoder
+func (s *Signer) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	cmd := msg.Cmd()
+	if !signed(cmd) {
+		return msg
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Error("[Signer] generate nonce failed: %v", err)
+		return msg
+	}
+	ts := strconv.FormatInt(client.Handler.Clock().Now().UnixNano()/int64(time.Millisecond), 10)
+	n := hex.EncodeToString(nonce)
+	version, key := s.Keys.Current()
+
+	md := arpc.Metadata{}
+	for k, v := range msg.Meta() {
+		md[k] = v
+	}
+	md[SignKeyVersionMetaKey] = version
+	md[SignTimestampMetaKey] = ts
+	md[SignNonceMetaKey] = n
+
+	// build a new message, msg may be shared by other clients
+	m := &arpc.Message{Buffer: msg.Buffer, Values: msg.Values}
+	if err := m.SetMeta(md); err != nil {
+		log.Error("[Signer] set metadata failed: %v", err)
+		return msg
+	}
+	md[SignatureMetaKey] = s.sign(key, m)
+	if err := m.SetMeta(md); err != nil {
+		log.Error("[Signer] set metadata failed: %v", err)
+		return msg
+	}
+	return m
+}
+
+// Decode implements arpc.MessageCoder, messages verified are marked for Handle
+func (s *Signer) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	if !signed(msg.Cmd()) {
+		return msg
+	}
+	if err := s.verify(client, msg); err != nil {
+		msg.Set(signedKey, err)
+	} else {
+		msg.Set(signedKey, true)
+	}
+	return msg
+}
+
+func (s *Signer) verify(client *arpc.Client, msg *arpc.Message) error {
+	md := msg.Meta()
+	ts, ok1 := md.Get(SignTimestampMetaKey)
+	nonce, ok2 := md.Get(SignNonceMetaKey)
+	sig, ok3 := md.Get(SignatureMetaKey)
+	version, ok4 := md.Get(SignKeyVersionMetaKey)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return ErrSignatureInvalid
+	}
+	key, ok := s.Keys.Key(version)
+	if !ok {
+		return ErrSignatureKeyUnknown
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(key, msg))) {
+		return ErrSignatureInvalid
+	}
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	now := client.Handler.Clock().Now().UnixNano() / int64(time.Millisecond)
+	skew := int64(s.maxSkew() / time.Millisecond)
+	if ms < now-skew || ms > now+skew {
+		return ErrSignatureExpired
+	}
+	return s.checkNonce(nonce, now, skew*2)
+}
+
+// checkNonce records nonce for ttl milliseconds, returns ErrSignatureReplayed if it's seen
+func (s *Signer) checkNonce(nonce string, now, ttl int64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.nonces == nil {
+		s.nonces = map[string]int64{}
+	}
+	if now-s.sweep >= ttl/2 || len(s.nonces) >= s.maxNonces() {
+		for k, expire := range s.nonces {
+			if expire <= now {
+				delete(s.nonces, k)
+			}
+		}
+		s.sweep = now
+	}
+	if expire, ok := s.nonces[nonce]; ok && expire > now {
+		return ErrSignatureReplayed
+	}
+	if len(s.nonces) >= s.maxNonces() {
+		return ErrReplayCacheFull
+	}
+	s.nonces[nonce] = now + ttl
+	return nil
+}
+
+// Verified returns nil if msg is verified by Decode of Signer, or the error failed to verify
+func Verified(msg *arpc.Message) error {
+	v, _ := msg.Get(signedKey)
+	if v == true {
+		return nil
+	}
+	if err, ok := v.(error); ok {
+		return err
+	}
+	return ErrSignatureInvalid
+}
+
+// Handle is the router middleware rejecting messages not verified by Decode
+func (s *Signer) Handle(ctx *arpc.Context) {
+	err := Verified(ctx.Message)
+	if err == nil {
+		ctx.Next()
+		return
+	}
+	method := ctx.Message.Method()
+	addr := ctx.Client.Conn.RemoteAddr()
+	log.Warn("[Signer] '%v' from %v rejected: %v", method, addr, err)
+	if ctx.Message.Cmd() == arpc.CmdRequest {
+		ctx.Error(err)
+	}
+	ctx.Done()
+}
+
+// NewSigner returns Signer with key shared by clients and the server
+func NewSigner(key []byte) *Signer {
+	return &Signer{Keys: arpc.NewKeyring("", key)}
+}
+
+// NewSignerWithKeys returns Signer with versioned keys
+func NewSignerWithKeys(keys arpc.KeyProvider) *Signer {
+	return &Signer{Keys: keys}
+}
@@ -0,0 +1,136 @@
+package coder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/codec"
+)
+
+func newSignClient(clock arpc.Clock) *arpc.Client {
+	h := arpc.NewHandler()
+	h.SetClock(clock)
+	return &arpc.Client{Handler: h, Codec: codec.DefaultCodec}
+}
+
+// signedMessage returns a copy of the signed request as read from the wire
+func signedMessage(s *Signer, c *arpc.Client, md arpc.Metadata) *arpc.Message {
+	msg := c.NewMessage(arpc.CmdRequest, "/sign/echo", "hello")
+	if len(md) > 0 {
+		msg.SetMeta(md)
+	}
+	m := s.Encode(c, msg)
+	return &arpc.Message{Buffer: append([]byte(nil), m.Buffer...)}
+}
+
+func TestSigner(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	cases := []struct {
+		name   string
+		tamper func(clock *arpc.MockClock, msg *arpc.Message)
+		want   error
+	}{
+		{"valid", func(clock *arpc.MockClock, msg *arpc.Message) {}, nil},
+		{"body", func(clock *arpc.MockClock, msg *arpc.Message) {
+			msg.Buffer[len(msg.Buffer)-1] ^= 0xFF
+		}, ErrSignatureInvalid},
+		{"meta", func(clock *arpc.MockClock, msg *arpc.Message) {
+			md := msg.Meta()
+			md[arpc.MetaKeyNamespace] = "other"
+			msg.SetMeta(md)
+		}, ErrSignatureInvalid},
+		{"seq", func(clock *arpc.MockClock, msg *arpc.Message) {
+			msg.SetSeq(msg.Seq() + 1)
+		}, ErrSignatureInvalid},
+		{"flag", func(clock *arpc.MockClock, msg *arpc.Message) {
+			msg.SetAsync(true)
+		}, ErrSignatureInvalid},
+		{"skew", func(clock *arpc.MockClock, msg *arpc.Message) {
+			clock.Advance(time.Minute)
+		}, ErrSignatureExpired},
+	}
+	for _, tc := range cases {
+		clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+		c := newSignClient(clock)
+		s := NewSigner(key)
+		msg := signedMessage(s, c, arpc.Metadata{arpc.MetaKeyNamespace: "tenant"})
+		tc.tamper(clock, msg)
+		if err := Verified(s.Decode(c, msg)); err != tc.want {
+			t.Fatalf("%v: Verified() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestSignerMetaTooLarge(t *testing.T) {
+	c := newSignClient(arpc.NewMockClock(time.Unix(1600000000, 0)))
+	s := NewSigner([]byte("0123456789abcdef"))
+	msg := c.NewMessage(arpc.CmdRequest, "/sign/echo", "hello")
+	large := strings.Repeat("v", arpc.MaxMetaLen-3-len("large")-16)
+	if err := msg.SetMeta(arpc.Metadata{"large": large}); err != nil {
+		t.Fatalf("Message.SetMeta() error = %v", err)
+	}
+	// no room for the signature, the message is sent unsigned for the peer to reject
+	if m := s.Encode(c, msg); m != msg {
+		t.Fatalf("Signer.Encode() = %p, want the message %p unsigned", m, msg)
+	}
+	if _, ok := msg.Meta().Get(SignatureMetaKey); ok {
+		t.Fatalf("Signer.Encode() signed the message")
+	}
+}
+
+func TestSignerReplay(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newSignClient(clock)
+	s := NewSigner([]byte("0123456789abcdef"))
+	s.MaxNonces = 2
+
+	msg := signedMessage(s, c, nil)
+	replayed := &arpc.Message{Buffer: append([]byte(nil), msg.Buffer...)}
+	if err := Verified(s.Decode(c, msg)); err != nil {
+		t.Fatalf("Verified() = %v, want nil", err)
+	}
+	if err := Verified(s.Decode(c, replayed)); err != ErrSignatureReplayed {
+		t.Fatalf("Verified() replayed = %v, want %v", err, ErrSignatureReplayed)
+	}
+
+	if err := Verified(s.Decode(c, signedMessage(s, c, nil))); err != nil {
+		t.Fatalf("Verified() = %v, want nil", err)
+	}
+	if err := Verified(s.Decode(c, signedMessage(s, c, nil))); err != ErrReplayCacheFull {
+		t.Fatalf("Verified() of full cache = %v, want %v", err, ErrReplayCacheFull)
+	}
+
+	// nonces expire after twice of MaxSkew
+	clock.Advance(s.maxSkew()*2 + time.Millisecond)
+	if err := Verified(s.Decode(c, signedMessage(s, c, nil))); err != nil {
+		t.Fatalf("Verified() after nonces expired = %v, want nil", err)
+	}
+}
+
+func TestSignerKeyRotation(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newSignClient(clock)
+	clientKeys := arpc.NewKeyring("v1", []byte("key-1"))
+	serverKeys := arpc.NewKeyring("v1", []byte("key-1"))
+	client, server := NewSignerWithKeys(clientKeys), NewSignerWithKeys(serverKeys)
+
+	// the server accepts both versions during rotation
+	serverKeys.Add("v2", []byte("key-2"))
+	serverKeys.SetCurrent("v2")
+	if err := Verified(server.Decode(c, signedMessage(client, c, nil))); err != nil {
+		t.Fatalf("Verified() of old version = %v, want nil", err)
+	}
+	clientKeys.Add("v2", []byte("key-2"))
+	clientKeys.SetCurrent("v2")
+	if err := Verified(server.Decode(c, signedMessage(client, c, nil))); err != nil {
+		t.Fatalf("Verified() of new version = %v, want nil", err)
+	}
+
+	clientKeys.SetCurrent("v1")
+	serverKeys.Remove("v1")
+	if err := Verified(server.Decode(c, signedMessage(client, c, nil))); err != ErrSignatureKeyUnknown {
+		t.Fatalf("Verified() of retired version = %v, want %v", err, ErrSignatureKeyUnknown)
+	}
+}
@@ -0,0 +1,249 @@
+package coder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// TraceFormat is the format of trace files
+type TraceFormat int
+
+const (
+	// TraceJSONL writes a JSON object of each frame per line:
+	//
+	//	{"time":"2020-01-02T15:04:05.000000001Z","dir":"send","addr":"127.0.0.1:8888","cmd":1,
+	//	 "seq":1,"async":false,"error":false,"method":"/echo","len":32,"frame":"base64..."}
+	//
+	// "dir" is "send" or "recv", "frame" is the whole frame in base64, omitted if bodies are not traced
+	TraceJSONL TraceFormat = iota
+	// TraceBinary writes records of each frame:
+	//
+	//	[unix nanoseconds: 8][dir: 1, 0 send, 1 recv][addr length: 1][addr][frame length: 4][frame]
+	//
+	// integers are little endian, frame is the header only if bodies are not traced
+	TraceBinary
+)
+
+// TraceRecord is a record of TraceJSONL
+type TraceRecord struct {
+	Time   time.Time `json:"time"`
+	Dir    string    `json:"dir"`
+	Addr   string    `json:"addr"`
+	Cmd    byte      `json:"cmd"`
+	Seq    uint64    `json:"seq"`
+	Async  bool      `json:"async"`
+	Error  bool      `json:"error"`
+	Method string    `json:"method"`
+	Len    int       `json:"len"`
+	Frame  []byte    `json:"frame,omitempty"`
+}
+
+// FrameTracer tees frames sent and received into rotating trace files, for post-incident
+// analysis. Register it as the last coder to trace frames on the wire, or the first to trace them
+// before other coders encode them, e.g. compressed. Unlike arpc.Tracer it records frames rather
+// than spans of calls.
+type FrameTracer struct {
+	// Format of trace files, TraceJSONL by default
+	Format TraceFormat
+	// Bodies traces whole frames, only headers are traced by default
+	Bodies bool
+	// File is the rotating file written to
+	File *RotatingFile
+}
+
+// Encode implements arpc.MessageCoder
+func (t *FrameTracer) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	t.trace(client, msg, false)
+	return msg
+}
+
+// Decode implements arpc.MessageCoder
+func (t *FrameTracer) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	t.trace(client, msg, true)
+	return msg
+}
+
+func (t *FrameTracer) trace(client *arpc.Client, msg *arpc.Message, recv bool) {
+	if len(msg.Buffer) < arpc.HeadLen {
+		return
+	}
+	now := client.Handler.Clock().Now()
+	addr := ""
+	if client.Conn != nil {
+		addr = client.Conn.RemoteAddr().String()
+	}
+	frame := msg.Buffer[:arpc.HeadLen]
+	if t.Bodies {
+		frame = msg.Buffer
+	}
+
+	var rec []byte
+	switch t.Format {
+	case TraceBinary:
+		if len(addr) > 255 {
+			addr = addr[:255]
+		}
+		rec = make([]byte, 14+len(addr)+len(frame))
+		binary.LittleEndian.PutUint64(rec, uint64(now.UnixNano()))
+		if recv {
+			rec[8] = 1
+		}
+		rec[9] = byte(len(addr))
+		copy(rec[10:], addr)
+		binary.LittleEndian.PutUint32(rec[10+len(addr):], uint32(len(frame)))
+		copy(rec[14+len(addr):], frame)
+	default:
+		r := &TraceRecord{
+			Time:   now,
+			Dir:    "send",
+			Addr:   addr,
+			Cmd:    msg.Cmd(),
+			Seq:    msg.Seq(),
+			Async:  msg.IsAsync(),
+			Error:  msg.IsError(),
+			Method: string(wireMethod(msg)),
+			Len:    len(msg.Buffer),
+		}
+		if recv {
+			r.Dir = "recv"
+		}
+		if t.Bodies {
+			r.Frame = frame
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			log.Error("[FrameTracer] encode record failed: %v", err)
+			return
+		}
+		rec = append(data, '\n')
+	}
+	if _, err := t.File.write(rec, now); err != nil {
+		log.Error("[FrameTracer] write record failed: %v", err)
+	}
+}
+
+// NewFrameTracer returns FrameTracer writing to file in format
+func NewFrameTracer(file *RotatingFile, format TraceFormat) *FrameTracer {
+	return &FrameTracer{Format: format, File: file}
+}
+
+// RotatingFile is a file rotated by size and age, rotated files are renamed with the time of
+// rotating and a sequence appended, e.g. "trace.jsonl.20200102-150405.000.000001". Age of files
+// written by FrameTracer is measured by the handler clock
+type RotatingFile struct {
+	// Path of the current file
+	Path string
+	// MaxSize rotates the file if it exceeds, 0 means no limit
+	MaxSize int64
+	// MaxAge rotates the file after opened for it, 0 means no limit
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, 0 means all are kept
+	MaxBackups int
+	// Clock measures age of files written by Write, arpc.SystemClock if nil
+	Clock arpc.Clock
+
+	mux    sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	seq    int
+}
+
+// NewRotatingFile returns RotatingFile of path
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) *RotatingFile {
+	return &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups}
+}
+
+// Write implements io.Writer, records are not split into different files
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	clock := f.Clock
+	if clock == nil {
+		clock = arpc.SystemClock
+	}
+	return f.write(p, clock.Now())
+}
+
+func (f *RotatingFile) write(p []byte, now time.Time) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.file != nil && ((f.MaxSize > 0 && f.size+int64(len(p)) > f.MaxSize && f.size > 0) ||
+		(f.MaxAge > 0 && now.Sub(f.opened) >= f.MaxAge)) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), now
+	return nil
+}
+
+func (f *RotatingFile) rotate(now time.Time) error {
+	f.file.Close()
+	f.file = nil
+	// the sequence keeps names unique if rotated more than once in a millisecond
+	var name string
+	for {
+		f.seq++
+		name = fmt.Sprintf("%v.%v.%06d", f.Path, now.Format("20060102-150405.000"), f.seq)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+	}
+	if err := os.Rename(f.Path, name); err != nil {
+		return err
+	}
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// names of backups sort by time and sequence of rotating
+	sort.Strings(backups)
+	for len(backups) > f.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the current file
+func (f *RotatingFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,117 @@
+package coder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestFrameTracer(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newNegotiateClient(clock)
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	file := NewRotatingFile(path, 0, 0, 0)
+	tracer := NewFrameTracer(file, TraceJSONL)
+
+	req := c.NewMessage(arpc.CmdRequest, "/trace", "hello")
+	if m := tracer.Encode(c, req); m != req {
+		t.Fatalf("FrameTracer.Encode() modified the message")
+	}
+	tracer.Bodies = true
+	tracer.Decode(c, c.NewMessage(arpc.CmdResponse, "/trace", "world"))
+	file.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	var records []TraceRecord
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var r TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records = %v, want 2", len(records))
+	}
+	if r := records[0]; r.Dir != "send" || r.Method != "/trace" || r.Cmd != arpc.CmdRequest ||
+		!r.Time.Equal(clock.Now()) || r.Len != len(req.Buffer) || r.Frame != nil {
+		t.Fatalf("send record = %+v", r)
+	}
+	if r := records[1]; r.Dir != "recv" || r.Cmd != arpc.CmdResponse || len(r.Frame) != r.Len {
+		t.Fatalf("recv record = %+v, want the whole frame", r)
+	}
+}
+
+func TestFrameTracerBinary(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newNegotiateClient(clock)
+	path := filepath.Join(t.TempDir(), "trace.bin")
+	file := NewRotatingFile(path, 0, 0, 0)
+	msg := c.NewMessage(arpc.CmdNotify, "/trace", "hello")
+	NewFrameTracer(file, TraceBinary).Decode(c, msg)
+	file.Close()
+
+	rec, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if len(rec) != 14+arpc.HeadLen {
+		t.Fatalf("record = %v bytes, want %v", len(rec), 14+arpc.HeadLen)
+	}
+	if ns := binary.LittleEndian.Uint64(rec); int64(ns) != clock.Now().UnixNano() || rec[8] != 1 || rec[9] != 0 {
+		t.Fatalf("record header = %v", rec[:10])
+	}
+	if n := binary.LittleEndian.Uint32(rec[10:]); int(n) != arpc.HeadLen || string(rec[14:]) != string(msg.Buffer[:arpc.HeadLen]) {
+		t.Fatalf("record frame = %v, want the header", rec[14:])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	c := newNegotiateClient(clock)
+	path := filepath.Join(t.TempDir(), "trace.bin")
+	file := NewRotatingFile(path, int64(arpc.HeadLen+20), 0, 2)
+	defer file.Close()
+	tracer := NewFrameTracer(file, TraceBinary)
+
+	// rotated in the same millisecond, names are unique by the sequence
+	for i := 0; i < 4; i++ {
+		tracer.Encode(c, c.NewMessage(arpc.CmdNotify, "/trace", "hello"))
+	}
+	backups := globBackups(t, path)
+	if len(backups) != 2 || !strings.HasSuffix(backups[0], ".000002") || !strings.HasSuffix(backups[1], ".000003") {
+		t.Fatalf("backups = %v, want the latest 2 of 3 rotated", backups)
+	}
+
+	// rotated by age of the handler clock
+	file.MaxSize, file.MaxBackups = 0, 0
+	file.MaxAge = time.Minute
+	tracer.Encode(c, c.NewMessage(arpc.CmdNotify, "/trace", "hello"))
+	if n := len(globBackups(t, path)); n != 2 {
+		t.Fatalf("backups = %v before aged, want 2", n)
+	}
+	clock.Advance(time.Minute)
+	tracer.Encode(c, c.NewMessage(arpc.CmdNotify, "/trace", "hello"))
+	if n := len(globBackups(t, path)); n != 3 {
+		t.Fatalf("backups = %v after aged, want 3", n)
+	}
+}
+
+func globBackups(t *testing.T, path string) []string {
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("filepath.Glob() error = %v", err)
+	}
+	return backups
+}
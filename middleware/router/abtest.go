@@ -0,0 +1,101 @@
+package router
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// VariantStats defines counters of an experiment variant
+type VariantStats struct {
+	Calls   uint64
+	Errors  uint64
+	Latency time.Duration
+}
+
+type variantCounter struct {
+	calls   uint64
+	errors  uint64
+	latency int64
+}
+
+func (c *variantCounter) stats() VariantStats {
+	return VariantStats{
+		Calls:   atomic.LoadUint64(&c.calls),
+		Errors:  atomic.LoadUint64(&c.errors),
+		Latency: time.Duration(atomic.LoadInt64(&c.latency)),
+	}
+}
+
+// Experiment routes requests of a method to handler A or B, e.g. by user bucket or version header
+// in metadata, and counts each variant separately
+type Experiment struct {
+	A arpc.HandlerFunc
+	B arpc.HandlerFunc
+	// SelectB returns true if ctx should be handled by B
+	SelectB func(ctx *arpc.Context) bool
+
+	a variantCounter
+	b variantCounter
+}
+
+// Handle is the handler to register for the method, e.g. Handle("/hello", exp.Handle), latency
+// is measured by the clock of the handler, see arpc.Handler.SetClock
+func (e *Experiment) Handle(ctx *arpc.Context) {
+	h, c := e.A, &e.a
+	if e.SelectB != nil && e.SelectB(ctx) {
+		h, c = e.B, &e.b
+	}
+	clock := ctx.Client.Handler.Clock()
+	t := clock.Now()
+	defer func() {
+		atomic.AddUint64(&c.calls, 1)
+		atomic.AddInt64(&c.latency, int64(clock.Now().Sub(t)))
+		if ctx.ResponseError() != nil {
+			atomic.AddUint64(&c.errors, 1)
+		}
+	}()
+	h(ctx)
+}
+
+// Stats returns counters of variant A and B, Latency is the sum of all calls
+func (e *Experiment) Stats() (a, b VariantStats) {
+	return e.a.stats(), e.b.stats()
+}
+
+// NewExperiment returns Experiment selecting B by selectB
+func NewExperiment(a, b arpc.HandlerFunc, selectB func(ctx *arpc.Context) bool) *Experiment {
+	return &Experiment{A: a, B: b, SelectB: selectB}
+}
+
+// MetaEquals selects requests whose metadata of key is one of values, e.g. a version header
+func MetaEquals(key string, values ...string) func(ctx *arpc.Context) bool {
+	return func(ctx *arpc.Context) bool {
+		v, ok := ctx.Meta().Get(key)
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MetaBucket selects percent of callers bucketed by hash of metadata of key, e.g. a user id,
+// requests without the key are not selected
+func MetaBucket(key string, percent int) func(ctx *arpc.Context) bool {
+	return func(ctx *arpc.Context) bool {
+		v, ok := ctx.Meta().Get(key)
+		if !ok {
+			return false
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(v))
+		return int(hash.Sum32()%100) < percent
+	}
+}
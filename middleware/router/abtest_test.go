@@ -0,0 +1,54 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestExperiment(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	variant := func(latency time.Duration) arpc.HandlerFunc {
+		return func(ctx *arpc.Context) {
+			clock.Advance(latency)
+			failOn(ctx)
+		}
+	}
+	e := NewExperiment(variant(time.Millisecond*3), variant(time.Millisecond*5), func(ctx *arpc.Context) bool {
+		v, _ := ctx.Meta().Get("variant")
+		return v == "b"
+	})
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/exp", e.Handle)
+	})
+
+	cases := []struct {
+		variant string
+		req     string
+		err     error
+	}{
+		{"", "ok", nil},
+		{"a", "fail", errTestFailed},
+		{"b", "ok", nil},
+		{"b", "ok", nil},
+		{"b", "fail", errTestFailed},
+	}
+	for i, tc := range cases {
+		err := c.CallWithOptions("/exp", tc.req, nil, time.Second, arpc.WithMeta(arpc.Metadata{"variant": tc.variant}))
+		if (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+			t.Fatalf("case %v: Call() error = %v, want %v", i, err, tc.err)
+		}
+	}
+	if err := c.Call(barrierRoute, nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() barrier error = %v", err)
+	}
+
+	a, b := e.Stats()
+	if want := (VariantStats{Calls: 2, Errors: 1, Latency: time.Millisecond * 6}); a != want {
+		t.Fatalf("Stats() a = %+v, want %+v", a, want)
+	}
+	if want := (VariantStats{Calls: 3, Errors: 1, Latency: time.Millisecond * 15}); b != want {
+		t.Fatalf("Stats() b = %+v, want %+v", b, want)
+	}
+}
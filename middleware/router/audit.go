@@ -0,0 +1,129 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// AuditRecord defines who called what, when, and the outcome
+type AuditRecord struct {
+	Identity string        `json:"identity"`
+	Addr     string        `json:"addr"`
+	Method   string        `json:"method"`
+	Payload  string        `json:"payload"`
+	Time     time.Time     `json:"time"`
+	Cost     time.Duration `json:"cost"`
+	Outcome  string        `json:"outcome"`
+}
+
+// AuditSink writes audit records
+type AuditSink interface {
+	Write(r *AuditRecord) error
+}
+
+// AuditSinkFunc adapts a func to AuditSink
+type AuditSinkFunc func(r *AuditRecord) error
+
+// Write implements AuditSink
+func (f AuditSinkFunc) Write(r *AuditRecord) error {
+	return f(r)
+}
+
+// LogAuditSink writes records with arpc log
+var LogAuditSink AuditSink = AuditSinkFunc(func(r *AuditRecord) error {
+	log.Info("[AUDIT] identity: '%v', addr: %v, method: '%v', payload: %v, outcome: %v, %v ms cost",
+		r.Identity, r.Addr, r.Method, r.Payload, r.Outcome, r.Cost.Milliseconds())
+	return nil
+})
+
+// NewJSONAuditSink returns AuditSink writing records as JSON lines
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	mux := sync.Mutex{}
+	return AuditSinkFunc(func(r *AuditRecord) error {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		_, err = w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// Auditor records audit logs for designated methods
+type Auditor struct {
+	// Sink writes records, LogAuditSink by default
+	Sink AuditSink
+	// Identity returns who is calling, e.g. user id stored by auth middleware
+	Identity func(ctx *arpc.Context) string
+	// Summary returns summary of payload, payload length by default,
+	// should redact sensitive fields, see Redactor.Summary
+	Summary func(method string, payload []byte) string
+
+	methods map[string]bool
+}
+
+// Handle is the audit middleware
+func (a *Auditor) Handle(ctx *arpc.Context) {
+	method := ctx.Message.Method()
+	if len(a.methods) > 0 && !a.methods[method] {
+		ctx.Next()
+		return
+	}
+
+	clock := ctx.Client.Handler.Clock()
+	r := &AuditRecord{
+		Addr:   ctx.Client.Conn.RemoteAddr().String(),
+		Method: method,
+		Time:   clock.Now(),
+	}
+	if a.Identity != nil {
+		r.Identity = a.Identity(ctx)
+	}
+	if a.Summary != nil {
+		r.Payload = a.Summary(method, ctx.Body())
+	} else {
+		r.Payload = fmt.Sprintf("%d bytes", len(ctx.Body()))
+	}
+
+	defer func() {
+		err := recover()
+		r.Cost = clock.Now().Sub(r.Time)
+		switch {
+		case err != nil:
+			r.Outcome = fmt.Sprintf("panic: %v", err)
+		case ctx.ResponseError() != nil:
+			r.Outcome = fmt.Sprintf("error: %v", ctx.ResponseError())
+		default:
+			r.Outcome = "ok"
+		}
+		sink := a.Sink
+		if sink == nil {
+			sink = LogAuditSink
+		}
+		if werr := sink.Write(r); werr != nil {
+			log.Error("[AUDIT] write record failed: %v", werr)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	ctx.Next()
+}
+
+// NewAuditor returns Auditor for methods, all methods are audited if none is given
+func NewAuditor(sink AuditSink, methods ...string) *Auditor {
+	a := &Auditor{Sink: sink, methods: map[string]bool{}}
+	for _, m := range methods {
+		a.methods[m] = true
+	}
+	return a
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestAuditor(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	var mux sync.Mutex
+	var records []AuditRecord
+	a := NewAuditor(AuditSinkFunc(func(r *AuditRecord) error {
+		mux.Lock()
+		defer mux.Unlock()
+		records = append(records, *r)
+		return nil
+	}), "/audit/ok", "/audit/error", "/audit/panic")
+	a.Identity = func(ctx *arpc.Context) string { return "alice" }
+
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.SetPanicResponse(true)
+		h.Use(a.Handle)
+		h.Handle("/audit/ok", func(ctx *arpc.Context) {
+			clock.Advance(time.Second * 2)
+			ctx.Write(nil)
+		})
+		h.Handle("/audit/error", func(ctx *arpc.Context) { ctx.Error(errors.New("denied")) })
+		h.Handle("/audit/panic", func(ctx *arpc.Context) { panic("boom") })
+		h.Handle("/audit/skipped", func(ctx *arpc.Context) { ctx.Write(nil) })
+	})
+	for _, method := range []string{"/audit/ok", "/audit/error", "/audit/panic", "/audit/skipped"} {
+		c.Call(method, []byte("hello"), nil, time.Second)
+	}
+	if err := c.Call(barrierRoute, nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() barrier error = %v", err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(records) != 3 {
+		t.Fatalf("records = %+v, want 3 of methods audited", records)
+	}
+	start := time.Unix(1600000000, 0)
+	want := []AuditRecord{
+		{Identity: "alice", Method: "/audit/ok", Payload: "5 bytes", Time: start, Cost: time.Second * 2, Outcome: "ok"},
+		{Identity: "alice", Method: "/audit/error", Payload: "5 bytes", Time: start.Add(time.Second * 2), Outcome: "error: denied"},
+		{Identity: "alice", Method: "/audit/panic", Payload: "5 bytes", Time: start.Add(time.Second * 2), Outcome: "panic: boom"},
+	}
+	for i, r := range records {
+		if w := want[i]; r.Identity != w.Identity || r.Method != w.Method || r.Payload != w.Payload ||
+			!r.Time.Equal(w.Time) || r.Cost != w.Cost || r.Outcome != w.Outcome {
+			t.Fatalf("record %v = %+v, want %+v", i, r, w)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// ErrCircuitOpen is responded to calls of methods whose circuit is open, unless there's a fallback
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerState defines state of the circuit of a method
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls pass
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects calls to the fallback of the route
+	BreakerOpen
+	// BreakerHalfOpen lets a probe call pass, its outcome closes or opens the circuit again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type circuit struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// CircuitBreaker opens the circuit of a method after consecutive failures, panics or error
+// responses, calls are degraded to arpc.Context.Fallback while open, so the fallback handler of
+// WithFallback serves cached or default data. After OpenTimeout a probe call is let pass, its
+// success closes the circuit and its failure opens it again
+type CircuitBreaker struct {
+	// Failures is consecutive failures of a method opening its circuit, 5 by default
+	Failures int
+	// OpenTimeout is how long a circuit stays open before a probe call, 10 seconds by default
+	OpenTimeout time.Duration
+	// OnStateChange is called when the circuit of a method changes state, it logs by default
+	OnStateChange func(method string, from, to BreakerState)
+	// Shadow records calls that would have been rejected by open circuits without rejecting them
+	// if DryRun is set, the circuits change state as they would
+	Shadow
+
+	mux      sync.Mutex
+	circuits map[string]*circuit
+}
+
+// Handle is the circuit breaker middleware, panics are counted and re-panicked for Recover.
+// Circuits are opened for OpenTimeout by the clock of the handler, see arpc.Handler.SetClock
+func (b *CircuitBreaker) Handle(ctx *arpc.Context) {
+	clock := ctx.Client.Handler.Clock()
+	method := ctx.Message.Method()
+	allowed, probe := b.allow(method, clock.Now())
+	if !allowed && !b.shadow(ctx, ErrCircuitOpen) {
+		ctx.Fallback(ErrCircuitOpen)
+		return
+	}
+	panicked := true
+	defer func() {
+		b.done(method, clock.Now(), probe, panicked || ctx.ResponseError() != nil)
+	}()
+	ctx.Next()
+	panicked = false
+}
+
+// State returns state of the circuit of method
+func (b *CircuitBreaker) State(method string) BreakerState {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if c, ok := b.circuits[method]; ok {
+		return c.state
+	}
+	return BreakerClosed
+}
+
+func (b *CircuitBreaker) failures() int {
+	if b.Failures > 0 {
+		return b.Failures
+	}
+	return 5
+}
+
+func (b *CircuitBreaker) openTimeout() time.Duration {
+	if b.OpenTimeout > 0 {
+		return b.OpenTimeout
+	}
+	return time.Second * 10
+}
+
+// allow returns whether a call of method could pass, and whether it's the probe of half-open state
+func (b *CircuitBreaker) allow(method string, now time.Time) (bool, bool) {
+	b.mux.Lock()
+	c := b.circuits[method]
+	if c == nil || c.state == BreakerClosed {
+		b.mux.Unlock()
+		return true, false
+	}
+	if c.state == BreakerOpen && now.Sub(c.openedAt) >= b.openTimeout() {
+		c.state = BreakerHalfOpen
+		b.mux.Unlock()
+		b.changed(method, BreakerOpen, BreakerHalfOpen)
+		return true, true
+	}
+	b.mux.Unlock()
+	return false, false
+}
+
+// done counts outcome of a call of method passed, calls passed in dry-run mode while the circuit
+// is not closed are ignored except the probe
+func (b *CircuitBreaker) done(method string, now time.Time, probe bool, failed bool) {
+	b.mux.Lock()
+	if b.circuits == nil {
+		b.circuits = map[string]*circuit{}
+	}
+	c := b.circuits[method]
+	if c == nil {
+		if !failed {
+			b.mux.Unlock()
+			return
+		}
+		c = &circuit{}
+		b.circuits[method] = c
+	}
+	from := c.state
+	switch {
+	case from == BreakerClosed && failed:
+		if c.failures++; c.failures >= b.failures() {
+			c.state, c.openedAt = BreakerOpen, now
+		}
+	case from == BreakerClosed:
+		c.failures = 0
+	case from == BreakerHalfOpen && probe && failed:
+		c.state, c.openedAt = BreakerOpen, now
+	case from == BreakerHalfOpen && probe:
+		c.state, c.failures = BreakerClosed, 0
+	}
+	to := c.state
+	if to == BreakerClosed && c.failures == 0 {
+		delete(b.circuits, method)
+	}
+	b.mux.Unlock()
+	if from != to {
+		b.changed(method, from, to)
+	}
+}
+
+func (b *CircuitBreaker) changed(method string, from, to BreakerState) {
+	if b.OnStateChange != nil {
+		b.OnStateChange(method, from, to)
+		return
+	}
+	log.Warn("[CircuitBreaker] method '%v' circuit %v -> %v", method, from, to)
+}
+
+// NewCircuitBreaker returns CircuitBreaker opening circuits after failures consecutive failures
+// for openTimeout
+func NewCircuitBreaker(failures int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Failures: failures, OpenTimeout: openTimeout}
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+var errTestFailed = errors.New("failed")
+
+// failOn fails calls whose request is "fail"
+func failOn(ctx *arpc.Context) {
+	if string(ctx.Body()) == "fail" {
+		ctx.Error(errTestFailed)
+		return
+	}
+	ctx.Write(nil)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fail := []byte("fail")
+	cases := []struct {
+		name    string
+		dryRun  bool
+		steps   []step
+		changes string
+	}{
+		{"probe fails and succeeds", false, []step{
+			{req: fail, err: errTestFailed},
+			{req: fail, err: errTestFailed},
+			{err: ErrCircuitOpen},
+			{advance: time.Second * 9, err: ErrCircuitOpen},
+			{advance: time.Second, req: fail, err: errTestFailed},
+			{advance: time.Second * 9, err: ErrCircuitOpen},
+			{advance: time.Second},
+			{req: fail, err: errTestFailed},
+			{},
+		}, "[closed->open open->half-open half-open->open open->half-open half-open->closed]"},
+		{"failures not consecutive", false, []step{
+			{req: fail, err: errTestFailed},
+			{},
+			{req: fail, err: errTestFailed},
+			{},
+		}, "[]"},
+		{"dry run", true, []step{
+			{req: fail, err: errTestFailed},
+			{req: fail, err: errTestFailed},
+			{},
+			{advance: time.Second * 10},
+		}, "[closed->open open->half-open half-open->closed]"},
+	}
+	for _, tc := range cases {
+		clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+		var (
+			mux     sync.Mutex
+			changes []string
+		)
+		b := NewCircuitBreaker(2, time.Second*10)
+		b.DryRun = tc.dryRun
+		b.OnStateChange = func(method string, from, to BreakerState) {
+			mux.Lock()
+			changes = append(changes, fmt.Sprintf("%v->%v", from, to))
+			mux.Unlock()
+		}
+		c := newTestClient(t, clock, func(h arpc.Handler) {
+			h.Handle("/breaker", failOn, b.Handle)
+		})
+		run(t, tc.name, clock, c, "/breaker", "ok", tc.steps)
+		mux.Lock()
+		got := fmt.Sprint(changes)
+		mux.Unlock()
+		if got != tc.changes {
+			t.Fatalf("%v: state changes = %v, want %v", tc.name, got, tc.changes)
+		}
+	}
+}
+
+func TestCircuitBreaker_Fallback(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	b := NewCircuitBreaker(1, time.Second)
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/breaker", failOn, b.Handle, arpc.WithFallback(func(ctx *arpc.Context) {
+			ctx.Write("cached")
+		}))
+	})
+	if err := c.Call("/breaker", "fail", nil, time.Second); err == nil || err.Error() != errTestFailed.Error() {
+		t.Fatalf("Call() error = %v, want %v", err, errTestFailed)
+	}
+	rsp := ""
+	if err := c.Call("/breaker", "ok", &rsp, time.Second); err != nil || rsp != "cached" {
+		t.Fatalf("Call() = %v, %v, want cached", rsp, err)
+	}
+	if s := b.State("/breaker"); s != BreakerOpen {
+		t.Fatalf("State() = %v, want %v", s, BreakerOpen)
+	}
+}
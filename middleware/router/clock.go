@@ -0,0 +1,42 @@
+package router
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+type clockBox struct {
+	arpc.Clock
+}
+
+// handlerClock keeps the clock of the handler a middleware served last, so that methods called
+// without a context, e.g. Quota.Usage, count time as calls do, see arpc.Handler.SetClock
+type handlerClock struct {
+	v atomic.Value
+}
+
+// of returns the clock of the handler of ctx and keeps it
+func (hc *handlerClock) of(ctx *arpc.Context) arpc.Clock {
+	clock := ctx.Client.Handler.Clock()
+	if box, _ := hc.v.Load().(clockBox); box.Clock != clock {
+		hc.v.Store(clockBox{clock})
+	}
+	return clock
+}
+
+// now returns current time of the clock kept, arpc.SystemClock before any call
+func (hc *handlerClock) now() time.Time {
+	if box, ok := hc.v.Load().(clockBox); ok {
+		return box.Now()
+	}
+	return time.Now()
+}
+
+// sleep waits for d by clock
+func sleep(clock arpc.Clock, d time.Duration) {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	<-timer.C()
+}
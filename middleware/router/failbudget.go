@@ -0,0 +1,167 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// ErrFailureBudgetExceeded is recorded for calls exceeding FailureBudget in dry-run mode
+var ErrFailureBudgetExceeded = errors.New("failure budget exceeded")
+
+// Failures defines failures counted in the current window
+type Failures struct {
+	Panics int
+	Errors int
+}
+
+type failureCounter struct {
+	start time.Time
+	Failures
+}
+
+// FailureBudget counts handler panics and error responses per client and per method in fixed
+// windows, and calls hooks when a client or method fails disproportionately, e.g. by malformed traffic
+type FailureBudget struct {
+	// Window is the counting window, 1 minute by default
+	Window time.Duration
+	// MaxClientFailures is failures of a client allowed in a window, 0 means no limit
+	MaxClientFailures int
+	// MaxMethodFailures is failures of a method allowed in a window, 0 means no limit
+	MaxMethodFailures int
+	// OnClientExceeded is called once a window when a client exceeds, it stops the client by default,
+	// it could also throttle the client, e.g. by a flag checked in an earlier middleware
+	OnClientExceeded func(c *arpc.Client, f Failures)
+	// OnMethodExceeded is called once a window when a method exceeds, it logs a warning by default
+	OnMethodExceeded func(method string, f Failures)
+	// Shadow records calls exceeding the budget without calling OnClientExceeded or
+	// OnMethodExceeded if DryRun is set
+	Shadow
+
+	mux     sync.Mutex
+	clock   handlerClock
+	sweep   time.Time
+	clients failureCounters
+	methods failureCounters
+}
+
+// Handle is the failure budget middleware, panics are counted and re-panicked for Recover.
+// Windows are counted by the clock of the handler, see arpc.Handler.SetClock
+func (b *FailureBudget) Handle(ctx *arpc.Context) {
+	panicked := true
+	defer func() {
+		if panicked {
+			b.add(ctx, true)
+		} else if ctx.ResponseError() != nil {
+			b.add(ctx, false)
+		}
+	}()
+	ctx.Next()
+	panicked = false
+}
+
+// ClientFailures returns failures of c in the current window
+func (b *FailureBudget) ClientFailures(c *arpc.Client) Failures {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.clients.get(c, b.clock.now(), b.window())
+}
+
+// MethodFailures returns failures of method in the current window
+func (b *FailureBudget) MethodFailures(method string) Failures {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.methods.get(method, b.clock.now(), b.window())
+}
+
+func (b *FailureBudget) window() time.Duration {
+	if b.Window > 0 {
+		return b.Window
+	}
+	return time.Minute
+}
+
+func (b *FailureBudget) add(ctx *arpc.Context, panicked bool) {
+	now := b.clock.of(ctx).Now()
+	window := b.window()
+	method := ctx.Message.Method()
+
+	b.mux.Lock()
+	if b.clients == nil {
+		b.clients, b.methods = failureCounters{}, failureCounters{}
+	}
+	if now.Sub(b.sweep) >= window {
+		b.clients.sweep(now, window)
+		b.methods.sweep(now, window)
+		b.sweep = now
+	}
+	clientExceeded, cf := b.clients.count(ctx.Client, now, window, panicked, b.MaxClientFailures)
+	methodExceeded, mf := b.methods.count(method, now, window, panicked, b.MaxMethodFailures)
+	b.mux.Unlock()
+
+	if (clientExceeded || methodExceeded) && b.shadow(ctx, ErrFailureBudgetExceeded) {
+		return
+	}
+	if clientExceeded {
+		if b.OnClientExceeded != nil {
+			b.OnClientExceeded(ctx.Client, cf)
+		} else {
+			log.Warn("[FailureBudget] client %v exceeded with %v panics and %v errors, stopped", ctx.Client.Conn.RemoteAddr(), cf.Panics, cf.Errors)
+			go ctx.Client.Stop()
+		}
+	}
+	if methodExceeded {
+		if b.OnMethodExceeded != nil {
+			b.OnMethodExceeded(method, mf)
+		} else {
+			log.Warn("[FailureBudget] method '%v' exceeded with %v panics and %v errors", method, mf.Panics, mf.Errors)
+		}
+	}
+}
+
+// failureCounters counts failures by client or method
+type failureCounters map[interface{}]*failureCounter
+
+// count counts a failure of key, returns true when the count just exceeds max
+func (m failureCounters) count(key interface{}, now time.Time, window time.Duration, panicked bool, max int) (bool, Failures) {
+	fc := m[key]
+	if fc == nil || now.Sub(fc.start) >= window {
+		fc = &failureCounter{start: now}
+		m[key] = fc
+	}
+	if panicked {
+		fc.Panics++
+	} else {
+		fc.Errors++
+	}
+	return max > 0 && fc.Panics+fc.Errors == max+1, fc.Failures
+}
+
+func (m failureCounters) get(key interface{}, now time.Time, window time.Duration) Failures {
+	if fc, ok := m[key]; ok && now.Sub(fc.start) < window {
+		return fc.Failures
+	}
+	return Failures{}
+}
+
+// sweep drops counters of past windows, e.g. of disconnected clients
+func (m failureCounters) sweep(now time.Time, window time.Duration) {
+	for key, fc := range m {
+		if now.Sub(fc.start) >= window {
+			delete(m, key)
+		}
+	}
+}
+
+// NewFailureBudget returns FailureBudget allowing maxClient failures of a client and maxMethod
+// failures of a method in each window
+func NewFailureBudget(window time.Duration, maxClient, maxMethod int) *FailureBudget {
+	return &FailureBudget{
+		Window:            window,
+		MaxClientFailures: maxClient,
+		MaxMethodFailures: maxMethod,
+	}
+}
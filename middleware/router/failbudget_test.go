@@ -0,0 +1,43 @@
+package router
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestFailureBudget(t *testing.T) {
+	fail := []byte("fail")
+	failed := step{req: fail, err: errTestFailed}
+	cases := []struct {
+		name     string
+		dryRun   bool
+		steps    []step
+		exceeded int32
+		failures Failures
+	}{
+		{"exceeded once a window", false, []step{failed, failed, {}, failed, failed}, 1, Failures{Errors: 4}},
+		{"window resets", false, []step{failed, failed, {advance: time.Second * 10, req: fail, err: errTestFailed}, failed}, 0, Failures{Errors: 2}},
+		{"dry run", true, []step{failed, failed, failed}, 0, Failures{Errors: 3}},
+		{"window passed", false, []step{failed, {advance: time.Second * 10}}, 0, Failures{}},
+	}
+	for _, tc := range cases {
+		clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+		var exceeded int32
+		b := NewFailureBudget(time.Second*10, 0, 2)
+		b.DryRun = tc.dryRun
+		b.OnMethodExceeded = func(method string, f Failures) { atomic.AddInt32(&exceeded, 1) }
+		c := newTestClient(t, clock, func(h arpc.Handler) {
+			h.Handle("/budget", failOn, b.Handle)
+		})
+		run(t, tc.name, clock, c, "/budget", "ok", tc.steps)
+		if n := atomic.LoadInt32(&exceeded); n != tc.exceeded {
+			t.Fatalf("%v: OnMethodExceeded called %v times, want %v", tc.name, n, tc.exceeded)
+		}
+		if f := b.MethodFailures("/budget"); f != tc.failures {
+			t.Fatalf("%v: MethodFailures() = %+v, want %+v", tc.name, f, tc.failures)
+		}
+	}
+}
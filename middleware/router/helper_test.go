@@ -0,0 +1,91 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// barrierRoute is handled after handlers of calls made before it returned, handlers of a client are
+// sync and run in order
+const barrierRoute = "/barrier"
+
+// newTestClient returns a client of a server whose handler is set up by setup and runs by clock,
+// both are stopped when the test finishes
+func newTestClient(t *testing.T, clock arpc.Clock, setup func(h arpc.Handler)) *arpc.Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	h := arpc.NewHandler()
+	h.SetClock(clock)
+	h.Handle(barrierRoute, func(ctx *arpc.Context) { ctx.Write(nil) })
+	setup(h)
+	svr := arpc.NewServer()
+	svr.Handler = h
+	go svr.Serve(ln)
+	t.Cleanup(func() { svr.Stop() })
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, func(c *arpc.Client) {
+		c.Handler = arpc.NewHandler()
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// step is a call made after the clock of the server is advanced
+type step struct {
+	advance time.Duration
+	// req is the request, the one passed to run if nil
+	req interface{}
+	err error
+	// retryAfter is the retry-after hint of err
+	retryAfter time.Duration
+}
+
+// run makes calls of method by steps, errors are compared by text as they are received. Handlers
+// of the calls have returned when it returns
+func run(t *testing.T, name string, clock *arpc.MockClock, c *arpc.Client, method string, req interface{}, steps []step) {
+	t.Helper()
+	for i, st := range steps {
+		clock.Advance(st.advance)
+		r := req
+		if st.req != nil {
+			r = st.req
+		}
+		err := c.Call(method, r, nil, time.Second)
+		if (err == nil) != (st.err == nil) || (err != nil && err.Error() != st.err.Error()) {
+			t.Fatalf("%v: step %v Call() error = %v, want %v", name, i, err, st.err)
+		}
+		var after time.Duration
+		if re, ok := err.(*arpc.RetryAfterError); ok {
+			after = re.After
+		}
+		if after != st.retryAfter {
+			t.Fatalf("%v: step %v retry after = %v, want %v", name, i, after, st.retryAfter)
+		}
+	}
+	if err := c.Call(barrierRoute, nil, nil, time.Second); err != nil {
+		t.Fatalf("%v: Call() barrier error = %v", name, err)
+	}
+}
+
+// waitTimers waits until clock has more than n timers, e.g. of a call sleeping
+func waitTimers(t *testing.T, clock *arpc.MockClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.Timers() <= n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timers = %v, want more than %v", clock.Timers(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,263 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+var (
+	// ErrRateLimited is responded to calls rejected by RateLimiter, unless there's a fallback
+	ErrRateLimited = errors.New("rate limited")
+	// ErrConcurrencyLimited is responded to calls rejected by ConcurrencyLimiter, unless there's a fallback
+	ErrConcurrencyLimited = errors.New("concurrency limited")
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits cost of calls per second by token buckets, each call consumes
+// arpc.Context.Cost tokens, so one heavy call counts more than many cheap ones
+type RateLimiter struct {
+	// Rate is tokens added per second
+	Rate float64
+	// Burst is the bucket size, Rate by default and at least 1, cost of a call is capped to it
+	Burst int
+	// Wait delays calls until tokens are enough instead of rejecting them with a retry-after hint,
+	// it blocks the read loop of the client for sync handlers
+	Wait bool
+	// Identity returns the key of each bucket, e.g. tenant id stored by auth middleware,
+	// all calls share a bucket if nil
+	Identity func(ctx *arpc.Context) string
+	// Shadow records calls beyond the rate without rejecting or delaying them if DryRun is set
+	Shadow
+
+	mux     sync.Mutex
+	clock   handlerClock
+	sweep   time.Time
+	buckets map[string]*tokenBucket
+}
+
+// Handle is the rate limiter middleware, tokens are added by the clock of the handler, see
+// arpc.Handler.SetClock
+func (l *RateLimiter) Handle(ctx *arpc.Context) {
+	clock := l.clock.of(ctx)
+	key := ""
+	if l.Identity != nil {
+		key = l.Identity(ctx)
+	}
+	if wait := l.take(key, ctx.Cost(), clock.Now()); wait > 0 && !l.shadow(ctx, ErrRateLimited) {
+		if !l.Wait {
+			ctx.SetRetryAfter(wait)
+			ctx.Fallback(ErrRateLimited)
+			return
+		}
+		sleep(clock, wait)
+	}
+	ctx.Next()
+}
+
+// Tokens returns tokens left in the bucket of identity, "" if Identity is nil
+func (l *RateLimiter) Tokens(identity string) float64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if b, ok := l.buckets[identity]; ok {
+		return l.refill(b, l.clock.now())
+	}
+	return float64(l.burst())
+}
+
+func (l *RateLimiter) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	if l.Rate > 1 {
+		return int(l.Rate)
+	}
+	return 1
+}
+
+// refill adds tokens of the time elapsed, l.mux should be held
+func (l *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.Rate
+	if max := float64(l.burst()); tokens > max {
+		tokens = max
+	}
+	return tokens
+}
+
+// take consumes cost tokens of key and returns 0, or the time to wait for the tokens. In Wait
+// mode the tokens are reserved and the bucket goes negative, otherwise and in dry-run mode
+// nothing is consumed
+func (l *RateLimiter) take(key string, cost int, now time.Time) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	if burst := l.burst(); cost > burst {
+		cost = burst
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if now.Sub(l.sweep) >= time.Minute {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= float64(l.burst()) {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweep = now
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.burst()), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens, b.last = l.refill(b, now), now
+	if b.tokens >= float64(cost) {
+		b.tokens -= float64(cost)
+		return 0
+	}
+	wait := time.Duration((float64(cost) - b.tokens) / l.Rate * float64(time.Second))
+	if l.Wait && !l.DryRun {
+		b.tokens -= float64(cost)
+	}
+	return wait
+}
+
+type costWaiter struct {
+	cost int
+	ch   chan struct{}
+}
+
+// ConcurrencyLimiter limits total cost of calls being handled, each call holds arpc.Context.Cost
+// until its handlers return, so one heavy call counts more than many cheap ones. Waiting calls
+// are admitted in order, cheap calls don't overtake a heavy one waiting before them
+type ConcurrencyLimiter struct {
+	// Max is the total cost allowed, cost of a call is capped to it, 0 means no limit
+	Max int
+	// Timeout is how long a call waits for running calls to finish by the clock of the handler,
+	// calls are rejected at once if 0
+	Timeout time.Duration
+	// Shadow records calls beyond Max without rejecting or delaying them if DryRun is set, their
+	// cost is still counted in InUse
+	Shadow
+
+	mux     sync.Mutex
+	used    int
+	waiters []*costWaiter
+}
+
+// Handle is the concurrency limiter middleware
+func (l *ConcurrencyLimiter) Handle(ctx *arpc.Context) {
+	if l.Max <= 0 {
+		ctx.Next()
+		return
+	}
+	cost := ctx.Cost()
+	if cost > l.Max {
+		cost = l.Max
+	}
+	if l.DryRun {
+		l.mux.Lock()
+		exceeded := l.used+cost > l.Max
+		l.used += cost
+		l.mux.Unlock()
+		if exceeded {
+			l.shadow(ctx, ErrConcurrencyLimited)
+		}
+		defer l.release(cost)
+		ctx.Next()
+		return
+	}
+	if !l.acquire(ctx.Client.Handler.Clock(), cost) {
+		ctx.Fallback(ErrConcurrencyLimited)
+		return
+	}
+	defer l.release(cost)
+	ctx.Next()
+}
+
+// InUse returns total cost of calls being handled
+func (l *ConcurrencyLimiter) InUse() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.used
+}
+
+func (l *ConcurrencyLimiter) acquire(clock arpc.Clock, cost int) bool {
+	l.mux.Lock()
+	if len(l.waiters) == 0 && l.used+cost <= l.Max {
+		l.used += cost
+		l.mux.Unlock()
+		return true
+	}
+	if l.Timeout <= 0 {
+		l.mux.Unlock()
+		return false
+	}
+	w := &costWaiter{cost: cost, ch: make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.mux.Unlock()
+
+	timer := clock.NewTimer(l.Timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C():
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	select {
+	case <-w.ch:
+		// admitted while timing out
+		return true
+	default:
+	}
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	// waiters after w may fit now
+	l.admit()
+	return false
+}
+
+func (l *ConcurrencyLimiter) release(cost int) {
+	l.mux.Lock()
+	l.used -= cost
+	l.admit()
+	l.mux.Unlock()
+}
+
+// admit admits waiters in order while their cost fits, l.mux should be held
+func (l *ConcurrencyLimiter) admit() {
+	for len(l.waiters) > 0 && l.used+l.waiters[0].cost <= l.Max {
+		w := l.waiters[0]
+		l.waiters[0] = nil
+		l.waiters = l.waiters[1:]
+		l.used += w.cost
+		close(w.ch)
+	}
+}
+
+// NewRateLimiter returns RateLimiter adding rate tokens per second to buckets of burst size
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// NewConcurrencyLimiter returns ConcurrencyLimiter allowing max total cost of calls, waiting for
+// at most timeout
+func NewConcurrencyLimiter(max int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{Max: max, Timeout: timeout}
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestRateLimiter(t *testing.T) {
+	cases := []struct {
+		name     string
+		cost     int
+		dryRun   bool
+		steps    []step
+		shadowed uint64
+	}{
+		{"reject", 1, false, []step{
+			{},
+			{},
+			{err: ErrRateLimited, retryAfter: time.Millisecond * 500},
+			{advance: time.Millisecond * 500},
+			{advance: time.Second * 10},
+			{},
+		}, 0},
+		{"cost", 2, false, []step{
+			{},
+			{err: ErrRateLimited, retryAfter: time.Second},
+			{advance: time.Millisecond * 500, err: ErrRateLimited, retryAfter: time.Millisecond * 500},
+			{advance: time.Millisecond * 500},
+		}, 0},
+		{"cost capped to burst", 5, false, []step{
+			{},
+			{err: ErrRateLimited, retryAfter: time.Second},
+			{advance: time.Second},
+		}, 0},
+		{"dry run", 2, true, []step{{}, {}, {advance: time.Second}, {}}, 2},
+	}
+	for _, tc := range cases {
+		clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+		l := NewRateLimiter(2, 2)
+		l.DryRun = tc.dryRun
+		c := newTestClient(t, clock, func(h arpc.Handler) {
+			h.Handle("/limit", func(ctx *arpc.Context) { ctx.Write(nil) }, arpc.WithCost(tc.cost), l.Handle)
+		})
+		run(t, tc.name, clock, c, "/limit", nil, tc.steps)
+		if n := l.Shadowed(); n != tc.shadowed {
+			t.Fatalf("%v: Shadowed() = %v, want %v", tc.name, n, tc.shadowed)
+		}
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	l := NewRateLimiter(1, 1)
+	l.Wait = true
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/limit", func(ctx *arpc.Context) { ctx.Write(nil) }, l.Handle)
+	})
+	if err := c.Call("/limit", nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+
+	timers := clock.Timers()
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/limit", nil, nil, time.Second) }()
+	waitTimers(t, clock, timers)
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if tokens := l.Tokens(""); tokens != 0 {
+		t.Fatalf("Tokens() = %v, want 0", tokens)
+	}
+	clock.Advance(time.Second)
+	if tokens := l.Tokens(""); tokens != 1 {
+		t.Fatalf("Tokens() = %v, want 1", tokens)
+	}
+}
+
+func TestConcurrencyLimiter_Timeout(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	l := NewConcurrencyLimiter(1, time.Second)
+	chRunning, chRelease := make(chan struct{}, 1), make(chan struct{})
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/limit/hold", func(ctx *arpc.Context) {
+			chRunning <- struct{}{}
+			<-chRelease
+			ctx.Write(nil)
+		}, true, l.Handle)
+		h.Handle("/limit", func(ctx *arpc.Context) { ctx.Write(nil) }, true, l.Handle)
+	})
+
+	held := make(chan error, 1)
+	go func() { held <- c.Call("/limit/hold", nil, nil, time.Second) }()
+	<-chRunning
+
+	timers := clock.Timers()
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/limit", nil, nil, time.Second) }()
+	waitTimers(t, clock, timers)
+	clock.Advance(time.Second)
+	if err := <-done; err == nil || err.Error() != ErrConcurrencyLimited.Error() {
+		t.Fatalf("Call() error = %v, want %v", err, ErrConcurrencyLimited)
+	}
+
+	close(chRelease)
+	if err := <-held; err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if err := c.Call("/limit", nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+}
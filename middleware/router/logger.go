@@ -19,7 +19,11 @@ func Logger(ctx *arpc.Context) {
 
 	switch cmd {
 	case arpc.CmdRequest, arpc.CmdNotify:
-		log.Info("'%v',\t%v,\t%v ms cost", method, addr, cost)
+		if id, ok := ctx.Meta().Get(arpc.MetaKeyRequestID); ok {
+			log.Info("'%v',\t%v,\t%v ms cost,\trequest id: %v", method, addr, cost, id)
+		} else {
+			log.Info("'%v',\t%v,\t%v ms cost", method, addr, cost)
+		}
 		break
 	default:
 		log.Error("invalid cmd: %d,\tdropped", cmd)
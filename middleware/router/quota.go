@@ -0,0 +1,235 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// quotaBuckets is the number of buckets a sliding window is split into
+const quotaBuckets = 10
+
+// ErrQuotaExceeded is responded to calls rejected by Quota, unless there's a fallback
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaMode defines how Quota enforces limits
+type QuotaMode int
+
+const (
+	// QuotaWarn lets calls over limits pass and calls OnExceeded once a window
+	QuotaWarn QuotaMode = iota
+	// QuotaThrottle delays calls over limits until the window slides enough, it blocks the read
+	// loop of the client for sync handlers, which also slows the client down
+	QuotaThrottle
+	// QuotaReject responds ErrQuotaExceeded with a retry-after hint to calls over limits
+	QuotaReject
+)
+
+// QuotaUsage defines calls and request bytes of an identity in the sliding window
+type QuotaUsage struct {
+	Calls int64
+	Bytes int64
+}
+
+type quotaBucket struct {
+	index int64
+	QuotaUsage
+}
+
+type quotaCounter struct {
+	buckets  [quotaBuckets]quotaBucket
+	notified int64
+}
+
+// Quota accounts calls and request body bytes of each identity over a sliding window, and enforces
+// limits by Mode for fairness between tenants. Rejected calls are not counted, and a call is always
+// allowed when the identity has no usage in the window, even if its body exceeds MaxBytes
+type Quota struct {
+	// Window is the sliding window, 1 minute by default
+	Window time.Duration
+	// MaxCalls is calls of an identity allowed in a window, 0 means no limit
+	MaxCalls int64
+	// MaxBytes is request body bytes of an identity allowed in a window, 0 means no limit
+	MaxBytes int64
+	// Mode is the enforcement of limits, QuotaWarn by default
+	Mode QuotaMode
+	// Identity returns who is calling, e.g. tenant id stored by auth middleware, remote address by default
+	Identity func(ctx *arpc.Context) string
+	// Limits returns limits of identity overriding MaxCalls and MaxBytes, e.g. by tenant plan
+	Limits func(identity string) (maxCalls, maxBytes int64)
+	// OnExceeded is called once a window when an identity exceeds, it logs a warning by default
+	OnExceeded func(identity string, usage QuotaUsage)
+	// Shadow records calls over limits without throttling or rejecting them if DryRun is set,
+	// they are counted as in QuotaWarn mode
+	Shadow
+
+	mux      sync.Mutex
+	clock    handlerClock
+	sweep    int64
+	counters map[string]*quotaCounter
+}
+
+// Handle is the quota middleware, windows slide by the clock of the handler, see
+// arpc.Handler.SetClock
+func (q *Quota) Handle(ctx *arpc.Context) {
+	clock := q.clock.of(ctx)
+	identity := q.identity(ctx)
+	n := int64(len(ctx.Body()))
+	for {
+		wait, usage, exceeded, notify := q.add(identity, n, clock.Now())
+		if exceeded {
+			q.shadow(ctx, ErrQuotaExceeded)
+		}
+		if notify {
+			if q.OnExceeded != nil {
+				q.OnExceeded(identity, usage)
+			} else {
+				log.Warn("[Quota] identity '%v' exceeded with %v calls and %v bytes", identity, usage.Calls, usage.Bytes)
+			}
+		}
+		if wait <= 0 {
+			break
+		}
+		if q.Mode == QuotaReject {
+			ctx.SetRetryAfter(wait)
+			ctx.Fallback(ErrQuotaExceeded)
+			return
+		}
+		sleep(clock, wait)
+	}
+	ctx.Next()
+}
+
+// Usage returns usage of identity in the current window
+func (q *Quota) Usage(identity string) QuotaUsage {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if qc, ok := q.counters[identity]; ok {
+		return qc.usage(q.bucketIndex(q.clock.now()))
+	}
+	return QuotaUsage{}
+}
+
+// Usages returns usages of identities with calls in the current window
+func (q *Quota) Usages() map[string]QuotaUsage {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	index := q.bucketIndex(q.clock.now())
+	usages := map[string]QuotaUsage{}
+	for identity, qc := range q.counters {
+		if u := qc.usage(index); u.Calls > 0 {
+			usages[identity] = u
+		}
+	}
+	return usages
+}
+
+func (q *Quota) identity(ctx *arpc.Context) string {
+	if q.Identity != nil {
+		return q.Identity(ctx)
+	}
+	return ctx.Client.Conn.RemoteAddr().String()
+}
+
+func (q *Quota) window() time.Duration {
+	if q.Window > 0 {
+		return q.Window
+	}
+	return time.Minute
+}
+
+func (q *Quota) bucketSize() int64 {
+	size := int64(q.window() / quotaBuckets)
+	if size <= 0 {
+		size = 1
+	}
+	return size
+}
+
+func (q *Quota) bucketIndex(now time.Time) int64 {
+	return now.UnixNano() / q.bucketSize()
+}
+
+// add counts a call of n bytes unless it should wait for the window to slide, it returns the time
+// to wait, usage of the window, whether limits are exceeded and whether OnExceeded should be called
+func (q *Quota) add(identity string, n int64, now time.Time) (time.Duration, QuotaUsage, bool, bool) {
+	maxCalls, maxBytes := q.MaxCalls, q.MaxBytes
+	if q.Limits != nil {
+		maxCalls, maxBytes = q.Limits(identity)
+	}
+	index := q.bucketIndex(now)
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.counters == nil {
+		q.counters = map[string]*quotaCounter{}
+	}
+	if index-q.sweep >= quotaBuckets {
+		for k, qc := range q.counters {
+			if qc.usage(index).Calls == 0 {
+				delete(q.counters, k)
+			}
+		}
+		q.sweep = index
+	}
+	qc := q.counters[identity]
+	if qc == nil {
+		qc = &quotaCounter{notified: -quotaBuckets}
+		q.counters[identity] = qc
+	}
+
+	usage := qc.usage(index)
+	exceeded := usage.Calls > 0 &&
+		((maxCalls > 0 && usage.Calls+1 > maxCalls) || (maxBytes > 0 && usage.Bytes+n > maxBytes))
+	notify := exceeded && index-qc.notified >= quotaBuckets
+	if notify {
+		qc.notified = index
+	}
+	if exceeded && q.Mode != QuotaWarn && !q.DryRun {
+		// the oldest bucket counted slides out of the window first
+		oldest := index
+		for _, b := range qc.buckets {
+			if b.Calls > 0 && index-b.index < quotaBuckets && b.index < oldest {
+				oldest = b.index
+			}
+		}
+		wait := time.Duration((oldest+quotaBuckets)*q.bucketSize() - now.UnixNano())
+		return wait, usage, exceeded, notify
+	}
+
+	b := &qc.buckets[index%quotaBuckets]
+	if b.index != index {
+		b.index, b.QuotaUsage = index, QuotaUsage{}
+	}
+	b.Calls++
+	b.Bytes += n
+	usage.Calls++
+	usage.Bytes += n
+	return 0, usage, exceeded, notify
+}
+
+// usage sums buckets in the window ending with bucket index
+func (qc *quotaCounter) usage(index int64) QuotaUsage {
+	var u QuotaUsage
+	for _, b := range qc.buckets {
+		if index-b.index < quotaBuckets {
+			u.Calls += b.Calls
+			u.Bytes += b.Bytes
+		}
+	}
+	return u
+}
+
+// NewQuota returns Quota allowing maxCalls calls and maxBytes request bytes of each identity in
+// the sliding window, enforced by mode
+func NewQuota(window time.Duration, maxCalls, maxBytes int64, mode QuotaMode) *Quota {
+	return &Quota{
+		Window:   window,
+		MaxCalls: maxCalls,
+		MaxBytes: maxBytes,
+		Mode:     mode,
+	}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestQuota(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     QuotaMode
+		maxCalls int64
+		maxBytes int64
+		steps    []step
+		exceeded int32
+	}{
+		{"warn", QuotaWarn, 1, 0, []step{{}, {}, {advance: time.Second}}, 1},
+		{"reject calls", QuotaReject, 2, 0, []step{
+			{},
+			{advance: time.Second * 3},
+			{err: ErrQuotaExceeded, retryAfter: time.Second * 7},
+			// the first bucket slides out of the window
+			{advance: time.Second * 7},
+			{err: ErrQuotaExceeded, retryAfter: time.Second * 3},
+		}, 1},
+		{"reject bytes", QuotaReject, 0, 10, []step{
+			{},
+			{advance: time.Second},
+			{advance: time.Second, err: ErrQuotaExceeded, retryAfter: time.Second * 8},
+			{advance: time.Second * 8},
+		}, 1},
+		{"notified once a window", QuotaReject, 1, 0, []step{
+			{},
+			{err: ErrQuotaExceeded, retryAfter: time.Second * 10},
+			{advance: time.Second * 5, err: ErrQuotaExceeded, retryAfter: time.Second * 5},
+			{advance: time.Second * 5},
+			{err: ErrQuotaExceeded, retryAfter: time.Second * 10},
+		}, 2},
+	}
+	for _, tc := range cases {
+		clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+		var exceeded int32
+		q := NewQuota(time.Second*10, tc.maxCalls, tc.maxBytes, tc.mode)
+		q.OnExceeded = func(identity string, usage QuotaUsage) { atomic.AddInt32(&exceeded, 1) }
+		c := newTestClient(t, clock, func(h arpc.Handler) {
+			h.Handle("/quota", func(ctx *arpc.Context) { ctx.Write(nil) }, q.Handle)
+		})
+		run(t, tc.name, clock, c, "/quota", []byte("hello"), tc.steps)
+		if n := atomic.LoadInt32(&exceeded); n != tc.exceeded {
+			t.Fatalf("%v: OnExceeded called %v times, want %v", tc.name, n, tc.exceeded)
+		}
+	}
+}
+
+func TestQuota_Throttle(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	q := NewQuota(time.Second*10, 1, 0, QuotaThrottle)
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/quota", func(ctx *arpc.Context) { ctx.Write(nil) }, q.Handle)
+	})
+	if err := c.Call("/quota", nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	identity := c.Conn.LocalAddr().String()
+	if u := q.Usage(identity); u.Calls != 1 {
+		t.Fatalf("Usage() = %+v, want 1 call", u)
+	}
+
+	timers := clock.Timers()
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/quota", nil, nil, time.Second) }()
+	waitTimers(t, clock, timers)
+	select {
+	case err := <-done:
+		t.Fatalf("Call() returned %v before the window slides", err)
+	default:
+	}
+	clock.Advance(time.Second * 10)
+	if err := <-done; err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+
+	clock.Advance(time.Second * 10)
+	if u := q.Usage(identity); u.Calls != 0 {
+		t.Fatalf("Usage() after the window = %+v, want none", u)
+	}
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// DefaultRedactMask replaces values of redacted fields
+const DefaultRedactMask = "******"
+
+// Redactor masks configured JSON fields, at any depth and case-insensitively, before payloads are logged
+type Redactor struct {
+	Mask   string
+	fields map[string]bool
+}
+
+// Redact returns data with configured fields masked, non-JSON data is replaced by its length
+func (r *Redactor) Redact(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return []byte(fmt.Sprintf("(%d bytes non-JSON payload)", len(data)))
+	}
+	ret, err := json.Marshal(r.redact(v))
+	if err != nil {
+		return []byte(fmt.Sprintf("(%d bytes payload)", len(data)))
+	}
+	return ret
+}
+
+// Summary returns redacted payload, could be used as Auditor.Summary
+func (r *Redactor) Summary(method string, payload []byte) string {
+	return string(r.Redact(payload))
+}
+
+func (r *Redactor) redact(v interface{}) interface{} {
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		for k, value := range vt {
+			if r.fields[strings.ToLower(k)] {
+				vt[k] = r.Mask
+			} else {
+				vt[k] = r.redact(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range vt {
+			vt[i] = r.redact(value)
+		}
+	}
+	return v
+}
+
+// NewRedactor returns Redactor for fields
+func NewRedactor(fields ...string) *Redactor {
+	r := &Redactor{Mask: DefaultRedactMask, fields: map[string]bool{}}
+	for _, f := range fields {
+		r.fields[strings.ToLower(f)] = true
+	}
+	return r
+}
+
+// RedactJSON masks fields of JSON data
+func RedactJSON(data []byte, fields ...string) []byte {
+	return NewRedactor(fields...).Redact(data)
+}
+
+// LoggerWithPayload returns Logger middleware that also logs payloads redacted by r
+func LoggerWithPayload(r *Redactor) arpc.HandlerFunc {
+	return func(ctx *arpc.Context) {
+		clock := ctx.Client.Handler.Clock()
+		t := clock.Now()
+		payload := r.Redact(ctx.Body())
+
+		ctx.Next()
+
+		log.Info("'%v',\t%v,\t%v ms cost,\tpayload: %s", ctx.Message.Method(), ctx.Client.Conn.RemoteAddr(), clock.Now().Sub(t).Milliseconds(), payload)
+	}
+}
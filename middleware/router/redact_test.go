@@ -0,0 +1,111 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// captureLogger keeps lines logged
+type captureLogger struct {
+	mux   sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) SetLogLevel(lvl int) {}
+
+func (l *captureLogger) Debug(format string, v ...interface{}) { l.add(format, v...) }
+
+func (l *captureLogger) Info(format string, v ...interface{}) { l.add(format, v...) }
+
+func (l *captureLogger) Warn(format string, v ...interface{}) { l.add(format, v...) }
+
+func (l *captureLogger) Error(format string, v ...interface{}) { l.add(format, v...) }
+
+func (l *captureLogger) add(format string, v ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) text() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestRedactJSON(t *testing.T) {
+	cases := []struct {
+		data string
+		want string
+	}{
+		{`{"user":"bob","Password":"secret"}`, `{"Password":"******","user":"bob"}`},
+		{`{"card":{"number":"4111","CVV":123}}`, `{"card":{"CVV":"******","number":"4111"}}`},
+		{`[{"password":"a"},{"password":"b"}]`, `[{"password":"******"},{"password":"******"}]`},
+		{`{"amount":12.50}`, `{"amount":12.50}`},
+		{`password=secret`, `(15 bytes non-JSON payload)`},
+		{``, ``},
+	}
+	for _, tc := range cases {
+		if got := string(RedactJSON([]byte(tc.data), "password", "cvv")); got != tc.want {
+			t.Fatalf("RedactJSON(%s) = %s, want %s", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestRedactor_NeverLogged(t *testing.T) {
+	logger := &captureLogger{}
+	prev := log.DefaultLogger
+	log.SetLogger(logger)
+	// restored after the server and the client stopped, cleanups run in reverse order
+	t.Cleanup(func() { log.SetLogger(prev) })
+
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	r := NewRedactor("password", "cvv")
+	var mux sync.Mutex
+	var records []AuditRecord
+	a := NewAuditor(AuditSinkFunc(func(rec *AuditRecord) error {
+		mux.Lock()
+		defer mux.Unlock()
+		records = append(records, *rec)
+		return nil
+	}))
+	a.Summary = r.Summary
+	c := newTestClient(t, clock, func(h arpc.Handler) {
+		h.Handle("/pay", func(ctx *arpc.Context) {
+			clock.Advance(time.Second * 2)
+			ctx.Write(nil)
+		}, LoggerWithPayload(r), a.Handle)
+	})
+
+	req := []byte(`{"user":"bob","password":"hunter2","card":{"cvv":"987"}}`)
+	if err := c.Call("/pay", req, nil, time.Second); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if err := c.Call(barrierRoute, nil, nil, time.Second); err != nil {
+		t.Fatalf("Call() barrier error = %v", err)
+	}
+
+	logged := logger.text()
+	mux.Lock()
+	defer mux.Unlock()
+	if len(records) != 1 {
+		t.Fatalf("records = %+v, want 1", records)
+	}
+	for name, out := range map[string]string{"log": logged, "sink": records[0].Payload} {
+		if strings.Contains(out, "hunter2") || strings.Contains(out, "987") {
+			t.Fatalf("%v = %q, redacted fields leaked", name, out)
+		}
+		if !strings.Contains(out, `"user":"bob"`) || !strings.Contains(out, DefaultRedactMask) {
+			t.Fatalf("%v = %q, want payload with fields masked", name, out)
+		}
+	}
+	if !strings.Contains(logged, "2000 ms cost") {
+		t.Fatalf("log = %q, want cost of the handler clock", logged)
+	}
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"sync/atomic"
+
+	"github.com/lesismal/arpc"
+)
+
+// Shadow is the dry-run mode embedded by limiters and breakers, calls they would have rejected are
+// recorded and still handled when DryRun is set, so thresholds could be tuned before enforcement
+type Shadow struct {
+	// DryRun records calls that would have been rejected instead of rejecting them
+	DryRun bool
+	// OnShadowed is called with each call that would have been rejected and the error it would get
+	OnShadowed func(ctx *arpc.Context, err error)
+
+	shadowed uint64
+}
+
+// Shadowed returns number of calls that would have been rejected in dry-run mode
+func (s *Shadow) Shadowed() uint64 {
+	return atomic.LoadUint64(&s.shadowed)
+}
+
+// shadow records ctx that would have been rejected with err, returns false if not in dry-run mode
+func (s *Shadow) shadow(ctx *arpc.Context, err error) bool {
+	if !s.DryRun {
+		return false
+	}
+	atomic.AddUint64(&s.shadowed, 1)
+	if s.OnShadowed != nil {
+		s.OnShadowed(ctx, err)
+	}
+	return true
+}
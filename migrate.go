@@ -0,0 +1,226 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// migrateRoute is the internal route a client presents its connection id with after connected
+const migrateRoute = "_arpc.migrate"
+
+const (
+	migrateTimeout = time.Second * 5
+
+	migrateResumed = "resumed"
+)
+
+// migrations maps connection ids to the latest server side clients presenting them
+type migrations struct {
+	mux     sync.Mutex
+	timeout time.Duration
+	clients map[string]migrated
+}
+
+type migrated struct {
+	client *Client
+	// gen is the number of connections of the client
+	gen uint64
+}
+
+// attach sets c as the client of id, returns the previous client of id if any, ok is false if
+// c presents an earlier connection than the current one, e.g. it's handled late
+func (m *migrations) attach(id string, gen uint64, c *Client) (old *Client, ok bool) {
+	m.mux.Lock()
+	cur, exist := m.clients[id]
+	if exist && gen < cur.gen {
+		m.mux.Unlock()
+		return nil, false
+	}
+	m.clients[id] = migrated{client: c, gen: gen}
+	m.mux.Unlock()
+	old = cur.client
+
+	c.migrateMux.Lock()
+	c.migrateID = id
+	c.migrateSet = m
+	c.migrateMux.Unlock()
+
+	if old == c {
+		return nil, true
+	}
+	return old, true
+}
+
+func (m *migrations) remove(id string, c *Client) {
+	m.mux.Lock()
+	if m.clients[id].client == c {
+		delete(m.clients, id)
+	}
+	m.mux.Unlock()
+}
+
+func (h *handler) Migration() time.Duration {
+	if m := h.load().migration; m != nil {
+		return m.timeout
+	}
+	return 0
+}
+
+func (h *handler) SetMigration(timeout time.Duration) {
+	h.update(func(s *handlerState) {
+		if timeout <= 0 {
+			s.migration = nil
+			return
+		}
+		s.migration = &migrations{timeout: timeout, clients: map[string]migrated{}}
+	})
+}
+
+func (h *handler) HandleMigrated(onMigrated func(old *Client, new *Client)) {
+	h.update(func(s *handlerState) { s.onMigrated = onMigrated })
+}
+
+func (h *handler) OnMigrated(old *Client, new *Client) {
+	if s := h.load(); s.onMigrated != nil {
+		s.onMigrated(old, new)
+	}
+}
+
+// onMigrate attaches c to the connection id presented, and migrates the previous client of the id
+func (h *handler) onMigrate(c *Client, msg *Message) {
+	ctx := newContext(c, msg, nil)
+	m := h.load().migration
+	if m == nil {
+		ctx.Error(ErrMigrationDisabled)
+		return
+	}
+	id, gen, err := parseMigrateID(string(msg.Data()))
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	old, ok := m.attach(id, gen, c)
+	if !ok {
+		ctx.Error(ErrMigrationOutdated)
+		return
+	}
+	if old == nil {
+		ctx.Write("")
+		return
+	}
+	log.Info("%v\t%v\tMigrated from %v", h.LogTag(), c.Conn.RemoteAddr(), old.Conn.RemoteAddr())
+	h.OnMigrated(old, c)
+	old.migrateTo(c)
+	ctx.Write(migrateResumed)
+}
+
+// migrateTo redirects messages of c to nc, messages held since c disconnected are pushed first,
+// c is stopped if the server has not noticed its disconnection yet
+func (c *Client) migrateTo(nc *Client) {
+	c.migrateMux.Lock()
+	c.migratedTo = nc
+	detached := c.detached
+	c.detached = nil
+	if c.detachTimer != nil {
+		c.detachTimer.Stop()
+		c.detachTimer = nil
+	}
+	c.migrateMux.Unlock()
+
+	for _, msg := range detached {
+		if err := nc.PushMsg(msg, TimeZero); err != nil {
+			log.Warn("%v\t%v\tpush migrated message failed: %v", c.logTag(), nc.Conn.RemoteAddr(), err)
+		}
+	}
+	c.Stop()
+}
+
+// detach is called on stopped, c holds messages pushed for the migration timeout
+func (c *Client) detach() {
+	c.migrateMux.Lock()
+	defer c.migrateMux.Unlock()
+	m, id := c.migrateSet, c.migrateID
+	if m == nil || c.migratedTo != nil || c.detachTimer != nil {
+		return
+	}
+	c.detachTimer = c.Handler.Clock().AfterFunc(m.timeout, func() {
+		m.remove(id, c)
+		c.migrateMux.Lock()
+		c.detachTimer = nil
+		c.detached = nil
+		c.migrateMux.Unlock()
+	})
+}
+
+// pushDetached holds msg pushed to the stopped c during the migration timeout, or returns the client c
+// migrated to, ok is false if c is not detached or too many messages are held
+func (c *Client) pushDetached(msg *Message) (nc *Client, ok bool) {
+	c.migrateMux.Lock()
+	defer c.migrateMux.Unlock()
+	if c.migratedTo != nil {
+		return c.migratedTo, true
+	}
+	if c.detachTimer == nil || len(c.detached) >= cap(c.chSend) {
+		return nil, false
+	}
+	c.detached = append(c.detached, msg)
+	return nil, true
+}
+
+// MigrateID returns connection id presented by the client after connected, empty if migration is
+// disabled or not negotiated yet
+func (c *Client) MigrateID() string {
+	c.migrateMux.Lock()
+	defer c.migrateMux.Unlock()
+	return c.migrateID
+}
+
+// parseMigrateID parses "id:gen" presented by clients
+func parseMigrateID(s string) (string, uint64, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return "", 0, ErrInvalidMigrateID
+	}
+	gen, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidMigrateID
+	}
+	return s[:i], gen, nil
+}
+
+// migrate presents connection id of the client with number of connections, the id is generated on
+// the first connection
+func (c *Client) migrate() {
+	c.migrateMux.Lock()
+	if c.migrateID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			c.migrateMux.Unlock()
+			log.Warn("%v\t%v\tgenerate migration id failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+			return
+		}
+		c.migrateID = hex.EncodeToString(id)
+	}
+	c.migrateGen++
+	id := c.migrateID + ":" + strconv.FormatUint(c.migrateGen, 10)
+	c.migrateMux.Unlock()
+
+	rsp := ""
+	if err := c.Call(migrateRoute, id, &rsp, migrateTimeout); err != nil {
+		log.Warn("%v\t%v\tmigration failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+		return
+	}
+	if rsp == migrateResumed {
+		log.Info("%v\t%v\tMigrated", c.logTag(), c.Conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_Migration(t *testing.T) {
+	// clients enable migration before NewClient to present the id on the first connection
+	SetMigration(time.Second)
+	defer SetMigration(0)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetMigration(time.Second)
+	chMigrated := make(chan *Client, 1)
+	svr.Handler.HandleMigrated(func(old *Client, new *Client) {
+		new.Set("user", "alice")
+		chMigrated <- old
+	})
+	chHandling := make(chan *Client, 1)
+	svr.Handler.Handle("/migrate/slow", func(ctx *Context) {
+		chHandling <- ctx.Client
+		time.Sleep(time.Second / 5)
+		ctx.Write("done")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	// the conn breaks while the call is handled, the response is delivered over the new conn
+	chErr := make(chan error, 1)
+	var rsp string
+	go func() {
+		chErr <- c.Call("/migrate/slow", nil, &rsp, time.Second*3)
+	}()
+	old := <-chHandling
+	for i := 0; old.MigrateID() == "" && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.Conn.Close()
+
+	select {
+	case migrated := <-chMigrated:
+		if migrated != old {
+			t.Fatalf("migrated from %p, want %p", migrated, old)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("migration timeout")
+	}
+	if err = <-chErr; err != nil || rsp != "done" {
+		t.Fatalf("Client.Call() = %v, %v, want done", rsp, err)
+	}
+	if c.MigrateID() == "" || old.MigrateID() != c.MigrateID() {
+		t.Fatalf("MigrateID() = %v, server side %v", c.MigrateID(), old.MigrateID())
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package namedpipe
+
+import "errors"
+
+var (
+	// ErrUnsupported .
+	ErrUnsupported = errors.New("namedpipe: named pipes unsupported on this platform")
+
+	// ErrClosed .
+	ErrClosed = errors.New("namedpipe: use of closed pipe")
+
+	// ErrTimeout .
+	ErrTimeout = errors.New("namedpipe: timeout")
+)
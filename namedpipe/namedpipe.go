@@ -0,0 +1,86 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package namedpipe is a windows named pipe transport of arpc, for services of the same machine
+// that should not open a port, access of the pipe is controlled by its security descriptor, and
+// clients limit what the server may do with their identity by the impersonation level, e.g.
+//
+//	// only SYSTEM and administrators may connect
+//	ln, _ := namedpipe.Listen(`\\.\pipe\arpc`, &namedpipe.Config{
+//		SecurityDescriptor: "D:P(A;;GA;;;SY)(A;;GA;;;BA)",
+//	})
+//	server.Serve(ln)
+//	...
+//	client, _ := arpc.NewClient(namedpipe.Dialer(`\\.\pipe\arpc`, namedpipe.Identification, time.Second))
+//
+// ErrUnsupported is returned on other platforms.
+package namedpipe
+
+import (
+	"net"
+	"time"
+)
+
+// ImpersonationLevel is the level the server may impersonate the client, see SECURITY_IMPERSONATION_LEVEL
+// of windows
+type ImpersonationLevel uint32
+
+// Impersonation levels
+const (
+	// Anonymous doesn't let the server identify the client
+	Anonymous ImpersonationLevel = iota
+	// Identification lets the server identify the client, but not act as the client
+	Identification
+	// Impersonation lets the server act as the client on the local machine
+	Impersonation
+	// Delegation lets the server act as the client on remote machines too
+	Delegation
+)
+
+// Config is the config of pipes of Listen
+type Config struct {
+	// SecurityDescriptor is the SDDL of the security descriptor of the pipe, the default security
+	// descriptor of windows is used if empty, which allows everyone to read the pipe
+	SecurityDescriptor string
+	// RemoteClients allows clients of other machines, they are rejected by default
+	RemoteClients bool
+	// InputBufferSize and OutputBufferSize are the buffer sizes of the pipe, 64k by default
+	InputBufferSize  int
+	OutputBufferSize int
+}
+
+// Addr is the address of a pipe
+type Addr string
+
+// Network implements net.Addr
+func (a Addr) Network() string {
+	return "pipe"
+}
+
+// String implements net.Addr
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Listen creates the pipe of path and returns a net.Listener of clients connected, it fails if the
+// pipe already exists, so another process can't serve clients of the same pipe
+func Listen(path string, conf *Config) (net.Listener, error) {
+	if conf == nil {
+		conf = &Config{}
+	}
+	return listen(path, conf)
+}
+
+// Dial connects the pipe of path, it waits for an instance of the pipe if all are busy until
+// timeout, or forever if timeout is 0
+func Dial(path string, level ImpersonationLevel, timeout time.Duration) (net.Conn, error) {
+	return dial(path, level, timeout)
+}
+
+// Dialer returns a dialer of arpc.NewClient connecting the pipe of path, see Dial
+func Dialer(path string, level ImpersonationLevel, timeout time.Duration) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return dial(path, level, timeout)
+	}
+}
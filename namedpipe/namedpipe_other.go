@@ -0,0 +1,21 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package namedpipe
+
+import (
+	"net"
+	"time"
+)
+
+func listen(path string, conf *Config) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func dial(path string, level ImpersonationLevel, timeout time.Duration) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
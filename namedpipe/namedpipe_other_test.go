@@ -0,0 +1,22 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package namedpipe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnsupported(t *testing.T) {
+	if _, err := Listen(`\\.\pipe\arpc`, nil); err != ErrUnsupported {
+		t.Fatalf("Listen() error = %v, want %v", err, ErrUnsupported)
+	}
+	if _, err := Dialer(`\\.\pipe\arpc`, Identification, time.Second)(); err != ErrUnsupported {
+		t.Fatalf("Dial() error = %v, want %v", err, ErrUnsupported)
+	}
+}
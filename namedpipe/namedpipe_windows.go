@@ -0,0 +1,417 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package namedpipe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x00080000
+	fileFlagOverlapped        = 0x40000000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	securitySqosPresent       = 0x00100000
+	sddlRevision1             = 1
+	nmpwaitWaitForever        = 0xFFFFFFFF
+	defaultBufferSize         = 65536
+
+	errorSemTimeout       syscall.Errno = 121
+	errorPipeBusy         syscall.Errno = 231
+	errorNoData           syscall.Errno = 232
+	errorPipeNotConnected syscall.Errno = 233
+	errorPipeConnected    syscall.Errno = 535
+	errorOperationAborted syscall.Errno = 995
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateEventW        = modkernel32.NewProc("CreateEventW")
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procWaitNamedPipeW      = modkernel32.NewProc("WaitNamedPipeW")
+	procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+// securityAttributes converts sddl to security attributes, the descriptor should be freed by
+// syscall.LocalFree
+func securityAttributes(sddl string) (*syscall.SecurityAttributes, error) {
+	p, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(
+		uintptr(unsafe.Pointer(p)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return nil, fmt.Errorf("namedpipe: invalid security descriptor %q: %v", sddl, err)
+	}
+	sa := &syscall.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return sa, nil
+}
+
+// createEvent creates a manual reset event of overlapped operations
+func createEvent() (syscall.Handle, error) {
+	r, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return syscall.Handle(r), nil
+}
+
+// overlappedResult waits for the overlapped operation o on h done
+func overlappedResult(h syscall.Handle, o *syscall.Overlapped) (uint32, error) {
+	var n uint32
+	r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(o)), uintptr(unsafe.Pointer(&n)), 1)
+	if r == 0 {
+		return n, err
+	}
+	return n, nil
+}
+
+// file is an overlapped handle of a pipe, operations pending are cancelled by close
+type file struct {
+	h      syscall.Handle
+	closed int32
+	mux    sync.RWMutex
+}
+
+// do runs the overlapped operation op and waits for it done or cancelled by the deadline or close
+func (f *file) do(deadline time.Time, op func(h syscall.Handle, o *syscall.Overlapped) error) (int, error) {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	if atomic.LoadInt32(&f.closed) == 1 {
+		return 0, ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	event, err := createEvent()
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(event)
+	o := &syscall.Overlapped{HEvent: event}
+	if err = op(f.h, o); err != nil && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+	var timedOut int32
+	if err == syscall.ERROR_IO_PENDING {
+		// close may have cancelled operations before this one started
+		if atomic.LoadInt32(&f.closed) == 1 {
+			syscall.CancelIoEx(f.h, o)
+		} else if !deadline.IsZero() {
+			timer := time.AfterFunc(time.Until(deadline), func() {
+				atomic.StoreInt32(&timedOut, 1)
+				syscall.CancelIoEx(f.h, o)
+			})
+			defer timer.Stop()
+		}
+	}
+	n, err := overlappedResult(f.h, o)
+	if err == errorOperationAborted {
+		if atomic.LoadInt32(&f.closed) == 1 {
+			err = ErrClosed
+		} else if atomic.LoadInt32(&timedOut) == 1 {
+			err = os.ErrDeadlineExceeded
+		}
+	}
+	return int(n), err
+}
+
+// close cancels operations pending and closes the handle after they returned
+func (f *file) close() error {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return ErrClosed
+	}
+	syscall.CancelIoEx(f.h, nil)
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return syscall.CloseHandle(f.h)
+}
+
+// conn implements net.Conn of a pipe
+type conn struct {
+	*file
+	addr Addr
+
+	mux           sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(h syscall.Handle, path string) *conn {
+	return &conn{file: &file{h: h}, addr: Addr(path)}
+}
+
+// Read implements net.Conn
+func (c *conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mux.Lock()
+	deadline := c.readDeadline
+	c.mux.Unlock()
+	n, err := c.do(deadline, func(h syscall.Handle, o *syscall.Overlapped) error {
+		return syscall.ReadFile(h, b, nil, o)
+	})
+	if err == syscall.ERROR_BROKEN_PIPE || err == errorPipeNotConnected {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *conn) Write(b []byte) (int, error) {
+	c.mux.Lock()
+	deadline := c.writeDeadline
+	c.mux.Unlock()
+	written := 0
+	for written < len(b) {
+		data := b[written:]
+		n, err := c.do(deadline, func(h syscall.Handle, o *syscall.Overlapped) error {
+			return syscall.WriteFile(h, data, nil, o)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close implements net.Conn
+func (c *conn) Close() error {
+	return c.close()
+}
+
+// LocalAddr implements net.Conn
+func (c *conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr implements net.Conn
+func (c *conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements net.Conn, it applies to operations started after it's set
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// listener implements net.Listener of a pipe, each client is connected to a new instance of it
+type listener struct {
+	path string
+	conf Config
+	sa   *syscall.SecurityAttributes
+
+	acceptMux sync.Mutex
+	mux       sync.Mutex
+	next      *file
+	closed    bool
+}
+
+func listen(path string, conf *Config) (net.Listener, error) {
+	l := &listener{path: path, conf: *conf}
+	if conf.SecurityDescriptor != "" {
+		sa, err := securityAttributes(conf.SecurityDescriptor)
+		if err != nil {
+			return nil, err
+		}
+		l.sa = sa
+	}
+	f, err := l.create(true)
+	if err != nil {
+		l.free()
+		return nil, err
+	}
+	l.next = f
+	return l, nil
+}
+
+// create creates an instance of the pipe, the first fails if the pipe exists
+func (l *listener) create(first bool) (*file, error) {
+	name, err := syscall.UTF16PtrFromString(l.path)
+	if err != nil {
+		return nil, err
+	}
+	openMode := uint32(pipeAccessDuplex | fileFlagOverlapped)
+	if first {
+		openMode |= fileFlagFirstPipeInstance
+	}
+	var pipeMode uint32
+	if !l.conf.RemoteClients {
+		pipeMode |= pipeRejectRemoteClients
+	}
+	inSize, outSize := l.conf.InputBufferSize, l.conf.OutputBufferSize
+	if inSize <= 0 {
+		inSize = defaultBufferSize
+	}
+	if outSize <= 0 {
+		outSize = defaultBufferSize
+	}
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(openMode), uintptr(pipeMode),
+		pipeUnlimitedInstances, uintptr(outSize), uintptr(inSize), 0, uintptr(unsafe.Pointer(l.sa)))
+	if syscall.Handle(r) == syscall.InvalidHandle {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: Addr(l.path), Err: err}
+	}
+	return &file{h: syscall.Handle(r)}, nil
+}
+
+// Accept implements net.Listener
+func (l *listener) Accept() (net.Conn, error) {
+	l.acceptMux.Lock()
+	defer l.acceptMux.Unlock()
+	for {
+		l.mux.Lock()
+		if l.closed {
+			l.mux.Unlock()
+			return nil, ErrClosed
+		}
+		f := l.next
+		if f == nil {
+			var err error
+			if f, err = l.create(false); err != nil {
+				l.mux.Unlock()
+				return nil, err
+			}
+			l.next = f
+		}
+		l.mux.Unlock()
+
+		_, err := f.do(time.Time{}, func(h syscall.Handle, o *syscall.Overlapped) error {
+			r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(o)))
+			if r != 0 {
+				return nil
+			}
+			return err
+		})
+
+		l.mux.Lock()
+		if l.closed {
+			l.mux.Unlock()
+			return nil, ErrClosed
+		}
+		l.next = nil
+		connected := err == nil || err == errorPipeConnected
+		if connected {
+			// clients find the pipe busy rather than not found until the next Accept
+			if next, err := l.create(false); err == nil {
+				l.next = next
+			}
+		}
+		l.mux.Unlock()
+
+		switch {
+		case connected:
+			return &conn{file: f, addr: Addr(l.path)}, nil
+		case err == errorNoData:
+			// the client closed before accepted
+			f.close()
+		default:
+			f.close()
+			return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: Addr(l.path), Err: err}
+		}
+	}
+}
+
+// Close implements net.Listener, clients connected are not closed
+func (l *listener) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.closed = true
+	if l.next != nil {
+		l.next.close()
+	}
+	l.free()
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *listener) Addr() net.Addr {
+	return Addr(l.path)
+}
+
+func (l *listener) free() {
+	if l.sa != nil {
+		syscall.LocalFree(syscall.Handle(l.sa.SecurityDescriptor))
+		l.sa = nil
+	}
+}
+
+func dial(path string, level ImpersonationLevel, timeout time.Duration) (net.Conn, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING,
+			fileFlagOverlapped|securitySqosPresent|uint32(level)<<16, 0)
+		if err == nil {
+			return newConn(h, path), nil
+		}
+		if err != errorPipeBusy {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: Addr(path), Err: err}
+		}
+
+		// all instances are busy, wait for one
+		wait := uint32(nmpwaitWaitForever)
+		if timeout > 0 {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, ErrTimeout
+			}
+			wait = uint32((left + time.Millisecond - 1) / time.Millisecond)
+		}
+		if r, _, err := procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(wait)); r == 0 {
+			if err == errorSemTimeout {
+				return nil, ErrTimeout
+			}
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: Addr(path), Err: err}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package namedpipe
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func pipePath(t *testing.T) string {
+	return fmt.Sprintf(`\\.\pipe\arpc-test-%v-%v`, os.Getpid(), strings.ReplaceAll(t.Name(), "/", "-"))
+}
+
+func TestNamedPipe(t *testing.T) {
+	path := pipePath(t)
+	// the creator owner and SYSTEM only
+	ln, err := Listen(path, &Config{SecurityDescriptor: "D:P(A;;GA;;;OW)(A;;GA;;;SY)"})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		ctx.Write(s)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	if _, err := Listen(path, nil); err == nil {
+		t.Fatalf("Listen() of the pipe existing error = nil, want error")
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := arpc.NewClient(Dialer(path, Identification, time.Second))
+		if err != nil {
+			t.Fatalf("NewClient() failed: %v", err)
+		}
+		defer c.Stop()
+		rsp := ""
+		// larger than the pipe buffers
+		req := strings.Repeat("a", defaultBufferSize*2)
+		if err := c.Call("/echo", req, &rsp, time.Second); err != nil || rsp != req {
+			t.Fatalf("Client.Call() = (%v bytes, %v), want %v bytes", len(rsp), err, len(req))
+		}
+	}
+}
+
+func TestNamedPipeDeadline(t *testing.T) {
+	path := pipePath(t)
+	ln, err := Listen(path, nil)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	conn, err := Dial(path, Anonymous, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := conn.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != ErrClosed {
+		t.Fatalf("Read() of closed conn error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestInvalidSecurityDescriptor(t *testing.T) {
+	if _, err := Listen(pipePath(t), &Config{SecurityDescriptor: "invalid"}); err == nil {
+		t.Fatalf("Listen() of invalid security descriptor error = nil, want error")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "sort"
+
+// MetaKeyNamespace selects the tenant namespace of routes for requests and notifies, see
+// Handler.HandleNamespace
+const MetaKeyNamespace = "arpc-namespace"
+
+// WithNamespace sets MetaKeyNamespace of requests and notifies of the client to ns
+func WithNamespace(ns string) ClientOption {
+	return func(c *Client) {
+		c.namespace = ns
+	}
+}
+
+// Namespace returns namespace set by WithNamespace
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// Namespace returns namespace of the message from MetaKeyNamespace, resolved by the resolver set by
+// Handler.SetNamespaceResolver if any, "" for the default routes
+func (ctx *Context) Namespace() string {
+	ns, _ := ctx.Meta().Get(MetaKeyNamespace)
+	if resolve := ctx.Client.Handler.NamespaceResolver(); resolve != nil {
+		ns, _ = resolve(ctx.Client, ns)
+	}
+	return ns
+}
+
+func (h *handler) HandleNamespace(ns string, method string, cb HandlerFunc, args ...interface{}) {
+	if ns == "" {
+		h.registered("HandleNamespace", h.handle(method, cb, args...))
+		return
+	}
+	if len(method) > MaxMethodLen {
+		panic(checkMethod(method))
+	}
+	var err error
+	h.update(func(s *handlerState) {
+		routes := s.routes
+		s.routes = s.namespaces[ns]
+		err = s.handle(method, cb, args...)
+		namespaces := make(map[string]map[string]*RouterHandler, len(s.namespaces)+1)
+		for k, v := range s.namespaces {
+			namespaces[k] = v
+		}
+		namespaces[ns] = s.routes
+		s.namespaces = namespaces
+		s.routes = routes
+	})
+	h.registered("HandleNamespace", err)
+}
+
+func (h *handler) Namespaces() []string {
+	s := h.load()
+	names := make([]string, 0, len(s.namespaces))
+	for ns := range s.namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *handler) NamespaceResolver() func(c *Client, requested string) (string, bool) {
+	return h.load().resolveNamespace
+}
+
+func (h *handler) SetNamespaceResolver(resolve func(c *Client, requested string) (string, bool)) {
+	h.update(func(s *handlerState) { s.resolveNamespace = resolve })
+}
+
+// routesOf returns routes of the namespace selected by msg and resolved for c, requests to
+// namespaces not registered or rejected by the resolver are responded ErrMethodNotFound
+func (s *handlerState) routesOf(c *Client, msg *Message) map[string]*RouterHandler {
+	if s.resolveNamespace == nil && (len(s.namespaces) == 0 || !msg.HasMeta()) {
+		return s.routes
+	}
+	var ns string
+	if msg.HasMeta() {
+		ns, _ = msg.Meta().Get(MetaKeyNamespace)
+	}
+	if s.resolveNamespace != nil {
+		var ok bool
+		if ns, ok = s.resolveNamespace(c, ns); !ok {
+			return nil
+		}
+	}
+	if ns == "" {
+		return s.routes
+	}
+	return s.namespaces[ns]
+}
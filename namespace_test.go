@@ -0,0 +1,128 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandler_HandleNamespace(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/who", func(ctx *Context) {
+		ctx.Write("default")
+	})
+	for _, ns := range []string{"a", "b"} {
+		ns := ns
+		svr.Handler.HandleNamespace(ns, "/who", func(ctx *Context) {
+			ctx.Write(ns + ":" + ctx.Namespace())
+		})
+	}
+	svr.Handler.HandleNamespace("b", "/only/b", func(ctx *Context) {
+		ctx.Write("b")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	if names := svr.Handler.Namespaces(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("Handler.Namespaces() = %v, want [a b]", names)
+	}
+
+	dial := func(opts ...ClientOption) *Client {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+		}, opts...)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		return c
+	}
+	for _, v := range []struct {
+		ns     string
+		method string
+		rsp    string
+		err    error
+	}{
+		{"", "/who", "default", nil},
+		{"a", "/who", "a:a", nil},
+		{"b", "/who", "b:b", nil},
+		{"b", "/only/b", "b", nil},
+		{"", "/only/b", "", ErrMethodNotFound},
+		{"a", "/only/b", "", ErrMethodNotFound},
+		{"c", "/who", "", ErrMethodNotFound},
+	} {
+		c := dial(WithNamespace(v.ns))
+		rsp := ""
+		err := c.Call(v.method, nil, &rsp, time.Second)
+		c.Stop()
+		if v.err != nil {
+			if err == nil || err.Error() != v.err.Error() {
+				t.Fatalf("Client.Call(%v) in namespace %q = %v, want %v", v.method, v.ns, err, v.err)
+			}
+			continue
+		}
+		if err != nil || rsp != v.rsp {
+			t.Fatalf("Client.Call(%v) in namespace %q = (%v, %v), want %v", v.method, v.ns, rsp, err, v.rsp)
+		}
+	}
+}
+
+func TestHandler_SetNamespaceResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/who", func(ctx *Context) {
+		ctx.Write("default")
+	})
+	for _, ns := range []string{"a", "b"} {
+		ns := ns
+		svr.Handler.HandleNamespace(ns, "/who", func(ctx *Context) {
+			ctx.Write(ns + ":" + ctx.Namespace())
+		})
+	}
+	// clients are bound to namespace "a", requests for other namespaces are rejected
+	svr.Handler.SetNamespaceResolver(func(c *Client, requested string) (string, bool) {
+		return "a", requested == "" || requested == "a"
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	for _, v := range []struct {
+		ns  string
+		rsp string
+		err error
+	}{
+		{"", "a:a", nil},
+		{"a", "a:a", nil},
+		{"b", "", ErrMethodNotFound},
+	} {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+		}, WithNamespace(v.ns))
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		rsp := ""
+		err = c.Call("/who", nil, &rsp, time.Second)
+		c.Stop()
+		if v.err != nil {
+			if err == nil || err.Error() != v.err.Error() {
+				t.Fatalf("Client.Call() in namespace %q = %v, want %v", v.ns, err, v.err)
+			}
+			continue
+		}
+		if err != nil || rsp != v.rsp {
+			t.Fatalf("Client.Call() in namespace %q = (%v, %v), want %v", v.ns, rsp, err, v.rsp)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// DefaultPageLimit is the limit of pages if the client doesn't set
+	DefaultPageLimit = 100
+
+	// DefaultPageTimeout is the timeout of each page called by iterators of Client.Iterate
+	DefaultPageTimeout = time.Second * 10
+)
+
+// PageRequest defines a page asked by the client, the first page has an empty Cursor
+type PageRequest struct {
+	Cursor string
+	Limit  int
+
+	query []byte
+	codec codec.Codec
+}
+
+// Bind decodes the query of the client into v
+func (p *PageRequest) Bind(v interface{}) error {
+	switch vt := v.(type) {
+	case *[]byte:
+		*vt = p.query
+	case *string:
+		*vt = string(p.query)
+	default:
+		if len(p.query) == 0 {
+			return nil
+		}
+		return p.codec.Unmarshal(p.query, v)
+	}
+	return nil
+}
+
+// PageHandler returns items of the page after p.Cursor, at most p.Limit items, and the cursor
+// of the next page, which is empty for the last page
+type PageHandler func(ctx *Context, p *PageRequest) (items interface{}, next string, err error)
+
+// Paged returns handler serving a large result set by pages, a page is asked by each call of
+// the client, so results are not held or sent at once. See Client.Pages and Client.CallPages
+func Paged(h PageHandler) HandlerFunc {
+	return func(ctx *Context) {
+		var data []byte
+		if err := ctx.Bind(&data); err != nil {
+			ctx.Error(err)
+			return
+		}
+		p, err := decodePageRequest(data)
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		p.codec = ctx.Client.Codec
+		items, next, err := h(ctx, p)
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(encodePage(next, util.ValueToBytes(ctx.Client.Codec, items)))
+	}
+}
+
+// page request: limit(4) + cursor length(2) + cursor + query
+func encodePageRequest(cursor string, limit int, query []byte) []byte {
+	buf := make([]byte, 6+len(cursor)+len(query))
+	binary.LittleEndian.PutUint32(buf, uint32(limit))
+	binary.LittleEndian.PutUint16(buf[4:], uint16(len(cursor)))
+	copy(buf[6:], cursor)
+	copy(buf[6+len(cursor):], query)
+	return buf
+}
+
+func decodePageRequest(buf []byte) (*PageRequest, error) {
+	if len(buf) < 6 {
+		return nil, ErrInvalidPage
+	}
+	cl := int(binary.LittleEndian.Uint16(buf[4:]))
+	if len(buf) < 6+cl {
+		return nil, ErrInvalidPage
+	}
+	p := &PageRequest{
+		Limit:  int(binary.LittleEndian.Uint32(buf)),
+		Cursor: string(buf[6 : 6+cl]),
+		query:  buf[6+cl:],
+	}
+	if p.Limit <= 0 {
+		p.Limit = DefaultPageLimit
+	}
+	return p, nil
+}
+
+// page: next cursor length(2) + next cursor + items
+func encodePage(next string, items []byte) []byte {
+	buf := make([]byte, 2+len(next)+len(items))
+	binary.LittleEndian.PutUint16(buf, uint16(len(next)))
+	copy(buf[2:], next)
+	copy(buf[2+len(next):], items)
+	return buf
+}
+
+func decodePage(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, ErrInvalidPage
+	}
+	nl := int(binary.LittleEndian.Uint16(buf))
+	if len(buf) < 2+nl {
+		return "", nil, ErrInvalidPage
+	}
+	return string(buf[2 : 2+nl]), buf[2+nl:], nil
+}
+
+// PageIterator iterates pages of a Paged handler lazily, a page is called on each Next
+type PageIterator struct {
+	c       *Client
+	ctx     context.Context
+	method  string
+	query   []byte
+	limit   int
+	timeout time.Duration
+	cursor  string
+	done    bool
+	err     error
+}
+
+// Pages returns PageIterator of method with query, limit is the max items of each page,
+// DefaultPageLimit if not positive
+func (c *Client) Pages(ctx context.Context, method string, query interface{}, limit int) *PageIterator {
+	return &PageIterator{
+		c:      c,
+		ctx:    ctx,
+		method: method,
+		query:  util.ValueToBytes(c.Codec, query),
+		limit:  limit,
+	}
+}
+
+// Iterate returns PageIterator of method with req as the query, each page is called with
+// DefaultPageTimeout and DefaultPageLimit, see SetTimeout and SetLimit
+func (c *Client) Iterate(method string, req interface{}) *PageIterator {
+	it := c.Pages(context.Background(), method, req, DefaultPageLimit)
+	it.timeout = DefaultPageTimeout
+	return it
+}
+
+// SetLimit sets max number of items of the following pages
+func (it *PageIterator) SetLimit(limit int) {
+	it.limit = limit
+}
+
+// SetTimeout sets timeout of each following page, 0 means only the context of Pages limits them
+func (it *PageIterator) SetTimeout(timeout time.Duration) {
+	it.timeout = timeout
+}
+
+// Next calls the next page and decodes its items into items, e.g. *[]User, it returns false
+// after the last page or on error
+func (it *PageIterator) Next(items interface{}) bool {
+	if it.done || it.err != nil {
+		return false
+	}
+	ctx := it.ctx
+	if it.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, it.timeout)
+		defer cancel()
+	}
+	var data []byte
+	err := it.c.CallWith(ctx, it.method, encodePageRequest(it.cursor, it.limit, it.query), &data)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	next, raw, err := decodePage(data)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if len(raw) > 0 {
+		if err = it.c.Codec.Unmarshal(raw, items); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	it.cursor = next
+	it.done = next == ""
+	return true
+}
+
+// Err returns the error stopped iterating
+func (it *PageIterator) Err() error {
+	return it.err
+}
+
+// Cursor returns cursor of the next page, it could be used to resume by SetCursor
+func (it *PageIterator) Cursor() string {
+	return it.cursor
+}
+
+// SetCursor sets cursor of the next page
+func (it *PageIterator) SetCursor(cursor string) {
+	it.cursor = cursor
+	it.done = false
+}
+
+// CallPages calls all pages of method and appends items of each page to the slice pointed by rsp
+func (c *Client) CallPages(ctx context.Context, method string, query interface{}, limit int, rsp interface{}) error {
+	rv := reflect.ValueOf(rsp)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return ErrInvalidPage
+	}
+	all := rv.Elem()
+	it := c.Pages(ctx, method, query, limit)
+	for {
+		page := reflect.New(all.Type())
+		if !it.Next(page.Interface()) {
+			break
+		}
+		all = reflect.AppendSlice(all, page.Elem())
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	rv.Elem().Set(all)
+	return nil
+}
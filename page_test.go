@@ -0,0 +1,94 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestClient_Pages(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/page/numbers", Paged(func(ctx *Context, p *PageRequest) (interface{}, string, error) {
+		var max int
+		if err := p.Bind(&max); err != nil {
+			return nil, "", err
+		}
+		begin := 0
+		if p.Cursor != "" {
+			begin, _ = strconv.Atoi(p.Cursor)
+		}
+		end := begin + p.Limit
+		if end >= max {
+			end = max
+		}
+		items := []int{}
+		for i := begin; i < end; i++ {
+			items = append(items, i)
+		}
+		next := ""
+		if end < max {
+			next = strconv.Itoa(end)
+		}
+		return items, next, nil
+	}))
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	it := c.Pages(context.Background(), "/page/numbers", 10, 4)
+	var sizes []int
+	for {
+		var items []int
+		if !it.Next(&items) {
+			break
+		}
+		sizes = append(sizes, len(items))
+	}
+	if it.Err() != nil {
+		t.Fatalf("PageIterator.Err() = %v", it.Err())
+	}
+	if len(sizes) != 3 || sizes[0] != 4 || sizes[1] != 4 || sizes[2] != 2 {
+		t.Fatalf("page sizes = %v, want [4 4 2]", sizes)
+	}
+
+	// resume from the cursor of an interrupted iteration
+	it = c.Iterate("/page/numbers", 10)
+	it.SetLimit(6)
+	var first []int
+	if !it.Next(&first) || len(first) != 6 {
+		t.Fatalf("PageIterator.Next() = %v, %v, want 6 items", first, it.Err())
+	}
+	resumed := c.Iterate("/page/numbers", 10)
+	resumed.SetCursor(it.Cursor())
+	var rest []int
+	if !resumed.Next(&rest) || len(rest) != 4 || rest[0] != 6 {
+		t.Fatalf("resumed PageIterator.Next() = %v, %v, want 6..9", rest, resumed.Err())
+	}
+	if resumed.Next(&rest) {
+		t.Fatalf("PageIterator.Next() after the last page = true")
+	}
+
+	var all []int
+	if err = c.CallPages(context.Background(), "/page/numbers", 10, 3, &all); err != nil {
+		t.Fatalf("Client.CallPages() error = %v", err)
+	}
+	if len(all) != 10 || all[9] != 9 {
+		t.Fatalf("Client.CallPages() = %v, want 0..9", all)
+	}
+}
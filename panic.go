@@ -0,0 +1,89 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// panicErrorPrefix prefixes messages of PanicError, callers parse the id back by it
+const panicErrorPrefix = "internal error, id: "
+
+// PanicError is the error response of requests whose handlers panicked, ID correlates the
+// response with the stack logged by the server, it's the request id if request ids enabled
+type PanicError struct {
+	ID string
+}
+
+// Error implements error
+func (e *PanicError) Error() string {
+	return panicErrorPrefix + e.ID
+}
+
+// PanicID returns the correlation id of err responded by a panicked handler, err decoded by
+// error codecs or carried by Envelope are parsed by the message
+func PanicID(err error) (string, bool) {
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		return pe.ID, true
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), panicErrorPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(err.Error(), panicErrorPrefix), true
+}
+
+func (h *handler) PanicResponse() bool {
+	return h.load().panicResponse
+}
+
+func (h *handler) SetPanicResponse(enable bool) {
+	h.update(func(s *handlerState) { s.panicResponse = enable })
+}
+
+// runRoute runs handlers of ctx, panics are recovered and responded if panic response enabled
+func (h *handler) runRoute(ctx *Context, s *handlerState) {
+	defer ctx.release()
+	if s.tracer != nil {
+		ctx.startSpan()
+		defer ctx.finishSpan(s.tracer)
+	}
+	if s.panicResponse {
+		defer ctx.recoverPanic(s.flight != nil)
+	}
+	ctx.Next()
+}
+
+// recoverPanic logs the stack with a correlation id, and responds the id if not responded yet
+func (ctx *Context) recoverPanic(flight bool) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	c := ctx.Client
+	id := NewRequestID()
+	if c.Handler.RequestIDs() {
+		id = ctx.RequestID()
+	}
+	log.Error("%v\t%v\truntime error in [%v], id: %v: %v\ntraceback:\n%v", c.logTag(), c.Conn.RemoteAddr(), ctx.Message.method(), id, err, string(debug.Stack()))
+	if flight {
+		c.recordEvent(FlightPanic, fmt.Sprintf("%v", err))
+		c.dumpFlightRecord(FlightPanic)
+	}
+	if ctx.Message.Cmd() != CmdRequest || ctx.written {
+		return
+	}
+	pe := &PanicError{ID: id}
+	if ctx.isEnvelope() {
+		ctx.Error(&StatusError{Code: StatusCodeInternal, Message: pe.Error()})
+		return
+	}
+	ctx.Error(pe)
+}
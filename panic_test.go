@@ -0,0 +1,64 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPanicResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetPanicResponse(true)
+	svr.Handler.Handle("/panic", func(ctx *Context) {
+		panic("boom")
+	})
+	svr.Handler.Handle("/panic/async", func(ctx *Context) {
+		panic("boom")
+	}, true)
+	svr.Handler.Handle("/panic/envelope", func(ctx *Context) {
+		panic("boom")
+	}, WithEnvelope())
+	svr.Handler.Handle("/panic/written", func(ctx *Context) {
+		ctx.Write("ok")
+		panic("boom")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	for _, method := range []string{"/panic", "/panic/async"} {
+		err = c.Call(method, "", nil, time.Second)
+		if id, ok := PanicID(err); !ok || len(id) != 16 {
+			t.Fatalf("Client.Call(%v) error = %v, want panic error with id", method, err)
+		}
+	}
+	err = c.Call("/panic/envelope", "", nil, time.Second)
+	if se, ok := err.(*StatusError); !ok || se.Code != StatusCodeInternal {
+		t.Fatalf("Client.Call() error = %v, want status %v", err, StatusCodeInternal)
+	}
+	if _, ok := PanicID(err); !ok {
+		t.Fatalf("PanicID(%v) not found", err)
+	}
+	rsp := ""
+	if err = c.Call("/panic/written", "", &rsp, time.Second); err != nil || rsp != "ok" {
+		t.Fatalf("Client.Call() = (%v, %v), want the response written before panicked", rsp, err)
+	}
+	if _, ok := PanicID(ErrClientTimeout); ok {
+		t.Fatalf("PanicID(%v) found", ErrClientTimeout)
+	}
+}
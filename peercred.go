@@ -0,0 +1,23 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+// PeerCred defines identity of the peer process of a unix socket
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerCred returns identity of the peer process, it's read by SO_PEERCRED from unix socket conns
+// on linux, ErrPeerCredUnsupported is returned for other conns and platforms
+func (c *Client) PeerCred() (PeerCred, error) {
+	return peerCred(c.Conn)
+}
+
+// PeerCred returns identity of the peer process of the client, see Client.PeerCred
+func (ctx *Context) PeerCred() (PeerCred, error) {
+	return ctx.Client.PeerCred()
+}
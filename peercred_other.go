@@ -0,0 +1,14 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package arpc
+
+import "net"
+
+func peerCred(conn net.Conn) (PeerCred, error) {
+	return PeerCred{}, ErrPeerCredUnsupported
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClient_PeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only supported on linux")
+	}
+	dir, err := ioutil.TempDir("", "arpc")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "arpc.sock")
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/peercred", func(ctx *Context) {
+		cred, err := ctx.PeerCred()
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(&cred)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("unix", addr)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	var cred PeerCred
+	if err = c.Call("/peercred", nil, &cred, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if int(cred.PID) != os.Getpid() || int(cred.UID) != os.Getuid() || int(cred.GID) != os.Getgid() {
+		t.Fatalf("PeerCred() = %+v, want pid %v uid %v gid %v", cred, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+
+	if _, err = (&Client{Conn: &net.TCPConn{}}).PeerCred(); err != ErrPeerCredUnsupported {
+		t.Fatalf("PeerCred() of tcp conn error = %v, want %v", err, ErrPeerCredUnsupported)
+	}
+}
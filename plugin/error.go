@@ -0,0 +1,18 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import "errors"
+
+var (
+	// ErrDuplicatePlugin .
+	ErrDuplicatePlugin = errors.New("plugin already registered")
+
+	// ErrInvalidPlugin .
+	ErrInvalidPlugin = errors.New("invalid plugin, should export Plugin as a plugin.Plugin or func() plugin.Plugin")
+
+	// ErrLoadUnsupported .
+	ErrLoadUnsupported = errors.New("loading plugins unsupported on this platform, see package plugin of the standard library")
+)
@@ -0,0 +1,35 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build (linux || darwin || freebsd) && cgo
+// +build linux darwin freebsd
+// +build cgo
+
+package plugin
+
+import (
+	"fmt"
+	goplugin "plugin"
+)
+
+// open opens the Go plugin of path and returns its exported Plugin
+func open(path string) (Plugin, error) {
+	p, err := goplugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(Symbol)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPlugin, err)
+	}
+	switch v := sym.(type) {
+	case *Plugin:
+		return *v, nil
+	case func() Plugin:
+		return v(), nil
+	case Plugin:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%w: %v is %T", ErrInvalidPlugin, Symbol, sym)
+}
@@ -0,0 +1,12 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !((linux || darwin || freebsd) && cgo)
+// +build !linux,!darwin,!freebsd !cgo
+
+package plugin
+
+func open(path string) (Plugin, error) {
+	return nil, ErrLoadUnsupported
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package plugin packages cross-cutting features, e.g. auth, tracing or audit, as plugins hooked
+// into handlers, servers and clients, which could be registered statically or loaded from Go
+// plugin .so files.
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// Symbol is the symbol a Go plugin .so exports, a variable of Plugin or a func() Plugin
+const Symbol = "Plugin"
+
+// Plugin is a feature packaged, it implements some of HandlerPlugin, ServerPlugin, ClientPlugin
+// and io.Closer to hook into their lifecycles
+type Plugin interface {
+	Name() string
+}
+
+// HandlerPlugin initializes handlers, e.g. registers coders, middlewares or callbacks
+type HandlerPlugin interface {
+	InitHandler(h arpc.Handler) error
+}
+
+// ServerPlugin initializes servers before serving, after handlers of them initialized
+type ServerPlugin interface {
+	InitServer(s *arpc.Server) error
+}
+
+// ClientPlugin initializes clients, after handlers of them initialized
+type ClientPlugin interface {
+	InitClient(c *arpc.Client) error
+}
+
+// Registry holds plugins, they're called in order of registering
+type Registry struct {
+	mux     sync.Mutex
+	plugins []Plugin
+	names   map[string]bool
+}
+
+// NewRegistry returns Registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// Register registers plugins
+func (r *Registry) Register(plugins ...Plugin) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, p := range plugins {
+		name := p.Name()
+		if r.names[name] {
+			return fmt.Errorf("%w: %v", ErrDuplicatePlugin, name)
+		}
+		r.names[name] = true
+		r.plugins = append(r.plugins, p)
+		log.Info("[Plugin] %v registered", name)
+	}
+	return nil
+}
+
+// Load loads Go plugin .so files and registers plugins they export, see Symbol
+func (r *Registry) Load(paths ...string) error {
+	for _, path := range paths {
+		p, err := open(path)
+		if err != nil {
+			return fmt.Errorf("load plugin %v: %w", path, err)
+		}
+		if err = r.Register(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns plugin of name
+func (r *Registry) Get(name string) (Plugin, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, p := range r.plugins {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Plugins returns plugins registered
+func (r *Registry) Plugins() []Plugin {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]Plugin(nil), r.plugins...)
+}
+
+// InitHandler initializes h by HandlerPlugins
+func (r *Registry) InitHandler(h arpc.Handler) error {
+	for _, p := range r.Plugins() {
+		if hp, ok := p.(HandlerPlugin); ok {
+			if err := hp.InitHandler(h); err != nil {
+				return fmt.Errorf("plugin %v: %w", p.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// InitServer initializes handler of s by HandlerPlugins then s by ServerPlugins, it should be
+// called before serving
+func (r *Registry) InitServer(s *arpc.Server) error {
+	if err := r.InitHandler(s.Handler); err != nil {
+		return err
+	}
+	for _, p := range r.Plugins() {
+		if sp, ok := p.(ServerPlugin); ok {
+			if err := sp.InitServer(s); err != nil {
+				return fmt.Errorf("plugin %v: %w", p.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// InitClient initializes c by ClientPlugins. Handlers of clients are shared usually, e.g. by a
+// ClientPool, so they should be initialized by InitHandler once instead of each client
+func (r *Registry) InitClient(c *arpc.Client) error {
+	for _, p := range r.Plugins() {
+		if cp, ok := p.(ClientPlugin); ok {
+			if err := cp.InitClient(c); err != nil {
+				return fmt.Errorf("plugin %v: %w", p.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes plugins implementing io.Closer in reverse order of registering, the first error
+// is returned
+func (r *Registry) Close() error {
+	plugins := r.Plugins()
+	var first error
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if c, ok := plugins[i].(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = fmt.Errorf("plugin %v: %w", plugins[i].Name(), err)
+			}
+		}
+	}
+	return first
+}
+
+// DefaultRegistry is the registry of package level functions
+var DefaultRegistry = NewRegistry()
+
+// Register registers plugins to DefaultRegistry, e.g. in init of packages of plugins
+func Register(plugins ...Plugin) error {
+	return DefaultRegistry.Register(plugins...)
+}
+
+// Load loads Go plugin .so files to DefaultRegistry
+func Load(paths ...string) error {
+	return DefaultRegistry.Load(paths...)
+}
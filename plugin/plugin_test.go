@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+type testPlugin struct {
+	name    string
+	events  *[]string
+	servers int
+}
+
+func (p *testPlugin) Name() string {
+	return p.name
+}
+
+func (p *testPlugin) InitHandler(h arpc.Handler) error {
+	*p.events = append(*p.events, "handler "+p.name)
+	h.Handle("/plugin/"+p.name, func(ctx *arpc.Context) { ctx.Write(p.name) })
+	return nil
+}
+
+func (p *testPlugin) InitServer(s *arpc.Server) error {
+	*p.events = append(*p.events, "server "+p.name)
+	p.servers++
+	return nil
+}
+
+func (p *testPlugin) Close() error {
+	*p.events = append(*p.events, "close "+p.name)
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	var events []string
+	r := NewRegistry()
+	if err := r.Register(&testPlugin{name: "a", events: &events}, &testPlugin{name: "b", events: &events}); err != nil {
+		t.Fatalf("Registry.Register() error = %v", err)
+	}
+	if err := r.Register(&testPlugin{name: "a", events: &events}); !errors.Is(err, ErrDuplicatePlugin) {
+		t.Fatalf("Registry.Register() error = %v, want %v", err, ErrDuplicatePlugin)
+	}
+	if _, ok := r.Get("b"); !ok {
+		t.Fatalf("Registry.Get() not found")
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	if err := r.InitServer(svr); err != nil {
+		t.Fatalf("Registry.InitServer() error = %v", err)
+	}
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	rsp := ""
+	if err := c.Call("/plugin/b", "", &rsp, time.Second); err != nil || rsp != "b" {
+		t.Fatalf("Client.Call() = %v, %v", rsp, err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Registry.Close() error = %v", err)
+	}
+	want := []string{"handler a", "handler b", "server a", "server b", "close b", "close a"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+	}
+
+	if err := r.Load("not_exist.so"); err == nil {
+		t.Fatalf("Registry.Load() error = nil for a missing file")
+	}
+}
@@ -48,6 +48,16 @@ const (
 	HeaderFlagMaskError byte = 0x01
 	// HeaderFlagMaskAsync .
 	HeaderFlagMaskAsync byte = 0x02
+	// HeaderFlagMaskEnvelope .
+	HeaderFlagMaskEnvelope byte = 0x04
+	// HeaderFlagMaskMeta .
+	HeaderFlagMaskMeta byte = 0x08
+	// HeaderFlagMaskApp masks flags reserved for applications, see Message.AppFlags
+	HeaderFlagMaskApp byte = 0xF0
+	// HeaderCmdMask masks cmd of the cmd byte
+	HeaderCmdMask byte = 0x0F
+	// HeaderContentTypeMask masks content type of the cmd byte, see Message.ContentType
+	HeaderContentTypeMask byte = 0xF0
 )
 
 const (
@@ -73,10 +83,10 @@ func (h Header) BodyLen() int {
 func (h Header) message(handler Handler) (*Message, error) {
 	bodyLen := h.BodyLen()
 	if bodyLen < 0 || bodyLen > MaxBodyLen {
-		return nil, fmt.Errorf("invalid body length: %v", bodyLen)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBodyLen, bodyLen)
 	}
 
-	m := &Message{Buffer: handler.GetBuffer(HeadLen + bodyLen)}
+	m := recvMessage(handler, HeadLen+bodyLen)
 	binary.LittleEndian.PutUint32(m.Buffer[HeaderIndexBodyLenBegin:HeaderIndexBodyLenEnd], uint32(bodyLen))
 	return m, nil
 }
@@ -85,6 +95,15 @@ func (h Header) message(handler Handler) (*Message, error) {
 type Message struct {
 	Buffer []byte
 	Values map[string]interface{}
+
+	// alloc and allocBuf are the allocator and buffer of a message received, see Allocator
+	alloc    Allocator
+	allocBuf []byte
+	// retained is set if the message is not freed after dispatched
+	retained bool
+	// pooled and sent are of messages sent by NotifyBytes and CallContext, see Message.written
+	pooled bool
+	sent   chan util.Empty
 }
 
 // Len returns total length of buffer
@@ -94,12 +113,12 @@ func (m *Message) Len() int {
 
 // Cmd returns cmd
 func (m *Message) Cmd() byte {
-	return m.Buffer[HeaderIndexCmd]
+	return m.Buffer[HeaderIndexCmd] & HeaderCmdMask
 }
 
-// SetCmd sets cmd
+// SetCmd sets cmd, content type of the message is kept
 func (m *Message) SetCmd(cmd byte) {
-	m.Buffer[HeaderIndexCmd] = cmd
+	m.Buffer[HeaderIndexCmd] = m.Buffer[HeaderIndexCmd]&HeaderContentTypeMask | cmd&HeaderCmdMask
 }
 
 // IsError returns error flag
@@ -121,7 +140,7 @@ func (m *Message) Error() error {
 	if !m.IsError() {
 		return nil
 	}
-	return errors.New(util.BytesToStr(m.Buffer[HeadLen+m.MethodLen():]))
+	return errors.New(util.BytesToStr(m.Data()))
 }
 
 // IsAsync returns async flag
@@ -138,7 +157,22 @@ func (m *Message) SetAsync(isAsync bool) {
 	}
 }
 
-// SetFlagBit sets flag bit with value by index
+// IsEnvelope returns envelope flag
+func (m *Message) IsEnvelope() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskEnvelope > 0
+}
+
+// SetEnvelope sets envelope flag
+func (m *Message) SetEnvelope(isEnvelope bool) {
+	if isEnvelope {
+		m.Buffer[HeaderIndexFlag] |= HeaderFlagMaskEnvelope
+	} else {
+		m.Buffer[HeaderIndexFlag] &= ^HeaderFlagMaskEnvelope
+	}
+}
+
+// SetFlagBit sets flag bit with value by index, the bits are of the reserved byte and are used by
+// coders, see Message.AppFlags for flags of applications
 func (m *Message) SetFlagBit(index int, value bool) error {
 	switch index {
 	case 0, 1, 2, 3, 4, 5, 6, 7:
@@ -213,10 +247,72 @@ func (m *Message) SetSeq(seq uint64) {
 	binary.LittleEndian.PutUint64(m.Buffer[HeaderIndexSeqBegin:HeaderIndexSeqEnd], seq)
 }
 
-// Data returns data after method
+// Data returns data after method and metadata
 func (m *Message) Data() []byte {
-	length := HeadLen + m.MethodLen()
-	return m.Buffer[length:]
+	return m.Buffer[m.dataOffset():]
+}
+
+// HasMeta returns metadata flag
+func (m *Message) HasMeta() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskMeta > 0
+}
+
+// Meta returns metadata carried by message
+func (m *Message) Meta() Metadata {
+	if !m.HasMeta() {
+		return nil
+	}
+	begin := HeadLen + m.MethodLen() + 2
+	end := m.dataOffset()
+	if begin > end {
+		return nil
+	}
+	return metadataFromBytes(m.Buffer[begin:end])
+}
+
+// SetMeta replaces metadata carried by message, it returns ErrMetaTooLarge without changing the
+// message if metadata encoded is more than MaxMetaLen
+func (m *Message) SetMeta(md Metadata) error {
+	var meta []byte
+	if len(md) > 0 {
+		var err error
+		if meta, err = md.toBytes(); err != nil {
+			return err
+		}
+	}
+	method := m.Buffer[HeadLen : HeadLen+m.MethodLen()]
+	data := m.Data()
+	offset := HeadLen + len(method)
+	total := offset + len(data)
+	if len(meta) > 0 {
+		total += 2 + len(meta)
+	}
+
+	buf := make([]byte, total)
+	copy(buf, m.Buffer[:offset])
+	if len(meta) > 0 {
+		buf[HeaderIndexFlag] |= HeaderFlagMaskMeta
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(len(meta)))
+		copy(buf[offset+2:], meta)
+		offset += 2 + len(meta)
+	} else {
+		buf[HeaderIndexFlag] &= ^HeaderFlagMaskMeta
+	}
+	copy(buf[offset:], data)
+	m.Buffer = buf
+	m.SetBodyLen(total - HeadLen)
+	return nil
+}
+
+func (m *Message) dataOffset() int {
+	offset := HeadLen + m.MethodLen()
+	if m.HasMeta() && len(m.Buffer) >= offset+2 {
+		offset += 2 + int(binary.LittleEndian.Uint16(m.Buffer[offset:]))
+	}
+	if offset > len(m.Buffer) {
+		offset = len(m.Buffer)
+	}
+	return offset
 }
 
 // Get returns value for key
@@ -270,7 +366,7 @@ func newMessage(cmd byte, method string, v interface{}, isError bool, isAsync bo
 func checkMethod(method string) error {
 	ml := len(method)
 	if ml == 0 || ml > MaxMethodLen {
-		return fmt.Errorf("invalid method length: %v, should <= %v", ml, MaxMethodLen)
+		return fmt.Errorf("%w: %v, should <= %v", ErrInvalidMethodLen, ml, MaxMethodLen)
 	}
 	return nil
 }
@@ -0,0 +1,93 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// protocolErrorRoute is the notify sent to the peer before closing for a fatal protocol violation
+const protocolErrorRoute = "_arpc.protoerr"
+
+const protocolErrorTimeout = time.Second
+
+const (
+	// ProtocolErrorFrame is the code of invalid frames, e.g. malformed varint or tiny frame headers
+	ProtocolErrorFrame byte = 1
+	// ProtocolErrorBodyLen is the code of invalid body length
+	ProtocolErrorBodyLen byte = 2
+)
+
+// ProtocolError is the fatal protocol violation reported by the peer before it closed the conn
+type ProtocolError struct {
+	Code   byte
+	Reason string
+}
+
+// Error implements error
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error %v: %v", e.Code, e.Reason)
+}
+
+// PeerProtocolError returns the protocol error reported by the peer before closing, nil if none
+func (c *Client) PeerProtocolError() *ProtocolError {
+	if e, ok := c.peerProtoErr.Load().(*ProtocolError); ok {
+		return e
+	}
+	return nil
+}
+
+// protocolErrorCode returns code of err if it's a fatal protocol violation
+func protocolErrorCode(err error) (byte, bool) {
+	switch {
+	case errors.Is(err, ErrInvalidBodyLen):
+		return ProtocolErrorBodyLen, true
+	case err == ErrInvalidVarintHeader, err == ErrInvalidTinyFrame, err == ErrTinyBodyTooLarge:
+		return ProtocolErrorFrame, true
+	}
+	return 0, false
+}
+
+// reportProtocolError tells the peer why the conn is closed if err of reading is a protocol violation,
+// it's written directly to the conn since the conn is closed next
+func (c *Client) reportProtocolError(err error) {
+	code, ok := protocolErrorCode(err)
+	if !ok {
+		return
+	}
+	reason := err.Error()
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	msg := newMessage(CmdNotify, protocolErrorRoute, append([]byte{code}, reason...), false, false, 0, c.Handler, c.Codec, nil)
+	for _, coder := range c.Handler.Coders() {
+		msg = coder.Encode(c, msg)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(protocolErrorTimeout))
+	size := c.Handler.SendBufferSize()
+	_, werr := c.Handler.Send(c.lockWriter(size), c.frame(msg.Buffer, false))
+	if size > 0 && werr == nil {
+		werr = c.wconn.w.Flush()
+	}
+	c.unlockWriter(size, werr)
+	if werr != nil {
+		log.Debug("%v\t%v\tsend protocol error failed: %v", c.logTag(), c.Conn.RemoteAddr(), werr)
+	}
+}
+
+func (h *handler) onProtocolError(c *Client, msg *Message) {
+	data := msg.Data()
+	if len(data) < 1 {
+		log.Warn("%v OnMessage: invalid protocol error message length %v, dropped", h.LogTag(), len(data))
+		return
+	}
+	e := &ProtocolError{Code: data[0], Reason: string(data[1:])}
+	c.peerProtoErr.Store(e)
+	log.Error("%v\t%v\tclosed by peer: %v", h.LogTag(), c.Conn.RemoteAddr(), e)
+}
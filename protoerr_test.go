@@ -0,0 +1,54 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProtocolError(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	head := make([]byte, HeaderIndexBodyLenEnd)
+	binary.LittleEndian.PutUint32(head, uint32(MaxBodyLen+1))
+	if _, err = conn.Write(head); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, HeadLen)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read protocol error: %v", err)
+	}
+	msg := &Message{Buffer: append(buf, make([]byte, Header(buf[:HeaderIndexBodyLenEnd]).BodyLen())...)}
+	if _, err = io.ReadFull(conn, msg.Buffer[HeadLen:]); err != nil {
+		t.Fatalf("failed to read protocol error body: %v", err)
+	}
+
+	c := &Client{Conn: conn, Handler: svr.Handler}
+	svr.Handler.OnMessage(c, msg)
+	e := c.PeerProtocolError()
+	if e == nil || e.Code != ProtocolErrorBodyLen {
+		t.Fatalf("Client.PeerProtocolError() = %v, want code %v", e, ProtocolErrorBodyLen)
+	}
+	if _, err = conn.Read(buf); err != io.EOF {
+		t.Fatalf("conn not closed after protocol error, err = %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+// DefaultBufferSize of copying between connections that could not be spliced
+const DefaultBufferSize = 32 * 1024
+
+var (
+	// ErrProxyStopped .
+	ErrProxyStopped = errors.New("proxy stopped")
+)
+
+// Proxy forwards arpc connections to backends, frames are passed through without decoding
+// or encoding, so peers should use the same codec, coders and frame mode
+type Proxy struct {
+	// Dial returns backend connection for the accepted connection
+	Dial func(conn net.Conn) (net.Conn, error)
+	// BufferSize of copying, DefaultBufferSize if <= 0
+	BufferSize int
+	// Clock delays retrying of accepting, arpc.SystemClock if nil
+	Clock arpc.Clock
+
+	mux      sync.Mutex
+	running  bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	pool     sync.Pool
+}
+
+// Serve accepts connections and forwards them to backends
+func (p *Proxy) Serve(ln net.Listener) error {
+	p.mux.Lock()
+	p.listener = ln
+	p.running = true
+	p.conns = map[net.Conn]struct{}{}
+	p.mux.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Error("[Proxy] Accept error: %v; retrying...", err)
+				p.sleep(time.Second / 20)
+				continue
+			}
+			p.mux.Lock()
+			running := p.running
+			p.mux.Unlock()
+			if !running {
+				return ErrProxyStopped
+			}
+			return err
+		}
+		go p.forward(conn)
+	}
+}
+
+// sleep waits for d by the clock of p
+func (p *Proxy) sleep(d time.Duration) {
+	clock := p.Clock
+	if clock == nil {
+		clock = arpc.SystemClock
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	<-timer.C()
+}
+
+func (p *Proxy) forward(conn net.Conn) {
+	backend, err := p.Dial(conn)
+	if err != nil {
+		log.Error("[Proxy] dial backend for %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !p.track(conn, backend) {
+		conn.Close()
+		backend.Close()
+		return
+	}
+	defer p.untrack(conn, backend)
+	if err = p.Pipe(conn, backend); err != nil {
+		log.Debug("[Proxy] %v <-> %v stopped: %v", conn.RemoteAddr(), backend.RemoteAddr(), err)
+	}
+}
+
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.running {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mux.Lock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+	p.mux.Unlock()
+}
+
+// Pipe copies data between a and b in both directions until either side closes, then closes both.
+// TCP connections are copied with splice on Linux, others with buffers from the pool
+func (p *Proxy) Pipe(a, b net.Conn) error {
+	errCh := make(chan error, 2)
+	go func() { errCh <- p.copy(a, b) }()
+	go func() { errCh <- p.copy(b, a) }()
+	err := <-errCh
+	a.Close()
+	b.Close()
+	<-errCh
+	return err
+}
+
+func (p *Proxy) copy(dst, src net.Conn) error {
+	// io.Copy uses ReadFrom of *net.TCPConn, which splices between TCP connections on Linux
+	if _, ok := dst.(*net.TCPConn); ok {
+		if _, ok = src.(*net.TCPConn); ok {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+	}
+	buf := p.getBuffer()
+	defer p.pool.Put(buf)
+	_, err := io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, *buf)
+	return err
+}
+
+func (p *Proxy) getBuffer() *[]byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return buf
+	}
+	size := p.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// Stop stops accepting and closes all forwarded connections
+func (p *Proxy) Stop() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.running {
+		return nil
+	}
+	p.running = false
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = map[net.Conn]struct{}{}
+	return p.listener.Close()
+}
+
+// onlyWriter and onlyReader hide ReadFrom and WriteTo so that io.CopyBuffer uses the given buffer
+type onlyWriter struct {
+	io.Writer
+}
+
+type onlyReader struct {
+	io.Reader
+}
+
+// New returns Proxy forwarding connections to addr
+func New(addr string) *Proxy {
+	return &Proxy{
+		Dial: func(net.Conn) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, time.Second*5)
+		},
+	}
+}
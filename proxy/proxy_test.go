@@ -0,0 +1,72 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestProxy(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/proxy/echo", func(ctx *arpc.Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(backendLn)
+	defer svr.Stop()
+
+	proxyLn, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	p := New(backendLn.Addr().String())
+	chServe := make(chan error, 1)
+	go func() { chServe <- p.Serve(proxyLn) }()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", proxyLn.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	for i := 0; i < 3; i++ {
+		rsp := ""
+		if err = c.Call("/proxy/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+		}
+	}
+
+	p.Stop()
+	if err = <-chServe; err != ErrProxyStopped {
+		t.Fatalf("Proxy.Serve() error = %v, want %v", err, ErrProxyStopped)
+	}
+}
+
+func TestProxy_Pipe(t *testing.T) {
+	p := &Proxy{BufferSize: 16}
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- p.Pipe(a2, b1) }()
+
+	go a1.Write([]byte("ping through pipe"))
+	buf := make([]byte, 64)
+	n, err := b2.Read(buf)
+	if err != nil || string(buf[:n]) != "ping through pipe"[:n] {
+		t.Fatalf("Pipe forwarded %q, %v", buf[:n], err)
+	}
+	a1.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Proxy.Pipe() error = %v", err)
+	}
+}
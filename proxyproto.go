@@ -0,0 +1,124 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = time.Second * 5
+
+	// proxyV1MaxLen is the max length of v1 header line including CRLF
+	proxyV1MaxLen = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// RealAddr returns source address from PROXY protocol header if Server.ProxyProtocol is enabled
+// and the proxy forwarded it, or else remote address of the conn
+func (c *Client) RealAddr() net.Addr {
+	if c.realAddr != nil {
+		return c.realAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header from conn, it returns nil address for
+// UNKNOWN of v1 and LOCAL of v2, e.g. health checks of load balancers
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	head := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, proxyV2Signature) {
+		return readProxyV2(conn)
+	}
+	if bytes.HasPrefix(head, []byte("PROXY ")) {
+		return readProxyV1(conn, head)
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+// readProxyV1 reads the rest of "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n" byte by byte,
+// so data after the header is left in conn
+func readProxyV1(conn net.Conn, line []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, ErrInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads [ver_cmd:1][fam:1][len:2][addresses][tlvs] after the signature
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	switch head[0] & 0xF {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch head[1] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no ip address
+		return nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := int(binary.BigEndian.Uint16(body[ipLen*2:]))
+	if head[1]&0xF == 2 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
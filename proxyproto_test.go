@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, fam byte, addrs ...byte) string {
+		return string(proxyV2Signature) + string([]byte{verCmd, fam, 0, byte(len(addrs))}) + string(addrs)
+	}
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.168.1.2 10.0.0.1 56324 443\r\n", "192.168.1.2:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n", "[2001:db8::1]:4000", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 invalid", "PROXY TCP4 x y z w\r\n", "", true},
+		{"v2 tcp4", v2(0x21, 0x11, 192, 168, 1, 2, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb), "192.168.1.2:56324", false},
+		{"v2 local", v2(0x20, 0x00), "", false},
+		{"v2 invalid version", v2(0x11, 0x11), "", true},
+		{"no header", "GET / HTTP/1.1\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			go c2.Write([]byte(tt.header + "data"))
+
+			addr, err := readProxyHeader(c1)
+			if (err != nil) != tt.err {
+				t.Fatalf("readProxyHeader() error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Fatalf("readProxyHeader() = %v, want %v", got, tt.want)
+			}
+			data := make([]byte, 4)
+			if _, err = io.ReadFull(c1, data); err != nil || string(data) != "data" {
+				t.Fatalf("data after header = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.ProxyProtocol = true
+	svr.Handler.Handle("/realaddr", func(ctx *Context) {
+		ctx.Write(ctx.Client.RealAddr().String())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	dialer := WrapDialer(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, func(conn net.Conn) (net.Conn, error) {
+		_, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 443\r\n"))
+		return conn, err
+	})
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	var addr string
+	if err = c.Call("/realaddr", nil, &addr, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if addr != "203.0.113.7:40000" {
+		t.Fatalf("Client.RealAddr() = %v, want 203.0.113.7:40000", addr)
+	}
+	if got := c.RealAddr(); got.String() != c.Conn.RemoteAddr().String() {
+		t.Fatalf("Client.RealAddr() without header = %v, want %v", got, c.Conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// Broker is an external messaging system bridged with pubsub Server, implemented with
+// the broker's own client, e.g. NATS, Kafka or MQTT
+type Broker interface {
+	// Publish publishes data to subject of the broker, it's called in publishing of
+	// arpc topics and should not block for long
+	Publish(subject string, data []byte) error
+	// Subscribe subscribes subject of the broker
+	Subscribe(subject string, h func(subject string, data []byte)) error
+	// Close closes the broker client
+	Close() error
+}
+
+// SubjectMapper maps a topic name to a broker subject or a broker subject to a topic name
+type SubjectMapper func(name string) string
+
+// SeparatorMapper returns SubjectMapper replacing level separator, e.g. "/" to "." for NATS
+func SeparatorMapper(old, new string) SubjectMapper {
+	return func(name string) string {
+		return strings.Replace(name, old, new, -1)
+	}
+}
+
+// PrefixMapper returns SubjectMapper replacing prefix old with new
+func PrefixMapper(old, new string) SubjectMapper {
+	return func(name string) string {
+		return new + strings.TrimPrefix(name, old)
+	}
+}
+
+type exportRoute struct {
+	trie   *topicTrie
+	mapper SubjectMapper
+}
+
+// Bridge mirrors topics of Server to Broker and subjects of Broker to Server,
+// messages imported from Broker are never exported back
+type Bridge struct {
+	server *Server
+	broker Broker
+
+	mux     sync.RWMutex
+	closed  bool
+	exports []exportRoute
+}
+
+// Export mirrors topics matching pattern to broker subjects mapped by mapper, nil mapper keeps the name
+func (b *Bridge) Export(pattern string, mapper SubjectMapper) error {
+	if pattern == "" {
+		return ErrInvalidTopicEmpty
+	}
+	if err := validTopicPattern(pattern); err != nil {
+		return err
+	}
+	trie := newTopicTrie()
+	trie.Add(pattern)
+	b.mux.Lock()
+	b.exports = append(b.exports, exportRoute{trie: trie, mapper: mapper})
+	b.mux.Unlock()
+	return nil
+}
+
+// Import mirrors messages of broker subject to topics mapped by mapper, nil mapper keeps the name
+func (b *Bridge) Import(subject string, mapper SubjectMapper) error {
+	return b.broker.Subscribe(subject, func(subject string, data []byte) {
+		name := subject
+		if mapper != nil {
+			name = mapper(subject)
+		}
+		topic, err := newTopic(name, data)
+		if err == nil {
+			topic.bridged = true
+			_, err = topic.toBytes()
+		}
+		if err == nil {
+			err = b.server.publish(nil, topic)
+		}
+		if err != nil {
+			log.Error("%v [Bridge Import] [subject: '%v'] failed: %v", b.server.Handler.LogTag(), subject, err)
+		}
+	})
+}
+
+// Close stops exporting and closes the broker
+func (b *Bridge) Close() error {
+	b.mux.Lock()
+	b.closed = true
+	b.mux.Unlock()
+	return b.broker.Close()
+}
+
+func (b *Bridge) onPublished(topic *Topic) {
+	if topic.bridged {
+		return
+	}
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, route := range b.exports {
+		if len(route.trie.Match(topic.Name)) == 0 {
+			continue
+		}
+		subject := topic.Name
+		if route.mapper != nil {
+			subject = route.mapper(topic.Name)
+		}
+		if err := b.broker.Publish(subject, topic.Data); err != nil {
+			log.Error("%v [Bridge Export] [topic: '%v'] failed: %v", b.server.Handler.LogTag(), topic.Name, err)
+		}
+	}
+}
+
+// NewBridge returns Bridge between s and broker
+func NewBridge(s *Server, broker Broker) *Bridge {
+	b := &Bridge{server: s, broker: broker}
+	s.psmux.Lock()
+	s.publishHooks = append(s.publishHooks, b.onPublished)
+	s.psmux.Unlock()
+	return b
+}
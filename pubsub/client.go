@@ -5,7 +5,9 @@
 package pubsub
 
 import (
+	"encoding/binary"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,19 +22,31 @@ type Client struct {
 
 	Password string
 
+	// Keys authenticates with the current versioned password if it's not nil, instead of Password
+	Keys arpc.KeyProvider
+
 	psmux sync.RWMutex
 
 	topicHandlerMap map[string]TopicHandler
 
 	onPublishHandler TopicHandler
+
+	states map[string][]*snapshot
+
+	subs map[string]*subRequest
 }
 
 // Authenticate .
 func (c *Client) Authenticate() error {
-	if c.Password == "" {
+	passwd := c.Password
+	if c.Keys != nil {
+		version, key := c.Keys.Current()
+		passwd = version + ":" + string(key)
+	}
+	if passwd == "" {
 		return nil
 	}
-	err := c.Call(routeAuthenticate, c.Password, nil, time.Second*5)
+	err := c.Call(routeAuthenticate, passwd, nil, time.Second*5)
 	if err == nil {
 		log.Info("%v [Authenticate] success from\t%v", c.Handler.LogTag(), c.Conn.RemoteAddr())
 	} else {
@@ -41,9 +55,43 @@ func (c *Client) Authenticate() error {
 	return err
 }
 
-// Subscribe .
+// Subscribe subscribes topic or topic pattern, e.g. "sensors/+/temp", "logs/#"
 func (c *Client) Subscribe(topicName string, h TopicHandler, timeout time.Duration) error {
-	topic, err := newTopic(topicName, nil)
+	return c.subscribe(topicName, h, nil, timeout)
+}
+
+// SubscribeFrom subscribes topic durably, replays stored messages from offset first,
+// and replays messages missed while disconnected after reconnecting. Offsets are per topic,
+// patterns can't be subscribed durably
+func (c *Client) SubscribeFrom(topicName string, h TopicHandler, offset uint64, timeout time.Duration) error {
+	return c.subscribe(topicName, h, &subRequest{replay: true, from: offset}, timeout)
+}
+
+// SubscribeSince subscribes topic durably, replays stored messages published since t first,
+// and replays messages missed while disconnected after reconnecting, patterns can't be subscribed durably
+func (c *Client) SubscribeSince(topicName string, h TopicHandler, t time.Time, timeout time.Duration) error {
+	return c.subscribe(topicName, h, &subRequest{replay: true, since: t.UnixNano()}, timeout)
+}
+
+// SubscribeQoS subscribes topic with qos, QoS1 messages are acked after h returns and redelivered if not acked
+func (c *Client) SubscribeQoS(topicName string, h TopicHandler, qos byte, timeout time.Duration) error {
+	if qos > QoS1 {
+		return ErrInvalidQoS
+	}
+	return c.subscribe(topicName, h, &subRequest{qos: qos}, timeout)
+}
+
+func (c *Client) subscribe(topicName string, h TopicHandler, req *subRequest, timeout time.Duration) error {
+	data := req.toBytes()
+	if IsTopicPattern(topicName) {
+		if err := validTopicPattern(topicName); err != nil {
+			return err
+		}
+		if req != nil && req.replay {
+			return ErrReplayPattern
+		}
+	}
+	topic, err := newTopic(topicName, data)
 	if err != nil {
 		return err
 	}
@@ -57,6 +105,9 @@ func (c *Client) Subscribe(topicName string, h TopicHandler, timeout time.Durati
 	// 	panic(fmt.Errorf("handler exist for topic [%v]", topicName))
 	// }
 	c.topicHandlerMap[topicName] = h
+	if req != nil {
+		c.subs[topicName] = req
+	}
 	c.psmux.Unlock()
 
 	err = c.Call(routeSubscribe, bs, nil, timeout)
@@ -65,6 +116,7 @@ func (c *Client) Subscribe(topicName string, h TopicHandler, timeout time.Durati
 	} else {
 		c.psmux.Lock()
 		delete(c.topicHandlerMap, topicName)
+		delete(c.subs, topicName)
 		c.psmux.Unlock()
 		log.Error("%v [Subscribe] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
 	}
@@ -85,6 +137,7 @@ func (c *Client) Unsubscribe(topicName string, timeout time.Duration) error {
 	if err == nil {
 		c.psmux.Lock()
 		delete(c.topicHandlerMap, topic.Name)
+		delete(c.subs, topic.Name)
 		c.psmux.Unlock()
 		log.Info("%v[Unsubscribe] [topic: '%v'] success from\t%v", c.Handler.LogTag(), topicName, c.Conn.RemoteAddr())
 	} else {
@@ -111,6 +164,24 @@ func (c *Client) Publish(topicName string, v interface{}, timeout time.Duration)
 	return err
 }
 
+// PublishRetained publishes topic and retains it as the last value delivered to new subscribers, nil v clears it
+func (c *Client) PublishRetained(topicName string, v interface{}, timeout time.Duration) error {
+	topic, err := newTopic(topicName, util.ValueToBytes(c.Codec, v))
+	if err != nil {
+		return err
+	}
+	bs, err := topic.toBytes()
+	if err != nil {
+		return err
+	}
+
+	err = c.Call(routePublishRetained, bs, nil, timeout)
+	if err != nil {
+		log.Error("%v [PublishRetained] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
+	}
+	return err
+}
+
 // PublishToOne .
 func (c *Client) PublishToOne(topicName string, v interface{}, timeout time.Duration) error {
 	topic, err := newTopic(topicName, util.ValueToBytes(c.Codec, v))
@@ -148,7 +219,10 @@ func (c *Client) initTopics() {
 		topicName := name
 		go util.Safe(func() {
 			for i := 0; i < 10; i++ {
-				topic, _ := newTopic(topicName, util.ValueToBytes(c.Codec, nil))
+				c.psmux.RLock()
+				data := c.subs[topicName].toBytes()
+				c.psmux.RUnlock()
+				topic, _ := newTopic(topicName, data)
 				bs, _ := topic.toBytes()
 				err := c.Call(routeSubscribe, bs, nil, time.Second*10)
 				if err == nil {
@@ -157,7 +231,8 @@ func (c *Client) initTopics() {
 				} else {
 					log.Error("%v [Subscribe] [topic: '%v'] %v times failed: %v, from\t%v", c.Handler.LogTag(), topicName, i+1, err, c.Conn.RemoteAddr())
 				}
-				time.Sleep(time.Second)
+				timer := c.Handler.Clock().NewTimer(time.Second)
+				<-timer.C()
 			}
 		})
 	}
@@ -178,10 +253,25 @@ func (c *Client) onPublish(ctx *arpc.Context) {
 		log.Error("%v [Publish IN] failed [%v], to\t%v", c.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
 		return
 	}
+	if v, ok := ctx.Meta().Get(MetaKeyOffset); ok {
+		topic.Offset, _ = strconv.ParseUint(v, 10, 64)
+		c.psmux.Lock()
+		if req, ok := c.subs[topic.Name]; ok && req.replay && topic.Offset >= req.from {
+			req.from = topic.Offset + 1
+		}
+		c.psmux.Unlock()
+	}
 
+	_, topic.Retained = ctx.Meta().Get(MetaKeyRetained)
+
+	// messages delivered by a subscribed pattern are handled by the pattern's handler
+	subscribed := topic.Name
+	if pattern, ok := ctx.Meta().Get(MetaKeyPattern); ok {
+		subscribed = pattern
+	}
 	if c.onPublishHandler == nil {
 		c.psmux.RLock()
-		if h, ok := c.topicHandlerMap[topic.Name]; ok {
+		if h, ok := c.topicHandlerMap[subscribed]; ok {
 			h(topic)
 			c.psmux.RUnlock()
 		} else {
@@ -190,21 +280,75 @@ func (c *Client) onPublish(ctx *arpc.Context) {
 	} else {
 		c.onPublishHandler(topic)
 	}
+
+	if id, ok := deliveryID(ctx.Meta()); ok {
+		c.Notify(routeDeliveryAck, deliveryAck(subscribed, id), arpc.TimeZero)
+	}
 }
 
-// NewClient .
-func NewClient(dialer func() (net.Conn, error)) (*Client, error) {
-	c, err := arpc.NewClient(dialer)
+func (c *Client) onDelta(ctx *arpc.Context) {
+	defer util.Recover()
+
+	topic := &Topic{}
+	err := topic.fromBytes(ctx.Body())
 	if err != nil {
-		return nil, err
+		log.Error("%v [Delta IN] failed [%v], to\t%v", c.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		return
+	}
+
+	c.psmux.Lock()
+	curr, ok := applyState(c.states[topic.Name], topic.Data)
+	if ok {
+		c.states[topic.Name] = keepSnapshot(c.states[topic.Name], curr)
+	}
+	c.psmux.Unlock()
+
+	// ack 0 to request the full snapshot at once if delta base mismatches
+	var version uint64
+	if ok {
+		version = curr.version
 	}
-	c.Handler.SetLogTag("[APS CLI]")
+	ack := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ack, version)
+	if tp, err := newTopic(topic.Name, ack); err == nil {
+		bs, _ := tp.toBytes()
+		c.Notify(routeDeltaAck, bs, arpc.TimeZero)
+	}
+	if !ok {
+		log.Warn("%v [Delta IN] [topic: '%v'] base mismatch, full snapshot requested", c.Handler.LogTag(), topic.Name)
+		return
+	}
+
+	topic.Data = curr.data
+	if c.onPublishHandler == nil {
+		c.psmux.RLock()
+		h, ok := c.topicHandlerMap[topic.Name]
+		c.psmux.RUnlock()
+		if ok {
+			h(topic)
+		}
+	} else {
+		c.onPublishHandler(topic)
+	}
+}
+
+// NewClient .
+func NewClient(dialer func() (net.Conn, error)) (*Client, error) {
 	cli := &Client{
-		Client:          c,
 		topicHandlerMap: map[string]TopicHandler{},
+		states:          map[string][]*snapshot{},
+		subs:            map[string]*subRequest{},
+	}
+	// routes are set before the client's loops start, replacing Handler after that races with them
+	h := arpc.DefaultHandler.Clone()
+	h.SetLogTag("[APS CLI]")
+	h.Handle(routePublish, cli.onPublish)
+	h.Handle(routeDelta, cli.onDelta)
+	c, err := arpc.NewClient(dialer, arpc.WithHandler(h))
+	if err != nil {
+		return nil, err
 	}
-	cli.Handler = cli.Handler.Clone()
-	cli.Handler.Handle(routePublish, cli.onPublish)
+	cli.Client = c
 	cli.Handler.HandleConnected(func(c *arpc.Client) {
 		if cli.Authenticate() == nil {
 			cli.initTopics()
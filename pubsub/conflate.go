@@ -0,0 +1,77 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/lesismal/arpc"
+)
+
+// ConflateKeyFunc returns conflation key of topic message, pending messages with the same key replace each other
+type ConflateKeyFunc func(topic *Topic) string
+
+// conflater queues at most one message per key for a slow subscriber
+type conflater struct {
+	mux     sync.Mutex
+	running bool
+	keys    []string
+	pending map[string]*arpc.Message
+}
+
+// push sends msg directly if nothing is pending and the send queue has room,
+// otherwise keeps msg as the latest of key until the subscriber catches up
+func (cf *conflater) push(to *arpc.Client, key string, msg *arpc.Message) error {
+	cf.mux.Lock()
+	if !cf.running {
+		cf.mux.Unlock()
+		err := to.PushMsg(msg, arpc.TimeZero)
+		if err != arpc.ErrClientOverstock {
+			return err
+		}
+		cf.mux.Lock()
+	}
+	if _, ok := cf.pending[key]; !ok {
+		cf.keys = append(cf.keys, key)
+	}
+	cf.pending[key] = msg
+	if !cf.running {
+		cf.running = true
+		go cf.flush(to)
+	}
+	cf.mux.Unlock()
+	return nil
+}
+
+func (cf *conflater) flush(to *arpc.Client) {
+	for {
+		cf.mux.Lock()
+		if len(cf.keys) == 0 {
+			cf.running = false
+			cf.mux.Unlock()
+			return
+		}
+		key := cf.keys[0]
+		cf.keys = cf.keys[1:]
+		msg := cf.pending[key]
+		delete(cf.pending, key)
+		cf.mux.Unlock()
+
+		if err := to.PushMsg(msg, arpc.TimeForever); err != nil {
+			cf.stop()
+		}
+	}
+}
+
+func (cf *conflater) stop() {
+	cf.mux.Lock()
+	cf.keys = nil
+	cf.pending = map[string]*arpc.Message{}
+	cf.mux.Unlock()
+}
+
+func newConflater() *conflater {
+	return &conflater{pending: map[string]*arpc.Message{}}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// MaxDeltaSnapshots is the number of recent snapshots kept per topic as delta base, by the
+	// server and by each subscriber, so that a delta against an acked snapshot is applied even if
+	// newer snapshots are published before the ack arrives
+	MaxDeltaSnapshots = 8
+
+	stateFull  byte = 0
+	stateDelta byte = 1
+)
+
+type snapshot struct {
+	version uint64
+	data    []byte
+}
+
+// encodeState encodes data as full state or as delta against base:
+// full:  [0][version:8][data]
+// delta: [1][version:8][baseVersion:8][prefixLen:uvarint][suffixLen:uvarint][middle]
+func encodeState(version uint64, base *snapshot, data []byte) []byte {
+	if base != nil {
+		prefix, suffix := commonPrefix(base.data, data), 0
+		for suffix < len(base.data)-prefix && suffix < len(data)-prefix &&
+			base.data[len(base.data)-1-suffix] == data[len(data)-1-suffix] {
+			suffix++
+		}
+		middle := data[prefix : len(data)-suffix]
+		buf := make([]byte, 17+2*binary.MaxVarintLen64+len(middle))
+		buf[0] = stateDelta
+		binary.LittleEndian.PutUint64(buf[1:], version)
+		binary.LittleEndian.PutUint64(buf[9:], base.version)
+		n := 17
+		n += binary.PutUvarint(buf[n:], uint64(prefix))
+		n += binary.PutUvarint(buf[n:], uint64(suffix))
+		n += copy(buf[n:], middle)
+		if n < 9+len(data) {
+			return buf[:n]
+		}
+	}
+	buf := make([]byte, 9+len(data))
+	buf[0] = stateFull
+	binary.LittleEndian.PutUint64(buf[1:], version)
+	copy(buf[9:], data)
+	return buf
+}
+
+// applyState decodes state with the base snapshot named by payload in recent snapshots, ok is false
+// if the delta base is not kept
+func applyState(recent []*snapshot, payload []byte) (*snapshot, bool) {
+	if len(payload) < 9 {
+		return nil, false
+	}
+	version := binary.LittleEndian.Uint64(payload[1:])
+	switch payload[0] {
+	case stateFull:
+		return &snapshot{version: version, data: append([]byte(nil), payload[9:]...)}, true
+	case stateDelta:
+		if len(payload) < 17 {
+			return nil, false
+		}
+		prev := findSnapshot(recent, binary.LittleEndian.Uint64(payload[9:]))
+		if prev == nil {
+			return nil, false
+		}
+		prefix, n1 := binary.Uvarint(payload[17:])
+		if n1 <= 0 {
+			return nil, false
+		}
+		suffix, n2 := binary.Uvarint(payload[17+n1:])
+		if n2 <= 0 || prefix+suffix > uint64(len(prev.data)) {
+			return nil, false
+		}
+		middle := payload[17+n1+n2:]
+		data := make([]byte, 0, int(prefix)+len(middle)+int(suffix))
+		data = append(data, prev.data[:prefix]...)
+		data = append(data, middle...)
+		data = append(data, prev.data[uint64(len(prev.data))-suffix:]...)
+		return &snapshot{version: version, data: data}, true
+	}
+	return nil, false
+}
+
+// keepSnapshot appends curr to recent snapshots, the oldest beyond MaxDeltaSnapshots are dropped
+func keepSnapshot(recent []*snapshot, curr *snapshot) []*snapshot {
+	recent = append(recent, curr)
+	if len(recent) > MaxDeltaSnapshots {
+		recent = recent[len(recent)-MaxDeltaSnapshots:]
+	}
+	return recent
+}
+
+func findSnapshot(recent []*snapshot, version uint64) *snapshot {
+	for i := len(recent) - 1; i >= 0; i-- {
+		if recent[i].version == version {
+			return recent[i]
+		}
+	}
+	return nil
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
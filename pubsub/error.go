@@ -18,4 +18,16 @@ var (
 
 	// ErrInvalidTopicNameLength .
 	ErrInvalidTopicNameLength = errors.New("invalid topic name length, should not be more than 1024")
+
+	// ErrInvalidTopicPattern .
+	ErrInvalidTopicPattern = errors.New("invalid topic pattern, wildcards should occupy a whole level and \"#\" should be the last level")
+
+	// ErrInvalidQoS .
+	ErrInvalidQoS = errors.New("invalid qos, should be QoS0 or QoS1")
+
+	// ErrPublishToPattern .
+	ErrPublishToPattern = errors.New("invalid topic, should not publish to topic pattern")
+
+	// ErrReplayPattern .
+	ErrReplayPattern = errors.New("invalid topic, should not subscribe topic pattern durably, offsets are per topic")
 )
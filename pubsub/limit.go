@@ -0,0 +1,134 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// LimitPolicy defines how messages beyond rate limit are handled
+type LimitPolicy int
+
+const (
+	// LimitDrop drops messages beyond rate limit
+	LimitDrop LimitPolicy = iota
+	// LimitConflate keeps only the latest message beyond rate limit and sends it when tokens refill
+	LimitConflate
+)
+
+// RateLimit defines a token bucket limit
+type RateLimit struct {
+	// Rate is tokens refilled per second
+	Rate float64
+	// Burst is the bucket size, at least 1
+	Burst int
+	// Policy for messages beyond limit
+	Policy LimitPolicy
+	// DryRun counts messages beyond limit without dropping or conflating them, see TopicAgent.DryRuns
+	DryRun bool
+}
+
+type limiter struct {
+	mux     sync.Mutex
+	clock   arpc.Clock
+	limit   RateLimit
+	tokens  float64
+	last    time.Time
+	pending func()
+	timer   arpc.Timer
+	// dryRuns counts messages beyond limit in dry-run mode
+	dryRuns *uint64
+}
+
+// do runs f if a token is available, or drops/conflates f by policy, returns false if f is not run now
+func (l *limiter) do(f func()) bool {
+	l.mux.Lock()
+	if l.limit.DryRun {
+		if !l.take() {
+			atomic.AddUint64(l.dryRuns, 1)
+		}
+		l.mux.Unlock()
+		f()
+		return true
+	}
+	// keep order: newer messages never bypass the pending one
+	if l.pending == nil && l.take() {
+		l.mux.Unlock()
+		f()
+		return true
+	}
+	if l.limit.Policy == LimitConflate {
+		l.pending = f
+		if l.timer == nil {
+			l.timer = l.clock.AfterFunc(l.wait(), l.flush)
+		}
+	}
+	l.mux.Unlock()
+	return false
+}
+
+func (l *limiter) flush() {
+	l.mux.Lock()
+	l.timer = nil
+	f := l.pending
+	if f == nil {
+		l.mux.Unlock()
+		return
+	}
+	if !l.take() {
+		l.timer = l.clock.AfterFunc(l.wait(), l.flush)
+		l.mux.Unlock()
+		return
+	}
+	l.pending = nil
+	l.mux.Unlock()
+	f()
+}
+
+func (l *limiter) take() bool {
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+	if burst := float64(l.limit.Burst); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+	return false
+}
+
+func (l *limiter) wait() time.Duration {
+	return time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func (l *limiter) stop() {
+	l.mux.Lock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.pending = nil
+	l.mux.Unlock()
+}
+
+// newLimiter returns nil if limit is nil or not limited, messages beyond limit in dry-run mode
+// are counted to dryRuns
+func newLimiter(limit *RateLimit, clock arpc.Clock, dryRuns *uint64) *limiter {
+	if limit == nil || limit.Rate <= 0 {
+		return nil
+	}
+	l := &limiter{clock: clock, limit: *limit, last: clock.Now(), dryRuns: dryRuns}
+	if l.limit.Burst < 1 {
+		l.limit.Burst = 1
+	}
+	l.tokens = float64(l.limit.Burst)
+	return l
+}
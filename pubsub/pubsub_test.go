@@ -7,9 +7,11 @@ package pubsub
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/lesismal/arpc"
 	"github.com/lesismal/arpc/log"
 )
 
@@ -86,3 +88,549 @@ func producer(c *Client, topicName string, chDone chan int) {
 		}
 	}
 }
+
+func TestDeltaState(t *testing.T) {
+	base := &snapshot{version: 1, data: []byte(`{"x":1,"y":2,"name":"player"}`)}
+	data := []byte(`{"x":3,"y":2,"name":"player"}`)
+
+	payload := encodeState(2, base, data)
+	if payload[0] != stateDelta || len(payload) >= 9+len(data) {
+		t.Fatalf("encodeState() = %v, want delta shorter than full", payload)
+	}
+	curr, ok := applyState([]*snapshot{base}, payload)
+	if !ok || curr.version != 2 || string(curr.data) != string(data) {
+		t.Fatalf("applyState() = %v, %v, want %s", curr, ok, data)
+	}
+	if _, ok = applyState([]*snapshot{{version: 3}}, payload); ok {
+		t.Fatalf("applyState() with mismatched base ok = true")
+	}
+
+	curr, ok = applyState(nil, encodeState(4, nil, data))
+	if !ok || curr.version != 4 || string(curr.data) != string(data) {
+		t.Fatalf("applyState() full = %v, %v, want %s", curr, ok, data)
+	}
+}
+
+func TestPublishState(t *testing.T) {
+	var (
+		address   = "localhost:8889"
+		topicName = "state"
+		chState   = make(chan string, 3)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, s.Password)
+	err := client.Subscribe(topicName, func(topic *Topic) {
+		chState <- string(topic.Data)
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, state := range []string{"aaaa-0-bbbb", "aaaa-1-bbbb", "aaaa-22-bbbb"} {
+		s.PublishState(topicName, state)
+		if got := <-chState; got != state {
+			t.Fatalf("PublishState %v: got %v, want %v", i, got, state)
+		}
+	}
+}
+
+func TestPublishStateBackToBack(t *testing.T) {
+	var (
+		address   = "localhost:8895"
+		topicName = "state"
+		states    = []string{"aaaa-0-bbbb", "aaaa-1-bbbb", "aaaa-22-bbbb", "aaaa-333-bbbb", "aaaa-4-bbbb", "aaaa-5-bbbb"}
+		chState   = make(chan string, 64)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, s.Password)
+	err := client.Subscribe(topicName, func(topic *Topic) {
+		chState <- string(topic.Data)
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// publish without waiting for acks, deltas are against snapshots not acked yet
+	for _, state := range states {
+		s.PublishState(topicName, state)
+	}
+	for i, state := range states {
+		select {
+		case got := <-chState:
+			if got != state {
+				t.Fatalf("PublishState %v: got %v, want %v", i, got, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("PublishState %v: timeout, want %v", i, state)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	drop := newLimiter(&RateLimit{Rate: 1, Burst: 2, Policy: LimitDrop}, arpc.SystemClock, nil)
+	cnt := 0
+	for i := 0; i < 5; i++ {
+		drop.do(func() { cnt++ })
+	}
+	if cnt != 2 {
+		t.Fatalf("drop limiter ran %v, want 2", cnt)
+	}
+
+	conflate := newLimiter(&RateLimit{Rate: 20, Burst: 1, Policy: LimitConflate}, arpc.SystemClock, nil)
+	chGot := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		i := i
+		conflate.do(func() { chGot <- i })
+	}
+	if got := <-chGot; got != 0 {
+		t.Fatalf("conflate limiter first = %v, want 0", got)
+	}
+	select {
+	case got := <-chGot:
+		if got != 4 {
+			t.Fatalf("conflate limiter latest = %v, want 4", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("conflate limiter latest timeout")
+	}
+	time.Sleep(time.Second / 10)
+	if len(chGot) != 0 {
+		t.Fatalf("conflate limiter ran %v more, want 0", len(chGot))
+	}
+
+	var dryRuns uint64
+	dryRun := newLimiter(&RateLimit{Rate: 1, Burst: 2, Policy: LimitDrop, DryRun: true}, arpc.SystemClock, &dryRuns)
+	cnt = 0
+	for i := 0; i < 5; i++ {
+		dryRun.do(func() { cnt++ })
+	}
+	if cnt != 5 || dryRuns != 3 {
+		t.Fatalf("dry-run limiter ran %v and counted %v, want 5 and 3", cnt, dryRuns)
+	}
+
+	if newLimiter(nil, arpc.SystemClock, nil) != nil || newLimiter(&RateLimit{}, arpc.SystemClock, nil) != nil {
+		t.Fatalf("newLimiter() without rate should be nil")
+	}
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	var (
+		address   = "localhost:8890"
+		topicName = "durable"
+		chData    = make(chan string, 8)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	s.Store = NewMemStore(2)
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	for _, v := range []string{"m1", "m2", "m3"} {
+		s.Publish(topicName, v)
+	}
+
+	client := newClient(t, address, s.Password)
+	err := client.SubscribeFrom(topicName, func(topic *Topic) {
+		chData <- fmt.Sprintf("%v:%v", topic.Offset, string(topic.Data))
+	}, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Publish(topicName, "m4")
+
+	// m1 is evicted by MemStore
+	for _, want := range []string{"2:m2", "3:m3", "4:m4"} {
+		select {
+		case got := <-chData:
+			if got != want {
+				t.Fatalf("SubscribeFrom got %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("SubscribeFrom timeout, want %v", want)
+		}
+	}
+	client.psmux.RLock()
+	from := client.subs[topicName].from
+	client.psmux.RUnlock()
+	if from != 5 {
+		t.Fatalf("durable from = %v, want 5", from)
+	}
+}
+
+func TestSubscribeFromPattern(t *testing.T) {
+	var (
+		address = "localhost:8896"
+		pattern = "sensors/+/temp"
+		chData  = make(chan string, 8)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	s.Store = NewMemStore(0)
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	s.Publish("sensors/1/temp", "stored")
+
+	client := newClient(t, address, s.Password)
+	h := func(topic *Topic) {
+		chData <- topic.Name + "=" + string(topic.Data)
+	}
+	if err := client.SubscribeFrom(pattern, h, 1, time.Second); err != ErrReplayPattern {
+		t.Fatalf("SubscribeFrom pattern err = %v, want %v", err, ErrReplayPattern)
+	}
+	if err := client.SubscribeSince(pattern, h, time.Time{}, time.Second); err != ErrReplayPattern {
+		t.Fatalf("SubscribeSince pattern err = %v, want %v", err, ErrReplayPattern)
+	}
+
+	// the server rejects durable pattern subscriptions not checked by the client
+	topic, _ := newTopic(pattern, (&subRequest{replay: true, from: 1}).toBytes())
+	bs, _ := topic.toBytes()
+	if err := client.Call(routeSubscribe, bs, nil, time.Second); err == nil || err.Error() != ErrReplayPattern.Error() {
+		t.Fatalf("subscribe pattern durably err = %v, want %v", err, ErrReplayPattern)
+	}
+
+	// patterns are still subscribed for live messages, stored ones are not replayed
+	if err := client.Subscribe(pattern, h, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.Publish("sensors/2/temp", "live")
+	select {
+	case got := <-chData:
+		if got != "sensors/2/temp=live" {
+			t.Fatalf("Subscribe pattern got %v, want sensors/2/temp=live", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribe pattern timeout")
+	}
+}
+
+func TestTopicTrie(t *testing.T) {
+	trie := newTopicTrie()
+	for _, p := range []string{"sensors/+/temp", "logs/#", "#", "a/+/+"} {
+		trie.Add(p)
+	}
+	cases := map[string]string{
+		"sensors/1/temp":  "sensors/+/temp,#",
+		"sensors/1/humid": "#",
+		"logs":            "logs/#,#",
+		"logs/app/error":  "logs/#,#",
+		"a/b/c":           "#,a/+/+",
+		"a/b":             "#",
+	}
+	for name, want := range cases {
+		got := trie.Match(name)
+		if len(got) != len(strings.Split(want, ",")) {
+			t.Fatalf("Match(%v) = %v, want %v", name, got, want)
+		}
+		for _, p := range got {
+			if !strings.Contains(","+want+",", ","+p+",") {
+				t.Fatalf("Match(%v) = %v, want %v", name, got, want)
+			}
+		}
+	}
+
+	for _, p := range []string{"a/#/b", "a/b+", "a#"} {
+		if validTopicPattern(p) == nil {
+			t.Fatalf("validTopicPattern(%v) = nil, want error", p)
+		}
+	}
+
+	// patterns are matched until their last subscription is removed
+	trie.Add("a/+/+")
+	trie.Remove("a/+/+")
+	trie.Remove("#")
+	trie.Remove("not/added")
+	if got := trie.Match("a/b/c"); len(got) != 1 || got[0] != "a/+/+" {
+		t.Fatalf("Match(a/b/c) after one of two removed = %v, want a/+/+", got)
+	}
+	trie.Remove("a/+/+")
+	if got := trie.Match("a/b/c"); len(got) != 0 {
+		t.Fatalf("Match(a/b/c) after removed = %v, want none", got)
+	}
+	if _, ok := trie.root.children["a"]; ok {
+		t.Fatalf("nodes of removed pattern a/+/+ are kept")
+	}
+}
+
+func TestSubscribePattern(t *testing.T) {
+	var (
+		address = "localhost:8891"
+		chData  = make(chan string, 8)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, s.Password)
+	for _, pattern := range []string{"sensors/+/temp", "sensors/1/temp"} {
+		p := pattern
+		err := client.Subscribe(p, func(topic *Topic) {
+			chData <- p + "=" + topic.Name
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Publish("sensors/+/temp", "x"); err != ErrPublishToPattern {
+		t.Fatalf("Publish to pattern err = %v, want %v", err, ErrPublishToPattern)
+	}
+	s.Publish("sensors/2/humid", "x")
+	s.Publish("sensors/1/temp", "x")
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-chData:
+			got[v] = true
+		case <-time.After(time.Second):
+			t.Fatalf("SubscribePattern timeout, got %v", got)
+		}
+	}
+	if !got["sensors/+/temp=sensors/1/temp"] || !got["sensors/1/temp=sensors/1/temp"] {
+		t.Fatalf("SubscribePattern got %v", got)
+	}
+	select {
+	case v := <-chData:
+		t.Fatalf("SubscribePattern got unexpected %v", v)
+	case <-time.After(time.Second / 10):
+	}
+
+	// the pattern is removed when its last subscriber unsubscribes or disconnects
+	other := newClient(t, address, s.Password)
+	if err := other.Subscribe("sensors/+/temp", func(topic *Topic) {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Unsubscribe("sensors/+/temp", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.patterns.Match("sensors/1/temp"); len(got) != 1 {
+		t.Fatalf("patterns matched with a subscriber left = %v, want sensors/+/temp", got)
+	}
+	other.Stop()
+	for i := 0; i < 100 && len(s.patterns.Match("sensors/1/temp")) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := s.patterns.Match("sensors/1/temp"); len(got) != 0 {
+		t.Fatalf("patterns matched after subscribers left = %v, want none", got)
+	}
+}
+
+func TestSubscribeQoS(t *testing.T) {
+	var (
+		address   = "localhost:8892"
+		topicName = "qos"
+		chData    = make(chan string, 8)
+	)
+
+	interval := RedeliverInterval
+	RedeliverInterval = time.Second / 10
+	defer func() { RedeliverInterval = interval }()
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, s.Password)
+	cnt := 0
+	err := client.SubscribeQoS(topicName, func(topic *Topic) {
+		cnt++
+		chData <- string(topic.Data)
+		// fail the first delivery without ack
+		if cnt == 1 {
+			panic("not acked")
+		}
+	}, QoS1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Publish(topicName, "m1")
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-chData:
+			if got != "m1" {
+				t.Fatalf("SubscribeQoS got %v, want m1", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("SubscribeQoS delivery %v timeout", i)
+		}
+	}
+	time.Sleep(time.Second / 2)
+	if len(chData) != 0 {
+		t.Fatalf("SubscribeQoS acked message redelivered")
+	}
+}
+
+func TestPublishRetained(t *testing.T) {
+	var (
+		address = "localhost:8893"
+		chData  = make(chan string, 8)
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	s.PublishRetained("room/1/state", "open")
+	s.PublishRetained("room/2/state", "closed")
+	s.PublishRetained("room/2/state", nil)
+
+	client := newClient(t, address, s.Password)
+	for _, name := range []string{"room/1/state", "room/+/state"} {
+		topicName := name
+		err := client.Subscribe(topicName, func(topic *Topic) {
+			chData <- fmt.Sprintf("%v:%v:%v", topicName, string(topic.Data), topic.Retained)
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"room/1/state:open:true", "room/+/state:open:true"} {
+		select {
+		case got := <-chData:
+			if got != want {
+				t.Fatalf("PublishRetained got %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("PublishRetained timeout, want %v", want)
+		}
+	}
+	select {
+	case got := <-chData:
+		t.Fatalf("PublishRetained got cleared value %v", got)
+	case <-time.After(time.Second / 10):
+	}
+}
+
+type testBroker struct {
+	published chan string
+	handlers  map[string]func(subject string, data []byte)
+}
+
+func (b *testBroker) Publish(subject string, data []byte) error {
+	b.published <- subject + "=" + string(data)
+	return nil
+}
+
+func (b *testBroker) Subscribe(subject string, h func(subject string, data []byte)) error {
+	b.handlers[subject] = h
+	return nil
+}
+
+func (b *testBroker) Close() error {
+	return nil
+}
+
+func TestBridge(t *testing.T) {
+	var (
+		address = "localhost:8894"
+		chData  = make(chan string, 8)
+		broker  = &testBroker{published: make(chan string, 8), handlers: map[string]func(string, []byte){}}
+	)
+
+	s := NewServer()
+	s.Password = "123qwe"
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	b := NewBridge(s, broker)
+	defer b.Close()
+	b.Export("sensors/#", SeparatorMapper("/", "."))
+	// imported topics match the export pattern but are not exported back
+	b.Import("edge.sensors", PrefixMapper("edge.", ""))
+
+	client := newClient(t, address, s.Password)
+	err := client.Subscribe("sensors", func(topic *Topic) {
+		chData <- topic.Name + "=" + string(topic.Data)
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Publish("sensors/1/temp", "20", time.Second)
+	client.Publish("other", "x", time.Second)
+	select {
+	case got := <-broker.published:
+		if got != "sensors.1.temp=20" {
+			t.Fatalf("Bridge Export got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Bridge Export timeout")
+	}
+
+	broker.handlers["edge.sensors"]("edge.sensors", []byte("reboot"))
+	select {
+	case got := <-chData:
+		if got != "sensors=reboot" {
+			t.Fatalf("Bridge Import got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Bridge Import timeout")
+	}
+	if len(broker.published) != 0 {
+		t.Fatalf("Bridge exported %v unexpected messages", len(broker.published))
+	}
+}
+
+func TestAuthenticateKeys(t *testing.T) {
+	address := "localhost:8897"
+
+	keys := arpc.NewKeyring("v1", []byte("old"))
+	s := NewServer()
+	s.Keys = keys
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	authenticate := func(k arpc.KeyProvider) error {
+		client, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", address, time.Second*3)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Stop()
+		client.Keys = k
+		return client.Authenticate()
+	}
+
+	// rotate: the server accepts both versions until the old one is removed
+	keys.Add("v2", []byte("new"))
+	if err := authenticate(arpc.NewKeyring("v1", []byte("old"))); err != nil {
+		t.Fatalf("Authenticate() with old key error = %v", err)
+	}
+	if err := authenticate(arpc.NewKeyring("v2", []byte("new"))); err != nil {
+		t.Fatalf("Authenticate() with new key error = %v", err)
+	}
+	keys.SetCurrent("v2")
+	keys.Remove("v1")
+	if err := authenticate(arpc.NewKeyring("v1", []byte("old"))); err == nil {
+		t.Fatalf("Authenticate() with removed key succeeded")
+	}
+	if err := authenticate(arpc.NewKeyring("v2", []byte("old"))); err == nil {
+		t.Fatalf("Authenticate() with wrong key succeeded")
+	}
+}
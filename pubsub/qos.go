@@ -0,0 +1,163 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// QoS0 delivers at most once, fire and forget
+	QoS0 byte = 0
+	// QoS1 delivers at least once, messages are redelivered until acked by the subscriber
+	QoS1 byte = 1
+
+	// MetaKeyDelivery carries delivery id of a QoS1 message, the subscriber acks it after handling
+	MetaKeyDelivery = "aps-delivery"
+)
+
+var (
+	// RedeliverInterval is the interval of redelivering unacked QoS1 messages
+	RedeliverInterval = time.Second * 3
+
+	// MaxRedeliver is the max redelivery times of a QoS1 message before it is dropped
+	MaxRedeliver = 5
+)
+
+const subFlagReplay byte = 0x1
+
+// subRequest is the subscription options carried by subscribe request:
+// [qos:1][flags:1][from:8][since:8]
+type subRequest struct {
+	qos    byte
+	replay bool
+	from   uint64
+	since  int64
+}
+
+func (r *subRequest) toBytes() []byte {
+	if r == nil || (r.qos == QoS0 && !r.replay) {
+		return nil
+	}
+	buf := make([]byte, 18)
+	buf[0] = r.qos
+	if r.replay {
+		buf[1] |= subFlagReplay
+	}
+	binary.LittleEndian.PutUint64(buf[2:], r.from)
+	binary.LittleEndian.PutUint64(buf[10:], uint64(r.since))
+	return buf
+}
+
+func parseSubRequest(data []byte) *subRequest {
+	if len(data) != 18 || data[0] > QoS1 {
+		return &subRequest{}
+	}
+	return &subRequest{
+		qos:    data[0],
+		replay: data[1]&subFlagReplay != 0,
+		from:   binary.LittleEndian.Uint64(data[2:]),
+		since:  int64(binary.LittleEndian.Uint64(data[10:])),
+	}
+}
+
+type pendingDelivery struct {
+	msg   *arpc.Message
+	times int
+	timer arpc.Timer
+}
+
+// inflight tracks unacked QoS1 messages of a subscriber
+type inflight struct {
+	mux     sync.Mutex
+	clock   arpc.Clock
+	seq     uint64
+	stopped bool
+	pending map[uint64]*pendingDelivery
+}
+
+// deliver pushes the message built with delivery id and redelivers it until acked
+func (f *inflight) deliver(to *arpc.Client, build func(delivery uint64) *arpc.Message) error {
+	f.mux.Lock()
+	if f.stopped {
+		f.mux.Unlock()
+		return nil
+	}
+	f.seq++
+	id := f.seq
+	pd := &pendingDelivery{msg: build(id)}
+	pd.timer = f.clock.AfterFunc(RedeliverInterval, func() { f.redeliver(to, id) })
+	f.pending[id] = pd
+	f.mux.Unlock()
+	return to.PushMsg(pd.msg, arpc.TimeZero)
+}
+
+func (f *inflight) redeliver(to *arpc.Client, id uint64) {
+	f.mux.Lock()
+	pd, ok := f.pending[id]
+	if !ok {
+		f.mux.Unlock()
+		return
+	}
+	if pd.times >= MaxRedeliver {
+		delete(f.pending, id)
+		f.mux.Unlock()
+		log.Warn("[Redeliver] delivery %v dropped after %v times, to\t%v", id, pd.times, to.Conn.RemoteAddr())
+		return
+	}
+	pd.times++
+	pd.timer.Reset(RedeliverInterval)
+	f.mux.Unlock()
+	to.PushMsg(pd.msg, arpc.TimeZero)
+}
+
+func (f *inflight) ack(id uint64) {
+	f.mux.Lock()
+	if pd, ok := f.pending[id]; ok {
+		pd.timer.Stop()
+		delete(f.pending, id)
+	}
+	f.mux.Unlock()
+}
+
+func (f *inflight) stop() {
+	f.mux.Lock()
+	f.stopped = true
+	for id, pd := range f.pending {
+		pd.timer.Stop()
+		delete(f.pending, id)
+	}
+	f.mux.Unlock()
+}
+
+func newInflight(clock arpc.Clock) *inflight {
+	return &inflight{clock: clock, pending: map[uint64]*pendingDelivery{}}
+}
+
+func deliveryID(md arpc.Metadata) (uint64, bool) {
+	v, ok := md.Get(MetaKeyDelivery)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	return id, err == nil
+}
+
+func deliveryAck(topicName string, id uint64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, id)
+	tp, err := newTopic(topicName, data)
+	if err != nil {
+		return nil
+	}
+	bs, _ := tp.toBytes()
+	return bs
+}
@@ -5,9 +5,13 @@
 package pubsub
 
 const (
-	routeAuthenticate = "in_A"
-	routeSubscribe    = "in_S"
-	routeUnsubscribe  = "in_U"
-	routePublish      = "in_P"
-	routePublishToOne = "in_P1"
+	routeAuthenticate    = "in_A"
+	routeSubscribe       = "in_S"
+	routeUnsubscribe     = "in_U"
+	routePublish         = "in_P"
+	routePublishToOne    = "in_P1"
+	routePublishRetained = "in_PR"
+	routeDelta           = "in_D"
+	routeDeltaAck        = "in_DA"
+	routeDeliveryAck     = "in_QA"
 )
@@ -5,6 +5,9 @@
 package pubsub
 
 import (
+	"crypto/subtle"
+	"encoding/binary"
+	"strings"
 	"sync"
 
 	"github.com/lesismal/arpc"
@@ -27,10 +30,21 @@ type Server struct {
 
 	Password string
 
+	// Keys accepts versioned passwords of clients, sent as "version:password", besides Password,
+	// so passwords could be rotated without disconnecting clients
+	Keys arpc.KeyProvider
+
+	// Store persists published messages for replay to durable subscribers, nil disables persistence
+	Store Store
+
 	psmux sync.RWMutex
 
 	topics map[string]*TopicAgent
 
+	patterns *topicTrie
+
+	publishHooks []func(topic *Topic)
+
 	clients map[*arpc.Client]map[string]*TopicAgent
 }
 
@@ -44,10 +58,87 @@ func (s *Server) Publish(topicName string, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	s.getOrMakeTopic(topic.Name).Publish(s, nil, topic)
+	return s.publish(nil, topic)
+}
+
+// publish publishes topic to its subscribers and subscribers of matching patterns
+func (s *Server) publish(from *arpc.Client, topic *Topic) error {
+	if IsTopicPattern(topic.Name) {
+		return ErrPublishToPattern
+	}
+	for _, pattern := range s.patterns.Match(topic.Name) {
+		if tp, ok := s.getTopic(pattern); ok {
+			cp := *topic
+			tp.Publish(s, from, &cp)
+		}
+	}
+	s.getOrMakeTopic(topic.Name).Publish(s, from, topic)
+	s.onPublished(topic)
 	return nil
 }
 
+func (s *Server) onPublished(topic *Topic) {
+	s.psmux.RLock()
+	hooks := s.publishHooks
+	s.psmux.RUnlock()
+	for _, h := range hooks {
+		h(topic)
+	}
+}
+
+// PublishRetained publishes topic and retains it as the last value delivered to new subscribers, nil v clears it
+func (s *Server) PublishRetained(topicName string, v interface{}) error {
+	topic, err := newTopic(topicName, util.ValueToBytes(s.Codec, v))
+	if err != nil {
+		return err
+	}
+	_, err = topic.toBytes()
+	if err != nil {
+		return err
+	}
+	return s.publishRetained(nil, topic)
+}
+
+func (s *Server) publishRetained(from *arpc.Client, topic *Topic) error {
+	if IsTopicPattern(topic.Name) {
+		return ErrPublishToPattern
+	}
+	tp := s.getOrMakeTopic(topic.Name)
+	if len(topic.Data) == 0 {
+		tp.PublishRetained(s, from, topic)
+		return nil
+	}
+	for _, pattern := range s.patterns.Match(topic.Name) {
+		if ptp, ok := s.getTopic(pattern); ok {
+			cp := *topic
+			ptp.Publish(s, from, &cp)
+		}
+	}
+	tp.PublishRetained(s, from, topic)
+	s.onPublished(topic)
+	return nil
+}
+
+// deliverRetained delivers retained values of topics matching the pattern tp to c
+func (s *Server) deliverRetained(tp *TopicAgent, c *arpc.Client) {
+	trie := newTopicTrie()
+	trie.Add(tp.Name)
+	s.psmux.RLock()
+	agents := make([]*TopicAgent, 0, len(s.topics))
+	for _, agent := range s.topics {
+		agents = append(agents, agent)
+	}
+	s.psmux.RUnlock()
+	for _, agent := range agents {
+		if IsTopicPattern(agent.Name) || len(trie.Match(agent.Name)) == 0 {
+			continue
+		}
+		if retained := agent.Retained(); retained != nil {
+			c.PushMsg(tp.newMessage(s, retained, 0), arpc.TimeZero)
+		}
+	}
+}
+
 // PublishToOne topic
 func (s *Server) PublishToOne(topicName string, v interface{}) error {
 	topic, err := newTopic(topicName, util.ValueToBytes(s.Codec, v))
@@ -62,6 +153,42 @@ func (s *Server) PublishToOne(topicName string, v interface{}) error {
 	return nil
 }
 
+// PublishState publishes topic data as a state snapshot with delta encoding
+func (s *Server) PublishState(topicName string, v interface{}) error {
+	topic, err := newTopic(topicName, util.ValueToBytes(s.Codec, v))
+	if err != nil {
+		return err
+	}
+	s.getOrMakeTopic(topic.Name).PublishDelta(s, nil, topic)
+	return nil
+}
+
+// SetTopicLimits sets publish rate limit and per subscriber delivery rate limit of topic, nil means unlimited
+func (s *Server) SetTopicLimits(topicName string, publish, deliver *RateLimit) error {
+	if topicName == "" {
+		return ErrInvalidTopicEmpty
+	}
+	if len(topicName) > MaxTopicNameLen {
+		return ErrInvalidTopicNameLength
+	}
+	tp := s.getOrMakeTopic(topicName)
+	tp.SetPublishLimit(publish)
+	tp.SetDeliverLimit(deliver)
+	return nil
+}
+
+// SetTopicConflation sets keep-latest delivery by key for slow subscribers of topic, nil disables it
+func (s *Server) SetTopicConflation(topicName string, key ConflateKeyFunc) error {
+	if topicName == "" {
+		return ErrInvalidTopicEmpty
+	}
+	if len(topicName) > MaxTopicNameLen {
+		return ErrInvalidTopicNameLength
+	}
+	s.getOrMakeTopic(topicName).SetConflation(key)
+	return nil
+}
+
 func (s *Server) invalid(ctx *arpc.Context) bool {
 	return ctx.Client.UserData == nil
 }
@@ -77,7 +204,7 @@ func (s *Server) onAuthenticate(ctx *arpc.Context) {
 		return
 	}
 
-	if passwd == s.Password {
+	if s.checkPassword(passwd) {
 		s.addClient(ctx.Client)
 		ctx.Write(nil)
 		log.Info("%v [Authenticate] success from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
@@ -87,6 +214,18 @@ func (s *Server) onAuthenticate(ctx *arpc.Context) {
 	}
 }
 
+func (s *Server) checkPassword(passwd string) bool {
+	if s.Keys != nil {
+		if i := strings.IndexByte(passwd, ':'); i >= 0 {
+			key, ok := s.Keys.Key(passwd[:i])
+			if ok && subtle.ConstantTimeCompare(key, []byte(passwd[i+1:])) == 1 {
+				return true
+			}
+		}
+	}
+	return passwd == s.Password
+}
+
 func (s *Server) onSubscribe(ctx *arpc.Context) {
 	defer util.Recover()
 
@@ -103,15 +242,32 @@ func (s *Server) onSubscribe(ctx *arpc.Context) {
 		return
 	}
 	topicName := topic.Name
+	req := parseSubRequest(topic.Data)
+	if IsTopicPattern(topicName) {
+		if err = validTopicPattern(topicName); err == nil && req.replay {
+			err = ErrReplayPattern
+		}
+		if err != nil {
+			ctx.Error(err)
+			log.Error("%v [Subscribe] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+			return
+		}
+	}
 	if topicName != "" {
 		cts := ctx.Client.UserData.(*clientTopics)
 		cts.mux.Lock()
 		tp, ok := cts.topicAgents[topicName]
 		if !ok {
 			tp = s.getOrMakeTopic(topicName)
+			if IsTopicPattern(topicName) {
+				s.patterns.Add(topicName)
+			}
 			cts.topicAgents[topicName] = tp
 			cts.mux.Unlock()
-			tp.Add(ctx.Client)
+			tp.subscribe(s, ctx.Client, req)
+			if IsTopicPattern(topicName) {
+				s.deliverRetained(tp, ctx.Client)
+			}
 			ctx.Write(nil)
 			log.Info("%v [Subscribe] [topic: '%v'] success from\t%v", s.Handler.LogTag(), topicName, ctx.Client.Conn.RemoteAddr())
 		} else {
@@ -146,7 +302,7 @@ func (s *Server) onUnsubscribe(ctx *arpc.Context) {
 		if ta, ok := cts.topicAgents[topicName]; ok {
 			delete(cts.topicAgents, topicName)
 			cts.mux.Unlock()
-			ta.Delete(ctx.Client)
+			s.deleteSubscriber(ta, ctx.Client)
 			ctx.Write(nil)
 			log.Info("%v [Unsubscribe] [topic: '%v'] success from\t%v", s.Handler.LogTag(), ta.Name, ctx.Client.Conn.RemoteAddr())
 		} else {
@@ -176,9 +332,14 @@ func (s *Server) onPublish(ctx *arpc.Context) {
 	}
 
 	topicName := topic.Name
+	if IsTopicPattern(topicName) {
+		ctx.Error(ErrPublishToPattern)
+		log.Error("%v [Publish] failed: %v, from\t%v", s.Handler.LogTag(), ErrPublishToPattern, ctx.Client.Conn.RemoteAddr())
+		return
+	}
 	if topicName != "" {
 		ctx.Write(nil)
-		s.getOrMakeTopic(topic.Name).Publish(s, ctx.Client, topic)
+		s.publish(ctx.Client, topic)
 		// log.Debug("%v [Publish] [%v], %v from\t%v", s.Handler.LogTag(), topicName, ctx.Client.Conn.RemoteAddr())
 	} else {
 		ctx.Error(ErrInvalidTopicEmpty)
@@ -186,6 +347,30 @@ func (s *Server) onPublish(ctx *arpc.Context) {
 	}
 }
 
+func (s *Server) onPublishRetained(ctx *arpc.Context) {
+	defer util.Recover()
+
+	if s.invalid(ctx) {
+		log.Error("%v [PublishRetained] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
+		return
+	}
+
+	topic := &Topic{}
+	err := topic.fromBytes(ctx.Body())
+	if err != nil {
+		ctx.Error(err)
+		log.Error("%v [PublishRetained] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		return
+	}
+
+	if err = s.publishRetained(ctx.Client, topic); err != nil {
+		ctx.Error(err)
+		log.Error("%v [PublishRetained] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		return
+	}
+	ctx.Write(nil)
+}
+
 func (s *Server) onPublishToOne(ctx *arpc.Context) {
 	defer util.Recover()
 
@@ -212,6 +397,52 @@ func (s *Server) onPublishToOne(ctx *arpc.Context) {
 	}
 }
 
+func (s *Server) onDeltaAck(ctx *arpc.Context) {
+	defer util.Recover()
+
+	if s.invalid(ctx) {
+		log.Error("%v [DeltaAck] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
+		return
+	}
+
+	topic := &Topic{}
+	err := topic.fromBytes(ctx.Body())
+	if err != nil || len(topic.Data) != 8 {
+		log.Error("%v [DeltaAck] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		return
+	}
+	cts := ctx.Client.UserData.(*clientTopics)
+	cts.mux.RLock()
+	tp, ok := cts.topicAgents[topic.Name]
+	cts.mux.RUnlock()
+	if ok {
+		tp.ack(s, ctx.Client, binary.LittleEndian.Uint64(topic.Data))
+	}
+}
+
+func (s *Server) onDeliveryAck(ctx *arpc.Context) {
+	defer util.Recover()
+
+	if s.invalid(ctx) {
+		log.Error("%v [DeliveryAck] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
+		return
+	}
+
+	topic := &Topic{}
+	err := topic.fromBytes(ctx.Body())
+	if err != nil || len(topic.Data) != 8 {
+		log.Error("%v [DeliveryAck] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		return
+	}
+	cts := ctx.Client.UserData.(*clientTopics)
+	cts.mux.RLock()
+	tp, ok := cts.topicAgents[topic.Name]
+	cts.mux.RUnlock()
+	if ok {
+		tp.ackDelivery(ctx.Client, binary.LittleEndian.Uint64(topic.Data))
+	}
+}
+
 func (s *Server) getTopic(topic string) (*TopicAgent, bool) {
 	s.psmux.RLock()
 	tp, ok := s.topics[topic]
@@ -227,7 +458,7 @@ func (s *Server) getOrMakeTopic(topic string) *TopicAgent {
 		s.psmux.Lock()
 		tp, ok = s.topics[topic]
 		if !ok {
-			tp = newTopicAgent(topic)
+			tp = newTopicAgent(topic, s.Handler.Clock())
 			s.topics[topic] = tp
 		}
 		s.psmux.Unlock()
@@ -235,6 +466,14 @@ func (s *Server) getOrMakeTopic(topic string) *TopicAgent {
 	return tp
 }
 
+// deleteSubscriber deletes c from tp, patterns are not matched after their last subscriber left
+func (s *Server) deleteSubscriber(tp *TopicAgent, c *arpc.Client) {
+	tp.Delete(c)
+	if IsTopicPattern(tp.Name) {
+		s.patterns.Remove(tp.Name)
+	}
+}
+
 // addClient .
 func (s *Server) addClient(c *arpc.Client) {
 	c.UserData = &clientTopics{
@@ -253,7 +492,7 @@ func (s *Server) deleteClient(c *arpc.Client) {
 	cts.mux.RLock()
 	defer cts.mux.RUnlock()
 	for _, tp := range cts.topicAgents {
-		tp.Delete(c)
+		s.deleteSubscriber(tp, c)
 		log.Info("%v [Disconnected Unsubscribe] [topic: '%v'] from\t%v", s.Handler.LogTag(), tp.Name, c.Conn.RemoteAddr())
 	}
 }
@@ -262,9 +501,10 @@ func (s *Server) deleteClient(c *arpc.Client) {
 func NewServer() *Server {
 	s := arpc.NewServer()
 	svr := &Server{
-		Server:  s,
-		topics:  map[string]*TopicAgent{},
-		clients: map[*arpc.Client]map[string]*TopicAgent{},
+		Server:   s,
+		topics:   map[string]*TopicAgent{},
+		patterns: newTopicTrie(),
+		clients:  map[*arpc.Client]map[string]*TopicAgent{},
 	}
 	s.Handler.SetLogTag("[APS SVR]")
 	svr.Handler.Handle(routeAuthenticate, svr.onAuthenticate)
@@ -272,6 +512,9 @@ func NewServer() *Server {
 	svr.Handler.Handle(routeUnsubscribe, svr.onUnsubscribe)
 	svr.Handler.Handle(routePublish, svr.onPublish)
 	svr.Handler.Handle(routePublishToOne, svr.onPublishToOne)
+	svr.Handler.Handle(routePublishRetained, svr.onPublishRetained)
+	svr.Handler.Handle(routeDeltaAck, svr.onDeltaAck)
+	svr.Handler.Handle(routeDeliveryAck, svr.onDeliveryAck)
 
 	svr.Handler.HandleDisconnected(svr.deleteClient)
 	return svr
@@ -0,0 +1,87 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+)
+
+// MetaKeyOffset carries the stored offset of a published topic message
+const MetaKeyOffset = "aps-offset"
+
+// Store persists published topic messages for replay to durable subscribers
+type Store interface {
+	// Append stores topic and returns its offset, offsets of a topic start from 1 and increase by 1
+	Append(topic *Topic) (uint64, error)
+	// Range calls f in offset order for messages of topic with offset >= from and timestamp >= since,
+	// stops if f returns false
+	Range(topicName string, from uint64, since int64, f func(topic *Topic) bool) error
+}
+
+type memTopic struct {
+	next   uint64
+	topics []*Topic
+}
+
+// MemStore keeps the latest messages of each topic in memory
+type MemStore struct {
+	mux         sync.RWMutex
+	maxPerTopic int
+	topics      map[string]*memTopic
+}
+
+// Append implements Store
+func (s *MemStore) Append(topic *Topic) (uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	mt, ok := s.topics[topic.Name]
+	if !ok {
+		mt = &memTopic{next: 1}
+		s.topics[topic.Name] = mt
+	}
+	offset := mt.next
+	mt.next++
+	mt.topics = append(mt.topics, &Topic{
+		Name:      topic.Name,
+		Data:      append([]byte(nil), topic.Data...),
+		Timestamp: topic.Timestamp,
+		Offset:    offset,
+	})
+	if s.maxPerTopic > 0 && len(mt.topics) > s.maxPerTopic {
+		mt.topics = mt.topics[1:]
+	}
+	return offset, nil
+}
+
+// Range implements Store
+func (s *MemStore) Range(topicName string, from uint64, since int64, f func(topic *Topic) bool) error {
+	s.mux.RLock()
+	mt, ok := s.topics[topicName]
+	if !ok {
+		s.mux.RUnlock()
+		return nil
+	}
+	topics := mt.topics
+	s.mux.RUnlock()
+
+	i := sort.Search(len(topics), func(i int) bool {
+		return topics[i].Offset >= from
+	})
+	for ; i < len(topics); i++ {
+		if topics[i].Timestamp < since {
+			continue
+		}
+		if !f(topics[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// NewMemStore returns MemStore keeping at most maxPerTopic messages for each topic, 0 means unlimited
+func NewMemStore(maxPerTopic int) *MemStore {
+	return &MemStore{maxPerTopic: maxPerTopic, topics: map[string]*memTopic{}}
+}
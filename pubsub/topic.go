@@ -6,7 +6,9 @@ package pubsub
 
 import (
 	"encoding/binary"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lesismal/arpc"
@@ -17,6 +19,15 @@ import (
 const (
 	// MaxTopicNameLen .
 	MaxTopicNameLen = 1024
+
+	// MetaKeyRetained marks the retained value delivered on subscribing
+	MetaKeyRetained = "aps-retained"
+
+	replayTimeout = time.Second * 5
+
+	// replayPasses bounds the passes replaying messages stored while replaying, before catching up
+	// under the lock
+	replayPasses = 4
 )
 
 // TopicHandler .
@@ -27,7 +38,13 @@ type Topic struct {
 	Name      string
 	Data      []byte
 	Timestamp int64
-	raw       []byte
+	// Offset is set by Server.Store, 0 if the message is not stored
+	Offset uint64
+	// Retained is true if the message is the retained value delivered on subscribing
+	Retained bool
+	raw      []byte
+	// bridged is true if the message is imported by Bridge
+	bridged bool
 }
 
 func (tp *Topic) toBytes() ([]byte, error) {
@@ -75,34 +92,214 @@ type TopicAgent struct {
 	mux sync.RWMutex
 
 	clients map[*arpc.Client]util.Empty
+
+	publishLimiter *limiter
+	deliverLimit   *RateLimit
+	limiters       map[*arpc.Client]*limiter
+
+	// messages beyond limits of dry-run mode, accessed atomically
+	publishDryRuns uint64
+	deliverDryRuns uint64
+
+	conflateKey ConflateKeyFunc
+	conflaters  map[*arpc.Client]*conflater
+
+	inflights map[*arpc.Client]*inflight
+
+	clock arpc.Clock
+
+	retained *Topic
+
+	stateMux  sync.Mutex
+	version   uint64
+	snapshots []*snapshot
+	acked     map[*arpc.Client]uint64
 }
 
 // Add .
 func (t *TopicAgent) Add(c *arpc.Client) {
 	t.mux.Lock()
-	t.clients[c] = util.Empty{}
+	t.add(c, QoS0)
+	t.mux.Unlock()
+}
+
+// AddFrom adds c and replays stored messages with offset >= from and timestamp >= since before live messages
+func (t *TopicAgent) AddFrom(s *Server, c *arpc.Client, from uint64, since int64) {
+	t.subscribe(s, c, &subRequest{replay: true, from: from, since: since})
+}
+
+// subscribe adds c with options, replayed and retained messages are delivered with QoS0
+func (t *TopicAgent) subscribe(s *Server, c *arpc.Client, req *subRequest) {
+	next := req.from
+	if req.replay {
+		for i := 0; i < replayPasses; i++ {
+			from := next
+			if next = t.replay(s, c, from, req.since, replayTimeout); next == from {
+				break
+			}
+		}
+	}
+	t.mux.Lock()
+	if req.replay {
+		// messages stored since the last pass are pushed without waiting as live messages are,
+		// publishing is blocked until c is added but not by a slow subscriber
+		t.replay(s, c, next, req.since, arpc.TimeZero)
+	} else if t.retained != nil {
+		c.PushMsg(t.newMessage(s, t.retained, 0), arpc.TimeZero)
+	}
+	t.add(c, req.qos)
 	t.mux.Unlock()
 }
 
+func (t *TopicAgent) replay(s *Server, c *arpc.Client, from uint64, since int64, timeout time.Duration) uint64 {
+	if s.Store == nil {
+		return from
+	}
+	err := s.Store.Range(t.Name, from, since, func(topic *Topic) bool {
+		tp := &Topic{Name: topic.Name, Data: append([]byte(nil), topic.Data...), Timestamp: topic.Timestamp, Offset: topic.Offset}
+		tp.toBytes()
+		if err := c.PushMsg(t.newMessage(s, tp, 0), timeout); err != nil {
+			log.Error("%v [Replay] [topic: '%v'] failed %v, to\t%v", s.Handler.LogTag(), t.Name, err, c.Conn.RemoteAddr())
+			return false
+		}
+		from = topic.Offset + 1
+		return true
+	})
+	if err != nil {
+		log.Error("%v [Replay] [topic: '%v'] failed %v, to\t%v", s.Handler.LogTag(), t.Name, err, c.Conn.RemoteAddr())
+	}
+	return from
+}
+
+func (t *TopicAgent) add(c *arpc.Client, qos byte) {
+	t.clients[c] = util.Empty{}
+	if qos == QoS1 {
+		if _, ok := t.inflights[c]; !ok {
+			t.inflights[c] = newInflight(t.clock)
+		}
+	} else if f, ok := t.inflights[c]; ok {
+		f.stop()
+		delete(t.inflights, c)
+	}
+	if l := newLimiter(t.deliverLimit, t.clock, &t.deliverDryRuns); l != nil {
+		t.limiters[c] = l
+	}
+	if t.conflateKey != nil {
+		// messages pending of the previous subscription are dropped
+		if cf, ok := t.conflaters[c]; ok {
+			cf.stop()
+		}
+		t.conflaters[c] = newConflater()
+	}
+}
+
 // Delete .
 func (t *TopicAgent) Delete(c *arpc.Client) {
 	t.mux.Lock()
 	delete(t.clients, c)
+	if l, ok := t.limiters[c]; ok {
+		l.stop()
+		delete(t.limiters, c)
+	}
+	if cf, ok := t.conflaters[c]; ok {
+		cf.stop()
+		delete(t.conflaters, c)
+	}
+	if f, ok := t.inflights[c]; ok {
+		f.stop()
+		delete(t.inflights, c)
+	}
+	t.mux.Unlock()
+
+	t.stateMux.Lock()
+	delete(t.acked, c)
+	t.stateMux.Unlock()
+}
+
+// SetPublishLimit sets rate limit of publishing to the topic, nil means unlimited
+func (t *TopicAgent) SetPublishLimit(limit *RateLimit) {
+	t.mux.Lock()
+	if t.publishLimiter != nil {
+		t.publishLimiter.stop()
+	}
+	t.publishLimiter = newLimiter(limit, t.clock, &t.publishDryRuns)
+	t.mux.Unlock()
+}
+
+// SetDeliverLimit sets rate limit of delivering to each subscriber, nil means unlimited
+func (t *TopicAgent) SetDeliverLimit(limit *RateLimit) {
+	t.mux.Lock()
+	t.deliverLimit = limit
+	for c, l := range t.limiters {
+		l.stop()
+		delete(t.limiters, c)
+	}
+	for c := range t.clients {
+		if l := newLimiter(limit, t.clock, &t.deliverDryRuns); l != nil {
+			t.limiters[c] = l
+		}
+	}
+	t.mux.Unlock()
+}
+
+// DryRuns returns numbers of messages published and delivered beyond rate limits of dry-run mode
+func (t *TopicAgent) DryRuns() (publish, deliver uint64) {
+	return atomic.LoadUint64(&t.publishDryRuns), atomic.LoadUint64(&t.deliverDryRuns)
+}
+
+// SetConflation enables keep-latest delivery: when a subscriber's send queue is full, only the latest
+// pending message of each key is kept and delivered when the subscriber catches up, nil disables it
+func (t *TopicAgent) SetConflation(key ConflateKeyFunc) {
+	t.mux.Lock()
+	t.conflateKey = key
+	for c, cf := range t.conflaters {
+		cf.stop()
+		delete(t.conflaters, c)
+	}
+	if key != nil {
+		for c := range t.clients {
+			t.conflaters[c] = newConflater()
+		}
+	}
 	t.mux.Unlock()
 }
 
 // Publish .
 func (t *TopicAgent) Publish(s *Server, from *arpc.Client, topic *Topic) {
-	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
 	t.mux.RLock()
+	l := t.publishLimiter
+	t.mux.RUnlock()
+	if l == nil {
+		t.publish(s, from, topic)
+		return
+	}
+	if !l.do(func() { t.publish(s, from, topic) }) {
+		log.Debug("%v [Publish] [topic: '%v'] rate limited", s.Handler.LogTag(), topic.Name)
+	}
+}
+
+func (t *TopicAgent) publish(s *Server, from *arpc.Client, topic *Topic) {
+	t.mux.RLock()
+	// messages delivered by patterns are stored by the topic itself
+	if s.Store != nil && t.Name == topic.Name {
+		offset, err := s.Store.Append(topic)
+		if err == nil {
+			topic.Offset = offset
+		} else {
+			log.Error("%v [Publish] [topic: '%v'] store failed %v", s.Handler.LogTag(), topic.Name, err)
+		}
+	}
+	msg := t.newMessage(s, topic, 0)
+	key := ""
+	if t.conflateKey != nil {
+		key = t.conflateKey(topic)
+	}
 	for to := range t.clients {
-		err := to.PushMsg(msg, arpc.TimeZero)
-		if err != nil {
-			if from != nil {
-				log.Error("[Publish] [topic: '%v'] failed %v, from\t%v\tto\t%v", topic.Name, err, from.Conn.RemoteAddr(), to.Conn.RemoteAddr())
-			} else {
-				log.Error("[Publish] [topic: '%v'] failed %v, from Server to\t%v", topic.Name, err, to.Conn.RemoteAddr())
-			}
+		d := delivery{to: to, conflater: t.conflaters[to], inflight: t.inflights[to]}
+		if l, ok := t.limiters[to]; ok {
+			l.do(func() { t.pushTo(s, msg, from, topic, key, d) })
+		} else {
+			t.pushTo(s, msg, from, topic, key, d)
 		}
 	}
 	t.mux.RUnlock()
@@ -113,8 +310,71 @@ func (t *TopicAgent) Publish(s *Server, from *arpc.Client, topic *Topic) {
 	}
 }
 
+// delivery is the subscriber and its delivery state, resolved under t.mux
+type delivery struct {
+	to        *arpc.Client
+	conflater *conflater
+	inflight  *inflight
+}
+
+func (t *TopicAgent) pushTo(s *Server, msg *arpc.Message, from *arpc.Client, topic *Topic, key string, d delivery) {
+	var err error
+	to := d.to
+	switch {
+	case d.inflight != nil:
+		err = d.inflight.deliver(to, func(id uint64) *arpc.Message { return t.newMessage(s, topic, id) })
+	case d.conflater != nil:
+		err = d.conflater.push(to, key, msg)
+	default:
+		err = to.PushMsg(msg, arpc.TimeZero)
+	}
+	if err != nil {
+		if from != nil {
+			log.Error("[Publish] [topic: '%v'] failed %v, from\t%v\tto\t%v", topic.Name, err, from.Conn.RemoteAddr(), to.Conn.RemoteAddr())
+		} else {
+			log.Error("[Publish] [topic: '%v'] failed %v, from Server to\t%v", topic.Name, err, to.Conn.RemoteAddr())
+		}
+	}
+}
+
+// PublishRetained publishes topic and keeps it as the retained value delivered to new subscribers,
+// topic with empty data clears the retained value and is not published
+func (t *TopicAgent) PublishRetained(s *Server, from *arpc.Client, topic *Topic) {
+	t.mux.Lock()
+	if len(topic.Data) == 0 {
+		t.retained = nil
+		t.mux.Unlock()
+		return
+	}
+	retained := &Topic{Name: topic.Name, Data: append([]byte(nil), topic.Data...), Timestamp: topic.Timestamp, Retained: true}
+	retained.toBytes()
+	t.retained = retained
+	t.mux.Unlock()
+	t.Publish(s, from, topic)
+}
+
+// Retained returns the retained value of the topic, nil if none
+func (t *TopicAgent) Retained() *Topic {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return t.retained
+}
+
 // PublishToOne .
 func (t *TopicAgent) PublishToOne(s *Server, from *arpc.Client, topic *Topic) {
+	t.mux.RLock()
+	l := t.publishLimiter
+	t.mux.RUnlock()
+	if l == nil {
+		t.publishToOne(s, from, topic)
+		return
+	}
+	if !l.do(func() { t.publishToOne(s, from, topic) }) {
+		log.Debug("%v [PublishToOne] [topic: '%v'] rate limited", s.Handler.LogTag(), topic.Name)
+	}
+}
+
+func (t *TopicAgent) publishToOne(s *Server, from *arpc.Client, topic *Topic) {
 	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
 	t.mux.RLock()
 	for to := range t.clients {
@@ -137,9 +397,101 @@ func (t *TopicAgent) PublishToOne(s *Server, from *arpc.Client, topic *Topic) {
 	t.mux.RUnlock()
 }
 
-func newTopicAgent(topic string) *TopicAgent {
+// PublishDelta publishes topic data as a state snapshot, each subscriber receives
+// the diff against the last snapshot it acked, or the full snapshot
+func (t *TopicAgent) PublishDelta(s *Server, from *arpc.Client, topic *Topic) {
+	t.stateMux.Lock()
+	t.version++
+	curr := &snapshot{version: t.version, data: append([]byte(nil), topic.Data...)}
+	t.snapshots = keepSnapshot(t.snapshots, curr)
+	t.stateMux.Unlock()
+
+	t.mux.RLock()
+	for to := range t.clients {
+		tp := &Topic{Name: topic.Name, Data: encodeState(curr.version, t.ackedSnapshot(to), curr.data), Timestamp: topic.Timestamp}
+		raw, _ := tp.toBytes()
+		err := to.PushMsg(s.NewMessage(arpc.CmdNotify, routeDelta, raw), arpc.TimeZero)
+		if err != nil {
+			if from != nil {
+				log.Error("[PublishDelta] [topic: '%v'] failed %v, from\t%v\tto\t%v", topic.Name, err, from.Conn.RemoteAddr(), to.Conn.RemoteAddr())
+			} else {
+				log.Error("[PublishDelta] [topic: '%v'] failed %v, from Server to\t%v", topic.Name, err, to.Conn.RemoteAddr())
+			}
+		}
+	}
+	t.mux.RUnlock()
+}
+
+// ack records the snapshot version acked by c, version 0 means the delta base of c mismatched and
+// the latest snapshot is pushed to c in full at once
+func (t *TopicAgent) ack(s *Server, c *arpc.Client, version uint64) {
+	t.stateMux.Lock()
+	t.acked[c] = version
+	var latest *snapshot
+	if version == 0 && len(t.snapshots) > 0 {
+		latest = t.snapshots[len(t.snapshots)-1]
+	}
+	t.stateMux.Unlock()
+
+	if latest != nil {
+		tp := &Topic{Name: t.Name, Data: encodeState(latest.version, nil, latest.data), Timestamp: t.clock.Now().UnixNano()}
+		raw, _ := tp.toBytes()
+		err := c.PushMsg(s.NewMessage(arpc.CmdNotify, routeDelta, raw), arpc.TimeZero)
+		if err != nil {
+			log.Error("[PublishDelta] [topic: '%v'] full snapshot failed %v, to\t%v", t.Name, err, c.Conn.RemoteAddr())
+		}
+	}
+}
+
+func (t *TopicAgent) ackedSnapshot(c *arpc.Client) *snapshot {
+	t.stateMux.Lock()
+	defer t.stateMux.Unlock()
+	version, ok := t.acked[c]
+	if !ok {
+		return nil
+	}
+	return findSnapshot(t.snapshots, version)
+}
+
+// ackDelivery acks QoS1 message of c
+func (t *TopicAgent) ackDelivery(c *arpc.Client, id uint64) {
+	t.mux.RLock()
+	f, ok := t.inflights[c]
+	t.mux.RUnlock()
+	if ok {
+		f.ack(id)
+	}
+}
+
+func (t *TopicAgent) newMessage(s *Server, topic *Topic, delivery uint64) *arpc.Message {
+	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
+	md := arpc.Metadata{}
+	if delivery > 0 {
+		md[MetaKeyDelivery] = strconv.FormatUint(delivery, 10)
+	}
+	if topic.Offset > 0 {
+		md[MetaKeyOffset] = strconv.FormatUint(topic.Offset, 10)
+	}
+	if t.Name != topic.Name {
+		md[MetaKeyPattern] = t.Name
+	}
+	if topic.Retained {
+		md[MetaKeyRetained] = "1"
+	}
+	if len(md) > 0 {
+		msg.SetMeta(md)
+	}
+	return msg
+}
+
+func newTopicAgent(topic string, clock arpc.Clock) *TopicAgent {
 	return &TopicAgent{
-		Name:    topic,
-		clients: map[*arpc.Client]util.Empty{},
+		Name:       topic,
+		clock:      clock,
+		clients:    map[*arpc.Client]util.Empty{},
+		limiters:   map[*arpc.Client]*limiter{},
+		conflaters: map[*arpc.Client]*conflater{},
+		inflights:  map[*arpc.Client]*inflight{},
+		acked:      map[*arpc.Client]uint64{},
 	}
 }
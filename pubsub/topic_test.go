@@ -0,0 +1,130 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// newConflatedSubscriber returns agent of topic "prices" conflated by the first byte of messages,
+// and its subscriber with send queue full and the other side of its conn
+func newConflatedSubscriber(t *testing.T, s *Server) (*TopicAgent, *arpc.Client, net.Conn) {
+	conn, peer := net.Pipe()
+	c, err := arpc.NewClient(func() (net.Conn, error) { return conn, nil })
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	agent := newTopicAgent("prices", arpc.SystemClock)
+	agent.SetConflation(func(tp *Topic) string { return string(tp.Data[:1]) })
+	agent.Add(c)
+
+	// the peer doesn't read, fill the send queue until a message is held by the flusher blocked
+	cf := agent.conflaters[c]
+	state := func() (running bool, pending int) {
+		cf.mux.Lock()
+		defer cf.mux.Unlock()
+		return cf.running, len(cf.keys)
+	}
+	for i, blocked := 0, 0; blocked < 5; i++ {
+		if i >= 100000 {
+			t.Fatalf("send queue not full")
+		}
+		switch running, pending := state(); {
+		case !running:
+			blocked = 0
+			publishTo(t, s, agent, fmt.Sprintf("x%v", i))
+		case pending == 0:
+			blocked++
+			time.Sleep(time.Millisecond * 10)
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return agent, c, peer
+}
+
+func publishTo(t *testing.T, s *Server, agent *TopicAgent, data string) {
+	tp, err := newTopic(agent.Name, []byte(data))
+	if err != nil {
+		t.Fatalf("newTopic() error = %v", err)
+	}
+	tp.toBytes()
+	agent.Publish(s, nil, tp)
+}
+
+// readTopics reads messages of the peer until no more arrived, returns the latest data of each key
+// and numbers of messages of each key
+func readTopics(t *testing.T, peer net.Conn) (map[string]string, map[string]int) {
+	latest, counts := map[string]string{}, map[string]int{}
+	for {
+		head := make([]byte, arpc.HeadLen)
+		peer.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		if _, err := io.ReadFull(peer, head); err != nil {
+			return latest, counts
+		}
+		buf := make([]byte, arpc.HeadLen+arpc.Header(head).BodyLen())
+		copy(buf, head)
+		if _, err := io.ReadFull(peer, buf[arpc.HeadLen:]); err != nil {
+			t.Fatalf("read message error = %v", err)
+		}
+		tp := &Topic{}
+		if err := tp.fromBytes((&arpc.Message{Buffer: buf}).Data()); err != nil {
+			t.Fatalf("Topic.fromBytes() error = %v", err)
+		}
+		key := string(tp.Data[:1])
+		latest[key] = string(tp.Data)
+		counts[key]++
+	}
+}
+
+func TestTopicAgentConflation(t *testing.T) {
+	s := NewServer()
+	agent, c, peer := newConflatedSubscriber(t, s)
+	defer c.Stop()
+
+	for i := 1; i <= 5; i++ {
+		publishTo(t, s, agent, fmt.Sprintf("a%v", i))
+		publishTo(t, s, agent, fmt.Sprintf("b%v", i))
+	}
+	latest, counts := readTopics(t, peer)
+	for _, key := range []string{"a", "b"} {
+		if want := key + "5"; latest[key] != want || counts[key] != 1 {
+			t.Fatalf("received %v messages of key %v, the latest %v, want only %v", counts[key], key, latest[key], want)
+		}
+	}
+}
+
+func TestTopicAgentConflationStopped(t *testing.T) {
+	stops := map[string]func(agent *TopicAgent, c *arpc.Client){
+		"Delete":             func(agent *TopicAgent, c *arpc.Client) { agent.Delete(c) },
+		"SetConflation(nil)": func(agent *TopicAgent, c *arpc.Client) { agent.SetConflation(nil) },
+		"Add again":          func(agent *TopicAgent, c *arpc.Client) { agent.Add(c) },
+	}
+	for name, stop := range stops {
+		s := NewServer()
+		agent, c, peer := newConflatedSubscriber(t, s)
+		cf := agent.conflaters[c]
+		publishTo(t, s, agent, "a1")
+		publishTo(t, s, agent, "b1")
+		stop(agent, c)
+
+		cf.mux.Lock()
+		pending := len(cf.pending)
+		cf.mux.Unlock()
+		if pending != 0 {
+			t.Fatalf("%v: %v messages pending, want 0", name, pending)
+		}
+		if _, counts := readTopics(t, peer); counts["a"] != 0 || counts["b"] != 0 {
+			t.Fatalf("%v: received %v, want pending messages dropped", name, counts)
+		}
+		c.Stop()
+	}
+}
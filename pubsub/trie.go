@@ -0,0 +1,140 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// TopicSeparator separates topic levels
+	TopicSeparator = "/"
+	// WildcardOne matches exactly one topic level
+	WildcardOne = "+"
+	// WildcardMulti matches any number of remaining topic levels, must be the last level
+	WildcardMulti = "#"
+
+	// MetaKeyPattern carries the subscribed pattern a message is delivered by
+	MetaKeyPattern = "aps-pattern"
+)
+
+// IsTopicPattern returns whether topic name contains wildcards
+func IsTopicPattern(topicName string) bool {
+	return strings.ContainsAny(topicName, WildcardOne+WildcardMulti)
+}
+
+func validTopicPattern(pattern string) error {
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		if !strings.ContainsAny(level, WildcardOne+WildcardMulti) {
+			continue
+		}
+		if level != WildcardOne && level != WildcardMulti {
+			return ErrInvalidTopicPattern
+		}
+		if level == WildcardMulti && i != len(levels)-1 {
+			return ErrInvalidTopicPattern
+		}
+	}
+	return nil
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// pattern ends at this node
+	pattern string
+	// subscriptions of pattern
+	refs int
+}
+
+// topicTrie matches topic names against wildcard patterns by level
+type topicTrie struct {
+	mux  sync.RWMutex
+	root *trieNode
+}
+
+// Add adds a subscription of pattern, it's matched until all subscriptions are removed
+func (t *topicTrie) Add(pattern string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	node := t.root
+	for _, level := range strings.Split(pattern, TopicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = &trieNode{children: map[string]*trieNode{}}
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.pattern = pattern
+	node.refs++
+}
+
+// Remove removes a subscription of pattern, the pattern and nodes left empty are removed with the
+// last one
+func (t *topicTrie) Remove(pattern string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	levels := strings.Split(pattern, TopicSeparator)
+	path := make([]*trieNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	if node.pattern != pattern {
+		return
+	}
+	if node.refs--; node.refs > 0 {
+		return
+	}
+	node.pattern = ""
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if child.pattern != "" || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// Match returns patterns matching topicName
+func (t *topicTrie) Match(topicName string) []string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	var patterns []string
+	levels := strings.Split(topicName, TopicSeparator)
+	var match func(node *trieNode, i int)
+	match = func(node *trieNode, i int) {
+		// "#" also matches the parent level, e.g. "logs/#" matches "logs"
+		if multi, ok := node.children[WildcardMulti]; ok && multi.pattern != "" {
+			patterns = append(patterns, multi.pattern)
+		}
+		if i == len(levels) {
+			if node.pattern != "" {
+				patterns = append(patterns, node.pattern)
+			}
+			return
+		}
+		if child, ok := node.children[levels[i]]; ok {
+			match(child, i+1)
+		}
+		if one, ok := node.children[WildcardOne]; ok {
+			match(one, i+1)
+		}
+	}
+	match(t.root, 0)
+	return patterns
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: &trieNode{children: map[string]*trieNode{}}}
+}
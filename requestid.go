@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// MetaKeyRequestID carries the correlation id of a request across hops, it's set on requests by
+// callers and on responses by servers with request ids enabled, see Handler.SetRequestIDs
+const MetaKeyRequestID = "arpc-request-id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of parent carrying request id, Client.CallWith and NotifyWith
+// send the id with the message
+func WithRequestID(parent context.Context, id string) context.Context {
+	return context.WithValue(parent, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns request id carried by ctx
+func RequestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// NewRequestID returns a random request id
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *handler) RequestIDs() bool {
+	return h.load().requestIDs
+}
+
+func (h *handler) SetRequestIDs(enable bool) {
+	h.update(func(s *handlerState) { s.requestIDs = enable })
+}
+
+// RequestID returns request id of the message sent by the caller, a new one is generated if absent,
+// the same id is returned for the message later
+func (ctx *Context) RequestID() string {
+	if ctx.requestID == "" {
+		if id, ok := ctx.Meta().Get(MetaKeyRequestID); ok && id != "" {
+			ctx.requestID = id
+		} else {
+			ctx.requestID = NewRequestID()
+		}
+	}
+	return ctx.requestID
+}
+
+// RequestContext returns context carrying RequestID, calls to other services with it propagate the id,
+// and are linked to the span of ctx if traced, see Handler.SetTracer
+func (ctx *Context) RequestContext() context.Context {
+	rctx := WithRequestID(context.Background(), ctx.RequestID())
+	if ctx.span != nil {
+		rctx = WithParentSpan(rctx, ctx.span.ID)
+	}
+	return rctx
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRequestID(t *testing.T) {
+	newTestServer := func(handle func(ctx *Context)) (*Server, string) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		svr := NewServer()
+		svr.Handler.SetRequestIDs(true)
+		svr.Handler.Handle("/requestid", handle)
+		go svr.Serve(ln)
+		return svr, ln.Addr().String()
+	}
+	dial := func(addr string) *Client {
+		SetRequestIDs(true)
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, time.Second)
+		})
+		SetRequestIDs(false)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		return c
+	}
+
+	svrB, addrB := newTestServer(func(ctx *Context) {
+		ctx.Write(ctx.RequestID())
+	})
+	defer svrB.Stop()
+	cb := dial(addrB)
+	defer cb.Stop()
+
+	// a calls b with the request id propagated
+	svrA, addrA := newTestServer(func(ctx *Context) {
+		rsp := ""
+		if err := cb.CallWith(ctx.RequestContext(), "/requestid", nil, &rsp); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(rsp)
+	})
+	defer svrA.Stop()
+	ca := dial(addrA)
+	defer ca.Stop()
+
+	rsp := ""
+	ctx, cancel := context.WithTimeout(WithRequestID(context.Background(), "abc"), time.Second)
+	defer cancel()
+	if err := ca.CallWith(ctx, "/requestid", nil, &rsp); err != nil || rsp != "abc" {
+		t.Fatalf("Client.CallWith() = (%v, %v), want abc propagated", rsp, err)
+	}
+	if err := ca.Call("/requestid", nil, &rsp, time.Second); err != nil || len(rsp) != 16 {
+		t.Fatalf("Client.Call() = (%v, %v), want id generated", rsp, err)
+	}
+
+	// the id is responded in metadata
+	done := make(chan string, 1)
+	err := cb.CallAsync("/requestid", nil, func(ctx *Context) {
+		id, _ := ctx.Meta().Get(MetaKeyRequestID)
+		body := ""
+		ctx.Bind(&body)
+		if id != body {
+			id = ""
+		}
+		done <- id
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	select {
+	case id := <-done:
+		if len(id) != 16 {
+			t.Fatalf("response id = %q, want the id of the request", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CallAsync timeout")
+	}
+}
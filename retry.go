@@ -0,0 +1,119 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// MetaKeyRetryAfter is set on error responses by Context.SetRetryAfter, value is milliseconds
+// the caller should wait before retrying
+const MetaKeyRetryAfter = "arpc-retry-after"
+
+// RetryAfterError wraps error responses with a retry-after hint of the server
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+// Error implements error
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error responded
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// SetRetryAfter hints the caller to retry after d, e.g. when the server is busy, it should be
+// called before Error, callers get a RetryAfterError and CallRetry waits for at least d
+func (ctx *Context) SetRetryAfter(d time.Duration) {
+	ctx.SetResponseMeta(MetaKeyRetryAfter, strconv.FormatInt(int64(d/time.Millisecond), 10))
+}
+
+// withRetryAfter wraps err with the retry-after hint of rsp if any
+func withRetryAfter(rsp *Message, err error) error {
+	if !rsp.HasMeta() {
+		return err
+	}
+	v, ok := rsp.Meta().Get(MetaKeyRetryAfter)
+	if !ok {
+		return err
+	}
+	ms, perr := strconv.ParseInt(v, 10, 64)
+	if perr != nil || ms < 0 {
+		return err
+	}
+	return &RetryAfterError{Err: err, After: time.Duration(ms) * time.Millisecond}
+}
+
+// RetryPolicy defines retries of CallRetry with exponential backoff and full jitter, a retry-after
+// hint of the server is honored with jitter added, so callers rejected together spread out
+type RetryPolicy struct {
+	// MaxAttempts is the max number of calls including the first, 1 if less than 1
+	MaxAttempts int
+	// Backoff is the base delay doubled after each retry
+	Backoff time.Duration
+	// MaxBackoff limits delay of Backoff, 0 means no limit
+	MaxBackoff time.Duration
+	// Retryable returns whether err should be retried, errors with retry-after hints, responses of
+	// StatusCodeUnavailable and ErrClientReconnecting are retried by default
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is used by CallRetry if policy is nil
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond * 100,
+	MaxBackoff:  time.Second * 5,
+}
+
+// IsRetryable returns whether err should be retried by the policy
+func (p *RetryPolicy) IsRetryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	var ra *RetryAfterError
+	var se *StatusError
+	return errors.As(err, &ra) || (errors.As(err, &se) && se.Code == StatusCodeUnavailable) ||
+		err == ErrClientReconnecting
+}
+
+// Delay returns wait time before the retry-th retry, retry starts from 0
+func (p *RetryPolicy) Delay(retry int, err error) time.Duration {
+	backoff := p.Backoff << uint(retry)
+	if backoff < p.Backoff || (p.MaxBackoff > 0 && backoff > p.MaxBackoff) {
+		backoff = p.MaxBackoff
+	}
+	var d time.Duration
+	if backoff > 0 {
+		d = time.Duration(rand.Int63n(int64(backoff) + 1))
+	}
+	var ra *RetryAfterError
+	if errors.As(err, &ra) && ra.After > 0 {
+		d += ra.After
+	}
+	return d
+}
+
+// CallRetry makes rpc call with timeout of each attempt, and retries by policy
+func (c *Client) CallRetry(method string, req interface{}, rsp interface{}, timeout time.Duration, policy *RetryPolicy) error {
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	for retry := 0; ; retry++ {
+		err := c.Call(method, req, rsp, timeout)
+		if err == nil || retry+1 >= policy.MaxAttempts || !policy.IsRetryable(err) {
+			return err
+		}
+		if !sleep(c.Handler.Clock(), policy.Delay(retry, err), c.chClose) {
+			return err
+		}
+	}
+}
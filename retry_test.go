@@ -0,0 +1,66 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_CallRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var calls int32
+	svr := NewServer()
+	svr.Handler.Handle("/retry/busy", func(ctx *Context) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			ctx.SetRetryAfter(time.Millisecond * 50)
+			ctx.Error("server busy")
+			return
+		}
+		ctx.Write("ok")
+	})
+	svr.Handler.Handle("/retry/fail", func(ctx *Context) {
+		atomic.AddInt32(&calls, 1)
+		ctx.Error("failed")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	var ra *RetryAfterError
+	err = c.Call("/retry/busy", nil, nil, time.Second)
+	if !errors.As(err, &ra) || ra.After != time.Millisecond*50 || err.Error() != "server busy" {
+		t.Fatalf("Client.Call() error = %v, want RetryAfterError of 50ms", err)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	begin := time.Now()
+	var rsp string
+	if err = c.CallRetry("/retry/busy", nil, &rsp, time.Second, policy); err != nil || rsp != "ok" {
+		t.Fatalf("Client.CallRetry() = (%v, %v), want (ok, nil)", rsp, err)
+	}
+	if used := time.Since(begin); used < time.Millisecond*100 {
+		t.Fatalf("Client.CallRetry() used %v, want at least 100ms of retry-after hints", used)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	if err = c.CallRetry("/retry/fail", nil, nil, time.Second, policy); err == nil || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("Client.CallRetry() error = %v, calls = %v, want error without retries", err, calls)
+	}
+}
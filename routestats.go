@@ -0,0 +1,132 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets counts latencies in power of two microseconds, the last one counts the rest
+const latencyBuckets = 32
+
+// deprecatedWarnInterval is the least interval of warnings logged for calls of a deprecated method
+const deprecatedWarnInterval = time.Minute
+
+// RouteStats defines counters of a route, latency percentiles are estimated by upper bounds of
+// power of two buckets
+type RouteStats struct {
+	Calls    uint64
+	Errors   uint64
+	BytesIn  uint64
+	BytesOut uint64
+	// Deprecated counts calls of the route marked by WithDeprecated
+	Deprecated uint64
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+}
+
+// routeStats counts messages handled by a route, see Handler.SetRouteStats
+type routeStats struct {
+	calls    uint64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+	// deprecated counts calls of a deprecated route, warned is the unix nano of the last warning
+	deprecated uint64
+	warned     int64
+	latency    [latencyBuckets]uint64
+}
+
+// record counts msg handled by ctx since start, rs is nil if route stats disabled
+func (rs *routeStats) record(ctx *Context, start time.Time) {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.calls, 1)
+	atomic.AddUint64(&rs.bytesIn, uint64(ctx.Message.Len()))
+	if ctx.err != nil {
+		atomic.AddUint64(&rs.errors, 1)
+	}
+	us := uint64(ctx.Client.Handler.Clock().Now().Sub(start) / time.Microsecond)
+	i := bits.Len64(us)
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddUint64(&rs.latency[i], 1)
+}
+
+func (rs *routeStats) addBytesOut(n int) {
+	if rs != nil {
+		atomic.AddUint64(&rs.bytesOut, uint64(n))
+	}
+}
+
+// deprecatedCall counts a call of the deprecated route, it returns calls counted and whether a
+// warning should be logged now
+func (rs *routeStats) deprecatedCall(now time.Time) (uint64, bool) {
+	return atomic.AddUint64(&rs.deprecated, 1), warnDue(&rs.warned, now)
+}
+
+// warnDue reports whether a warning is due at now, at most once per deprecatedWarnInterval since the
+// last one at unix nano *last
+func warnDue(last *int64, now time.Time) bool {
+	prev := atomic.LoadInt64(last)
+	if prev != 0 && now.UnixNano()-prev < int64(deprecatedWarnInterval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(last, prev, now.UnixNano())
+}
+
+func (rs *routeStats) snapshot() RouteStats {
+	st := RouteStats{
+		Calls:      atomic.LoadUint64(&rs.calls),
+		Errors:     atomic.LoadUint64(&rs.errors),
+		BytesIn:    atomic.LoadUint64(&rs.bytesIn),
+		BytesOut:   atomic.LoadUint64(&rs.bytesOut),
+		Deprecated: atomic.LoadUint64(&rs.deprecated),
+	}
+	var (
+		counts [latencyBuckets]uint64
+		total  uint64
+	)
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&rs.latency[i])
+		total += counts[i]
+	}
+	percentile := func(p uint64) time.Duration {
+		if total == 0 {
+			return 0
+		}
+		rank := (total*p + 99) / 100
+		var n uint64
+		for i, cnt := range counts {
+			n += cnt
+			if n >= rank {
+				return time.Microsecond << uint(i)
+			}
+		}
+		return time.Microsecond << uint(latencyBuckets-1)
+	}
+	st.P50, st.P95, st.P99 = percentile(50), percentile(95), percentile(99)
+	return st
+}
+
+func (h *handler) RouteStats() map[string]RouteStats {
+	s := h.load()
+	stats := make(map[string]RouteStats, len(s.routes))
+	for method, rh := range s.routes {
+		if method != "" && rh.stats != nil {
+			stats[method] = rh.stats.snapshot()
+		}
+	}
+	return stats
+}
+
+func (h *handler) SetRouteStats(enable bool) {
+	h.update(func(s *handlerState) { s.routeStats = enable && metricsEnabled })
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !arpc_nometrics
+// +build !arpc_nometrics
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetRouteStats(true)
+	svr.Handler.Handle("/stats/ok", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/stats/fail", func(ctx *Context) {
+		ctx.Error(errors.New("failed"))
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err = c.Call("/stats/ok", "hello", nil, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if err = c.Call("/stats/fail", "hello", nil, time.Second); err == nil {
+		t.Fatalf("Client.Call() error = nil, want error")
+	}
+
+	stats := svr.Handler.RouteStats()
+	ok, fail := stats["/stats/ok"], stats["/stats/fail"]
+	if ok.Calls != 3 || ok.Errors != 0 || ok.BytesIn == 0 || ok.BytesOut == 0 || ok.P99 == 0 {
+		t.Fatalf("RouteStats() /stats/ok = %+v", ok)
+	}
+	if fail.Calls != 1 || fail.Errors != 1 {
+		t.Fatalf("RouteStats() /stats/fail = %+v", fail)
+	}
+	if _, ok := stats[""]; ok {
+		t.Fatalf("RouteStats() contains not found route")
+	}
+	for method, st := range c.Handler.RouteStats() {
+		if st.Calls != 0 {
+			t.Fatalf("RouteStats() of disabled handler %v = %+v", method, st)
+		}
+	}
+}
+
+func TestRouteStats_Percentile(t *testing.T) {
+	rs := &routeStats{}
+	// 90 calls < 1us, 9 calls in [1us, 2us), 1 call in [512us, 1024us)
+	rs.latency[0], rs.latency[1], rs.latency[10] = 90, 9, 1
+	st := rs.snapshot()
+	if st.P50 != time.Microsecond || st.P95 != time.Microsecond*2 || st.P99 != time.Microsecond*2 {
+		t.Fatalf("snapshot() percentiles = %v, %v, %v", st.P50, st.P95, st.P99)
+	}
+	rs.latency[10] = 10
+	if st = rs.snapshot(); st.P99 != time.Microsecond*1024 {
+		t.Fatalf("snapshot() P99 = %v, want %v", st.P99, time.Microsecond*1024)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+
+	"github.com/lesismal/arpc/util"
+)
+
+type schedTask struct {
+	cost int
+	f    func()
+}
+
+// runQueue is the run queue of a connection
+type runQueue struct {
+	c       *Client
+	tasks   []schedTask
+	deficit int
+}
+
+// Scheduler is a shared pool of workers running handlers of async routes, see SetScheduler.
+// Each connection has its own run queue, and workers take tasks from the queues by deficit round
+// robin: a queue is credited Quantum each round and runs tasks while its credit covers their
+// cost, arpc.Context.Cost of the call, so one chatty connection can't monopolize the workers
+// even when others send few but heavy calls. Tasks of a connection are started in order
+type Scheduler struct {
+	// Quantum is cost credited to a run queue each round, 1 by default
+	Quantum int
+	// MaxQueue is tasks queued of a connection, Submit blocks the read loop of the connection
+	// when full to slow it down, 0 means no limit
+	MaxQueue int
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	full    *sync.Cond
+	queues  map[*Client]*runQueue
+	active  []*runQueue
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewScheduler returns Scheduler of workers started, quantum is cost credited to connections each round
+func NewScheduler(workers int, quantum int) *Scheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+	s := &Scheduler{Quantum: quantum, queues: map[*Client]*runQueue{}}
+	s.cond = sync.NewCond(&s.mux)
+	s.full = sync.NewCond(&s.mux)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go util.Safe(s.work)
+	}
+	return s
+}
+
+// Submit queues f of cost to the run queue of c, it returns false if the scheduler is stopped
+func (s *Scheduler) Submit(c *Client, cost int, f func()) bool {
+	if cost < 1 {
+		cost = 1
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	q := s.queues[c]
+	for !s.stopped && s.MaxQueue > 0 && q != nil && len(q.tasks) >= s.MaxQueue {
+		s.full.Wait()
+		q = s.queues[c]
+	}
+	if s.stopped {
+		return false
+	}
+	if q == nil {
+		q = &runQueue{c: c}
+		s.queues[c] = q
+		s.active = append(s.active, q)
+	}
+	q.tasks = append(q.tasks, schedTask{cost: cost, f: f})
+	s.cond.Signal()
+	return true
+}
+
+// Pending returns tasks queued of c
+func (s *Scheduler) Pending(c *Client) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if q, ok := s.queues[c]; ok {
+		return len(q.tasks)
+	}
+	return 0
+}
+
+// Stop stops accepting tasks and waits for the workers to run tasks queued
+func (s *Scheduler) Stop() {
+	s.mux.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.full.Broadcast()
+	s.mux.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) quantum() int {
+	if s.Quantum > 0 {
+		return s.Quantum
+	}
+	return 1
+}
+
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	for {
+		t, ok := s.next()
+		if !ok {
+			return
+		}
+		func() {
+			defer util.Recover()
+			t.f()
+		}()
+	}
+}
+
+// next takes the next task by deficit round robin, it returns false if stopped and nothing queued
+func (s *Scheduler) next() (schedTask, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for len(s.active) == 0 {
+		if s.stopped {
+			return schedTask{}, false
+		}
+		s.cond.Wait()
+	}
+	for {
+		q := s.active[0]
+		t := q.tasks[0]
+		if q.deficit < t.cost {
+			// the queue's turn ends, credited for the next round
+			q.deficit += s.quantum()
+			if len(s.active) > 1 {
+				copy(s.active, s.active[1:])
+				s.active[len(s.active)-1] = q
+			}
+			continue
+		}
+		q.deficit -= t.cost
+		q.tasks[0] = schedTask{}
+		q.tasks = q.tasks[1:]
+		if len(q.tasks) == 0 {
+			// idle queues don't keep credit
+			s.active[0] = nil
+			s.active = s.active[1:]
+			delete(s.queues, q.c)
+		}
+		s.full.Broadcast()
+		return t, true
+	}
+}
+
+func (h *handler) Scheduler() *Scheduler {
+	return h.load().scheduler
+}
+
+func (h *handler) SetScheduler(sched *Scheduler) {
+	h.update(func(s *handlerState) { s.scheduler = sched })
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(1, 2)
+	chatty, quiet, heavy := &Client{}, &Client{}, &Client{}
+
+	// the worker is blocked until all tasks are queued
+	gate := make(chan struct{})
+	s.Submit(chatty, 1, func() { <-gate })
+	time.Sleep(time.Millisecond * 10)
+
+	var mux sync.Mutex
+	var order []string
+	run := func(name string) func() {
+		return func() {
+			mux.Lock()
+			order = append(order, name)
+			mux.Unlock()
+		}
+	}
+	for i := 0; i < 6; i++ {
+		s.Submit(chatty, 1, run("c"))
+	}
+	s.Submit(quiet, 1, run("q"))
+	s.Submit(heavy, 4, run("h"))
+	if n := s.Pending(chatty); n != 6 {
+		t.Fatalf("Scheduler.Pending() = %v, want 6", n)
+	}
+	close(gate)
+	s.Stop()
+
+	want := []string{"c", "c", "q", "c", "c", "h", "c", "c"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("tasks run in order %v, want %v", order, want)
+	}
+	if s.Submit(quiet, 1, run("q")) {
+		t.Fatalf("Scheduler.Submit() = true after stopped")
+	}
+}
+
+func TestScheduler_MaxQueue(t *testing.T) {
+	s := NewScheduler(1, 1)
+	s.MaxQueue = 1
+	defer s.Stop()
+	c := &Client{}
+
+	gate := make(chan struct{})
+	s.Submit(c, 1, func() { <-gate })
+	time.Sleep(time.Millisecond * 10)
+	s.Submit(c, 1, func() {})
+
+	submitted := make(chan struct{})
+	go func() {
+		s.Submit(c, 1, func() {})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatalf("Scheduler.Submit() didn't block with the run queue full")
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(gate)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatalf("Scheduler.Submit() blocked after the run queue drained")
+	}
+}
+
+func TestHandler_SetScheduler(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	sched := NewScheduler(2, 1)
+	defer sched.Stop()
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetScheduler(sched)
+	svr.Handler.Handle("/sched/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	}, true)
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp := ""
+			if err := c.Call("/sched/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+				t.Errorf("Client.Call() = (%q, %v)", rsp, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -27,6 +27,10 @@ type Server struct {
 
 	Listener net.Listener
 
+	// ProxyProtocol requires PROXY protocol v1 or v2 header on accepted conns, e.g. behind TCP load
+	// balancers, conns without a valid header are closed, see Client.RealAddr
+	ProxyProtocol bool
+
 	mux sync.Mutex
 
 	seq     uint64
@@ -58,14 +62,51 @@ func (s *Server) Run(addr string) error {
 	return s.runLoop()
 }
 
+// ServeContext starts rpc service with listener until ctx is done, it returns nil if the service is
+// stopped by ctx, so it could be composed with other services, e.g. by errgroup
+func (s *Server) ServeContext(ctx context.Context, ln net.Listener) error {
+	s.Listener = ln
+	s.chStop = make(chan error)
+	log.Info("%v Running On: \"%v\"", s.Handler.LogTag(), ln.Addr())
+	defer log.Info("%v Stopped", s.Handler.LogTag())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-done:
+		}
+	}()
+	err := s.runLoop()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// RunContext starts a tcp service on addr until ctx is done, see ServeContext
+func (s *Server) RunContext(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Info("%v Running failed: %v", s.Handler.LogTag(), err)
+		return err
+	}
+	return s.ServeContext(ctx, ln)
+}
+
 // Stop rpc service
 func (s *Server) Stop() error {
+	if s.Listener == nil {
+		return s.stopHTTP()
+	}
 	defer log.Info("%v %v Stop", s.Handler.LogTag(), s.Listener.Addr())
 	s.running = false
 	s.Listener.Close()
 	select {
 	case <-s.chStop:
-	case <-time.After(time.Second):
+	case <-s.Handler.Clock().NewTimer(time.Second).C():
 		return ErrTimeout
 	default:
 	}
@@ -74,6 +115,9 @@ func (s *Server) Stop() error {
 
 // Shutdown stop rpc service
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.Listener == nil {
+		return s.stopHTTP()
+	}
 	defer log.Info("%v %v Shutdown", s.Handler.LogTag(), s.Listener.Addr())
 	s.running = false
 	s.Listener.Close()
@@ -90,6 +134,17 @@ func (s *Server) NewMessage(cmd byte, method string, v interface{}) *Message {
 	return newMessage(cmd, method, v, false, false, atomic.AddUint64(&s.seq, 1), s.Handler, s.Codec, nil)
 }
 
+// Clients returns connections of the server
+func (s *Server) Clients() []*Client {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
 func (s *Server) addLoad() int64 {
 	return atomic.AddInt64(&s.CurrLoad, 1)
 }
@@ -122,11 +177,13 @@ func (s *Server) clearClients() {
 func (s *Server) runLoop() error {
 	var (
 		err  error
-		cli  *Client
 		conn net.Conn
 	)
 
 	s.running = true
+	if s.Handler.GoroutineLabels() {
+		setGoroutineLabels(labelLoopAccept, labelSideServer, s.Listener.Addr().String())
+	}
 	defer func() {
 		s.clearClients()
 		close(s.chStop)
@@ -135,23 +192,17 @@ func (s *Server) runLoop() error {
 	for s.running {
 		conn, err = s.Listener.Accept()
 		if err == nil {
-			load := s.addLoad()
-			if s.MaxLoad <= 0 || load <= s.MaxLoad {
-				s.Accepted++
-				cli = newClientWithConn(conn, s.Codec, s.Handler, func(c *Client) {
-					s.deleteClient(c)
-					s.subLoad()
-				})
-				s.addClient(cli)
-				s.Handler.OnConnected(cli)
+			if s.ProxyProtocol {
+				// reading headers of slow conns should not block accepting
+				c := conn
+				go util.Safe(func() { s.acceptProxy(c) })
 			} else {
-				conn.Close()
-				s.subLoad()
+				s.accept(conn, nil)
 			}
 		} else {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				log.Error("%v Accept error: %v; retrying...", s.Handler.LogTag(), err)
-				time.Sleep(time.Second / 20)
+				sleep(s.Handler.Clock(), time.Second/20, nil)
 			} else {
 				log.Error("%v Accept error: %v", s.Handler.LogTag(), err)
 				break
@@ -162,6 +213,32 @@ func (s *Server) runLoop() error {
 	return err
 }
 
+func (s *Server) accept(conn net.Conn, realAddr net.Addr) {
+	load := s.addLoad()
+	if s.MaxLoad <= 0 || load <= s.MaxLoad {
+		atomic.AddInt64(&s.Accepted, 1)
+		cli := newClientWithRealAddr(conn, realAddr, s.Codec, s.Handler, func(c *Client) {
+			s.deleteClient(c)
+			s.subLoad()
+		})
+		s.addClient(cli)
+		s.Handler.OnConnected(cli)
+	} else {
+		conn.Close()
+		s.subLoad()
+	}
+}
+
+func (s *Server) acceptProxy(conn net.Conn) {
+	realAddr, err := readProxyHeader(conn)
+	if err != nil {
+		log.Warn("%v\t%v\tread proxy protocol header failed: %v", s.Handler.LogTag(), conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	s.accept(conn, realAddr)
+}
+
 // NewServer factory
 func NewServer() *Server {
 	h := DefaultHandler.Clone()
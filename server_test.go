@@ -116,6 +116,63 @@ func TestServer_Run(t *testing.T) {
 	svr.Stop()
 }
 
+func TestServer_ServeContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	chErr := make(chan error, 1)
+	go func() { chErr <- svr.ServeContext(ctx, ln) }()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	chRun := make(chan error, 1)
+	go func() { chRun <- c.Run(ctx) }()
+
+	cancel()
+	select {
+	case err := <-chErr:
+		if err != nil {
+			t.Fatalf("Server.ServeContext() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Server.ServeContext() not returned after ctx done")
+	}
+	select {
+	case err := <-chRun:
+		if err != nil {
+			t.Fatalf("Client.Run() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Client.Run() not returned after ctx done")
+	}
+
+	// the client stopped by others is an error
+	ln, err = net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr = NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+	c, err = NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	go c.Stop()
+	if err := c.Run(context.Background()); err != ErrClientStopped {
+		t.Fatalf("Client.Run() error = %v, want %v", err, ErrClientStopped)
+	}
+}
+
 func TestServer_Shutdown(t *testing.T) {
 	svr := NewServer()
 	go svr.Run(":8899")
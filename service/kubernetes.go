@@ -0,0 +1,416 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	watchRetryInterval = time.Second
+)
+
+// endpointSlice is the part of discovery.k8s.io/v1 EndpointSlice used
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// errWatchExpired is returned if the resource version of watching is too old, the list is fetched again
+var errWatchExpired = errors.New("watch expired")
+
+// EndpointSliceResolver is a Watcher of ready endpoints of a kubernetes service, it watches
+// EndpointSlices of the service by the API server, so Service tracks pods without a registry.
+// The service account of the pod should be allowed to list and watch endpointslices
+type EndpointSliceResolver struct {
+	// Namespace and Name of the service
+	Namespace string
+	Name      string
+	// Port is name of the port of endpoints, the first port if empty
+	Port string
+	// APIServer is the url of the API server
+	APIServer string
+	// Token is the bearer token of requests, used if TokenFile is empty
+	Token string
+	// TokenFile is the file of the bearer token, read by each request, since the kubelet rotates
+	// the projected service account token before it expires
+	TokenFile string
+	// Client sends requests to the API server
+	Client *http.Client
+	// Clock drives retrying of watching, arpc.SystemClock if nil, should be set before Resolve
+	Clock arpc.Clock
+
+	mux     sync.Mutex
+	slices  map[string][]string
+	version string
+	started bool
+	changes chan struct{}
+	chStop  chan util.Empty
+	stopped bool
+}
+
+// NewEndpointSliceResolver returns EndpointSliceResolver of service name in namespace with the
+// in-cluster config of the pod, namespace of the pod if namespace is empty
+func NewEndpointSliceResolver(namespace string, name string) (*EndpointSliceResolver, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	tokenFile := serviceAccountDir + "/token"
+	if _, err := readToken(tokenFile); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid ca of service account")
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &EndpointSliceResolver{
+		Namespace: namespace,
+		Name:      name,
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		TokenFile: tokenFile,
+		Client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}, nil
+}
+
+// Resolve implements Resolver, the first call lists endpoints and starts watching, others return
+// endpoints watched
+func (r *EndpointSliceResolver) Resolve() ([]string, error) {
+	r.mux.Lock()
+	if r.stopped {
+		r.mux.Unlock()
+		return nil, ErrServiceStopped
+	}
+	if r.started {
+		defer r.mux.Unlock()
+		return r.addrs(), nil
+	}
+	r.mux.Unlock()
+
+	if err := r.list(); err != nil {
+		return nil, err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.started {
+		r.started = true
+		r.init()
+		go util.Safe(r.watchLoop)
+	}
+	return r.addrs(), nil
+}
+
+// Changes implements Watcher
+func (r *EndpointSliceResolver) Changes() <-chan struct{} {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.init()
+	return r.changes
+}
+
+// Stop stops watching, Changes is closed
+func (r *EndpointSliceResolver) Stop() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	r.init()
+	close(r.chStop)
+	close(r.changes)
+}
+
+// init makes channels of r, r.mux should be held
+func (r *EndpointSliceResolver) init() {
+	if r.changes == nil {
+		r.changes = make(chan struct{}, 1)
+		r.chStop = make(chan util.Empty)
+	}
+}
+
+// addrs returns ready endpoints of all slices sorted, r.mux should be held
+func (r *EndpointSliceResolver) addrs() []string {
+	var addrs []string
+	for _, slice := range r.slices {
+		addrs = append(addrs, slice...)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (r *EndpointSliceResolver) url(watch bool, version string) string {
+	q := url.Values{}
+	q.Set("labelSelector", "kubernetes.io/service-name="+r.Name)
+	if watch {
+		q.Set("watch", "true")
+		q.Set("allowWatchBookmarks", "true")
+		q.Set("resourceVersion", version)
+	}
+	return fmt.Sprintf("%v/apis/discovery.k8s.io/v1/namespaces/%v/endpointslices?%v",
+		strings.TrimSuffix(r.APIServer, "/"), url.PathEscape(r.Namespace), q.Encode())
+}
+
+func (r *EndpointSliceResolver) get(rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := r.Token
+	if r.TokenFile != "" {
+		if token, err = readToken(r.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		if rsp.StatusCode == http.StatusGone {
+			return nil, errWatchExpired
+		}
+		return nil, fmt.Errorf("kubernetes api: %v", rsp.Status)
+	}
+	return rsp, nil
+}
+
+// readToken reads the bearer token of file
+func readToken(file string) (string, error) {
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// list fetches all slices of the service
+func (r *EndpointSliceResolver) list() error {
+	rsp, err := r.get(r.url(false, ""))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	list := &endpointSliceList{}
+	if err := json.NewDecoder(rsp.Body).Decode(list); err != nil {
+		return err
+	}
+	slices := make(map[string][]string, len(list.Items))
+	for i := range list.Items {
+		slices[list.Items[i].Metadata.Name] = r.ready(&list.Items[i])
+	}
+	r.mux.Lock()
+	r.slices, r.version = slices, list.Metadata.ResourceVersion
+	r.mux.Unlock()
+	r.notify()
+	return nil
+}
+
+// watch applies events of slices until the stream ends or fails
+func (r *EndpointSliceResolver) watch() error {
+	r.mux.Lock()
+	version := r.version
+	r.mux.Unlock()
+	rsp, err := r.get(r.url(true, version))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	done := make(chan util.Empty)
+	defer close(done)
+	go func() {
+		select {
+		case <-r.chStop:
+			rsp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	decoder := json.NewDecoder(bufio.NewReader(rsp.Body))
+	for {
+		event := &watchEvent{}
+		if err := decoder.Decode(event); err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			// metav1.Status, 410 if the version is too old
+			status := &struct {
+				Code int `json:"code"`
+			}{}
+			json.Unmarshal(event.Object, status)
+			if status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return fmt.Errorf("kubernetes api: watch error %s", event.Object)
+		}
+		slice := &endpointSlice{}
+		if err := json.Unmarshal(event.Object, slice); err != nil {
+			return err
+		}
+		r.mux.Lock()
+		if slice.Metadata.ResourceVersion != "" {
+			r.version = slice.Metadata.ResourceVersion
+		}
+		changed := true
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			r.slices[slice.Metadata.Name] = r.ready(slice)
+		case "DELETED":
+			delete(r.slices, slice.Metadata.Name)
+		default:
+			changed = false
+		}
+		r.mux.Unlock()
+		if changed {
+			r.notify()
+		}
+	}
+}
+
+func (r *EndpointSliceResolver) watchLoop() {
+	clock := r.Clock
+	if clock == nil {
+		clock = arpc.SystemClock
+	}
+	for {
+		err := r.watch()
+		select {
+		case <-r.chStop:
+			return
+		default:
+		}
+		switch err {
+		case io.EOF:
+			// the API server ends watching by its timeout
+			continue
+		case errWatchExpired:
+			err = r.list()
+		}
+		if err != nil {
+			log.Warn("[Service] watch endpointslices of %v/%v failed: %v", r.Namespace, r.Name, err)
+			timer := clock.NewTimer(watchRetryInterval)
+			select {
+			case <-timer.C():
+			case <-r.chStop:
+				timer.Stop()
+				return
+			}
+			// events may be missed while failing
+			if err := r.list(); err != nil {
+				log.Warn("[Service] list endpointslices of %v/%v failed: %v", r.Namespace, r.Name, err)
+			}
+		}
+	}
+}
+
+// notify notifies a change without blocking, changes not consumed are merged
+func (r *EndpointSliceResolver) notify() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stopped || r.changes == nil {
+		return
+	}
+	select {
+	case r.changes <- struct{}{}:
+	default:
+	}
+}
+
+// ready returns addresses of ready endpoints of slice with the port
+func (r *EndpointSliceResolver) ready(slice *endpointSlice) []string {
+	port := -1
+	for _, p := range slice.Ports {
+		if p.Port != nil && (r.Port == "" || (p.Name != nil && *p.Name == r.Port)) {
+			port = int(*p.Port)
+			break
+		}
+	}
+	if port < 0 {
+		if len(slice.Endpoints) > 0 {
+			log.Warn("[Service] endpointslice %v: %v [%v]", slice.Metadata.Name, ErrNoEndpointPort, r.Port)
+		}
+		return nil
+	}
+	var addrs []string
+	for _, e := range slice.Endpoints {
+		// nil means ready
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+		for _, addr := range e.Addresses {
+			addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(port)))
+		}
+	}
+	return addrs
+}
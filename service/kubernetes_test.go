@@ -0,0 +1,169 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func sliceJSON(name string, version string, port string, ready bool, ips ...string) string {
+	endpoints := ""
+	for i, ip := range ips {
+		if i > 0 {
+			endpoints += ","
+		}
+		endpoints += fmt.Sprintf(`{"addresses":[%q],"conditions":{"ready":%v}}`, ip, ready)
+	}
+	return fmt.Sprintf(`{"metadata":{"name":%q,"resourceVersion":%q},"endpoints":[%v],"ports":[{"name":"arpc","port":%v}]}`,
+		name, version, endpoints, port)
+}
+
+func TestEndpointSliceResolver(t *testing.T) {
+	svrA, addrA := newServer(t, "a")
+	defer svrA.Stop()
+	svrB, addrB := newServer(t, "b")
+	defer svrB.Stop()
+	hostA, portA, _ := net.SplitHostPort(addrA)
+	_, portB, _ := net.SplitHostPort(addrB)
+
+	events := make(chan string, 4)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=echo" ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":[%v]}`, sliceJSON("echo-a", "1", portA, true, hostA))
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer api.Close()
+
+	r := &EndpointSliceResolver{Namespace: "default", Name: "echo", Port: "arpc", APIServer: api.URL, Token: "token"}
+	defer r.Stop()
+	s, err := New("echo", r, WithRefreshInterval(0))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+
+	waitAddrs := func(want []string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if addrs := s.Addrs(); reflect.DeepEqual(addrs, want) || (len(addrs) == 0 && len(want) == 0) {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("Service.Addrs() = %v, want %v", s.Addrs(), want)
+	}
+	waitAddrs([]string{addrA})
+
+	events <- fmt.Sprintf(`{"type":"ADDED","object":%v}`, sliceJSON("echo-b", "2", portB, true, hostA))
+	want := []string{addrA, addrB}
+	if addrB < addrA {
+		want = []string{addrB, addrA}
+	}
+	waitAddrs(want)
+
+	// endpoints not ready are removed
+	events <- fmt.Sprintf(`{"type":"MODIFIED","object":%v}`, sliceJSON("echo-a", "3", portA, false, hostA))
+	waitAddrs([]string{addrB})
+
+	events <- fmt.Sprintf(`{"type":"DELETED","object":%v}`, sliceJSON("echo-b", "4", portB, true, hostA))
+	waitAddrs(nil)
+}
+
+func TestEndpointSliceResolver_TokenFile(t *testing.T) {
+	var auths []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[]}`)
+	}))
+	defer api.Close()
+
+	file := filepath.Join(t.TempDir(), "token")
+	r := &EndpointSliceResolver{Namespace: "default", Name: "echo", APIServer: api.URL, Token: "static", TokenFile: file}
+	// the token rotated is used by the next request
+	for _, token := range []string{"token-1", "token-2"} {
+		if err := os.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+			t.Fatalf("os.WriteFile() error = %v", err)
+		}
+		if err := r.list(); err != nil {
+			t.Fatalf("list() error = %v", err)
+		}
+	}
+	if want := []string{"Bearer token-1", "Bearer token-2"}; !reflect.DeepEqual(auths, want) {
+		t.Fatalf("Authorization = %v, want %v", auths, want)
+	}
+
+	os.Remove(file)
+	if err := r.list(); err == nil {
+		t.Fatalf("list() error = nil, want error of the token file missing")
+	}
+}
+
+func TestEndpointSliceResolver_Clock(t *testing.T) {
+	var lists int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&lists, 1)
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[]}`)
+	}))
+	defer api.Close()
+
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	r := &EndpointSliceResolver{Namespace: "default", Name: "echo", APIServer: api.URL, Clock: clock}
+	if _, err := r.Resolve(); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+
+	// watching fails and is retried by the clock, listing again first
+	for i := 1; i <= 2; i++ {
+		waitTimers(t, clock)
+		if n := atomic.LoadInt32(&lists); n != int32(i) {
+			t.Fatalf("lists = %v before retried, want %v", n, i)
+		}
+		clock.Advance(watchRetryInterval)
+		for j := 0; j < 100 && atomic.LoadInt32(&lists) == int32(i); j++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	waitTimers(t, clock)
+	r.Stop()
+	for i := 0; i < 100 && clock.Timers() > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := clock.Timers(); n != 0 {
+		t.Fatalf("timers = %v after stopped, want 0", n)
+	}
+}
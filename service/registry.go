@@ -0,0 +1,269 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// DefaultTTL is the ttl of registrations by default
+	DefaultTTL = time.Second * 10
+
+	registerMaxBackoff = time.Second * 5
+)
+
+// Registry registers addresses of services with leases of ttl, e.g. etcd, consul or redis,
+// addresses are removed by the registry if their leases are not renewed in ttl
+type Registry interface {
+	// Register registers addr of service name with a new lease of ttl and metadata of addr,
+	// e.g. arpc.Capabilities.Metadata of the server
+	Register(name string, addr string, ttl time.Duration, meta map[string]string) error
+	// KeepAlive renews the lease of addr, it returns ErrNotRegistered if the lease is lost, e.g.
+	// expired while the registry was not reachable
+	KeepAlive(name string, addr string, ttl time.Duration) error
+	// Deregister removes addr
+	Deregister(name string, addr string) error
+}
+
+// Registration keeps addr of a server registered to a registry, the lease is renewed every third
+// of ttl, addr is registered again if the lease is lost, and retried with backoff while the
+// registry is not reachable. It implements lifecycle.Subsystem and lifecycle.HealthChecker
+type Registration struct {
+	// OnStateChange is called when addr is registered or lost, err is why it's lost
+	OnStateChange func(registered bool, err error)
+	// Metadata is registered with addr, should be set before Start
+	Metadata map[string]string
+	// Clock drives renewing, arpc.SystemClock if nil, should be set before Start
+	Clock arpc.Clock
+
+	registry Registry
+	name     string
+	addr     string
+	ttl      time.Duration
+
+	mux        sync.Mutex
+	registered bool
+	err        error
+	chStop     chan util.Empty
+	done       chan util.Empty
+}
+
+// NewRegistration returns Registration of addr of service name with ttl, DefaultTTL if ttl <= 0
+func NewRegistration(registry Registry, name string, addr string, ttl time.Duration) *Registration {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Registration{registry: registry, name: name, addr: addr, ttl: ttl}
+}
+
+// Start registers addr and starts renewing, it returns error if the first registering fails
+func (r *Registration) Start(ctx context.Context) error {
+	if err := r.registry.Register(r.name, r.addr, r.ttl, r.Metadata); err != nil {
+		return err
+	}
+	r.mux.Lock()
+	r.chStop = make(chan util.Empty)
+	r.done = make(chan util.Empty)
+	r.mux.Unlock()
+	r.setState(true, nil)
+	go util.Safe(r.keepAliveLoop)
+	return nil
+}
+
+// Stop stops renewing and deregisters addr
+func (r *Registration) Stop(ctx context.Context) error {
+	r.mux.Lock()
+	chStop, done := r.chStop, r.done
+	r.chStop = nil
+	r.mux.Unlock()
+	if chStop == nil {
+		return nil
+	}
+	close(chStop)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r.setState(false, nil)
+	return r.registry.Deregister(r.name, r.addr)
+}
+
+// Registered returns whether addr is registered now
+func (r *Registration) Registered() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.registered
+}
+
+// Health implements lifecycle.HealthChecker, it returns why addr is not registered
+func (r *Registration) Health() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.registered {
+		return nil
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return ErrNotRegistered
+}
+
+func (r *Registration) setState(registered bool, err error) {
+	r.mux.Lock()
+	changed := r.registered != registered
+	r.registered, r.err = registered, err
+	r.mux.Unlock()
+	if changed && r.OnStateChange != nil {
+		r.OnStateChange(registered, err)
+	}
+}
+
+func (r *Registration) keepAliveLoop() {
+	r.mux.Lock()
+	chStop, done := r.chStop, r.done
+	r.mux.Unlock()
+	defer close(done)
+
+	clock := r.Clock
+	if clock == nil {
+		clock = arpc.SystemClock
+	}
+	interval := r.ttl / 3
+	backoff := interval
+	timer := clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+		case <-chStop:
+			return
+		}
+
+		var err error
+		if r.Registered() {
+			err = r.registry.KeepAlive(r.name, r.addr, r.ttl)
+			if err == ErrNotRegistered {
+				log.Warn("[Service] %v lease of %v lost, registering again", r.name, r.addr)
+				err = r.registry.Register(r.name, r.addr, r.ttl, r.Metadata)
+			}
+		} else {
+			// the lease may have expired while the registry was not reachable
+			err = r.registry.Register(r.name, r.addr, r.ttl, r.Metadata)
+		}
+		if err == nil {
+			if !r.Registered() {
+				log.Info("[Service] %v registered %v again", r.name, r.addr)
+			}
+			r.setState(true, nil)
+			backoff = interval
+			timer.Reset(interval)
+			continue
+		}
+
+		log.Warn("[Service] %v keep %v registered failed: %v", r.name, r.addr, err)
+		r.setState(false, err)
+		timer.Reset(backoff)
+		if backoff *= 2; backoff > registerMaxBackoff {
+			backoff = registerMaxBackoff
+		}
+	}
+}
+
+type memoryLease struct {
+	expire time.Time
+	meta   map[string]string
+}
+
+// MemoryRegistry is a Registry in memory, for tests and single process deployments, it's also a
+// Resolver of a service by Resolver
+type MemoryRegistry struct {
+	mux      sync.Mutex
+	services map[string]map[string]*memoryLease
+	now      func() time.Time
+}
+
+// NewMemoryRegistry returns MemoryRegistry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{services: map[string]map[string]*memoryLease{}, now: time.Now}
+}
+
+// Register implements Registry
+func (m *MemoryRegistry) Register(name string, addr string, ttl time.Duration, meta map[string]string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	leases, ok := m.services[name]
+	if !ok {
+		leases = map[string]*memoryLease{}
+		m.services[name] = leases
+	}
+	leases[addr] = &memoryLease{expire: m.now().Add(ttl), meta: meta}
+	return nil
+}
+
+// KeepAlive implements Registry
+func (m *MemoryRegistry) KeepAlive(name string, addr string, ttl time.Duration) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	lease, ok := m.services[name][addr]
+	if !ok || !m.now().Before(lease.expire) {
+		delete(m.services[name], addr)
+		return ErrNotRegistered
+	}
+	lease.expire = m.now().Add(ttl)
+	return nil
+}
+
+// Deregister implements Registry
+func (m *MemoryRegistry) Deregister(name string, addr string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.services[name], addr)
+	return nil
+}
+
+// Addrs returns addresses of service name with leases not expired, sorted
+func (m *MemoryRegistry) Addrs(name string) []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := m.now()
+	addrs := []string{}
+	for addr, lease := range m.services[name] {
+		if now.Before(lease.expire) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Metadata returns metadata of addresses of service name with leases not expired
+func (m *MemoryRegistry) Metadata(name string) map[string]map[string]string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := m.now()
+	metas := map[string]map[string]string{}
+	for addr, lease := range m.services[name] {
+		if now.Before(lease.expire) {
+			metas[addr] = lease.meta
+		}
+	}
+	return metas
+}
+
+// Resolver returns Resolver of service name
+func (m *MemoryRegistry) Resolver(name string) Resolver {
+	return ResolverFunc(func() ([]string, error) {
+		return m.Addrs(name), nil
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+type flakyRegistry struct {
+	*MemoryRegistry
+	down int32
+}
+
+func (f *flakyRegistry) Register(name string, addr string, ttl time.Duration, meta map[string]string) error {
+	if atomic.LoadInt32(&f.down) != 0 {
+		return errors.New("registry down")
+	}
+	return f.MemoryRegistry.Register(name, addr, ttl, meta)
+}
+
+func (f *flakyRegistry) KeepAlive(name string, addr string, ttl time.Duration) error {
+	if atomic.LoadInt32(&f.down) != 0 {
+		return errors.New("registry down")
+	}
+	return f.MemoryRegistry.KeepAlive(name, addr, ttl)
+}
+
+func TestRegistration(t *testing.T) {
+	registry := &flakyRegistry{MemoryRegistry: NewMemoryRegistry()}
+	r := NewRegistration(registry, "echo", "127.0.0.1:8888", time.Millisecond*30)
+	r.Metadata = map[string]string{"zone": "a"}
+	chState := make(chan bool, 8)
+	r.OnStateChange = func(registered bool, err error) {
+		chState <- registered
+	}
+	wantState := func(want bool) {
+		t.Helper()
+		select {
+		case registered := <-chState:
+			if registered != want {
+				t.Fatalf("OnStateChange registered = %v, want %v", registered, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnStateChange not called, want %v", want)
+		}
+	}
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Registration.Start() error = %v", err)
+	}
+	wantState(true)
+	if meta := registry.Metadata("echo")["127.0.0.1:8888"]; meta["zone"] != "a" {
+		t.Fatalf("Metadata() = %v, want registered with the metadata", meta)
+	}
+
+	// renewed beyond ttl
+	time.Sleep(time.Millisecond * 60)
+	if addrs := registry.Addrs("echo"); len(addrs) != 1 || r.Health() != nil {
+		t.Fatalf("Addrs() = %v, Health() = %v, want registered", addrs, r.Health())
+	}
+
+	// the registry is down until the lease expires, it's registered again after recovered
+	atomic.StoreInt32(&registry.down, 1)
+	wantState(false)
+	if r.Health() == nil {
+		t.Fatalf("Registration.Health() = nil while the registry is down")
+	}
+	time.Sleep(time.Millisecond * 40)
+	if addrs := registry.Addrs("echo"); len(addrs) != 0 {
+		t.Fatalf("Addrs() = %v, want expired", addrs)
+	}
+	atomic.StoreInt32(&registry.down, 0)
+	wantState(true)
+	if addrs := registry.Addrs("echo"); len(addrs) != 1 {
+		t.Fatalf("Addrs() = %v after recovered, want registered again", addrs)
+	}
+
+	// a lease lost is registered again without being reported
+	registry.MemoryRegistry.Deregister("echo", "127.0.0.1:8888")
+	time.Sleep(time.Millisecond * 30)
+	if addrs := registry.Addrs("echo"); len(addrs) != 1 {
+		t.Fatalf("Addrs() = %v after lease lost, want registered again", addrs)
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatalf("Registration.Stop() error = %v", err)
+	}
+	wantState(false)
+	if addrs := registry.Addrs("echo"); len(addrs) != 0 || r.Registered() {
+		t.Fatalf("Addrs() = %v after stopped, want deregistered", addrs)
+	}
+}
+
+func TestRegistration_Clock(t *testing.T) {
+	clock := arpc.NewMockClock(time.Unix(1600000000, 0))
+	registry := NewMemoryRegistry()
+	registry.now = clock.Now
+	r := NewRegistration(registry, "echo", "127.0.0.1:8888", time.Second*30)
+	r.Clock = clock
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Registration.Start() error = %v", err)
+	}
+	defer r.Stop(context.Background())
+
+	// renewed every third of ttl of the clock, the lease never expires
+	for i := 0; i < 6; i++ {
+		waitTimers(t, clock)
+		clock.Advance(time.Second * 10)
+		waitTimers(t, clock)
+		if addrs := registry.Addrs("echo"); len(addrs) != 1 {
+			t.Fatalf("Addrs() = %v after %v renewals, want registered", addrs, i+1)
+		}
+	}
+}
+
+// waitTimers waits until a timer of clock is armed, e.g. of renewing or retrying
+func waitTimers(t *testing.T, clock *arpc.MockClock) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.Timers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timer not armed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
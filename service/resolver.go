@@ -0,0 +1,81 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lesismal/arpc"
+)
+
+// Resolver discovers addresses of a service, e.g. from DNS, a registry or config
+type Resolver interface {
+	Resolve() ([]string, error)
+}
+
+// Watcher is a Resolver notifying changes of addresses, e.g. watching a registry, Service resolves
+// again on each notification besides refreshing periodically
+type Watcher interface {
+	Resolver
+	Changes() <-chan struct{}
+}
+
+// ResolverFunc adapts a func to Resolver
+type ResolverFunc func() ([]string, error)
+
+// Resolve implements Resolver
+func (f ResolverFunc) Resolve() ([]string, error) {
+	return f()
+}
+
+// StaticResolver resolves to fixed addresses
+type StaticResolver []string
+
+// Resolve implements Resolver
+func (r StaticResolver) Resolve() ([]string, error) {
+	return r, nil
+}
+
+// SRVResolver resolves targets of DNS SRV records with the best priority, e.g. pods of a Kubernetes
+// headless service, records of other priorities are backups used if there are none of it. Weights
+// are not used since the Service balances in round robin, see arpc.SRVDialer for dialing a client
+type SRVResolver struct {
+	// Service, Proto and Name of the SRV records, _Service._Proto.Name is looked up, or Name
+	// directly if Service and Proto are empty
+	Service string
+	Proto   string
+	Name    string
+	// LookupSRV looks up records, net.LookupSRV by default
+	LookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Resolve implements Resolver
+func (r *SRVResolver) Resolve() ([]string, error) {
+	lookup := r.LookupSRV
+	if lookup == nil {
+		lookup = net.LookupSRV
+	}
+	_, records, err := lookup(r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	best := -1
+	for _, rec := range records {
+		if rec.Target == "." || (best >= 0 && int(rec.Priority) > best) {
+			continue
+		}
+		if int(rec.Priority) != best {
+			addrs, best = nil, int(rec.Priority)
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, arpc.ErrSRVNoTarget
+	}
+	return addrs, nil
+}
@@ -0,0 +1,395 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/metrics"
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// DefaultTimeout is the timeout of Invoke if ctx has no deadline
+	DefaultTimeout = time.Second * 5
+
+	// DefaultRefreshInterval is the interval of resolving addresses again
+	DefaultRefreshInterval = time.Second * 30
+
+	dialTimeout = time.Second * 3
+)
+
+var (
+	// ErrNoAvailableClient .
+	ErrNoAvailableClient = errors.New("no available client of the service")
+
+	// ErrServiceStopped .
+	ErrServiceStopped = errors.New("service stopped")
+
+	// ErrNotRegistered .
+	ErrNotRegistered = errors.New("not registered")
+
+	// ErrNotInCluster .
+	ErrNotInCluster = errors.New("not running in a kubernetes cluster")
+
+	// ErrNoEndpointPort .
+	ErrNoEndpointPort = errors.New("no port of endpoints")
+)
+
+// DefaultRetryPolicy is the retry policy of Service by default, retries go to the next address,
+// besides arpc.DefaultRetryPolicy, errors of stopped clients are retried
+var DefaultRetryPolicy = &arpc.RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond * 50,
+	MaxBackoff:  time.Second,
+	Retryable: func(err error) bool {
+		return err == arpc.ErrClientStopped || arpc.DefaultRetryPolicy.IsRetryable(err)
+	},
+}
+
+// Option configures Service
+type Option func(s *Service)
+
+// WithDialer sets how addresses are dialed, tcp with 3s timeout by default
+func WithDialer(dial func(addr string) (net.Conn, error)) Option {
+	return func(s *Service) { s.dial = dial }
+}
+
+// WithHandler sets Handler shared by clients of the Service, e.g. with coders registered,
+// a clone of arpc.DefaultHandler by default
+func WithHandler(h arpc.Handler) Option {
+	return func(s *Service) { s.handler = h }
+}
+
+// WithCodec sets Codec of clients, codec.DefaultCodec by default
+func WithCodec(c codec.Codec) Option {
+	return func(s *Service) { s.codec = c }
+}
+
+// WithTimeout sets timeout of Invoke if ctx has no deadline, DefaultTimeout by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Service) { s.timeout = timeout }
+}
+
+// WithRetry sets retry policy of Invoke, DefaultRetryPolicy by default
+func WithRetry(policy *arpc.RetryPolicy) Option {
+	return func(s *Service) { s.retry = policy }
+}
+
+// WithRefreshInterval sets the interval of resolving addresses again, 0 disables it,
+// DefaultRefreshInterval by default
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(s *Service) { s.refresh = interval }
+}
+
+// WithLabels attaches labels to clients of the Service, see arpc.WithLabels
+func WithLabels(labels map[string]string) Option {
+	return func(s *Service) { s.labels = labels }
+}
+
+// WithMetrics adds clients to pusher with name "service@addr"
+func WithMetrics(pusher *metrics.Pusher) Option {
+	return func(s *Service) { s.pusher = pusher }
+}
+
+// WithCapabilityFilter routes calls only to servers whose capabilities are accepted by filter, e.g.
+// by Version, capabilities are fetched only if the handler of the Service has arpc.SetCapabilities
+// enabled, servers not advertising capabilities are not filtered
+func WithCapabilityFilter(filter func(caps *arpc.Capabilities) bool) Option {
+	return func(s *Service) { s.filter = filter }
+}
+
+// Service is the high-level client of a service, it keeps a client to each address resolved,
+// balances calls over them round robin, and retries failed calls on the next address.
+// Servers advertising capabilities which don't support the method are skipped
+type Service struct {
+	name     string
+	resolver Resolver
+	dial     func(addr string) (net.Conn, error)
+	handler  arpc.Handler
+	codec    codec.Codec
+	timeout  time.Duration
+	retry    *arpc.RetryPolicy
+	refresh  time.Duration
+	pusher   *metrics.Pusher
+	filter   func(caps *arpc.Capabilities) bool
+	labels   map[string]string
+
+	round uint64
+
+	mux     sync.RWMutex
+	clients map[string]*arpc.Client
+	list    []*arpc.Client
+	stopped bool
+	chStop  chan util.Empty
+}
+
+// New returns Service of name with addresses of resolver, it returns error if no address is connected
+func New(name string, resolver Resolver, options ...Option) (*Service, error) {
+	s := &Service{
+		name:     name,
+		resolver: resolver,
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, dialTimeout)
+		},
+		codec:   codec.DefaultCodec,
+		timeout: DefaultTimeout,
+		retry:   DefaultRetryPolicy,
+		refresh: DefaultRefreshInterval,
+		clients: map[string]*arpc.Client{},
+		chStop:  make(chan util.Empty),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	if s.handler == nil {
+		s.handler = arpc.DefaultHandler.Clone()
+	}
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	if len(s.Addrs()) == 0 {
+		return nil, ErrNoAvailableClient
+	}
+	if s.refresh > 0 {
+		go util.Safe(s.refreshLoop)
+	}
+	if w, ok := resolver.(Watcher); ok {
+		go util.Safe(func() { s.watchLoop(w) })
+	}
+	return s, nil
+}
+
+// Invoke makes rpc call on one of the clients, retried by the retry policy on the next client
+func (s *Service) Invoke(ctx context.Context, method string, req interface{}, rsp interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	for retry := 0; ; retry++ {
+		c, err := s.next(method)
+		if c != nil {
+			err = c.CallWith(ctx, method, req, rsp)
+		}
+		if err == nil || retry+1 >= s.retry.MaxAttempts || !s.retry.IsRetryable(err) {
+			return err
+		}
+		timer := s.handler.Clock().NewTimer(s.retry.Delay(retry, err))
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// CallWith implements arpc.Caller by Invoke, e.g. for arpc.Bind
+func (s *Service) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}) error {
+	return s.Invoke(ctx, method, req, rsp)
+}
+
+// Addrs returns addresses connected
+func (s *Service) Addrs() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	addrs := make([]string, 0, len(s.clients))
+	for addr := range s.clients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Stats returns stats of clients by address
+func (s *Service) Stats() map[string]arpc.Stats {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	stats := make(map[string]arpc.Stats, len(s.clients))
+	for addr, c := range s.clients {
+		stats[addr] = c.Stats()
+	}
+	return stats
+}
+
+// Refresh resolves addresses, connects new addresses and stops clients of addresses removed
+func (s *Service) Refresh() error {
+	addrs, err := s.resolver.Resolve()
+	if err != nil {
+		return err
+	}
+	resolved := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		resolved[addr] = true
+	}
+
+	s.mux.RLock()
+	var added []string
+	for addr := range resolved {
+		if _, ok := s.clients[addr]; !ok {
+			added = append(added, addr)
+		}
+	}
+	s.mux.RUnlock()
+
+	connected := map[string]*arpc.Client{}
+	for _, addr := range added {
+		addr := addr
+		c, err := arpc.NewClient(func() (net.Conn, error) {
+			return s.dial(addr)
+		}, arpc.WithLabels(s.labels), arpc.WithHandler(s.handler), arpc.WithCodec(s.codec))
+		if err != nil {
+			log.Warn("[Service] %v connect %v failed: %v", s.name, addr, err)
+			continue
+		}
+		if s.handler.Capabilities() != nil {
+			// fetched before balanced to, so calls are routed by capabilities from the first
+			if err := c.FetchCapabilities(); err != nil {
+				log.Warn("[Service] %v fetch capabilities of %v failed: %v", s.name, addr, err)
+			}
+		}
+		connected[addr] = c
+	}
+
+	var removed []*arpc.Client
+	s.mux.Lock()
+	if s.stopped {
+		s.mux.Unlock()
+		for _, c := range connected {
+			c.Stop()
+		}
+		return ErrServiceStopped
+	}
+	for addr, c := range connected {
+		s.clients[addr] = c
+		if s.pusher != nil {
+			s.pusher.Add(s.name+"@"+addr, c)
+		}
+	}
+	for addr, c := range s.clients {
+		if !resolved[addr] {
+			delete(s.clients, addr)
+			removed = append(removed, c)
+			if s.pusher != nil {
+				s.pusher.Delete(s.name + "@" + addr)
+			}
+		}
+	}
+	s.rebuild()
+	s.mux.Unlock()
+
+	for _, c := range removed {
+		c.Stop()
+	}
+	return nil
+}
+
+// rebuild rebuilds the balancing list in order of addresses, should be called with s.mux locked
+func (s *Service) rebuild() {
+	addrs := make([]string, 0, len(s.clients))
+	for addr := range s.clients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	list := make([]*arpc.Client, len(addrs))
+	for i, addr := range addrs {
+		list[i] = s.clients[addr]
+	}
+	s.list = list
+}
+
+// Capabilities returns capabilities of servers by address, nil of servers not advertising them
+func (s *Service) Capabilities() map[string]*arpc.Capabilities {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	caps := make(map[string]*arpc.Capabilities, len(s.clients))
+	for addr, c := range s.clients {
+		caps[addr] = c.Capabilities()
+	}
+	return caps
+}
+
+// next returns the next client round robin capable of method, it returns
+// arpc.ErrMethodNotSupported if no server supports it
+func (s *Service) next(method string) (*arpc.Client, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	n := uint64(len(s.list))
+	if n == 0 {
+		return nil, ErrNoAvailableClient
+	}
+	round := atomic.AddUint64(&s.round, 1)
+	for i := uint64(0); i < n; i++ {
+		c := s.list[(round+i)%n]
+		if caps := c.Capabilities(); caps == nil || (caps.Supports(method) && (s.filter == nil || s.filter(caps))) {
+			return c, nil
+		}
+	}
+	return nil, arpc.ErrMethodNotSupported
+}
+
+func (s *Service) refreshLoop() {
+	ticker := s.handler.Clock().NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.Refresh(); err != nil {
+				log.Warn("[Service] %v refresh failed: %v", s.name, err)
+			}
+		case <-s.chStop:
+			return
+		}
+	}
+}
+
+func (s *Service) watchLoop(w Watcher) {
+	changes := w.Changes()
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+			if err := s.Refresh(); err != nil {
+				log.Warn("[Service] %v refresh failed: %v", s.name, err)
+			}
+		case <-s.chStop:
+			return
+		}
+	}
+}
+
+// Stop stops refreshing and all clients
+func (s *Service) Stop() {
+	s.mux.Lock()
+	if s.stopped {
+		s.mux.Unlock()
+		return
+	}
+	s.stopped = true
+	clients := s.clients
+	s.clients = map[string]*arpc.Client{}
+	s.list = nil
+	s.mux.Unlock()
+
+	close(s.chStop)
+	for addr, c := range clients {
+		c.Stop()
+		if s.pusher != nil {
+			s.pusher.Delete(s.name + "@" + addr)
+		}
+	}
+}
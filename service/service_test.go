@@ -0,0 +1,197 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func newServer(t *testing.T, name string) (*arpc.Server, string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/name", func(ctx *arpc.Context) {
+		ctx.Write(name)
+	})
+	go svr.Serve(ln)
+	return svr, ln.Addr().String()
+}
+
+func TestService_Invoke(t *testing.T) {
+	svrA, addrA := newServer(t, "a")
+	defer svrA.Stop()
+	svrB, addrB := newServer(t, "b")
+	defer svrB.Stop()
+
+	var mux sync.Mutex
+	addrs := []string{addrA, addrB}
+	resolver := ResolverFunc(func() ([]string, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		return addrs, nil
+	})
+	s, err := New("echo", resolver, WithRefreshInterval(0))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+
+	invoke := func() string {
+		var rsp string
+		if err := s.Invoke(context.Background(), "/name", nil, &rsp); err != nil {
+			t.Fatalf("Service.Invoke() error = %v", err)
+		}
+		return rsp
+	}
+	names := map[string]int{}
+	for i := 0; i < 4; i++ {
+		names[invoke()]++
+	}
+	if names["a"] != 2 || names["b"] != 2 {
+		t.Fatalf("calls balanced = %v, want 2 of each", names)
+	}
+
+	// calls failed by a server down are retried on the next address
+	svrA.Stop()
+	for i := 0; i < 4; i++ {
+		if name := invoke(); name != "b" {
+			t.Fatalf("Service.Invoke() = %v, want b", name)
+		}
+	}
+
+	mux.Lock()
+	addrs = []string{addrB}
+	mux.Unlock()
+	if err = s.Refresh(); err != nil {
+		t.Fatalf("Service.Refresh() error = %v", err)
+	}
+	if got := s.Addrs(); len(got) != 1 || got[0] != addrB {
+		t.Fatalf("Service.Addrs() = %v, want [%v]", got, addrB)
+	}
+	if st := s.Stats()[addrB]; st.Calls == 0 {
+		t.Fatalf("Service.Stats() calls of %v = 0", addrB)
+	}
+}
+
+func TestService_RefreshMockClock(t *testing.T) {
+	svrA, addrA := newServer(t, "a")
+	defer svrA.Stop()
+	svrB, addrB := newServer(t, "b")
+	defer svrB.Stop()
+
+	var mux sync.Mutex
+	addrs := []string{addrA}
+	resolver := ResolverFunc(func() ([]string, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		return addrs, nil
+	})
+	mc := arpc.NewMockClock(time.Now())
+	h := arpc.NewHandler()
+	h.SetClock(mc)
+	s, err := New("echo", resolver, WithHandler(h), WithRefreshInterval(time.Minute))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+	for i := 0; mc.Timers() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("refresh ticker not created by the handler clock")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	mux.Lock()
+	addrs = []string{addrA, addrB}
+	mux.Unlock()
+	mc.Advance(time.Second * 59)
+	time.Sleep(time.Millisecond * 50)
+	if got := s.Addrs(); len(got) != 1 {
+		t.Fatalf("Service.Addrs() before the refresh interval = %v, want [%v]", got, addrA)
+	}
+	mc.Advance(time.Second)
+	for i := 0; len(s.Addrs()) != 2; i++ {
+		if i == 100 {
+			t.Fatalf("Service.Addrs() after the refresh interval = %v, want [%v %v]", s.Addrs(), addrA, addrB)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSRVResolver(t *testing.T) {
+	r := &SRVResolver{Service: "arpc", Proto: "tcp", Name: "echo", LookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+		if service != "arpc" || proto != "tcp" || name != "echo" {
+			t.Fatalf("LookupSRV(%v, %v, %v), want (arpc, tcp, echo)", service, proto, name)
+		}
+		return "_arpc._tcp.echo.", []*net.SRV{
+			{Target: "backup.", Port: 8888, Priority: 20, Weight: 10},
+			{Target: "a.", Port: 8888, Priority: 10, Weight: 10},
+			{Target: "b.", Port: 9999, Priority: 10},
+		}, nil
+	}}
+	addrs, err := r.Resolve()
+	if err != nil || !reflect.DeepEqual(addrs, []string{"a:8888", "b:9999"}) {
+		t.Fatalf("SRVResolver.Resolve() = (%v, %v), want [a:8888 b:9999]", addrs, err)
+	}
+}
+
+func TestService_Capabilities(t *testing.T) {
+	svrA, addrA := newServer(t, "a")
+	defer svrA.Stop()
+	svrA.Handler.SetCapabilities(&arpc.Capabilities{Version: "v2"})
+	svrA.Handler.Handle("/v2", func(ctx *arpc.Context) {
+		ctx.Write("a")
+	})
+	svrB, addrB := newServer(t, "b")
+	defer svrB.Stop()
+	svrB.Handler.SetCapabilities(&arpc.Capabilities{Version: "v1"})
+
+	h := arpc.DefaultHandler.Clone()
+	h.SetCapabilities(&arpc.Capabilities{})
+	resolver := ResolverFunc(func() ([]string, error) {
+		return []string{addrA, addrB}, nil
+	})
+	s, err := New("name", resolver, WithHandler(h), WithRefreshInterval(0))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+	if caps := s.Capabilities(); caps[addrA] == nil || caps[addrB] == nil {
+		t.Fatalf("Service.Capabilities() = %v, want fetched", caps)
+	}
+
+	// only a supports /v2
+	for i := 0; i < 4; i++ {
+		rsp := ""
+		if err := s.Invoke(context.Background(), "/v2", nil, &rsp); err != nil || rsp != "a" {
+			t.Fatalf("Service.Invoke() = (%v, %v), want a", rsp, err)
+		}
+	}
+
+	s, err = New("name", resolver, WithHandler(h), WithRefreshInterval(0),
+		WithCapabilityFilter(func(caps *arpc.Capabilities) bool { return caps.Version == "v1" }))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+	for i := 0; i < 4; i++ {
+		rsp := ""
+		if err := s.Invoke(context.Background(), "/name", nil, &rsp); err != nil || rsp != "b" {
+			t.Fatalf("Service.Invoke() = (%v, %v), want b of v1", rsp, err)
+		}
+	}
+	if err := s.Invoke(context.Background(), "/v2", nil, nil); err != arpc.ErrMethodNotSupported {
+		t.Fatalf("Service.Invoke() error = %v, want %v", err, arpc.ErrMethodNotSupported)
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package simnet
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrConnRefused .
+	ErrConnRefused = errors.New("simnet: connection refused")
+	// ErrPartitioned .
+	ErrPartitioned = errors.New("simnet: network partitioned")
+	// ErrAddrInUse .
+	ErrAddrInUse = errors.New("simnet: address already in use")
+	// ErrClosed .
+	ErrClosed = errors.New("simnet: use of closed connection")
+)
+
+// Addr is address of a simulated node
+type Addr string
+
+// Network implements net.Addr
+func (a Addr) Network() string { return "simnet" }
+
+// String implements net.Addr
+func (a Addr) String() string { return string(a) }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "simnet: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type link struct {
+	from, to string
+}
+
+// LinkConfig defines behavior of a direction between two nodes
+type LinkConfig struct {
+	// Latency of each write
+	Latency time.Duration
+	// Jitter adds random latency up to Jitter to each write, writes are reordered if it's set
+	Jitter time.Duration
+	// Partitioned drops writes and refuses dials
+	Partitioned bool
+}
+
+// event is a packet delivery or a timer, ordered by time and then by creation
+type event struct {
+	at   time.Time
+	seq  uint64
+	conn *Conn
+	data []byte
+	fin  bool
+	ch   chan time.Time
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int { return len(h) }
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h eventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(*event)) }
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Network is a simulated network with a fake clock, writes are delivered when the clock is
+// advanced past their latency, writes without latency are delivered immediately. Each write is
+// delivered as a unit, so reordering keeps arpc frames written separately intact
+type Network struct {
+	mux    sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	seq    uint64
+	rand   *rand.Rand
+	events eventHeap
+
+	defaultLink LinkConfig
+	links       map[link]LinkConfig
+	listeners   map[string]*Listener
+	conns       map[*Conn]struct{}
+}
+
+// New returns Network, seed makes jitter deterministic
+func New(seed int64) *Network {
+	n := &Network{
+		now:       time.Unix(0, 0),
+		rand:      rand.New(rand.NewSource(seed)),
+		links:     map[link]LinkConfig{},
+		listeners: map[string]*Listener{},
+		conns:     map[*Conn]struct{}{},
+	}
+	n.cond = sync.NewCond(&n.mux)
+	return n
+}
+
+// Now returns time of the fake clock
+func (n *Network) Now() time.Time {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.now
+}
+
+// After returns a channel receiving the fake time after d is advanced
+func (n *Network) After(d time.Duration) <-chan time.Time {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	ch := make(chan time.Time, 1)
+	n.push(&event{at: n.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the fake clock forward by d, delivering writes and firing timers due in order
+func (n *Network) Advance(d time.Duration) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	target := n.now.Add(d)
+	for len(n.events) > 0 && !n.events[0].at.After(target) {
+		e := heap.Pop(&n.events).(*event)
+		n.now = e.at
+		n.fire(e)
+	}
+	n.now = target
+	n.cond.Broadcast()
+}
+
+func (n *Network) push(e *event) {
+	n.seq++
+	e.seq = n.seq
+	heap.Push(&n.events, e)
+}
+
+func (n *Network) fire(e *event) {
+	switch {
+	case e.ch != nil:
+		e.ch <- n.now
+	case e.fin:
+		e.conn.eof = true
+	default:
+		e.conn.buf = append(e.conn.buf, e.data...)
+	}
+	n.cond.Broadcast()
+}
+
+// SetDefaultLink sets config of links not set by SetLink
+func (n *Network) SetDefaultLink(cfg LinkConfig) {
+	n.mux.Lock()
+	n.defaultLink = cfg
+	n.mux.Unlock()
+}
+
+// SetLink sets config of both directions between a and b
+func (n *Network) SetLink(a, b string, cfg LinkConfig) {
+	n.mux.Lock()
+	n.links[link{a, b}] = cfg
+	n.links[link{b, a}] = cfg
+	n.mux.Unlock()
+}
+
+func (n *Network) linkConfig(from, to string) LinkConfig {
+	if cfg, ok := n.links[link{from, to}]; ok {
+		return cfg
+	}
+	return n.defaultLink
+}
+
+// Partition drops writes and refuses dials between a and b until healed
+func (n *Network) Partition(a, b string) {
+	n.setPartitioned(a, b, true)
+}
+
+// Heal recovers partition between a and b
+func (n *Network) Heal(a, b string) {
+	n.setPartitioned(a, b, false)
+}
+
+func (n *Network) setPartitioned(a, b string, partitioned bool) {
+	n.mux.Lock()
+	for _, l := range []link{{a, b}, {b, a}} {
+		cfg := n.linkConfig(l.from, l.to)
+		cfg.Partitioned = partitioned
+		n.links[l] = cfg
+	}
+	n.mux.Unlock()
+}
+
+// Disconnect resets all connections of node addr, both sides read EOF immediately
+func (n *Network) Disconnect(addr string) {
+	n.mux.Lock()
+	for c := range n.conns {
+		if string(c.local) == addr || string(c.remote) == addr {
+			c.closed, c.eof = true, true
+			c.peer.closed, c.peer.eof = true, true
+			delete(n.conns, c)
+			delete(n.conns, c.peer)
+		}
+	}
+	n.cond.Broadcast()
+	n.mux.Unlock()
+}
+
+// Listen listens on addr
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	ln := &Listener{net: n, addr: Addr(addr), chAccept: make(chan *Conn, 1024), chClose: make(chan struct{})}
+	n.listeners[addr] = ln
+	return ln, nil
+}
+
+// Dial connects node from to the listener of node to
+func (n *Network) Dial(from, to string) (net.Conn, error) {
+	n.mux.Lock()
+	ln, ok := n.listeners[to]
+	if !ok {
+		n.mux.Unlock()
+		return nil, ErrConnRefused
+	}
+	if n.linkConfig(from, to).Partitioned {
+		n.mux.Unlock()
+		return nil, ErrPartitioned
+	}
+	client := &Conn{net: n, local: Addr(from), remote: Addr(to)}
+	server := &Conn{net: n, local: Addr(to), remote: Addr(from), peer: client}
+	client.peer = server
+	n.conns[client] = struct{}{}
+	n.conns[server] = struct{}{}
+	n.mux.Unlock()
+
+	select {
+	case ln.chAccept <- server:
+		return client, nil
+	case <-ln.chClose:
+		return nil, ErrConnRefused
+	}
+}
+
+// Dialer returns dialer of node from to node to, it could be used as arpc.DialerFunc
+func (n *Network) Dialer(from, to string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return n.Dial(from, to)
+	}
+}
+
+// Listener is a simulated listener
+type Listener struct {
+	net       *Network
+	addr      Addr
+	chAccept  chan *Conn
+	chClose   chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept implements net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.chAccept:
+		return c, nil
+	case <-l.chClose:
+		return nil, ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.chClose)
+		l.net.mux.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.mux.Unlock()
+	})
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Conn is a simulated connection, deadlines are checked against the fake clock
+type Conn struct {
+	net    *Network
+	local  Addr
+	remote Addr
+	peer   *Conn
+
+	buf    []byte
+	closed bool
+	eof    bool
+	// lastAt keeps writes of links without jitter in order
+	lastAt time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Read implements net.Conn
+func (c *Conn) Read(b []byte) (int, error) {
+	n := c.net
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for len(c.buf) == 0 {
+		if c.closed {
+			return 0, ErrClosed
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if !c.readDeadline.IsZero() && !n.now.Before(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		n.cond.Wait()
+	}
+	nr := copy(b, c.buf)
+	c.buf = c.buf[nr:]
+	return nr, nil
+}
+
+// Write implements net.Conn
+func (c *Conn) Write(b []byte) (int, error) {
+	n := c.net
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if !c.writeDeadline.IsZero() && !n.now.Before(c.writeDeadline) {
+		return 0, timeoutError{}
+	}
+	cfg := n.linkConfig(string(c.local), string(c.remote))
+	if cfg.Partitioned || c.peer.closed {
+		return len(b), nil
+	}
+	e := &event{conn: c.peer, data: append([]byte(nil), b...)}
+	c.schedule(e, cfg)
+	return len(b), nil
+}
+
+func (c *Conn) schedule(e *event, cfg LinkConfig) {
+	n := c.net
+	e.at = n.now.Add(cfg.Latency)
+	if cfg.Jitter > 0 {
+		e.at = e.at.Add(time.Duration(n.rand.Int63n(int64(cfg.Jitter))))
+	} else if e.at.Before(c.lastAt) {
+		e.at = c.lastAt
+	}
+	if e.at.After(c.lastAt) {
+		c.lastAt = e.at
+	}
+	// writes of the conn still in flight are due later, so delivering now keeps the order
+	if e.at.Equal(n.now) {
+		n.fire(e)
+		return
+	}
+	n.push(e)
+}
+
+// Close implements net.Conn, the peer reads EOF after data written before
+func (c *Conn) Close() error {
+	n := c.net
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	delete(n.conns, c)
+	e := &event{conn: c.peer, fin: true}
+	cfg := n.linkConfig(string(c.local), string(c.remote))
+	cfg.Jitter = 0
+	c.schedule(e, cfg)
+	n.cond.Broadcast()
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr implements net.Conn
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.net.mux.Lock()
+	c.readDeadline = t
+	c.net.cond.Broadcast()
+	c.net.mux.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.net.mux.Lock()
+	c.writeDeadline = t
+	c.net.mux.Unlock()
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package simnet_test
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/simnet"
+)
+
+func newEcho(t *testing.T, n *simnet.Network) *arpc.Server {
+	ln, err := n.Listen("server")
+	if err != nil {
+		t.Fatalf("Network.Listen() error = %v", err)
+	}
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		ctx.Write(s)
+	})
+	go svr.Serve(ln)
+	return svr
+}
+
+func TestNetwork_Call(t *testing.T) {
+	n := simnet.New(1)
+	svr := newEcho(t, n)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(n.Dialer("client", "server"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	var rsp string
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v", rsp, err)
+	}
+
+	n.SetLink("client", "server", simnet.LinkConfig{Latency: time.Second})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Call("/echo", "delayed", &rsp, time.Second*5)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("Client.Call() returned before clock advanced: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	// the request and the response take one second each
+	for i := 0; i < 100; i++ {
+		n.Advance(time.Millisecond * 100)
+		select {
+		case err = <-done:
+			if err != nil || rsp != "delayed" {
+				t.Fatalf("Client.Call() = %v, %v", rsp, err)
+			}
+			if n.Now().Sub(time.Unix(0, 0)) < time.Second*2 {
+				t.Fatalf("Client.Call() done at %v, want >= 2s", n.Now())
+			}
+			return
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+	t.Fatalf("Client.Call() not done")
+}
+
+func TestNetwork_Partition(t *testing.T) {
+	n := simnet.New(1)
+	svr := newEcho(t, n)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(n.Dialer("client", "server"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	n.Partition("client", "server")
+	var rsp string
+	if err = c.Call("/echo", "lost", &rsp, time.Millisecond*20); err != arpc.ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, arpc.ErrClientTimeout)
+	}
+	if _, err = n.Dial("client", "server"); err != simnet.ErrPartitioned {
+		t.Fatalf("Network.Dial() error = %v, want %v", err, simnet.ErrPartitioned)
+	}
+	n.Heal("client", "server")
+	if err = c.Call("/echo", "healed", &rsp, time.Second); err != nil || rsp != "healed" {
+		t.Fatalf("Client.Call() = %v, %v", rsp, err)
+	}
+}
+
+func reorder(t *testing.T, seed int64) []byte {
+	n := simnet.New(seed)
+	ln, _ := n.Listen("b")
+	defer ln.Close()
+	n.SetLink("a", "b", simnet.LinkConfig{Latency: time.Millisecond, Jitter: time.Millisecond * 10})
+	go func() {
+		c, err := n.Dial("a", "b")
+		if err != nil {
+			return
+		}
+		for i := byte(0); i < 10; i++ {
+			c.Write([]byte{i})
+		}
+		c.Close()
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Listener.Accept() error = %v", err)
+	}
+	got := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		buf := make([]byte, 16)
+		for {
+			nr, err := c.Read(buf)
+			data = append(data, buf[:nr]...)
+			if err == io.EOF {
+				got <- data
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		n.Advance(time.Millisecond)
+		select {
+		case data := <-got:
+			return data
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatalf("EOF not delivered")
+	return nil
+}
+
+func TestNetwork_Reorder(t *testing.T) {
+	first := reorder(t, 7)
+	if len(first) != 10 {
+		t.Fatalf("delivered %v bytes, want 10", len(first))
+	}
+	if second := reorder(t, 7); !reflect.DeepEqual(first, second) {
+		t.Fatalf("delivery of the same seed differs: %v, %v", first, second)
+	}
+	for i, b := range first {
+		if int(b) != i {
+			return
+		}
+	}
+	t.Fatalf("writes not reordered: %v", first)
+}
+
+func TestNetwork_Disconnect(t *testing.T) {
+	n := simnet.New(1)
+	ln, _ := n.Listen("b")
+	defer ln.Close()
+	go n.Dial("a", "b")
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Listener.Accept() error = %v", err)
+	}
+	c.SetReadDeadline(n.Now().Add(time.Second))
+	timeout := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		timeout <- err
+	}()
+	n.Advance(time.Second)
+	if err = <-timeout; err == nil {
+		t.Fatalf("Conn.Read() returned no error after deadline")
+	}
+	c.SetReadDeadline(time.Time{})
+	n.Disconnect("a")
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Conn.Read() returned no error after disconnected")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+)
+
+// flight is a handler call shared by identical requests
+type flight struct {
+	once    sync.Once
+	done    chan struct{}
+	written bool
+	v       interface{}
+	isError bool
+	rspMeta Metadata
+}
+
+// Singleflight returns handler collapsing identical requests in flight into one call of h, e.g. for hot
+// read methods, so that backends are not stampeded on cache misses. Requests waiting for the call are
+// responded with the same response and response metadata.
+//
+// key returns key of a request, requests of the same key are collapsed, they are not if key returns an
+// empty string. If key is nil, requests of the same method and body are collapsed, metadata is ignored.
+// Requests are handled by h separately if the call shared returns without responding.
+func Singleflight(h HandlerFunc, key func(ctx *Context) string) HandlerFunc {
+	var (
+		mux     sync.Mutex
+		flights = map[string]*flight{}
+	)
+	return func(ctx *Context) {
+		if ctx.Message.Cmd() != CmdRequest {
+			h(ctx)
+			return
+		}
+		k := ""
+		if key != nil {
+			k = key(ctx)
+		} else {
+			k = ctx.Message.Method() + "\x00" + string(ctx.Body())
+		}
+		if k == "" {
+			h(ctx)
+			return
+		}
+
+		mux.Lock()
+		if f, ok := flights[k]; ok {
+			mux.Unlock()
+			<-f.done
+			if !f.written {
+				h(ctx)
+				return
+			}
+			for mk, mv := range f.rspMeta {
+				ctx.SetResponseMeta(mk, mv)
+			}
+			ctx.write(f.v, f.isError, TimeForever)
+			return
+		}
+		f := &flight{done: make(chan struct{})}
+		flights[k] = f
+		mux.Unlock()
+
+		done := func() {
+			mux.Lock()
+			if flights[k] == f {
+				delete(flights, k)
+			}
+			mux.Unlock()
+			close(f.done)
+		}
+		// only the first response is shared, responses written after h returned are not
+		onWrite := ctx.onWrite
+		ctx.onWrite = func(v interface{}, isError bool) {
+			if onWrite != nil {
+				onWrite(v, isError)
+			}
+			f.once.Do(func() {
+				f.written, f.v, f.isError = true, v, isError
+				for mk, mv := range ctx.rspMeta {
+					if f.rspMeta == nil {
+						f.rspMeta = Metadata{}
+					}
+					f.rspMeta[mk] = mv
+				}
+				done()
+			})
+		}
+		defer f.once.Do(done)
+		h(ctx)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleflight(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var arrived, calls int32
+	release := make(chan struct{})
+	svr := NewServer()
+	sf := Singleflight(func(ctx *Context) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		var key string
+		ctx.Bind(&key)
+		if key == "missing" {
+			ctx.Error(errors.New("not found"))
+			return
+		}
+		ctx.SetResponseMeta("source", "backend")
+		ctx.Write("value of " + key)
+	}, nil)
+	svr.Handler.Handle("/sf/get", func(ctx *Context) {
+		atomic.AddInt32(&arrived, 1)
+		sf(ctx)
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	const n = 6
+	clients := make([]*Client, n)
+	for i := range clients {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.Dial("tcp", ln.Addr().String())
+		})
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		defer c.Stop()
+		clients[i] = c
+	}
+
+	for round, key := range []string{"a", "missing"} {
+		atomic.StoreInt32(&arrived, 0)
+		release = make(chan struct{})
+		rsps := make([]string, n)
+		errs := make([]error, n)
+		wg := sync.WaitGroup{}
+		for i, c := range clients {
+			wg.Add(1)
+			go func(i int, c *Client) {
+				defer wg.Done()
+				errs[i] = c.Call("/sf/get", key, &rsps[i], time.Second*5)
+			}(i, c)
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for atomic.LoadInt32(&arrived) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("requests not arrived")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(time.Millisecond * 50)
+		close(release)
+		wg.Wait()
+
+		for i := 0; i < n; i++ {
+			if key == "missing" {
+				if errs[i] == nil || errs[i].Error() != "not found" {
+					t.Fatalf("Client.Call() error = %v, want not found", errs[i])
+				}
+				continue
+			}
+			if errs[i] != nil || rsps[i] != "value of a" {
+				t.Fatalf("Client.Call() = %q, %v", rsps[i], errs[i])
+			}
+		}
+		if v := atomic.LoadInt32(&calls); v != int32(round+1) {
+			t.Fatalf("handler called %v times, want %v", v, round+1)
+		}
+	}
+}
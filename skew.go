@@ -0,0 +1,65 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// DefaultMaxClockSkew is the clock skew of peers tolerated by default, see Handler.SetMaxClockSkew
+const DefaultMaxClockSkew = time.Second * 5
+
+func (h *handler) MaxClockSkew() time.Duration {
+	return h.load().maxClockSkew
+}
+
+func (h *handler) SetMaxClockSkew(d time.Duration) {
+	h.update(func(s *handlerState) { s.maxClockSkew = d })
+}
+
+func (h *handler) HandleClockSkew(onClockSkew func(c *Client, skew time.Duration)) {
+	h.update(func(s *handlerState) { s.onClockSkew = onClockSkew })
+}
+
+func (h *handler) OnClockSkew(c *Client, skew time.Duration) {
+	if s := h.load(); s.onClockSkew != nil {
+		s.onClockSkew(c, skew)
+		return
+	}
+	log.Warn("%v\t%v\tclock skew %v with the peer exceeds %v", c.logTag(), c.Conn.RemoteAddr(), skew, h.MaxClockSkew())
+}
+
+// ClockSkew returns how far the wall clock of the peer is ahead of the local one, negative if
+// behind, measured by the last Client.Ping, 0 if not measured or the peer doesn't report its clock
+func (c *Client) ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.clockSkew))
+}
+
+// pingBody is the body of ping responses, wall clock of the responder in unix nanoseconds
+func pingBody(clock Clock) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(clock.Now().UnixNano()))
+	return body
+}
+
+// measureSkew records skew reported by the ping response msg sent at start and received at end,
+// assuming the peer responded halfway of the round trip. Old peers respond without a body
+func (c *Client) measureSkew(msg *Message, start, end time.Time) {
+	data := msg.Data()
+	if len(data) != 8 {
+		return
+	}
+	peer := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	// start and end are compared with monotonic time, peer with wall time
+	skew := peer.Sub(start.Add(end.Sub(start) / 2))
+	atomic.StoreInt64(&c.clockSkew, int64(skew))
+	if max := c.Handler.MaxClockSkew(); max > 0 && (skew > max || skew < -max) {
+		c.Handler.OnClockSkew(c, skew)
+	}
+}
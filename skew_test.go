@@ -0,0 +1,75 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+// skewedClock is SystemClock with wall time shifted by skew
+type skewedClock struct {
+	systemClock
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return time.Now().Round(0).Add(c.skew)
+}
+
+func TestClient_ClockSkew(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetClock(skewedClock{skew: time.Minute})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	h := NewHandler()
+	skews := make(chan time.Duration, 1)
+	h.HandleClockSkew(func(c *Client, skew time.Duration) {
+		skews <- skew
+	})
+	c := newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	defer c.Stop()
+
+	if skew := c.ClockSkew(); skew != 0 {
+		t.Fatalf("Client.ClockSkew() = %v before ping, want 0", skew)
+	}
+	if _, err = c.Ping(time.Second); err != nil {
+		t.Fatalf("Client.Ping() failed: %v", err)
+	}
+	if skew := c.ClockSkew(); skew < time.Minute-time.Second || skew > time.Minute+time.Second {
+		t.Fatalf("Client.ClockSkew() = %v, want about 1m", skew)
+	}
+	select {
+	case skew := <-skews:
+		if skew != c.ClockSkew() {
+			t.Fatalf("skew of OnClockSkew = %v, want %v", skew, c.ClockSkew())
+		}
+	default:
+		t.Fatalf("OnClockSkew not called for skew beyond MaxClockSkew")
+	}
+
+	h.SetMaxClockSkew(time.Hour)
+	if _, err = c.Ping(time.Second); err != nil {
+		t.Fatalf("Client.Ping() failed: %v", err)
+	}
+	select {
+	case skew := <-skews:
+		t.Fatalf("OnClockSkew called for skew %v within MaxClockSkew", skew)
+	default:
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSRVRefresh is the interval of looking up SRV records again of SRVDialer by default
+var DefaultSRVRefresh = time.Second * 30
+
+// SRVDialer dials targets of DNS SRV records, e.g. of a Kubernetes headless service, without a
+// registry:
+//
+//	d := &arpc.SRVDialer{Service: "arpc", Proto: "tcp", Name: "echo.default.svc.cluster.local"}
+//	client, _ := arpc.NewClient(d.Dial)
+//
+// Records are cached and looked up again after Refresh, the cached records are used if looking up
+// fails. Targets are tried in order of priority, and of random weighted order of records with the
+// same priority as RFC 2782, so reconnecting goes to another target if the current one is down
+type SRVDialer struct {
+	// Service, Proto and Name of the SRV records, _Service._Proto.Name is looked up, or Name
+	// directly if Service and Proto are empty
+	Service string
+	Proto   string
+	Name    string
+	// Refresh is the interval of looking up again, DefaultSRVRefresh by default
+	Refresh time.Duration
+	// Timeout of dialing each target, 0 means no timeout
+	Timeout time.Duration
+	// DialAddr dials a target, tcp by default, e.g. for tls or a Transport
+	DialAddr func(addr string) (net.Conn, error)
+	// LookupSRV looks up records, net.LookupSRV by default
+	LookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	// Clock measures Refresh, SystemClock by default
+	Clock Clock
+
+	mux     sync.Mutex
+	records []*net.SRV
+	updated time.Time
+}
+
+// Dial implements DialerFunc, it dials targets in order until one succeeds, the last error is
+// returned if all of them fail
+func (d *SRVDialer) Dial() (net.Conn, error) {
+	addrs, err := d.Targets()
+	if err != nil {
+		return nil, err
+	}
+	dial := d.DialAddr
+	if dial == nil {
+		dial = func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, d.Timeout)
+		}
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dial(addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Targets returns addresses of targets in the order of dialing, records are looked up if they're
+// not cached or expired
+func (d *SRVDialer) Targets() ([]string, error) {
+	records, err := d.lookup()
+	if err != nil {
+		return nil, err
+	}
+	records = orderSRV(records, rand.Intn)
+	addrs := make([]string, len(records))
+	for i, r := range records {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+	}
+	return addrs, nil
+}
+
+func (d *SRVDialer) lookup() ([]*net.SRV, error) {
+	refresh := d.Refresh
+	if refresh <= 0 {
+		refresh = DefaultSRVRefresh
+	}
+	clock := d.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.records != nil && clock.Now().Sub(d.updated) < refresh {
+		return d.records, nil
+	}
+	lookup := d.LookupSRV
+	if lookup == nil {
+		lookup = net.LookupSRV
+	}
+	_, records, err := lookup(d.Service, d.Proto, d.Name)
+	// "." means the service is decidedly not available
+	if err == nil && (len(records) == 0 || (len(records) == 1 && records[0].Target == ".")) {
+		err = ErrSRVNoTarget
+	}
+	if err != nil {
+		if d.records != nil {
+			return d.records, nil
+		}
+		return nil, err
+	}
+	d.records, d.updated = records, clock.Now()
+	return records, nil
+}
+
+// orderSRV returns records sorted by priority, records of the same priority are in random order
+// weighted by weight as RFC 2782, rnd(n) returns a random number in [0, n)
+func orderSRV(records []*net.SRV, rnd func(int) int) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		shuffleSRV(sorted[i:j], rnd)
+		i = j
+	}
+	return sorted
+}
+
+// shuffleSRV orders records of the same priority, each next record is chosen with probability
+// of its weight of the sum of records left, records of weight 0 have a small chance
+func shuffleSRV(records []*net.SRV, rnd func(int) int) {
+	sum := 0
+	for _, r := range records {
+		sum += int(r.Weight) + 1
+	}
+	for i := range records {
+		n := rnd(sum)
+		for j := i; j < len(records); j++ {
+			w := int(records[j].Weight) + 1
+			if n < w {
+				records[i], records[j] = records[j], records[i]
+				sum -= w
+				break
+			}
+			n -= w
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package arpc
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 1},
+		{Target: "a", Priority: 10, Weight: 0},
+		{Target: "b", Priority: 10, Weight: 99},
+	}
+	counts := map[string]int{}
+	// rnd returns each number of [0, n) in turn, so b is first for 99 of 101 draws
+	seq := 0
+	rnd := func(n int) int {
+		seq++
+		return seq % n
+	}
+	for i := 0; i < 1010; i++ {
+		sorted := orderSRV(records, rnd)
+		if sorted[2].Target != "c" {
+			t.Fatalf("orderSRV()[2] = %v, want c of the lowest priority", sorted[2].Target)
+		}
+		counts[sorted[0].Target]++
+	}
+	if counts["b"] < 900 || counts["a"] == 0 {
+		t.Fatalf("first of priority 10 = %v, want b mostly by weight", counts)
+	}
+	if records[0].Target != "c" {
+		t.Fatalf("orderSRV() modified records")
+	}
+}
+
+func TestSRVDialer_Dial(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	// a closed port of the best priority, dialing falls back to the server
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	lookups := 0
+	fail := false
+	clock := NewMockClock(time.Unix(1600000000, 0))
+	d := &SRVDialer{
+		Service: "arpc",
+		Proto:   "tcp",
+		Name:    "echo",
+		Refresh: time.Second * 20,
+		Clock:   clock,
+		LookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+			lookups++
+			if fail {
+				return "", nil, errors.New("lookup failed")
+			}
+			return "_arpc._tcp.echo.", []*net.SRV{
+				{Target: "127.0.0.1.", Port: uint16(port), Priority: 20},
+				{Target: "127.0.0.1.", Port: uint16(closedPort), Priority: 10},
+			}, nil
+		},
+	}
+	addrs, err := d.Targets()
+	if err != nil || len(addrs) != 2 || addrs[0] != "127.0.0.1:"+strconv.Itoa(closedPort) {
+		t.Fatalf("SRVDialer.Targets() = (%v, %v), want the closed port first", addrs, err)
+	}
+
+	c, err := NewClient(d.Dial)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	rsp := ""
+	if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want hello", rsp, err)
+	}
+	if lookups != 1 {
+		t.Fatalf("lookups = %v, want 1 of cached records", lookups)
+	}
+
+	// cached records are used if looking up fails after expired
+	fail = true
+	clock.Advance(time.Second * 30)
+	if addrs, err := d.Targets(); err != nil || len(addrs) != 2 || lookups != 2 {
+		t.Fatalf("SRVDialer.Targets() = (%v, %v) after %v lookups, want cached records", addrs, err, lookups)
+	}
+
+	d = &SRVDialer{Name: "none", LookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+		return "none.", []*net.SRV{{Target: "."}}, nil
+	}}
+	if _, err := d.Dial(); err != ErrSRVNoTarget {
+		t.Fatalf("SRVDialer.Dial() error = %v, want %v", err, ErrSRVNoTarget)
+	}
+}
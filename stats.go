@@ -0,0 +1,136 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats defines counters of a Client
+type Stats struct {
+	MessagesIn  uint64
+	MessagesOut uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	Calls       uint64
+	CallErrors  uint64
+}
+
+// Stats returns a snapshot of counters
+func (c *Client) Stats() Stats {
+	return Stats{
+		MessagesIn:  atomic.LoadUint64(&c.stats.MessagesIn),
+		MessagesOut: atomic.LoadUint64(&c.stats.MessagesOut),
+		BytesIn:     atomic.LoadUint64(&c.stats.BytesIn),
+		BytesOut:    atomic.LoadUint64(&c.stats.BytesOut),
+		Calls:       atomic.LoadUint64(&c.stats.Calls),
+		CallErrors:  atomic.LoadUint64(&c.stats.CallErrors),
+	}
+}
+
+// ConnectedAt returns when the current conn is connected, updated after reconnected
+func (c *Client) ConnectedAt() time.Time {
+	return monoTime(atomic.LoadInt64(&c.connectedAt))
+}
+
+// Age returns how long the current conn has been connected
+func (c *Client) Age() time.Duration {
+	return c.Handler.Clock().Now().Sub(c.ConnectedAt())
+}
+
+// LastRead returns when the last message is received, zero if none
+func (c *Client) LastRead() time.Time {
+	return monoTime(atomic.LoadInt64(&c.lastRead))
+}
+
+// LastWrite returns when messages are sent last, zero if none
+func (c *Client) LastWrite() time.Time {
+	return monoTime(atomic.LoadInt64(&c.lastWrite))
+}
+
+// IdleTime returns how long since the last read or write, e.g. for idle eviction
+func (c *Client) IdleTime() time.Duration {
+	last := atomic.LoadInt64(&c.lastRead)
+	if w := atomic.LoadInt64(&c.lastWrite); w > last {
+		last = w
+	}
+	if last == 0 {
+		last = atomic.LoadInt64(&c.connectedAt)
+	}
+	return time.Duration(monoNanos(c.Handler.Clock()) - last)
+}
+
+// monoBase is the base of timestamps of stats, which are kept as nanoseconds since it, so that
+// durations between them are measured with monotonic time, not affected by wall clock adjusted
+var monoBase = time.Now()
+
+func monoNanos(clock Clock) int64 {
+	return int64(clock.Now().Sub(monoBase))
+}
+
+// monoTime returns time of ns returned by monoNanos, zero if ns is 0
+func monoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return monoBase.Add(time.Duration(ns))
+}
+
+func (c *Client) setConnectedAt() {
+	atomic.StoreInt64(&c.connectedAt, monoNanos(c.Handler.Clock()))
+}
+
+func (c *Client) statRecv(msg *Message) {
+	atomic.StoreInt64(&c.lastRead, monoNanos(c.Handler.Clock()))
+	atomic.AddUint64(&c.stats.MessagesIn, 1)
+	atomic.AddUint64(&c.stats.BytesIn, uint64(msg.Len()))
+}
+
+func (c *Client) statSend(messages int, n int) {
+	atomic.StoreInt64(&c.lastWrite, monoNanos(c.Handler.Clock()))
+	atomic.AddUint64(&c.stats.MessagesOut, uint64(messages))
+	if n > 0 {
+		atomic.AddUint64(&c.stats.BytesOut, uint64(n))
+	}
+}
+
+func (c *Client) statCall(err *error) {
+	atomic.AddUint64(&c.stats.Calls, 1)
+	if *err != nil {
+		atomic.AddUint64(&c.stats.CallErrors, 1)
+	}
+}
+
+// AllocStats defines sampled allocations of a call path
+type AllocStats struct {
+	Samples uint64
+	Mallocs uint64
+	Bytes   uint64
+}
+
+// PerSample returns average mallocs and bytes per sampled call
+func (s AllocStats) PerSample() (mallocs float64, bytes float64) {
+	if s.Samples == 0 {
+		return 0, 0
+	}
+	return float64(s.Mallocs) / float64(s.Samples), float64(s.Bytes) / float64(s.Samples)
+}
+
+// AllocReport defines sampled allocations of recv, dispatch and send paths of all clients
+type AllocReport struct {
+	Recv     AllocStats
+	Dispatch AllocStats
+	Send     AllocStats
+}
+
+// ReadAllocReport returns a snapshot of sampled allocations, see SetAllocSampleRate
+func ReadAllocReport() AllocReport {
+	return AllocReport{
+		Recv:     allocSampler.recv.stats(),
+		Dispatch: allocSampler.dispatch.stats(),
+		Send:     allocSampler.send.stats(),
+	}
+}
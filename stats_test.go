@@ -0,0 +1,52 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_Activity(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/activity", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	begin := time.Now()
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	if at := c.ConnectedAt(); at.Before(begin) || at.After(time.Now()) {
+		t.Fatalf("Client.ConnectedAt() = %v, want after %v", at, begin)
+	}
+	if !c.LastRead().IsZero() || !c.LastWrite().IsZero() {
+		t.Fatalf("Client.LastRead(), LastWrite() = %v, %v before any message, want zero", c.LastRead(), c.LastWrite())
+	}
+	if err = c.Call("/activity", "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if c.LastWrite().Before(c.ConnectedAt()) || c.LastRead().Before(c.ConnectedAt()) {
+		t.Fatalf("Client.LastRead(), LastWrite() = %v, %v, connected at %v", c.LastRead(), c.LastWrite(), c.ConnectedAt())
+	}
+	if st := c.Stats(); st.MessagesIn != 1 || st.MessagesOut != 1 {
+		t.Fatalf("Client.Stats() = %+v, want 1 message in and out", st)
+	}
+	if c.Age() < c.IdleTime() {
+		t.Fatalf("Client.Age() = %v less than IdleTime() = %v", c.Age(), c.IdleTime())
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/lesismal/arpc/log"
+	"github.com/lesismal/arpc/util"
+)
+
+// Stream frames share the header of other messages, seq is the stream id:
+//
+//	CmdStreamOpen:   [header][method]
+//	CmdStreamData:   [header][data]
+//	CmdStreamClose:  [header][error, if the error flag is set]
+//	CmdStreamWindow: [header][increment:4]
+//
+// Frames sent by the opener of a stream have the async flag set, ids of streams opened by each side
+// of a connection are in different spaces. Streams are not supported by tiny frames.
+const (
+	// CmdStreamOpen opens a stream of method
+	CmdStreamOpen byte = 4
+	// CmdStreamData carries data of a stream
+	CmdStreamData byte = 5
+	// CmdStreamClose closes the sending side of a stream, or resets the whole stream with an error
+	CmdStreamClose byte = 6
+	// CmdStreamWindow returns send credit of a stream consumed by the receiver
+	CmdStreamWindow byte = 7
+
+	streamFlagOpener = HeaderFlagMaskAsync
+)
+
+// StreamWindowSize is the receive window of each stream, senders block when it's exhausted, so a
+// stream never buffers more than it on the receiver or floods the send queue of the connection
+const StreamWindowSize = 256 * 1024
+
+// DefaultMaxStreams is the number of concurrent streams the peer could open on a connection by
+// default, see Handler.SetMaxStreams
+const DefaultMaxStreams = 1024
+
+// StreamFunc handles a stream opened by the peer, the stream is closed and finished when it returns,
+// data the peer sends after that is dropped
+type StreamFunc func(s *Stream)
+
+type streamKey struct {
+	id    uint64
+	local bool
+}
+
+// Stream is a bidirectional stream multiplexed over the connection, Send and Recv could be called
+// by different goroutines, but each of them should not be called concurrently
+type Stream struct {
+	c      *Client
+	id     uint64
+	method string
+	local  bool
+	ctx    context.Context
+	cancel func()
+
+	window *flowWindow
+
+	mux        sync.Mutex
+	queue      [][]byte
+	queued     int
+	consumed   int
+	ch         chan util.Empty
+	sendClosed bool
+	recvClosed bool
+	recvErr    error
+	err        error
+}
+
+// Method returns method of the stream
+func (s *Stream) Method() string {
+	return s.method
+}
+
+// Client returns the connection of the stream
+func (s *Stream) Client() *Client {
+	return s.c
+}
+
+// Context returns context of the stream, it's done when the stream is closed by both sides or reset
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send sends v to the peer, it blocks when the window of the stream is exhausted until the peer
+// receives enough, or the stream is reset
+func (s *Stream) Send(v interface{}) error {
+	s.mux.Lock()
+	err := s.err
+	if err == nil && s.sendClosed {
+		err = ErrStreamClosed
+	}
+	s.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data := util.ValueToBytes(s.c.Codec, v)
+	for {
+		ok, ch := s.window.tryAcquire(len(data))
+		if ok {
+			break
+		}
+		select {
+		case <-ch:
+		case <-s.ctx.Done():
+			if err := s.doneErr(); err != nil {
+				return err
+			}
+			return s.ctx.Err()
+		}
+	}
+	if err := s.doneErr(); err != nil {
+		return err
+	}
+	return s.push(CmdStreamData, data, false)
+}
+
+// Recv receives data from the peer into v, v could be a *[]byte, *string or decoded by Codec.
+// It returns io.EOF after the peer closed its sending side
+func (s *Stream) Recv(v interface{}) error {
+	for {
+		s.mux.Lock()
+		if len(s.queue) > 0 {
+			data := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.queued -= len(data)
+			s.consumed += len(data)
+			increment := 0
+			if s.consumed >= StreamWindowSize/2 {
+				increment, s.consumed = s.consumed, 0
+			}
+			s.mux.Unlock()
+			if increment > 0 {
+				buf := make([]byte, 4)
+				binary.LittleEndian.PutUint32(buf, uint32(increment))
+				s.push(CmdStreamWindow, buf, false)
+			}
+			return s.decode(data, v)
+		}
+		if s.recvClosed {
+			err := s.recvErr
+			s.mux.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+		if s.err != nil {
+			err := s.err
+			s.mux.Unlock()
+			return err
+		}
+		ch := s.ch
+		s.mux.Unlock()
+		<-ch
+	}
+}
+
+func (s *Stream) decode(data []byte, v interface{}) error {
+	switch vt := v.(type) {
+	case nil:
+	case *[]byte:
+		*vt = data
+	case *string:
+		*vt = string(data)
+	default:
+		return s.c.Codec.Unmarshal(data, v)
+	}
+	return nil
+}
+
+// Close closes the sending side of the stream, the peer receives io.EOF after data sent, and the
+// stream could still receive until the peer closes
+func (s *Stream) Close() error {
+	s.mux.Lock()
+	if s.sendClosed || s.err != nil {
+		s.mux.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	finished := s.recvClosed
+	s.mux.Unlock()
+	err := s.push(CmdStreamClose, nil, false)
+	if finished {
+		s.finish()
+	}
+	return err
+}
+
+// CloseWithError resets the stream, Send and Recv of both sides fail with err
+func (s *Stream) CloseWithError(err error) error {
+	if err == nil {
+		return s.Close()
+	}
+	if !s.reset(err) {
+		return nil
+	}
+	return s.push(CmdStreamClose, err.Error(), true)
+}
+
+func (s *Stream) push(cmd byte, v interface{}, isError bool) error {
+	method := ""
+	if cmd == CmdStreamOpen {
+		method = s.method
+	}
+	msg := newMessage(cmd, method, v, isError, s.local, s.id, s.c.Handler, s.c.Codec, nil)
+	if cmd == CmdStreamWindow {
+		return s.c.pushControl(msg)
+	}
+	return s.c.PushMsg(msg, TimeForever)
+}
+
+// doneErr returns the error the stream is reset with or closed by
+func (s *Stream) doneErr() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.sendClosed {
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// wake wakes up Recv, s.mux should be held
+func (s *Stream) wake() {
+	close(s.ch)
+	s.ch = make(chan util.Empty)
+}
+
+func (s *Stream) onData(data []byte) {
+	s.mux.Lock()
+	if s.recvClosed || s.err != nil {
+		s.mux.Unlock()
+		return
+	}
+	// the sender takes idle credit for a message larger than the window
+	if s.queued > 0 && s.queued+len(data) > StreamWindowSize {
+		s.mux.Unlock()
+		log.Warn("%v\t%v\tstream [%v] %v window exceeded, reset", s.c.logTag(), s.c.Conn.RemoteAddr(), s.method, s.id)
+		s.CloseWithError(ErrStreamWindowExceeded)
+		return
+	}
+	s.queue = append(s.queue, data)
+	s.queued += len(data)
+	s.wake()
+	s.mux.Unlock()
+}
+
+func (s *Stream) onClose(err error) {
+	if err != nil {
+		s.reset(err)
+		return
+	}
+	s.mux.Lock()
+	if s.recvClosed || s.err != nil {
+		s.mux.Unlock()
+		return
+	}
+	s.recvClosed = true
+	finished := s.sendClosed
+	s.wake()
+	s.mux.Unlock()
+	if finished {
+		s.finish()
+	}
+}
+
+// reset fails the stream with err, it returns false if the stream was reset already
+func (s *Stream) reset(err error) bool {
+	s.mux.Lock()
+	if s.err != nil {
+		s.mux.Unlock()
+		return false
+	}
+	s.err = err
+	if !s.recvClosed {
+		s.recvClosed, s.recvErr = true, err
+	}
+	s.wake()
+	s.mux.Unlock()
+	s.window.close()
+	s.finish()
+	return true
+}
+
+// finish removes the stream from the connection after closed by both sides or reset
+func (s *Stream) finish() {
+	s.c.removeStream(s)
+	s.cancel()
+}
+
+func newStream(ctx context.Context, c *Client, id uint64, method string, local bool) *Stream {
+	s := &Stream{
+		c:      c,
+		id:     id,
+		method: method,
+		local:  local,
+		window: newFlowWindow(StreamWindowSize),
+		ch:     make(chan util.Empty),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return s
+}
+
+// OpenStream opens a stream of method handled by HandleStream of the peer
+func (c *Client) OpenStream(method string) (*Stream, error) {
+	return c.OpenStreamWith(context.Background(), method)
+}
+
+// OpenStreamWith opens a stream of method with ctx, the stream is reset when ctx is done
+func (c *Client) OpenStreamWith(ctx context.Context, method string) (*Stream, error) {
+	if err := c.checkStateAndMethod(method); err != nil {
+		return nil, err
+	}
+	c.smux.Lock()
+	s := newStream(ctx, c, c.streamSeq+1, method, true)
+	c.streamSeq++
+	if c.streams == nil {
+		c.streams = map[streamKey]*Stream{}
+	}
+	c.streams[streamKey{s.id, true}] = s
+	c.smux.Unlock()
+
+	if err := s.push(CmdStreamOpen, nil, false); err != nil {
+		s.reset(err)
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-s.ctx.Done()
+			if ctx.Err() != nil {
+				s.CloseWithError(ctx.Err())
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Streams returns number of streams of the connection
+func (c *Client) Streams() int {
+	c.smux.Lock()
+	defer c.smux.Unlock()
+	return len(c.streams)
+}
+
+func (c *Client) getStream(id uint64, local bool) (*Stream, bool) {
+	c.smux.Lock()
+	defer c.smux.Unlock()
+	s, ok := c.streams[streamKey{id, local}]
+	return s, ok
+}
+
+func (c *Client) removeStream(s *Stream) {
+	c.smux.Lock()
+	defer c.smux.Unlock()
+	key := streamKey{s.id, s.local}
+	if c.streams[key] == s {
+		delete(c.streams, key)
+		if !s.local {
+			c.remoteStreams--
+		}
+	}
+}
+
+// resetStreams fails streams when the connection is stopped or broken
+func (c *Client) resetStreams(err error) {
+	c.smux.Lock()
+	streams := c.streams
+	c.streams = nil
+	c.remoteStreams = 0
+	c.smux.Unlock()
+	for _, s := range streams {
+		s.reset(err)
+	}
+}
+
+func (h *handler) MaxStreams() int {
+	return h.load().maxStreams
+}
+
+func (h *handler) SetMaxStreams(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.update(func(s *handlerState) { s.maxStreams = n })
+}
+
+// onStream handles stream frames from the peer
+func (h *handler) onStream(c *Client, msg *Message, s *handlerState) {
+	cmd, id := msg.Cmd(), msg.Seq()
+	// the peer opened the stream if it's an opener's frame
+	local := msg.Buffer[HeaderIndexFlag]&streamFlagOpener == 0
+	if cmd == CmdStreamOpen {
+		ml := msg.MethodLen()
+		if local || ml <= 0 || ml > MaxMethodLen || HeadLen+ml > msg.Len() {
+			log.Warn("%v OnMessage: invalid stream open, dropped", h.LogTag())
+			return
+		}
+		method := msg.method()
+		sh, ok := s.streamRoutes[method]
+		if !ok {
+			log.Warn("%v OnMessage: invalid stream method: [%v], no handler", h.LogTag(), method)
+			rst := &Stream{c: c, id: id}
+			rst.push(CmdStreamClose, ErrMethodNotFound.Error(), true)
+			return
+		}
+		st := newStream(context.Background(), c, id, method, false)
+		c.smux.Lock()
+		if _, ok := c.streams[streamKey{id, false}]; ok {
+			c.smux.Unlock()
+			log.Warn("%v OnMessage: duplicate stream open: [%v] of id %v, dropped", h.LogTag(), method, id)
+			return
+		}
+		if s.maxStreams > 0 && c.remoteStreams >= s.maxStreams {
+			c.smux.Unlock()
+			log.Warn("%v OnMessage: stream [%v] beyond %v streams, reset", h.LogTag(), method, s.maxStreams)
+			rst := &Stream{c: c, id: id}
+			rst.push(CmdStreamClose, ErrStreamLimit.Error(), true)
+			return
+		}
+		if c.streams == nil {
+			c.streams = map[streamKey]*Stream{}
+		}
+		c.streams[streamKey{id, false}] = st
+		c.remoteStreams++
+		c.smux.Unlock()
+		go util.Safe(func() {
+			c.labelGoroutine(labelLoopWorker)
+			defer func() {
+				st.Close()
+				st.finish()
+			}()
+			sh(st)
+		})
+		return
+	}
+
+	st, ok := c.getStream(id, local)
+	if !ok {
+		// the peer keeps sending to a stream finished here, tell it to stop
+		if cmd == CmdStreamData {
+			rst := &Stream{c: c, id: id, local: local}
+			rst.push(CmdStreamClose, ErrStreamNotFound.Error(), true)
+		}
+		return
+	}
+	switch cmd {
+	case CmdStreamData:
+		data := make([]byte, len(msg.Data()))
+		copy(data, msg.Data())
+		st.onData(data)
+	case CmdStreamClose:
+		st.onClose(msg.Error())
+	case CmdStreamWindow:
+		if data := msg.Data(); len(data) >= 4 {
+			st.window.release(int(binary.LittleEndian.Uint32(data)))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package arpc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_OpenStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.HandleStream("/echo", func(s *Stream) {
+		for {
+			data := []byte{}
+			if err := s.Recv(&data); err != nil {
+				if err != io.EOF {
+					t.Errorf("Stream.Recv() error = %v", err)
+				}
+				return
+			}
+			if err := s.Send(data); err != nil {
+				t.Errorf("Stream.Send() error = %v", err)
+				return
+			}
+		}
+	})
+	svr.Handler.Handle("/ping", func(ctx *Context) {
+		ctx.Write("pong")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	s, err := c.OpenStream("/echo")
+	if err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+
+	// more than the window in flight, the sender is blocked until the echo is received
+	chunk := bytes.Repeat([]byte("a"), 32*1024)
+	total := StreamWindowSize * 4 / len(chunk)
+	chErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			if err := s.Send(chunk); err != nil {
+				chErr <- err
+				return
+			}
+		}
+		chErr <- s.Close()
+	}()
+
+	// calls are not starved by the stream
+	rsp := ""
+	if err := c.Call("/ping", "", &rsp, time.Second); err != nil || rsp != "pong" {
+		t.Fatalf("Client.Call() = (%v, %v), want pong", rsp, err)
+	}
+
+	for i := 0; i < total; i++ {
+		data := []byte{}
+		if err := s.Recv(&data); err != nil {
+			t.Fatalf("Stream.Recv() error = %v", err)
+		}
+		if !bytes.Equal(data, chunk) {
+			t.Fatalf("Stream.Recv() = %v bytes, want %v", len(data), len(chunk))
+		}
+	}
+	if err := s.Recv(nil); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+	if err := <-chErr; err != nil {
+		t.Fatalf("Stream.Send() error = %v", err)
+	}
+	select {
+	case <-s.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Stream.Context() not done after closed by both sides")
+	}
+	if n := c.Streams(); n != 0 {
+		t.Fatalf("Client.Streams() = %v, want 0", n)
+	}
+
+	s, err = c.OpenStream("/none")
+	if err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+	if err := s.Recv(nil); err == nil || err.Error() != ErrMethodNotFound.Error() {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, ErrMethodNotFound)
+	}
+	if err := s.Send("x"); err == nil {
+		t.Fatalf("Stream.Send() error = nil after reset")
+	}
+
+	s, err = c.OpenStream("/echo")
+	if err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+	c.Stop()
+	if err := s.Recv(nil); err != ErrClientStopped {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestHandler_SetMaxStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	opened := make(chan *Stream, 4)
+	svr := NewServer()
+	svr.Handler.SetMaxStreams(1)
+	svr.Handler.HandleStream("/hold", func(s *Stream) {
+		opened <- s
+		s.Recv(nil)
+	})
+	svr.Handler.Handle("/ping", func(ctx *Context) {
+		ctx.Write("pong")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if n := svr.Handler.MaxStreams(); n != 1 {
+		t.Fatalf("Handler.MaxStreams() = %v, want 1", n)
+	}
+
+	s1, err := c.OpenStream("/hold")
+	if err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+	peer := <-opened
+
+	// a duplicate open of a live id is dropped instead of replacing the stream
+	if err = s1.push(CmdStreamOpen, nil, false); err != nil {
+		t.Fatalf("Stream.push() error = %v", err)
+	}
+	if err = c.Call("/ping", "", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	select {
+	case <-opened:
+		t.Fatalf("duplicate stream open handled")
+	default:
+	}
+	if st, ok := peer.c.getStream(s1.id, false); !ok || st != peer {
+		t.Fatalf("stream of duplicate id = (%v, %v), want the live one", st, ok)
+	}
+
+	// streams beyond the limit are reset
+	s2, err := c.OpenStream("/hold")
+	if err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+	if err = s2.Recv(nil); err == nil || err.Error() != ErrStreamLimit.Error() {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, ErrStreamLimit)
+	}
+
+	// the limit is released when the stream finishes
+	s1.Close()
+	select {
+	case <-peer.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("stream not finished after closed by both sides")
+	}
+	if _, err = c.OpenStream("/hold"); err != nil {
+		t.Fatalf("Client.OpenStream() error = %v", err)
+	}
+	select {
+	case <-opened:
+	case <-time.After(time.Second):
+		t.Fatalf("stream not opened after the limit released")
+	}
+}
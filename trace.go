@@ -0,0 +1,268 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetaKeyParentSpan carries id of the span that issued a call, so that spans of the callee are
+// linked to it, see Tracer
+const MetaKeyParentSpan = "arpc-parent-span"
+
+// DefaultTracerSize is the number of spans kept by Tracer by default
+const DefaultTracerSize = 4096
+
+// SpanKind defines side of a span
+type SpanKind int
+
+const (
+	// SpanServer is the span of handling a request or notify
+	SpanServer SpanKind = iota
+	// SpanClient is the span of a call issued under a context carrying a parent span, e.g. by a
+	// handler with Context.RequestContext
+	SpanClient
+)
+
+var spanKindNames = []string{"server", "client"}
+
+// String implements fmt.Stringer
+func (k SpanKind) String() string {
+	if k >= 0 && int(k) < len(spanKindNames) {
+		return spanKindNames[k]
+	}
+	return "unknown"
+}
+
+// Span is a handler execution or a call recorded by Tracer, spans of the same request id share
+// TraceID and are linked by ParentID
+type Span struct {
+	TraceID  string
+	ID       string
+	ParentID string
+	Kind     SpanKind
+	Method   string
+	Peer     string
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+}
+
+type parentSpanKey struct{}
+
+// WithParentSpan returns a copy of parent carrying span id, calls by Client.CallWith and NotifyWith
+// with it are linked to the span
+func WithParentSpan(parent context.Context, id string) context.Context {
+	return context.WithValue(parent, parentSpanKey{}, id)
+}
+
+// ParentSpanFrom returns parent span id carried by ctx
+func ParentSpanFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(parentSpanKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Tracer records spans of handlers and the calls they issue, spans of a request across hops are
+// linked into a causality graph, see Tracer.Graph. A tracer shared by handlers of services in the
+// same process links their spans, spans of other processes are exported by OnFinish
+type Tracer struct {
+	// OnFinish is called with each span finished, e.g. to log or export it
+	OnFinish func(s Span)
+
+	mux   sync.Mutex
+	size  int
+	next  int
+	spans []Span
+}
+
+// NewTracer returns Tracer keeping the latest size spans finished, DefaultTracerSize if size <= 0
+func NewTracer(size int) *Tracer {
+	if size <= 0 {
+		size = DefaultTracerSize
+	}
+	return &Tracer{size: size}
+}
+
+// Spans returns spans of traceID kept in order of started, all spans if traceID is empty
+func (t *Tracer) Spans(traceID string) []Span {
+	t.mux.Lock()
+	spans := make([]Span, 0, len(t.spans))
+	for _, s := range t.spans {
+		if traceID == "" || s.TraceID == traceID {
+			spans = append(spans, s)
+		}
+	}
+	t.mux.Unlock()
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	return spans
+}
+
+// Graph returns causality graph of spans of traceID, spans whose parents are not kept are roots
+func (t *Tracer) Graph(traceID string) *CallGraph {
+	spans := t.Spans(traceID)
+	nodes := make(map[string]*CallNode, len(spans))
+	for _, s := range spans {
+		nodes[s.ID] = &CallNode{Span: s}
+	}
+	g := &CallGraph{}
+	for _, s := range spans {
+		node := nodes[s.ID]
+		if parent, ok := nodes[s.ParentID]; ok && parent != node {
+			parent.Children = append(parent.Children, node)
+		} else {
+			g.Roots = append(g.Roots, node)
+		}
+	}
+	return g
+}
+
+func (t *Tracer) finish(s *Span, err interface{}, clock Clock) {
+	s.Duration = clock.Now().Sub(s.Start)
+	if err != nil {
+		s.Error = fmt.Sprint(err)
+	}
+	t.mux.Lock()
+	if len(t.spans) < t.size {
+		t.spans = append(t.spans, *s)
+	} else {
+		t.spans[t.next] = *s
+		t.next = (t.next + 1) % t.size
+	}
+	t.mux.Unlock()
+	if t.OnFinish != nil {
+		t.OnFinish(*s)
+	}
+}
+
+// CallGraph is the causality graph of spans of a request
+type CallGraph struct {
+	Roots []*CallNode
+}
+
+// CallNode is a span with the spans caused by it, in order of started
+type CallNode struct {
+	Span
+	Children []*CallNode
+}
+
+// Len returns number of spans in the graph
+func (g *CallGraph) Len() int {
+	n := 0
+	var count func(nodes []*CallNode)
+	count = func(nodes []*CallNode) {
+		for _, node := range nodes {
+			n++
+			count(node.Children)
+		}
+	}
+	count(g.Roots)
+	return n
+}
+
+// String returns the graph as an indented tree, a span per line
+func (g *CallGraph) String() string {
+	sb := &strings.Builder{}
+	var write func(nodes []*CallNode, depth int)
+	write = func(nodes []*CallNode, depth int) {
+		for _, node := range nodes {
+			fmt.Fprintf(sb, "%v%v %v [%v] %v", strings.Repeat("  ", depth), node.Kind, node.Method, node.ID, node.Duration)
+			if node.Error != "" {
+				fmt.Fprintf(sb, " error: %v", node.Error)
+			}
+			sb.WriteString("\n")
+			write(node.Children, depth+1)
+		}
+	}
+	write(g.Roots, 0)
+	return sb.String()
+}
+
+func (h *handler) Tracer() *Tracer {
+	return h.load().tracer
+}
+
+func (h *handler) SetTracer(t *Tracer) {
+	h.update(func(s *handlerState) { s.tracer = t })
+}
+
+// SpanID returns id of the span of ctx, empty if the handler has no Tracer
+func (ctx *Context) SpanID() string {
+	if ctx.span == nil {
+		return ""
+	}
+	return ctx.span.ID
+}
+
+// startSpan starts the server span of ctx, linked to the parent span sent by the caller
+func (ctx *Context) startSpan() {
+	s := &Span{
+		TraceID: ctx.RequestID(),
+		ID:      NewRequestID(),
+		Kind:    SpanServer,
+		Method:  ctx.Message.Method(),
+		Peer:    ctx.Client.RealAddr().String(),
+		Start:   ctx.Client.Handler.Clock().Now(),
+	}
+	s.ParentID, _ = ctx.Meta().Get(MetaKeyParentSpan)
+	ctx.span = s
+}
+
+// finishSpan finishes the server span of ctx after handlers of the route returned
+func (ctx *Context) finishSpan(t *Tracer) {
+	t.finish(ctx.span, ctx.err, ctx.Client.Handler.Clock())
+}
+
+// startSpan starts the client span of msg if ctx carries a parent span, the span is sent as the
+// parent of spans of the callee. Without Tracer the parent span is sent as it is
+func (c *Client) startSpan(ctx context.Context, msg *Message) (*Span, error) {
+	parent, ok := ParentSpanFrom(ctx)
+	if !ok || strings.HasPrefix(msg.method(), internalRoutePrefix) {
+		return nil, nil
+	}
+	md := msg.Meta()
+	if md == nil {
+		md = Metadata{}
+	}
+	t := c.Handler.Tracer()
+	if t == nil {
+		md[MetaKeyParentSpan] = parent
+		return nil, msg.SetMeta(md)
+	}
+	s := &Span{
+		ID:       NewRequestID(),
+		ParentID: parent,
+		Kind:     SpanClient,
+		Method:   msg.Method(),
+		Peer:     c.Conn.RemoteAddr().String(),
+		Start:    c.Handler.Clock().Now(),
+	}
+	s.TraceID, _ = md.Get(MetaKeyRequestID)
+	md[MetaKeyParentSpan] = s.ID
+	if err := msg.SetMeta(md); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// finishSpan finishes client span s with err of the call
+func (c *Client) finishSpan(s *Span, err *error) {
+	if s == nil {
+		return
+	}
+	t := c.Handler.Tracer()
+	if t == nil {
+		return
+	}
+	var e interface{}
+	if *err != nil {
+		e = *err
+	}
+	t.finish(s, e, c.Handler.Clock())
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestTracer_Graph(t *testing.T) {
+	tr := NewTracer(0)
+	finished := make(chan Span, 16)
+	tr.OnFinish = func(s Span) { finished <- s }
+
+	serve := func(h Handler) (*Server, string) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		svr := NewServer()
+		svr.Handler = h
+		go svr.Serve(ln)
+		return svr, ln.Addr().String()
+	}
+	dial := func(addr string, h Handler) *Client {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		return newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	}
+
+	leaf := NewHandler()
+	leaf.SetTracer(tr)
+	leaf.Handle("/trace/leaf", func(ctx *Context) {
+		if string(ctx.Body()) == "fail" {
+			ctx.Error(errors.New("failed"))
+			return
+		}
+		ctx.Write("ok")
+	})
+	leafSvr, leafAddr := serve(leaf)
+	defer leafSvr.Stop()
+
+	traced := NewHandler()
+	traced.SetTracer(tr)
+	cTraced := dial(leafAddr, traced)
+	defer cTraced.Stop()
+	// calls of clients without tracer link spans of the callee to the handler directly
+	cPlain := dial(leafAddr, NewHandler())
+	defer cPlain.Stop()
+
+	front := NewHandler()
+	front.SetTracer(tr)
+	front.Handle("/trace/front", func(ctx *Context) {
+		rctx, cancel := context.WithTimeout(ctx.RequestContext(), time.Second)
+		defer cancel()
+		cTraced.CallWith(rctx, "/trace/leaf", "ok", nil)
+		cTraced.CallWith(rctx, "/trace/leaf", "fail", nil)
+		cPlain.CallWith(rctx, "/trace/leaf", "ok", nil)
+		ctx.Write(ctx.SpanID())
+	})
+	frontSvr, frontAddr := serve(front)
+	defer frontSvr.Stop()
+
+	c := dial(frontAddr, NewHandler())
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(WithRequestID(context.Background(), "trace-1"), time.Second)
+	defer cancel()
+	rootID := ""
+	if err := c.CallWith(ctx, "/trace/front", nil, &rootID); err != nil || rootID == "" {
+		t.Fatalf("CallWith() = (%v, %v), want span id", rootID, err)
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatalf("%v spans finished, want 6", i)
+		}
+	}
+
+	g := tr.Graph("trace-1")
+	if g.Len() != 6 || len(g.Roots) != 1 {
+		t.Fatalf("Graph() of %v spans and %v roots, want 6 and 1:\n%v", g.Len(), len(g.Roots), g)
+	}
+	root := g.Roots[0]
+	if root.ID != rootID || root.Kind != SpanServer || root.Method != "/trace/front" || root.ParentID != "" {
+		t.Fatalf("root span = %+v", root.Span)
+	}
+	if len(root.Children) != 3 {
+		t.Fatalf("root span has %v children, want 3:\n%v", len(root.Children), g)
+	}
+	for i, kind := range []SpanKind{SpanClient, SpanClient, SpanServer} {
+		child := root.Children[i]
+		if child.Kind != kind || child.Method != "/trace/leaf" || child.TraceID != "trace-1" {
+			t.Fatalf("child %v = %+v, want %v span of /trace/leaf", i, child.Span, kind)
+		}
+		if kind == SpanClient && (len(child.Children) != 1 || child.Children[0].Kind != SpanServer) {
+			t.Fatalf("client span %v children = %v, want the server span:\n%v", i, len(child.Children), g)
+		}
+	}
+	if failed := root.Children[1]; failed.Error != "failed" || failed.Children[0].Error != "failed" {
+		t.Fatalf("spans of failed call = (%q, %q), want failed", failed.Error, failed.Children[0].Error)
+	}
+	if s := g.String(); !strings.HasPrefix(s, "server /trace/front ["+rootID+"]") || strings.Count(s, "\n") != 6 {
+		t.Fatalf("CallGraph.String() =\n%v", s)
+	}
+	if spans := tr.Spans("none"); len(spans) != 0 {
+		t.Fatalf("Spans() of unknown trace = %v", spans)
+	}
+}
+
+func TestTracer_Size(t *testing.T) {
+	tr := NewTracer(2)
+	for _, id := range []string{"a", "b", "c"} {
+		tr.finish(&Span{TraceID: "t", ID: id, Start: time.Now()}, nil, SystemClock)
+	}
+	spans := tr.Spans("")
+	if len(spans) != 2 || spans[0].ID != "b" || spans[1].ID != "c" {
+		t.Fatalf("Spans() = %+v, want the latest 2", spans)
+	}
+}
+
+func TestTracer_Clock(t *testing.T) {
+	tr := NewTracer(0)
+	finished := make(chan Span, 2)
+	tr.OnFinish = func(s Span) { finished <- s }
+	clock := NewMockClock(time.Unix(1000, 0))
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetTracer(tr)
+	svr.Handler.SetClock(clock)
+	svr.Handler.Handle("/trace/slow", func(ctx *Context) {
+		clock.Advance(time.Second)
+		ctx.Write("ok")
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	h := NewHandler()
+	h.SetTracer(tr)
+	h.SetClock(clock)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, WithHandler(h))
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Stop()
+
+	var rsp string
+	ctx := WithParentSpan(context.Background(), "root")
+	if err := c.CallWith(ctx, "/trace/slow", "", &rsp); err != nil {
+		t.Fatalf("Client.CallWith() failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		s := <-finished
+		if !s.Start.Equal(time.Unix(1000, 0)) || s.Duration != time.Second {
+			t.Fatalf("%v span = (%v, %v), want started and timed by the handler clock", s.Kind, s.Start, s.Duration)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+type statRequest struct {
+	Name string
+}
+
+type statResponse struct {
+	Size     int64
+	Checksum uint32
+}
+
+type readRequest struct {
+	Name   string
+	Offset int64
+	Size   int
+}
+
+func routeStat(route string) string { return route + "/stat" }
+func routeRead(route string) string { return route + "/read" }
+
+// DownloadRetryPolicy is used by Downloader by default, it retries calls failed by disconnection
+// and timeout while the Client is reconnecting, so the download resumes from the offset it stopped at
+var DownloadRetryPolicy = &arpc.RetryPolicy{
+	MaxAttempts: 30,
+	Backoff:     time.Millisecond * 100,
+	MaxBackoff:  time.Second * 2,
+	Retryable: func(err error) bool {
+		return err == arpc.ErrClientReconnecting || err == arpc.ErrClientTimeout
+	},
+}
+
+// ReadWriterAt is the destination of Downloader, bytes downloaded before resuming are read back
+// for the checksum of the whole blob, e.g. *os.File
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Downloader downloads blobs from a Sender in chunks, each chunk and the whole blob are verified
+// by checksums
+type Downloader struct {
+	Client *arpc.Client
+	// Route is the route prefix registered by Sender
+	Route string
+	// ChunkSize is bytes of each chunk, DefaultChunkSize by default
+	ChunkSize int
+	// Timeout is the timeout of each call, 10s by default
+	Timeout time.Duration
+	// Retry is the retry policy of each call, DownloadRetryPolicy by default
+	Retry *arpc.RetryPolicy
+	// OnProgress is called after each chunk is written with bytes written and total size
+	OnProgress func(name string, offset, size int64)
+}
+
+// NewDownloader returns Downloader downloading from route of c
+func NewDownloader(c *arpc.Client, route string) *Downloader {
+	return &Downloader{Client: c, Route: route}
+}
+
+func (d *Downloader) call(method string, req interface{}, rsp interface{}) error {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	policy := d.Retry
+	if policy == nil {
+		policy = DownloadRetryPolicy
+	}
+	return d.Client.CallRetry(method, req, rsp, timeout, policy)
+}
+
+// Download downloads the blob of name into f, bytes before offset are already in f, e.g. of an
+// interrupted download, it returns the size of the blob
+func (d *Downloader) Download(name string, f ReadWriterAt, offset int64) (int64, error) {
+	if !validName(name) {
+		return 0, ErrInvalidName
+	}
+	stat := &statResponse{}
+	if err := d.call(routeStat(d.Route), &statRequest{Name: name}, stat); err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > stat.Size {
+		return 0, ErrInvalidOffset
+	}
+
+	// the checksum covers bytes downloaded before resuming
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, offset)); err != nil {
+		return 0, err
+	}
+
+	chunkSize := d.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	for offset < stat.Size {
+		n := chunkSize
+		if stat.Size-offset < int64(n) {
+			n = int(stat.Size - offset)
+		}
+		var buf []byte
+		if err := d.call(routeRead(d.Route), &readRequest{Name: name, Offset: offset, Size: n}, &buf); err != nil {
+			return 0, err
+		}
+		if len(buf) != 4+n {
+			return 0, ErrInvalidChunk
+		}
+		data := buf[4:]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf) {
+			return 0, ErrChecksumMismatch
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return 0, err
+		}
+		hash.Write(data)
+		offset += int64(n)
+		if d.OnProgress != nil {
+			d.OnProgress(name, offset, stat.Size)
+		}
+	}
+
+	if hash.Sum32() != stat.Checksum {
+		return 0, ErrChecksumMismatch
+	}
+	return stat.Size, nil
+}
+
+// DownloadFile downloads the blob of name into the file of path, it resumes from the size of the
+// file if it exists
+func (d *Downloader) DownloadFile(name, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size, err := d.Download(name, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	return f.Truncate(size)
+}
+
+// Sender serves blobs of Source to Downloader
+type Sender struct {
+	Source Source
+	// MaxChunkSize is the max bytes of a chunk, DefaultMaxChunkSize by default
+	MaxChunkSize int
+}
+
+// NewSender returns Sender serving blobs of source
+func NewSender(source Source) *Sender {
+	return &Sender{Source: source}
+}
+
+// Register registers routes of the download protocol with route prefix to h, e.g. Register(svr.Handler, "/download")
+func (s *Sender) Register(h arpc.Handler, route string) {
+	h.Handle(routeStat(route), s.onStat)
+	h.Handle(routeRead(route), s.onRead)
+}
+
+func (s *Sender) onStat(ctx *arpc.Context) {
+	req := &statRequest{}
+	if err := ctx.Bind(req); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !validName(req.Name) {
+		ctx.Error(ErrInvalidName)
+		return
+	}
+	size, checksum, err := s.Source.Stat(req.Name)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(&statResponse{Size: size, Checksum: checksum})
+}
+
+func (s *Sender) onRead(ctx *arpc.Context) {
+	req := &readRequest{}
+	if err := ctx.Bind(req); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !validName(req.Name) {
+		ctx.Error(ErrInvalidName)
+		return
+	}
+	maxChunkSize := s.MaxChunkSize
+	if maxChunkSize <= 0 {
+		maxChunkSize = DefaultMaxChunkSize
+	}
+	if req.Size <= 0 || req.Offset < 0 {
+		ctx.Error(ErrInvalidChunk)
+		return
+	}
+	if req.Size > maxChunkSize {
+		ctx.Error(ErrChunkTooLarge)
+		return
+	}
+	buf := make([]byte, 4+req.Size)
+	n, err := s.Source.ReadAt(req.Name, buf[4:], req.Offset)
+	if err != nil && err != io.EOF {
+		ctx.Error(err)
+		return
+	}
+	buf = buf[:4+n]
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	ctx.Write(buf)
+}
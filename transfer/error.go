@@ -0,0 +1,27 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import "errors"
+
+var (
+	// ErrInvalidName .
+	ErrInvalidName = errors.New("invalid upload name, should be a non-empty base name")
+
+	// ErrInvalidChunk .
+	ErrInvalidChunk = errors.New("invalid upload chunk")
+
+	// ErrChunkTooLarge .
+	ErrChunkTooLarge = errors.New("upload chunk too large")
+
+	// ErrInvalidOffset .
+	ErrInvalidOffset = errors.New("invalid upload offset, should be the offset stored by the sink")
+
+	// ErrChecksumMismatch .
+	ErrChecksumMismatch = errors.New("upload checksum mismatch")
+
+	// ErrSizeMismatch .
+	ErrSizeMismatch = errors.New("upload size mismatch")
+)
@@ -0,0 +1,93 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sink stores uploaded blobs for Receiver, chunks of a name are written in order
+type Sink interface {
+	// Offset returns bytes stored of name, the upload resumes from it
+	Offset(name string) (int64, error)
+	// Write stores data of name at offset, which is always the value of Offset
+	Write(name string, offset int64, data []byte) error
+	// Commit is called when size bytes of name are stored, checksum is crc32 IEEE of the whole blob
+	Commit(name string, size int64, checksum uint32) error
+}
+
+// DirSink stores blobs as files of Dir, a blob is written to name+".part" and renamed to name on commit
+type DirSink struct {
+	Dir string
+
+	mux sync.Mutex
+}
+
+// NewDirSink returns DirSink storing files in dir
+func NewDirSink(dir string) *DirSink {
+	return &DirSink{Dir: dir}
+}
+
+func (s *DirSink) partPath(name string) string {
+	return filepath.Join(s.Dir, name+".part")
+}
+
+// Offset implements Sink
+func (s *DirSink) Offset(name string) (int64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	fi, err := os.Stat(s.partPath(name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Write implements Sink
+func (s *DirSink) Write(name string, offset int64, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	f, err := os.OpenFile(s.partPath(name), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, offset)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Commit implements Sink, the part file is removed if its checksum mismatches
+func (s *DirSink) Commit(name string, size int64, checksum uint32) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	path := s.partPath(name)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return ErrSizeMismatch
+	}
+	if hash.Sum32() != checksum {
+		os.Remove(path)
+		return ErrChecksumMismatch
+	}
+	return os.Rename(path, filepath.Join(s.Dir, name))
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Source provides blobs for Sender
+type Source interface {
+	// Stat returns size and crc32 IEEE checksum of the whole blob of name
+	Stat(name string) (size int64, checksum uint32, err error)
+	// ReadAt reads the blob of name at offset into buf
+	ReadAt(name string, buf []byte, offset int64) (int, error)
+}
+
+// DirSource provides files of Dir as blobs
+type DirSource struct {
+	Dir string
+}
+
+// NewDirSource returns DirSource providing files in dir
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{Dir: dir}
+}
+
+// Stat implements Source
+func (s *DirSource) Stat(name string) (int64, uint32, error) {
+	f, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, hash.Sum32(), nil
+}
+
+// ReadAt implements Source
+func (s *DirSource) ReadAt(name string, buf []byte, offset int64) (int, error) {
+	f, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(buf, offset)
+}
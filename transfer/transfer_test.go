@@ -0,0 +1,177 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+// failingSink fails the Write of failAt offset once
+type failingSink struct {
+	Sink
+	failAt int64
+}
+
+func (s *failingSink) Write(name string, offset int64, data []byte) error {
+	if offset == s.failAt {
+		s.failAt = -1
+		return errors.New("disk full")
+	}
+	return s.Sink.Write(name, offset, data)
+}
+
+func TestUploader_Upload(t *testing.T) {
+	dir := t.TempDir()
+	sink := &failingSink{Sink: NewDirSink(dir), failAt: 300}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	NewReceiver(sink).Register(svr.Handler, "/upload")
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	u := NewUploader(c, "/upload")
+	u.ChunkSize = 100
+	u.Timeout = time.Second
+
+	if err = u.Upload("blob", bytes.NewReader(data), int64(len(data))); err == nil || err.Error() != "disk full" {
+		t.Fatalf("Uploader.Upload() error = %v, want disk full", err)
+	}
+	n, err := sink.Offset("blob")
+	if err != nil || n != 300 {
+		t.Fatalf("Sink.Offset() = %v, %v, want 300", n, err)
+	}
+
+	var resumed int64 = -1
+	u.OnProgress = func(name string, offset, size int64) {
+		if resumed < 0 {
+			resumed = offset
+		}
+	}
+	if err = u.Upload("blob", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Uploader.Upload() resumed error = %v", err)
+	}
+	if resumed != 400 {
+		t.Fatalf("first chunk after resuming stored at %v, want 400", resumed)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "blob"))
+	if err != nil {
+		t.Fatalf("failed to read uploaded file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file mismatch")
+	}
+
+	if err = u.Upload("../blob", bytes.NewReader(data), int64(len(data))); err != ErrInvalidName {
+		t.Fatalf("Uploader.Upload() error = %v, want %v", err, ErrInvalidName)
+	}
+}
+
+func TestDownloader_Download(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "blob"), data, 0644); err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := arpc.NewServer()
+	NewSender(NewDirSource(dir)).Register(svr.Handler, "/download")
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	// resume from a partial file, and reconnect in the middle of the download
+	path := filepath.Join(t.TempDir(), "blob")
+	if err = ioutil.WriteFile(path, data[:200], 0644); err != nil {
+		t.Fatalf("failed to write partial file: %v", err)
+	}
+	var first int64 = -1
+	d := NewDownloader(c, "/download")
+	d.ChunkSize = 100
+	d.Timeout = time.Second
+	d.OnProgress = func(name string, offset, size int64) {
+		if first < 0 {
+			first = offset
+		}
+		if offset == 500 {
+			c.Conn.Close()
+		}
+	}
+	if err = d.DownloadFile("blob", path); err != nil {
+		t.Fatalf("Downloader.DownloadFile() error = %v", err)
+	}
+	if first != 300 {
+		t.Fatalf("first chunk after resuming written at %v, want 300", first)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read downloaded file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded file mismatch")
+	}
+
+	// a corrupted partial file fails the checksum of the whole blob
+	if err = ioutil.WriteFile(path, make([]byte, 200), 0644); err != nil {
+		t.Fatalf("failed to write partial file: %v", err)
+	}
+	d.OnProgress = nil
+	if err = d.DownloadFile("blob", path); err != ErrChecksumMismatch {
+		t.Fatalf("Downloader.DownloadFile() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestDirSink_Commit(t *testing.T) {
+	sink := NewDirSink(t.TempDir())
+	if err := sink.Write("blob", 0, []byte("hello")); err != nil {
+		t.Fatalf("DirSink.Write() error = %v", err)
+	}
+	if err := sink.Commit("blob", 4, 0); err != ErrSizeMismatch {
+		t.Fatalf("DirSink.Commit() error = %v, want %v", err, ErrSizeMismatch)
+	}
+	if err := sink.Commit("blob", 5, 0); err != ErrChecksumMismatch {
+		t.Fatalf("DirSink.Commit() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if n, _ := sink.Offset("blob"); n != 0 {
+		t.Fatalf("DirSink.Offset() after mismatch = %v, want 0", n)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+const (
+	// DefaultChunkSize is the chunk size of Uploader by default
+	DefaultChunkSize = 64 * 1024
+
+	// DefaultMaxChunkSize is the max chunk size accepted by Receiver by default
+	DefaultMaxChunkSize = 1024 * 1024
+
+	// chunk header: offset(8) + checksum(4) + name length(2)
+	chunkHeaderLen = 14
+
+	defaultTimeout = time.Second * 10
+)
+
+type beginRequest struct {
+	Name string
+	Size int64
+}
+
+type beginResponse struct {
+	Offset int64
+}
+
+type commitRequest struct {
+	Name     string
+	Size     int64
+	Checksum uint32
+}
+
+func routeBegin(route string) string  { return route + "/begin" }
+func routeChunk(route string) string  { return route + "/chunk" }
+func routeCommit(route string) string { return route + "/commit" }
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && len(name) <= 1024
+}
+
+func encodeChunk(name string, offset int64, data []byte) []byte {
+	buf := make([]byte, chunkHeaderLen+len(name)+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(offset))
+	binary.LittleEndian.PutUint32(buf[8:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint16(buf[12:], uint16(len(name)))
+	copy(buf[chunkHeaderLen:], name)
+	copy(buf[chunkHeaderLen+len(name):], data)
+	return buf
+}
+
+func decodeChunk(buf []byte) (name string, offset int64, data []byte, err error) {
+	if len(buf) < chunkHeaderLen {
+		return "", 0, nil, ErrInvalidChunk
+	}
+	nameLen := int(binary.LittleEndian.Uint16(buf[12:]))
+	if len(buf) < chunkHeaderLen+nameLen {
+		return "", 0, nil, ErrInvalidChunk
+	}
+	offset = int64(binary.LittleEndian.Uint64(buf))
+	name = string(buf[chunkHeaderLen : chunkHeaderLen+nameLen])
+	data = buf[chunkHeaderLen+nameLen:]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[8:]) {
+		return "", 0, nil, ErrChecksumMismatch
+	}
+	return name, offset, data, nil
+}
+
+// Uploader uploads blobs to a Receiver in chunks, an interrupted upload of the same name resumes
+// from the offset stored by the Receiver's Sink
+type Uploader struct {
+	Client *arpc.Client
+	// Route is the route prefix registered by Receiver
+	Route string
+	// ChunkSize is bytes of each chunk, DefaultChunkSize by default
+	ChunkSize int
+	// Timeout is the timeout of each call, 10s by default
+	Timeout time.Duration
+	// OnProgress is called after each chunk is stored with bytes stored and total size
+	OnProgress func(name string, offset, size int64)
+}
+
+// NewUploader returns Uploader uploading to route of c
+func NewUploader(c *arpc.Client, route string) *Uploader {
+	return &Uploader{Client: c, Route: route}
+}
+
+func (u *Uploader) timeout() time.Duration {
+	if u.Timeout > 0 {
+		return u.Timeout
+	}
+	return defaultTimeout
+}
+
+// Upload uploads size bytes of r as name, it returns nil after the blob is committed by the Sink
+func (u *Uploader) Upload(name string, r io.ReaderAt, size int64) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	timeout := u.timeout()
+	rsp := &beginResponse{}
+	if err := u.Client.Call(routeBegin(u.Route), &beginRequest{Name: name, Size: size}, rsp, timeout); err != nil {
+		return err
+	}
+	offset := rsp.Offset
+	if offset < 0 || offset > size {
+		return ErrInvalidOffset
+	}
+
+	// the checksum covers bytes uploaded before resuming
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, io.NewSectionReader(r, 0, offset)); err != nil {
+		return err
+	}
+
+	chunkSize := u.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	buf := make([]byte, chunkSize)
+	for offset < size {
+		n := int64(chunkSize)
+		if size-offset < n {
+			n = size - offset
+		}
+		data := buf[:n]
+		if _, err := r.ReadAt(data, offset); err != nil && err != io.EOF {
+			return err
+		}
+		hash.Write(data)
+		if err := u.Client.Call(routeChunk(u.Route), encodeChunk(name, offset, data), nil, timeout); err != nil {
+			return err
+		}
+		offset += n
+		if u.OnProgress != nil {
+			u.OnProgress(name, offset, size)
+		}
+	}
+
+	return u.Client.Call(routeCommit(u.Route), &commitRequest{Name: name, Size: size, Checksum: hash.Sum32()}, nil, timeout)
+}
+
+// UploadFile uploads the file of path as name
+func (u *Uploader) UploadFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return u.Upload(name, f, fi.Size())
+}
+
+// Receiver assembles blobs uploaded by Uploader into Sink
+type Receiver struct {
+	Sink Sink
+	// MaxChunkSize is the max bytes of a chunk, DefaultMaxChunkSize by default
+	MaxChunkSize int
+}
+
+// NewReceiver returns Receiver storing blobs into sink
+func NewReceiver(sink Sink) *Receiver {
+	return &Receiver{Sink: sink}
+}
+
+// Register registers routes of the upload protocol with route prefix to h, e.g. Register(svr.Handler, "/upload")
+func (r *Receiver) Register(h arpc.Handler, route string) {
+	h.Handle(routeBegin(route), r.onBegin)
+	h.Handle(routeChunk(route), r.onChunk)
+	h.Handle(routeCommit(route), r.onCommit)
+}
+
+func (r *Receiver) onBegin(ctx *arpc.Context) {
+	req := &beginRequest{}
+	if err := ctx.Bind(req); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !validName(req.Name) {
+		ctx.Error(ErrInvalidName)
+		return
+	}
+	offset, err := r.Sink.Offset(req.Name)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(&beginResponse{Offset: offset})
+}
+
+func (r *Receiver) onChunk(ctx *arpc.Context) {
+	name, offset, data, err := decodeChunk(ctx.Body())
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	maxChunkSize := r.MaxChunkSize
+	if maxChunkSize <= 0 {
+		maxChunkSize = DefaultMaxChunkSize
+	}
+	if len(data) > maxChunkSize {
+		ctx.Error(ErrChunkTooLarge)
+		return
+	}
+	if !validName(name) {
+		ctx.Error(ErrInvalidName)
+		return
+	}
+	stored, err := r.Sink.Offset(name)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if offset != stored {
+		ctx.Error(ErrInvalidOffset)
+		return
+	}
+	if err = r.Sink.Write(name, offset, data); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(nil)
+}
+
+func (r *Receiver) onCommit(ctx *arpc.Context) {
+	req := &commitRequest{}
+	if err := ctx.Bind(req); err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !validName(req.Name) {
+		ctx.Error(ErrInvalidName)
+		return
+	}
+	if err := r.Sink.Commit(req.Name, req.Size, req.Checksum); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Write(nil)
+}
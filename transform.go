@@ -0,0 +1,145 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Forwarded is the request or response forwarded by Context.Forward, rewritten by Transformer
+type Forwarded struct {
+	// Method of the request, renaming it on responses takes no effect
+	Method string
+	// Body of the message
+	Body []byte
+	// Meta of the message, owned by the transformers
+	Meta Metadata
+	// Error is true for error responses
+	Error bool
+}
+
+// Transformer adapts messages forwarded by a gateway between old and new API shapes, Request
+// rewrites requests and notifies before forwarded and Response rewrites their responses, either
+// could be nil. An error returned is responded to the caller instead
+type Transformer struct {
+	Request  func(f *Forwarded) error
+	Response func(f *Forwarded) error
+}
+
+// WithTransformers sets transformers applied by Context.Forward of the route
+func WithTransformers(ts ...Transformer) RouteOption {
+	return func(rh *RouterHandler) {
+		rh.Transformers = append(rh.Transformers, ts...)
+	}
+}
+
+// RenameMethod forwards requests to method
+func RenameMethod(method string) Transformer {
+	return Transformer{
+		Request: func(f *Forwarded) error {
+			f.Method = method
+			return nil
+		},
+	}
+}
+
+// StripMeta removes metadata of keys from requests and responses
+func StripMeta(keys ...string) Transformer {
+	strip := func(f *Forwarded) error {
+		for _, k := range keys {
+			delete(f.Meta, k)
+		}
+		return nil
+	}
+	return Transformer{Request: strip, Response: strip}
+}
+
+// RenameFields renames fields of JSON bodies, top level fields of objects or objects in arrays,
+// from keys to values of fields on requests and back on responses. Empty bodies and error
+// responses are not rewritten
+func RenameFields(fields map[string]string) Transformer {
+	reverse := make(map[string]string, len(fields))
+	for k, v := range fields {
+		reverse[v] = k
+	}
+	return Transformer{
+		Request: func(f *Forwarded) error {
+			return renameFields(f, fields)
+		},
+		Response: func(f *Forwarded) error {
+			return renameFields(f, reverse)
+		},
+	}
+}
+
+func renameFields(f *Forwarded, fields map[string]string) error {
+	if len(f.Body) == 0 || f.Error {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(f.Body, &v); err != nil {
+		return fmt.Errorf("rename fields of %v: %w", f.Method, err)
+	}
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		renameKeys(vt, fields)
+	case []interface{}:
+		for _, item := range vt {
+			if m, ok := item.(map[string]interface{}); ok {
+				renameKeys(m, fields)
+			}
+		}
+	default:
+		return nil
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("rename fields of %v: %w", f.Method, err)
+	}
+	f.Body = body
+	return nil
+}
+
+func renameKeys(m map[string]interface{}, fields map[string]string) {
+	renamed := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if to, ok := fields[k]; ok {
+			k = to
+		}
+		renamed[k] = v
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	for k, v := range renamed {
+		m[k] = v
+	}
+}
+
+func transformRequest(ts []Transformer, f *Forwarded) error {
+	for _, t := range ts {
+		if t.Request != nil {
+			if err := t.Request(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func transformResponse(ts []Transformer, f *Forwarded) error {
+	if len(ts) > 0 && f.Meta == nil {
+		f.Meta = Metadata{}
+	}
+	for i := len(ts) - 1; i >= 0; i-- {
+		if t := ts[i]; t.Response != nil {
+			if err := t.Response(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+// Transport listens and dials connections of a network, e.g. raw tcp or websocket, see package
+// websocket. Handlers and clients work on the net.Conn returned, so routes and client APIs are the
+// same across transports
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is the raw tcp Transport
+type TCPTransport struct {
+	// DialTimeout of Dial, 0 means no timeout
+	DialTimeout time.Duration
+}
+
+// Listen implements Transport
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial implements Transport
+func (t *TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, t.DialTimeout)
+}
+
+// TransportDialer returns dialer dialing addr with t, e.g. NewClient(TransportDialer(t, addr))
+func TransportDialer(t Transport, addr string) DialerFunc {
+	return func() (net.Conn, error) {
+		return t.Dial(addr)
+	}
+}
+
+// RunTransport starts rpc service on addr listened by t
+func (s *Server) RunTransport(t Transport, addr string) error {
+	ln, err := t.Listen(addr)
+	if err != nil {
+		log.Info("%v Running failed: %v", s.Handler.LogTag(), err)
+		return err
+	}
+	return s.Serve(ln)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// UrgentQueueSize is the buffer size of the urgent lane of each connection
+	UrgentQueueSize = 16
+
+	// PingRoute is the internal route of Client.Ping, responded by the peer on the urgent lane
+	PingRoute = "_arpc.ping"
+)
+
+// PushUrgent queues msg on the urgent lane, which is sent before messages of the send queue
+// waiting, so control frames such as cancel, goaway or ping are not delayed behind bulk data.
+// The lane is small and not counted in send budget or flow control windows, it fails with
+// ErrClientOverstock instead of blocking when full, and should not be used for bulk data
+func (c *Client) PushUrgent(msg *Message) error {
+	if err := c.checkState(); err != nil {
+		return err
+	}
+	if !c.tryUrgent(msg) {
+		c.Handler.OnOverstock(c, msg)
+		return ErrClientOverstock
+	}
+	return nil
+}
+
+func (c *Client) tryUrgent(msg *Message) bool {
+	select {
+	case c.chUrgent <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// NotifyUrgent sends notify message on the urgent lane, see PushUrgent
+func (c *Client) NotifyUrgent(method string, data interface{}) error {
+	if err := c.checkStateAndMethod(method); err != nil {
+		return err
+	}
+	msg := c.newRequestMessage(CmdNotify, method, data, false, false)
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	return c.PushUrgent(msg)
+}
+
+// Ping sends ping on the urgent lane and returns the round trip time when the peer responds
+func (c *Client) Ping(timeout time.Duration) (time.Duration, error) {
+	if err := c.checkState(); err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, ErrClientInvalidTimeoutZero
+	}
+
+	clock := c.Handler.Clock()
+	timer := clock.NewTimer(timeout)
+	msg := c.newRequestMessage(CmdRequest, PingRoute, nil, false, false)
+	seq := msg.Seq()
+	sess := newSession(seq)
+	c.addSession(seq, sess)
+	defer func() {
+		stopTimer(timer)
+		c.deleteSession(seq)
+	}()
+
+	start := clock.Now()
+	if err := c.PushUrgent(msg); err != nil {
+		return 0, err
+	}
+	select {
+	case msg = <-sess.done:
+	case <-timer.C():
+		return 0, ErrClientTimeout
+	case <-c.chClose:
+		return 0, ErrClientStopped
+	}
+	end := clock.Now()
+	if err := c.parseResponse(msg, nil); err != nil {
+		return 0, err
+	}
+	c.measureSkew(msg, start, end)
+	return end.Sub(start), nil
+}
+
+// pushControl sends msg on the urgent lane, or queues it to the send queue if the lane is full
+func (c *Client) pushControl(msg *Message) error {
+	if c.checkState() == nil && c.tryUrgent(msg) {
+		return nil
+	}
+	return c.PushMsg(msg, TimeForever)
+}
+
+func (h *handler) onPing(c *Client, msg *Message) {
+	rsp := newMessage(CmdResponse, PingRoute, pingBody(c.Handler.Clock()), false, msg.IsAsync(), msg.Seq(), c.Handler, c.Codec, nil)
+	if err := c.pushControl(rsp); err != nil {
+		log.Warn("%v\t%v\trespond ping failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+func TestClient_PushUrgent(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		h := NewHandler()
+		h.SetBatchSend(batch)
+		conn, peer := net.Pipe()
+		c := &Client{Conn: conn, Handler: h, Codec: codec.DefaultCodec, running: true}
+		c.chSend = make(chan *Message, 10)
+		c.chUrgent = make(chan *Message, UrgentQueueSize)
+		c.chClose = make(chan util.Empty)
+
+		// bulk data queued before the urgent frame
+		for i := 0; i < 5; i++ {
+			if err := c.Notify("/bulk", "data", TimeZero); err != nil {
+				t.Fatalf("Client.Notify() error = %v", err)
+			}
+		}
+		if err := c.NotifyUrgent("/cancel", "1"); err != nil {
+			t.Fatalf("Client.NotifyUrgent() error = %v", err)
+		}
+		go c.sendLoop()
+
+		var methods []string
+		for i := 0; i < 6; i++ {
+			head := make([]byte, HeadLen)
+			if _, err := io.ReadFull(peer, head); err != nil {
+				t.Fatalf("read header failed: %v", err)
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(head))
+			if _, err := io.ReadFull(peer, body); err != nil {
+				t.Fatalf("read body failed: %v", err)
+			}
+			methods = append(methods, string(body[:head[HeaderIndexMethodLen]]))
+		}
+		close(c.chClose)
+		conn.Close()
+		peer.Close()
+		if methods[0] != "/cancel" {
+			t.Fatalf("batch send %v: methods sent = %v, want urgent first", batch, methods)
+		}
+	}
+
+	c := &Client{Handler: NewHandler(), Codec: codec.DefaultCodec, running: true}
+	c.chUrgent = make(chan *Message, 1)
+	if err := c.NotifyUrgent("/cancel", "1"); err != nil {
+		t.Fatalf("Client.NotifyUrgent() error = %v", err)
+	}
+	if err := c.NotifyUrgent("/cancel", "2"); err != ErrClientOverstock {
+		t.Fatalf("Client.NotifyUrgent() error = %v, want %v", err, ErrClientOverstock)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rtt, err := c.Ping(time.Second)
+	if err != nil || rtt <= 0 || rtt >= time.Second {
+		t.Fatalf("Client.Ping() = (%v, %v)", rtt, err)
+	}
+	if _, err = c.Ping(0); err != ErrClientInvalidTimeoutZero {
+		t.Fatalf("Client.Ping() error = %v, want %v", err, ErrClientInvalidTimeoutZero)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Severity of issues found by Server.Validate
+type Severity int
+
+const (
+	// SeverityWarning means the option takes no effect or works poorly
+	SeverityWarning Severity = iota
+	// SeverityError means the server would not work as configured
+	SeverityError
+)
+
+var severityNames = []string{"warning", "error"}
+
+// String implements fmt.Stringer
+func (s Severity) String() string {
+	if s >= 0 && int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return "unknown"
+}
+
+// ValidationIssue is an issue of an option found by Server.Validate
+type ValidationIssue struct {
+	Severity Severity
+	Option   string
+	Message  string
+}
+
+// String implements fmt.Stringer
+func (i ValidationIssue) String() string {
+	return fmt.Sprintf("%v: %v: %v", i.Severity, i.Option, i.Message)
+}
+
+// ValidationReport is the result of Server.Validate
+type ValidationReport struct {
+	Issues []ValidationIssue
+}
+
+func (r *ValidationReport) add(severity Severity, option string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, ValidationIssue{Severity: severity, Option: option, Message: fmt.Sprintf(format, args...)})
+}
+
+// OK returns true if no issue of SeverityError found
+func (r *ValidationReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns error wrapping ErrInvalidConfig with issues of SeverityError, nil if none
+func (r *ValidationReport) Err() error {
+	var errs []string
+	for _, i := range r.Issues {
+		if i.Severity == SeverityError {
+			errs = append(errs, i.Option+": "+i.Message)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidConfig, strings.Join(errs, "; "))
+}
+
+// String implements fmt.Stringer, an issue per line
+func (r *ValidationReport) String() string {
+	lines := make([]string, len(r.Issues))
+	for i, issue := range r.Issues {
+		lines[i] = issue.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check is an extra check of Server.Validate for resources outside of the server, an error
+// returned by Run is reported as SeverityError of Option
+type Check struct {
+	Option string
+	Run    func() error
+}
+
+// CheckTLSFiles checks that certFile and keyFile are a valid key pair and the certificate is
+// not expired
+func CheckTLSFiles(certFile, keyFile string) Check {
+	return Check{
+		Option: "tls",
+		Run: func() error {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+			if now := time.Now(); now.After(leaf.NotAfter) {
+				return fmt.Errorf("certificate %v expired at %v", certFile, leaf.NotAfter)
+			} else if now.Before(leaf.NotBefore) {
+				return fmt.Errorf("certificate %v not valid before %v", certFile, leaf.NotBefore)
+			}
+			return nil
+		},
+	}
+}
+
+// CheckReachable checks that addr of option, e.g. a service registry, accepts TCP connections
+// in timeout
+func CheckReachable(option string, addr string, timeout time.Duration) Check {
+	return Check{
+		Option: option,
+		Run: func() error {
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				return fmt.Errorf("%v unreachable: %w", addr, err)
+			}
+			return conn.Close()
+		},
+	}
+}
+
+// Validate checks options of the server and its handler for conflicts before Serve, and runs
+// checks in order. It returns the report of all issues found, see ValidationReport.Err
+func (s *Server) Validate(checks ...Check) *ValidationReport {
+	r := &ValidationReport{}
+	if s.Codec == nil {
+		r.add(SeverityError, "codec", "nil codec")
+	}
+	h := s.Handler
+	if h == nil {
+		r.add(SeverityError, "handler", "nil handler")
+	} else {
+		validateHandler(r, h)
+	}
+	for _, c := range checks {
+		if err := c.Run(); err != nil {
+			r.add(SeverityError, c.Option, "%v", err)
+		}
+	}
+	return r
+}
+
+func validateHandler(r *ValidationReport, h Handler) {
+	if size := h.SendQueueSize(); size <= 0 {
+		r.add(SeverityError, "send queue size", "%v, messages not pushed with a timeout fail unless the send loop is waiting", size)
+	} else if h.BatchSend() && size == 1 {
+		r.add(SeverityWarning, "batch send", "send queue size 1 never batches")
+	}
+	if size := h.RecvBufferSize(); size <= 0 {
+		r.add(SeverityWarning, "recv buffer size", "%v, the default size of bufio is used", size)
+	}
+	if size := h.SendBufferSize(); size > 0 && !h.BatchSend() {
+		r.add(SeverityWarning, "send buffer size", "%v is ignored without batch send", size)
+	}
+	if interval := h.FlushInterval(); interval > 0 && (h.SendBufferSize() <= 0 || !h.BatchSend()) {
+		r.add(SeverityWarning, "flush interval", "%v is ignored without send buffer of batch send", interval)
+	}
+	if msg := h.Maintenance(); msg != "" {
+		r.add(SeverityWarning, "maintenance", "requests are rejected: %v", msg)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_Validate(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	if r := svr.Validate(); len(r.Issues) != 0 || !r.OK() {
+		t.Fatalf("Server.Validate() of default options = %v, want no issues", r)
+	}
+
+	svr.Handler.SetSendQueueSize(0)
+	svr.Handler.SetBatchSend(false)
+	svr.Handler.SetSendBufferSize(4096)
+	r := svr.Validate()
+	if r.OK() || !errors.Is(r.Err(), ErrInvalidConfig) {
+		t.Fatalf("Server.Validate() with zero send queue size = %v, want error", r.Err())
+	}
+	options := map[string]Severity{}
+	for _, i := range r.Issues {
+		options[i.Option] = i.Severity
+	}
+	if options["send queue size"] != SeverityError || options["send buffer size"] != SeverityWarning || len(options) != 2 {
+		t.Fatalf("Server.Validate() issues = %v", r)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+
+	svr.Handler = NewHandler()
+	r = svr.Validate(
+		CheckReachable("registry", addr, time.Second),
+		CheckTLSFiles(certFile, certFile),
+	)
+	if len(r.Issues) != 1 || r.Issues[0].Option != "tls" {
+		t.Fatalf("Server.Validate() with checks = %v, want tls error", r)
+	}
+	ln.Close()
+	if r = svr.Validate(CheckReachable("registry", addr, time.Second)); r.OK() {
+		t.Fatalf("Server.Validate() with unreachable registry = %v, want error", r)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const (
+	// FeatureRoute is the internal route negotiating features of the peers
+	FeatureRoute = "_arpc.features"
+
+	// FeatureVarintHeader sends body length as uvarint instead of the fixed 4 bytes
+	FeatureVarintHeader byte = 0x01
+
+	// varintHeaderRoute notifies the peer that the following messages are sent with varint header
+	varintHeaderRoute = "_arpc.varint"
+
+	featureTimeout = time.Second * 5
+)
+
+// features returns features enabled by h
+func (h *handler) features() byte {
+	s := h.load()
+	var features byte
+	if s.varintHeader {
+		features |= FeatureVarintHeader
+	}
+	return features
+}
+
+// negotiateFeatures fetches features supported by both sides, then switches to varint header
+func (c *Client) negotiateFeatures() {
+	rsp := []byte{}
+	if err := c.Call(FeatureRoute, []byte{FeatureVarintHeader}, &rsp, featureTimeout); err != nil {
+		log.Warn("%v\t%v\tnegotiate features failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+		return
+	}
+	if len(rsp) == 1 && rsp[0]&FeatureVarintHeader != 0 {
+		c.switchVarintHeader()
+	}
+}
+
+// switchVarintHeader notifies the peer and sends the following messages with varint header
+func (c *Client) switchVarintHeader() {
+	msg := newMessage(CmdNotify, varintHeaderRoute, nil, false, false, 0, c.Handler, c.Codec, nil)
+	if err := c.PushMsg(msg, TimeForever); err != nil {
+		log.Warn("%v\t%v\tswitch varint header failed: %v", c.logTag(), c.Conn.RemoteAddr(), err)
+	}
+}
+
+// onFeatures responds features supported by both sides
+func (h *handler) onFeatures(c *Client, msg *Message) {
+	var features byte
+	if data := msg.Data(); len(data) == 1 {
+		features = data[0] & h.features()
+	}
+	newContext(c, msg, nil).Write([]byte{features})
+}
+
+// onVarintHeader is called in reading loop, messages after the notify are read with varint header.
+// The server side switches its own sending when notified by the client
+func (h *handler) onVarintHeader(c *Client) {
+	atomic.StoreUint32(&c.recvVarint, 1)
+	if c.Dialer == nil {
+		c.switchVarintHeader()
+	}
+}
+
+// resetVarintHeader is called before reconnected, the fixed header is used until negotiated again
+func (c *Client) resetVarintHeader() {
+	atomic.StoreUint32(&c.recvVarint, 0)
+	atomic.StoreUint32(&c.sendVarint, 0)
+}
+
+// isVarintSwitch returns whether msg is the notify of switching to varint header
+func isVarintSwitch(msg *Message) bool {
+	ml := int(msg.Buffer[HeaderIndexMethodLen])
+	return msg.Buffer[HeaderIndexCmd] == CmdNotify && HeadLen+ml <= len(msg.Buffer) &&
+		string(msg.Buffer[HeadLen:HeadLen+ml]) == varintHeaderRoute
+}
+
+// frame returns buffer to send of the encoded message, sw is whether the message is the switch
+// notify, which is still sent with the fixed header and enables varint header after it
+func (c *Client) frame(buffer []byte, sw bool) []byte {
+	if atomic.LoadUint32(&c.sendVarint) == 1 {
+		return toVarintFrame(buffer)
+	}
+	if sw {
+		atomic.StoreUint32(&c.sendVarint, 1)
+	}
+	return buffer
+}
+
+// toVarintFrame converts message buffer to varint header frame:
+// [bodyLen:uvarint][reserved:1][cmd:1][flag:1][methodLen:1][seq:8][body]
+func toVarintFrame(buffer []byte) []byte {
+	bodyLen := len(buffer) - HeadLen
+	frame := make([]byte, binary.MaxVarintLen32+len(buffer)-HeaderIndexBodyLenEnd)
+	n := binary.PutUvarint(frame, uint64(bodyLen))
+	n += copy(frame[n:], buffer[HeaderIndexBodyLenEnd:])
+	return frame[:n]
+}
+
+// recvVarintFrame reads a varint header frame and converts it to message
+func recvVarintFrame(c *Client) (*Message, error) {
+	var bodyLen uint64
+	head := c.Head[:1]
+	for shift := uint(0); ; shift += 7 {
+		if shift >= 7*binary.MaxVarintLen32 {
+			return nil, ErrInvalidVarintHeader
+		}
+		if _, err := io.ReadFull(c.Reader, head); err != nil {
+			return nil, err
+		}
+		bodyLen |= uint64(head[0]&0x7F) << shift
+		if head[0] < 0x80 {
+			break
+		}
+	}
+	if bodyLen > uint64(MaxBodyLen) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBodyLen, bodyLen)
+	}
+
+	msg := recvMessage(c.Handler, HeadLen+int(bodyLen))
+	msg.SetBodyLen(int(bodyLen))
+	if _, err := io.ReadFull(c.Reader, msg.Buffer[HeaderIndexBodyLenEnd:]); err != nil {
+		msg.Release()
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newVarintTestClient(frame []byte) *Client {
+	c := &Client{Handler: NewHandler(), Reader: bytes.NewReader(frame)}
+	c.Head = Header(c.head[:])
+	return c
+}
+
+func TestVarintFrame(t *testing.T) {
+	cases := []struct {
+		bodyLen int
+		prefix  []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xAC, 0x02}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, v := range cases {
+		buffer := make([]byte, HeadLen+v.bodyLen)
+		binary.LittleEndian.PutUint32(buffer, uint32(v.bodyLen))
+		copy(buffer[HeaderIndexBodyLenEnd:], []byte{0xA5, CmdRequest, HeaderFlagMaskMeta, 0, 1, 2, 3, 4, 5, 6, 7, 8})
+		for i := HeadLen; i < len(buffer); i++ {
+			buffer[i] = byte(i)
+		}
+
+		frame := toVarintFrame(buffer)
+		want := append(append([]byte{}, v.prefix...), buffer[HeaderIndexBodyLenEnd:]...)
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("toVarintFrame(%v) prefix = %x, want %x", v.bodyLen, frame[:len(v.prefix)], v.prefix)
+		}
+
+		msg, err := recvVarintFrame(newVarintTestClient(frame))
+		if err != nil {
+			t.Fatalf("recvVarintFrame(%v) error = %v", v.bodyLen, err)
+		}
+		if !bytes.Equal(msg.Buffer, buffer) {
+			t.Fatalf("recvVarintFrame(%v) = %x, want %x", v.bodyLen, msg.Buffer[:HeadLen], buffer[:HeadLen])
+		}
+	}
+
+	if _, err := recvVarintFrame(newVarintTestClient([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01})); err != ErrInvalidVarintHeader {
+		t.Fatalf("recvVarintFrame() error = %v, want %v", err, ErrInvalidVarintHeader)
+	}
+	tooLarge := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(tooLarge, uint64(MaxBodyLen+1))
+	if _, err := recvVarintFrame(newVarintTestClient(tooLarge[:n])); err == nil {
+		t.Fatalf("recvVarintFrame() body length %v error = nil", MaxBodyLen+1)
+	}
+}
+
+func TestVarintHeader_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.SetVarintHeader(true)
+	svr.Handler.Handle("/varint/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	SetVarintHeader(true)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetVarintHeader(false)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	// negotiation runs asynchronously after connected
+	for i := 0; i < 100 && atomic.LoadUint32(&c.sendVarint) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if atomic.LoadUint32(&c.sendVarint) == 0 {
+		t.Fatalf("varint header not negotiated")
+	}
+
+	method, body := "/varint/echo", "hello"
+	for i := 0; i < 3; i++ {
+		before := c.Stats().BytesOut
+		rsp := ""
+		if err = c.Call(method, body, &rsp, time.Second); err != nil || rsp != body {
+			t.Fatalf("Client.Call() = (%v, %v), want (%v, nil)", rsp, err, body)
+		}
+		want := uint64(1 + HeadLen - HeaderIndexBodyLenEnd + len(method) + len(body))
+		if sent := c.Stats().BytesOut - before; sent != want {
+			t.Fatalf("Client.Call() sent %v bytes, want %v", sent, want)
+		}
+	}
+}
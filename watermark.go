@@ -0,0 +1,56 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import "sync/atomic"
+
+func (h *handler) HandleQueueWatermark(high, low float64, onHigh, onLow func(c *Client)) {
+	h.update(func(s *handlerState) {
+		s.queueHigh, s.queueLow = high, low
+		s.onQueueHigh, s.onQueueLow = onHigh, onLow
+	})
+}
+
+func (h *handler) QueueWatermark() (float64, float64) {
+	s := h.load()
+	return s.queueHigh, s.queueLow
+}
+
+func (h *handler) OnQueueHigh(c *Client) {
+	if s := h.load(); s.onQueueHigh != nil {
+		s.onQueueHigh(c)
+	}
+}
+
+func (h *handler) OnQueueLow(c *Client) {
+	if s := h.load(); s.onQueueLow != nil {
+		s.onQueueLow(c)
+	}
+}
+
+// checkQueueHigh is called before a message is queued
+func (c *Client) checkQueueHigh() {
+	high, _ := c.Handler.QueueWatermark()
+	if high <= 0 || float64(len(c.chSend)+1) < high*float64(cap(c.chSend)) {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&c.queueHigh, 0, 1) {
+		c.Handler.OnQueueHigh(c)
+	}
+}
+
+// checkQueueLow is called after a message is dequeued or its queueing is canceled
+func (c *Client) checkQueueLow() {
+	if atomic.LoadUint32(&c.queueHigh) == 0 {
+		return
+	}
+	_, low := c.Handler.QueueWatermark()
+	if float64(len(c.chSend)) > low*float64(cap(c.chSend)) {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&c.queueHigh, 1, 0) {
+		c.Handler.OnQueueLow(c)
+	}
+}
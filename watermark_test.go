@@ -0,0 +1,50 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"testing"
+
+	"github.com/lesismal/arpc/codec"
+	"github.com/lesismal/arpc/util"
+)
+
+func TestClient_QueueWatermark(t *testing.T) {
+	var highs, lows int
+	h := NewHandler()
+	h.HandleQueueWatermark(0.8, 0.2, func(c *Client) { highs++ }, func(c *Client) { lows++ })
+
+	// no send loop, messages stay in the queue until taken out by the test
+	c := &Client{Handler: h, Codec: codec.DefaultCodec, running: true}
+	c.chSend = make(chan *Message, 10)
+	c.chClose = make(chan util.Empty)
+
+	msg := c.NewMessage(CmdNotify, "/watermark", "hello")
+	for i := 0; i < 10; i++ {
+		if err := c.PushMsg(msg, TimeZero); err != nil {
+			t.Fatalf("Client.PushMsg() error = %v", err)
+		}
+		want := 0
+		if i+1 >= 8 {
+			want = 1
+		}
+		if highs != want {
+			t.Fatalf("high watermark called %v times with %v queued, want %v", highs, i+1, want)
+		}
+	}
+	for i := 10; i > 0; i-- {
+		c.uncharge(<-c.chSend)
+		want := 0
+		if i-1 <= 2 {
+			want = 1
+		}
+		if lows != want {
+			t.Fatalf("low watermark called %v times with %v queued, want %v", lows, i-1, want)
+		}
+	}
+	if highs != 1 {
+		t.Fatalf("high watermark called %v times, want 1", highs)
+	}
+}
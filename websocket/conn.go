@@ -0,0 +1,255 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	maxControlLen = 125
+
+	closeNormal = 1000
+
+	closeTimeout = time.Second
+)
+
+// Conn is a websocket connection implementing net.Conn, arpc frames are carried by binary messages
+// and read as a stream of bytes, so one arpc frame could be split into or share websocket messages.
+// Each Write is sent as a binary message, that's what browser clients expect of arpc frames
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool
+
+	// reading state, only accessed by the reading goroutine
+	remain  int64
+	mask    [4]byte
+	masked  bool
+	maskPos int
+	closed  bool
+
+	wmux      sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read implements net.Conn, it reads payloads of data messages, control messages are handled
+// internally. It returns io.EOF after the peer closed the websocket connection
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for c.remain == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.reader.Read(b)
+	if c.masked {
+		c.unmask(b[:n])
+	}
+	c.remain -= int64(n)
+	if err == io.EOF && c.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Conn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads header of the next frame, control frames are consumed here
+func (c *Conn) nextFrame() error {
+	var head [14]byte
+	if _, err := io.ReadFull(c.reader, head[:2]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0F
+	// frames of clients must be masked and frames of servers must not
+	masked := head[1]&maskBit != 0
+	if masked == c.client {
+		return ErrProtocol
+	}
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, head[2:4]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, head[2:10]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(head[2:10]))
+		if length < 0 {
+			return ErrProtocol
+		}
+	}
+	c.masked, c.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remain = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlLen || head[0]&finBit == 0 {
+			return ErrProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		if masked {
+			c.unmask(payload)
+		}
+		switch opcode {
+		case opClose:
+			c.closed = true
+			// echo the close code, then the peer closes the underlying connection
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(opClose, payload)
+			return io.EOF
+		case opPing:
+			_, err := c.writeFrame(opPong, payload)
+			return err
+		}
+		return nil
+	default:
+		return ErrProtocol
+	}
+}
+
+// Write implements net.Conn, b is sent as a binary message
+func (c *Conn) Write(b []byte) (int, error) {
+	if _, err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) (int, error) {
+	headLen := 2
+	switch {
+	case len(payload) > 0xFFFF:
+		headLen += 8
+	case len(payload) > maxControlLen:
+		headLen += 2
+	}
+	if c.client {
+		headLen += 4
+	}
+	frame := make([]byte, headLen+len(payload))
+	frame[0] = finBit | opcode
+	switch {
+	case len(payload) > 0xFFFF:
+		frame[1] = 127
+		binary.BigEndian.PutUint64(frame[2:10], uint64(len(payload)))
+	case len(payload) > maxControlLen:
+		frame[1] = 126
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	default:
+		frame[1] = byte(len(payload))
+	}
+	copy(frame[headLen:], payload)
+	if c.client {
+		frame[1] |= maskBit
+		mask := frame[headLen-4 : headLen]
+		if _, err := rand.Read(mask); err != nil {
+			return 0, err
+		}
+		data := frame[headLen:]
+		for i := range data {
+			data[i] ^= mask[i&3]
+		}
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	return c.conn.Write(frame)
+}
+
+// Close sends a close message and closes the underlying connection
+func (c *Conn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		var code [2]byte
+		binary.BigEndian.PutUint16(code[:], closeNormal)
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrame(opClose, code[:])
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// LocalAddr implements net.Conn
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// UnderlyingConn returns the underlying connection, e.g. *net.TCPConn or *tls.Conn
+func (c *Conn) UnderlyingConn() net.Conn {
+	return c.conn
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, reader: reader, client: client}
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import "errors"
+
+var (
+	// ErrBadHandshake .
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+
+	// ErrBadOrigin .
+	ErrBadOrigin = errors.New("websocket: origin not allowed")
+
+	// ErrProtocol .
+	ErrProtocol = errors.New("websocket: protocol error")
+
+	// ErrClosed .
+	ErrClosed = errors.New("websocket: use of closed connection")
+)
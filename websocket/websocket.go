@@ -0,0 +1,340 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package websocket is a websocket transport of arpc, so browsers and clients behind proxies that
+// only allow HTTP could call the same routes of a server as tcp clients, e.g.
+//
+//	ln, _ := websocket.Listen(":8888", nil)
+//	http.HandleFunc("/ws", ln.(*websocket.Listener).Handler)
+//	go http.ListenAndServe(":8888", nil)
+//	server.Serve(ln)
+//	...
+//	client, _ := arpc.NewClient(func() (net.Conn, error) {
+//		return websocket.Dial("ws://localhost:8888/ws")
+//	})
+//
+// or with Transport, which serves the endpoint itself:
+//
+//	t := &websocket.Transport{Path: "/ws"}
+//	go server.RunTransport(t, ":8888")
+//	client, _ := arpc.NewClient(arpc.TransportDialer(t, "localhost:8888"))
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/log"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultHandshakeTimeout is the timeout of the handshake of Dial
+var DefaultHandshakeTimeout = time.Second * 10
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SameOrigin allows requests without the Origin header, i.e. not of browsers, and requests of
+// the Origin of the same host as the request. It's the origin check used if none is set, so pages
+// of other sites can't connect with cookies of users
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// AllowAllOrigins allows requests of all origins, it should only be used if connections are not
+// authenticated by cookies of browsers
+func AllowAllOrigins(r *http.Request) bool {
+	return true
+}
+
+// Upgrade upgrades the http request to a websocket connection, checkOrigin checks the Origin
+// header of the request, SameOrigin if it's nil
+func Upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool) (*Conn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, ErrBadHandshake.Error(), http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, ErrBadOrigin.Error(), http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, fmt.Errorf("%w: response is not a http.Hijacker", ErrBadHandshake)
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rsp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	// conn may still have the deadline of the http server
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(rsp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial dials a websocket connection of rawurl, e.g. "ws://localhost:8888/ws" or
+// "wss://localhost:8888/ws" with tls
+func Dial(rawurl string) (net.Conn, error) {
+	return DialTLS(rawurl, nil)
+}
+
+// DialTLS dials a websocket connection of rawurl with tlsConfig for wss
+func DialTLS(rawurl string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: DefaultHandshakeTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("%w: invalid scheme [%v]", ErrBadHandshake, u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func handshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(rsp.Header, "Upgrade", "websocket") ||
+		rsp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: %v", ErrBadHandshake, rsp.Status)
+	}
+	return newConn(conn, reader, true), nil
+}
+
+// Listener is a net.Listener accepting websocket connections upgraded by Handler, it should be
+// registered on a http server, conns are accepted after upgraded
+type Listener struct {
+	addr        net.Addr
+	checkOrigin func(r *http.Request) bool
+	chAccept    chan net.Conn
+	chClose     chan struct{}
+	closeOnce   sync.Once
+	onClose     func() error
+}
+
+// Listen returns Listener of addr, addr is only used as Addr of the Listener, Handler of the
+// Listener should be registered on a http server of addr. checkOrigin checks the Origin header of
+// requests, SameOrigin if it's nil, see Upgrade
+func Listen(addr string, checkOrigin func(r *http.Request) bool) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newListener(tcpAddr, checkOrigin), nil
+}
+
+// Handler upgrades requests of the endpoint to websocket connections accepted by the Listener
+func (l *Listener) Handler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.chClose:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	conn, err := Upgrade(w, r, l.checkOrigin)
+	if err != nil {
+		log.Debug("[websocket] %v upgrade failed: %v", r.RemoteAddr, err)
+		return
+	}
+	select {
+	case l.chAccept <- conn:
+	case <-l.chClose:
+		conn.Close()
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Handler(w, r)
+}
+
+// Accept implements net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.chAccept:
+		return conn, nil
+	case <-l.chClose:
+		return nil, ErrClosed
+	}
+}
+
+// Close implements net.Listener, requests are refused after closed
+func (l *Listener) Close() error {
+	err := ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.chClose)
+		err = nil
+		if l.onClose != nil {
+			err = l.onClose()
+		}
+	})
+	return err
+}
+
+// Addr implements net.Listener
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+func newListener(addr net.Addr, checkOrigin func(r *http.Request) bool) *Listener {
+	return &Listener{
+		addr:        addr,
+		checkOrigin: checkOrigin,
+		chAccept:    make(chan net.Conn),
+		chClose:     make(chan struct{}),
+	}
+}
+
+// Transport is a websocket arpc.Transport serving the endpoint of Path itself
+type Transport struct {
+	// Path of the endpoint, "/" by default
+	Path string
+	// TLSConfig enables wss if it's not nil, servers should have certificates configured
+	TLSConfig *tls.Config
+	// CheckOrigin checks the Origin header of requests, SameOrigin if nil, see AllowAllOrigins
+	CheckOrigin func(r *http.Request) bool
+}
+
+func (t *Transport) path() string {
+	if t.Path == "" {
+		return "/"
+	}
+	return t.Path
+}
+
+// Listen implements arpc.Transport, the endpoint is served until the Listener is closed
+func (t *Transport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLSConfig != nil {
+		ln = tls.NewListener(ln, t.TLSConfig)
+	}
+	l := newListener(ln.Addr(), t.CheckOrigin)
+	mux := http.NewServeMux()
+	mux.Handle(t.path(), l)
+	svr := &http.Server{Handler: mux}
+	l.onClose = svr.Close
+	go func() {
+		if err := svr.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error("[websocket] serve %v failed: %v", ln.Addr(), err)
+			l.Close()
+		}
+	}()
+	return l, nil
+}
+
+// Dial implements arpc.Transport, addr is the host of the endpoint, e.g. "localhost:8888"
+func (t *Transport) Dial(addr string) (net.Conn, error) {
+	scheme := "ws"
+	if t.TLSConfig != nil {
+		scheme = "wss"
+	}
+	return DialTLS((&url.URL{Scheme: scheme, Host: addr, Path: t.path()}).String(), t.TLSConfig)
+}
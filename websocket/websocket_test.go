@@ -0,0 +1,238 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket_test
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/websocket"
+)
+
+func newEchoServer() *arpc.Server {
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		ctx.Write(s)
+	})
+	svr.Handler.Handle("/notify", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		ctx.Client.Notify("/notified", s, time.Second)
+	})
+	return svr
+}
+
+var chNotified = make(chan string, 1)
+
+func init() {
+	arpc.DefaultHandler.Handle("/notified", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		chNotified <- s
+	})
+}
+
+func testClient(t *testing.T, c *arpc.Client) {
+	rsp := ""
+	if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want hello", rsp, err)
+	}
+
+	// larger than a 16-bit frame
+	big := strings.Repeat("a", 70000)
+	if err := c.Call("/echo", big, &rsp, time.Second); err != nil || rsp != big {
+		t.Fatalf("Client.Call() = (%v bytes, %v), want %v bytes", len(rsp), err, len(big))
+	}
+
+	chAsync := make(chan string, 1)
+	err := c.CallAsync("/echo", "async", func(ctx *arpc.Context) {
+		var s string
+		ctx.Bind(&s)
+		chAsync <- s
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	select {
+	case s := <-chAsync:
+		if s != "async" {
+			t.Fatalf("CallAsync response = %v, want async", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CallAsync timeout")
+	}
+
+	if err := c.Notify("/notify", "notify", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	select {
+	case s := <-chNotified:
+		if s != "notify" {
+			t.Fatalf("notified = %v, want notify", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("notify timeout")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tr := &websocket.Transport{Path: "/ws"}
+	ln, err := tr.Listen("localhost:0")
+	if err != nil {
+		t.Fatalf("Transport.Listen() error = %v", err)
+	}
+	svr := newEchoServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(arpc.TransportDialer(tr, ln.Addr().String()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	testClient(t, c)
+
+	// requests of other paths are not upgraded
+	if _, err := websocket.Dial("ws://" + ln.Addr().String() + "/other"); err == nil {
+		t.Fatalf("Dial() of other path error = nil")
+	}
+}
+
+func TestListener_Handler(t *testing.T) {
+	ln, err := websocket.Listen("localhost:0", func(r *http.Request) bool {
+		return r.Header.Get("Origin") == ""
+	})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	hs := httptest.NewServer(ln.(*websocket.Listener))
+	defer hs.Close()
+	svr := newEchoServer()
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return websocket.Dial(url)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	testClient(t, c)
+
+	// plain http requests are refused
+	rsp, err := http.Get(hs.URL)
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("http.Get() status = %v, want %v", rsp.StatusCode, http.StatusBadRequest)
+	}
+
+	// origins are checked
+	if status := upgradeStatus(t, hs.URL, "http://evil.example"); status != http.StatusForbidden {
+		t.Fatalf("upgrade status = %v, want %v", status, http.StatusForbidden)
+	}
+}
+
+// upgradeStatus returns status of the upgrade request of a browser of origin
+func upgradeStatus(t *testing.T, url string, origin string) int {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", origin)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Do() error = %v", err)
+	}
+	rsp.Body.Close()
+	return rsp.StatusCode
+}
+
+func TestListener_SameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		checkOrigin func(r *http.Request) bool
+		origin      string
+		want        int
+	}{
+		{nil, "http://evil.example", http.StatusForbidden},
+		{nil, "", http.StatusSwitchingProtocols},
+		{websocket.AllowAllOrigins, "http://evil.example", http.StatusSwitchingProtocols},
+	} {
+		ln, err := websocket.Listen("localhost:0", tc.checkOrigin)
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		hs := httptest.NewServer(ln.(*websocket.Listener))
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				conn.Close()
+			}
+		}()
+		origin := tc.origin
+		if origin == "" {
+			// the page of the same host
+			origin = hs.URL
+		}
+		if status := upgradeStatus(t, hs.URL, origin); status != tc.want {
+			t.Fatalf("upgrade status of origin %v = %v, want %v", origin, status, tc.want)
+		}
+		ln.Close()
+		hs.Close()
+	}
+}
+
+func TestConn_Ping(t *testing.T) {
+	ln, err := websocket.Listen("localhost:0", nil)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	hs := httptest.NewServer(ln.(*websocket.Listener))
+	defer hs.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+
+	conn, err := websocket.Dial("ws" + strings.TrimPrefix(hs.URL, "http"))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	// a masked ping frame, pong is answered by the reader of the server and skipped by the client
+	raw := conn.(*websocket.Conn).UnderlyingConn()
+	raw.Write([]byte{0x89, 0x80, 0, 0, 0, 0})
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Conn.Write() error = %v", err)
+	}
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte("hello")) {
+		t.Fatalf("Conn.Read() = (%q, %v), want hello", buf[:n], err)
+	}
+	// the server closes after echoed
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("Conn.Read() error = nil after closed by the server")
+	}
+}
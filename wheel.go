@@ -0,0 +1,224 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+const (
+	// DefaultWheelTick is the tick of TimerWheel by default
+	DefaultWheelTick = time.Millisecond * 10
+	// DefaultWheelSlots is the number of slots of TimerWheel by default
+	DefaultWheelSlots = 512
+)
+
+// TimerWheel is a Clock keeping timers in a hashed timing wheel shared by all calls, instead of a
+// runtime timer of each call. Timers fire no earlier than due and at most two ticks later, and
+// timers of calls are pooled, which cuts timer allocations and heap churn at high call rates.
+// Tickers are the tickers of package time. Set it by Handler.SetClock:
+//
+//	wheel := arpc.NewTimerWheel(arpc.DefaultWheelTick, arpc.DefaultWheelSlots)
+//	arpc.SetClock(wheel)
+type TimerWheel struct {
+	tick  time.Duration
+	mux   sync.Mutex
+	pos   int
+	slots []*wheelTimer
+	pool  sync.Pool
+
+	stopOnce sync.Once
+	chStop   chan util.Empty
+}
+
+type wheelTimer struct {
+	wheel      *TimerWheel
+	slot       int
+	rounds     int
+	active     bool
+	prev, next *wheelTimer
+	ch         chan time.Time
+	f          func()
+}
+
+// NewTimerWheel returns TimerWheel ticking every tick with slots, DefaultWheelTick and
+// DefaultWheelSlots if not positive, and starts ticking
+func NewTimerWheel(tick time.Duration, slots int) *TimerWheel {
+	if tick <= 0 {
+		tick = DefaultWheelTick
+	}
+	if slots <= 0 {
+		slots = DefaultWheelSlots
+	}
+	w := &TimerWheel{
+		tick:   tick,
+		slots:  make([]*wheelTimer, slots),
+		chStop: make(chan util.Empty),
+	}
+	w.pool.New = func() interface{} {
+		return &wheelTimer{wheel: w, ch: make(chan time.Time, 1)}
+	}
+	go util.Safe(w.run)
+	return w
+}
+
+// Now returns time.Now
+func (w *TimerWheel) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a timer of the wheel fired after d
+func (w *TimerWheel) NewTimer(d time.Duration) Timer {
+	t := w.pool.Get().(*wheelTimer)
+	w.mux.Lock()
+	w.schedule(t, d)
+	w.mux.Unlock()
+	return t
+}
+
+// AfterFunc calls f in its own goroutine after d
+func (w *TimerWheel) AfterFunc(d time.Duration, f func()) Timer {
+	t := w.pool.Get().(*wheelTimer)
+	t.f = f
+	w.mux.Lock()
+	w.schedule(t, d)
+	w.mux.Unlock()
+	return t
+}
+
+// NewTicker returns ticker of package time
+func (w *TimerWheel) NewTicker(d time.Duration) Ticker {
+	return SystemClock.NewTicker(d)
+}
+
+// Timers returns number of active timers
+func (w *TimerWheel) Timers() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	n := 0
+	for _, t := range w.slots {
+		for ; t != nil; t = t.next {
+			n++
+		}
+	}
+	return n
+}
+
+// Stop stops ticking, active timers would not fire
+func (w *TimerWheel) Stop() {
+	w.stopOnce.Do(func() { close(w.chStop) })
+}
+
+// schedule adds t to the slot of d, w.mux should be held. One more tick is counted since the
+// current tick is partly elapsed
+func (w *TimerWheel) schedule(t *wheelTimer, d time.Duration) {
+	ticks := 1
+	if d > 0 {
+		ticks += int((d + w.tick - 1) / w.tick)
+	}
+	n := len(w.slots)
+	t.slot, t.rounds, t.active = (w.pos+ticks)%n, (ticks-1)/n, true
+	t.prev, t.next = nil, w.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[t.slot] = t
+}
+
+// remove removes t from its slot, w.mux should be held
+func (w *TimerWheel) remove(t *wheelTimer) bool {
+	if !t.active {
+		return false
+	}
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next, t.active = nil, nil, false
+	return true
+}
+
+func (w *TimerWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	var funcs []func()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.mux.Lock()
+			w.pos = (w.pos + 1) % len(w.slots)
+			for t := w.slots[w.pos]; t != nil; {
+				next := t.next
+				if t.rounds > 0 {
+					t.rounds--
+				} else {
+					w.remove(t)
+					if t.f != nil {
+						funcs = append(funcs, t.f)
+					} else {
+						// sent with w.mux held, so timers stopped never receive the tick after reused
+						select {
+						case t.ch <- now:
+						default:
+						}
+					}
+				}
+				t = next
+			}
+			w.mux.Unlock()
+			for i, f := range funcs {
+				go f()
+				funcs[i] = nil
+			}
+			funcs = funcs[:0]
+		case <-w.chStop:
+			return
+		}
+	}
+}
+
+func (t *wheelTimer) C() <-chan time.Time {
+	if t.f != nil {
+		return nil
+	}
+	return t.ch
+}
+
+func (t *wheelTimer) Stop() bool {
+	t.wheel.mux.Lock()
+	defer t.wheel.mux.Unlock()
+	return t.wheel.remove(t)
+}
+
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	t.wheel.mux.Lock()
+	defer t.wheel.mux.Unlock()
+	active := t.wheel.remove(t)
+	t.wheel.schedule(t, d)
+	return active
+}
+
+// release returns t stopped to the pool of the wheel
+func (t *wheelTimer) release() {
+	t.wheel.mux.Lock()
+	active := t.active
+	t.wheel.mux.Unlock()
+	if active {
+		return
+	}
+	select {
+	case <-t.ch:
+	default:
+	}
+	t.f = nil
+	t.wheel.pool.Put(t)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	tick := time.Millisecond * 5
+	w := NewTimerWheel(tick, 4)
+	defer w.Stop()
+
+	// more ticks than slots go around the wheel
+	start := time.Now()
+	timer := w.NewTimer(tick * 10)
+	select {
+	case <-timer.C():
+		if cost := time.Since(start); cost < tick*10 {
+			t.Fatalf("timer fired after %v, want >= %v", cost, tick*10)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timer not fired")
+	}
+	if timer.Stop() {
+		t.Fatalf("Timer.Stop() = true after fired")
+	}
+	stopTimer(timer)
+
+	// a stopped timer is reused without the tick
+	timer = w.NewTimer(tick)
+	if !timer.Stop() {
+		t.Fatalf("Timer.Stop() = false before fired")
+	}
+	stopTimer(timer)
+	timer = w.NewTimer(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatalf("reused timer fired")
+	case <-time.After(tick * 4):
+	}
+	if timer.Reset(tick) != true {
+		t.Fatalf("Timer.Reset() = false of an active timer")
+	}
+	select {
+	case <-timer.C():
+	case <-time.After(time.Second):
+		t.Fatalf("timer reset not fired")
+	}
+
+	var called int32
+	w.AfterFunc(tick, func() { atomic.StoreInt32(&called, 1) })
+	stopped := w.AfterFunc(tick, func() { atomic.StoreInt32(&called, 2) })
+	stopped.Stop()
+	time.Sleep(tick * 6)
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("AfterFunc called = %v, want 1", called)
+	}
+	if n := w.Timers(); n != 0 {
+		t.Fatalf("TimerWheel.Timers() = %v, want 0", n)
+	}
+}
+
+func TestTimerWheel_Call(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/wheel/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/wheel/slow", func(ctx *Context) {
+		time.Sleep(time.Millisecond * 100)
+	}, true)
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	w := NewTimerWheel(time.Millisecond*5, 0)
+	defer w.Stop()
+	SetClock(w)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	})
+	SetClock(nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	for i := 0; i < 100; i++ {
+		rsp := ""
+		if err := c.Call("/wheel/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+			t.Fatalf("Client.Call() = (%v, %v), want hello", rsp, err)
+		}
+	}
+	if err := c.Call("/wheel/slow", nil, nil, time.Millisecond*20); err != ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if n := w.Timers(); n != 0 {
+		t.Fatalf("TimerWheel.Timers() = %v after calls, want 0", n)
+	}
+}
+
+func BenchmarkTimerWheel(b *testing.B) {
+	w := NewTimerWheel(DefaultWheelTick, DefaultWheelSlots)
+	defer w.Stop()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			stopTimer(w.NewTimer(time.Second))
+		}
+	})
+}
+
+func BenchmarkSystemTimer(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			stopTimer(SystemClock.NewTimer(time.Second))
+		}
+	})
+}
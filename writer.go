@@ -0,0 +1,86 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var writerPool sync.Pool
+
+// bufferedConn writes to the buffered writer of the conn
+type bufferedConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func newBufferedConn(conn net.Conn, size int) *bufferedConn {
+	w, _ := writerPool.Get().(*bufio.Writer)
+	if w == nil || w.Size() != size {
+		w = bufio.NewWriterSize(conn, size)
+	} else {
+		w.Reset(conn)
+	}
+	atomic.AddInt64(&writersInUse, 1)
+	return &bufferedConn{Conn: conn, w: w}
+}
+
+// lockWriter returns conn for sending, the buffered conn is locked until unlockWriter if size > 0
+func (c *Client) lockWriter(size int) net.Conn {
+	if size <= 0 {
+		return c.Conn
+	}
+	c.wmux.Lock()
+	if c.wconn == nil {
+		c.wconn = newBufferedConn(c.Conn, size)
+	} else if c.wconn.Conn != c.Conn {
+		// reconnected, data buffered for the closed conn is discarded
+		c.wconn.w.Reset(c.Conn)
+		c.wconn.Conn = c.Conn
+	}
+	return c.wconn
+}
+
+// unlockWriter flushes the buffered conn when the send queue is idle if flush interval is not set
+func (c *Client) unlockWriter(size int, err error) error {
+	if size <= 0 {
+		return err
+	}
+	if err == nil && c.Handler.FlushInterval() <= 0 && len(c.chSend) == 0 {
+		err = c.wconn.w.Flush()
+	}
+	c.wmux.Unlock()
+	return err
+}
+
+// releaseWriter puts the buffered writer back to the pool when send loop exits
+func (c *Client) releaseWriter() {
+	c.wmux.Lock()
+	if c.wconn != nil {
+		c.wconn.w.Reset(nil)
+		writerPool.Put(c.wconn.w)
+		atomic.AddInt64(&writersInUse, -1)
+		c.wconn = nil
+	}
+	c.wmux.Unlock()
+}
+
+// Flush writes data in the send buffer to the conn, messages still in the send queue are not
+// flushed, see Handler.SetSendBufferSize
+func (c *Client) Flush() error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.wconn == nil || c.wconn.w.Buffered() == 0 {
+		return nil
+	}
+	return c.wconn.w.Flush()
+}
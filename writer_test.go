@@ -0,0 +1,73 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestClient_Flush(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	received := make(chan struct{}, 4)
+	svr := NewServer()
+	svr.Handler.Handle("/flush/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/flush/notify", func(ctx *Context) {
+		received <- struct{}{}
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	dial := func(h Handler) *Client {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		return newClientWithConn(conn, codec.DefaultCodec, h, nil)
+	}
+
+	// flushed when the send queue is idle
+	h := DefaultHandler.Clone()
+	h.SetBatchSend(true)
+	h.SetSendBufferSize(4096)
+	c := dial(h)
+	defer c.Stop()
+	rsp := ""
+	if err = c.Call("/flush/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = (%v, %v), want (hello, nil)", rsp, err)
+	}
+
+	// flushed explicitly before the interval
+	h = DefaultHandler.Clone()
+	h.SetBatchSend(true)
+	h.SetSendBufferSize(4096)
+	h.SetFlushInterval(time.Hour)
+	c2 := dial(h)
+	defer c2.Stop()
+	if err = c2.Notify("/flush/notify", "hello", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	select {
+	case <-received:
+		t.Fatalf("notify received before flushed")
+	case <-time.After(time.Millisecond * 50):
+	}
+	if err = c2.Flush(); err != nil {
+		t.Fatalf("Client.Flush() error = %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("notify not received after flushed")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/util"
+)
+
+// framePool recycles messages of NotifyBytes after they are written by the send loops
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{pooled: true}
+	},
+}
+
+// fill sets m as a frame of cmd with method and data, the buffer of m is reused if it's large enough
+func (m *Message) fill(cmd byte, method string, data []byte, isAsync bool, seq uint64) {
+	size := HeadLen + len(method) + len(data)
+	if cap(m.Buffer) < size {
+		m.Buffer = make([]byte, size)
+	} else {
+		m.Buffer = m.Buffer[:size]
+		for i := 0; i < HeadLen; i++ {
+			m.Buffer[i] = 0
+		}
+	}
+	m.Values = nil
+	m.SetCmd(cmd)
+	m.SetAsync(isAsync)
+	m.SetMethodLen(len(method))
+	m.SetBodyLen(len(method) + len(data))
+	m.SetSeq(seq)
+	copy(m.Buffer[HeadLen:], method)
+	copy(m.Buffer[HeadLen+len(method):], data)
+}
+
+// written is called by the send loops after m is written or dropped, the buffer of m is not
+// referenced by arpc after
+func (m *Message) written() {
+	if m.pooled {
+		m.Values = nil
+		framePool.Put(m)
+		return
+	}
+	if m.sent != nil {
+		select {
+		case m.sent <- util.Empty{}:
+		default:
+		}
+	}
+}
+
+// NotifyBytes makes rpc notify of data as Notify, without allocation in steady state: the frame is
+// built in a pooled buffer recycled after it's written, and data is not referenced after it returns,
+// so callers could reuse their buffers. Timeouts other than TimeZero and TimeForever, metadata
+// such as request ids and labels, and coders still allocate
+func (c *Client) NotifyBytes(method string, data []byte, timeout time.Duration) error {
+	if err := c.checkNotifyArgs(method, timeout); err != nil {
+		return err
+	}
+	msg := framePool.Get().(*Message)
+	msg.fill(CmdNotify, method, data, true, atomic.AddUint64(&c.seq, 1))
+	if err := c.setOutgoingMeta(msg); err != nil {
+		msg.written()
+		return err
+	}
+	if err := c.PushMsg(msg, timeout); err != nil {
+		msg.written()
+		return err
+	}
+	return nil
+}
+
+// CallContext is a reusable context of calls of a client, it keeps the request buffer, the session
+// and the timer between calls, so sending calls of it doesn't allocate in steady state. Responses
+// are still received into new messages, see Allocator to reduce those. It's not safe for concurrent
+// use, e.g. each goroutine of a worker pool could own one
+type CallContext struct {
+	c     *Client
+	msg   Message
+	sess  rpcSession
+	timer Timer
+	// queued is set if msg was queued, its buffer is reused after the send loop wrote it
+	queued bool
+}
+
+// NewCallContext returns a reusable CallContext of c
+func (c *Client) NewCallContext() *CallContext {
+	cc := &CallContext{c: c}
+	cc.msg.sent = make(chan util.Empty, 1)
+	cc.sess.done = make(chan *Message, 1)
+	return cc
+}
+
+// Call makes rpc call with timeout as Client.Call, req is not referenced after it returns
+func (cc *CallContext) Call(method string, req []byte, rsp interface{}, timeout time.Duration) (err error) {
+	c := cc.c
+	defer c.statCall(&err)
+
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return err
+	}
+	if timeout < 0 {
+		timeout = TimeForever
+	}
+	if !cc.reuse() {
+		return ErrClientStopped
+	}
+
+	msg := &cc.msg
+	msg.fill(CmdRequest, method, req, false, atomic.AddUint64(&c.seq, 1))
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	cc.sess.seq = msg.Seq()
+	if cc.timer == nil {
+		cc.timer = c.Handler.Clock().NewTimer(timeout)
+	} else {
+		select {
+		case <-cc.timer.C():
+		default:
+		}
+		cc.timer.Reset(timeout)
+	}
+	ret, queued, err := c.callWith(msg, &cc.sess, cc.timer)
+	cc.timer.Stop()
+	cc.queued = queued
+	if err != nil {
+		return err
+	}
+	return c.parseResponse(ret, rsp)
+}
+
+// Notify makes rpc notify with timeout as Client.Notify, data is not referenced after it returns
+func (cc *CallContext) Notify(method string, data []byte, timeout time.Duration) error {
+	c := cc.c
+	if err := c.checkNotifyArgs(method, timeout); err != nil {
+		return err
+	}
+	if !cc.reuse() {
+		return ErrClientStopped
+	}
+
+	msg := &cc.msg
+	msg.fill(CmdNotify, method, data, true, atomic.AddUint64(&c.seq, 1))
+	if err := c.setOutgoingMeta(msg); err != nil {
+		return err
+	}
+	if err := c.PushMsg(msg, timeout); err != nil {
+		return err
+	}
+	cc.queued = true
+	return nil
+}
+
+// reuse waits for the previous message to be written before its buffer is reused, drops the
+// response of a previous call timed out and renews the session closed for reconnecting, it
+// returns false if the client is stopped
+func (cc *CallContext) reuse() bool {
+	if cc.queued {
+		select {
+		case <-cc.msg.sent:
+		case <-cc.c.chClose:
+			return false
+		}
+		cc.queued = false
+	}
+	select {
+	case m, ok := <-cc.sess.done:
+		if !ok {
+			cc.sess.done = make(chan *Message, 1)
+		} else if m != nil {
+			m.Release()
+		}
+	default:
+	}
+	return true
+}
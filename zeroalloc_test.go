@@ -0,0 +1,118 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/codec"
+)
+
+func TestClient_NotifyBytes(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	const n = 100
+	received := make(chan string, n*2)
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/notify", func(ctx *Context) {
+		received <- string(ctx.Body())
+	})
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		if string(ctx.Body()) == "slow" {
+			time.Sleep(time.Millisecond * 50)
+		}
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c := newClientWithConn(conn, codec.DefaultCodec, NewHandler(), nil)
+	defer c.Stop()
+
+	// the caller's buffer is reused for each notify
+	buf := make([]byte, 0, 16)
+	for i := 0; i < n; i++ {
+		buf = append(buf[:0], fmt.Sprintf("bytes-%v", i)...)
+		if err := c.NotifyBytes("/notify", buf, TimeForever); err != nil {
+			t.Fatalf("Client.NotifyBytes() error = %v", err)
+		}
+	}
+	cc := c.NewCallContext()
+	for i := 0; i < n; i++ {
+		buf = append(buf[:0], fmt.Sprintf("ctx-%v", i)...)
+		if err := cc.Notify("/notify", buf, TimeForever); err != nil {
+			t.Fatalf("CallContext.Notify() error = %v", err)
+		}
+	}
+	for i := 0; i < n*2; i++ {
+		want := fmt.Sprintf("bytes-%v", i)
+		if i >= n {
+			want = fmt.Sprintf("ctx-%v", i-n)
+		}
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("notify %v received %q, want %q", i, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notify %v not received", i)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		rsp := ""
+		buf = append(buf[:0], fmt.Sprintf("call-%v", i)...)
+		if err := cc.Call("/echo", buf, &rsp, time.Second); err != nil || rsp != string(buf) {
+			t.Fatalf("CallContext.Call() = (%q, %v), want %q", rsp, err, buf)
+		}
+	}
+	// the late response of a call timed out is dropped by the next call
+	if err := cc.Call("/echo", []byte("slow"), nil, time.Millisecond*10); err != ErrClientTimeout {
+		t.Fatalf("CallContext.Call() error = %v, want %v", err, ErrClientTimeout)
+	}
+	time.Sleep(time.Millisecond * 100)
+	rsp := ""
+	if err := cc.Call("/echo", []byte("fast"), &rsp, time.Second); err != nil || rsp != "fast" {
+		t.Fatalf("CallContext.Call() = (%q, %v), want %q", rsp, err, "fast")
+	}
+
+	// labels are not dropped silently, calls fail if metadata has no room for them
+	large, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	}, WithHandler(NewHandler()), WithLabels(map[string]string{"tenant": strings.Repeat("a", MaxMetaLen-len("tenant="))}))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer large.Stop()
+	if err := large.NotifyBytes("/notify", buf, TimeForever); err != ErrMetaTooLarge {
+		t.Fatalf("Client.NotifyBytes() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+	lcc := large.NewCallContext()
+	if err := lcc.Call("/echo", buf, nil, time.Second); err != ErrMetaTooLarge {
+		t.Fatalf("CallContext.Call() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+	if err := lcc.Notify("/notify", buf, TimeForever); err != ErrMetaTooLarge {
+		t.Fatalf("CallContext.Notify() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+
+	c.Stop()
+	if err := c.NotifyBytes("/notify", buf, TimeZero); err != ErrClientStopped {
+		t.Fatalf("Client.NotifyBytes() error = %v, want %v", err, ErrClientStopped)
+	}
+	if err := cc.Call("/echo", buf, nil, time.Second); err != ErrClientStopped {
+		t.Fatalf("CallContext.Call() error = %v, want %v", err, ErrClientStopped)
+	}
+}